@@ -0,0 +1,417 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+	"github.com/vmihailenco/msgpack"
+)
+
+// merkleKey is the version of a key in a mismatched leaf.
+type merkleKey struct {
+	DMap      string
+	Key       string
+	HKey      uint64
+	TTL       int64
+	Timestamp int64
+}
+
+// syncRequest sends a request to the backup owner in a sync and counts the transferred bytes.
+type syncRequest func(opcode protocol.OpCode, req *protocol.Message) (*protocol.Message, error)
+
+// merkleID identifies a key on a partition.
+type merkleID struct {
+	dmap string
+	hkey uint64
+}
+
+// buildMerkleTree builds the Merkle tree of a partition. The expired keys are ignored.
+func buildMerkleTree(part *partition) (*merkleTree, error) {
+	t := newMerkleTree()
+	var err error
+	part.m.Range(func(name, tmp interface{}) bool {
+		dm := tmp.(*dmap)
+		dm.Lock()
+		err = dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+			if !isKeyExpired(vdata.TTL) {
+				t.add(name.(string), hkey, vdata)
+			}
+			return true
+		})
+		dm.Unlock()
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.build()
+	return t, nil
+}
+
+// merkleKeys returns the versions of the keys in the given leaves of a partition.
+func merkleKeys(part *partition, leaves []uint32) ([]merkleKey, error) {
+	set := make(map[uint32]struct{}, len(leaves))
+	for _, leaf := range leaves {
+		set[leaf] = struct{}{}
+	}
+	var keys []merkleKey
+	var err error
+	part.m.Range(func(name, tmp interface{}) bool {
+		dm := tmp.(*dmap)
+		dm.Lock()
+		err = dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+			if _, ok := set[merkleLeaf(hkey)]; !ok || isKeyExpired(vdata.TTL) {
+				return true
+			}
+			keys = append(keys, merkleKey{
+				DMap:      name.(string),
+				Key:       vdata.Key,
+				HKey:      hkey,
+				TTL:       vdata.TTL,
+				Timestamp: vdata.Timestamp,
+			})
+			return true
+		})
+		dm.Unlock()
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (db *Olric) antiEntropyAtBackground() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.config.AntiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-ticker.C:
+			for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+				select {
+				case <-db.ctx.Done():
+					return
+				default:
+				}
+				db.syncPartition(partID)
+			}
+		}
+	}
+}
+
+// syncPartition compares the partition with its backups and repairs the divergent replicas, if this
+// node is the primary owner. The backups are compared level by level, only the mismatched subtrees
+// are requested and only the keys in the mismatched leaves are compared.
+func (db *Olric) syncPartition(partID uint64) {
+	part := db.partitions[partID]
+	part.RLock()
+	if len(part.owners) == 0 || !hostCmp(part.owners[len(part.owners)-1], db.this) {
+		part.RUnlock()
+		return
+	}
+	part.RUnlock()
+
+	memCount := db.discovery.numMembers()
+	backupCount := calcMaxBackupCount(db.config.BackupCount, memCount)
+	if backupCount == 0 {
+		return
+	}
+	bpart := db.backups[partID]
+	bpart.RLock()
+	backups := append([]host{}, bpart.owners...)
+	bpart.RUnlock()
+	if len(backups) > backupCount {
+		backups = backups[len(backups)-backupCount:]
+	}
+
+	tree, err := buildMerkleTree(part)
+	if err != nil {
+		db.log.Printf("[ERROR] Failed to build the Merkle tree of PartID: %d: %v", partID, err)
+		return
+	}
+	synced := true
+	for _, backup := range backups {
+		transferred, err := db.syncBackup(part, tree, backup)
+		atomic.AddUint64(&part.syncedBytes, transferred)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to sync PartID: %d with %s: %v", partID, backup, err)
+			synced = false
+		}
+	}
+	if synced {
+		atomic.StoreInt64(&part.lastSync, time.Now().UnixNano())
+	}
+}
+
+// syncBackup repairs the backup of a partition on the given owner. It returns the number of bytes
+// transferred in both directions.
+func (db *Olric) syncBackup(part *partition, tree *merkleTree, owner host) (uint64, error) {
+	var transferred uint64
+	var request syncRequest = func(opcode protocol.OpCode, req *protocol.Message) (*protocol.Message, error) {
+		transferred += uint64(len(req.Value))
+		resp, err := db.requestTo(owner.String(), opcode, req)
+		if err != nil {
+			return nil, err
+		}
+		transferred += uint64(len(resp.Value))
+		return resp, nil
+	}
+
+	resp, err := request(protocol.OpMerkleRoot, &protocol.Message{
+		Extra: protocol.MerkleExtra{PartID: part.id},
+	})
+	if err != nil {
+		return transferred, err
+	}
+	var root uint64
+	if err = msgpack.Unmarshal(resp.Value, &root); err != nil {
+		return transferred, err
+	}
+	if root == tree.root() {
+		return transferred, nil
+	}
+
+	nodes := []uint32{0}
+	for level := 0; level < merkleDepth && len(nodes) != 0; level++ {
+		value, err := msgpack.Marshal(nodes)
+		if err != nil {
+			return transferred, err
+		}
+		resp, err = request(protocol.OpMerkleSubtree, &protocol.Message{
+			Extra: protocol.MerkleExtra{PartID: part.id, Level: uint8(level)},
+			Value: value,
+		})
+		if err != nil {
+			return transferred, err
+		}
+		var hashes []uint64
+		if err = msgpack.Unmarshal(resp.Value, &hashes); err != nil {
+			return transferred, err
+		}
+		nodes, err = tree.diff(level, nodes, hashes)
+		if err != nil {
+			return transferred, err
+		}
+	}
+	if len(nodes) == 0 {
+		return transferred, nil
+	}
+
+	value, err := msgpack.Marshal(nodes)
+	if err != nil {
+		return transferred, err
+	}
+	resp, err = request(protocol.OpMerkleKeys, &protocol.Message{
+		Extra: protocol.MerkleExtra{PartID: part.id},
+		Value: value,
+	})
+	if err != nil {
+		return transferred, err
+	}
+	var keys []merkleKey
+	if err = msgpack.Unmarshal(resp.Value, &keys); err != nil {
+		return transferred, err
+	}
+	remote := make(map[merkleID]merkleKey, len(keys))
+	for _, k := range keys {
+		remote[merkleID{dmap: k.DMap, hkey: k.HKey}] = k
+	}
+
+	locals, err := merkleKeys(part, nodes)
+	if err != nil {
+		return transferred, err
+	}
+	for _, local := range locals {
+		id := merkleID{dmap: local.DMap, hkey: local.HKey}
+		theirs, ok := remote[id]
+		delete(remote, id)
+		switch {
+		case !ok, theirs.Timestamp < local.Timestamp, theirs.Timestamp == local.Timestamp && theirs.TTL != local.TTL:
+			err = db.pushToBackup(part, local, request)
+		case theirs.Timestamp > local.Timestamp:
+			err = db.pullFromBackup(part, theirs, request)
+		}
+		if err != nil {
+			return transferred, err
+		}
+	}
+	// The primary owner doesn't have these keys anymore.
+	for _, theirs := range remote {
+		_, err = request(protocol.OpDeleteBackup, &protocol.Message{
+			DMap: theirs.DMap,
+			Key:  theirs.Key,
+		})
+		if err != nil {
+			return transferred, err
+		}
+	}
+	return transferred, nil
+}
+
+func (db *Olric) pushToBackup(part *partition, k merkleKey, request syncRequest) error {
+	tmp, ok := part.m.Load(k.DMap)
+	if !ok {
+		return nil
+	}
+	dm := tmp.(*dmap)
+	dm.Lock()
+	vdata, err := dm.str.Get(k.HKey)
+	if err == nil {
+		// The value points to the storage, copy it before releasing the lock.
+		vdata.Value = append([]byte(nil), vdata.Value...)
+	}
+	dm.Unlock()
+	if err == storage.ErrKeyNotFound {
+		// It has been deleted after the comparison. The backup follows the primary owner.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = request(protocol.OpPutBackup, &protocol.Message{
+		DMap:  k.DMap,
+		Key:   k.Key,
+		Extra: protocol.PutBackupExtra{TTL: vdata.TTL, Timestamp: vdata.Timestamp},
+		Value: vdata.Value,
+	})
+	return err
+}
+
+func (db *Olric) pullFromBackup(part *partition, k merkleKey, request syncRequest) error {
+	tmp, ok := part.m.Load(k.DMap)
+	if !ok {
+		return nil
+	}
+	dm := tmp.(*dmap)
+	resp, err := request(protocol.OpGetBackup, &protocol.Message{
+		DMap: k.DMap,
+		Key:  k.Key,
+	})
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	extra, ok := resp.Extra.(protocol.GetExExtra)
+	if !ok {
+		return fmt.Errorf("invalid response: no version")
+	}
+	vdata := &storage.VData{
+		Key:       k.Key,
+		TTL:       extra.TTL,
+		Timestamp: extra.Timestamp,
+		Value:     resp.Value,
+	}
+	db.clock.update(vdata.Timestamp)
+
+	dm.Lock()
+	defer dm.Unlock()
+	current, err := dm.str.Get(k.HKey)
+	if err == nil && current.Timestamp >= vdata.Timestamp {
+		return nil
+	}
+	if dm.isDeleted(k.HKey, vdata.Timestamp) {
+		// The backup has missed the delete, syncBackup deletes it in the next round.
+		return nil
+	}
+	return db.putEntry(dm, k.DMap, k.HKey, vdata)
+}
+
+func (db *Olric) merkleBackupPartition(req *protocol.Message) (protocol.MerkleExtra, *partition, error) {
+	extra, ok := req.Extra.(protocol.MerkleExtra)
+	if !ok {
+		return extra, nil, ErrInvalidArgument
+	}
+	if extra.PartID >= db.config.PartitionCount {
+		return extra, nil, fmt.Errorf("invalid PartID: %d", extra.PartID)
+	}
+	return extra, db.backups[extra.PartID], nil
+}
+
+func (db *Olric) merkleRootOperation(req *protocol.Message) *protocol.Message {
+	_, part, err := db.merkleBackupPartition(req)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	tree, err := buildMerkleTree(part)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	value, err := msgpack.Marshal(tree.root())
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = value
+	return resp
+}
+
+func (db *Olric) merkleSubtreeOperation(req *protocol.Message) *protocol.Message {
+	extra, part, err := db.merkleBackupPartition(req)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	var nodes []uint32
+	if err = msgpack.Unmarshal(req.Value, &nodes); err != nil {
+		return errorResponse(req, err)
+	}
+	tree, err := buildMerkleTree(part)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	hashes, err := tree.children(int(extra.Level), nodes)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	value, err := msgpack.Marshal(hashes)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = value
+	return resp
+}
+
+func (db *Olric) merkleKeysOperation(req *protocol.Message) *protocol.Message {
+	_, part, err := db.merkleBackupPartition(req)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	var leaves []uint32
+	if err = msgpack.Unmarshal(req.Value, &leaves); err != nil {
+		return errorResponse(req, err)
+	}
+	keys, err := merkleKeys(part, leaves)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	value, err := msgpack.Marshal(keys)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = value
+	return resp
+}
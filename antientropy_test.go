@@ -0,0 +1,172 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+func TestOlric_AntiEntropy(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "mymap"
+	dm := db1.NewDMap(mname)
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// replicas returns the stored entries of the key on the primary and the backup owner.
+	replicas := func(key string) (*storage.Storage, *storage.Storage, uint64) {
+		owner, hkey, err := db1.locateKey(mname, key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		primary, backup := db1, db2
+		if !hostCmp(owner, db1.this) {
+			primary, backup = db2, db1
+		}
+		partID := db1.getPartitionID(hkey)
+		p, ok := primary.partitions[partID].m.Load(mname)
+		if !ok {
+			t.Fatalf("%s could not be found on the primary owner", mname)
+		}
+		b, ok := backup.backups[partID].m.Load(mname)
+		if !ok {
+			t.Fatalf("%s could not be found on the backup owner", mname)
+		}
+		return p.(*dmap).str, b.(*dmap).str, hkey
+	}
+
+	// The backup owner missed a write.
+	_, bstr, hkey := replicas(bkey(0))
+	err = bstr.Delete(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The backup owner has a stale version.
+	_, bstr, hkey = replicas(bkey(1))
+	vdata, err := bstr.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = bstr.Put(hkey, &storage.VData{Key: vdata.Key, Timestamp: vdata.Timestamp - 1, Value: []byte("stale")})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The backup owner missed a delete.
+	pstr, _, hkey := replicas(bkey(2))
+	err = pstr.Delete(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The backup owner has a newer version.
+	_, bstr, hkey = replicas(bkey(3))
+	vdata, err = bstr.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	newer := []byte("newer")
+	err = bstr.Put(hkey, &storage.VData{Key: vdata.Key, Timestamp: vdata.Timestamp + 1, Value: newer})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	for _, db := range []*Olric{db1, db2} {
+		for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+			db.syncPartition(partID)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		pstr, bstr, hkey := replicas(bkey(i))
+		pvdata, perr := pstr.Get(hkey)
+		bvdata, berr := bstr.Get(hkey)
+		if i == 2 {
+			if perr != storage.ErrKeyNotFound || berr != storage.ErrKeyNotFound {
+				t.Fatalf("Expected storage.ErrKeyNotFound. Got: %v, %v", perr, berr)
+			}
+			continue
+		}
+		if perr != nil || berr != nil {
+			t.Fatalf("Expected nil. Got: %v, %v", perr, berr)
+		}
+		if !bytes.Equal(pvdata.Value, bvdata.Value) || pvdata.Timestamp != bvdata.Timestamp {
+			t.Fatalf("Replicas of %s are divergent", bkey(i))
+		}
+		if i == 3 && !bytes.Equal(pvdata.Value, newer) {
+			t.Fatalf("Expected the newer version. Got: %s", pvdata.Value)
+		}
+	}
+
+	var synced int
+	for _, db := range []*Olric{db1, db2} {
+		// The backups of the partitions are on the other node.
+		other := db2
+		if db == db2 {
+			other = db1
+		}
+		for partID, st := range db.Stats().AntiEntropy {
+			synced++
+			if st.LastSync.IsZero() || st.BytesTransferred == 0 {
+				t.Fatalf("Expected anti-entropy stats for PartID: %d. Got: %v", partID, st)
+			}
+			primary, err := buildMerkleTree(db.partitions[partID])
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			backup, err := buildMerkleTree(other.backups[partID])
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			if primary.root() != backup.root() {
+				t.Fatalf("Expected the same Merkle tree on the backup of PartID: %d", partID)
+			}
+		}
+	}
+	if synced != int(db1.config.PartitionCount) {
+		t.Fatalf("Expected %d synced partitions. Got: %d", db1.config.PartitionCount, synced)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// OpCode is an operation of Olric Binary Protocol. Its String method returns the name of the operation,
+// i.e. ExPut, ExGet or ExDestroy for the requests of the clients and PutBackup or DestroyDMap for
+// the requests of the other nodes.
+type OpCode = protocol.OpCode
+
+// Authorizer is the interface to restrict the operations. Authorize is called before every request
+// received by this node is handled, including the requests of the other nodes in the cluster. The
+// request is denied with ErrForbidden if it returns an error. conn is the connection of the request.
+// It must be safe for concurrent use.
+type Authorizer interface {
+	Authorize(op OpCode, dmap, key string, conn net.Conn) error
+}
+
+// NopAuthorizer allows every request. It's the default Authorizer.
+type NopAuthorizer struct{}
+
+// Authorize always returns nil.
+func (NopAuthorizer) Authorize(op OpCode, dmap, key string, conn net.Conn) error {
+	return nil
+}
+
+// Authenticator is the interface to plug a credential store. Authenticate is called with the credential
+// of a new connection, the connection is authenticated if it returns nil. The connections which are not
+// authenticated within AuthTimeout are dropped. It must be safe for concurrent use.
+type Authenticator interface {
+	Authenticate(credential []byte, conn net.Conn) error
+}
+
+// SecretAuthenticator authenticates the connections which present the shared secret.
+type SecretAuthenticator struct {
+	secret []byte
+}
+
+// NewSecretAuthenticator returns a new SecretAuthenticator with the given secret. Set the same secret
+// as Credential, so the nodes can authenticate to each other.
+func NewSecretAuthenticator(secret []byte) *SecretAuthenticator {
+	return &SecretAuthenticator{secret: secret}
+}
+
+// Authenticate compares the credential with the secret in constant time.
+func (a *SecretAuthenticator) Authenticate(credential []byte, conn net.Conn) error {
+	if subtle.ConstantTimeCompare(credential, a.secret) != 1 {
+		return errors.New("invalid credential")
+	}
+	return nil
+}
+
+// authenticateConn calls the Authenticator of the config for the given credential.
+func (db *Olric) authenticateConn(credential []byte, conn net.Conn) error {
+	return db.config.Authenticator.Authenticate(credential, conn)
+}
+
+// authorizeRequest calls the Authorizer of the config for the given request.
+func (db *Olric) authorizeRequest(req *protocol.Message, conn net.Conn) error {
+	return db.config.Authorizer.Authorize(req.Op, req.DMap, req.Key, conn)
+}
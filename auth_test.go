@@ -0,0 +1,198 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/transport"
+)
+
+// testAuthorizer denies ExDestroy and the keys starting with "secret".
+type testAuthorizer struct{}
+
+func (testAuthorizer) Authorize(op OpCode, dmap, key string, conn net.Conn) error {
+	if conn == nil {
+		return errors.New("no connection")
+	}
+	if op == protocol.OpExDestroy {
+		return errors.New("destroy is not allowed")
+	}
+	if len(key) >= 6 && key[:6] == "secret" {
+		return errors.New("secret keys are not allowed")
+	}
+	return nil
+}
+
+func TestAuthorizer(t *testing.T) {
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.Authorizer = testAuthorizer{}
+	db, err := startTestOlric(cfg)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	addr := db.this.String()
+	value, err := db.serializer.Marshal("myvalue")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = db.requestTo(addr, protocol.OpExPut, &protocol.Message{DMap: "mymap", Key: "mykey", Value: value})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = db.requestTo(addr, protocol.OpExPut, &protocol.Message{DMap: "mymap", Key: "secret-key", Value: value})
+	if err != ErrForbidden {
+		t.Fatalf("Expected ErrForbidden. Got: %v", err)
+	}
+	_, err = db.requestTo(addr, protocol.OpExDestroy, &protocol.Message{DMap: "mymap"})
+	if err != ErrForbidden {
+		t.Fatalf("Expected ErrForbidden. Got: %v", err)
+	}
+	// The denied requests are not applied.
+	_, err = db.NewDMap("mymap").Get("secret-key")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+	_, err = db.NewDMap("mymap").Get("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func newOlricWithAuth(peers []string, secret []byte) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Authenticator = NewSecretAuthenticator(secret)
+	cfg.Credential = secret
+	cfg.AuthTimeout = 200 * time.Millisecond
+	return startTestOlric(cfg)
+}
+
+func TestAuthenticator(t *testing.T) {
+	secret := []byte("s3cret")
+	db1, err := newOlricWithAuth(nil, secret)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithAuth(peers, secret)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	// The nodes authenticate to each other with their credentials.
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	addr := db1.this.String()
+	req := &protocol.Message{DMap: "mymap", Key: bkey(0)}
+	c := transport.NewClient(&transport.ClientConfig{DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+	resp, err := c.RequestTo(addr, protocol.OpExGet, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusUnauthorized {
+		t.Fatalf("Expected StatusUnauthorized. Got: %d", resp.Status)
+	}
+
+	wrong := transport.NewClient(&transport.ClientConfig{DialTimeout: time.Second, MaxConn: 1, Credential: []byte("wrong")})
+	defer wrong.Close()
+	_, err = wrong.RequestTo(addr, protocol.OpExGet, req)
+	if err != ErrUnauthorized {
+		t.Fatalf("Expected ErrUnauthorized. Got: %v", err)
+	}
+
+	valid := transport.NewClient(&transport.ClientConfig{DialTimeout: time.Second, MaxConn: 1, Credential: secret})
+	defer valid.Close()
+	resp, err = valid.RequestTo(addr, protocol.OpExGet, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("Expected StatusOK. Got: %d", resp.Status)
+	}
+	// The deadline is cleared after the authentication.
+	<-time.After(300 * time.Millisecond)
+	_, err = valid.RequestTo(addr, protocol.OpExGet, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestAuthenticator_Timeout(t *testing.T) {
+	db, err := newOlricWithAuth(nil, []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", db.this.String())
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer conn.Close()
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// The unauthenticated connection is dropped after AuthTimeout.
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF. Got: %v", err)
+	}
+}
@@ -16,26 +16,137 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/buraksezer/olric"
 	"github.com/buraksezer/olric/internal/protocol"
 	"github.com/buraksezer/olric/internal/transport"
+	"github.com/vmihailenco/msgpack"
 )
 
+const (
+	// DefaultMaxAttempts is the default maximum number of attempts of a request.
+	DefaultMaxAttempts = 3
+
+	// DefaultRetryBackoff is the default delay before the first retry of a request.
+	DefaultRetryBackoff = 100 * time.Millisecond
+
+	// DefaultMaxRetryBackoff is the default maximum delay between two attempts of a request.
+	DefaultMaxRetryBackoff = time.Second
+
+	// DefaultBreakerCooldown is the default time that the circuit breaker of a node stays open.
+	DefaultBreakerCooldown = 5 * time.Second
+)
+
+// BreakerState is the state of the circuit breaker of a node.
+type BreakerState = transport.BreakerState
+
+const (
+	// BreakerClosed lets the requests pass.
+	BreakerClosed = transport.BreakerClosed
+
+	// BreakerOpen fails the requests with ErrPeerUnavailable.
+	BreakerOpen = transport.BreakerOpen
+
+	// BreakerHalfOpen lets a probe request pass.
+	BreakerHalfOpen = transport.BreakerHalfOpen
+)
+
+// ErrPeerUnavailable is returned when the circuit breaker of the node is open.
+var ErrPeerUnavailable = transport.ErrPeerUnavailable
+
 // Client implements Go client of Olric Binary Protocol and its methods.
 type Client struct {
 	client     *transport.Client
 	serializer olric.Serializer
+	addrs      []string
+	routing    *routingTable
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
 }
 
 // Config includes configuration parameters for the Client.
 type Config struct {
 	Addrs       []string
 	DialTimeout time.Duration
-	KeepAlive   time.Duration
-	MaxConn     int
+
+	// KeepAlive is the period of the TCP keepalive probes. Zero means the default of the net package,
+	// 15 seconds, a negative value disables the probes.
+	KeepAlive time.Duration
+
+	// DisableNoDelay enables the Nagle algorithm on the connections. TCP_NODELAY is set by default.
+	DisableNoDelay bool
+
+	// MinConn is the number of connections dialed to a node when the client connects to it first.
+	MinConn int
+
+	// MaxConn is the maximum number of idle connections kept for a node. It's 1, by default.
+	MaxConn int
+
+	// IdleTimeout closes the connections which stayed idle longer than it. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxAttempts is the maximum number of attempts of a request which fails with a network error,
+	// i.e. the node is restarted or left the cluster. It's DefaultMaxAttempts, by default.
+	// Set it to 1 to disable retries.
+	MaxAttempts int
+
+	// RetryBackoff is the delay before the first retry. It's doubled on every retry up to MaxRetryBackoff.
+	// It's DefaultRetryBackoff, by default.
+	RetryBackoff time.Duration
+
+	// MaxRetryBackoff is DefaultMaxRetryBackoff, by default.
+	MaxRetryBackoff time.Duration
+
+	// BreakerThreshold is the number of consecutive network errors which trip the circuit breaker
+	// of a node. The requests to a tripped node fail fast with ErrPeerUnavailable during BreakerCooldown.
+	// Then a probe request is let to pass. Zero disables the circuit breakers.
+	BreakerThreshold int
+
+	// BreakerCooldown is DefaultBreakerCooldown, by default.
+	BreakerCooldown time.Duration
+
+	// OnBreakerStateChange is called after the circuit breaker of a node changes its state, if it's set.
+	OnBreakerStateChange func(addr string, from, to BreakerState)
+
+	// CompressionCodec has to be the same codec with the cluster. Compression is disabled if it's nil.
+	CompressionCodec olric.CompressionCodec
+
+	// Tracer creates a span with SpanKindClient for every attempt of a request, if it's set. The trace
+	// context is sent to the nodes, so their spans are children of the client's spans.
+	Tracer olric.Tracer
+
+	// TLSConfig enables TLS for the connections to the nodes, if it's set. The ServerName is the host
+	// of the address of a node, if it's empty.
+	TLSConfig *tls.Config
+
+	// Credential authenticates the connections to the nodes, if it's set. The requests fail with
+	// olric.ErrUnauthorized, if a node rejects it.
+	Credential []byte
+
+	// Multiplex sends the concurrent requests to a node over a single connection, instead of a connection
+	// for every request in flight. It's used with the nodes which speak protocol version 2 or later, the
+	// connection pool is used for the older ones.
+	Multiplex bool
+
+	// DirectRouting sends the requests of the keys directly to their owners instead of a random node which
+	// forwards them. The client keeps a copy of the routing table of the cluster for it.
+	DirectRouting bool
+
+	// RoutingRefreshInterval is the interval of fetching the routing table. It's DefaultRoutingRefreshInterval,
+	// by default.
+	RoutingRefreshInterval time.Duration
+
+	// Hasher has to be the same hasher with the cluster, it's used to find the owners of the keys when
+	// DirectRouting is enabled. It's olric.NewDefaultHasher(), by default.
+	Hasher olric.Hasher
 }
 
 // DMap provides methods to access distributed maps on Olric cluster.
@@ -58,23 +169,213 @@ func New(c *Config, s olric.Serializer) (*Client, error) {
 	if c.MaxConn == 0 {
 		c.MaxConn = 1
 	}
+	if c.MinConn < 0 || c.MinConn > c.MaxConn {
+		return nil, fmt.Errorf("invalid MinConn: %d", c.MinConn)
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = DefaultMaxAttempts
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = DefaultRetryBackoff
+	}
+	if c.MaxRetryBackoff == 0 {
+		c.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = DefaultBreakerCooldown
+	}
+	if c.CompressionCodec != nil {
+		protocol.Codec = c.CompressionCodec
+	}
+	if c.RoutingRefreshInterval == 0 {
+		c.RoutingRefreshInterval = DefaultRoutingRefreshInterval
+	}
+	if c.Hasher == nil {
+		c.Hasher = olric.NewDefaultHasher()
+	}
 	cc := &transport.ClientConfig{
-		Addrs:       c.Addrs,
-		DialTimeout: c.DialTimeout,
-		KeepAlive:   c.KeepAlive,
-		MaxConn:     c.MaxConn,
+		Addrs:          c.Addrs,
+		DialTimeout:    c.DialTimeout,
+		KeepAlive:      c.KeepAlive,
+		MinConn:        c.MinConn,
+		DisableNoDelay: c.DisableNoDelay,
+		MaxConn:        c.MaxConn,
+		IdleTimeout:    c.IdleTimeout,
+		MaxAttempts:    c.MaxAttempts,
+		Backoff:        c.RetryBackoff,
+		MaxBackoff:     c.MaxRetryBackoff,
+
+		BreakerThreshold:     c.BreakerThreshold,
+		BreakerCooldown:      c.BreakerCooldown,
+		OnBreakerStateChange: c.OnBreakerStateChange,
+		TLSConfig:            c.TLSConfig,
+		Credential:           c.Credential,
+		Multiplex:            c.Multiplex,
+	}
+	if c.Tracer != nil {
+		cc.Tracer = traceRequest(c.Tracer)
 	}
-	return &Client{
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
 		client:     transport.NewClient(cc),
 		serializer: s,
-	}, nil
+		addrs:      c.Addrs,
+		routing:    &routingTable{hasher: c.Hasher},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	if c.DirectRouting {
+		client.wg.Add(1)
+		go client.refreshRoutingPeriodically(c.RoutingRefreshInterval)
+	}
+	return client, nil
+}
+
+// traceRequest returns a transport.ClientTracer which starts the spans with the given tracer.
+func traceRequest(tracer olric.Tracer) transport.ClientTracer {
+	return func(addr string, req *protocol.Message) func(*protocol.Message, error) {
+		span := tracer.StartSpan((*olric.TraceContext)(req.Trace), olric.SpanAttributes{
+			Kind: olric.SpanKindClient,
+			Op:   req.Op.String(),
+			DMap: req.DMap,
+			Node: addr,
+		})
+		tc := protocol.TraceContext(span.Context())
+		req.Trace = &tc
+		return func(resp *protocol.Message, err error) {
+			if err == nil {
+				err = statusError(resp)
+			}
+			span.End(err)
+		}
+	}
+}
+
+// statusError converts the status of a response to an error like the methods of DMap.
+func statusError(resp *protocol.Message) error {
+	switch resp.Status {
+	case protocol.StatusOK:
+		return nil
+	case protocol.StatusKeyNotFound:
+		return olric.ErrKeyNotFound
+	case protocol.StatusKeyFound:
+		return olric.ErrKeyFound
+	case protocol.StatusNoSuchLock:
+		return olric.ErrNoSuchLock
+	case protocol.StatusValueTooBig:
+		return olric.ErrValueTooBig
+	case protocol.StatusWriteQuorum:
+		return olric.ErrWriteQuorum
+	case protocol.StatusReadQuorum:
+		return olric.ErrReadQuorum
+	case protocol.StatusQuotaExceeded:
+		return olric.ErrQuotaExceeded
+	case protocol.StatusForbidden:
+		return olric.ErrForbidden
+	case protocol.StatusUnauthorized:
+		return olric.ErrUnauthorized
+	case protocol.StatusNotOwner:
+		return olric.ErrNotOwner
+	case protocol.StatusTimeout:
+		return olric.ErrOperationTimeout
+	case protocol.StatusOverflow:
+		return olric.ErrOverflow
+	case protocol.StatusReadOnly:
+		return olric.ErrReadOnly
+	case protocol.StatusRateLimited:
+		return olric.ErrRateLimited
+	case protocol.StatusQuorumLost:
+		return olric.ErrQuorumLost
+	}
+	return fmt.Errorf("status code: %d: %s", resp.Status, string(resp.Value))
+}
+
+// requestError returns the error of a response if its status has the same meaning for all operations.
+// The other statuses, i.e. StatusKeyNotFound, are handled by the methods.
+func requestError(resp *protocol.Message) error {
+	switch resp.Status {
+	case protocol.StatusForbidden, protocol.StatusUnauthorized, protocol.StatusValueTooBig,
+		protocol.StatusQuotaExceeded, protocol.StatusWriteQuorum, protocol.StatusReadQuorum,
+		protocol.StatusNotOwner, protocol.StatusTimeout, protocol.StatusReadOnly, protocol.StatusRateLimited,
+		protocol.StatusQuorumLost:
+		return statusError(resp)
+	}
+	return nil
+}
+
+// request sends the request to a node, the owner of its key if DirectRouting is enabled. It returns
+// olric.ErrForbidden if the request is denied by the Authorizer of the node, olric.ErrUnauthorized if the
+// connection is not authenticated. The other statuses of requestError are converted to the olric errors
+// in the same way.
+func (c *Client) request(op protocol.OpCode, m *protocol.Message) (*protocol.Message, error) {
+	var resp *protocol.Message
+	var err error
+	if m.Key != "" {
+		resp, err = c.requestOwner(op, m)
+	} else {
+		resp, err = c.client.Request(op, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = requestError(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// requestTo sends the request to the given node like request.
+func (c *Client) requestTo(addr string, op protocol.OpCode, m *protocol.Message) (*protocol.Message, error) {
+	resp, err := c.client.RequestTo(addr, op, m)
+	if err != nil {
+		return nil, err
+	}
+	if err = requestError(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 // Close cancels underlying context and cancels ongoing requests.
 func (c *Client) Close() {
+	c.cancel()
+	c.wg.Wait()
 	c.client.Close()
 }
 
+// Ping sends a ping message to given node and returns the round trip time. It doesn't touch any DMap.
+func (c *Client) Ping(addr string) (time.Duration, error) {
+	return c.client.Ping(addr)
+}
+
+// Stats returns the statistics of the given node.
+func (c *Client) Stats(addr string) (olric.Stats, error) {
+	var stats olric.Stats
+	resp, err := c.requestTo(addr, protocol.OpStats, &protocol.Message{})
+	if err != nil {
+		return stats, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return stats, fmt.Errorf("failed to get stats: %s", string(resp.Value))
+	}
+	err = msgpack.Unmarshal(resp.Value, &stats)
+	return stats, err
+}
+
+// SlowLog returns the slow log of the given node, the newest entry first.
+func (c *Client) SlowLog(addr string) ([]olric.SlowLogEntry, error) {
+	resp, err := c.requestTo(addr, protocol.OpSlowLog, &protocol.Message{})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return nil, fmt.Errorf("failed to get slow log: %s", string(resp.Value))
+	}
+	var entries []olric.SlowLogEntry
+	err = msgpack.Unmarshal(resp.Value, &entries)
+	return entries, err
+}
+
 // NewDMap creates and returns a new DMap object to access DMaps on the cluster.
 func (c *Client) NewDMap(name string) *DMap {
 	return &DMap{
@@ -90,12 +391,12 @@ func (d *DMap) Get(key string) (interface{}, error) {
 		DMap: d.name,
 		Key:  key,
 	}
-	resp, err := d.client.Request(protocol.OpExGet, m)
+	resp, err := d.request(protocol.OpExGet, m)
 	if err != nil {
 		return nil, err
 	}
-	if resp.Status == protocol.StatusKeyNotFound {
-		return nil, olric.ErrKeyNotFound
+	if err = statusError(resp); err != nil {
+		return nil, err
 	}
 	var value interface{}
 	err = d.serializer.Unmarshal(resp.Value, &value)
@@ -105,6 +406,107 @@ func (d *DMap) Get(key string) (interface{}, error) {
 	return value, nil
 }
 
+// GetWithTTL gets the value and the remaining lifetime for the given key. It returns olric.NoTTL as ttl if the key
+// doesn't expire and olric.ErrKeyNotFound if the DB does not contain the key. It's thread-safe.
+func (d *DMap) GetWithTTL(key string) (interface{}, time.Duration, error) {
+	m := &protocol.Message{
+		DMap: d.name,
+		Key:  key,
+	}
+	resp, err := d.request(protocol.OpExGetEx, m)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = statusError(resp); err != nil {
+		return nil, 0, err
+	}
+	var value interface{}
+	err = d.serializer.Unmarshal(resp.Value, &value)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := olric.NoTTL
+	if extra, ok := resp.Extra.(protocol.GetExExtra); ok && extra.TTL != 0 {
+		ttl = time.Until(time.Unix(0, extra.TTL*int64(time.Millisecond)))
+		if ttl < 0 {
+			ttl = 0
+		}
+	}
+	return value, ttl, nil
+}
+
+// GetEntry gets the value and the metadata for the given key. It returns olric.ErrKeyNotFound if the DB
+// does not contain the key. It's thread-safe.
+func (d *DMap) GetEntry(key string) (*olric.Entry, error) {
+	m := &protocol.Message{
+		DMap: d.name,
+		Key:  key,
+	}
+	resp, err := d.request(protocol.OpExGetEntry, m)
+	if err != nil {
+		return nil, err
+	}
+	if err = statusError(resp); err != nil {
+		return nil, err
+	}
+	extra, ok := resp.Extra.(protocol.GetEntryExtra)
+	if !ok || int(extra.OwnerLen) > len(resp.Value) {
+		return nil, protocol.ErrMalformedMessage
+	}
+	var value interface{}
+	err = d.serializer.Unmarshal(resp.Value[extra.OwnerLen:], &value)
+	if err != nil {
+		return nil, err
+	}
+	entry := &olric.Entry{
+		Key:    key,
+		Value:  value,
+		TTL:    olric.NoTTL,
+		PartID: extra.PartID,
+		Owner:  string(resp.Value[:extra.OwnerLen]),
+	}
+	if extra.TTL != 0 {
+		entry.TTL = time.Until(time.Unix(0, extra.TTL*int64(time.Millisecond)))
+		if entry.TTL < 0 {
+			entry.TTL = 0
+		}
+	}
+	if extra.LastAccess != 0 {
+		entry.LastAccess = time.Unix(0, extra.LastAccess)
+	}
+	return entry, nil
+}
+
+// GetMany gets the values for the given keys with one request. Missing keys are omitted
+// from the returned map. It's thread-safe.
+func (d *DMap) GetMany(keys ...string) (map[string]interface{}, error) {
+	m := &protocol.Message{
+		DMap:  d.name,
+		Value: protocol.EncodeKeys(keys),
+	}
+	resp, err := d.request(protocol.OpExMGet, m)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return nil, fmt.Errorf("failed to get keys: %s", string(resp.Value))
+	}
+	entries, err := protocol.DecodeEntries(resp.Value)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, len(entries))
+	for key, rawval := range entries {
+		var value interface{}
+		err = d.serializer.Unmarshal(rawval, &value)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
 // Put sets the value for the given key. It overwrites any previous value for that key and it's thread-safe.
 // It is safe to modify the contents of the arguments after Put returns but not before.
 func (d *DMap) Put(key string, value interface{}) error {
@@ -117,8 +519,68 @@ func (d *DMap) Put(key string, value interface{}) error {
 		Key:   key,
 		Value: data,
 	}
-	_, err = d.client.Request(protocol.OpExPut, m)
-	return err
+	resp, err := d.request(protocol.OpExPut, m)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+// PutMany sets the values for the given keys with one request. It returns an *olric.PutManyError
+// which lists the failed keys, if some of the keys could not be written. It's thread-safe.
+func (d *DMap) PutMany(entries map[string]interface{}) error {
+	values := make(map[string][]byte, len(entries))
+	for key, value := range entries {
+		data, err := d.serializer.Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[key] = data
+	}
+	m := &protocol.Message{
+		DMap:  d.name,
+		Value: protocol.EncodeEntries(values),
+	}
+	resp, err := d.request(protocol.OpExMPut, m)
+	if err != nil {
+		return err
+	}
+	if resp.Status != protocol.StatusOK {
+		return fmt.Errorf("failed to put keys: %s", string(resp.Value))
+	}
+	errs, err := protocol.DecodeEntries(resp.Value)
+	if err != nil {
+		return err
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	failed := make(map[string]error, len(errs))
+	for key, msg := range errs {
+		failed[key] = errors.New(string(msg))
+	}
+	return &olric.PutManyError{Errors: failed}
+}
+
+// PutIf sets the value for the given key if the condition given by flags is satisfied. Flags is one of
+// olric.IfNotFound and olric.IfFound. It returns olric.ErrKeyFound if IfNotFound is given and the key exists,
+// olric.ErrKeyNotFound if IfFound is given and the key doesn't exist. It's thread-safe.
+func (d *DMap) PutIf(key string, value interface{}, flags int) error {
+	data, err := d.serializer.Marshal(value)
+	if err != nil {
+		return err
+	}
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   key,
+		Extra: protocol.PutIfExtra{Flags: uint8(flags)},
+		Value: data,
+	}
+	resp, err := d.request(protocol.OpExPutIf, m)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
 }
 
 // PutEx sets the value for the given key with TTL. It overwrites any previous value for that key. It's thread-safe.
@@ -134,8 +596,90 @@ func (d *DMap) PutEx(key string, value interface{}, timeout time.Duration) error
 		Extra: protocol.PutExExtra{TTL: timeout.Nanoseconds()},
 		Value: data,
 	}
-	_, err = d.client.Request(protocol.OpExPutEx, m)
-	return err
+	resp, err := d.request(protocol.OpExPutEx, m)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+// Expire updates the expiry for the given key without touching its value. A zero timeout removes the expiry.
+// It returns olric.ErrKeyNotFound if the DB does not contain the key. It's thread-safe.
+func (d *DMap) Expire(key string, timeout time.Duration) error {
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   key,
+		Extra: protocol.ExpireExtra{TTL: timeout.Nanoseconds()},
+	}
+	resp, err := d.request(protocol.OpExpire, m)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+// Touch marks the given key as recently used without reading its value. The idle time of the key for
+// MaxIdleDuration is reset, the TTL doesn't change. It returns olric.ErrKeyNotFound if the DB does not
+// contain the key. It's thread-safe.
+func (d *DMap) Touch(key string) error {
+	m := &protocol.Message{
+		DMap: d.name,
+		Key:  key,
+	}
+	resp, err := d.request(protocol.OpTouch, m)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+// CompareAndSwap sets the value for the given key to new, only if the current value is equal to old. The comparison
+// is done on the serialized values by the owner of the key. It returns true if the swap happened. It's thread-safe.
+func (d *DMap) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	oldval, err := d.serializer.Marshal(old)
+	if err != nil {
+		return false, err
+	}
+	newval, err := d.serializer.Marshal(new)
+	if err != nil {
+		return false, err
+	}
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   key,
+		Extra: protocol.CASExtra{OldLen: uint32(len(oldval))},
+		Value: append(oldval, newval...),
+	}
+	resp, err := d.request(protocol.OpExCAS, m)
+	if err != nil {
+		return false, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return false, fmt.Errorf("failed to compare and swap: %s", string(resp.Value))
+	}
+	return len(resp.Value) == 1 && resp.Value[0] == 1, nil
+}
+
+// CompareAndDelete deletes the given key, only if the current value is equal to old. The comparison is done
+// on the serialized values by the owner of the key. It returns true if the key has been deleted. It's thread-safe.
+func (d *DMap) CompareAndDelete(key string, old interface{}) (bool, error) {
+	oldval, err := d.serializer.Marshal(old)
+	if err != nil {
+		return false, err
+	}
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   key,
+		Value: oldval,
+	}
+	resp, err := d.request(protocol.OpExCAD, m)
+	if err != nil {
+		return false, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return false, fmt.Errorf("failed to compare and delete: %s", string(resp.Value))
+	}
+	return len(resp.Value) == 1 && resp.Value[0] == 1, nil
 }
 
 // Delete deletes the value for the given key. Delete will not return error if key doesn't exist. It's thread-safe.
@@ -145,51 +689,348 @@ func (d *DMap) Delete(key string) error {
 		DMap: d.name,
 		Key:  key,
 	}
-	_, err := d.client.Request(protocol.OpExDelete, m)
+	_, err := d.request(protocol.OpExDelete, m)
 	return err
 }
 
+// DeleteMany deletes the values for the given keys with one request. It returns an *olric.DeleteManyError
+// which lists the failed keys, if some of the keys could not be deleted. It's thread-safe.
+func (d *DMap) DeleteMany(keys ...string) error {
+	m := &protocol.Message{
+		DMap:  d.name,
+		Value: protocol.EncodeKeys(keys),
+	}
+	resp, err := d.request(protocol.OpExMDelete, m)
+	if err != nil {
+		return err
+	}
+	if resp.Status != protocol.StatusOK {
+		return fmt.Errorf("failed to delete keys: %s", string(resp.Value))
+	}
+	errs, err := protocol.DecodeEntries(resp.Value)
+	if err != nil {
+		return err
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	failed := make(map[string]error, len(errs))
+	for key, msg := range errs {
+		failed[key] = errors.New(string(msg))
+	}
+	return &olric.DeleteManyError{Errors: failed}
+}
+
+// DeleteByPattern deletes the keys which match the given glob pattern on the cluster and returns the
+// number of deleted keys. The pattern has the same syntax with Query. The keys are not transferred to the client.
+func (d *DMap) DeleteByPattern(pattern string) (int, error) {
+	m := &protocol.Message{
+		DMap:  d.name,
+		Value: []byte(pattern),
+	}
+	resp, err := d.request(protocol.OpExDeleteByPattern, m)
+	if err != nil {
+		return 0, err
+	}
+	extra, ok := resp.Extra.(protocol.LenExtra)
+	if !ok {
+		return 0, fmt.Errorf("invalid response: no count")
+	}
+	return int(extra.Count), nil
+}
+
+// GetByIndex returns the keys whose values have the given value of the indexed field in sorted order.
+// The index is configured on the cluster, see olric.DMapConfig.Indexes.
+func (d *DMap) GetByIndex(field, value string) ([]string, error) {
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   field,
+		Value: []byte(value),
+	}
+	resp, err := d.request(protocol.OpExGetByIndex, m)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeKeys(resp.Value)
+}
+
+// DMapLock is a handle of an acquired lock. It carries the key and the token of the lock,
+// so the lock can be released with a simple call like defer lock.Unlock().
+type DMapLock struct {
+	dm    *DMap
+	key   string
+	token olric.LockToken
+}
+
+// Key returns the locked key.
+func (l *DMapLock) Key() string {
+	return l.key
+}
+
+// Token returns the token of this acquisition.
+func (l *DMapLock) Token() olric.LockToken {
+	return l.token
+}
+
+// Unlock releases the lock. It returns olric.ErrNoSuchLock if the lock has already expired.
+func (l *DMapLock) Unlock() error {
+	return l.dm.Unlock(l.key, l.token)
+}
+
+// Lease extends the lifetime of the lock to d from now. It returns olric.ErrNoSuchLock if the lock has already expired.
+func (l *DMapLock) Lease(d time.Duration) error {
+	return l.dm.Lease(l.key, l.token, d)
+}
+
 // LockWithTimeout sets a lock for the given key. If the lock is still unreleased the end of given period of time,
 // it automatically releases the lock. Acquired lock is only for the key in this map. Please note that, before
 // setting a lock for a key, you should set the key with Put method. Otherwise it returns olric.ErrKeyNotFound error.
 //
 // It returns immediately if it acquires the lock for the given key. Otherwise, it waits until timeout.
 //
+// It returns a DMapLock handle to release or lease the acquired lock.
+//
 // You should know that the locks are approximate, and only to be used for non-critical purposes.
-func (d *DMap) LockWithTimeout(key string, timeout time.Duration) error {
+func (d *DMap) LockWithTimeout(key string, timeout time.Duration) (*DMapLock, error) {
 	m := &protocol.Message{
 		DMap:  d.name,
 		Key:   key,
 		Extra: protocol.LockWithTimeoutExtra{TTL: timeout.Nanoseconds()},
 	}
-	_, err := d.client.Request(protocol.OpExLockWithTimeout, m)
-	return err
+	resp, err := d.request(protocol.OpExLockWithTimeout, m)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return nil, fmt.Errorf("failed to lock: %s", string(resp.Value))
+	}
+	return &DMapLock{dm: d, key: key, token: olric.LockToken(resp.Value)}, nil
 }
 
-// Unlock releases an acquired lock for the given key. It returns olric.ErrNoSuchLock if there is no lock for the given key.
-func (d *DMap) Unlock(key string) error {
+// TryLock tries to set a lock for the given key only once. It doesn't wait for the lock and returns false
+// immediately if the lock is held by someone else. If the lock is acquired, it's released automatically
+// after the given ttl. The returned DMapLock is nil if the lock is not acquired.
+func (d *DMap) TryLock(key string, ttl time.Duration) (*DMapLock, bool, error) {
 	m := &protocol.Message{
-		DMap: d.name,
-		Key:  key,
+		DMap:  d.name,
+		Key:   key,
+		Extra: protocol.LockWithTimeoutExtra{TTL: ttl.Nanoseconds()},
+	}
+	resp, err := d.request(protocol.OpTryLock, m)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return nil, false, fmt.Errorf("failed to try lock: %s", string(resp.Value))
+	}
+	if len(resp.Value) == 0 {
+		return nil, false, nil
+	}
+	return &DMapLock{dm: d, key: key, token: olric.LockToken(resp.Value)}, true, nil
+}
+
+// Lease extends the lifetime of a held lock to newTTL from now, only if the given token is the one
+// returned when the lock was acquired. It returns olric.ErrNoSuchLock if the lock has already expired
+// or it's held by someone else.
+func (d *DMap) Lease(key string, token olric.LockToken, newTTL time.Duration) error {
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   key,
+		Value: token,
+		Extra: protocol.LockWithTimeoutExtra{TTL: newTTL.Nanoseconds()},
+	}
+	resp, err := d.request(protocol.OpLockLease, m)
+	if err != nil {
+		return err
 	}
-	resp, err := d.client.Request(protocol.OpExUnlock, m)
 	if resp.Status == protocol.StatusNoSuchLock {
 		return olric.ErrNoSuchLock
 	}
-	return err
+	if resp.Status != protocol.StatusOK {
+		return fmt.Errorf("failed to lease: %s", string(resp.Value))
+	}
+	return nil
+}
+
+// Unlock releases an acquired lock for the given key. The token must be the one returned when the lock
+// was acquired. It returns olric.ErrNoSuchLock if there is no lock for the given key or it's held by someone else.
+func (d *DMap) Unlock(key string, token olric.LockToken) error {
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   key,
+		Value: token,
+	}
+	resp, err := d.request(protocol.OpExUnlock, m)
+	if err != nil {
+		return err
+	}
+	return statusError(resp)
+}
+
+// Len returns the number of keys in the DMap. The result is approximate under concurrent mutation.
+func (d *DMap) Len() (int, error) {
+	m := &protocol.Message{
+		DMap: d.name,
+	}
+	resp, err := d.request(protocol.OpExLen, m)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return 0, fmt.Errorf("failed to get length: %s", string(resp.Value))
+	}
+	extra, ok := resp.Extra.(protocol.LenExtra)
+	if !ok {
+		return 0, fmt.Errorf("invalid response: no count")
+	}
+	return int(extra.Count), nil
+}
+
+// ScanIterator iterates over the keys of a DMap, partition by partition. It's not thread-safe.
+// See olric.ScanIterator for the guarantees.
+type ScanIterator struct {
+	dm     *DMap
+	cursor protocol.ScanExtra
+	keys   []string
+	key    string
+	err    error
+	done   bool
+}
+
+// Scan returns an iterator to walk the keys of the DMap.
+func (d *DMap) Scan() *ScanIterator {
+	return &ScanIterator{dm: d}
+}
+
+func (s *ScanIterator) fetch() error {
+	m := &protocol.Message{
+		DMap:  s.dm.name,
+		Extra: s.cursor,
+	}
+	resp, err := s.dm.request(protocol.OpExScan, m)
+	if err != nil {
+		return err
+	}
+	if resp.Status != protocol.StatusOK {
+		return fmt.Errorf("failed to scan: %s", string(resp.Value))
+	}
+	keys, err := protocol.DecodeKeys(resp.Value)
+	if err != nil {
+		return err
+	}
+	next, ok := resp.Extra.(protocol.ScanExtra)
+	if !ok {
+		return fmt.Errorf("invalid response: no cursor")
+	}
+	s.keys, s.cursor = keys, next
+	s.done = len(keys) == 0
+	return nil
+}
+
+// Next advances the iterator to the next key. It returns false when the scan is done or an error
+// occurs. Check Err after Next returns false.
+func (s *ScanIterator) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	if len(s.keys) == 0 && !s.done {
+		if s.err = s.fetch(); s.err != nil {
+			return false
+		}
+	}
+	if len(s.keys) == 0 {
+		return false
+	}
+	s.key, s.keys = s.keys[0], s.keys[1:]
+	return true
+}
+
+// Key returns the current key.
+func (s *ScanIterator) Key() string {
+	return s.key
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (s *ScanIterator) Err() error {
+	return s.err
+}
+
+func (d *DMap) query(pattern string, isRegexp bool) (map[string]interface{}, error) {
+	extra := protocol.QueryExtra{}
+	if isRegexp {
+		extra.Regexp = 1
+	}
+	result := make(map[string]interface{})
+	for {
+		m := &protocol.Message{
+			DMap:  d.name,
+			Extra: extra,
+			Value: []byte(pattern),
+		}
+		resp, err := d.request(protocol.OpExQuery, m)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status != protocol.StatusOK {
+			return nil, fmt.Errorf("failed to query: %s", string(resp.Value))
+		}
+		entries, err := protocol.DecodeEntries(resp.Value)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return result, nil
+		}
+		for key, rawval := range entries {
+			var value interface{}
+			err = d.serializer.Unmarshal(rawval, &value)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+		}
+		next, ok := resp.Extra.(protocol.QueryExtra)
+		if !ok {
+			return nil, fmt.Errorf("invalid response: no cursor")
+		}
+		extra = next
+	}
+}
+
+// Query returns the keys which match the given glob pattern with their values. The pattern supports
+// '*' to match any sequence of characters and '?' to match a single character. Matching entries are
+// transferred in batches.
+func (d *DMap) Query(pattern string) (map[string]interface{}, error) {
+	return d.query(pattern, false)
+}
+
+// QueryRegexp is like Query but it matches the keys with the given regular expression.
+func (d *DMap) QueryRegexp(expr string) (map[string]interface{}, error) {
+	return d.query(expr, true)
 }
 
 // Destroy flushes the given DMap on the cluster. You should know that there is no global lock on DMaps.
 // So if you call Put/PutEx and Destroy methods concurrently on the cluster, Put/PutEx calls may set new values to the DMap.
+// It returns nil if the DMap doesn't exist. If the DMap could not be destroyed on some of the nodes, the error lists them.
 func (d *DMap) Destroy() error {
 	m := &protocol.Message{
 		DMap: d.name,
 	}
-	_, err := d.client.Request(protocol.OpExDestroy, m)
+	_, err := d.request(protocol.OpExDestroy, m)
 	return err
 }
 
-func (c *Client) incrDecr(op protocol.OpCode, name, key string, delta int) (int, error) {
+// Clear deletes all the keys of the DMap on the cluster but keeps the DMap with its configuration.
+// It returns nil if the DMap doesn't exist. If the DMap could not be cleared on some of the nodes, the error lists them.
+func (d *DMap) Clear() error {
+	m := &protocol.Message{
+		DMap: d.name,
+	}
+	_, err := d.request(protocol.OpExClear, m)
+	return err
+}
+
+func (c *Client) incrDecr(op protocol.OpCode, name, key string, delta, initial int) (int, error) {
 	value, err := c.serializer.Marshal(delta)
 	if err != nil {
 		return 0, err
@@ -199,26 +1040,105 @@ func (c *Client) incrDecr(op protocol.OpCode, name, key string, delta int) (int,
 		Key:   key,
 		Value: value,
 	}
-	resp, err := c.client.Request(op, m)
+	if initial != 0 {
+		m.Extra = protocol.IncrExtra{Initial: int64(initial)}
+	}
+	resp, err := c.request(op, m)
 	if err != nil {
 		return 0, err
 	}
+	if err = statusError(resp); err != nil {
+		return 0, err
+	}
 	var res interface{}
 	err = c.serializer.Unmarshal(resp.Value, &res)
-	return res.(int), err
+	if err != nil {
+		return 0, err
+	}
+	newval, ok := res.(int)
+	if !ok {
+		return 0, fmt.Errorf("mismatched type: %T", res)
+	}
+	return newval, nil
 }
 
-// Incr atomically increments key by delta. The return value is the new value after being incremented or an error.
+// Incr atomically increments key by delta. If the key doesn't exist, it's created with delta. The return value
+// is the new value after being incremented or an error. It returns olric.ErrOverflow if the new value doesn't
+// fit in an int.
 func (d *DMap) Incr(key string, delta int) (int, error) {
-	return d.incrDecr(protocol.OpExIncr, d.name, key, delta)
+	return d.incrDecr(protocol.OpExIncr, d.name, key, delta, 0)
 }
 
-// Decr atomically decrements key by delta. The return value is the new value after being decremented or an error.
+// IncrBy is like Incr but a key which doesn't exist starts from initial, so it's created with initial+delta.
+func (d *DMap) IncrBy(key string, delta, initial int) (int, error) {
+	return d.incrDecr(protocol.OpExIncr, d.name, key, delta, initial)
+}
+
+// Decr atomically decrements key by delta. If the key doesn't exist, it's created with -delta. The return value
+// is the new value after being decremented or an error. It returns olric.ErrOverflow like Incr.
 func (d *DMap) Decr(key string, delta int) (int, error) {
-	return d.incrDecr(protocol.OpExDecr, d.name, key, delta)
+	return d.incrDecr(protocol.OpExDecr, d.name, key, delta, 0)
+}
+
+func (c *Client) appendPrepend(op protocol.OpCode, name, key string, data []byte) (int, error) {
+	m := &protocol.Message{
+		DMap:  name,
+		Key:   key,
+		Value: data,
+	}
+	resp, err := c.request(op, m)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return 0, fmt.Errorf("failed to update value: %s", string(resp.Value))
+	}
+	if len(resp.Value) != 8 {
+		return 0, fmt.Errorf("invalid response length: %d", len(resp.Value))
+	}
+	return int(binary.BigEndian.Uint64(resp.Value)), nil
+}
+
+// Append atomically appends data to the value of the given key and returns the new length of the value.
+// The value must be a byte slice. If the key doesn't exist, Append creates it with data.
+func (d *DMap) Append(key string, data []byte) (int, error) {
+	return d.appendPrepend(protocol.OpExAppend, d.name, key, data)
+}
+
+// Prepend atomically prepends data to the value of the given key and returns the new length of the value.
+// The value must be a byte slice. If the key doesn't exist, Prepend creates it with data.
+func (d *DMap) Prepend(key string, data []byte) (int, error) {
+	return d.appendPrepend(protocol.OpExPrepend, d.name, key, data)
+}
+
+// IncrByFloat atomically increments key by delta. The return value is the new value after being incremented or an error.
+func (d *DMap) IncrByFloat(key string, delta float64) (float64, error) {
+	value, err := d.serializer.Marshal(delta)
+	if err != nil {
+		return 0, err
+	}
+	m := &protocol.Message{
+		DMap:  d.name,
+		Key:   key,
+		Value: value,
+	}
+	resp, err := d.request(protocol.OpExIncrByFloat, m)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Status != protocol.StatusOK {
+		return 0, fmt.Errorf("failed to increment: %s", string(resp.Value))
+	}
+	var res interface{}
+	err = d.serializer.Unmarshal(resp.Value, &res)
+	if err != nil {
+		return 0, err
+	}
+	return res.(float64), nil
 }
 
-// GetPut atomically sets key to value and returns the old value stored at key.
+// GetPut atomically sets key to value and returns the old value stored at key. If the key doesn't exist,
+// the old value is nil and the error is nil.
 func (d *DMap) GetPut(key string, value interface{}) (interface{}, error) {
 	data, err := d.serializer.Marshal(value)
 	if err != nil {
@@ -229,7 +1149,7 @@ func (d *DMap) GetPut(key string, value interface{}) (interface{}, error) {
 		Key:   key,
 		Value: data,
 	}
-	resp, err := d.client.Request(protocol.OpExGetPut, m)
+	resp, err := d.request(protocol.OpExGetPut, m)
 	if err != nil {
 		return nil, err
 	}
@@ -17,7 +17,9 @@ package client
 import (
 	"context"
 	"log"
+	"math"
 	"net"
+	"reflect"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -25,6 +27,8 @@ import (
 	"time"
 
 	"github.com/buraksezer/olric"
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/hashicorp/memberlist"
 )
 
 var testConfig = &Config{
@@ -48,12 +52,16 @@ func getFreePort() (int, error) {
 }
 
 func newOlric() (*olric.Olric, chan struct{}, error) {
+	return newOlricWithDMaps(nil)
+}
+
+func newOlricWithDMaps(dmaps map[string]olric.DMapConfig) (*olric.Olric, chan struct{}, error) {
 	port, err := getFreePort()
 	if err != nil {
 		return nil, nil, err
 	}
 	addr := "127.0.0.1:" + strconv.Itoa(port)
-	cfg := &olric.Config{Name: addr}
+	cfg := &olric.Config{Name: addr, DMaps: dmaps}
 	db, err := olric.New(cfg)
 	if err != nil {
 		return nil, nil, err
@@ -141,7 +149,7 @@ func TestClient_Put(t *testing.T) {
 	}
 }
 
-func TestClient_PutEx(t *testing.T) {
+func TestClient_Multiplex(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
@@ -154,31 +162,85 @@ func TestClient_PutEx(t *testing.T) {
 		<-done
 	}()
 
-	c, err := New(testConfig, nil)
+	cfg := *testConfig
+	cfg.Multiplex = true
+	c, err := New(&cfg, nil)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
+	defer c.Close()
 
-	name := "mymap"
-	key, value := "my-key", "my-value"
-	err = c.NewDMap(name).PutEx(key, value, 10*time.Millisecond)
+	dm := c.NewDMap("mymap")
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "my-key-" + strconv.Itoa(i)
+			if err := dm.Put(key, i); err != nil {
+				t.Errorf("Expected nil. Got: %v", err)
+				return
+			}
+			val, err := dm.Get(key)
+			if err != nil {
+				t.Errorf("Expected nil. Got: %v", err)
+				return
+			}
+			if val.(int) != i {
+				t.Errorf("Expected value %d. Got: %v", i, val)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClient_GetMany(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	// Wait for updating currentUnixNano in Olric.
-	time.Sleep(110 * time.Millisecond)
+	name := "mymap"
 	dm := db.NewDMap(name)
-	v, err := dm.Get(key)
-	if err != olric.ErrKeyNotFound {
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := "my-key-" + strconv.Itoa(i)
+		err = dm.Put(key, i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	keys = append(keys, "missing-key")
+
+	entries, err := c.NewDMap(name).GetMany(keys...)
+	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-	if v != nil {
-		t.Fatalf("Expected nil. Got: %v", v)
+	if len(entries) != 10 {
+		t.Fatalf("Expected 10 entries. Got: %d", len(entries))
+	}
+	for i := 0; i < 10; i++ {
+		value := entries["my-key-"+strconv.Itoa(i)]
+		if value.(int) != i {
+			t.Fatalf("Expected value %d. Got: %v", i, value)
+		}
 	}
 }
 
-func TestClient_Delete(t *testing.T) {
+func TestClient_PutMany(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
@@ -197,24 +259,69 @@ func TestClient_Delete(t *testing.T) {
 	}
 
 	name := "mymap"
-	key, value := "my-key", "my-value"
-	err = c.NewDMap(name).Put(key, value)
+	entries := make(map[string]interface{})
+	for i := 0; i < 10; i++ {
+		entries["my-key-"+strconv.Itoa(i)] = i
+	}
+	err = c.NewDMap(name).PutMany(entries)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	err = c.NewDMap(name).Delete(key)
+	dm := db.NewDMap(name)
+	for key, value := range entries {
+		val, err := dm.Get(key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if val.(int) != value.(int) {
+			t.Fatalf("Expected value %v. Got: %v", value, val)
+		}
+	}
+}
+
+func TestClient_DeleteMany(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	_, err = c.NewDMap(name).Get(key)
-	if err != olric.ErrKeyNotFound {
-		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	name := "mymap"
+	dm := db.NewDMap(name)
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := "my-key-" + strconv.Itoa(i)
+		err = dm.Put(key, i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	err = c.NewDMap(name).DeleteMany(append(keys, "absent-key")...)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	for _, key := range keys {
+		_, err = dm.Get(key)
+		if err != olric.ErrKeyNotFound {
+			t.Fatalf("Expected olric.ErrKeyNotFound. Got: %v", err)
+		}
 	}
 }
 
-func TestClient_LockWithTimeout(t *testing.T) {
+func TestClient_PutIf(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
@@ -232,26 +339,35 @@ func TestClient_LockWithTimeout(t *testing.T) {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	name := "mymap"
+	dm := c.NewDMap("mymap")
 	key := "my-key"
-	err = c.NewDMap(name).Put(key, nil)
+	err = dm.PutIf(key, "my-value", olric.IfFound)
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+	err = dm.PutIf(key, "my-value", olric.IfNotFound)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	err = c.NewDMap(name).LockWithTimeout(key, time.Second)
+	err = dm.PutIf(key, "my-value", olric.IfNotFound)
+	if err != olric.ErrKeyFound {
+		t.Fatalf("Expected ErrKeyFound. Got: %v", err)
+	}
+	err = dm.PutIf(key, "new-value", olric.IfFound)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	dm := db.NewDMap(name)
-	err = dm.Unlock(key)
+	value, err := dm.Get(key)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
+	if value.(string) != "new-value" {
+		t.Fatalf("Expected new-value. Got: %v", value)
+	}
 }
 
-func TestClient_Unlock(t *testing.T) {
+func TestClient_PutEx(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
@@ -270,24 +386,25 @@ func TestClient_Unlock(t *testing.T) {
 	}
 
 	name := "mymap"
-	key := "my-key"
-	err = c.NewDMap(name).Put(key, nil)
+	key, value := "my-key", "my-value"
+	err = c.NewDMap(name).PutEx(key, value, 10*time.Millisecond)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	err = c.NewDMap(name).LockWithTimeout(key, time.Second)
-	if err != nil {
+	// Wait for updating currentUnixNano in Olric.
+	time.Sleep(110 * time.Millisecond)
+	dm := db.NewDMap(name)
+	v, err := dm.Get(key)
+	if err != olric.ErrKeyNotFound {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	err = c.NewDMap(name).Unlock(key)
-	if err != nil {
-		t.Fatalf("Expected nil. Got: %v", err)
+	if v != nil {
+		t.Fatalf("Expected nil. Got: %v", v)
 	}
 }
 
-func TestClient_Destroy(t *testing.T) {
+func TestClient_Expire(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
@@ -306,34 +423,38 @@ func TestClient_Destroy(t *testing.T) {
 	}
 
 	name := "mymap"
-	key := "my-key"
-	err = c.NewDMap(name).Put(key, nil)
+	key, value := "my-key", "my-value"
+	err = c.NewDMap(name).Expire(key, 10*time.Millisecond)
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+
+	err = c.NewDMap(name).Put(key, value)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	err = c.NewDMap(name).Destroy()
+	err = c.NewDMap(name).Expire(key, 10*time.Millisecond)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	_, err = c.NewDMap(name).Get(key)
+	// Wait for updating currentUnixNano in Olric.
+	time.Sleep(110 * time.Millisecond)
+	_, err = db.NewDMap(name).Get(key)
 	if err != olric.ErrKeyNotFound {
 		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
 	}
 }
 
-func TestClient_Incr(t *testing.T) {
+func TestClient_GetWithTTL(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
 	}
 	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		serr := db.Shutdown(ctx)
+		serr := db.Shutdown(context.Background())
 		if serr != nil {
-			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+			t.Errorf("Expected nil. Got %v", serr)
 		}
 		<-done
 	}()
@@ -343,52 +464,50 @@ func TestClient_Incr(t *testing.T) {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	key := "incr"
-	name := "atomic_test"
-	var wg sync.WaitGroup
-	start := make(chan struct{})
-
-	incr := func() {
-		defer wg.Done()
-		<-start
-
-		_, ierr := c.NewDMap(name).Incr(key, 1)
-		if ierr != nil {
-			log.Printf("[ERROR] Failed to call Incr: %v", ierr)
-			return
-		}
+	name := "mymap"
+	err = c.NewDMap(name).PutEx("with-ttl", "my-value", time.Hour)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	for i := 0; i < 100; i++ {
-		wg.Add(1)
-		go incr()
+	err = c.NewDMap(name).Put("without-ttl", "my-value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	close(start)
-	wg.Wait()
-
-	res, err := c.NewDMap(name).Incr(key, 1)
+	value, ttl, err := c.NewDMap(name).GetWithTTL("with-ttl")
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
+	if value.(string) != "my-value" {
+		t.Fatalf("Expected my-value. Got: %v", value)
+	}
+	if ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("Expected a TTL between 0 and 1 hour. Got: %v", ttl)
+	}
 
-	if res != 101 {
-		t.Fatalf("Expected 101. Got: %v", res)
+	_, ttl, err = c.NewDMap(name).GetWithTTL("without-ttl")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if ttl != olric.NoTTL {
+		t.Fatalf("Expected NoTTL. Got: %v", ttl)
 	}
 
+	_, _, err = c.NewDMap(name).GetWithTTL("missing-key")
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
 }
 
-func TestClient_Decr(t *testing.T) {
+func TestClient_CompareAndSwap(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
 	}
 	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		serr := db.Shutdown(ctx)
+		serr := db.Shutdown(context.Background())
 		if serr != nil {
-			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+			t.Errorf("Expected nil. Got %v", serr)
 		}
 		<-done
 	}()
@@ -398,52 +517,45 @@ func TestClient_Decr(t *testing.T) {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	key := "incr"
-	name := "atomic_test"
-	var wg sync.WaitGroup
-	start := make(chan struct{})
-
-	incr := func() {
-		defer wg.Done()
-		<-start
-
-		_, ierr := c.NewDMap(name).Decr(key, 1)
-		if ierr != nil {
-			log.Printf("[ERROR] Failed to call Decr: %v", ierr)
-			return
-		}
+	dm := c.NewDMap("mymap")
+	key := "my-key"
+	err = dm.Put(key, "old-value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	for i := 0; i < 100; i++ {
-		wg.Add(1)
-		go incr()
+	swapped, err := dm.CompareAndSwap(key, "wrong-value", "new-value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	close(start)
-	wg.Wait()
-
-	res, err := c.NewDMap(name).Decr(key, 1)
+	if swapped {
+		t.Fatalf("Expected no swap")
+	}
+	swapped, err = dm.CompareAndSwap(key, "old-value", "new-value")
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	if res != -101 {
-		t.Fatalf("Expected -101. Got: %v", res)
+	if !swapped {
+		t.Fatalf("Expected swap")
 	}
 
+	value, err := dm.Get(key)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if value.(string) != "new-value" {
+		t.Fatalf("Expected new-value. Got: %v", value)
+	}
 }
 
-func TestClient_GetPut(t *testing.T) {
+func TestClient_CompareAndDelete(t *testing.T) {
 	db, done, err := newOlric()
 	if err != nil {
 		t.Fatalf("Expected nil. Got %v", err)
 	}
 	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		serr := db.Shutdown(ctx)
+		serr := db.Shutdown(context.Background())
 		if serr != nil {
-			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+			t.Errorf("Expected nil. Got %v", serr)
 		}
 		<-done
 	}()
@@ -453,43 +565,1369 @@ func TestClient_GetPut(t *testing.T) {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	key := "getput"
-	name := "atomic_test"
-	var total int64
-	var wg sync.WaitGroup
-	var final int64
-	start := make(chan struct{})
-
-	getput := func(i int) {
-		defer wg.Done()
-		<-start
-
-		oldval, ierr := c.NewDMap(name).GetPut(key, i)
-		if ierr != nil {
-			log.Printf("[ERROR] Failed to call GetPut: %v", ierr)
-			return
-		}
-		if oldval != nil {
-			atomic.AddInt64(&total, int64(oldval.(int)))
-		}
+	dm := c.NewDMap("mymap")
+	key := "my-key"
+	err = dm.Put(key, "my-value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	for i := 0; i < 100; i++ {
-		wg.Add(1)
-		go getput(i)
-		final += int64(i)
+	deleted, err := dm.CompareAndDelete(key, "wrong-value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
 	}
-
-	close(start)
-	wg.Wait()
-
-	last, err := c.NewDMap(name).Get(key)
+	if deleted {
+		t.Fatalf("Expected no delete")
+	}
+	deleted, err = dm.CompareAndDelete(key, "my-value")
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
+	if !deleted {
+		t.Fatalf("Expected delete")
+	}
+	_, err = dm.Get(key)
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
 
-	atomic.AddInt64(&total, int64(last.(int)))
-	if atomic.LoadInt64(&total) != final {
-		t.Fatalf("Expected %d. Got: %d", final, atomic.LoadInt64(&total))
+func TestClient_AppendPrepend(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	key := "my-key"
+	_, err = dm.Append(key, []byte("bar"))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	length, err := dm.Prepend(key, []byte("foo"))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if length != 6 {
+		t.Fatalf("Expected length 6. Got: %d", length)
+	}
+	value, err := dm.Get(key)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if string(value.([]byte)) != "foobar" {
+		t.Fatalf("Expected foobar. Got: %s", value)
+	}
+}
+
+func TestClient_Len(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put("my-key-"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	length, err := dm.Len()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if length != 10 {
+		t.Fatalf("Expected length 10. Got: %d", length)
+	}
+}
+
+func TestClient_Scan(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 1000; i++ {
+		err = dm.Put("my-key-"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	keys := make(map[string]struct{})
+	s := dm.Scan()
+	for s.Next() {
+		keys[s.Key()] = struct{}{}
+	}
+	if s.Err() != nil {
+		t.Fatalf("Expected nil. Got: %v", s.Err())
+	}
+	if len(keys) != 1000 {
+		t.Fatalf("Expected 1000 keys. Got: %d", len(keys))
+	}
+}
+
+func TestClient_Query(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put("user:"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		err = dm.Put("session:"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	result, err := dm.Query("user:*")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(result) != 100 {
+		t.Fatalf("Expected 100 keys. Got: %d", len(result))
+	}
+	if result["user:10"] != 10 {
+		t.Fatalf("Expected 10. Got: %v", result["user:10"])
+	}
+
+	result, err = dm.QueryRegexp("^session:[0-9]$")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(result) != 10 {
+		t.Fatalf("Expected 10 keys. Got: %d", len(result))
+	}
+}
+
+func TestClient_DeleteByPattern(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put("user:"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		err = dm.Put("session:"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	count, err := dm.DeleteByPattern("user:*")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if count != 100 {
+		t.Fatalf("Expected 100 deleted keys. Got: %d", count)
+	}
+	total, err := dm.Len()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if total != 100 {
+		t.Fatalf("Expected 100 keys. Got: %d", total)
+	}
+}
+
+func TestClient_GetByIndex(t *testing.T) {
+	byParity := func(value interface{}) (string, bool) {
+		i, ok := value.(int)
+		if !ok {
+			return "", false
+		}
+		if i%2 == 0 {
+			return "even", true
+		}
+		return "odd", true
+	}
+	db, done, err := newOlricWithDMaps(map[string]olric.DMapConfig{
+		"mymap": {Indexes: map[string]olric.IndexFunc{"parity": byParity}},
+	})
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put("key-"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	keys, err := dm.GetByIndex("parity", "odd")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	expected := []string{"key-1", "key-3", "key-5", "key-7", "key-9"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected %v. Got: %v", expected, keys)
+	}
+
+	_, err = dm.GetByIndex("color", "red")
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown index. Got: nil")
+	}
+}
+
+func TestClient_Delete(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	name := "mymap"
+	key, value := "my-key", "my-value"
+	err = c.NewDMap(name).Put(key, value)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	err = c.NewDMap(name).Delete(key)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	_, err = c.NewDMap(name).Get(key)
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
+
+func TestClient_LockWithTimeout(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	name := "mymap"
+	key := "my-key"
+	err = c.NewDMap(name).Put(key, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	lock, err := c.NewDMap(name).LockWithTimeout(key, time.Second)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := db.NewDMap(name)
+	err = dm.Unlock(key, lock.Token())
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestClient_TryLock(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	lock, locked, err := dm.TryLock("my-key", time.Second)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !locked {
+		t.Fatalf("Expected to acquire the lock")
+	}
+	_, locked, err = dm.TryLock("my-key", time.Second)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if locked {
+		t.Fatalf("Expected to fail while the lock is held")
+	}
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestClient_Lease(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	lock, err := dm.LockWithTimeout("my-key", 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = dm.Lease("my-key", olric.LockToken("invalid-token"), time.Minute)
+	if err != olric.ErrNoSuchLock {
+		t.Fatalf("Expected olric.ErrNoSuchLock. Got: %v", err)
+	}
+	err = lock.Lease(time.Minute)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	_, locked, err := dm.TryLock("my-key", time.Second)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if locked {
+		t.Fatalf("Expected the leased lock to be held")
+	}
+}
+
+func TestClient_Unlock(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	name := "mymap"
+	key := "my-key"
+	err = c.NewDMap(name).Put(key, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	lock, err := c.NewDMap(name).LockWithTimeout(key, time.Second)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	err = c.NewDMap(name).Unlock(key, olric.LockToken("invalid-token"))
+	if err != olric.ErrNoSuchLock {
+		t.Fatalf("Expected olric.ErrNoSuchLock. Got: %v", err)
+	}
+
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestClient_Destroy(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	name := "mymap"
+	key := "my-key"
+	err = c.NewDMap(name).Put(key, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	err = c.NewDMap(name).Destroy()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	_, err = c.NewDMap(name).Get(key)
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
+
+func TestClient_Clear(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put("my-key-"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err = dm.Clear()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	count, err := dm.Len()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("Expected 0 keys. Got: %d", count)
+	}
+}
+
+func TestClient_Incr(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serr := db.Shutdown(ctx)
+		if serr != nil {
+			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	key := "incr"
+	name := "atomic_test"
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	incr := func() {
+		defer wg.Done()
+		<-start
+
+		_, ierr := c.NewDMap(name).Incr(key, 1)
+		if ierr != nil {
+			log.Printf("[ERROR] Failed to call Incr: %v", ierr)
+			return
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go incr()
+	}
+
+	close(start)
+	wg.Wait()
+
+	res, err := c.NewDMap(name).Incr(key, 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	if res != 101 {
+		t.Fatalf("Expected 101. Got: %v", res)
+	}
+
+}
+
+func TestClient_IncrByFloat(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serr := db.Shutdown(ctx)
+		if serr != nil {
+			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("atomic_test")
+	res, err := dm.IncrByFloat("incr", 1.25)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	res, err = dm.IncrByFloat("incr", 1.25)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if res != 2.5 {
+		t.Fatalf("Expected 2.5. Got: %v", res)
+	}
+}
+
+func TestClient_Decr(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serr := db.Shutdown(ctx)
+		if serr != nil {
+			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	key := "incr"
+	name := "atomic_test"
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	incr := func() {
+		defer wg.Done()
+		<-start
+
+		_, ierr := c.NewDMap(name).Decr(key, 1)
+		if ierr != nil {
+			log.Printf("[ERROR] Failed to call Decr: %v", ierr)
+			return
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go incr()
+	}
+
+	close(start)
+	wg.Wait()
+
+	res, err := c.NewDMap(name).Decr(key, 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	if res != -101 {
+		t.Fatalf("Expected -101. Got: %v", res)
+	}
+
+}
+
+func TestClient_GetPut(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serr := db.Shutdown(ctx)
+		if serr != nil {
+			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	key := "getput"
+	name := "atomic_test"
+	var total int64
+	var wg sync.WaitGroup
+	var final int64
+	start := make(chan struct{})
+
+	getput := func(i int) {
+		defer wg.Done()
+		<-start
+
+		oldval, ierr := c.NewDMap(name).GetPut(key, i)
+		if ierr != nil {
+			log.Printf("[ERROR] Failed to call GetPut: %v", ierr)
+			return
+		}
+		if oldval != nil {
+			atomic.AddInt64(&total, int64(oldval.(int)))
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go getput(i)
+		final += int64(i)
+	}
+
+	close(start)
+	wg.Wait()
+
+	last, err := c.NewDMap(name).Get(key)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	atomic.AddInt64(&total, int64(last.(int)))
+	if atomic.LoadInt64(&total) != final {
+		t.Fatalf("Expected %d. Got: %d", final, atomic.LoadInt64(&total))
+	}
+}
+
+func TestClient_GetEntry(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("mymap")
+	err = dm.PutEx("mykey", "myvalue", time.Hour)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	entry, err := dm.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if entry.Value.(string) != "myvalue" {
+		t.Fatalf("Expected myvalue. Got: %v", entry.Value)
+	}
+	if entry.TTL <= 0 || entry.TTL > time.Hour {
+		t.Fatalf("Expected a TTL between 0 and 1 hour. Got: %v", entry.TTL)
+	}
+	if entry.Owner == "" {
+		t.Fatalf("Expected a non-empty owner")
+	}
+
+	_, err = dm.GetEntry("missing-key")
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
+
+func TestClient_GetPutMissingKey(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serr := db.Shutdown(ctx)
+		if serr != nil {
+			log.Printf("[WARN] Olric Shutdown returned an error: %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("atomic_test")
+	oldval, err := dm.GetPut("getput", 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if oldval != nil {
+		t.Fatalf("Expected nil. Got: %v", oldval)
+	}
+
+	oldval, err = dm.GetPut("getput", 2)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if oldval.(int) != 1 {
+		t.Fatalf("Expected 1. Got: %v", oldval)
+	}
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	p := c.NewPipeline()
+	for i := 0; i < 100; i++ {
+		err = p.Put("mymap", "my-key-"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		p.Get("mymap", "my-key-"+strconv.Itoa(i))
+	}
+	p.Delete("mymap", "my-key-0")
+	p.Get("mymap", "my-key-0")
+	if p.Len() != 202 {
+		t.Fatalf("Expected 202 operations. Got: %d", p.Len())
+	}
+
+	results, err := p.Flush()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(results) != 202 {
+		t.Fatalf("Expected 202 results. Got: %d", len(results))
+	}
+	for i := 0; i < 100; i++ {
+		put, get := results[2*i], results[2*i+1]
+		if put.Err != nil || get.Err != nil {
+			t.Fatalf("Expected nil. Got: %v, %v", put.Err, get.Err)
+		}
+		if get.Value.(int) != i {
+			t.Fatalf("Expected %d. Got: %v", i, get.Value)
+		}
+	}
+	if results[200].Err != nil {
+		t.Fatalf("Expected nil. Got: %v", results[200].Err)
+	}
+	if results[201].Err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", results[201].Err)
+	}
+	if p.Len() != 0 {
+		t.Fatalf("Expected an empty pipeline. Got: %d operations", p.Len())
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	rtt, err := c.Ping(testConfig.Addrs[0])
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("Expected a positive round trip time. Got: %v", rtt)
+	}
+}
+
+func TestClient_Stats(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	dname := "mymap"
+	d := c.NewDMap(dname)
+	for i := 0; i < 10; i++ {
+		err = d.Put("key-"+strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	_, err = d.Get("key-0")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	stats, err := c.Stats(testConfig.Addrs[0])
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !reflect.DeepEqual(stats.DMaps, db.Stats().DMaps) {
+		t.Fatalf("Expected %v. Got: %v", db.Stats().DMaps, stats.DMaps)
+	}
+	if stats.DMaps[dname].Length != 10 || stats.DMaps[dname].Hits != 1 {
+		t.Fatalf("Unexpected stats of %s: %v", dname, stats.DMaps[dname])
+	}
+}
+
+func TestClient_SlowLog(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+	db.SetSlowLogThreshold(time.Nanosecond)
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	dname := "mymap"
+	d := c.NewDMap(dname)
+	err = d.Put("key", "value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	entries, err := c.SlowLog(testConfig.Addrs[0])
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var found bool
+	for _, entry := range entries {
+		if entry.Op == "ExPut" && entry.DMap == dname {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected a slow log entry for ExPut. Got: %v", entries)
+	}
+}
+
+type testSpan struct {
+	attrs olric.SpanAttributes
+	err   error
+}
+
+func (s *testSpan) Context() olric.TraceContext {
+	return olric.TraceContext{TraceID: [16]byte{1}, SpanID: [8]byte{1}}
+}
+
+func (s *testSpan) End(err error) {
+	s.err = err
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(parent *olric.TraceContext, attrs olric.SpanAttributes) olric.Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &testSpan{attrs: attrs}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func TestClient_Tracer(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	tracer := &testTracer{}
+	cfg := *testConfig
+	cfg.Tracer = tracer
+	c, err := New(&cfg, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	dname := "mymap"
+	d := c.NewDMap(dname)
+	err = d.Put("key", "value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = d.Get("missing")
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.spans) != 2 {
+		t.Fatalf("Expected 2 spans. Got: %d", len(tracer.spans))
+	}
+	put, get := tracer.spans[0], tracer.spans[1]
+	if put.attrs.Op != "ExPut" || put.attrs.DMap != dname || put.attrs.Kind != olric.SpanKindClient {
+		t.Fatalf("Unexpected attributes: %v", put.attrs)
+	}
+	if put.attrs.Node != testConfig.Addrs[0] {
+		t.Fatalf("Expected node: %s. Got: %s", testConfig.Addrs[0], put.attrs.Node)
+	}
+	if put.err != nil {
+		t.Fatalf("Expected nil. Got: %v", put.err)
+	}
+	if get.attrs.Op != "ExGet" || get.err == nil {
+		t.Fatalf("Expected an error for ExGet. Got: %v, %v", get.attrs, get.err)
+	}
+}
+
+func TestClient_InvalidMinConn(t *testing.T) {
+	_, err := New(&Config{Addrs: []string{"127.0.0.1:3320"}, MinConn: 2, MaxConn: 1}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for MinConn > MaxConn")
+	}
+}
+
+func TestClient_Touch(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	name := "mymap"
+	key, value := "my-key", "my-value"
+	err = c.NewDMap(name).Touch(key)
+	if err != olric.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+	err = c.NewDMap(name).Put(key, value)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = c.NewDMap(name).Touch(key)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestClient_StatusError(t *testing.T) {
+	statuses := map[protocol.StatusCode]error{
+		protocol.StatusKeyNotFound:   olric.ErrKeyNotFound,
+		protocol.StatusKeyFound:      olric.ErrKeyFound,
+		protocol.StatusNoSuchLock:    olric.ErrNoSuchLock,
+		protocol.StatusValueTooBig:   olric.ErrValueTooBig,
+		protocol.StatusWriteQuorum:   olric.ErrWriteQuorum,
+		protocol.StatusReadQuorum:    olric.ErrReadQuorum,
+		protocol.StatusQuotaExceeded: olric.ErrQuotaExceeded,
+		protocol.StatusForbidden:     olric.ErrForbidden,
+		protocol.StatusUnauthorized:  olric.ErrUnauthorized,
+		protocol.StatusNotOwner:      olric.ErrNotOwner,
+		protocol.StatusTimeout:       olric.ErrOperationTimeout,
+		protocol.StatusOverflow:      olric.ErrOverflow,
+		protocol.StatusReadOnly:      olric.ErrReadOnly,
+		protocol.StatusRateLimited:   olric.ErrRateLimited,
+		protocol.StatusQuorumLost:    olric.ErrQuorumLost,
+	}
+	for status, expected := range statuses {
+		resp := &protocol.Message{Header: protocol.Header{Status: status}}
+		if err := statusError(resp); err != expected {
+			t.Fatalf("Expected %v for status %d. Got: %v", expected, status, err)
+		}
+	}
+	resp := &protocol.Message{Header: protocol.Header{Status: protocol.StatusOK}}
+	if err := statusError(resp); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	resp = &protocol.Message{
+		Header: protocol.Header{Status: protocol.StatusInternalServerError},
+		Value:  []byte("foobar"),
+	}
+	if err := statusError(resp); err == nil {
+		t.Fatalf("Expected an error for StatusInternalServerError")
+	}
+}
+
+func TestClient_DirectRouting(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	cfg := *testConfig
+	cfg.DirectRouting = true
+	c, err := New(&cfg, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer c.Close()
+
+	err = c.refreshRouting()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(c.routing.owners) != int(olric.DefaultPartitionCount) {
+		t.Fatalf("Expected %d owners. Got: %d", olric.DefaultPartitionCount, len(c.routing.owners))
+	}
+	for partID, owner := range c.routing.owners {
+		if owner != cfg.Addrs[0] {
+			t.Fatalf("Expected owner of %d: %s. Got: %s", partID, cfg.Addrs[0], owner)
+		}
+	}
+
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put(strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// A stale routing table falls back to a random node.
+	port, err := getFreePort()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	owners := make([]string, len(c.routing.owners))
+	for i := range owners {
+		owners[i] = "127.0.0.1:" + strconv.Itoa(port)
+	}
+	c.routing.update(owners)
+	for i := 0; i < 10; i++ {
+		value, err := dm.Get(strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if value != i {
+			t.Fatalf("Expected %d. Got: %v", i, value)
+		}
+	}
+}
+
+func TestClient_DirectRoutingMoved(t *testing.T) {
+	var nodes []*olric.Olric
+	var addrs, peers []string
+	for i := 0; i < 2; i++ {
+		port, err := getFreePort()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		addr := "127.0.0.1:" + strconv.Itoa(port)
+		mport, err := getFreePort()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		mc := memberlist.DefaultLocalConfig()
+		mc.Name = addr
+		mc.BindAddr = "127.0.0.1"
+		mc.BindPort = mport
+		db, err := olric.New(&olric.Config{Name: addr, Peers: peers, MemberlistConfig: mc})
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			rerr := db.Start()
+			if rerr != nil {
+				log.Printf("[ERROR] Expected nil. Got %v", rerr)
+			}
+			close(done)
+		}()
+		defer func() {
+			serr := db.Shutdown(context.Background())
+			if serr != nil {
+				t.Errorf("Expected nil. Got %v", serr)
+			}
+			<-done
+		}()
+		time.Sleep(100 * time.Millisecond)
+		nodes = append(nodes, db)
+		addrs = append(addrs, addr)
+		peers = append(peers, mc.BindAddr+":"+strconv.Itoa(mport))
+	}
+
+	cfg := *testConfig
+	cfg.Addrs = addrs[:1]
+	cfg.DirectRouting = true
+	c, err := New(&cfg, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer c.Close()
+
+	// Wait for the coordinator to distribute the partitions.
+	owned := func() bool {
+		c.routing.mu.RLock()
+		defer c.routing.mu.RUnlock()
+		for _, owner := range c.routing.owners {
+			if owner == addrs[1] {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !owned() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected partitions on %s", addrs[1])
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err = c.refreshRouting(); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// A stale routing table which points at the first node is corrected by the StatusMoved responses.
+	stale := make([]string, olric.DefaultPartitionCount)
+	for i := range stale {
+		stale[i] = addrs[0]
+	}
+	c.routing.update(stale)
+	dm := c.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(strconv.Itoa(i), i)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	if !owned() {
+		t.Fatalf("Expected the routing table to be updated by StatusMoved")
+	}
+	for i := 0; i < 100; i++ {
+		value, err := dm.Get(strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if value != i {
+			t.Fatalf("Expected %d. Got: %v", i, value)
+		}
+	}
+}
+
+func TestClient_IncrBy(t *testing.T) {
+	db, done, err := newOlric()
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		serr := db.Shutdown(context.Background())
+		if serr != nil {
+			t.Errorf("Expected nil. Got %v", serr)
+		}
+		<-done
+	}()
+
+	c, err := New(testConfig, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := c.NewDMap("atomic_test")
+	res, err := dm.IncrBy("incr", 1, 100)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if res != 101 {
+		t.Fatalf("Expected 101. Got: %d", res)
+	}
+	res, err = dm.Decr("incr", 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if res != 100 {
+		t.Fatalf("Expected 100. Got: %d", res)
+	}
+	_, err = dm.IncrBy("max", 1, math.MaxInt64)
+	if err != olric.ErrOverflow {
+		t.Fatalf("Expected olric.ErrOverflow. Got: %v", err)
 	}
 }
@@ -0,0 +1,123 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// PipelineResult is the result of an operation in a pipeline. Value is only set for Get.
+type PipelineResult struct {
+	Value interface{}
+	Err   error
+}
+
+// Pipeline buffers Put, Get and Delete operations on any DMap and sends them to a node in one network
+// exchange by Flush. It amortizes the network latency of many small operations.
+//
+// The node processes the operations of a pipeline one by one in the order they are added, so an operation
+// sees the effects of the previous ones on the same key. The operations are independent otherwise: a failed
+// operation doesn't stop the next ones and its error is returned in its result. If the exchange fails with
+// a network error, Flush returns the error and some of the operations may have been applied. A pipeline is
+// not retried on the other nodes. It's thread-safe.
+type Pipeline struct {
+	c *Client
+
+	mu   sync.Mutex
+	reqs []*protocol.Message
+}
+
+// NewPipeline returns a new, empty Pipeline.
+func (c *Client) NewPipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+func (p *Pipeline) add(op protocol.OpCode, req *protocol.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	req.Op = op
+	p.reqs = append(p.reqs, req)
+}
+
+// Put adds a Put operation to the pipeline. It returns an error if the value cannot be serialized,
+// then the operation is not added.
+func (p *Pipeline) Put(dmap, key string, value interface{}) error {
+	data, err := p.c.serializer.Marshal(value)
+	if err != nil {
+		return err
+	}
+	p.add(protocol.OpExPut, &protocol.Message{
+		DMap:  dmap,
+		Key:   key,
+		Value: data,
+	})
+	return nil
+}
+
+// Get adds a Get operation to the pipeline. Its result has olric.ErrKeyNotFound as error if the key
+// doesn't exist.
+func (p *Pipeline) Get(dmap, key string) {
+	p.add(protocol.OpExGet, &protocol.Message{
+		DMap: dmap,
+		Key:  key,
+	})
+}
+
+// Delete adds a Delete operation to the pipeline.
+func (p *Pipeline) Delete(dmap, key string) {
+	p.add(protocol.OpExDelete, &protocol.Message{
+		DMap: dmap,
+		Key:  key,
+	})
+}
+
+// Len returns the number of buffered operations.
+func (p *Pipeline) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.reqs)
+}
+
+// Flush sends the buffered operations to a randomly selected node and returns their results in the same
+// order. The pipeline is empty after Flush, even if it fails.
+func (p *Pipeline) Flush() ([]PipelineResult, error) {
+	p.mu.Lock()
+	reqs := p.reqs
+	p.reqs = nil
+	p.mu.Unlock()
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+
+	addr := p.c.addrs[rand.Intn(len(p.c.addrs))]
+	resps, err := p.c.client.RequestBatch(addr, reqs)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]PipelineResult, len(resps))
+	for i, resp := range resps {
+		results[i].Err = statusError(resp)
+		if results[i].Err != nil || reqs[i].Op != protocol.OpExGet {
+			continue
+		}
+		var value interface{}
+		results[i].Err = p.c.serializer.Unmarshal(resp.Value, &value)
+		results[i].Value = value
+	}
+	return results, nil
+}
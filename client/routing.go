@@ -0,0 +1,128 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/buraksezer/olric"
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/vmihailenco/msgpack"
+)
+
+// DefaultRoutingRefreshInterval is the default interval of fetching the routing table when DirectRouting is enabled.
+const DefaultRoutingRefreshInterval = time.Minute
+
+// routingTable is the copy of the partition owners of the cluster, it's used to send the requests
+// directly to the owners of the keys.
+type routingTable struct {
+	mu     sync.RWMutex
+	hasher olric.Hasher
+	owners []string
+}
+
+// owner returns the address of the owner of the given key, it's empty if the table is not fetched yet.
+func (r *routingTable) owner(name, key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.owners) == 0 {
+		return ""
+	}
+	// Same with the hash of the keys on the nodes.
+	tmp := name + key
+	hkey := r.hasher.Sum64(*(*[]byte)(unsafe.Pointer(&tmp)))
+	return r.owners[hkey%uint64(len(r.owners))]
+}
+
+// move sets the owner of a partition, it's reported by a node with StatusMoved.
+func (r *routingTable) move(partID uint64, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if partID < uint64(len(r.owners)) {
+		r.owners[partID] = addr
+	}
+}
+
+func (r *routingTable) update(owners []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.owners = owners
+}
+
+// refreshRouting fetches the routing table from a node.
+func (c *Client) refreshRouting() error {
+	resp, err := c.client.Request(protocol.OpUpdateRouting, &protocol.Message{})
+	if err != nil {
+		return err
+	}
+	if err = statusError(resp); err != nil {
+		return err
+	}
+	var owners []string
+	if err = msgpack.Unmarshal(resp.Value, &owners); err != nil {
+		return err
+	}
+	c.routing.update(owners)
+	return nil
+}
+
+// refreshRoutingPeriodically keeps the routing table up to date until the client is closed. The table is
+// fetched first without waiting.
+func (c *Client) refreshRoutingPeriodically(interval time.Duration) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// The requests are sent to the random nodes, which forward them, until a fetch succeeds.
+		_ = c.refreshRouting()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// maxRedirects is the maximum number of StatusMoved responses followed by a request.
+const maxRedirects = 2
+
+// requestOwner sends the request to the owner of its key. It falls back to a random node if the owner
+// is not known or it cannot be reached, the node forwards the request to the owner. A StatusMoved response
+// updates the owner of the partition in the routing table and the request is sent to the new owner.
+func (c *Client) requestOwner(op protocol.OpCode, m *protocol.Message) (*protocol.Message, error) {
+	addr := c.routing.owner(m.DMap, m.Key)
+	for i := 0; addr != "" && i <= maxRedirects; i++ {
+		m.Flags |= protocol.FlagRedirect
+		resp, err := c.client.RequestTo(addr, op, m)
+		if err != nil {
+			break
+		}
+		if resp.Status != protocol.StatusMoved {
+			m.Flags &^= protocol.FlagRedirect
+			return resp, nil
+		}
+		extra, ok := resp.Extra.(protocol.MovedExtra)
+		if !ok {
+			break
+		}
+		addr = string(resp.Value)
+		c.routing.move(extra.PartID, addr)
+	}
+	m.Flags &^= protocol.FlagRedirect
+	return c.client.Request(op, m)
+}
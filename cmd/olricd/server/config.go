@@ -29,16 +29,73 @@ const (
 )
 
 type olricd struct {
-	Name            string  `toml:"name"`
-	CertFile        string  `toml:"certFile"`
-	KeyFile         string  `toml:"keyFile"`
-	BackupMode      int     `toml:"backupMode"`
-	PartitionCount  uint64  `toml:"partitionCount"`
-	BackupCount     int     `toml:"backupCount"`
-	LoadFactor      float64 `toml:"loadFactor"`
-	Serializer      string  `toml:"serializer"`
-	KeepAlivePeriod string  `toml:"keepAlivePeriod"`
+	Name                  string  `toml:"name"`
+	CertFile              string  `toml:"certFile"`
+	KeyFile               string  `toml:"keyFile"`
+	CAFile                string  `toml:"caFile"`
+	ClientAuth            string  `toml:"clientAuth"`
+	PlaintextAddr         string  `toml:"plaintextAddr"`
+	AuthSecret            string  `toml:"authSecret"`
+	AuthTimeout           string  `toml:"authTimeout"`
+	ReadTimeout           string  `toml:"readTimeout"`
+	OutboundQueueSize     int     `toml:"outboundQueueSize"`
+	BackpressurePolicy    string  `toml:"backpressurePolicy"`
+	MaxConnections        int     `toml:"maxConnections"`
+	ConnRateLimit         float64 `toml:"connRateLimit"`
+	BackupMode            int     `toml:"backupMode"`
+	Zone                  string  `toml:"zone"`
+	Rack                  string  `toml:"rack"`
+	ReadOnly              bool    `toml:"readOnly"`
+	PartitionCount        uint64  `toml:"partitionCount"`
+	BackupCount           int     `toml:"backupCount"`
+	WriteQuorum           int     `toml:"writeQuorum"`
+	ReadQuorum            int     `toml:"readQuorum"`
+	QuorumLossPolicy      string  `toml:"quorumLossPolicy"`
+	ReadRepair            bool    `toml:"readRepair"`
+	MaxHints              int     `toml:"maxHints"`
+	BackupBatchWindow     string  `toml:"backupBatchWindow"`
+	BackupBatchSize       int     `toml:"backupBatchSize"`
+	AntiEntropyInterval   string  `toml:"antiEntropyInterval"`
+	TombstoneTTL          string  `toml:"tombstoneTTL"`
+	RebalanceRate         int     `toml:"rebalanceRate"`
+	RebalanceConcurrency  int     `toml:"rebalanceConcurrency"`
+	RebalanceThreshold    float64 `toml:"rebalanceThreshold"`
+	SlowLogThreshold      string  `toml:"slowLogThreshold"`
+	SlowLogSize           int     `toml:"slowLogSize"`
+	EnableMetrics         bool    `toml:"enableMetrics"`
+	MetricsAddr           string  `toml:"metricsAddr"`
+	HealthAddr            string  `toml:"healthAddr"`
+	LoadFactor            float64 `toml:"loadFactor"`
+	Serializer            string  `toml:"serializer"`
+	Compression           string  `toml:"compression"`
+	KeepAlivePeriod       string  `toml:"keepAlivePeriod"`
+	DisableNoDelay        bool    `toml:"disableNoDelay"`
+	MaxValueSize          int     `toml:"maxValueSize"`
+	ExpirySweepInterval   string  `toml:"expirySweepInterval"`
+	ExpirySweepSampleSize int     `toml:"expirySweepSampleSize"`
+	TTLJitter             float64 `toml:"ttlJitter"`
+	BufferPoolInitialSize int     `toml:"bufferPoolInitialSize"`
+	BufferPoolMaxSize     int     `toml:"bufferPoolMaxSize"`
+}
+
+// dmap contains configuration variables of a DMap, it's defined in a dmaps.<name> section.
+type dmap struct {
 	MaxValueSize    int     `toml:"maxValueSize"`
+	EvictionPolicy  string  `toml:"evictionPolicy"`
+	MaxKeys         int     `toml:"maxKeys"`
+	MaxInuse        int     `toml:"maxInuse"`
+	MaxIdleDuration string  `toml:"maxIdleDuration"`
+	TTLJitter       float64 `toml:"ttlJitter"`
+	DefaultTTL      string  `toml:"defaultTTL"`
+	RawValues       bool    `toml:"rawValues"`
+	RateLimit       float64 `toml:"rateLimit"`
+}
+
+// namespace contains configuration variables of a namespace, it's defined in a namespaces.<name> section.
+type namespace struct {
+	MaxKeys  int  `toml:"maxKeys"`
+	MaxInuse int  `toml:"maxInuse"`
+	DMaps    dmap `toml:"dmaps"`
 }
 
 type snapshot struct {
@@ -47,6 +104,14 @@ type snapshot struct {
 	Dir            string  `toml:"dir"`
 	GCInterval     string  `toml:"gcInterval"`
 	GCDiscardRatio float64 `toml:"gcDiscardRatio"`
+	WAL            bool    `toml:"wal"`
+	WALSyncPolicy  string  `toml:"walSyncPolicy"`
+}
+
+// encryption contains the keys to encrypt the values in the partitions. The keys are base64 encoded.
+type encryption struct {
+	KeyVersion uint8             `toml:"keyVersion"`
+	Keys       map[string]string `toml:"keys"`
 }
 
 // logging contains configuration variables of logging section of config file.
@@ -73,10 +138,14 @@ type memberlist struct {
 
 // Config is the main configuration struct
 type Config struct {
-	Memberlist memberlist
-	Logging    logging
-	Olricd     olricd
-	Snapshot   snapshot
+	Memberlist        memberlist
+	Logging           logging
+	Olricd            olricd
+	Snapshot          snapshot
+	Encryption        encryption
+	DMaps             map[string]dmap
+	Namespaces        map[string]namespace
+	OperationTimeouts map[string]string
 }
 
 // NewConfig creates a new configuration object of olricd
@@ -17,11 +17,14 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -30,7 +33,6 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/buraksezer/olric"
-	"github.com/dgraph-io/badger"
 	"github.com/hashicorp/logutils"
 	"github.com/pkg/errors"
 )
@@ -79,6 +81,16 @@ func New(c *Config) (*Olricd, error) {
 		return nil, fmt.Errorf("invalid serializer: %s", c.Olricd.Serializer)
 	}
 
+	// Compression is disabled by default.
+	var codec olric.CompressionCodec
+	if c.Olricd.Compression != "" {
+		var err error
+		codec, err = olric.NewCompressionCodec(c.Olricd.Compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	mc, err := newMemberlistConf(c)
 	if err != nil {
 		return nil, err
@@ -92,22 +104,182 @@ func New(c *Config) (*Olricd, error) {
 				fmt.Sprintf("failed to parse olricd.keepAlivePeriod: '%s'", c.Olricd.KeepAlivePeriod))
 		}
 	}
+	var expirySweepInterval time.Duration
+	if c.Olricd.ExpirySweepInterval != "" {
+		expirySweepInterval, err = time.ParseDuration(c.Olricd.ExpirySweepInterval)
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse olricd.expirySweepInterval: '%s'", c.Olricd.ExpirySweepInterval))
+		}
+	}
+	var antiEntropyInterval time.Duration
+	if c.Olricd.AntiEntropyInterval != "" {
+		antiEntropyInterval, err = time.ParseDuration(c.Olricd.AntiEntropyInterval)
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse olricd.antiEntropyInterval: '%s'", c.Olricd.AntiEntropyInterval))
+		}
+	}
+	var tombstoneTTL time.Duration
+	if c.Olricd.TombstoneTTL != "" {
+		tombstoneTTL, err = time.ParseDuration(c.Olricd.TombstoneTTL)
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse olricd.tombstoneTTL: '%s'", c.Olricd.TombstoneTTL))
+		}
+	}
+	var backupBatchWindow time.Duration
+	if c.Olricd.BackupBatchWindow != "" {
+		backupBatchWindow, err = time.ParseDuration(c.Olricd.BackupBatchWindow)
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse olricd.backupBatchWindow: '%s'", c.Olricd.BackupBatchWindow))
+		}
+	}
+	var slowLogThreshold time.Duration
+	if c.Olricd.SlowLogThreshold != "" {
+		slowLogThreshold, err = time.ParseDuration(c.Olricd.SlowLogThreshold)
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse olricd.slowLogThreshold: '%s'", c.Olricd.SlowLogThreshold))
+		}
+	}
+	var authTimeout time.Duration
+	if c.Olricd.AuthTimeout != "" {
+		authTimeout, err = time.ParseDuration(c.Olricd.AuthTimeout)
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse olricd.authTimeout: '%s'", c.Olricd.AuthTimeout))
+		}
+	}
+	var readTimeout time.Duration
+	if c.Olricd.ReadTimeout != "" {
+		readTimeout, err = time.ParseDuration(c.Olricd.ReadTimeout)
+		if err != nil {
+			return nil, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse olricd.readTimeout: '%s'", c.Olricd.ReadTimeout))
+		}
+	}
+	var clientAuth tls.ClientAuthType
+	switch c.Olricd.ClientAuth {
+	case "", "none":
+		clientAuth = tls.NoClientCert
+	case "request":
+		clientAuth = tls.RequestClientCert
+	case "require":
+		clientAuth = tls.RequireAnyClientCert
+	case "verify-if-given":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require-and-verify":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client auth mode: %s", c.Olricd.ClientAuth)
+	}
 	s.config = &olric.Config{
-		Name:             c.Olricd.Name,
-		MemberlistConfig: mc,
-		KeyFile:          c.Olricd.KeyFile,
-		CertFile:         c.Olricd.CertFile,
-		LogLevel:         c.Logging.Level,
-		Peers:            c.Memberlist.Peers,
-		PartitionCount:   c.Olricd.PartitionCount,
-		BackupCount:      c.Olricd.BackupCount,
-		BackupMode:       c.Olricd.BackupMode,
-		LoadFactor:       c.Olricd.LoadFactor,
-		Logger:           s.logger,
-		Hasher:           olric.NewDefaultHasher(),
-		Serializer:       serializer,
-		KeepAlivePeriod:  keepAlivePeriod,
-		MaxValueSize:     c.Olricd.MaxValueSize,
+		Name:                  c.Olricd.Name,
+		MemberlistConfig:      mc,
+		KeyFile:               c.Olricd.KeyFile,
+		CertFile:              c.Olricd.CertFile,
+		CAFile:                c.Olricd.CAFile,
+		ClientAuth:            clientAuth,
+		PlaintextAddr:         c.Olricd.PlaintextAddr,
+		AuthTimeout:           authTimeout,
+		ReadTimeout:           readTimeout,
+		OutboundQueueSize:     c.Olricd.OutboundQueueSize,
+		BackpressurePolicy:    olric.BackpressurePolicy(c.Olricd.BackpressurePolicy),
+		MaxConnections:        c.Olricd.MaxConnections,
+		ConnRateLimit:         c.Olricd.ConnRateLimit,
+		LogLevel:              c.Logging.Level,
+		Peers:                 c.Memberlist.Peers,
+		PartitionCount:        c.Olricd.PartitionCount,
+		BackupCount:           c.Olricd.BackupCount,
+		BackupMode:            c.Olricd.BackupMode,
+		Zone:                  c.Olricd.Zone,
+		Rack:                  c.Olricd.Rack,
+		ReadOnly:              c.Olricd.ReadOnly,
+		WriteQuorum:           c.Olricd.WriteQuorum,
+		ReadQuorum:            c.Olricd.ReadQuorum,
+		QuorumLossPolicy:      olric.QuorumLossPolicy(c.Olricd.QuorumLossPolicy),
+		ReadRepair:            c.Olricd.ReadRepair,
+		MaxHints:              c.Olricd.MaxHints,
+		BackupBatchWindow:     backupBatchWindow,
+		BackupBatchSize:       c.Olricd.BackupBatchSize,
+		AntiEntropyInterval:   antiEntropyInterval,
+		TombstoneTTL:          tombstoneTTL,
+		RebalanceRate:         c.Olricd.RebalanceRate,
+		RebalanceConcurrency:  c.Olricd.RebalanceConcurrency,
+		RebalanceThreshold:    c.Olricd.RebalanceThreshold,
+		SlowLogThreshold:      slowLogThreshold,
+		SlowLogSize:           c.Olricd.SlowLogSize,
+		EnableMetrics:         c.Olricd.EnableMetrics,
+		MetricsAddr:           c.Olricd.MetricsAddr,
+		HealthAddr:            c.Olricd.HealthAddr,
+		LoadFactor:            c.Olricd.LoadFactor,
+		Logger:                s.logger,
+		Hasher:                olric.NewDefaultHasher(),
+		Serializer:            serializer,
+		CompressionCodec:      codec,
+		KeepAlivePeriod:       keepAlivePeriod,
+		DisableNoDelay:        c.Olricd.DisableNoDelay,
+		MaxValueSize:          c.Olricd.MaxValueSize,
+		ExpirySweepInterval:   expirySweepInterval,
+		ExpirySweepSampleSize: c.Olricd.ExpirySweepSampleSize,
+		TTLJitter:             c.Olricd.TTLJitter,
+		BufferPoolInitialSize: c.Olricd.BufferPoolInitialSize,
+		BufferPoolMaxSize:     c.Olricd.BufferPoolMaxSize,
+	}
+	if c.Olricd.AuthSecret != "" {
+		s.config.Authenticator = olric.NewSecretAuthenticator([]byte(c.Olricd.AuthSecret))
+		s.config.Credential = []byte(c.Olricd.AuthSecret)
+	}
+	if len(c.DMaps) != 0 {
+		s.config.DMaps = make(map[string]olric.DMapConfig)
+		for name, dc := range c.DMaps {
+			s.config.DMaps[name], err = newDMapConfig("dmaps."+name, dc)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(c.Namespaces) != 0 {
+		s.config.Namespaces = make(map[string]olric.NamespaceConfig)
+		for name, nc := range c.Namespaces {
+			dc, err := newDMapConfig("namespaces."+name+".dmaps", nc.DMaps)
+			if err != nil {
+				return nil, err
+			}
+			s.config.Namespaces[name] = olric.NamespaceConfig{
+				MaxKeys:  nc.MaxKeys,
+				MaxInuse: nc.MaxInuse,
+				DMaps:    dc,
+			}
+		}
+	}
+	if len(c.Encryption.Keys) != 0 {
+		s.config.EncryptionKeyVersion = c.Encryption.KeyVersion
+		s.config.EncryptionKeys = make(map[uint8][]byte)
+		for version, key := range c.Encryption.Keys {
+			ver, err := strconv.ParseUint(version, 10, 8)
+			if err != nil {
+				return nil, errors.WithMessage(err,
+					fmt.Sprintf("failed to parse encryption.keys: '%s'", version))
+			}
+			s.config.EncryptionKeys[uint8(ver)], err = base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return nil, errors.WithMessage(err,
+					fmt.Sprintf("failed to parse encryption.keys.%s", version))
+			}
+		}
+	}
+	if len(c.OperationTimeouts) != 0 {
+		s.config.OperationTimeouts = make(map[string]time.Duration)
+		for name, timeout := range c.OperationTimeouts {
+			s.config.OperationTimeouts[name], err = time.ParseDuration(timeout)
+			if err != nil {
+				return nil, errors.WithMessage(err,
+					fmt.Sprintf("failed to parse operationTimeouts.%s: '%s'", name, timeout))
+			}
+		}
 	}
 	if c.Snapshot.Enabled {
 		s.config.OperationMode = olric.OpInMemoryWithSnapshot
@@ -137,14 +309,47 @@ func New(c *Config) (*Olricd, error) {
 			}
 			s.config.SnapshotInterval = interval
 		}
-		opt := &badger.DefaultOptions
-		opt.Dir = c.Snapshot.Dir
-		opt.ValueDir = c.Snapshot.Dir
-		s.config.BadgerOptions = opt
+		s.config.SnapshotDir = c.Snapshot.Dir
+		s.config.EnableWAL = c.Snapshot.WAL
+		s.config.WALSyncPolicy = olric.WALSyncPolicy(c.Snapshot.WALSyncPolicy)
 	}
 	return s, nil
 }
 
+// newDMapConfig converts the given dmap section to a DMapConfig. section is the name of the section
+// in the config file.
+func newDMapConfig(section string, dc dmap) (olric.DMapConfig, error) {
+	var maxIdleDuration time.Duration
+	if dc.MaxIdleDuration != "" {
+		var err error
+		maxIdleDuration, err = time.ParseDuration(dc.MaxIdleDuration)
+		if err != nil {
+			return olric.DMapConfig{}, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse %s.maxIdleDuration: '%s'", section, dc.MaxIdleDuration))
+		}
+	}
+	var defaultTTL time.Duration
+	if dc.DefaultTTL != "" {
+		var err error
+		defaultTTL, err = time.ParseDuration(dc.DefaultTTL)
+		if err != nil {
+			return olric.DMapConfig{}, errors.WithMessage(err,
+				fmt.Sprintf("failed to parse %s.defaultTTL: '%s'", section, dc.DefaultTTL))
+		}
+	}
+	return olric.DMapConfig{
+		MaxValueSize:    dc.MaxValueSize,
+		EvictionPolicy:  olric.EvictionPolicy(dc.EvictionPolicy),
+		MaxKeys:         dc.MaxKeys,
+		MaxInuse:        dc.MaxInuse,
+		MaxIdleDuration: maxIdleDuration,
+		TTLJitter:       dc.TTLJitter,
+		DefaultTTL:      defaultTTL,
+		RawValues:       dc.RawValues,
+		RateLimit:       dc.RateLimit,
+	}, nil
+}
+
 func (s *Olricd) waitForInterrupt() {
 	shutDownChan := make(chan os.Signal, 1)
 	signal.Notify(shutDownChan, syscall.SIGTERM, syscall.SIGINT)
@@ -0,0 +1,97 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/snappy"
+)
+
+// CompressionCodec interface is responsible for compressing/decompressing values to transmit over network
+// between Olric nodes and clients. DMap names, keys and extras are never compressed.
+type CompressionCodec = protocol.CompressionCodec
+
+var codecs = map[string]func() CompressionCodec{
+	"gzip":   NewGzipCodec,
+	"snappy": NewSnappyCodec,
+}
+
+// RegisterCompressionCodec registers a compression codec with the given name, so it can be selected by
+// its name, i.e. in the configuration file of olricd. gzip and snappy are registered by default. It's not
+// safe to call RegisterCompressionCodec concurrently with NewCompressionCodec.
+func RegisterCompressionCodec(name string, factory func() CompressionCodec) {
+	codecs[name] = factory
+}
+
+// NewCompressionCodec returns a new codec registered with the given name.
+func NewCompressionCodec(name string) (CompressionCodec, error) {
+	factory, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid compression codec: %s", name)
+	}
+	return factory(), nil
+}
+
+// Compression codec implementation which uses compress/gzip.
+type gzipCodec struct {
+	level int
+}
+
+// NewGzipCodec returns a gzip compression codec with the default compression level.
+func NewGzipCodec() CompressionCodec {
+	return CompressionCodec(gzipCodec{level: gzip.DefaultCompression})
+}
+
+func (g gzipCodec) Compress(data []byte) []byte {
+	var res bytes.Buffer
+	// NewWriterLevel only fails with an invalid compression level and writing
+	// to a bytes.Buffer never fails.
+	w, _ := gzip.NewWriterLevel(&res, g.level)
+	_, _ = w.Write(data)
+	_ = w.Close()
+	return res.Bytes()
+}
+
+func (g gzipCodec) Decompress(data []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+}
+
+// Compression codec implementation which uses the block format of Snappy. It's faster than gzip
+// and compresses less.
+type snappyCodec struct{}
+
+// NewSnappyCodec returns a Snappy compression codec.
+func NewSnappyCodec() CompressionCodec {
+	return CompressionCodec(snappyCodec{})
+}
+
+func (s snappyCodec) Compress(data []byte) []byte {
+	return snappy.Encode(data)
+}
+
+func (s snappyCodec) Decompress(data []byte, limit int) ([]byte, error) {
+	return snappy.Decode(data, limit)
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressionCodec(t *testing.T) {
+	data := bytes.Repeat([]byte("olric distributed cache "), 1<<10)
+	for _, name := range []string{"gzip", "snappy"} {
+		codec, err := NewCompressionCodec(name)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		compressed := codec.Compress(data)
+		if len(compressed) >= len(data) {
+			t.Fatalf("Expected %s to compress the data. Length: %d", name, len(compressed))
+		}
+		decompressed, err := codec.Decompress(compressed, len(data))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("Decompressed data is different for %s", name)
+		}
+		// The data over the limit is not decompressed.
+		decompressed, err = codec.Decompress(compressed, 100)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if len(decompressed) != 101 {
+			t.Fatalf("Expected 101 bytes from %s. Got: %d", name, len(decompressed))
+		}
+	}
+	if _, err := NewCompressionCodec("lz4"); err == nil {
+		t.Fatalf("Expected an error for an unknown codec")
+	}
+}
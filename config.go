@@ -15,6 +15,7 @@
 package olric
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -44,6 +45,42 @@ const (
 
 	// DefaultLogLevel determines the log level without extra configuration. It's DEBUG.
 	DefaultLogLevel = "DEBUG"
+
+	// DefaultExpirySweepInterval is the default interval between two expiry sweeps of a partition.
+	DefaultExpirySweepInterval = time.Second
+
+	// DefaultExpirySweepSampleSize is the default number of keys sampled from a DMap in an expiry sweep round.
+	DefaultExpirySweepSampleSize = 20
+
+	// DefaultMaxHints is the default maximum number of pending hints on a node.
+	DefaultMaxHints = 1 << 16
+
+	// DefaultBackupBatchSize is the default maximum number of backup writes sent in a batch.
+	DefaultBackupBatchSize = 128
+
+	// DefaultAntiEntropyInterval is the default interval between two anti-entropy rounds.
+	DefaultAntiEntropyInterval = time.Minute
+
+	// DefaultSlowLogSize is the default maximum number of entries in the slow log.
+	DefaultSlowLogSize = 128
+
+	// DefaultMetricsAddr is the default bind address of the metrics endpoint.
+	DefaultMetricsAddr = "127.0.0.1:3330"
+
+	// DefaultAuthTimeout is the default maximum time that a connection can stay unauthenticated.
+	DefaultAuthTimeout = 10 * time.Second
+
+	// DefaultKeepAlivePeriod is the default period of the TCP keepalive probes.
+	DefaultKeepAlivePeriod = 15 * time.Second
+
+	// DefaultOutboundQueueSize is the default number of the responses queued for a connection.
+	DefaultOutboundQueueSize = 64
+
+	// DefaultReadTimeout is the default maximum time to read a request after its first bytes arrive.
+	DefaultReadTimeout = 30 * time.Second
+
+	// DefaultTombstoneTTL is the default time that a deleted key is remembered.
+	DefaultTombstoneTTL = 5 * time.Minute
 )
 
 // OpMode is the type for operation modes.
@@ -59,6 +96,133 @@ const (
 	OpInMemoryWithSnapshot
 )
 
+// WALSyncPolicy determines when the write-ahead log is flushed to disk.
+type WALSyncPolicy string
+
+const (
+	// WALSyncAlways flushes the write-ahead log after every mutation. It's the safest and slowest one.
+	WALSyncAlways WALSyncPolicy = "always"
+
+	// WALSyncEverySec flushes the write-ahead log once per second. A crash may lose the last second of mutations.
+	WALSyncEverySec WALSyncPolicy = "everysec"
+
+	// WALSyncNo leaves flushing the write-ahead log to the operating system.
+	WALSyncNo WALSyncPolicy = "no"
+)
+
+// BackpressurePolicy determines what the server does when the outbound queue of a connection is full,
+// i.e. the client sends requests faster than it reads the responses.
+type BackpressurePolicy string
+
+const (
+	// BackpressureBlock stops reading the requests of the connection until its queue has room.
+	BackpressureBlock BackpressurePolicy = "block"
+
+	// BackpressureClose closes the connection. The queued responses are discarded.
+	BackpressureClose BackpressurePolicy = "close-connection"
+)
+
+// QuorumLossPolicy determines what a node does when it cannot reach Config.WriteQuorum nodes, i.e. too many
+// nodes are down.
+type QuorumLossPolicy string
+
+const (
+	// QuorumLossReadOnly rejects the writes of the clients with ErrQuorumLost and keeps serving the reads from
+	// the available replicas, so the caches stay useful during a partial outage.
+	QuorumLossReadOnly QuorumLossPolicy = "read-only"
+
+	// QuorumLossUnavailable rejects all the requests of the clients with ErrQuorumLost.
+	QuorumLossUnavailable QuorumLossPolicy = "unavailable"
+)
+
+// EvictionPolicy determines how the keys are evicted when a DMap exceeds its budget.
+type EvictionPolicy string
+
+const (
+	// NoEviction never evicts the keys to keep a DMap within its budget. The keys are only
+	// removed when their TTL expires.
+	NoEviction EvictionPolicy = "none"
+
+	// LRUEviction evicts the least recently used keys.
+	LRUEviction EvictionPolicy = "LRU"
+
+	// LFUEviction evicts the least frequently used keys. The access counters decay over time.
+	LFUEviction EvictionPolicy = "LFU"
+
+	// TTLOnlyEviction evicts the keys which are closest to expire. The keys without a TTL are never evicted.
+	TTLOnlyEviction EvictionPolicy = "TTL-only"
+)
+
+// DMapConfig is the configuration of a DMap. All the nodes in the cluster should have the
+// same DMap configuration.
+type DMapConfig struct {
+	// MaxValueSize is the maximum size of a value in bytes which can be stored in this DMap.
+	// Default value is Config.MaxValueSize.
+	MaxValueSize int
+
+	// EvictionPolicy is applied when a partition of this DMap exceeds MaxKeys or MaxInuse.
+	// Default value is NoEviction.
+	EvictionPolicy EvictionPolicy
+
+	// MaxKeys is the maximum number of keys in a partition of this DMap.
+	MaxKeys int
+
+	// MaxInuse is the maximum number of bytes used by the keys and values in a partition of this DMap.
+	MaxInuse int
+
+	// MaxIdleDuration is the maximum time that a key can stay in this DMap without being accessed.
+	// The idle keys are evicted even if they have no TTL. Zero means no limit.
+	MaxIdleDuration time.Duration
+
+	// TTLJitter randomizes the expiry of the keys in this DMap like Config.TTLJitter.
+	// Default value is Config.TTLJitter.
+	TTLJitter float64
+
+	// DefaultTTL is the TTL of the keys which are written without one, i.e. by Put, PutIf, PutMany or Incr.
+	// A TTL given to PutEx or Expire takes precedence over it. The owner of the key converts it to an
+	// absolute expiry, so the backups expire the key at the same time. Zero means no default TTL.
+	DefaultTTL time.Duration
+
+	// RawValues stores the values of this DMap as they are instead of encoding them with Config.Serializer.
+	// The values must be byte slices and Get returns exactly the bytes stored. Incr, Decr and IncrByFloat
+	// don't work on raw values. The clients should use NewRawSerializer for this DMap.
+	RawValues bool
+
+	// Indexes maps the names of the indexed fields to the functions which extract them from the values.
+	// The primary owners of the partitions index the keys as the values are written, GetByIndex returns
+	// the keys with a given field value. The functions are called under the lock of a partition, they
+	// should be fast and they must not call the DMaps.
+	Indexes map[string]IndexFunc
+
+	// RateLimit is the maximum number of requests per second of the clients to this DMap on a node, so a
+	// hot DMap cannot saturate the node. The requests beyond it fail with ErrRateLimited. It can be changed
+	// without restart, see Olric.SetDMapRateLimit. Zero means no limit.
+	RateLimit float64
+}
+
+// NamespaceSeparator separates the namespace from the rest of a DMap name. The DMap "app1/users"
+// belongs to the namespace "app1".
+const NamespaceSeparator = "/"
+
+// NamespaceConfig is the configuration of a namespace. A namespace groups the DMaps of a tenant,
+// so the tenants sharing a cluster can be given separate quotas. The quotas are enforced by every node
+// for the keys owned by it, the backups are not counted. All the nodes in the cluster should have the
+// same namespace configuration.
+type NamespaceConfig struct {
+	// MaxKeys is the maximum number of keys in the DMaps of this namespace on a node. A write which adds
+	// a new key beyond it fails with ErrQuotaExceeded. Zero means no limit.
+	MaxKeys int
+
+	// MaxInuse is the maximum number of bytes used by the keys and values in the DMaps of this namespace
+	// on a node. A write beyond it fails with ErrQuotaExceeded. Zero means no limit.
+	MaxInuse int
+
+	// DMaps is the default configuration of the DMaps in this namespace which are not listed in
+	// Config.DMaps. Its EvictionPolicy, MaxKeys, MaxInuse, MaxIdleDuration, TTLJitter and DefaultTTL
+	// apply to every DMap of the namespace separately. MaxValueSize is only applied by Config.DMaps.
+	DMaps DMapConfig
+}
+
 // Config is the configuration for creating a Olric instance.
 type Config struct {
 	LogLevel string
@@ -70,14 +234,23 @@ type Config struct {
 
 	OperationMode OpMode
 
+	// KeepAlivePeriod is the period of the TCP keepalive probes on the accepted and dialed connections.
+	// The probes detect the dead peers of long-lived idle connections. Default value is DefaultKeepAlivePeriod,
+	// a negative value disables the probes.
 	KeepAlivePeriod time.Duration
 
+	// DisableNoDelay enables the Nagle algorithm on the connections. TCP_NODELAY is set by default, so the
+	// small messages are sent without delay. Disabling it may improve throughput at the cost of latency.
+	DisableNoDelay bool
+
 	DialTimeout time.Duration
 
 	// The list of host:port which are used by memberlist for discovery. Don't confuse it with Name.
 	Peers []string
 
-	// PartitionCount is 271, by default.
+	// PartitionCount is 271, by default. It's a cluster-wide setting, a node which has a different
+	// PartitionCount cannot join the cluster and Start returns ErrPartitionCountMismatch. Changing it
+	// requires a full cluster restart.
 	PartitionCount uint64
 
 	// BackupCount is 0, by default.
@@ -86,25 +259,189 @@ type Config struct {
 	// Default value is SyncBackupMode.
 	BackupMode int
 
+	// Zone and Rack are the topology labels of this node, i.e. the availability zone and the rack of
+	// the server. The backups of a partition are placed in the other zones than its primary owner and
+	// the other backups, then in the other racks. If there are not enough zones, the backups share
+	// the zones and a warning is logged. The placement is the default one if the labels are empty.
+	Zone string
+	Rack string
+
+	// ReadOnly makes this node a read-only replica. It holds the backups of the partitions but never
+	// becomes a primary owner, so it scales the read capacity without adding to the write coordination.
+	// The reads of the keys which it backs up are served from its backups, they may be stale with
+	// AsyncBackupMode or a failing backup write. The writes of the clients are rejected with ErrReadOnly,
+	// the DMap methods of the embedded node bypass the check and forward them to the primary owners.
+	// Unlocking and leasing a lock are not rejected, they're redirected to the owners.
+	ReadOnly bool
+
+	// ReplicaCount is the number of copies of a key in the cluster, including the primary one.
+	// It overrides BackupCount if it's set, BackupCount is ReplicaCount-1.
+	ReplicaCount int
+
+	// WriteQuorum is the number of replicas, including the primary one, which have to acknowledge
+	// a write. Put returns ErrWriteQuorum otherwise. It requires SyncBackupMode. If it's zero, a write
+	// is acknowledged if it's applied on one of the backups, at least.
+	WriteQuorum int
+
+	// ReadQuorum is the number of replicas, including the primary one, which have to respond a read.
+	// Get returns ErrReadQuorum otherwise. Zero and one mean that the primary owner responds alone.
+	ReadQuorum int
+
+	// QuorumLossPolicy determines what happens when the cluster has less alive nodes than WriteQuorum. The
+	// quorum is checked as the nodes join and leave, see Olric.OnQuorumChange. Default value is
+	// QuorumLossReadOnly. It has no effect if WriteQuorum is zero or one. It's applied to the requests of the
+	// clients, the DMap methods of the embedded node bypass it. Unlocking and leasing a lock are served like
+	// the reads.
+	QuorumLossPolicy QuorumLossPolicy
+
+	// ReadRepair enables pushing the newest replica of a key to the stale replicas found by
+	// a quorum read. The replicas are compared by the timestamps of their last writes.
+	ReadRepair bool
+
+	// BackupBatchWindow enables the batching of the backup writes. The writes to the same backup owner
+	// and DMap within the window are sent in one request, it cuts the framing and syscall overhead of
+	// write-heavy workloads at the cost of up to BackupBatchWindow latency for the synchronous writes.
+	// A batch is sent immediately when it has BackupBatchSize writes. Zero disables it, by default.
+	// All the nodes must support OpPutBackupBatch before it's enabled.
+	BackupBatchWindow time.Duration
+
+	// BackupBatchSize is the maximum number of backup writes in a batch. Default value is
+	// DefaultBackupBatchSize.
+	BackupBatchSize int
+
+	// MaxHints is the maximum number of pending hints on this node. A hint is recorded when a write
+	// cannot be applied on a backup owner, it's replayed when the backup owner joins the cluster again.
+	// The writes are not hinted if the store is full. Default value is DefaultMaxHints.
+	MaxHints int
+
+	// AntiEntropyInterval is the interval between two anti-entropy rounds. In a round, the primary owners
+	// compare the Merkle trees of their partitions with the backups and repair the divergent keys. A negative
+	// value disables anti-entropy. Default value is DefaultAntiEntropyInterval.
+	AntiEntropyInterval time.Duration
+
+	// TombstoneTTL is the time that the owners of a key remember its delete. The older copies of the key on
+	// the previous owners and the backups are ignored during this time, so a delete which isn't propagated
+	// yet doesn't resurrect the key when the partitions move. The expired tombstones are reaped in the
+	// background. A negative value disables the tombstones. Default value is DefaultTombstoneTTL.
+	TombstoneTTL time.Duration
+
+	// RebalanceRate is the maximum number of bytes per second sent by this node to move the DMaps to
+	// their new owners when the cluster membership changes. Zero means unlimited, by default.
+	RebalanceRate int
+
+	// RebalanceConcurrency is the maximum number of DMaps moved by this node at the same time.
+	// Zero means unlimited, by default.
+	RebalanceConcurrency int
+
+	// RebalanceThreshold trades the balance of the partitions for less data movement. If it's set, the
+	// partitions stay on their current primary owners when the membership changes, unless the imbalance
+	// of the cluster exceeds the threshold. Then all of the partitions are moved to their owners on the
+	// hash ring. The imbalance is the ratio of the partitions on the most loaded member to the average
+	// minus one, i.e. 0.5 means that a member owns 50% more partitions than the average. The partitions of
+	// the members which have left are always moved. Zero disables it, the partitions always follow the
+	// hash ring by default.
+	RebalanceThreshold float64
+
 	// LoadFactor is used by consistent hashing function. It determines the maximum load
 	// for a server in the cluster. Keep it small.
 	LoadFactor float64
 
 	MaxValueSize int
 
+	// ExpirySweepInterval is the interval between two expiry sweeps of a partition. Every partition
+	// has its own background sweeper which samples the keys and evicts the expired ones.
+	// Default value is DefaultExpirySweepInterval.
+	ExpirySweepInterval time.Duration
+
+	// ExpirySweepSampleSize is the number of keys sampled from a DMap in a sweep round. The sweeper
+	// starts a new round if more than 25% of the sampled keys were expired.
+	// Default value is DefaultExpirySweepSampleSize.
+	ExpirySweepSampleSize int
+
+	// TTLJitter randomizes the expiry of the keys which are written with a TTL, so the keys written
+	// with the same TTL don't expire at the same time. The TTL of a key is shortened by a random amount
+	// of up to TTLJitter times the TTL, 0.1 means up to 10%. The owner of the key applies it and the
+	// backups store the same expiry. It must be between 0 and 1. Zero disables it, by default.
+	TTLJitter float64
+
+	// DMaps contains the DMap specific configuration, keyed by DMap name. The DMaps without
+	// a configuration use the global defaults.
+	DMaps map[string]DMapConfig
+
+	// Namespaces contains the namespace specific configuration, keyed by namespace. The DMaps whose
+	// names don't start with a configured namespace and NamespaceSeparator have no quota.
+	Namespaces map[string]NamespaceConfig
+
+	// MaxKeyLen is the maximum length of a key in bytes which can be received from the network.
+	// It's 65535, the longest key in the protocol, by default. The local DMaps don't check it,
+	// so a key longer than the limit is only rejected if its owner is a remote node.
+	MaxKeyLen int
+
+	// MaxDMapLen is the maximum length of a DMap name in bytes which can be received from
+	// the network. It's 65535, the longest name in the protocol, by default.
+	MaxDMapLen int
+
+	// BufferPoolInitialSize is the initial capacity in bytes of the buffers allocated to read and write
+	// the messages. The buffers grow when needed, it's zero by default.
+	BufferPoolInitialSize int
+
+	// BufferPoolMaxSize is the maximum capacity in bytes of a buffer retained to be reused. The bigger
+	// buffers are dropped, so a few big values don't pin memory. It's 1MB, by default. The buffer pool
+	// is shared by the nodes running in the same process.
+	BufferPoolMaxSize int
+
+	// MaxProtocolVersion is the highest version of Olric Binary Protocol spoken by this node.
+	// Set it to an older version during rolling upgrades until the whole cluster is upgraded.
+	// Default value is protocol.ProtocolVersion.
+	MaxProtocolVersion uint8
+
 	// Default hasher is github.com/cespare/xxhash. You may want to use a different
-	// hasher which implements Hasher interface.
+	// hasher which implements Hasher interface. All nodes in the cluster must use the same hasher,
+	// it cannot be validated when a node joins.
 	Hasher Hasher
 
 	// Default Serializer implementation uses gob for encoding/decoding.
 	Serializer Serializer
 
-	// TLS certificate file for TCP server. If it's empty, TLS is disabled.
+	// CompressionCodec compresses values bigger than CompressionThreshold before sending them
+	// over network. Compression is disabled if it's nil. All the nodes and clients in the
+	// cluster have to use the same codec.
+	CompressionCodec CompressionCodec
+
+	// CompressionThreshold is 1KB, by default.
+	CompressionThreshold int
+
+	// EncryptionKeys are the AES keys to encrypt the values in the partitions, by their versions. A key
+	// must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256. The keys and DMap names are
+	// never encrypted. Encryption is disabled if it's empty. All the nodes in the cluster have to
+	// use the same keys, the encrypted values are moved between them as they are.
+	EncryptionKeys map[uint8][]byte
+
+	// EncryptionKeyVersion is the version of the key in EncryptionKeys to encrypt the new values. Add a new
+	// key and set its version to rotate the keys, the values which have been encrypted with the older ones
+	// are still readable as long as their keys are kept in EncryptionKeys.
+	EncryptionKeyVersion uint8
+
+	// TLS certificate file for TCP server. If it's empty, TLS is disabled. The connections to the
+	// other nodes use TLS and present the same certificate, if it's enabled.
 	CertFile string
 
 	// TLS key file for TCP server. If it's empty, TLS is disabled.
 	KeyFile string
 
+	// CAFile is the PEM encoded CA certificates file to verify the certificates of the other nodes and
+	// the clients. The system roots are used to verify the other nodes, if it's empty.
+	CAFile string
+
+	// ClientAuth is the policy of the TCP server for the certificates of the clients, including the
+	// other nodes. Default value is tls.NoClientCert.
+	ClientAuth tls.ClientAuthType
+
+	// PlaintextAddr is the address of an additional listener which accepts plaintext connections while
+	// TLS is enabled, to migrate a cluster and its clients to TLS without downtime. The other nodes are
+	// always connected over TLS. It's disabled, if it's empty.
+	PlaintextAddr string
+
 	// LogOutput is the writer where logs should be sent. If this is not
 	// set, logging will go to stderr by default. You cannot specify both LogOutput
 	// and Logger at the same time.
@@ -116,11 +453,99 @@ type Config struct {
 	// at the same time.
 	Logger *log.Logger
 
+	// SnapshotInterval is the interval between two synchronizations of the DMaps to the snapshot.
+	// Call Olric.Snapshot to synchronize them immediately.
 	SnapshotInterval time.Duration
 	GCInterval       time.Duration
 	GCDiscardRatio   float64
 	BadgerOptions    *badger.Options
 
+	// SnapshotDir is the directory of the snapshot. It overrides the directory in BadgerOptions.
+	// The current working directory is used, if both of them are empty.
+	SnapshotDir string
+
+	// EnableWAL enables the write-ahead log which records every mutation before it's applied. A crashed
+	// node replays the mutations which are not in the snapshot yet. It requires OpInMemoryWithSnapshot,
+	// the log is kept in the wal directory under the snapshot directory.
+	EnableWAL bool
+
+	// WALSyncPolicy is WALSyncEverySec, by default.
+	WALSyncPolicy WALSyncPolicy
+
+	// SlowLogThreshold is the minimum duration of the operations recorded in the slow log. Zero disables
+	// the slow log. It can be changed without restart, see Olric.SetSlowLogThreshold.
+	SlowLogThreshold time.Duration
+
+	// SlowLogSize is the maximum number of entries in the slow log, the oldest ones are dropped.
+	// Default value is DefaultSlowLogSize. See Olric.SetSlowLogSize.
+	SlowLogSize int
+
+	// Tracer creates a span for every request received or sent by this node, if it's set. The trace
+	// context is propagated with the requests, so the spans of the clients and the nodes are linked.
+	// The forwarded requests and the backups of Put, PutEx, PutIf and Delete are children of the
+	// span of the operation.
+	Tracer Tracer
+
+	// Authorizer is called before every request received by this node, the denied requests fail with
+	// ErrForbidden. Default value is NopAuthorizer, which allows every request.
+	Authorizer Authorizer
+
+	// Authenticator authenticates the connections with OpAuth, if it's set. The requests of an
+	// unauthenticated connection fail with ErrUnauthorized. See NewSecretAuthenticator.
+	Authenticator Authenticator
+
+	// Credential is sent by this node to authenticate its connections to the other nodes.
+	Credential []byte
+
+	// AuthTimeout is the maximum time that a connection can stay unauthenticated, it's dropped then.
+	// Default value is DefaultAuthTimeout.
+	AuthTimeout time.Duration
+
+	// ReadTimeout is the maximum time to read a request after its first bytes arrive. A sender which
+	// stalls or trickles a request is dropped, so it cannot pin a goroutine. The idle connections are
+	// not affected. It must be long enough to receive the biggest message, i.e. a DMap moved to this
+	// node. Default value is DefaultReadTimeout, a negative value disables it.
+	ReadTimeout time.Duration
+
+	// OutboundQueueSize is the maximum number of the responses queued for a connection, the requests
+	// of a connection are handled while its responses are written. Default value is DefaultOutboundQueueSize.
+	OutboundQueueSize int
+
+	// BackpressurePolicy determines what happens when the outbound queue of a connection is full.
+	// Default value is BackpressureBlock. There is no drop policy, the responses are matched with the
+	// requests by their order, so a dropped response would be taken for the response of the next request.
+	BackpressurePolicy BackpressurePolicy
+
+	// MaxConnections is the maximum number of open connections to this node, including the connections of
+	// the other nodes. The new connections beyond it are rejected before the hello message, they fail with
+	// ErrTooManyConnections. It prevents the exhaustion of the file descriptors. It can be changed without
+	// restart, see Olric.SetMaxConnections. Zero means no limit, by default.
+	MaxConnections int
+
+	// ConnRateLimit is the maximum number of requests per second of a client connection to this node.
+	// The requests beyond it fail with ErrRateLimited without being handled, a connection can send up to
+	// a second of them in a burst. The requests of the other nodes are not limited. It can be changed
+	// without restart, see Olric.SetConnRateLimit. Zero means no limit, by default.
+	ConnRateLimit float64
+
+	// OperationTimeouts maps the names of the operations, i.e. ExQuery or ExScan, to their maximum
+	// durations on this node. A request which exceeds it fails with ErrOperationTimeout. The operations
+	// which iterate over the partitions stop early, the others are completed in the background and their
+	// results are discarded. The operations without a timeout are not limited.
+	OperationTimeouts map[string]time.Duration
+
+	// EnableMetrics enables the HTTP endpoint which exposes the metrics of this node in the Prometheus
+	// text format on /metrics.
+	EnableMetrics bool
+
+	// MetricsAddr is the bind address of the metrics endpoint. Default value is DefaultMetricsAddr.
+	MetricsAddr string
+
+	// HealthAddr is the bind address of the HTTP health checks for the liveness and readiness probes,
+	// /healthz and /readyz. /readyz responds with 503 until Olric.Ready returns nil. If it's the same as
+	// MetricsAddr, the health checks are served by the metrics endpoint. Empty disables them, by default.
+	HealthAddr string
+
 	// MemberlistConfig is the memberlist configuration that Olric will
 	// use to do the underlying membership management and gossip. Some
 	// fields in the MemberlistConfig will be overwritten by Olric no
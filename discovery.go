@@ -15,13 +15,14 @@
 package olric
 
 import (
-	"errors"
+	"fmt"
 	"log"
 	"sort"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/memberlist"
+	"github.com/pkg/errors"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -37,6 +38,7 @@ type discovery struct {
 	peers      []string
 	memberlist *memberlist.Memberlist
 	config     *memberlist.Config
+	delegate   *delegate
 	Birthdate  int64
 	wg         sync.WaitGroup
 	done       chan struct{}
@@ -48,7 +50,15 @@ type discovery struct {
 
 // TODO: NodeMetadata will be removed.
 type NodeMetadata struct {
-	Birthdate int64
+	Birthdate      int64
+	PartitionCount uint64
+
+	// Zone and Rack are the topology labels of the node, see Config.Zone and Config.Rack.
+	Zone string
+	Rack string
+
+	// ReadOnly is set if the node is a read-only replica, see Config.ReadOnly.
+	ReadOnly bool
 }
 
 // host represents a node in the cluster.
@@ -70,7 +80,13 @@ func (d *discovery) DecodeMeta(buf []byte) (*NodeMetadata, error) {
 // New creates a new memberlist with a proper configuration and returns a new discovery instance along with it.
 func newDiscovery(cfg *Config) (*discovery, error) {
 	birthdate := time.Now().UnixNano()
-	dlg, err := newDelegate(birthdate)
+	dlg, err := newDelegate(NodeMetadata{
+		Birthdate:      birthdate,
+		PartitionCount: cfg.PartitionCount,
+		Zone:           cfg.Zone,
+		Rack:           cfg.Rack,
+		ReadOnly:       cfg.ReadOnly,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -78,6 +94,7 @@ func newDiscovery(cfg *Config) (*discovery, error) {
 
 	cfg.MemberlistConfig.Name = cfg.Name
 	cfg.MemberlistConfig.Delegate = dlg
+	cfg.MemberlistConfig.Merge = dlg
 	cfg.MemberlistConfig.Logger = cfg.Logger
 	cfg.MemberlistConfig.Events = &memberlist.ChannelEventDelegate{
 		Ch: eventsCh,
@@ -93,6 +110,7 @@ func newDiscovery(cfg *Config) (*discovery, error) {
 		memberlist: list,
 		peers:      cfg.Peers,
 		config:     cfg.MemberlistConfig,
+		delegate:   dlg,
 		eventsCh:   eventsCh,
 		done:       make(chan struct{}),
 	}, nil
@@ -102,9 +120,13 @@ func newDiscovery(cfg *Config) (*discovery, error) {
 // by contacting all the given hosts and performing a state sync. Initially,
 // the Memberlist only contains our own state, so doing this will cause remote
 // nodes to become aware of the existence of this node, effectively joining the cluster.
-func (d *discovery) join() {
+// It returns an error if the cluster refuses this node.
+func (d *discovery) join() error {
 	if len(d.peers) != 0 {
 		nr, err := d.memberlist.Join(d.peers)
+		if merr := d.delegate.mergeError(); merr != nil {
+			return merr
+		}
 		if err != nil {
 			d.logger.Printf("[WARN] There are some errors: %v", err)
 		}
@@ -116,6 +138,7 @@ func (d *discovery) join() {
 	}
 	d.wg.Add(1)
 	go d.eventLoop()
+	return nil
 }
 
 // getMembers returns a list of all known live nodes.
@@ -234,40 +257,69 @@ func (d *discovery) subscribeNodeEvents() chan memberlist.NodeEvent {
 	return ch
 }
 
-// delegate is a struct which implements memberlist.Delegate interface.
+// delegate is a struct which implements memberlist.Delegate and memberlist.MergeDelegate interfaces.
 type delegate struct {
-	meta []byte
+	meta           []byte
+	partitionCount uint64
+
+	mu       sync.Mutex
+	mergeErr error
 }
 
-// newDelegate returns a new delegate instance.
-func newDelegate(birthdate int64) (delegate, error) {
-	mt := &NodeMetadata{
-		Birthdate: birthdate,
-	}
+// newDelegate returns a new delegate instance which broadcasts the given metadata.
+func newDelegate(mt NodeMetadata) (*delegate, error) {
 	data, err := msgpack.Marshal(mt)
 	if err != nil {
-		return delegate{}, err
+		return nil, err
 	}
-	return delegate{
-		meta: data,
+	return &delegate{
+		meta:           data,
+		partitionCount: mt.PartitionCount,
 	}, nil
 }
 
+// NotifyMerge is invoked on both sides when a node joins the cluster. It cancels the join
+// if the nodes don't agree on the partition count.
+func (d *delegate) NotifyMerge(peers []*memberlist.Node) error {
+	for _, peer := range peers {
+		mt := &NodeMetadata{}
+		if err := msgpack.Unmarshal(peer.Meta, mt); err != nil {
+			return err
+		}
+		if mt.PartitionCount != d.partitionCount {
+			err := errors.WithMessage(ErrPartitionCountMismatch,
+				fmt.Sprintf("%s has %d partitions, this node has %d", peer.Name, mt.PartitionCount, d.partitionCount))
+			d.mu.Lock()
+			d.mergeErr = err
+			d.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeError returns the reason of the last cancelled join, if any.
+func (d *delegate) mergeError() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.mergeErr
+}
+
 // NodeMeta is used to retrieve meta-data about the current node
 // when broadcasting an alive message. It's length is limited to
 // the given byte size. This metadata is available in the Node structure.
-func (d delegate) NodeMeta(limit int) []byte {
+func (d *delegate) NodeMeta(limit int) []byte {
 	return d.meta
 }
 
 // NotifyMsg is called when a user-data message is received.
-func (d delegate) NotifyMsg(data []byte) {}
+func (d *delegate) NotifyMsg(data []byte) {}
 
 // GetBroadcasts is called when user data messages can be broadcast.
-func (d delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
 
 // LocalState is used for a TCP Push/Pull.
-func (d delegate) LocalState(join bool) []byte { return nil }
+func (d *delegate) LocalState(join bool) []byte { return nil }
 
 // MergeRemoteState is invoked after a TCP Push/Pull.
-func (d delegate) MergeRemoteState(buf []byte, join bool) {}
+func (d *delegate) MergeRemoteState(buf []byte, join bool) {}
@@ -0,0 +1,121 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+func (db *Olric) appendPrepend(op protocol.OpCode, name, key string, data []byte) (int, error) {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return 0, err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Value: data,
+		}
+		resp, err := db.requestTo(member.String(), op, req)
+		if err != nil {
+			return 0, err
+		}
+		if len(resp.Value) != 8 {
+			return 0, fmt.Errorf("invalid response length: %d", len(resp.Value))
+		}
+		return int(binary.BigEndian.Uint64(resp.Value)), nil
+	}
+
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return 0, err
+	}
+	dm.Lock()
+	defer dm.Unlock()
+
+	var current []byte
+	var ttl int64
+	vdata, err := dm.str.Get(hkey)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return 0, err
+	}
+	if err == nil && !isKeyExpired(vdata.TTL) {
+		value, err := db.unmarshalValue(name, vdata.Value)
+		if err != nil {
+			return 0, err
+		}
+		b, ok := value.([]byte)
+		if !ok {
+			return 0, fmt.Errorf("mismatched type: %T", value)
+		}
+		current, ttl = b, vdata.TTL
+	}
+
+	var newval []byte
+	if op == protocol.OpExPrepend {
+		newval = append(append(newval, data...), current...)
+	} else {
+		newval = append(append(newval, current...), data...)
+	}
+	rawval, err := db.serializerOf(name).Marshal(newval)
+	if err != nil {
+		return 0, err
+	}
+	if limit := protocol.MaxValueSizeFor(name); len(rawval) > limit {
+		return 0, &ValueTooBigError{Size: len(rawval), Limit: limit}
+	}
+	// putKeyValLocked replicates the new value to the backups.
+	err = db.putKeyValLocked(dm, hkey, name, key, rawval, remainingTimeout(ttl), nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(newval), nil
+}
+
+// Append atomically appends data to the value of the given key and returns the new length of the value.
+// The value must be a byte slice. If the key doesn't exist, Append creates it with data. It returns
+// ErrValueTooBig if the resulting value exceeds MaxValueSize. It's thread-safe.
+func (dm *DMap) Append(key string, data []byte) (int, error) {
+	return dm.db.appendPrepend(protocol.OpExAppend, dm.name, key, data)
+}
+
+// Prepend atomically prepends data to the value of the given key and returns the new length of the value.
+// The value must be a byte slice. If the key doesn't exist, Prepend creates it with data. It returns
+// ErrValueTooBig if the resulting value exceeds MaxValueSize. It's thread-safe.
+func (dm *DMap) Prepend(key string, data []byte) (int, error) {
+	return dm.db.appendPrepend(protocol.OpExPrepend, dm.name, key, data)
+}
+
+func (db *Olric) exAppendPrependOperation(req *protocol.Message) *protocol.Message {
+	length, err := db.appendPrepend(req.Op, req.DMap, req.Key, req.Value)
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
+	if _, ok := err.(*ValueTooBigError); ok {
+		return req.Error(protocol.StatusValueTooBig, err)
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = make([]byte, 8)
+	binary.BigEndian.PutUint64(resp.Value, uint64(length))
+	return resp
+}
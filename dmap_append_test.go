@@ -0,0 +1,149 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestDMap_AppendPrepend(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1, dm2 := db1.NewDMap("mymap"), db2.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		length, err := dm1.Append(bkey(i), []byte("bar"))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if length != 3 {
+			t.Fatalf("Expected length 3. Got: %d", length)
+		}
+		_, err = dm2.Prepend(bkey(i), []byte("foo"))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		length, err = dm2.Append(bkey(i), []byte("baz"))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if length != 9 {
+			t.Fatalf("Expected length 9. Got: %d", length)
+		}
+		value, err := dm1.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), []byte("foobarbaz")) {
+			t.Fatalf("Expected foobarbaz. Got: %s", value)
+		}
+	}
+
+	// Concurrent calls don't lose any update.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(dm *DMap) {
+			defer wg.Done()
+			_, err := dm.Append("counter", []byte("a"))
+			if err != nil {
+				t.Errorf("Expected nil. Got: %v", err)
+			}
+		}([]*DMap{dm1, dm2}[i%2])
+	}
+	wg.Wait()
+	value, err := dm1.Get("counter")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(value.([]byte)) != 100 {
+		t.Fatalf("Expected length 100. Got: %d", len(value.([]byte)))
+	}
+}
+
+func TestDMap_AppendValueTooBig(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	maxValueSize := protocol.MaxValueSize
+	protocol.MaxValueSize = 100
+	defer func() {
+		protocol.MaxValueSize = maxValueSize
+	}()
+
+	dm := db.NewDMap("mymap")
+	_, err = dm.Append("mykey", make([]byte, 50))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = dm.Append("mykey", make([]byte, 50))
+	if !errors.Is(err, ErrValueTooBig) {
+		t.Fatalf("Expected ErrValueTooBig. Got: %v", err)
+	}
+	verr, ok := err.(*ValueTooBigError)
+	if !ok {
+		t.Fatalf("Expected *ValueTooBigError. Got: %T", err)
+	}
+	if verr.Limit != 100 {
+		t.Fatalf("Expected limit 100. Got: %d", verr.Limit)
+	}
+	if verr.Size <= 100 {
+		t.Fatalf("Expected a size bigger than 100. Got: %d", verr.Size)
+	}
+
+	err = dm.Put("int-key", 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = dm.Append("int-key", []byte("foo"))
+	if err == nil {
+		t.Fatalf("Expected an error for mismatched type")
+	}
+}
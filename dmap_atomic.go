@@ -17,18 +17,21 @@ package olric
 import (
 	"fmt"
 	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
 )
 
-func (db *Olric) atomicIncrDecr(name, key, opr string, delta int) (int, error) {
-	err := db.lockWithTimeout(name, key, time.Minute)
+// atomicIncrDecr applies delta to the value of the key. A key which doesn't exist starts from initial.
+func (db *Olric) atomicIncrDecr(name, key, opr string, delta, initial int) (int, error) {
+	token, err := db.lockWithTimeout(name, key, time.Minute)
 	if err != nil {
 		return 0, err
 	}
 	defer func() {
-		err = db.unlock(name, key)
+		err = db.unlock(name, key, token)
 		if err != nil {
 			db.log.Printf("[ERROR] Failed to release the lock for key: %s: %v", key, err)
 		}
@@ -39,12 +42,13 @@ func (db *Olric) atomicIncrDecr(name, key, opr string, delta int) (int, error) {
 		return 0, err
 	}
 
-	var newval, curval int
+	var newval int
+	curval := initial
 	if err == ErrKeyNotFound {
 		err = nil
 	} else {
 		var value interface{}
-		if err = db.serializer.Unmarshal(rawval, &value); err != nil {
+		if err = db.serializerOf(name).Unmarshal(rawval, &value); err != nil {
 			return 0, err
 		}
 		// switch is faster than reflect.
@@ -59,40 +63,54 @@ func (db *Olric) atomicIncrDecr(name, key, opr string, delta int) (int, error) {
 
 	if opr == "incr" {
 		newval = curval + delta
+		if (delta > 0 && newval < curval) || (delta < 0 && newval > curval) {
+			return 0, ErrOverflow
+		}
 	} else if opr == "decr" {
 		newval = curval - delta
+		if (delta > 0 && newval > curval) || (delta < 0 && newval < curval) {
+			return 0, ErrOverflow
+		}
 	} else {
 		return 0, fmt.Errorf("invalid operation")
 	}
 
-	nval, err := db.serializer.Marshal(newval)
+	nval, err := db.serializerOf(name).Marshal(newval)
 	if err != nil {
 		return 0, err
 	}
-	err = db.put(name, key, nval, nilTimeout)
+	err = db.put(name, key, nval, nilTimeout, nil)
 	if err != nil {
 		return 0, err
 	}
 	return newval, nil
 }
 
-// Incr atomically increments key by delta. The return value is the new value after being incremented or an error.
+// Incr atomically increments key by delta. If the key doesn't exist, it's created with delta. The return value
+// is the new value after being incremented or an error. It returns ErrOverflow if the new value doesn't fit in
+// an int, the value is not changed then. The new value is written to the backups like Put.
 func (dm *DMap) Incr(key string, delta int) (int, error) {
-	return dm.db.atomicIncrDecr(dm.name, key, "incr", delta)
+	return dm.db.atomicIncrDecr(dm.name, key, "incr", delta, 0)
 }
 
-// Decr atomically decrements key by delta. The return value is the new value after being decremented or an error.
+// IncrBy is like Incr but a key which doesn't exist starts from initial, so it's created with initial+delta.
+func (dm *DMap) IncrBy(key string, delta, initial int) (int, error) {
+	return dm.db.atomicIncrDecr(dm.name, key, "incr", delta, initial)
+}
+
+// Decr atomically decrements key by delta. If the key doesn't exist, it's created with -delta. The return value
+// is the new value after being decremented or an error. It returns ErrOverflow like Incr.
 func (dm *DMap) Decr(key string, delta int) (int, error) {
-	return dm.db.atomicIncrDecr(dm.name, key, "decr", delta)
+	return dm.db.atomicIncrDecr(dm.name, key, "decr", delta, 0)
 }
 
-func (db *Olric) getPut(name, key string, value []byte) ([]byte, error) {
-	err := db.lockWithTimeout(name, key, time.Minute)
+func (db *Olric) incrByFloat(name, key string, delta float64) (float64, error) {
+	token, err := db.lockWithTimeout(name, key, time.Minute)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer func() {
-		err = db.unlock(name, key)
+		err = db.unlock(name, key, token)
 		if err != nil {
 			db.log.Printf("[ERROR] Failed to release the lock for key: %s: %v", key, err)
 		}
@@ -100,22 +118,103 @@ func (db *Olric) getPut(name, key string, value []byte) ([]byte, error) {
 
 	rawval, err := db.get(name, key)
 	if err != nil && err != ErrKeyNotFound {
+		return 0, err
+	}
+
+	var curval float64
+	if err == ErrKeyNotFound {
+		err = nil
+	} else {
+		var value interface{}
+		if err = db.serializerOf(name).Unmarshal(rawval, &value); err != nil {
+			return 0, err
+		}
+		switch v := value.(type) {
+		case float64:
+			curval = v
+		case int:
+			curval = float64(v)
+		case string:
+			curval, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return 0, fmt.Errorf("value is not a valid float: %q", v)
+			}
+		default:
+			return 0, fmt.Errorf("value is not a valid float: mismatched type: %T", value)
+		}
+	}
+
+	newval := curval + delta
+	nval, err := db.serializerOf(name).Marshal(newval)
+	if err != nil {
+		return 0, err
+	}
+	err = db.put(name, key, nval, nilTimeout, nil)
+	if err != nil {
+		return 0, err
+	}
+	return newval, nil
+}
+
+// IncrByFloat atomically increments key by delta. The stored value can be a float64, an int or a string
+// which contains a valid float. The return value is the new value after being incremented or an error.
+func (dm *DMap) IncrByFloat(key string, delta float64) (float64, error) {
+	return dm.db.incrByFloat(dm.name, key, delta)
+}
+
+func (db *Olric) getPut(name, key string, value []byte) ([]byte, error) {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
 		return nil, err
 	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Value: value,
+		}
+		resp, err := db.requestTo(member.String(), protocol.OpExGetPut, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Value) == 0 {
+			return nil, nil
+		}
+		return resp.Value, nil
+	}
 
-	err = db.put(name, key, value, nilTimeout)
+	dm, err := db.getDMap(name, hkey)
 	if err != nil {
 		return nil, err
 	}
-	return rawval, nil
+	dm.Lock()
+	defer dm.Unlock()
+
+	var oldval []byte
+	vdata, err := dm.str.Get(hkey)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return nil, err
+	}
+	if err == nil && !isKeyExpired(vdata.TTL) {
+		// The value points to the memory of the storage, copy it before the put.
+		oldval = append([]byte{}, vdata.Value...)
+	}
+	// putKeyValLocked creates the backups like the single Put path.
+	err = db.putKeyValLocked(dm, hkey, name, key, value, nilTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	return oldval, nil
 }
 
-// GetPut atomically sets key to value and returns the old value stored at key.
+// GetPut atomically sets key to value and returns the old value stored at key. The swap is done under
+// the lock of the key's owner and the new value is written to the backups like Put. If the key
+// doesn't exist or has expired, the old value is nil and the error is nil. It's thread-safe.
 func (dm *DMap) GetPut(key string, value interface{}) (interface{}, error) {
 	if value == nil {
 		value = struct{}{}
 	}
-	val, err := dm.db.serializer.Marshal(value)
+	val, err := dm.db.serializerOf(dm.name).Marshal(value)
 	if err != nil {
 		return nil, err
 	}
@@ -127,7 +226,7 @@ func (dm *DMap) GetPut(key string, value interface{}) (interface{}, error) {
 
 	var oldval interface{}
 	if rawval != nil {
-		if err = dm.db.serializer.Unmarshal(rawval, &oldval); err != nil {
+		if err = dm.db.serializerOf(dm.name).Unmarshal(rawval, &oldval); err != nil {
 			return nil, err
 		}
 	}
@@ -138,20 +237,54 @@ func (db *Olric) exIncrDecrOperation(req *protocol.Message) *protocol.Message {
 	var delta interface{}
 	err := db.serializer.Unmarshal(req.Value, &delta)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	op := "incr"
 	if req.Op == protocol.OpExDecr {
 		op = "decr"
 	}
-	newval, err := db.atomicIncrDecr(req.DMap, req.Key, op, delta.(int))
+	var initial int
+	if extra, ok := req.Extra.(protocol.IncrExtra); ok {
+		initial = int(extra.Initial)
+	}
+	newval, err := db.atomicIncrDecr(req.DMap, req.Key, op, delta.(int), initial)
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+
+	data, err := db.serializer.Marshal(newval)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = data
+	return resp
+}
+
+func (db *Olric) exIncrByFloatOperation(req *protocol.Message) *protocol.Message {
+	var delta interface{}
+	err := db.serializer.Unmarshal(req.Value, &delta)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	fdelta, ok := delta.(float64)
+	if !ok {
+		return req.Error(protocol.StatusInternalServerError, fmt.Sprintf("mismatched type: %T", delta))
+	}
+	newval, err := db.incrByFloat(req.DMap, req.Key, fdelta)
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
+	if err != nil {
+		return errorResponse(req, err)
 	}
 
 	data, err := db.serializer.Marshal(newval)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	resp := req.Success()
 	resp.Value = data
@@ -160,8 +293,11 @@ func (db *Olric) exIncrDecrOperation(req *protocol.Message) *protocol.Message {
 
 func (db *Olric) exGetPutOperation(req *protocol.Message) *protocol.Message {
 	oldval, err := db.getPut(req.DMap, req.Key, req.Value)
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	resp := req.Success()
 	if oldval != nil {
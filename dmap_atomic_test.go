@@ -15,7 +15,9 @@
 package olric
 
 import (
+	"bytes"
 	"context"
+	"math"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -162,3 +164,280 @@ func TestDMap_GetPut(t *testing.T) {
 		t.Fatalf("Expected %d. Got: %d", final, atomic.LoadInt64(&total))
 	}
 }
+
+func TestDMap_GetPutMissingKey(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("atomic_test")
+	for i := 0; i < 10; i++ {
+		oldval, err := dm.GetPut(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if oldval != nil {
+			t.Fatalf("Expected nil. Got: %v", oldval)
+		}
+	}
+
+	dm2 := db2.NewDMap("atomic_test")
+	for i := 0; i < 10; i++ {
+		oldval, err := dm2.GetPut(bkey(i), bval(i+1))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(oldval.([]byte), bval(i)) {
+			t.Fatalf("Old value is different for %s", bkey(i))
+		}
+	}
+
+	// The new values are written to the backups.
+	for i := 0; i < 10; i++ {
+		hkey := db1.getHKey("atomic_test", bkey(i))
+		owner := db1.getBackupPartitionOwners(hkey)[0]
+		db := db1
+		if hostCmp(owner, db2.this) {
+			db = db2
+		}
+		bdm, err := db.getBackupDMap("atomic_test", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		vdata, err := bdm.str.Get(hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for %s", err, bkey(i))
+		}
+		var value interface{}
+		err = db.serializer.Unmarshal(vdata.Value, &value)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i+1)) {
+			t.Fatalf("Backup value is different for %s", bkey(i))
+		}
+	}
+}
+
+func TestDMap_IncrByFloat(t *testing.T) {
+	r, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = r.Shutdown(context.Background())
+		if err != nil {
+			r.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var start chan struct{}
+	key := "incrbyfloat"
+
+	incr := func(dm *DMap) {
+		<-start
+		defer wg.Done()
+
+		_, err := dm.IncrByFloat(key, 0.5)
+		if err != nil {
+			r.log.Printf("[ERROR] Failed to call IncrByFloat: %v", err)
+			return
+		}
+	}
+
+	dm := r.NewDMap("atomic_test")
+	start = make(chan struct{})
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go incr(dm)
+	}
+	close(start)
+	wg.Wait()
+
+	res, err := dm.Get(key)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if res.(float64) != 50 {
+		t.Fatalf("Expected 50. Got: %v", res)
+	}
+
+	err = dm.Put("string-key", "1.5")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	newval, err := dm.IncrByFloat("string-key", 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if newval != 2.5 {
+		t.Fatalf("Expected 2.5. Got: %v", newval)
+	}
+
+	err = dm.Put("invalid-key", "foobar")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = dm.IncrByFloat("invalid-key", 1)
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid float")
+	}
+}
+
+func TestDMap_IncrBy(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "atomic_test"
+	dm := db1.NewDMap(mname)
+	for i := 0; i < 10; i++ {
+		key := bkey(i)
+		res, err := dm.IncrBy(key, 5, 100)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if res != 105 {
+			t.Fatalf("Expected 105. Got: %d", res)
+		}
+		// The initial value is ignored for the existing keys.
+		res, err = dm.IncrBy(key, 5, 100)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if res != 110 {
+			t.Fatalf("Expected 110. Got: %d", res)
+		}
+	}
+
+	// The new values are written to the backups.
+	for i := 0; i < 10; i++ {
+		key := bkey(i)
+		owner, hkey, err := db1.locateKey(mname, key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		var backup = db1
+		if hostCmp(owner, db1.this) {
+			backup = db2
+		}
+		tmp, ok := backup.backups[db1.getPartitionID(hkey)].m.Load(mname)
+		if !ok {
+			t.Fatalf("%s could not be found on the backup", mname)
+		}
+		data := tmp.(*dmap)
+		data.Lock()
+		vdata, err := data.str.Get(hkey)
+		data.Unlock()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		var val interface{}
+		err = db1.serializer.Unmarshal(vdata.Value, &val)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if val.(int) != 110 {
+			t.Fatalf("Expected 110 on the backup. Got: %v", val)
+		}
+	}
+}
+
+func TestDMap_IncrOverflow(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("atomic_test")
+	_, err = dm.IncrBy("max", 1, math.MaxInt64)
+	if err != ErrOverflow {
+		t.Fatalf("Expected ErrOverflow. Got: %v", err)
+	}
+	if _, err = dm.Get("max"); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+
+	err = dm.Put("max", math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if _, err = dm.Incr("max", 1); err != ErrOverflow {
+		t.Fatalf("Expected ErrOverflow. Got: %v", err)
+	}
+	if _, err = dm.Decr("max", -1); err != ErrOverflow {
+		t.Fatalf("Expected ErrOverflow. Got: %v", err)
+	}
+	res, err := dm.Get("max")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if res.(int) != math.MaxInt64 {
+		t.Fatalf("Expected the value to be unchanged. Got: %v", res)
+	}
+
+	err = dm.Put("min", math.MinInt64)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if _, err = dm.Decr("min", 1); err != ErrOverflow {
+		t.Fatalf("Expected ErrOverflow. Got: %v", err)
+	}
+	if _, err = dm.Incr("min", -1); err != ErrOverflow {
+		t.Fatalf("Expected ErrOverflow. Got: %v", err)
+	}
+	res, err = dm.Incr("min", 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if res != math.MinInt64+1 {
+		t.Fatalf("Expected %d. Got: %d", math.MinInt64+1, res)
+	}
+}
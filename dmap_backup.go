@@ -0,0 +1,208 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+	"github.com/pkg/errors"
+)
+
+// backupBatcher coalesces the backup writes to the same node and DMap into OpPutBackupBatch requests.
+// A batch is sent when it has maxCount records, when the next record doesn't fit in the value size
+// limit of the DMap, or when window elapses after its first record. See Config.BackupBatchWindow.
+type backupBatcher struct {
+	window   time.Duration
+	maxCount int
+	send     func(addr, name string, records []protocol.BackupRecord) []error
+
+	mu      sync.Mutex
+	batches map[backupBatchKey]*backupBatch
+}
+
+type backupBatchKey struct {
+	addr string
+	name string
+}
+
+// backupBatch is a batch waiting to be sent. errs is set and done is closed after it's sent.
+type backupBatch struct {
+	records []protocol.BackupRecord
+	size    int
+	timer   *time.Timer
+	errs    []error
+	done    chan struct{}
+}
+
+func newBackupBatcher(window time.Duration, maxCount int,
+	send func(addr, name string, records []protocol.BackupRecord) []error) *backupBatcher {
+	return &backupBatcher{
+		window:   window,
+		maxCount: maxCount,
+		send:     send,
+		batches:  make(map[backupBatchKey]*backupBatch),
+	}
+}
+
+// fits reports whether the record is small enough to be batched. The bigger records gain nothing from
+// batching, they're sent with OpPutBackup.
+func (b *backupBatcher) fits(name string, rec protocol.BackupRecord) bool {
+	return rec.EncodedSize() <= protocol.MaxValueSizeFor(name)/2
+}
+
+// put adds the record to the batch of addr and name, and waits until the batch is sent. It returns
+// the error of the record.
+func (b *backupBatcher) put(addr, name string, rec protocol.BackupRecord) error {
+	key := backupBatchKey{addr: addr, name: name}
+	size := rec.EncodedSize()
+
+	b.mu.Lock()
+	var full *backupBatch
+	batch := b.batches[key]
+	if batch != nil && batch.size+size > protocol.MaxValueSizeFor(name) {
+		full = batch
+		b.detach(key, full)
+		batch = nil
+	}
+	if batch == nil {
+		batch = &backupBatch{done: make(chan struct{})}
+		b.batches[key] = batch
+		created := batch
+		batch.timer = time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			if b.batches[key] != created {
+				// It's already sent because it's full.
+				b.mu.Unlock()
+				return
+			}
+			delete(b.batches, key)
+			b.mu.Unlock()
+			b.flush(key, created)
+		})
+	}
+	idx := len(batch.records)
+	batch.records = append(batch.records, rec)
+	batch.size += size
+	ready := len(batch.records) >= b.maxCount
+	if ready {
+		b.detach(key, batch)
+	}
+	b.mu.Unlock()
+
+	if full != nil {
+		// The writers of the previous batch are waiting for it.
+		go b.flush(key, full)
+	}
+	if ready {
+		b.flush(key, batch)
+	}
+	<-batch.done
+	return batch.errs[idx]
+}
+
+// detach removes the batch from the pending batches, so the next records start a new batch.
+// It must be called while mu is held.
+func (b *backupBatcher) detach(key backupBatchKey, batch *backupBatch) {
+	delete(b.batches, key)
+	batch.timer.Stop()
+}
+
+func (b *backupBatcher) flush(key backupBatchKey, batch *backupBatch) {
+	batch.errs = b.send(key.addr, key.name, batch.records)
+	close(batch.done)
+}
+
+// sendBackup writes the replica to the backup owner. The small writes are batched if Config.BackupBatchWindow
+// is set, the traced ones are sent alone to keep their trace context.
+func (db *Olric) sendBackup(addr, name string, vdata *storage.VData, trace *protocol.TraceContext) error {
+	rec := protocol.BackupRecord{
+		Record:    protocol.Record{Key: vdata.Key, Value: vdata.Value, TTL: vdata.TTL},
+		Timestamp: vdata.Timestamp,
+	}
+	if db.backupBatcher != nil && trace == nil && db.backupBatcher.fits(name, rec) {
+		return db.backupBatcher.put(addr, name, rec)
+	}
+	msg := &protocol.Message{
+		DMap:  name,
+		Key:   vdata.Key,
+		Extra: protocol.PutBackupExtra{TTL: vdata.TTL, Timestamp: vdata.Timestamp},
+		Value: vdata.Value,
+		Trace: trace,
+	}
+	_, err := db.requestTo(addr, protocol.OpPutBackup, msg)
+	return err
+}
+
+// sendBackupBatch writes the records to the backup owner with OpPutBackupBatch and returns their errors
+// in the same order.
+func (db *Olric) sendBackupBatch(addr, name string, records []protocol.BackupRecord) []error {
+	errs := make([]error, len(records))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	req := &protocol.Message{
+		DMap:  name,
+		Value: protocol.EncodeBackupRecords(records),
+	}
+	resp, err := db.requestTo(addr, protocol.OpPutBackupBatch, req)
+	if err != nil {
+		return fail(err)
+	}
+	if len(resp.Value) == 0 {
+		return errs
+	}
+	failed, err := protocol.DecodeEntries(resp.Value)
+	if err != nil {
+		return fail(err)
+	}
+	for i, rec := range records {
+		if msg, ok := failed[rec.Key]; ok {
+			errs[i] = errors.New(string(msg))
+		}
+	}
+	return errs
+}
+
+// putBackupBatchOperation applies the records of an OpPutBackupBatch request like putBackupOperation.
+// The failed keys are returned with their error messages, like the response of OpExMPut.
+func (db *Olric) putBackupBatchOperation(req *protocol.Message) *protocol.Message {
+	records, err := protocol.DecodeBackupRecords(req.Value)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	errs := make(map[string][]byte)
+	for _, rec := range records {
+		vdata := &storage.VData{
+			Key:       rec.Key,
+			Value:     rec.Value,
+			TTL:       rec.TTL,
+			Timestamp: rec.Timestamp,
+		}
+		if err = db.putBackup(req.DMap, vdata); err != nil {
+			errs[rec.Key] = []byte(err.Error())
+		}
+	}
+	resp := req.Success()
+	if len(errs) != 0 {
+		resp.Value = protocol.EncodeEntries(errs)
+	}
+	return resp
+}
@@ -17,7 +17,14 @@ package olric
 import (
 	"bytes"
 	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestDMap_PutBackup(t *testing.T) {
@@ -279,14 +286,541 @@ func TestDMap_PruneStaleBackups(t *testing.T) {
 		}
 	}()
 
+	// The other nodes move the stale backups in the background after a routing update. Wait for
+	// them, the empty backup owners are pruned by the next routing update.
+	db1.updateRouting()
+	for _, db := range []*Olric{db2, db3, r4} {
+		db.fsck()
+	}
+
 	db1.deleteStaleDMaps()
 	db1.updateRouting()
 
 	for _, bpart := range db1.backups {
 		bpart.RLock()
-		if len(bpart.owners) != 1 {
-			t.Fatalf("Expected backup owner count is 1. Got: %d", len(bpart.owners))
-		}
+		count := len(bpart.owners)
 		bpart.RUnlock()
+		if count != 1 {
+			t.Fatalf("Expected backup owner count is 1. Got: %d", count)
+		}
+	}
+}
+
+func TestDMap_WriteQuorum(t *testing.T) {
+	newDB := func(peers []string) (*Olric, error) {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ReplicaCount = 2
+		cfg.WriteQuorum = 2
+		return startTestOlric(cfg)
+	}
+	db1, err := newDB(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db1.NewDMap("mymap")
+	// There is no backup owner in a single node cluster.
+	err = dm.Put(bkey(1), bval(1))
+	if err != ErrWriteQuorum {
+		t.Fatalf("Expected ErrWriteQuorum. Got: %v", err)
+	}
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newDB(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+}
+
+func TestDMap_ReadQuorum(t *testing.T) {
+	newDB := func(peers []string) (*Olric, error) {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ReadQuorum = 2
+		return startTestOlric(cfg)
+	}
+	db1, err := newDB(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db1.NewDMap("mymap")
+	err = dm.Put(bkey(1), bval(1))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = dm.Get(bkey(1))
+	if err != ErrReadQuorum {
+		t.Fatalf("Expected ErrReadQuorum. Got: %v", err)
+	}
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newDB(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		value, err := dm.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value for %d", i)
+		}
+	}
+}
+
+func TestDMap_InvalidQuorum(t *testing.T) {
+	configs := []*Config{
+		{ReplicaCount: 2, WriteQuorum: 3},
+		{ReplicaCount: 2, ReadQuorum: 3},
+		{ReplicaCount: 2, WriteQuorum: 2, BackupMode: AsyncBackupMode},
+	}
+	for _, c := range configs {
+		_, err := New(c)
+		if err == nil {
+			t.Fatalf("Expected an error for %+v", c)
+		}
+	}
+}
+
+func TestDMap_ReadRepair(t *testing.T) {
+	newDB := func(peers []string) (*Olric, error) {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ReadQuorum = 2
+		cfg.ReadRepair = true
+		return startTestOlric(cfg)
+	}
+	db1, err := newDB(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newDB(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "mymap"
+	dm := db1.NewDMap(mname)
+	for i := 0; i < 2; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// replicas returns the stored entries of the key on the primary and the backup owner.
+	replicas := func(key string) (*dmap, *dmap, uint64) {
+		owner, hkey, err := db1.locateKey(mname, key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		primary, backup := db1, db2
+		if !hostCmp(owner, db1.this) {
+			primary, backup = db2, db1
+		}
+		partID := db1.getPartitionID(hkey)
+		p, ok := primary.partitions[partID].m.Load(mname)
+		if !ok {
+			t.Fatalf("%s could not be found on the primary owner", mname)
+		}
+		b, ok := backup.backups[partID].m.Load(mname)
+		if !ok {
+			t.Fatalf("%s could not be found on the backup owner", mname)
+		}
+		return p.(*dmap), b.(*dmap), hkey
+	}
+	waitFor := func(dm *dmap, hkey uint64, expected []byte) {
+		for i := 0; i < 100; i++ {
+			vdata, err := dm.str.Get(hkey)
+			if err == nil && bytes.Equal(vdata.Value, expected) {
+				return
+			}
+			<-time.After(10 * time.Millisecond)
+		}
+		t.Fatalf("Replica could not be repaired")
+	}
+	stale := []byte("stale")
+	newer := []byte("newer")
+
+	// A stale backup is repaired.
+	primary, backup, hkey := replicas(bkey(0))
+	vdata, err := primary.str.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	expected := append([]byte(nil), vdata.Value...)
+	vdata, err = backup.str.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = backup.str.Put(hkey, &storage.VData{Key: vdata.Key, Timestamp: vdata.Timestamp - 1, Value: stale})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	value, err := dm.Get(bkey(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(value.([]byte), bval(0)) {
+		t.Fatalf("Expected the value on the primary owner. Got: %v", value)
+	}
+	waitFor(backup, hkey, expected)
+
+	// A newer backup wins and repairs the primary owner.
+	primary, backup, hkey = replicas(bkey(1))
+	vdata, err = backup.str.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	encoded, err := db1.serializer.Marshal(newer)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = backup.str.Put(hkey, &storage.VData{Key: vdata.Key, Timestamp: vdata.Timestamp + 1, Value: encoded})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	value, err = dm.Get(bkey(1))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(value.([]byte), newer) {
+		t.Fatalf("Expected the newer value on the backup owner. Got: %v", value)
+	}
+	waitFor(primary, hkey, encoded)
+
+	for i := 0; i < 100; i++ {
+		if db1.Stats().ReadRepairs+db2.Stats().ReadRepairs == 2 {
+			return
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected 2 read repairs. Got: %d", db1.Stats().ReadRepairs+db2.Stats().ReadRepairs)
+}
+
+func TestDMap_PutBackupIgnoresStaleWrite(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "mymap"
+	send := func(addr string, value []byte, ts int64) {
+		req := &protocol.Message{
+			DMap:  mname,
+			Key:   "mykey",
+			Extra: protocol.PutBackupExtra{Timestamp: ts},
+			Value: value,
+		}
+		_, err := db1.requestTo(addr, protocol.OpPutBackup, req)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	addr := db2.this.String()
+	send(addr, []byte("newer"), 200)
+	send(addr, []byte("older"), 100)
+
+	hkey := db2.getHKey(mname, "mykey")
+	dm, err := db2.getBackupDMap(mname, hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	vdata, err := dm.str.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(vdata.Value, []byte("newer")) || vdata.Timestamp != 200 {
+		t.Fatalf("Expected the newer write. Got: %s with version %d", vdata.Value, vdata.Timestamp)
+	}
+	if db2.clock.now() <= 200 {
+		t.Fatalf("Expected the clock to be updated by the received version")
+	}
+}
+
+func TestDMap_PutBackupIgnoresDeletedKey(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "mymap"
+	addr := db2.this.String()
+	for _, key := range []string{"mykey", "mykey-batch"} {
+		req := &protocol.Message{
+			DMap: mname,
+			Key:  key,
+		}
+		_, err = db1.requestTo(addr, protocol.OpDeleteBackup, req)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// The writes are older than the deletes.
+	req := &protocol.Message{
+		DMap:  mname,
+		Key:   "mykey",
+		Extra: protocol.PutBackupExtra{Timestamp: 100},
+		Value: []byte("stale"),
+	}
+	_, err = db1.requestTo(addr, protocol.OpPutBackup, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	req = &protocol.Message{
+		DMap: mname,
+		Value: protocol.EncodeBackupRecords([]protocol.BackupRecord{
+			{Record: protocol.Record{Key: "mykey-batch", Value: []byte("stale")}, Timestamp: 100},
+		}),
+	}
+	_, err = db1.requestTo(addr, protocol.OpPutBackupBatch, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	for _, key := range []string{"mykey", "mykey-batch"} {
+		hkey := db2.getHKey(mname, key)
+		dm, err := db2.getBackupDMap(mname, hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		dm.Lock()
+		_, err = dm.str.Get(hkey)
+		dm.Unlock()
+		if err != storage.ErrKeyNotFound {
+			t.Fatalf("Expected storage.ErrKeyNotFound for %s. Got: %v", key, err)
+		}
+	}
+}
+
+func TestDMap_PutBackupBatch(t *testing.T) {
+	newDB := func(peers []string) (*Olric, error) {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.BackupBatchWindow = 10 * time.Millisecond
+		cfg.BackupBatchSize = 16
+		return startTestOlric(cfg)
+	}
+	db1, err := newDB(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newDB(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "mymap"
+	dm := db1.NewDMap(mname)
+	var g errgroup.Group
+	for i := 0; i < 100; i++ {
+		i := i
+		g.Go(func() error {
+			return dm.Put(bkey(i), bval(i))
+		})
+	}
+	if err = g.Wait(); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		owner, hkey, err := db1.locateKey(mname, bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		backup := db1
+		if hostCmp(owner, db1.this) {
+			backup = db2
+		}
+		bdm, err := backup.getBackupDMap(mname, hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		bdm.Lock()
+		_, err = bdm.str.Get(hkey)
+		bdm.Unlock()
+		if err != nil {
+			t.Fatalf("Expected the backup of %s. Got: %v", bkey(i), err)
+		}
+	}
+
+	var batches, singles uint64
+	for _, db := range []*Olric{db1, db2} {
+		stats := db.Stats()
+		batches += stats.Operations["PutBackupBatch"].Requests
+		singles += stats.Operations["PutBackup"].Requests
+	}
+	if singles != 0 {
+		t.Fatalf("Expected no OpPutBackup requests. Got: %d", singles)
+	}
+	if batches == 0 || batches >= 100 {
+		t.Fatalf("Expected the backup writes to be batched. Got: %d batches", batches)
+	}
+}
+
+func TestBackupBatcher(t *testing.T) {
+	errFailed := errors.New("failed")
+	var mu sync.Mutex
+	var sent [][]protocol.BackupRecord
+	send := func(addr, name string, records []protocol.BackupRecord) []error {
+		mu.Lock()
+		sent = append(sent, records)
+		mu.Unlock()
+		errs := make([]error, len(records))
+		for i, rec := range records {
+			if rec.Key == "bad" {
+				errs[i] = errFailed
+			}
+		}
+		return errs
+	}
+
+	// The batch is sent when it's full, the errors are reported per record.
+	b := newBackupBatcher(time.Hour, 3, send)
+	results := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, key := range []string{"foo", "bad", "bar"} {
+		key := key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := b.put("addr", "mymap", protocol.BackupRecord{Record: protocol.Record{Key: key}})
+			mu.Lock()
+			results[key] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(sent) != 1 || len(sent[0]) != 3 {
+		t.Fatalf("Expected one batch of 3 records. Got: %v", sent)
+	}
+	if results["foo"] != nil || results["bar"] != nil || results["bad"] != errFailed {
+		t.Fatalf("Expected the error of the bad record only. Got: %v", results)
+	}
+
+	// The batch is sent after the window.
+	b = newBackupBatcher(10*time.Millisecond, 100, send)
+	err := b.put("addr", "mymap", protocol.BackupRecord{Record: protocol.Record{Key: "foo"}})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(sent) != 2 || len(sent[1]) != 1 {
+		t.Fatalf("Expected a batch of 1 record. Got: %v", sent)
 	}
 }
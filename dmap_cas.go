@@ -0,0 +1,190 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+// remainingTimeout converts the absolute TTL of a key to a timeout, to keep the TTL while updating the value.
+func remainingTimeout(ttl int64) time.Duration {
+	if ttl == 0 {
+		return nilTimeout
+	}
+	timeout := time.Duration(ttl)*time.Millisecond - time.Duration(atomic.LoadInt64(&currentUnixNano))
+	if timeout < time.Millisecond {
+		timeout = time.Millisecond
+	}
+	return timeout
+}
+
+// compareValue returns the current value of the key if it's equal to oldval.
+func (db *Olric) compareValue(dm *dmap, hkey uint64, oldval []byte) (*storage.VData, bool, error) {
+	vdata, err := dm.str.Get(hkey)
+	if err == storage.ErrKeyNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if isKeyExpired(vdata.TTL) || !bytes.Equal(vdata.Value, oldval) {
+		return nil, false, nil
+	}
+	return vdata, true, nil
+}
+
+func (db *Olric) compareAndSwap(name, key string, oldval, newval []byte) (bool, error) {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return false, err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Extra: protocol.CASExtra{OldLen: uint32(len(oldval))},
+			Value: append(append([]byte{}, oldval...), newval...),
+		}
+		resp, err := db.requestTo(member.String(), protocol.OpExCAS, req)
+		if err != nil {
+			return false, err
+		}
+		return len(resp.Value) == 1 && resp.Value[0] == 1, nil
+	}
+
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return false, err
+	}
+	dm.Lock()
+	defer dm.Unlock()
+
+	vdata, ok, err := db.compareValue(dm, hkey, oldval)
+	if err != nil || !ok {
+		return false, err
+	}
+	// putKeyValLocked creates the backups, only if the swap happens.
+	err = db.putKeyValLocked(dm, hkey, name, key, newval, remainingTimeout(vdata.TTL), nil)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompareAndSwap sets the value for the given key to new, only if the current value is equal to old. The comparison
+// is done on the serialized values under the lock of the key's owner. It returns true if the swap happened. A missing
+// key never matches. It's thread-safe.
+func (dm *DMap) CompareAndSwap(key string, old, new interface{}) (bool, error) {
+	oldval, err := dm.db.serializerOf(dm.name).Marshal(old)
+	if err != nil {
+		return false, err
+	}
+	newval, err := dm.db.serializerOf(dm.name).Marshal(new)
+	if err != nil {
+		return false, err
+	}
+	return dm.db.compareAndSwap(dm.name, key, oldval, newval)
+}
+
+func (db *Olric) compareAndDelete(name, key string, oldval []byte) (bool, error) {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return false, err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Value: oldval,
+		}
+		resp, err := db.requestTo(member.String(), protocol.OpExCAD, req)
+		if err != nil {
+			return false, err
+		}
+		return len(resp.Value) == 1 && resp.Value[0] == 1, nil
+	}
+
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return false, err
+	}
+	dm.Lock()
+	defer dm.Unlock()
+
+	_, ok, err := db.compareValue(dm, hkey, oldval)
+	if err != nil || !ok {
+		return false, err
+	}
+	// delKeyVal deletes the key on the backups and the previous owners.
+	err = db.delKeyVal(dm, hkey, name, key, nil)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompareAndDelete deletes the given key, only if the current value is equal to old. The comparison is done
+// on the serialized values under the lock of the key's owner. It returns true if the key has been deleted.
+// It's thread-safe.
+func (dm *DMap) CompareAndDelete(key string, old interface{}) (bool, error) {
+	oldval, err := dm.db.serializerOf(dm.name).Marshal(old)
+	if err != nil {
+		return false, err
+	}
+	return dm.db.compareAndDelete(dm.name, key, oldval)
+}
+
+func boolValue(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (db *Olric) exCASOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.CASExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	oldLen := int(extra.OldLen)
+	if oldLen > len(req.Value) {
+		return req.Error(protocol.StatusInternalServerError, protocol.ErrMalformedMessage)
+	}
+	swapped, err := db.compareAndSwap(req.DMap, req.Key, req.Value[:oldLen], req.Value[oldLen:])
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = boolValue(swapped)
+	return resp
+}
+
+func (db *Olric) exCADOperation(req *protocol.Message) *protocol.Message {
+	deleted, err := db.compareAndDelete(req.DMap, req.Key, req.Value)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = boolValue(deleted)
+	return resp
+}
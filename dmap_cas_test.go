@@ -0,0 +1,192 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestDMap_CompareAndSwap(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1, dm2 := db1.NewDMap("mymap"), db2.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		swapped, err := dm1.CompareAndSwap(bkey(i), 0, 1)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if swapped {
+			t.Fatalf("Expected no swap for a missing key")
+		}
+		err = dm1.Put(bkey(i), 0)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// Increment the counters without locks.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, dm := range []*DMap{dm1, dm2} {
+			wg.Add(1)
+			go func(dm *DMap, key string) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					for {
+						value, err := dm.Get(key)
+						if err != nil {
+							t.Errorf("Expected nil. Got: %v", err)
+							return
+						}
+						swapped, err := dm.CompareAndSwap(key, value, value.(int)+1)
+						if err != nil {
+							t.Errorf("Expected nil. Got: %v", err)
+							return
+						}
+						if swapped {
+							break
+						}
+					}
+				}
+			}(dm, bkey(i))
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		value, err := dm2.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if value.(int) != 20 {
+			t.Fatalf("Expected 20. Got: %v", value)
+		}
+	}
+}
+
+func TestDMap_CompareAndDelete(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1, dm2 := db1.NewDMap("mymap"), db2.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm1.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		deleted, err := dm1.CompareAndDelete(bkey(i), bval(i+1))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if deleted {
+			t.Fatalf("Expected no delete for a different value")
+		}
+	}
+
+	// Two goroutines race on the same key, only one of them deletes it.
+	var wg sync.WaitGroup
+	results := make(chan bool, 20)
+	for i := 0; i < 10; i++ {
+		for _, dm := range []*DMap{dm1, dm2} {
+			wg.Add(1)
+			go func(dm *DMap, i int) {
+				defer wg.Done()
+				deleted, err := dm.CompareAndDelete(bkey(i), bval(i))
+				if err != nil {
+					t.Errorf("Expected nil. Got: %v", err)
+					return
+				}
+				results <- deleted
+			}(dm, i)
+		}
+	}
+	wg.Wait()
+	close(results)
+	var count int
+	for deleted := range results {
+		if deleted {
+			count++
+		}
+	}
+	if count != 10 {
+		t.Fatalf("Expected 10 deletes. Got: %d", count)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err = dm2.Get(bkey(i))
+		if err != ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+		}
+		// The backup has been deleted too.
+		hkey := db1.getHKey("mymap", bkey(i))
+		owner := db1.getBackupPartitionOwners(hkey)[0]
+		db := db1
+		if hostCmp(owner, db2.this) {
+			db = db2
+		}
+		bdm, err := db.getBackupDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if bdm.str.Check(hkey) {
+			t.Fatalf("Expected the backup of %s to be deleted", bkey(i))
+		}
+	}
+}
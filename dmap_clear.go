@@ -0,0 +1,140 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+// ClearError is returned by Clear if the DMap could not be cleared on some of the nodes.
+// It's cleared on the other ones, call Clear again to retry.
+type ClearError struct {
+	// Nodes maps the addresses of the failed nodes to their errors.
+	Nodes map[string]error
+}
+
+func (e *ClearError) Error() string {
+	return fmt.Sprintf("failed to clear DMap on %d nodes: %s", len(e.Nodes), joinNodeErrors(e.Nodes))
+}
+
+func (db *Olric) clearDMap(name string) error {
+	<-db.bcx.Done()
+	if db.bcx.Err() == context.DeadlineExceeded {
+		return ErrOperationTimeout
+	}
+
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, item := range db.discovery.getMembers() {
+		addr := item.String()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := &protocol.Message{
+				DMap: name,
+			}
+			_, err := db.requestTo(addr, protocol.OpClear, msg)
+			if err != nil {
+				db.log.Printf("[ERROR] Failed to clear dmap:%s on %s: %v", name, addr, err)
+				mu.Lock()
+				failed[addr] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		return &ClearError{Nodes: failed}
+	}
+	return nil
+}
+
+// Clear deletes all the keys of the DMap on the cluster, but the DMap itself is kept with its
+// configuration and its eviction state, unlike Destroy. Like Destroy, there is no global lock on
+// DMaps, the keys which are set concurrently may survive.
+//
+// It returns nil after every node in the cluster has confirmed that it has deleted the keys on the
+// primary copies and the backups of the DMap, even if the DMap doesn't exist or it's already empty.
+// Otherwise it returns a *ClearError which contains the failed nodes.
+func (dm *DMap) Clear() error {
+	return dm.db.clearDMap(dm.name)
+}
+
+func (db *Olric) exClearOperation(req *protocol.Message) *protocol.Message {
+	err := db.clearDMap(req.DMap)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	return req.Success()
+}
+
+// clearPartition deletes the keys of the DMap on the given partition.
+func (db *Olric) clearPartition(part *partition, name string) error {
+	tmp, ok := part.m.Load(name)
+	if !ok {
+		return nil
+	}
+	dm := tmp.(*dmap)
+	dm.Lock()
+	defer dm.Unlock()
+	if !part.hasDMap(name, dm) {
+		// It has already been moved or deleted by a concurrent call.
+		return nil
+	}
+
+	keys := make(map[uint64]string)
+	err := dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+		keys[hkey] = vdata.Key
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for hkey, key := range keys {
+		if err := db.deleteEntry(dm, name, hkey, key); err != nil {
+			return err
+		}
+		db.addTombstone(dm, hkey)
+		if dm.tracker != nil {
+			dm.tracker.remove(hkey)
+		}
+		if dm.idle != nil {
+			dm.idle.remove(hkey)
+		}
+	}
+	return nil
+}
+
+func (db *Olric) clearOperation(req *protocol.Message) *protocol.Message {
+	// Fail early. The caller may want to call again if one of the steps have failed.
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		if err := db.clearPartition(db.partitions[partID], req.DMap); err != nil {
+			return errorResponse(req, err)
+		}
+		if db.config.BackupCount != 0 {
+			if err := db.clearPartition(db.backups[partID], req.DMap); err != nil {
+				return errorResponse(req, err)
+			}
+		}
+	}
+	return req.Success()
+}
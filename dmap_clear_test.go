@@ -0,0 +1,115 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDMap_Clear(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {DefaultTTL: time.Hour, EvictionPolicy: LRUEviction, MaxKeys: 1000},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	err = db1.NewDMap("absent").Clear()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	// Clear is idempotent.
+	for i := 0; i < 2; i++ {
+		err = dm.Clear()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		_, err = dm.Get(bkey(i))
+		if err != ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+		}
+	}
+
+	// The primary copies and the backups are empty but the DMaps are kept.
+	var count int
+	for _, db := range []*Olric{db1, db2} {
+		for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+			for _, part := range []*partition{db.partitions[partID], db.backups[partID]} {
+				tmp, ok := part.m.Load("mymap")
+				if !ok {
+					continue
+				}
+				count++
+				d := tmp.(*dmap)
+				d.Lock()
+				if d.str.Len() != 0 {
+					t.Fatalf("Expected an empty storage on PartID(backup: %t): %d. Got: %d keys", part.backup, partID, d.str.Len())
+				}
+				if !part.backup && d.tracker == nil {
+					t.Fatalf("Expected the eviction tracker to be kept on PartID: %d", partID)
+				}
+				d.Unlock()
+			}
+		}
+	}
+	if count == 0 {
+		t.Fatalf("Expected the DMaps to be kept")
+	}
+
+	// The configuration of the DMap still applies.
+	err = dm.Put(bkey(1), bval(1))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, ttl, err := dm.GetWithTTL(bkey(1))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("Expected the default TTL. Got: %v", ttl)
+	}
+}
@@ -15,6 +15,10 @@
 package olric
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -44,6 +48,14 @@ func (db *Olric) deleteStaleDMaps() {
 			d := dm.(*dmap)
 			d.Lock()
 			defer d.Unlock()
+			if !part.hasDMap(name.(string), d) {
+				// It has already been moved by fsck.
+				return true
+			}
+			if d.reapTombstones() != 0 {
+				// Keep the DMap until its tombstones are reaped.
+				return true
+			}
 			if d.str.Len() != 0 {
 				// Continue scanning.
 				return true
@@ -84,7 +96,19 @@ func (db *Olric) deleteStaleDMaps() {
 	}
 }
 
-func (db *Olric) delKeyVal(dm *dmap, hkey uint64, name, key string) error {
+func (db *Olric) delKeyVal(dm *dmap, hkey uint64, name, key string, trace *protocol.TraceContext) error {
+	if db.config.BackupCount != 0 {
+		err := db.deleteKeyValBackup(hkey, name, key, trace)
+		if err != nil {
+			return err
+		}
+	}
+	return db.delKeyValOnOwners(dm, hkey, name, key, trace)
+}
+
+// delKeyValOnOwners deletes the key/value pair on the previous owners and on this node, but not
+// on the backups.
+func (db *Olric) delKeyValOnOwners(dm *dmap, hkey uint64, name, key string, trace *protocol.TraceContext) error {
 	owners := db.getPartitionOwners(hkey)
 	if len(owners) == 0 {
 		panic("partition owners list cannot be empty")
@@ -97,35 +121,39 @@ func (db *Olric) delKeyVal(dm *dmap, hkey uint64, name, key string) error {
 		idx := len(owners) - i
 		owner := owners[idx]
 		msg := &protocol.Message{
-			DMap: name,
-			Key:  key,
+			DMap:  name,
+			Key:   key,
+			Trace: trace,
 		}
 		_, err := db.requestTo(owner.String(), protocol.OpDeletePrev, msg)
 		if err != nil {
 			return err
 		}
 	}
-	if db.config.BackupCount != 0 {
-		err := db.deleteKeyValBackup(hkey, name, key)
-		if err != nil {
-			return err
-		}
+	if dm.tracker != nil {
+		dm.tracker.remove(hkey)
 	}
-	if db.config.OperationMode == OpInMemoryWithSnapshot {
-		dm.oplog.Delete(hkey)
+	if dm.idle != nil {
+		dm.idle.remove(hkey)
+	}
+	err := db.deleteEntry(dm, name, hkey, key)
+	if err != nil {
+		return err
 	}
-	return dm.str.Delete(hkey)
+	db.addTombstone(dm, hkey)
+	return nil
 }
 
-func (db *Olric) deleteKey(name, key string) error {
+func (db *Olric) deleteKey(name, key string, trace *protocol.TraceContext) error {
 	member, hkey, err := db.locateKey(name, key)
 	if err != nil {
 		return err
 	}
 	if !hostCmp(member, db.this) {
 		msg := &protocol.Message{
-			DMap: name,
-			Key:  key,
+			DMap:  name,
+			Key:   key,
+			Trace: trace,
 		}
 		_, err := db.requestTo(member.String(), protocol.OpExDelete, msg)
 		return err
@@ -137,19 +165,19 @@ func (db *Olric) deleteKey(name, key string) error {
 	}
 	dm.Lock()
 	defer dm.Unlock()
-	return db.delKeyVal(dm, hkey, name, key)
+	return db.delKeyVal(dm, hkey, name, key, trace)
 }
 
 // Delete deletes the value for the given key. Delete will not return error if key doesn't exist. It's thread-safe.
 // It is safe to modify the contents of the argument after Delete returns.
 func (dm *DMap) Delete(key string) error {
-	return dm.db.deleteKey(dm.name, key)
+	return dm.db.deleteKey(dm.name, key, nil)
 }
 
 func (db *Olric) exDeleteOperation(req *protocol.Message) *protocol.Message {
-	err := db.deleteKey(req.DMap, req.Key)
+	err := db.deleteKey(req.DMap, req.Key, req.Trace)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
@@ -158,18 +186,20 @@ func (db *Olric) deletePrevOperation(req *protocol.Message) *protocol.Message {
 	hkey := db.getHKey(req.DMap, req.Key)
 	dm, err := db.getDMap(req.DMap, hkey)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	dm.Lock()
 	defer dm.Unlock()
 
-	err = dm.str.Delete(hkey)
+	err = db.deleteEntry(dm, req.DMap, hkey, req.Key)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
-
-	if db.config.OperationMode == OpInMemoryWithSnapshot {
-		dm.oplog.Delete(hkey)
+	if dm.tracker != nil {
+		dm.tracker.remove(hkey)
+	}
+	if dm.idle != nil {
+		dm.idle.remove(hkey)
 	}
 	return req.Success()
 }
@@ -179,22 +209,23 @@ func (db *Olric) deleteBackupOperation(req *protocol.Message) *protocol.Message
 	hkey := db.getHKey(req.DMap, req.Key)
 	dm, err := db.getBackupDMap(req.DMap, hkey)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	dm.Lock()
 	defer dm.Unlock()
 
-	err = dm.str.Delete(hkey)
+	err = db.deleteEntry(dm, req.DMap, hkey, req.Key)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
-	if db.config.OperationMode == OpInMemoryWithSnapshot {
-		dm.oplog.Delete(hkey)
+	db.addTombstone(dm, hkey)
+	if dm.idle != nil {
+		dm.idle.remove(hkey)
 	}
 	return req.Success()
 }
 
-func (db *Olric) deleteKeyValBackup(hkey uint64, name, key string) error {
+func (db *Olric) deleteKeyValBackup(hkey uint64, name, key string, trace *protocol.TraceContext) error {
 	backupOwners := db.getBackupPartitionOwners(hkey)
 	var g errgroup.Group
 	for _, backup := range backupOwners {
@@ -202,15 +233,246 @@ func (db *Olric) deleteKeyValBackup(hkey uint64, name, key string) error {
 		g.Go(func() error {
 			// TODO: Add retry with backoff
 			req := &protocol.Message{
-				DMap: name,
-				Key:  key,
+				DMap:  name,
+				Key:   key,
+				Trace: trace,
 			}
 			_, err := db.requestTo(mem.String(), protocol.OpDeleteBackup, req)
 			if err != nil {
 				db.log.Printf("[ERROR] Failed to delete backup key/value on %s: %s", name, err)
+				db.addHint(mem, name, hkey, key)
 			}
 			return err
 		})
 	}
 	return g.Wait()
 }
+
+// DeleteManyError is returned by DeleteMany if some of the keys could not be deleted.
+// The other keys have been deleted successfully.
+type DeleteManyError struct {
+	// Errors maps the failed keys to their errors.
+	Errors map[string]error
+}
+
+// Keys returns the failed keys in sorted order.
+func (e *DeleteManyError) Keys() []string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *DeleteManyError) Error() string {
+	return fmt.Sprintf("failed to delete %d keys: %v", len(e.Errors), e.Keys())
+}
+
+func (db *Olric) deleteMany(name string, keys []string) error {
+	// Group the keys by their owners. Only one request is sent to a remote node.
+	local := make(map[string]uint64)
+	remote := make(map[string][]string)
+	for _, key := range keys {
+		member, hkey, err := db.locateKey(name, key)
+		if err != nil {
+			return err
+		}
+		if hostCmp(member, db.this) {
+			local[key] = hkey
+			continue
+		}
+		addr := member.String()
+		remote[addr] = append(remote[addr], key)
+	}
+
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	var wg sync.WaitGroup
+	for addr, batch := range remote {
+		wg.Add(1)
+		go func(addr string, batch []string) {
+			defer wg.Done()
+			req := &protocol.Message{
+				DMap:  name,
+				Value: protocol.EncodeKeys(batch),
+			}
+			resp, err := db.requestTo(addr, protocol.OpExMDelete, req)
+			if err == nil {
+				var errs map[string][]byte
+				errs, err = protocol.DecodeEntries(resp.Value)
+				if err == nil {
+					mu.Lock()
+					for key, msg := range errs {
+						failed[key] = errors.New(string(msg))
+					}
+					mu.Unlock()
+					return
+				}
+			}
+			mu.Lock()
+			for _, key := range batch {
+				failed[key] = err
+			}
+			mu.Unlock()
+		}(addr, batch)
+	}
+
+	if len(local) != 0 {
+		errs := db.deleteManyLocal(name, local)
+		mu.Lock()
+		for key, err := range errs {
+			failed[key] = err
+		}
+		mu.Unlock()
+	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		return &DeleteManyError{Errors: failed}
+	}
+	return nil
+}
+
+// deleteManyLocal deletes the keys owned by this node and returns the failed ones. The DMaps are
+// locked during the operation like the single Delete path, and every backup owner receives only
+// one request for all of its keys.
+func (db *Olric) deleteManyLocal(name string, keys map[string]uint64) map[string]error {
+	failed := make(map[string]error)
+	dmaps := make(map[uint64]*dmap)
+	for key, hkey := range keys {
+		partID := db.getPartitionID(hkey)
+		if _, ok := dmaps[partID]; ok {
+			continue
+		}
+		dm, err := db.getDMap(name, hkey)
+		if err != nil {
+			failed[key] = err
+			continue
+		}
+		dmaps[partID] = dm
+	}
+	// Lock the DMaps in the same order to prevent deadlocks between the concurrent calls.
+	partIDs := make([]uint64, 0, len(dmaps))
+	for partID := range dmaps {
+		partIDs = append(partIDs, partID)
+	}
+	sort.Slice(partIDs, func(i, j int) bool { return partIDs[i] < partIDs[j] })
+	for _, partID := range partIDs {
+		dmaps[partID].Lock()
+	}
+	defer func() {
+		for _, partID := range partIDs {
+			dmaps[partID].Unlock()
+		}
+	}()
+
+	if db.config.BackupCount != 0 {
+		backups := make(map[string][]string)
+		owners := make(map[string]host)
+		for key, hkey := range keys {
+			if _, ok := failed[key]; ok {
+				continue
+			}
+			for _, backup := range db.getBackupPartitionOwners(hkey) {
+				addr := backup.String()
+				owners[addr] = backup
+				backups[addr] = append(backups[addr], key)
+			}
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for addr, batch := range backups {
+			wg.Add(1)
+			go func(owner host, batch []string) {
+				defer wg.Done()
+				req := &protocol.Message{
+					DMap:  name,
+					Value: protocol.EncodeKeys(batch),
+				}
+				_, err := db.requestTo(owner.String(), protocol.OpMDeleteBackup, req)
+				if err == nil {
+					return
+				}
+				db.log.Printf("[ERROR] Failed to delete %d backup keys/values of %s on %s: %v",
+					len(batch), name, owner, err)
+				mu.Lock()
+				defer mu.Unlock()
+				for _, key := range batch {
+					db.addHint(owner, name, keys[key], key)
+					failed[key] = err
+				}
+			}(owners[addr], batch)
+		}
+		wg.Wait()
+	}
+
+	for key, hkey := range keys {
+		if _, ok := failed[key]; ok {
+			continue
+		}
+		if err := db.delKeyValOnOwners(dmaps[db.getPartitionID(hkey)], hkey, name, key, nil); err != nil {
+			failed[key] = err
+		}
+	}
+	return failed
+}
+
+// DeleteMany deletes the values for the given keys. It sends only one request to every node which owns
+// some of the keys, and the owners send only one request to every backup owner. It returns
+// a *DeleteManyError which lists the failed keys, if some of the keys could not be deleted. Like Delete,
+// it doesn't return an error for the absent keys. It's thread-safe.
+func (dm *DMap) DeleteMany(keys ...string) error {
+	return dm.db.deleteMany(dm.name, keys)
+}
+
+func (db *Olric) exMDeleteOperation(req *protocol.Message) *protocol.Message {
+	keys, err := protocol.DecodeKeys(req.Value)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	err = db.deleteMany(req.DMap, keys)
+	if err == nil {
+		return req.Success()
+	}
+	derr, ok := err.(*DeleteManyError)
+	if !ok {
+		return errorResponse(req, err)
+	}
+	// Return the failed keys with their error messages.
+	errs := make(map[string][]byte, len(derr.Errors))
+	for key, e := range derr.Errors {
+		errs[key] = []byte(e.Error())
+	}
+	resp := req.Success()
+	resp.Value = protocol.EncodeEntries(errs)
+	return resp
+}
+
+func (db *Olric) mDeleteBackupOperation(req *protocol.Message) *protocol.Message {
+	// TODO: We may need to check backup ownership
+	keys, err := protocol.DecodeKeys(req.Value)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	for _, key := range keys {
+		hkey := db.getHKey(req.DMap, key)
+		dm, err := db.getBackupDMap(req.DMap, hkey)
+		if err != nil {
+			return errorResponse(req, err)
+		}
+		dm.Lock()
+		err = db.deleteEntry(dm, req.DMap, hkey, key)
+		if err == nil {
+			db.addTombstone(dm, hkey)
+			if dm.idle != nil {
+				dm.idle.remove(hkey)
+			}
+		}
+		dm.Unlock()
+		if err != nil {
+			return errorResponse(req, err)
+		}
+	}
+	return req.Success()
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// localDeleteByPattern deletes the matching keys of the given dmap on the partitions owned by
+// this node and returns the number of deleted keys. The deletions are propagated to the backups
+// like DeleteMany.
+func (db *Olric) localDeleteByPattern(name, pattern string) (uint64, error) {
+	match, err := compileQuery(pattern, false)
+	if err != nil {
+		return 0, err
+	}
+	keys := make(map[string]uint64)
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		part.RLock()
+		owned := len(part.owners) != 0 && hostCmp(part.owners[len(part.owners)-1], db.this)
+		part.RUnlock()
+		if !owned {
+			continue
+		}
+		tmp, ok := part.m.Load(name)
+		if !ok {
+			continue
+		}
+		dm := tmp.(*dmap)
+		dm.Lock()
+		dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+			if !isKeyExpired(vdata.TTL) && match.MatchString(vdata.Key) {
+				keys[vdata.Key] = hkey
+			}
+			return true
+		})
+		dm.Unlock()
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	failed := db.deleteManyLocal(name, keys)
+	deleted := uint64(len(keys) - len(failed))
+	if len(failed) != 0 {
+		return deleted, &DeleteManyError{Errors: failed}
+	}
+	return deleted, nil
+}
+
+func (db *Olric) deleteByPattern(name, pattern string) (uint64, error) {
+	<-db.bcx.Done()
+	if db.bcx.Err() == context.DeadlineExceeded {
+		return 0, ErrOperationTimeout
+	}
+	// Fail early with an invalid pattern.
+	if _, err := compileQuery(pattern, false); err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	var g errgroup.Group
+	for _, item := range db.discovery.getMembers() {
+		member := item
+		g.Go(func() error {
+			if hostCmp(member, db.this) {
+				deleted, err := db.localDeleteByPattern(name, pattern)
+				atomic.AddUint64(&total, deleted)
+				return err
+			}
+			req := &protocol.Message{
+				DMap:  name,
+				Value: []byte(pattern),
+			}
+			resp, err := db.requestTo(member.String(), protocol.OpDeleteByPattern, req)
+			if err != nil {
+				return err
+			}
+			if extra, ok := resp.Extra.(protocol.LenExtra); ok {
+				atomic.AddUint64(&total, extra.Count)
+			}
+			return nil
+		})
+	}
+	err := g.Wait()
+	return total, err
+}
+
+// DeleteByPattern deletes the keys which match the given glob pattern and returns the number of deleted
+// keys. The pattern has the same syntax with Query. Keys are matched and deleted on the partition owners,
+// they're not transferred to the caller, and the deletions are propagated to the backups. Like Query, the
+// keys which are set concurrently or while partitions are moving between nodes may survive. If some of the
+// keys could not be deleted, it returns an error with the number of the deleted ones. It's thread-safe.
+func (dm *DMap) DeleteByPattern(pattern string) (int, error) {
+	total, err := dm.db.deleteByPattern(dm.name, pattern)
+	return int(total), err
+}
+
+func (db *Olric) exDeleteByPatternOperation(req *protocol.Message) *protocol.Message {
+	total, err := db.deleteByPattern(req.DMap, string(req.Value))
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Extra = protocol.LenExtra{Count: total}
+	return resp
+}
+
+func (db *Olric) deleteByPatternOperation(req *protocol.Message) *protocol.Message {
+	total, err := db.localDeleteByPattern(req.DMap, string(req.Value))
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Extra = protocol.LenExtra{Count: total}
+	return resp
+}
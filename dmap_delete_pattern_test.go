@@ -0,0 +1,109 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+func TestDMap_DeleteByPattern(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put("user:"+strconv.Itoa(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		err = dm.Put("session:"+strconv.Itoa(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	count, err := db2.NewDMap("mymap").DeleteByPattern("user:?0")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if count != 9 {
+		t.Fatalf("Expected 9 deleted keys. Got: %d", count)
+	}
+	count, err = db2.NewDMap("mymap").DeleteByPattern("user:*")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if count != 91 {
+		t.Fatalf("Expected 91 deleted keys. Got: %d", count)
+	}
+
+	result, err := dm.Query("*")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(result) != 100 {
+		t.Fatalf("Expected 100 keys. Got: %d", len(result))
+	}
+	for key := range result {
+		if !strings.HasPrefix(key, "session:") {
+			t.Fatalf("Expected %s to be deleted", key)
+		}
+	}
+
+	// The deletions have been propagated to the backups.
+	for _, db := range []*Olric{db1, db2} {
+		for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+			tmp, ok := db.backups[partID].m.Load("mymap")
+			if !ok {
+				continue
+			}
+			d := tmp.(*dmap)
+			d.Lock()
+			d.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+				if strings.HasPrefix(vdata.Key, "user:") {
+					t.Fatalf("Expected %s to be deleted on the backup", vdata.Key)
+				}
+				return true
+			})
+			d.Unlock()
+		}
+	}
+}
@@ -16,38 +16,81 @@ package olric
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/buraksezer/olric/internal/protocol"
 	"github.com/buraksezer/olric/internal/snapshot"
-	"golang.org/x/sync/errgroup"
 )
 
+// DestroyError is returned by Destroy if the DMap could not be destroyed on some of the nodes.
+// It's destroyed on the other ones, call Destroy again to retry.
+type DestroyError struct {
+	// Nodes maps the addresses of the failed nodes to their errors.
+	Nodes map[string]error
+}
+
+func (e *DestroyError) Error() string {
+	return fmt.Sprintf("failed to destroy DMap on %d nodes: %s", len(e.Nodes), joinNodeErrors(e.Nodes))
+}
+
+// joinNodeErrors formats the errors of the nodes, sorted by their addresses.
+func joinNodeErrors(nodes map[string]error) string {
+	addrs := make([]string, 0, len(nodes))
+	for addr := range nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for i, addr := range addrs {
+		addrs[i] = fmt.Sprintf("%s: %v", addr, nodes[addr])
+	}
+	return strings.Join(addrs, ", ")
+}
+
 func (db *Olric) destroyDMap(name string) error {
 	<-db.bcx.Done()
 	if db.bcx.Err() == context.DeadlineExceeded {
 		return ErrOperationTimeout
 	}
 
-	var g errgroup.Group
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	var wg sync.WaitGroup
 	for _, item := range db.discovery.getMembers() {
 		addr := item.String()
-		g.Go(func() error {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 			msg := &protocol.Message{
 				DMap: name,
 			}
 			_, err := db.requestTo(addr, protocol.OpDestroyDMap, msg)
 			if err != nil {
-				db.log.Printf("[ERROR] Failed to destroy dmap:%s on %s", name, addr)
+				db.log.Printf("[ERROR] Failed to destroy dmap:%s on %s: %v", name, addr, err)
+				mu.Lock()
+				failed[addr] = err
+				mu.Unlock()
 			}
-			return err
-		})
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		return &DestroyError{Nodes: failed}
 	}
-	return g.Wait()
+	return nil
 }
 
 // Destroy flushes the given DMap on the cluster. You should know that there
 // is no global lock on DMaps. So if you call Put/PutEx and Destroy methods
 // concurrently on the cluster, Put/PutEx calls may set new values to the DMap.
+//
+// It returns nil after every node in the cluster has confirmed that it has destroyed the primary
+// copies and the backups of the DMap, even if the DMap doesn't exist. Otherwise it returns
+// a *DestroyError which contains the failed nodes.
 func (dm *DMap) Destroy() error {
 	return dm.db.destroyDMap(dm.name)
 }
@@ -55,7 +98,7 @@ func (dm *DMap) Destroy() error {
 func (db *Olric) exDestroyOperation(req *protocol.Message) *protocol.Message {
 	err := db.destroyDMap(req.DMap)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
@@ -68,6 +111,12 @@ func (db *Olric) destroyDMapOperation(req *protocol.Message) *protocol.Message {
 			return nil
 		}
 		dm := tmp.(*dmap)
+		dm.Lock()
+		defer dm.Unlock()
+		if !part.hasDMap(req.DMap, dm) {
+			// It has already been moved or deleted by a concurrent call.
+			return nil
+		}
 		if err := dm.str.Close(); err != nil {
 			return err
 		}
@@ -81,6 +130,7 @@ func (db *Olric) destroyDMapOperation(req *protocol.Message) *protocol.Message {
 			}
 		}
 		part.m.Delete(req.DMap)
+		atomic.AddInt32(&part.count, -1)
 		return nil
 	}
 	// Fail early. The caller may want to call again if one of the steps have failed.
@@ -88,13 +138,13 @@ func (db *Olric) destroyDMapOperation(req *protocol.Message) *protocol.Message {
 		// Delete primary copies
 		part := db.partitions[partID]
 		if err := destroy(part); err != nil {
-			return req.Error(protocol.StatusInternalServerError, err)
+			return errorResponse(req, err)
 		}
 		// Delete from Backups
 		if db.config.BackupCount != 0 {
 			bpart := db.backups[partID]
 			if err := destroy(bpart); err != nil {
-				return req.Error(protocol.StatusInternalServerError, err)
+				return errorResponse(req, err)
 			}
 		}
 	}
@@ -0,0 +1,112 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// localDump returns a batch of records on the given partition, starting from the cursor.
+func (db *Olric) localDump(name string, cursor protocol.ScanExtra) ([]protocol.Record, protocol.ScanExtra) {
+	items, next := db.scanItems(name, cursor, func(string) bool { return true })
+	records := make([]protocol.Record, 0, len(items))
+	for _, item := range items {
+		records = append(records, protocol.Record{Key: item.key, Value: item.value, TTL: item.ttl})
+	}
+	return records, next
+}
+
+func (db *Olric) dumpPartition(name string, cursor protocol.ScanExtra) ([]protocol.Record, protocol.ScanExtra, error) {
+	part := db.partitions[cursor.PartID]
+	part.RLock()
+	if len(part.owners) == 0 {
+		part.RUnlock()
+		return nil, cursor, fmt.Errorf("no owner found for PartID: %d", cursor.PartID)
+	}
+	owner := part.owners[len(part.owners)-1]
+	part.RUnlock()
+
+	if hostCmp(owner, db.this) {
+		records, next := db.localDump(name, cursor)
+		return records, next, nil
+	}
+	req := &protocol.Message{
+		DMap:  name,
+		Extra: cursor,
+	}
+	resp, err := db.requestTo(owner.String(), protocol.OpDump, req)
+	if err != nil {
+		return nil, cursor, err
+	}
+	records, err := protocol.DecodeRecords(resp.Value)
+	if err != nil {
+		return nil, cursor, err
+	}
+	next, ok := resp.Extra.(protocol.ScanExtra)
+	if !ok {
+		return nil, cursor, fmt.Errorf("invalid response: no cursor")
+	}
+	return records, next, nil
+}
+
+// Dump writes all the entries of the DMap to w with their expiry times, in the format read by Load.
+// The entries are read from the partition owners in batches, like Scan, and only one batch is kept
+// in memory. The result has the same guarantees with Scan. The values are written as they are stored,
+// encoded with the serializer of the DMap.
+func (dm *DMap) Dump(w io.Writer) error {
+	<-dm.db.bcx.Done()
+	if dm.db.bcx.Err() == context.DeadlineExceeded {
+		return ErrOperationTimeout
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := protocol.WriteDumpHeader(bw); err != nil {
+		return err
+	}
+	var cursor protocol.ScanExtra
+	for cursor.PartID < dm.db.config.PartitionCount {
+		records, next, err := dm.db.dumpPartition(dm.name, cursor)
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if err = protocol.WriteRecord(bw, rec); err != nil {
+				return err
+			}
+		}
+		cursor = next
+	}
+	return bw.Flush()
+}
+
+func (db *Olric) dumpOperation(req *protocol.Message) *protocol.Message {
+	cursor, ok := req.Extra.(protocol.ScanExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	if cursor.PartID >= db.config.PartitionCount {
+		return req.Error(protocol.StatusInternalServerError, fmt.Sprintf("invalid PartID: %d", cursor.PartID))
+	}
+	records, next := db.localDump(req.DMap, cursor)
+	resp := req.Success()
+	resp.Extra = next
+	resp.Value = protocol.EncodeRecords(records)
+	return resp
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestDMap_Dump(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 500; i++ {
+		if i%2 == 0 {
+			err = dm.PutEx(bkey(i), bval(i), time.Hour)
+		} else {
+			err = dm.Put(bkey(i), bval(i))
+		}
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = dm.Dump(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// Count the records in the dump.
+	r := bytes.NewReader(buf.Bytes())
+	err = protocol.ReadDumpHeader(r)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var count int
+	for {
+		_, err = protocol.ReadRecord(r, protocol.MaxValueSize)
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 500 {
+		t.Fatalf("Expected 500 records in the dump. Got: %d", count)
+	}
+
+	copied := db2.NewDMap("copy")
+	n, err := copied.Load(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if n != 500 {
+		t.Fatalf("Expected 500 records to be loaded. Got: %d", n)
+	}
+	for i := 0; i < 500; i++ {
+		value, ttl, err := copied.GetWithTTL(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for %s", err, bkey(i))
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Expected %s. Got: %v", bval(i), value)
+		}
+		if i%2 == 0 && (ttl <= 0 || ttl > time.Hour) {
+			t.Fatalf("Expected the TTL to be kept for %s. Got: %v", bkey(i), ttl)
+		}
+		if i%2 == 1 && ttl != NoTTL {
+			t.Fatalf("Expected NoTTL for %s. Got: %v", bkey(i), ttl)
+		}
+	}
+}
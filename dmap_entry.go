@@ -0,0 +1,152 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+// Entry is a key with its value and metadata. It's returned by GetEntry.
+type Entry struct {
+	Key   string
+	Value interface{}
+
+	// TTL is the remaining lifetime of the key. It's NoTTL if the key doesn't expire.
+	TTL time.Duration
+
+	// LastAccess is the last access time of the key before GetEntry. It's only tracked if
+	// MaxIdleDuration is set for the DMap and recorded with a resolution of a tenth of it,
+	// otherwise it's zero.
+	LastAccess time.Time
+
+	// PartID is the ID of the partition which the key belongs to.
+	PartID uint64
+
+	// Owner is the address of the node which owns the partition.
+	Owner string
+}
+
+// entry is the raw form of Entry which is sent over the wire.
+type entry struct {
+	vdata      *storage.VData
+	lastAccess int64
+	partID     uint64
+	owner      string
+}
+
+func entryFromResponse(key string, resp *protocol.Message) (*entry, error) {
+	extra, ok := resp.Extra.(protocol.GetEntryExtra)
+	if !ok || int(extra.OwnerLen) > len(resp.Value) {
+		return nil, protocol.ErrMalformedMessage
+	}
+	return &entry{
+		vdata: &storage.VData{
+			Key:   key,
+			TTL:   extra.TTL,
+			Value: resp.Value[extra.OwnerLen:],
+		},
+		lastAccess: extra.LastAccess,
+		partID:     extra.PartID,
+		owner:      string(resp.Value[:extra.OwnerLen]),
+	}, nil
+}
+
+func (db *Olric) getEntry(name, key string) (*entry, error) {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return nil, err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap: name,
+			Key:  key,
+		}
+		resp, err := db.requestTo(member.String(), protocol.OpExGetEntry, req)
+		if err != nil {
+			return nil, err
+		}
+		return entryFromResponse(key, resp)
+	}
+
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return nil, err
+	}
+	var lastAccess int64
+	if dm.idle != nil {
+		// Read it before getKeyVal records this access.
+		lastAccess, _ = dm.idle.lastAccess(hkey)
+	}
+	vdata, err := db.getKeyVal(hkey, name, key)
+	if err != nil {
+		return nil, err
+	}
+	return &entry{
+		vdata:      vdata,
+		lastAccess: lastAccess,
+		partID:     db.getPartitionID(hkey),
+		owner:      db.this.String(),
+	}, nil
+}
+
+// GetEntry gets the value and the metadata for the given key. It's useful for debugging and admin tools.
+// It returns ErrKeyNotFound if the DB does not contain the key. It's thread-safe.
+func (dm *DMap) GetEntry(key string) (*Entry, error) {
+	e, err := dm.db.getEntry(dm.name, key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := dm.db.unmarshalValue(dm.name, e.vdata.Value)
+	if err != nil {
+		return nil, err
+	}
+	var lastAccess time.Time
+	if e.lastAccess != 0 {
+		lastAccess = time.Unix(0, e.lastAccess)
+	}
+	return &Entry{
+		Key:        key,
+		Value:      value,
+		TTL:        remainingTTL(e.vdata.TTL),
+		LastAccess: lastAccess,
+		PartID:     e.partID,
+		Owner:      e.owner,
+	}, nil
+}
+
+func (db *Olric) exGetEntryOperation(req *protocol.Message) *protocol.Message {
+	e, err := db.getEntry(req.DMap, req.Key)
+	if err == ErrKeyNotFound {
+		return req.Error(protocol.StatusKeyNotFound, "")
+	}
+	if err == ErrReadQuorum {
+		return req.Error(protocol.StatusReadQuorum, err)
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Extra = protocol.GetEntryExtra{
+		TTL:        e.vdata.TTL,
+		LastAccess: e.lastAccess,
+		PartID:     e.partID,
+		OwnerLen:   uint16(len(e.owner)),
+	}
+	resp.Value = append([]byte(e.owner), e.vdata.Value...)
+	return resp
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDMap_GetEntry(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.PutEx(bkey(i), bval(i), time.Hour)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	dm2 := db2.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		entry, err := dm2.GetEntry(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(entry.Value.([]byte), bval(i)) {
+			t.Fatalf("Value is different for %s", bkey(i))
+		}
+		if entry.TTL <= 0 || entry.TTL > time.Hour {
+			t.Fatalf("Expected a TTL between 0 and 1 hour. Got: %v", entry.TTL)
+		}
+		if !entry.LastAccess.IsZero() {
+			t.Fatalf("Expected zero LastAccess. Got: %v", entry.LastAccess)
+		}
+		owner, hkey, err := db1.locateKey("mymap", bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if entry.PartID != db1.getPartitionID(hkey) {
+			t.Fatalf("Expected PartID: %d. Got: %d", db1.getPartitionID(hkey), entry.PartID)
+		}
+		if entry.Owner != owner.String() {
+			t.Fatalf("Expected Owner: %s. Got: %s", owner, entry.Owner)
+		}
+	}
+
+	_, err = dm2.GetEntry("missing-key")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
+
+func TestDMap_GetEntryLastAccess(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {MaxIdleDuration: time.Hour},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	start := time.Now()
+	dm := db.NewDMap("mymap")
+	err = dm.Put("mykey", "myvalue")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	entry, err := dm.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if entry.Value.(string) != "myvalue" {
+		t.Fatalf("Expected myvalue. Got: %v", entry.Value)
+	}
+	if entry.TTL != NoTTL {
+		t.Fatalf("Expected NoTTL. Got: %v", entry.TTL)
+	}
+	if entry.LastAccess.Before(start) || entry.LastAccess.After(time.Now()) {
+		t.Fatalf("Expected LastAccess after %v. Got: %v", start, entry.LastAccess)
+	}
+}
@@ -15,8 +15,9 @@
 package olric
 
 import (
-	"math/rand"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/buraksezer/olric/internal/storage"
@@ -24,30 +25,44 @@ import (
 
 func (db *Olric) evictKeysAtBackground() {
 	defer db.wg.Done()
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+	// Every partition has its own sweeper. The first sweeps are spread over the interval.
+	step := db.config.ExpirySweepInterval / time.Duration(db.config.PartitionCount)
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		db.wg.Add(1)
+		go db.evictKeysOnPartitionAtBackground(partID, time.Duration(partID)*step)
+	}
+}
 
+func (db *Olric) evictKeysOnPartitionAtBackground(partID uint64, delay time.Duration) {
+	defer db.wg.Done()
+	select {
+	case <-db.ctx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	ticker := time.NewTicker(db.config.ExpirySweepInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-db.ctx.Done():
 			return
 		case <-ticker.C:
-			db.evictKeys()
+			db.evictKeys(partID)
 		}
 	}
 }
 
-func (db *Olric) evictKeys() {
-	partID := uint64(rand.Intn(int(db.config.PartitionCount)))
+func (db *Olric) evictKeys(partID uint64) {
 	part := db.partitions[partID]
 
 	var wg sync.WaitGroup
+	dcount := 0
 	part.m.Range(func(name, tmp interface{}) bool {
 		dm := tmp.(*dmap)
 		// Picks 20 map objects randomly to check out expired keys. Then waits until all the goroutines done.
-		dcount := 0
 		dcount++
-		if dcount >= 20 {
+		if dcount > 20 {
 			return false
 		}
 		wg.Add(1)
@@ -60,37 +75,47 @@ func (db *Olric) evictKeys() {
 
 func (db *Olric) scanDMapForEviction(partID uint64, name string, dm *dmap, wg *sync.WaitGroup) {
 	/*
-		1- Test 20 random keys from the set of keys with an associated expire.
-		2- Delete all the keys found expired.
+		1- Test ExpirySweepSampleSize random keys from the set of keys with an associated expire.
+		2- Delete all the keys found expired. delKeyVal deletes them on the backups too.
 		3- If more than 25% of keys were expired, start again from step 1.
 	*/
 	defer wg.Done()
 	dm.Lock()
 	defer dm.Unlock()
 	var totalCount = 0
-	var maxKcount = 20
+	var maxKcount = db.config.ExpirySweepSampleSize
 	janitor := func() bool {
 		dcount, kcount := 0, 0
-		dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
-			kcount++
+		// Deleting a key in Range deadlocks, collect the expired keys first.
+		expired := make(map[uint64]string)
+		err := dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
 			if kcount >= maxKcount {
 				return false
 			}
+			kcount++
 			if isKeyExpired(vdata.TTL) {
-				err := db.delKeyVal(dm, hkey, name, vdata.Key)
-				if err != nil {
-					db.log.Printf("[ERROR] Failed to delete expired hkey: %d on DMap: %s: %v", hkey, name, err)
-					return true
-				}
-				dcount++
+				expired[hkey] = vdata.Key
 			}
 			return true
 		})
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to find the expired keys on DMap: %s: %v", name, err)
+		}
+		for hkey, key := range expired {
+			err := db.delKeyVal(dm, hkey, name, key, nil)
+			if err != nil {
+				db.log.Printf("[ERROR] Failed to delete expired hkey: %d on DMap: %s: %v", hkey, name, err)
+				continue
+			}
+			dcount++
+		}
 		totalCount += dcount
-		return dcount >= maxKcount/4
+		return dcount > 0 && dcount >= maxKcount/4
 	}
 	defer func() {
-		db.log.Printf("[DEBUG] Evicted key count is %d on PartID: %d", totalCount, partID)
+		if totalCount != 0 {
+			db.log.Printf("[DEBUG] Evicted key count is %d on PartID: %d", totalCount, partID)
+		}
 	}()
 	for {
 		select {
@@ -103,3 +128,105 @@ func (db *Olric) scanDMapForEviction(partID uint64, name string, dm *dmap, wg *s
 		}
 	}
 }
+
+// ttlTracker implements accessTracker for TTL-only eviction policy. It keeps no access metadata, the key
+// which is closest to expire is evicted first. The keys without a TTL are never evicted.
+type ttlTracker struct {
+	str *storage.Storage
+	log *log.Logger
+}
+
+func (t *ttlTracker) touch(hkey uint64) {}
+
+func (t *ttlTracker) remove(hkey uint64) {}
+
+func (t *ttlTracker) has(hkey uint64) bool { return true }
+
+func (t *ttlTracker) length() int { return t.str.Len() }
+
+func (t *ttlTracker) victim(except uint64) (uint64, bool) {
+	var hkey uint64
+	var ttl int64
+	err := t.str.Range(func(h uint64, vdata *storage.VData) bool {
+		if h == except || vdata.TTL == 0 {
+			return true
+		}
+		if ttl == 0 || vdata.TTL < ttl {
+			hkey, ttl = h, vdata.TTL
+		}
+		return true
+	})
+	if err != nil {
+		t.log.Printf("[ERROR] Failed to find the key which is closest to expire: %v", err)
+		return 0, false
+	}
+	return hkey, ttl != 0
+}
+
+// overBudget returns true if the DMap fragment exceeds MaxKeys or MaxInuse.
+func (dm *dmap) overBudget() bool {
+	if dm.config.MaxKeys > 0 && dm.str.Len() > dm.config.MaxKeys {
+		return true
+	}
+	if dm.config.MaxInuse > 0 && dm.str.Inuse() > dm.config.MaxInuse {
+		return true
+	}
+	return false
+}
+
+// evictionCandidate returns the key which should be evicted first except the given one.
+func (dm *dmap) evictionCandidate(except uint64) (uint64, bool, error) {
+	// The keys which have been moved from the other nodes have no access metadata. They
+	// haven't been accessed on this node, so evict them first.
+	if dm.tracker.length() < dm.str.Len() {
+		var hkey uint64
+		var found bool
+		err := dm.str.Range(func(h uint64, _ *storage.VData) bool {
+			if h != except && !dm.tracker.has(h) {
+				hkey, found = h, true
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return 0, false, err
+		}
+		if found {
+			return hkey, true, nil
+		}
+	}
+	hkey, ok := dm.tracker.victim(except)
+	return hkey, ok, nil
+}
+
+// evictKeysForBudget evicts keys by the eviction policy of the DMap until the fragment is within its
+// budget. The given key has just been written and it's never evicted. The caller must hold the lock of dm.
+func (db *Olric) evictKeysForBudget(dm *dmap, name string, except uint64) {
+	for dm.overBudget() {
+		hkey, ok, err := dm.evictionCandidate(except)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to find a key to evict on DMap: %s: %v", name, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		vdata, err := dm.str.Get(hkey)
+		if err == storage.ErrKeyNotFound {
+			// Stale access metadata.
+			dm.tracker.remove(hkey)
+			continue
+		}
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to get hkey: %d for eviction on DMap: %s: %v", hkey, name, err)
+			return
+		}
+		err = db.delKeyVal(dm, hkey, name, vdata.Key, nil)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to evict hkey: %d on DMap: %s: %v", hkey, name, err)
+			return
+		}
+		atomic.AddUint64(&db.evictions, 1)
+		atomic.AddUint64(&dm.evictions, 1)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDMap_LRUEvictionMaxKeys(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {
+			EvictionPolicy: LRUEviction,
+			MaxKeys:        10,
+		},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	hot := "hot-key"
+	err = dm.Put(hot, bval(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	count := 1000
+	for i := 0; i < count; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		// Keep the hot key recently used.
+		_, err = dm.Get(hot)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for the hot key", err)
+		}
+	}
+
+	var total int
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		tmp, ok := db.partitions[partID].m.Load("mymap")
+		if !ok {
+			continue
+		}
+		length := tmp.(*dmap).str.Len()
+		if length > 10 {
+			t.Fatalf("Expected at most 10 keys on PartID: %d. Got: %d", partID, length)
+		}
+		total += length
+	}
+	evictions := db.Stats().Evictions
+	if int(evictions) != count+1-total {
+		t.Fatalf("Expected %d evictions. Got: %d", count+1-total, evictions)
+	}
+
+	// The DMaps without an eviction policy are not bounded.
+	other := db.NewDMap("other")
+	for i := 0; i < count; i++ {
+		err = other.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	if db.Stats().Evictions != evictions {
+		t.Fatalf("Expected %d evictions. Got: %d", evictions, db.Stats().Evictions)
+	}
+}
+
+func TestDMap_LRUEvictionMaxInuse(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {
+			EvictionPolicy: LRUEviction,
+			MaxInuse:       1024,
+		},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	for i := 0; i < 1000; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		tmp, ok := db.partitions[partID].m.Load("mymap")
+		if !ok {
+			continue
+		}
+		inuse := tmp.(*dmap).str.Inuse()
+		if inuse > 1024 {
+			t.Fatalf("Expected at most 1024 bytes on PartID: %d. Got: %d", partID, inuse)
+		}
+	}
+	if db.Stats().Evictions == 0 {
+		t.Fatalf("Expected evictions")
+	}
+}
+
+func TestDMap_LFUEvictionMaxKeys(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {
+			EvictionPolicy: LFUEviction,
+			MaxKeys:        10,
+		},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	hot := "hot-key"
+	err = dm.Put(hot, bval(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		// Keep the hot key frequently used.
+		_, err = dm.Get(hot)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for the hot key", err)
+		}
+	}
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		tmp, ok := db.partitions[partID].m.Load("mymap")
+		if !ok {
+			continue
+		}
+		length := tmp.(*dmap).str.Len()
+		if length > 10 {
+			t.Fatalf("Expected at most 10 keys on PartID: %d. Got: %d", partID, length)
+		}
+	}
+	if db.Stats().Evictions == 0 {
+		t.Fatalf("Expected evictions")
+	}
+}
+
+func TestDMap_TTLOnlyEviction(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {
+			EvictionPolicy: TTLOnlyEviction,
+			MaxKeys:        10,
+		},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	persistent := "persistent-key"
+	err = dm.Put(persistent, bval(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		err = dm.PutEx(bkey(i), bval(i), time.Hour+time.Duration(i)*time.Second)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	// The keys without a TTL are never evicted.
+	_, err = dm.Get(persistent)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v for the persistent key", err)
+	}
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		tmp, ok := db.partitions[partID].m.Load("mymap")
+		if !ok {
+			continue
+		}
+		length := tmp.(*dmap).str.Len()
+		if length > 10 {
+			t.Fatalf("Expected at most 10 keys on PartID: %d. Got: %d", partID, length)
+		}
+	}
+	if db.Stats().Evictions == 0 {
+		t.Fatalf("Expected evictions")
+	}
+}
+
+func TestDMap_NoEviction(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {
+			EvictionPolicy: NoEviction,
+			MaxKeys:        10,
+		},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	for i := 0; i < 1000; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	if db.Stats().Evictions != 0 {
+		t.Fatalf("Expected no evictions. Got: %d", db.Stats().Evictions)
+	}
+}
+
+func TestDMap_ExpirySweeper(t *testing.T) {
+	newDB := func(peers []string) (*Olric, error) {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ExpirySweepInterval = 10 * time.Millisecond
+		cfg.ExpirySweepSampleSize = 5
+		db, err := startTestOlric(cfg)
+		if err != nil {
+			return nil, err
+		}
+		db.wg.Add(1)
+		go db.evictKeysAtBackground()
+		return db, nil
+	}
+	db1, err := newDB(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newDB(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.PutEx(bkey(i), bval(i), 50*time.Millisecond)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// The expired keys are removed from the owners and the backups without accessing them.
+	length := func() int {
+		var total int
+		for _, db := range []*Olric{db1, db2} {
+			for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+				for _, part := range []*partition{db.partitions[partID], db.backups[partID]} {
+					part.m.Range(func(k, v interface{}) bool {
+						total += v.(*dmap).str.Len()
+						return true
+					})
+				}
+			}
+		}
+		return total
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for length() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected all the expired keys to be evicted. Remaining: %d", length())
+		}
+		<-time.After(20 * time.Millisecond)
+	}
+}
+
+func TestDMap_UnknownEvictionPolicy(t *testing.T) {
+	_, err := New(&Config{
+		DMaps: map[string]DMapConfig{
+			"mymap": {EvictionPolicy: "foobar"},
+		},
+	})
+	if err == nil {
+		t.Fatalf("Expected an error for unknown eviction policy")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// jitterTimeout shortens the given timeout by a random amount of up to the TTL jitter of the dmap.
+func (db *Olric) jitterTimeout(dm *dmap, timeout time.Duration) time.Duration {
+	jitter := dm.config.TTLJitter
+	if jitter == 0 {
+		jitter = db.config.TTLJitter
+	}
+	if jitter == 0 || timeout <= 0 {
+		return timeout
+	}
+	timeout -= time.Duration(rand.Float64() * jitter * float64(timeout))
+	if timeout <= 0 {
+		// Zero means no TTL.
+		timeout = 1
+	}
+	return timeout
+}
+
+// updateTTL sets the TTL of an existing key on the given dmap without touching its value.
+func (db *Olric) updateTTL(dm *dmap, hkey uint64, name string, timeout time.Duration) error {
+	vdata, err := dm.str.Get(hkey)
+	if err == storage.ErrKeyNotFound {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if isKeyExpired(vdata.TTL) {
+		return ErrKeyNotFound
+	}
+
+	vdata.TTL = 0
+	if timeout.Seconds() != 0 {
+		vdata.TTL = getTTL(timeout)
+	}
+	return db.putEntry(dm, name, hkey, vdata)
+}
+
+func (db *Olric) expireKeyValBackup(hkey uint64, name, key string, timeout time.Duration) error {
+	memCount := db.discovery.numMembers()
+	backupCount := calcMaxBackupCount(db.config.BackupCount, memCount)
+	backupOwners := db.getBackupPartitionOwners(hkey)
+	if len(backupOwners) > backupCount {
+		backupOwners = backupOwners[len(backupOwners)-backupCount:]
+	}
+
+	var g errgroup.Group
+	for _, backup := range backupOwners {
+		mem := backup
+		g.Go(func() error {
+			msg := &protocol.Message{
+				DMap:  name,
+				Key:   key,
+				Extra: protocol.ExpireExtra{TTL: timeout.Nanoseconds()},
+			}
+			_, err := db.requestTo(mem.String(), protocol.OpExpireBackup, msg)
+			if err != nil {
+				db.log.Printf("[ERROR] Failed to update TTL of backup on %s: %s", mem, err)
+			}
+			return err
+		})
+	}
+	return g.Wait()
+}
+
+func (db *Olric) expire(name, key string, timeout time.Duration) error {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Extra: protocol.ExpireExtra{TTL: timeout.Nanoseconds()},
+		}
+		_, err = db.requestTo(member.String(), protocol.OpExpire, req)
+		return err
+	}
+
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return err
+	}
+	dm.Lock()
+	defer dm.Unlock()
+
+	// The backups get the same timeout.
+	timeout = db.jitterTimeout(dm, timeout)
+	err = db.updateTTL(dm, hkey, name, timeout)
+	if err != nil {
+		return err
+	}
+	if db.config.BackupCount != 0 {
+		if db.config.BackupMode == AsyncBackupMode {
+			db.wg.Add(1)
+			go func() {
+				defer db.wg.Done()
+				err := db.expireKeyValBackup(hkey, name, key, timeout)
+				if err != nil {
+					db.log.Printf("[ERROR] Failed to update TTL of backup in async mode: %v", err)
+				}
+			}()
+		} else {
+			err := db.expireKeyValBackup(hkey, name, key, timeout)
+			if err != nil {
+				return fmt.Errorf("failed to update TTL of backup in sync mode: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Expire updates the expiry for the given key without touching its value. A zero timeout
+// removes the expiry. It returns ErrKeyNotFound if the DB does not contain the key. It's thread-safe.
+func (dm *DMap) Expire(key string, timeout time.Duration) error {
+	return dm.db.expire(dm.name, key, timeout)
+}
+
+func (db *Olric) exExpireOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.ExpireExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	err := db.expire(req.DMap, req.Key, time.Duration(extra.TTL))
+	if err == ErrKeyNotFound {
+		return req.Error(protocol.StatusKeyNotFound, "")
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	return req.Success()
+}
+
+func (db *Olric) expireBackupOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.ExpireExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	hkey := db.getHKey(req.DMap, req.Key)
+	dm, err := db.getBackupDMap(req.DMap, hkey)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	dm.Lock()
+	defer dm.Unlock()
+
+	err = db.updateTTL(dm, hkey, req.DMap, time.Duration(extra.TTL))
+	if err == ErrKeyNotFound {
+		return req.Error(protocol.StatusKeyNotFound, "")
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	return req.Success()
+}
@@ -0,0 +1,348 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDMap_Expire(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		err = dm.Expire(bkey(i), 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// The new TTL is replicated to the backups.
+	for i := 0; i < 100; i++ {
+		hkey := db1.getHKey("mymap", bkey(i))
+		owner := db1.getBackupPartitionOwners(hkey)[0]
+		db := db1
+		if hostCmp(owner, db2.this) {
+			db = db2
+		}
+		bdm, err := db.getBackupDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		vdata, err := bdm.str.Get(hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if vdata.TTL == 0 {
+			t.Fatalf("Expected TTL to be set on the backup for %s", bkey(i))
+		}
+		value, err := db.unmarshalValue("mymap", vdata.Value)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value on the backup for %s", bkey(i))
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	// Update currentUnixNano to evict the key now.
+	atomic.StoreInt64(&currentUnixNano, time.Now().UnixNano())
+	for i := 0; i < 100; i++ {
+		_, err := dm.Get(bkey(i))
+		if err != ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+		}
+	}
+}
+
+func TestDMap_ExpireKeyNotFound(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	err = db.NewDMap("mymap").Expire("mykey", time.Second)
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
+
+func TestDMap_ExpirePersist(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	err = dm.PutEx("mykey", "myvalue", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// Zero timeout removes the expiry.
+	err = dm.Expire("mykey", 0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt64(&currentUnixNano, time.Now().UnixNano())
+	value, err := dm.Get("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if value.(string) != "myvalue" {
+		t.Fatalf("Expected myvalue. Got: %v", value)
+	}
+}
+
+func TestDMap_TTLJitter(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {TTLJitter: 0.1},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.PutEx(bkey(i), bval(i), time.Hour)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	expiries := make(map[int64]struct{})
+	for i := 0; i < 100; i++ {
+		_, ttl, err := dm.GetWithTTL(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if ttl < 54*time.Minute || ttl > time.Hour {
+			t.Fatalf("Expected a TTL between 54 minutes and 1 hour. Got: %v", ttl)
+		}
+
+		// The backup has the same absolute expiry with the owner.
+		owner, hkey, err := db1.locateKey("mymap", bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		primary, backup := db1, db2
+		if hostCmp(owner, db2.this) {
+			primary, backup = db2, db1
+		}
+		pdm, err := primary.getDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		bdm, err := backup.getBackupDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		pdata, err := pdm.str.Get(hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		bdata, err := bdm.str.Get(hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if pdata.TTL != bdata.TTL {
+			t.Fatalf("Expected the same expiry on the backup. Got: %d, %d", pdata.TTL, bdata.TTL)
+		}
+		expiries[pdata.TTL] = struct{}{}
+	}
+	if len(expiries) < 2 {
+		t.Fatalf("Expected randomized expiries. Got: %d distinct expiries", len(expiries))
+	}
+}
+
+func TestDMap_TTLJitterInvalid(t *testing.T) {
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.TTLJitter = 1.5
+	_, err = New(cfg)
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid TTL jitter")
+	}
+}
+
+func TestDMap_DefaultTTL(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {DefaultTTL: time.Hour},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		_, ttl, err := dm.GetWithTTL(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if ttl < 59*time.Minute || ttl > time.Hour {
+			t.Fatalf("Expected a TTL about 1 hour. Got: %v", ttl)
+		}
+
+		// The backup has the same absolute expiry with the owner.
+		owner, hkey, err := db1.locateKey("mymap", bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		primary, backup := db1, db2
+		if hostCmp(owner, db2.this) {
+			primary, backup = db2, db1
+		}
+		pdm, err := primary.getDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		bdm, err := backup.getBackupDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		pdata, err := pdm.str.Get(hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		bdata, err := bdm.str.Get(hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if pdata.TTL != bdata.TTL {
+			t.Fatalf("Expected the same expiry on the backup. Got: %d, %d", pdata.TTL, bdata.TTL)
+		}
+	}
+
+	// PutEx overrides the default TTL.
+	err = dm.PutEx("mykey", "myvalue", time.Minute)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, ttl, err := dm.GetWithTTL("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if ttl > time.Minute {
+		t.Fatalf("Expected a TTL up to 1 minute. Got: %v", ttl)
+	}
+
+	// The other DMaps have no default TTL.
+	other := db1.NewDMap("other")
+	err = other.Put("mykey", "myvalue")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, ttl, err = other.GetWithTTL("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if ttl != NoTTL {
+		t.Fatalf("Expected NoTTL. Got: %v", ttl)
+	}
+}
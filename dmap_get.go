@@ -15,13 +15,18 @@
 package olric
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/buraksezer/olric/internal/protocol"
 	"github.com/buraksezer/olric/internal/storage"
+	"golang.org/x/sync/errgroup"
 )
 
-func (db *Olric) unmarshalValue(rawval []byte) (interface{}, error) {
+func (db *Olric) unmarshalValue(name string, rawval []byte) (interface{}, error) {
 	var value interface{}
-	err := db.serializer.Unmarshal(rawval, &value)
+	err := db.serializerOf(name).Unmarshal(rawval, &value)
 	if err != nil {
 		return nil, err
 	}
@@ -31,17 +36,52 @@ func (db *Olric) unmarshalValue(rawval []byte) (interface{}, error) {
 	return value, nil
 }
 
-func (db *Olric) getKeyVal(hkey uint64, name, key string) ([]byte, error) {
+// expiryFromExtra returns the absolute expiry timestamp carried by a response.
+func expiryFromExtra(resp *protocol.Message) int64 {
+	if extra, ok := resp.Extra.(protocol.GetExExtra); ok {
+		return extra.TTL
+	}
+	return 0
+}
+
+func (db *Olric) getKeyVal(hkey uint64, name, key string) (*storage.VData, error) {
 	dm, err := db.getDMap(name, hkey)
 	if err != nil {
 		return nil, err
 	}
+	vdata, err := db.findKeyVal(dm, hkey, name, key)
+	if err == nil {
+		atomic.AddUint64(&dm.hits, 1)
+	} else if err == ErrKeyNotFound {
+		atomic.AddUint64(&dm.misses, 1)
+	}
+	return vdata, err
+}
+
+// findKeyVal looks up the key on this node, then on the previous owners and the backups of its partition.
+func (db *Olric) findKeyVal(dm *dmap, hkey uint64, name, key string) (*storage.VData, error) {
 	value, err := dm.str.Get(hkey)
 	if err == nil {
 		if isKeyExpired(value.TTL) {
 			return nil, ErrKeyNotFound
 		}
-		return value.Value, nil
+		if db.config.ReadQuorum > 1 {
+			value, err = db.readQuorum(dm, hkey, name, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if dm.idle != nil {
+			if dm.idle.isIdle(hkey, time.Now().UnixNano()) {
+				// The sweeper will evict it.
+				return nil, ErrKeyNotFound
+			}
+			db.touchIdle(dm, hkey, name, key)
+		}
+		if dm.tracker != nil {
+			dm.tracker.touch(hkey)
+		}
+		return value, nil
 	}
 
 	// Run a query on the previous owners.
@@ -65,7 +105,10 @@ func (db *Olric) getKeyVal(hkey uint64, name, key string) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		return resp.Value, err
+		if db.isDeletedCopy(dm, hkey, resp) {
+			return nil, ErrKeyNotFound
+		}
+		return &storage.VData{Key: key, TTL: expiryFromExtra(resp), Value: resp.Value}, nil
 	}
 
 	// Check backups.
@@ -82,18 +125,164 @@ func (db *Olric) getKeyVal(hkey uint64, name, key string) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		return resp.Value, nil
+		if db.isDeletedCopy(dm, hkey, resp) {
+			return nil, ErrKeyNotFound
+		}
+		return &storage.VData{Key: key, TTL: expiryFromExtra(resp), Value: resp.Value}, nil
 	}
 
 	// It's not there, really.
 	return nil, ErrKeyNotFound
 }
 
+// readQuorum returns ErrReadQuorum if less than ReadQuorum-1 backup owners of the key respond.
+// The primary owner is one of the replicas. It returns the newest one of the replicas and repairs
+// the stale ones in background, if ReadRepair is enabled.
+func (db *Olric) readQuorum(dm *dmap, hkey uint64, name string, vdata *storage.VData) (*storage.VData, error) {
+	quorum := db.config.ReadQuorum - 1
+	backups := db.getBackupPartitionOwners(hkey)
+	if len(backups) < quorum {
+		return nil, ErrReadQuorum
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	// Maps the backup owners which responded to their replicas. A nil replica means
+	// that the backup owner doesn't have the key.
+	replicas := make(map[host]*storage.VData)
+	for _, backup := range backups {
+		wg.Add(1)
+		go func(owner host) {
+			defer wg.Done()
+			req := &protocol.Message{
+				DMap: name,
+				Key:  vdata.Key,
+			}
+			resp, err := db.requestTo(owner.String(), protocol.OpGetBackup, req)
+			if err != nil && err != ErrKeyNotFound {
+				db.log.Printf("[ERROR] Failed to read backup of %s: %s on %s: %v", name, vdata.Key, owner, err)
+				return
+			}
+			var replica *storage.VData
+			if err == nil {
+				replica = &storage.VData{Key: vdata.Key, Value: resp.Value}
+				if extra, ok := resp.Extra.(protocol.GetExExtra); ok {
+					replica.TTL, replica.Timestamp = extra.TTL, extra.Timestamp
+				}
+			}
+			mu.Lock()
+			replicas[owner] = replica
+			mu.Unlock()
+		}(backup)
+	}
+	wg.Wait()
+	if len(replicas) < quorum {
+		return nil, ErrReadQuorum
+	}
+	if !db.config.ReadRepair {
+		return vdata, nil
+	}
+
+	newest := vdata
+	for _, replica := range replicas {
+		if replica != nil && replica.Timestamp > newest.Timestamp {
+			newest = replica
+		}
+	}
+	var stale []host
+	for owner, replica := range replicas {
+		if replica == nil || replica.Timestamp < newest.Timestamp {
+			stale = append(stale, owner)
+		}
+	}
+	if newest != vdata || len(stale) != 0 {
+		// The value of vdata points to the storage, copy it before the background task.
+		repair := *newest
+		repair.Value = append([]byte(nil), newest.Value...)
+		db.wg.Add(1)
+		go db.readRepair(dm, hkey, name, &repair, newest != vdata, stale)
+	}
+	return newest, nil
+}
+
+// readRepair pushes the newest replica of a key to the stale replicas.
+func (db *Olric) readRepair(dm *dmap, hkey uint64, name string, vdata *storage.VData, primary bool, stale []host) {
+	defer db.wg.Done()
+
+	if primary {
+		dm.Lock()
+		current, err := dm.str.Get(hkey)
+		if err == nil && current.Timestamp < vdata.Timestamp {
+			err = db.putEntry(dm, name, hkey, vdata)
+		}
+		dm.Unlock()
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to repair %s: %s on the primary owner: %v", name, vdata.Key, err)
+		} else {
+			atomic.AddUint64(&db.readRepairs, 1)
+		}
+	}
+	for _, owner := range stale {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   vdata.Key,
+			Extra: protocol.PutBackupExtra{TTL: vdata.TTL, Timestamp: vdata.Timestamp},
+			Value: vdata.Value,
+		}
+		_, err := db.requestTo(owner.String(), protocol.OpPutBackup, req)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to repair %s: %s on %s: %v", name, vdata.Key, owner, err)
+			continue
+		}
+		atomic.AddUint64(&db.readRepairs, 1)
+	}
+}
+
+// getReplica serves a read from the backup of the key on a read-only replica, see Config.ReadOnly. The value
+// may be stale since the backups are written after the primary copy. It reports false if this node is not
+// a read-only replica which backs up the key.
+func (db *Olric) getReplica(hkey uint64, name string) (*storage.VData, bool, error) {
+	if !db.config.ReadOnly {
+		return nil, false, nil
+	}
+	var backup bool
+	for _, owner := range db.getBackupPartitionOwners(hkey) {
+		if hostCmp(owner, db.this) {
+			backup = true
+			break
+		}
+	}
+	if !backup {
+		return nil, false, nil
+	}
+	tmp, ok := db.getBackupPartition(hkey).m.Load(name)
+	if !ok {
+		return nil, true, ErrKeyNotFound
+	}
+	vdata, err := tmp.(*dmap).str.Get(hkey)
+	if err == storage.ErrKeyNotFound {
+		return nil, true, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	if isKeyExpired(vdata.TTL) {
+		return nil, true, ErrKeyNotFound
+	}
+	return vdata, true, nil
+}
+
 func (db *Olric) get(name, key string) ([]byte, error) {
 	member, hkey, err := db.locateKey(name, key)
 	if err != nil {
 		return nil, err
 	}
+	if vdata, ok, err := db.getReplica(hkey, name); ok {
+		if err != nil {
+			return nil, err
+		}
+		return vdata.Value, nil
+	}
 	if !hostCmp(member, db.this) {
 		req := &protocol.Message{
 			DMap: name,
@@ -106,9 +295,64 @@ func (db *Olric) get(name, key string) ([]byte, error) {
 		return resp.Value, nil
 	}
 
+	vdata, err := db.getKeyVal(hkey, name, key)
+	if err != nil {
+		return nil, err
+	}
+	return vdata.Value, nil
+}
+
+func (db *Olric) getWithTTL(name, key string) (*storage.VData, error) {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return nil, err
+	}
+	if vdata, ok, err := db.getReplica(hkey, name); ok {
+		return vdata, err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap: name,
+			Key:  key,
+		}
+		resp, err := db.requestTo(member.String(), protocol.OpExGetEx, req)
+		if err != nil {
+			return nil, err
+		}
+		return &storage.VData{Key: key, TTL: expiryFromExtra(resp), Value: resp.Value}, nil
+	}
 	return db.getKeyVal(hkey, name, key)
 }
 
+// remainingTTL converts an absolute expiry timestamp in milliseconds to the remaining lifetime.
+func remainingTTL(ttl int64) time.Duration {
+	if ttl == 0 {
+		return NoTTL
+	}
+	remaining := time.Duration(ttl)*time.Millisecond - time.Duration(time.Now().UnixNano())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// NoTTL is returned by GetWithTTL as the remaining lifetime of keys which don't expire.
+const NoTTL time.Duration = -1
+
+// GetWithTTL gets the value and the remaining lifetime for the given key. It returns NoTTL as ttl if the key
+// doesn't expire and ErrKeyNotFound if the DB does not contain the key. It's thread-safe.
+func (dm *DMap) GetWithTTL(key string) (interface{}, time.Duration, error) {
+	vdata, err := dm.db.getWithTTL(dm.name, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := dm.db.unmarshalValue(dm.name, vdata.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, remainingTTL(vdata.TTL), nil
+}
+
 // Get gets the value for the given key. It returns ErrKeyNotFound if the DB does not contains the key. It's thread-safe.
 // It is safe to modify the contents of the returned value. It is safe to modify the contents of the argument after Get returns.
 func (dm *DMap) Get(key string) (interface{}, error) {
@@ -116,7 +360,91 @@ func (dm *DMap) Get(key string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	return dm.db.unmarshalValue(rawval)
+	return dm.db.unmarshalValue(dm.name, rawval)
+}
+
+func (db *Olric) getMany(name string, keys []string) (map[string][]byte, error) {
+	// Group the keys by their owners. Only one request is sent to a remote node.
+	local := make(map[string]uint64)
+	remote := make(map[string][]string)
+	for _, key := range keys {
+		member, hkey, err := db.locateKey(name, key)
+		if err != nil {
+			return nil, err
+		}
+		if hostCmp(member, db.this) {
+			local[key] = hkey
+			continue
+		}
+		addr := member.String()
+		remote[addr] = append(remote[addr], key)
+	}
+
+	var mu sync.Mutex
+	result := make(map[string][]byte)
+	var g errgroup.Group
+	for addr, keys := range remote {
+		addr, keys := addr, keys
+		g.Go(func() error {
+			req := &protocol.Message{
+				DMap:  name,
+				Value: protocol.EncodeKeys(keys),
+			}
+			resp, err := db.requestTo(addr, protocol.OpExMGet, req)
+			if err != nil {
+				return err
+			}
+			entries, err := protocol.DecodeEntries(resp.Value)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for key, value := range entries {
+				result[key] = value
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		for key, hkey := range local {
+			vdata, err := db.getKeyVal(hkey, name, key)
+			if err == ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			result[key] = vdata.Value
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetMany gets the values for the given keys. It sends only one request to every node which owns
+// some of the keys. Missing keys are omitted from the returned map. It's thread-safe.
+func (dm *DMap) GetMany(keys ...string) (map[string]interface{}, error) {
+	entries, err := dm.db.getMany(dm.name, keys)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, len(entries))
+	for key, rawval := range entries {
+		value, err := dm.db.unmarshalValue(dm.name, rawval)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+	return result, nil
 }
 
 func (db *Olric) exGetOperation(req *protocol.Message) *protocol.Message {
@@ -124,33 +452,68 @@ func (db *Olric) exGetOperation(req *protocol.Message) *protocol.Message {
 	if err == ErrKeyNotFound {
 		return req.Error(protocol.StatusKeyNotFound, "")
 	}
+	if err == ErrReadQuorum {
+		return req.Error(protocol.StatusReadQuorum, err)
+	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	resp := req.Success()
 	resp.Value = value
 	return resp
 }
 
+func (db *Olric) exGetExOperation(req *protocol.Message) *protocol.Message {
+	vdata, err := db.getWithTTL(req.DMap, req.Key)
+	if err == ErrKeyNotFound {
+		return req.Error(protocol.StatusKeyNotFound, "")
+	}
+	if err == ErrReadQuorum {
+		return req.Error(protocol.StatusReadQuorum, err)
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Extra = protocol.GetExExtra{TTL: vdata.TTL, Timestamp: vdata.Timestamp}
+	resp.Value = vdata.Value
+	return resp
+}
+
+func (db *Olric) exMGetOperation(req *protocol.Message) *protocol.Message {
+	keys, err := protocol.DecodeKeys(req.Value)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	entries, err := db.getMany(req.DMap, keys)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = protocol.EncodeEntries(entries)
+	return resp
+}
+
 func (db *Olric) getBackupOperation(req *protocol.Message) *protocol.Message {
 	// TODO: We may need to check backup ownership
 	hkey := db.getHKey(req.DMap, req.Key)
 	dm, err := db.getBackupDMap(req.DMap, hkey)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	vdata, err := dm.str.Get(hkey)
 	if err == storage.ErrKeyNotFound {
 		return req.Error(protocol.StatusKeyNotFound, "")
 	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	if isKeyExpired(vdata.TTL) {
 		return req.Error(protocol.StatusKeyNotFound, "")
 	}
 
 	resp := req.Success()
+	resp.Extra = protocol.GetExExtra{TTL: vdata.TTL, Timestamp: vdata.Timestamp}
 	resp.Value = vdata.Value
 	return resp
 }
@@ -169,13 +532,14 @@ func (db *Olric) getPrevOperation(req *protocol.Message) *protocol.Message {
 		return req.Error(protocol.StatusKeyNotFound, "")
 	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 
 	if isKeyExpired(vdata.TTL) {
 		return req.Error(protocol.StatusKeyNotFound, "")
 	}
 	resp := req.Success()
+	resp.Extra = protocol.GetExExtra{TTL: vdata.TTL, Timestamp: vdata.Timestamp}
 	resp.Value = vdata.Value
 	return resp
 }
@@ -0,0 +1,99 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"fmt"
+	"time"
+)
+
+// getOrSetLockTimeout is the lifetime of the lock which is held while computing a value in GetOrSet.
+// The lock is leased periodically until the computation ends, so a slow compute function doesn't
+// let the other callers run it again.
+const getOrSetLockTimeout = 10 * time.Second
+
+func (dm *DMap) getBytes(key string) ([]byte, error) {
+	value, err := dm.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("mismatched type: %T", value)
+	}
+	return b, nil
+}
+
+// leaseUntilDone extends the lifetime of the lock until done is closed.
+func (dm *DMap) leaseUntilDone(lock *DMapLock, done chan struct{}) {
+	ticker := time.NewTicker(getOrSetLockTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := lock.Lease(getOrSetLockTimeout); err != nil {
+				dm.db.log.Printf("[ERROR] Failed to lease the lock of %s: %v", lock.Key(), err)
+				return
+			}
+		}
+	}
+}
+
+// GetOrSet returns the value of the given key. If the key doesn't exist, it acquires a lock for the key,
+// calls compute and stores the returned value with the given ttl. Concurrent callers wait for the lock
+// and receive the stored value, so compute runs only once even if the key is requested by many callers
+// at the same time. A ttl of zero applies the DefaultTTL of the DMap, like Put, so the key doesn't expire
+// only if the DMap has no DefaultTTL. The value must be a byte slice.
+//
+// If compute returns an error, nothing is stored and the error is returned. One of the waiting callers
+// runs its own compute function then. GetOrSet uses the lock of the key, so it waits for the locks
+// acquired by Lock or LockWithTimeout for the same key.
+func (dm *DMap) GetOrSet(key string, compute func() ([]byte, error), ttl time.Duration) ([]byte, error) {
+	value, err := dm.getBytes(key)
+	if err != ErrKeyNotFound {
+		return value, err
+	}
+
+	lock, err := dm.LockWithTimeout(key, getOrSetLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil && err != ErrNoSuchLock {
+			dm.db.log.Printf("[ERROR] Failed to unlock %s: %v", key, err)
+		}
+	}()
+
+	// Someone else may have set the key while we were waiting for the lock.
+	value, err = dm.getBytes(key)
+	if err != ErrKeyNotFound {
+		return value, err
+	}
+
+	done := make(chan struct{})
+	go dm.leaseUntilDone(lock, done)
+	value, err = compute()
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	err = dm.PutEx(key, value, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
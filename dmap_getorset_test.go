@@ -0,0 +1,191 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDMap_GetOrSet(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	var calls int32
+	compute := func(key string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			atomic.AddInt32(&calls, 1)
+			<-time.After(50 * time.Millisecond)
+			return []byte(key), nil
+		}
+	}
+
+	dms := []*DMap{db1.NewDMap("mymap"), db2.NewDMap("mymap")}
+	var wg sync.WaitGroup
+	errCh := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		key := bkey(i)
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(dm *DMap) {
+				defer wg.Done()
+				value, err := dm.GetOrSet(key, compute(key), 0)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if !bytes.Equal(value, []byte(key)) {
+					errCh <- errors.New("unexpected value: " + string(value))
+				}
+			}(dms[j%2])
+		}
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 10 {
+		t.Fatalf("Expected compute to be called 10 times. Got: %d", calls)
+	}
+	for i := 0; i < 10; i++ {
+		value, err := dms[0].Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), []byte(bkey(i))) {
+			t.Fatalf("Expected %s. Got: %v", bkey(i), value)
+		}
+	}
+}
+
+func TestDMap_GetOrSetError(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	errCompute := errors.New("compute failed")
+	_, err = dm.GetOrSet("mykey", func() ([]byte, error) {
+		return nil, errCompute
+	}, time.Minute)
+	if err != errCompute {
+		t.Fatalf("Expected errCompute. Got: %v", err)
+	}
+	_, err = dm.Get("mykey")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+
+	// The lock must be released after a failed computation.
+	value, err := dm.GetOrSet("mykey", func() ([]byte, error) {
+		return []byte("myvalue"), nil
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if string(value) != "myvalue" {
+		t.Fatalf("Expected myvalue. Got: %s", value)
+	}
+
+	err = dm.Put("string", "value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = dm.GetOrSet("string", func() ([]byte, error) {
+		t.Fatal("compute must not be called for an existing key")
+		return nil, nil
+	}, 0)
+	if err == nil {
+		t.Fatalf("Expected an error for mismatched type")
+	}
+}
+
+func TestDMap_GetOrSetDefaultTTL(t *testing.T) {
+	db, err := newOlricWithDMaps(nil, map[string]DMapConfig{
+		"mymap": {DefaultTTL: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	compute := func() ([]byte, error) {
+		return []byte("myvalue"), nil
+	}
+	_, err = dm.GetOrSet("mykey", compute, 0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, ttl, err := dm.GetWithTTL("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if ttl < 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("Expected the default TTL of 1 hour. Got: %v", ttl)
+	}
+
+	// A ttl given to GetOrSet takes precedence over the default TTL.
+	_, err = dm.GetOrSet("otherkey", compute, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, ttl, err = dm.GetWithTTL("otherkey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if ttl > time.Minute {
+		t.Fatalf("Expected a TTL of 1 minute. Got: %v", ttl)
+	}
+}
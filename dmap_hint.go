@@ -0,0 +1,186 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// hint is a write which could not be applied on a backup owner. Only the key is recorded,
+// the current value of the key is sent to the backup owner when the hint is replayed.
+type hint struct {
+	dmap string
+	hkey uint64
+	key  string
+}
+
+// hintStore keeps the pending hints per backup owner.
+type hintStore struct {
+	mu    sync.Mutex
+	max   int
+	count int
+	hints map[string]map[hint]struct{}
+}
+
+func newHintStore(max int) *hintStore {
+	return &hintStore{
+		max:   max,
+		hints: make(map[string]map[hint]struct{}),
+	}
+}
+
+// add records a hint for the given owner. It returns false if the store is full.
+func (s *hintStore) add(owner string, h hint) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hints, ok := s.hints[owner]
+	if !ok {
+		hints = make(map[hint]struct{})
+		s.hints[owner] = hints
+	}
+	if _, ok := hints[h]; ok {
+		return true
+	}
+	if s.count >= s.max {
+		return false
+	}
+	hints[h] = struct{}{}
+	s.count++
+	return true
+}
+
+// take removes and returns the hints of the given owner.
+func (s *hintStore) take(owner string) []hint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hints := make([]hint, 0, len(s.hints[owner]))
+	for h := range s.hints[owner] {
+		hints = append(hints, h)
+	}
+	s.count -= len(hints)
+	delete(s.hints, owner)
+	return hints
+}
+
+// perPartition returns the number of pending hints on each partition.
+func (s *hintStore) perPartition(partitionCount uint64) map[uint64]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[uint64]int)
+	for _, hints := range s.hints {
+		for h := range hints {
+			counts[h.hkey%partitionCount]++
+		}
+	}
+	return counts
+}
+
+func (s *hintStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// addHint records a write which failed on the given backup owner.
+func (db *Olric) addHint(owner host, name string, hkey uint64, key string) {
+	if !db.hints.add(owner.String(), hint{dmap: name, hkey: hkey, key: key}) {
+		db.log.Printf("[WARN] Hint store is full, dropped the hint of %s: %s for %s", name, key, owner)
+	}
+}
+
+// isBackupOwner reports whether the given member is a backup owner of the hkey.
+func (db *Olric) isBackupOwner(owner string, hkey uint64) bool {
+	for _, backup := range db.getBackupPartitionOwners(hkey) {
+		if backup.String() == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// replayHint sends the current value of the hinted key to the backup owner.
+func (db *Olric) replayHint(owner string, h hint) error {
+	part := db.getPartition(h.hkey)
+	tmp, ok := part.m.Load(h.dmap)
+	if !ok {
+		// The DMap has been destroyed.
+		return db.deleteBackupOn(owner, h)
+	}
+	dm := tmp.(*dmap)
+	dm.Lock()
+	vdata, err := dm.str.Get(h.hkey)
+	if err == nil {
+		// The value points to the storage, copy it before releasing the lock.
+		vdata.Value = append([]byte(nil), vdata.Value...)
+	}
+	dm.Unlock()
+	if err != nil || isKeyExpired(vdata.TTL) {
+		return db.deleteBackupOn(owner, h)
+	}
+	req := &protocol.Message{
+		DMap:  h.dmap,
+		Key:   h.key,
+		Extra: protocol.PutBackupExtra{TTL: vdata.TTL, Timestamp: vdata.Timestamp},
+		Value: vdata.Value,
+	}
+	_, err = db.requestTo(owner, protocol.OpPutBackup, req)
+	return err
+}
+
+func (db *Olric) deleteBackupOn(owner string, h hint) error {
+	req := &protocol.Message{
+		DMap: h.dmap,
+		Key:  h.key,
+	}
+	_, err := db.requestTo(owner, protocol.OpDeleteBackup, req)
+	return err
+}
+
+// replayHints replays the pending hints of a member which joined the cluster. The hints of
+// the partitions which are not owned by this node and the member anymore are dropped, the
+// rebalancing moves them.
+func (db *Olric) replayHints(owner string) {
+	defer db.wg.Done()
+
+	hints := db.hints.take(owner)
+	for i, h := range hints {
+		select {
+		case <-db.ctx.Done():
+			return
+		default:
+		}
+		owners := db.getPartitionOwners(h.hkey)
+		if len(owners) == 0 || !hostCmp(owners[len(owners)-1], db.this) || !db.isBackupOwner(owner, h.hkey) {
+			continue
+		}
+		err := db.replayHint(owner, h)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to replay hints for %s: %v", owner, err)
+			// Keep the remaining hints for the next join event.
+			for _, remaining := range hints[i:] {
+				db.hints.add(owner, remaining)
+			}
+			return
+		}
+	}
+	if len(hints) != 0 {
+		db.log.Printf("[INFO] Replayed %d hints for %s", len(hints), owner)
+	}
+}
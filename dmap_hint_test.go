@@ -0,0 +1,158 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+func TestHintStore(t *testing.T) {
+	s := newHintStore(2)
+	h1 := hint{dmap: "mymap", hkey: 1, key: "key-1"}
+	h2 := hint{dmap: "mymap", hkey: 2, key: "key-2"}
+	if !s.add("node1", h1) {
+		t.Fatalf("Expected true. Got: false")
+	}
+	// The same hint is recorded once.
+	if !s.add("node1", h1) {
+		t.Fatalf("Expected true. Got: false")
+	}
+	if !s.add("node2", h2) {
+		t.Fatalf("Expected true. Got: false")
+	}
+	if s.add("node1", h2) {
+		t.Fatalf("Expected false. Got: true")
+	}
+	if s.len() != 2 {
+		t.Fatalf("Expected 2 hints. Got: %d", s.len())
+	}
+	hints := s.take("node1")
+	if len(hints) != 1 || hints[0] != h1 {
+		t.Fatalf("Expected %v. Got: %v", h1, hints)
+	}
+	if s.len() != 1 {
+		t.Fatalf("Expected 1 hint. Got: %d", s.len())
+	}
+	if len(s.take("node1")) != 0 {
+		t.Fatalf("Expected no hints for node1")
+	}
+}
+
+func TestDMap_ReplayHints(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "mymap"
+	dm := db1.NewDMap(mname)
+	for i := 0; i < 2; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// replicas returns the primary owner and the stored entries of the key on both owners.
+	replicas := func(key string) (*Olric, *storage.Storage, *storage.Storage, uint64) {
+		owner, hkey, err := db1.locateKey(mname, key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		primary, backup := db1, db2
+		if !hostCmp(owner, db1.this) {
+			primary, backup = db2, db1
+		}
+		partID := db1.getPartitionID(hkey)
+		p, ok := primary.partitions[partID].m.Load(mname)
+		if !ok {
+			t.Fatalf("%s could not be found on the primary owner", mname)
+		}
+		b, ok := backup.backups[partID].m.Load(mname)
+		if !ok {
+			t.Fatalf("%s could not be found on the backup owner", mname)
+		}
+		return primary, p.(*dmap).str, b.(*dmap).str, hkey
+	}
+
+	// The backup owner missed the write.
+	db, pstr, bstr, hkey := replicas(bkey(0))
+	vdata, err := pstr.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	expected := append([]byte(nil), vdata.Value...)
+	err = bstr.Delete(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	backupOwner := db.getBackupPartitionOwners(hkey)[0]
+	db.addHint(backupOwner, mname, hkey, bkey(0))
+
+	// The backup owner missed the delete.
+	db, pstr, bstr, hkey = replicas(bkey(1))
+	err = pstr.Delete(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	backupOwner = db.getBackupPartitionOwners(hkey)[0]
+	db.addHint(backupOwner, mname, hkey, bkey(1))
+
+	for _, db := range []*Olric{db1, db2} {
+		for _, owner := range []*Olric{db1, db2} {
+			db.wg.Add(1)
+			db.replayHints(owner.this.String())
+		}
+		if db.Stats().PendingHints != 0 {
+			t.Fatalf("Expected no pending hints. Got: %d", db.Stats().PendingHints)
+		}
+	}
+
+	_, _, bstr, hkey = replicas(bkey(0))
+	vdata, err = bstr.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(vdata.Value, expected) {
+		t.Fatalf("Expected the value on the primary owner. Got: %v", vdata.Value)
+	}
+	_, _, bstr, hkey = replicas(bkey(1))
+	_, err = bstr.Get(hkey)
+	if err != storage.ErrKeyNotFound {
+		t.Fatalf("Expected storage.ErrKeyNotFound. Got: %v", err)
+	}
+}
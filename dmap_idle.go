@@ -0,0 +1,196 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// idleTracker keeps the last access times of the keys in a DMap fragment for MaxIdleDuration.
+// The access times are recorded with a resolution of a tenth of MaxIdleDuration, so the backups
+// are not updated on every access.
+type idleTracker struct {
+	mu         sync.Mutex
+	maxIdle    int64
+	resolution int64
+	accessed   map[uint64]int64
+}
+
+func newIdleTracker(maxIdle time.Duration) *idleTracker {
+	return &idleTracker{
+		maxIdle:    maxIdle.Nanoseconds(),
+		resolution: maxIdle.Nanoseconds() / 10,
+		accessed:   make(map[uint64]int64),
+	}
+}
+
+// touch records an access to the given key. It returns true if the recorded access time has been updated.
+func (i *idleTracker) touch(hkey uint64, now int64) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if last, ok := i.accessed[hkey]; ok && now-last < i.resolution {
+		return false
+	}
+	i.accessed[hkey] = now
+	return true
+}
+
+// remove removes the access time of the given key.
+func (i *idleTracker) remove(hkey uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.accessed, hkey)
+}
+
+// lastAccess returns the recorded access time of the given key.
+func (i *idleTracker) lastAccess(hkey uint64) (int64, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	last, ok := i.accessed[hkey]
+	return last, ok
+}
+
+// isIdle returns true if the given key hasn't been accessed within MaxIdleDuration. The idle time of
+// a key without an access time, a key moved from another node for example, starts now.
+func (i *idleTracker) isIdle(hkey uint64, now int64) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	last, ok := i.accessed[hkey]
+	if !ok {
+		i.accessed[hkey] = now
+		return false
+	}
+	// The real access time may be later than the recorded one by the resolution at most.
+	return now-last >= i.maxIdle+i.resolution
+}
+
+// accessKeyValBackup updates the access time of the given key on the backups.
+func (db *Olric) accessKeyValBackup(hkey uint64, name, key string) error {
+	memCount := db.discovery.numMembers()
+	backupCount := calcMaxBackupCount(db.config.BackupCount, memCount)
+	backupOwners := db.getBackupPartitionOwners(hkey)
+	if len(backupOwners) > backupCount {
+		backupOwners = backupOwners[len(backupOwners)-backupCount:]
+	}
+
+	var g errgroup.Group
+	for _, backup := range backupOwners {
+		mem := backup
+		g.Go(func() error {
+			msg := &protocol.Message{
+				DMap: name,
+				Key:  key,
+			}
+			_, err := db.requestTo(mem.String(), protocol.OpAccessBackup, msg)
+			if err != nil {
+				db.log.Printf("[ERROR] Failed to update access time of backup on %s: %s", mem, err)
+			}
+			return err
+		})
+	}
+	return g.Wait()
+}
+
+// touchIdle records an access to the given key on the owner. The backups are updated in background.
+func (db *Olric) touchIdle(dm *dmap, hkey uint64, name, key string) {
+	if !dm.idle.touch(hkey, time.Now().UnixNano()) || db.config.BackupCount == 0 {
+		return
+	}
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		err := db.accessKeyValBackup(hkey, name, key)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to update access time of backup: %v", err)
+		}
+	}()
+}
+
+func (db *Olric) accessBackupOperation(req *protocol.Message) *protocol.Message {
+	hkey := db.getHKey(req.DMap, req.Key)
+	dm, err := db.getBackupDMap(req.DMap, hkey)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	if dm.idle != nil {
+		dm.idle.touch(hkey, time.Now().UnixNano())
+	}
+	return req.Success()
+}
+
+func (db *Olric) evictIdleKeysAtBackground() {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.config.ExpirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-ticker.C:
+			db.evictIdleKeys()
+		}
+	}
+}
+
+func (db *Olric) evictIdleKeys() {
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		part.m.Range(func(name, tmp interface{}) bool {
+			dm := tmp.(*dmap)
+			if dm.idle != nil {
+				db.evictIdleKeysOnDMap(partID, name.(string), dm)
+			}
+			select {
+			case <-db.ctx.Done():
+				return false
+			default:
+			}
+			return true
+		})
+	}
+}
+
+func (db *Olric) evictIdleKeysOnDMap(partID uint64, name string, dm *dmap) {
+	dm.Lock()
+	defer dm.Unlock()
+
+	now := time.Now().UnixNano()
+	idle := make(map[uint64]string)
+	dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+		if dm.idle.isIdle(hkey, now) {
+			idle[hkey] = vdata.Key
+		}
+		return true
+	})
+	for hkey, key := range idle {
+		err := db.delKeyVal(dm, hkey, name, key, nil)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to evict idle hkey: %d on DMap: %s: %v", hkey, name, err)
+			continue
+		}
+		atomic.AddUint64(&db.evictions, 1)
+		atomic.AddUint64(&dm.evictions, 1)
+	}
+	if len(idle) != 0 {
+		db.log.Printf("[DEBUG] Evicted idle key count is %d on PartID: %d", len(idle), partID)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdleTracker(t *testing.T) {
+	i := newIdleTracker(time.Second)
+	now := time.Now().UnixNano()
+	if i.isIdle(1, now) {
+		t.Fatalf("Expected a key without an access time to be active")
+	}
+	// The access times are recorded with a resolution of 100ms.
+	if i.touch(1, now+int64(50*time.Millisecond)) {
+		t.Fatalf("Expected the access time to be unchanged")
+	}
+	if !i.touch(1, now+int64(100*time.Millisecond)) {
+		t.Fatalf("Expected the access time to be updated")
+	}
+	if i.isIdle(1, now+int64(time.Second)) {
+		t.Fatalf("Expected the key to be active")
+	}
+	if !i.isIdle(1, now+int64(1200*time.Millisecond)) {
+		t.Fatalf("Expected the key to be idle")
+	}
+	i.remove(1)
+	if i.isIdle(1, now+int64(time.Hour)) {
+		t.Fatalf("Expected a removed key to be active")
+	}
+}
+
+func TestDMap_MaxIdleDuration(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {MaxIdleDuration: 500 * time.Millisecond},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for _, key := range []string{"idle", "active"} {
+		err = dm.Put(key, key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	start := time.Now().UnixNano()
+	for i := 0; i < 20; i++ {
+		<-time.After(50 * time.Millisecond)
+		_, err = dm.Get("active")
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for the active key", err)
+		}
+	}
+	_, err = dm.Get("idle")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+
+	// The access time of the active key must be refreshed on the backup.
+	var refreshed bool
+	for _, db := range []*Olric{db1, db2} {
+		hkey := db.getHKey("mymap", "active")
+		tmp, ok := db.getBackupPartition(hkey).m.Load("mymap")
+		if !ok {
+			continue
+		}
+		bdm := tmp.(*dmap)
+		bdm.idle.mu.Lock()
+		if bdm.idle.accessed[hkey] > start {
+			refreshed = true
+		}
+		bdm.idle.mu.Unlock()
+	}
+	if !refreshed {
+		t.Fatalf("Expected the access time to be refreshed on the backup")
+	}
+
+	// The sweeper evicts the idle key.
+	db1.evictIdleKeys()
+	db2.evictIdleKeys()
+	for key, expected := range map[string]bool{"idle": false, "active": true} {
+		var found bool
+		for _, db := range []*Olric{db1, db2} {
+			hkey := db.getHKey("mymap", key)
+			tmp, ok := db.getPartition(hkey).m.Load("mymap")
+			if ok && tmp.(*dmap).str.Check(hkey) {
+				found = true
+			}
+		}
+		if found != expected {
+			t.Fatalf("Expected %s in storage: %v. Got: %v", key, expected, found)
+		}
+	}
+	if db1.Stats().Evictions+db2.Stats().Evictions != 1 {
+		t.Fatalf("Expected 1 eviction. Got: %d", db1.Stats().Evictions+db2.Stats().Evictions)
+	}
+}
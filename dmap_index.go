@@ -0,0 +1,247 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrUnknownIndex means that the DMap has no index on the given field, see DMapConfig.Indexes.
+var ErrUnknownIndex = errors.New("unknown index")
+
+// IndexFunc extracts the indexed field from a value of a DMap. The value is decoded by the serializer of
+// the DMap. It returns false if the value doesn't have the field, then the key is not indexed.
+type IndexFunc func(value interface{}) (string, bool)
+
+// fieldIndex maps the values of a field to the keys in a dmap.
+type fieldIndex struct {
+	extract IndexFunc
+	// keys maps the indexed values to the keys with their hkeys.
+	keys map[string]map[string]uint64
+	// values maps the keys to their indexed values.
+	values map[string]string
+}
+
+func (f *fieldIndex) add(key string, hkey uint64, value interface{}) {
+	f.remove(key)
+	field, ok := f.extract(value)
+	if !ok {
+		return
+	}
+	keys, ok := f.keys[field]
+	if !ok {
+		keys = make(map[string]uint64)
+		f.keys[field] = keys
+	}
+	keys[key] = hkey
+	f.values[key] = field
+}
+
+func (f *fieldIndex) remove(key string) {
+	field, ok := f.values[key]
+	if !ok {
+		return
+	}
+	delete(f.values, key)
+	delete(f.keys[field], key)
+	if len(f.keys[field]) == 0 {
+		delete(f.keys, field)
+	}
+}
+
+// dmapIndex is the secondary index of a dmap on the primary partitions, keyed by field. It's guarded
+// by the dmap lock.
+type dmapIndex map[string]*fieldIndex
+
+func newDMapIndex(indexes map[string]IndexFunc) dmapIndex {
+	idx := make(dmapIndex, len(indexes))
+	for field, extract := range indexes {
+		idx[field] = &fieldIndex{
+			extract: extract,
+			keys:    make(map[string]map[string]uint64),
+			values:  make(map[string]string),
+		}
+	}
+	return idx
+}
+
+// indexValue indexes the given entry. The caller must hold the dmap lock.
+func (db *Olric) indexValue(dm *dmap, name string, hkey uint64, vdata *storage.VData) {
+	if dm.index == nil {
+		return
+	}
+	value, err := db.unmarshalValue(name, vdata.Value)
+	if err != nil {
+		db.log.Printf("[ERROR] Failed to index key: %s on DMap: %s: %v", vdata.Key, name, err)
+		return
+	}
+	for _, f := range dm.index {
+		f.add(vdata.Key, hkey, value)
+	}
+}
+
+// indexStored indexes the stored value of hkey, it's used by the paths which write the encrypted values.
+// The caller must hold the dmap lock.
+func (db *Olric) indexStored(dm *dmap, name string, hkey uint64) {
+	if dm.index == nil {
+		return
+	}
+	vdata, err := dm.str.Get(hkey)
+	if err != nil {
+		return
+	}
+	db.indexValue(dm, name, hkey, vdata)
+}
+
+// unindex removes the key from the index. The caller must hold the dmap lock.
+func (dm *dmap) unindex(key string) {
+	for _, f := range dm.index {
+		f.remove(key)
+	}
+}
+
+// buildIndex indexes all the keys of a restored or a moved dmap. The caller must hold the dmap lock,
+// if the dmap is shared.
+func (db *Olric) buildIndex(dm *dmap, name string) {
+	if dm.index == nil {
+		return
+	}
+	dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+		db.indexValue(dm, name, hkey, vdata)
+		return true
+	})
+}
+
+// localGetByIndex returns the keys with the given field value on the partitions owned by this node.
+// The expired keys and the ones which are no longer in the storage are skipped.
+func (db *Olric) localGetByIndex(name, field, value string) []string {
+	var keys []string
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		part.RLock()
+		owned := len(part.owners) != 0 && hostCmp(part.owners[len(part.owners)-1], db.this)
+		part.RUnlock()
+		if !owned {
+			continue
+		}
+		tmp, ok := part.m.Load(name)
+		if !ok {
+			continue
+		}
+		dm := tmp.(*dmap)
+		dm.Lock()
+		if f, ok := dm.index[field]; ok {
+			for key, hkey := range f.keys[value] {
+				vdata, err := dm.str.Get(hkey)
+				if err != nil || vdata.Key != key || isKeyExpired(vdata.TTL) {
+					continue
+				}
+				keys = append(keys, key)
+			}
+		}
+		dm.Unlock()
+	}
+	return keys
+}
+
+func (db *Olric) getByIndex(name, field, value string) ([]string, error) {
+	<-db.bcx.Done()
+	if db.bcx.Err() == context.DeadlineExceeded {
+		return nil, ErrOperationTimeout
+	}
+	if _, ok := db.dmapConfig(name).Indexes[field]; !ok {
+		return nil, ErrUnknownIndex
+	}
+
+	var mu sync.Mutex
+	var result []string
+	var g errgroup.Group
+	for _, item := range db.discovery.getMembers() {
+		member := item
+		g.Go(func() error {
+			var keys []string
+			if hostCmp(member, db.this) {
+				keys = db.localGetByIndex(name, field, value)
+			} else {
+				req := &protocol.Message{
+					DMap:  name,
+					Key:   field,
+					Value: []byte(value),
+				}
+				resp, err := db.requestTo(member.String(), protocol.OpGetByIndex, req)
+				if err != nil {
+					return err
+				}
+				keys, err = protocol.DecodeKeys(resp.Value)
+				if err != nil {
+					return err
+				}
+			}
+			mu.Lock()
+			result = append(result, keys...)
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	// The nodes may own the same partition for a moment while the routing table is being updated.
+	sort.Strings(result)
+	keys := result[:0]
+	for i, key := range result {
+		if i == 0 || key != result[i-1] {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// GetByIndex returns the keys whose values have the given value of the indexed field in sorted order,
+// see DMapConfig.Indexes. It returns ErrUnknownIndex if the DMap has no index on the field.
+//
+// The index is kept by the primary owners of the partitions and it's updated with the values under the
+// same lock, so a key is returned by GetByIndex as soon as Put returns. But the partitions are queried
+// one by one, the result is not a snapshot of the DMap. The keys which are written concurrently may be
+// missing or stale, and the values of the returned keys may have changed when they are read. The
+// keys of the partitions which are moving between the nodes may be missing until the moves complete.
+// It's thread-safe.
+func (dm *DMap) GetByIndex(field, value string) ([]string, error) {
+	return dm.db.getByIndex(dm.name, field, value)
+}
+
+func (db *Olric) exGetByIndexOperation(req *protocol.Message) *protocol.Message {
+	keys, err := db.getByIndex(req.DMap, req.Key, string(req.Value))
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = protocol.EncodeKeys(keys)
+	return resp
+}
+
+func (db *Olric) getByIndexOperation(req *protocol.Message) *protocol.Message {
+	keys := db.localGetByIndex(req.DMap, req.Key, string(req.Value))
+	resp := req.Success()
+	resp.Value = protocol.EncodeKeys(keys)
+	return resp
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// colorIndex indexes the values like "red:1" by their colors.
+func colorIndex(value interface{}) (string, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return "", false
+	}
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", false
+	}
+	return s[:i], true
+}
+
+func TestDMap_GetByIndex(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {Indexes: map[string]IndexFunc{"color": colorIndex}},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 20; i++ {
+		color := "red"
+		if i%2 == 1 {
+			color = "blue"
+		}
+		err = dm.Put(bkey(i), color+":"+bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	// Not indexed.
+	err = dm.Put("plain", "plain")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The index is rebuilt on the new owners when the partitions move.
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	var expected []string
+	for i := 0; i < 20; i += 2 {
+		expected = append(expected, bkey(i))
+	}
+	for _, db := range []*Olric{db1, db2} {
+		keys, err := db.NewDMap("mymap").GetByIndex("color", "red")
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("Expected %v. Got: %v", expected, keys)
+		}
+	}
+
+	// The index follows the writes and the deletes.
+	err = dm.Put(bkey(0), "blue:"+bkey(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = dm.Delete(bkey(2))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	keys, err := dm.GetByIndex("color", "red")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !reflect.DeepEqual(keys, expected[2:]) {
+		t.Fatalf("Expected %v. Got: %v", expected[2:], keys)
+	}
+	keys, err = dm.GetByIndex("color", "blue")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(keys) != 11 {
+		t.Fatalf("Expected 11 keys. Got: %d", len(keys))
+	}
+	keys, err = dm.GetByIndex("color", "green")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("Expected no keys. Got: %v", keys)
+	}
+
+	_, err = dm.GetByIndex("size", "big")
+	if err != ErrUnknownIndex {
+		t.Fatalf("Expected ErrUnknownIndex. Got: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"golang.org/x/sync/errgroup"
+)
+
+// localLen returns the number of keys of the given dmap on the partitions owned by this node.
+// Backups and the partitions which have been moved to another node are not counted.
+func (db *Olric) localLen(name string) uint64 {
+	var total uint64
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		part.RLock()
+		owned := len(part.owners) != 0 && hostCmp(part.owners[len(part.owners)-1], db.this)
+		part.RUnlock()
+		if !owned {
+			continue
+		}
+		tmp, ok := part.m.Load(name)
+		if !ok {
+			continue
+		}
+		dm := tmp.(*dmap)
+		dm.Lock()
+		total += uint64(dm.str.Len())
+		dm.Unlock()
+	}
+	return total
+}
+
+func (db *Olric) length(name string) (uint64, error) {
+	<-db.bcx.Done()
+	if db.bcx.Err() == context.DeadlineExceeded {
+		return 0, ErrOperationTimeout
+	}
+
+	var total uint64
+	var g errgroup.Group
+	for _, item := range db.discovery.getMembers() {
+		member := item
+		if hostCmp(member, db.this) {
+			atomic.AddUint64(&total, db.localLen(name))
+			continue
+		}
+		g.Go(func() error {
+			req := &protocol.Message{
+				DMap: name,
+			}
+			resp, err := db.requestTo(member.String(), protocol.OpLen, req)
+			if err != nil {
+				return err
+			}
+			if extra, ok := resp.Extra.(protocol.LenExtra); ok {
+				atomic.AddUint64(&total, extra.Count)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// Len returns the number of keys in the DMap. Only the primary copies are counted. The result is
+// approximate under concurrent mutation or while partitions are moving between nodes, and it may
+// include expired keys which haven't been evicted yet. It's thread-safe.
+func (dm *DMap) Len() (int, error) {
+	total, err := dm.db.length(dm.name)
+	return int(total), err
+}
+
+func (db *Olric) exLenOperation(req *protocol.Message) *protocol.Message {
+	total, err := db.length(req.DMap)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Extra = protocol.LenExtra{Count: total}
+	return resp
+}
+
+func (db *Olric) lenOperation(req *protocol.Message) *protocol.Message {
+	resp := req.Success()
+	resp.Extra = protocol.LenExtra{Count: db.localLen(req.DMap)}
+	return resp
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// loadBatchSize is the number of records written together by Load.
+const loadBatchSize = 1000
+
+// Load reads a stream of records from r and writes them to the DMap in batches. It returns the number
+// of the loaded records. Every batch is routed to the owners of its keys like PutMany.
+//
+// The stream is in the format written by Dump: a header with the magic and the version of the format,
+// followed by the records. A record is [uint16 key length][key][uint32 value length][value][int64 ttl],
+// big-endian. The value is stored as it is, it must be encoded with the serializer of the DMap. ttl is
+// the expiry time in unix milliseconds and zero means no expiry. The expired records are skipped.
+//
+// If some of the records could not be written, Load reads the rest of the stream and returns a
+// *PutManyError which lists the failed keys. It stops at the first malformed record.
+func (dm *DMap) Load(r io.Reader) (int, error) {
+	if err := protocol.ReadDumpHeader(r); err != nil {
+		return 0, err
+	}
+	maxValueSize := protocol.MaxValueSizeFor(dm.name)
+	failed := make(map[string]error)
+	var loaded int
+	batch := make([]protocol.Record, 0, loadBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := dm.db.putRecords(dm.name, batch)
+		if perr, ok := err.(*PutManyError); ok {
+			for key, e := range perr.Errors {
+				failed[key] = e
+			}
+			loaded -= len(perr.Errors)
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		loaded += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for n := 0; ; n++ {
+		rec, err := protocol.ReadRecord(r, maxValueSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if ferr := flush(); ferr != nil {
+				return loaded, ferr
+			}
+			return loaded, fmt.Errorf("failed to read record %d: %v", n, err)
+		}
+		if isKeyExpired(rec.TTL) {
+			continue
+		}
+		batch = append(batch, rec)
+		if len(batch) == loadBatchSize {
+			if err = flush(); err != nil {
+				return loaded, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return loaded, err
+	}
+	if len(failed) != 0 {
+		return loaded, &PutManyError{Errors: failed}
+	}
+	return loaded, nil
+}
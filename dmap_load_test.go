@@ -0,0 +1,149 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestDMap_Load(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	buf := new(bytes.Buffer)
+	err = protocol.WriteDumpHeader(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	ttl := (time.Now().UnixNano() + int64(time.Hour)) / int64(time.Millisecond)
+	for i := 0; i < 2500; i++ {
+		value, err := db1.serializer.Marshal(bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		rec := protocol.Record{Key: bkey(i), Value: value}
+		if i%2 == 0 {
+			rec.TTL = ttl
+		}
+		if err = protocol.WriteRecord(buf, rec); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	// The expired records are skipped.
+	err = protocol.WriteRecord(buf, protocol.Record{Key: "expired", Value: []byte("value"), TTL: 1})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := db1.NewDMap("mymap")
+	n, err := dm.Load(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if n != 2500 {
+		t.Fatalf("Expected 2500 records to be loaded. Got: %d", n)
+	}
+	dm2 := db2.NewDMap("mymap")
+	for i := 0; i < 2500; i++ {
+		value, ttl, err := dm2.GetWithTTL(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for %s", err, bkey(i))
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Expected %s. Got: %v", bval(i), value)
+		}
+		if i%2 == 0 && (ttl <= 0 || ttl > time.Hour) {
+			t.Fatalf("Expected a TTL for %s. Got: %v", bkey(i), ttl)
+		}
+		if i%2 == 1 && ttl != NoTTL {
+			t.Fatalf("Expected NoTTL for %s. Got: %v", bkey(i), ttl)
+		}
+	}
+	_, err = dm2.Get("expired")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
+
+func TestDMap_LoadMalformed(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	buf := new(bytes.Buffer)
+	err = protocol.WriteDumpHeader(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	value, err := db.serializer.Marshal("value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = protocol.WriteRecord(buf, protocol.Record{Key: "mykey", Value: value})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// A truncated record.
+	buf.Write([]byte{0, 5, 'k'})
+
+	dm := db.NewDMap("mymap")
+	n, err := dm.Load(buf)
+	if err == nil {
+		t.Fatalf("Expected an error for the truncated record")
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 record to be loaded. Got: %d", n)
+	}
+	got, err := dm.Get("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if got.(string) != "value" {
+		t.Fatalf("Expected value. Got: %v", got)
+	}
+}
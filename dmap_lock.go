@@ -16,11 +16,53 @@ package olric
 
 import (
 	"context"
+	"crypto/rand"
 	"time"
 
 	"github.com/buraksezer/olric/internal/protocol"
 )
 
+// LockToken is an opaque value which identifies a lock acquisition. It's returned when the lock
+// is acquired and required to lease the lock.
+type LockToken []byte
+
+// DMapLock is a handle of an acquired lock. It carries the key and the token of the lock,
+// so the lock can be released with a simple call like defer lock.Unlock().
+type DMapLock struct {
+	dm    *DMap
+	key   string
+	token LockToken
+}
+
+// Key returns the locked key.
+func (l *DMapLock) Key() string {
+	return l.key
+}
+
+// Token returns the token of this acquisition.
+func (l *DMapLock) Token() LockToken {
+	return l.token
+}
+
+// Unlock releases the lock. It returns ErrNoSuchLock if the lock has already expired.
+func (l *DMapLock) Unlock() error {
+	return l.dm.Unlock(l.key, l.token)
+}
+
+// Lease extends the lifetime of the lock to d from now. It returns ErrNoSuchLock if the lock has already expired.
+func (l *DMapLock) Lease(d time.Duration) error {
+	return l.dm.Lease(l.key, l.token, d)
+}
+
+func newLockToken() (LockToken, error) {
+	token := make(LockToken, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
 func (db *Olric) findLockKey(hkey uint64, name, key string) (host, error) {
 	part := db.getPartition(hkey)
 	part.RLock()
@@ -60,17 +102,29 @@ func (db *Olric) findLockKey(hkey uint64, name, key string) (host, error) {
 }
 
 // Wait until the timeout is exceeded and background and release the key if it's still locked.
-func (db *Olric) waitLockForTimeout(dm *dmap, key string, timeout time.Duration) {
+func (db *Olric) waitLockForTimeout(dm *dmap, key string, token LockToken, timeout time.Duration) {
 	defer db.wg.Done()
 	unlockCh := dm.locker.unlockNotifier(key)
-	select {
-	case <-time.After(timeout):
-	case <-db.ctx.Done():
-	case <-unlockCh:
-		// It's already unlocked
-		return
-	}
-	err := dm.locker.unlock(key)
+	for {
+		select {
+		case <-time.After(timeout):
+		case <-db.ctx.Done():
+		case <-unlockCh:
+			// It's already unlocked
+			return
+		}
+		remaining, ok := dm.locker.remaining(key, token)
+		if !ok {
+			// It's already unlocked or acquired by someone else.
+			return
+		}
+		if remaining <= 0 || db.ctx.Err() != nil {
+			break
+		}
+		// The lock has been leased, wait until the new deadline.
+		timeout = remaining
+	}
+	err := dm.locker.unlock(key, token)
 	if err == ErrNoSuchLock {
 		err = nil
 	}
@@ -79,22 +133,33 @@ func (db *Olric) waitLockForTimeout(dm *dmap, key string, timeout time.Duration)
 	}
 }
 
-func (db *Olric) lockKey(hkey uint64, name, key string, timeout time.Duration) error {
+// grantLock registers the token of an acquired lock. It waits until the timeout is exceeded and
+// background and releases the key if it's still locked.
+func (db *Olric) grantLock(dm *dmap, key string, token LockToken, timeout time.Duration) {
+	dm.locker.setToken(key, token, timeout)
+	db.wg.Add(1)
+	go db.waitLockForTimeout(dm, key, token, timeout)
+}
+
+func (db *Olric) lockKey(hkey uint64, name, key string, timeout time.Duration) (LockToken, error) {
 	dm, err := db.getDMap(name, hkey)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	token, err := newLockToken()
+	if err != nil {
+		return nil, err
 	}
 	if dm.locker.check(key) {
 		dm.locker.lock(key)
-		db.wg.Add(1)
-		go db.waitLockForTimeout(dm, key, timeout)
-		return nil
+		db.grantLock(dm, key, token, timeout)
+		return token, nil
 	}
 
 	// Find the key or lock among previous owners, if any.
 	owner, err := db.findLockKey(hkey, name, key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// One of the previous owners has the key, redirect the call.
@@ -104,23 +169,23 @@ func (db *Olric) lockKey(hkey uint64, name, key string, timeout time.Duration) e
 			Key:   key,
 			Extra: protocol.LockWithTimeoutExtra{TTL: timeout.Nanoseconds()},
 		}
-		_, err := db.requestTo(owner.String(), protocol.OpLockPrev, req)
-		return err
+		resp, err := db.requestTo(owner.String(), protocol.OpLockPrev, req)
+		if err != nil {
+			return nil, err
+		}
+		return LockToken(resp.Value), nil
 	}
 
 	// This node owns the key/lock. Try to acquire it.
 	dm.locker.lock(key)
-	// Wait until the timeout is exceeded and background and release the key if
-	// it's still locked.
-	db.wg.Add(1)
-	go db.waitLockForTimeout(dm, key, timeout)
-	return nil
+	db.grantLock(dm, key, token, timeout)
+	return token, nil
 }
 
-func (db *Olric) lockWithTimeout(name, key string, timeout time.Duration) error {
+func (db *Olric) lockWithTimeout(name, key string, timeout time.Duration) (LockToken, error) {
 	member, hkey, err := db.locateKey(name, key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !hostCmp(member, db.this) {
 		req := &protocol.Message{
@@ -128,8 +193,11 @@ func (db *Olric) lockWithTimeout(name, key string, timeout time.Duration) error
 			Key:   key,
 			Extra: protocol.LockWithTimeoutExtra{TTL: timeout.Nanoseconds()},
 		}
-		_, err = db.requestTo(member.String(), protocol.OpExLockWithTimeout, req)
-		return err
+		resp, err := db.requestTo(member.String(), protocol.OpExLockWithTimeout, req)
+		if err != nil {
+			return nil, err
+		}
+		return LockToken(resp.Value), nil
 	}
 	return db.lockKey(hkey, name, key, timeout)
 }
@@ -140,20 +208,147 @@ func (db *Olric) lockWithTimeout(name, key string, timeout time.Duration) error
 // It returns immediately if it acquires the lock for the given key. Otherwise, it waits until timeout.
 // The timeout is determined by http.Client which can be configured via Config structure.
 //
+// It returns a DMapLock handle to release or lease the acquired lock.
+//
 // You should know that the locks are approximate, and only to be used for non-critical purposes.
-func (dm *DMap) LockWithTimeout(key string, timeout time.Duration) error {
-	return dm.db.lockWithTimeout(dm.name, key, timeout)
+func (dm *DMap) LockWithTimeout(key string, timeout time.Duration) (*DMapLock, error) {
+	token, err := dm.db.lockWithTimeout(dm.name, key, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &DMapLock{dm: dm, key: key, token: token}, nil
 }
 
-func (db *Olric) unlockKey(hkey uint64, name, key string) error {
+func (db *Olric) tryLockKey(hkey uint64, name, key string, timeout time.Duration) (LockToken, bool, error) {
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return nil, false, err
+	}
+	if dm.locker.check(key) {
+		return nil, false, nil
+	}
+
+	// Find the lock among previous owners, if any. If one of them has it, the lock is held.
+	owner, err := db.findLockKey(hkey, name, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !hostCmp(db.this, owner) {
+		return nil, false, nil
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		return nil, false, err
+	}
+	if !dm.locker.tryLock(key) {
+		return nil, false, nil
+	}
+	db.grantLock(dm, key, token, timeout)
+	return token, true, nil
+}
+
+func (db *Olric) tryLock(name, key string, timeout time.Duration) (LockToken, bool, error) {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Extra: protocol.LockWithTimeoutExtra{TTL: timeout.Nanoseconds()},
+		}
+		resp, err := db.requestTo(member.String(), protocol.OpTryLock, req)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(resp.Value) == 0 {
+			return nil, false, nil
+		}
+		return LockToken(resp.Value), true, nil
+	}
+	return db.tryLockKey(hkey, name, key, timeout)
+}
+
+// TryLock tries to set a lock for the given key only once. It doesn't wait for the lock and returns false
+// immediately if the lock is held by someone else. If the lock is acquired, it's released automatically
+// after the given ttl, like LockWithTimeout. The returned DMapLock is nil if the lock is not acquired.
+func (dm *DMap) TryLock(key string, ttl time.Duration) (*DMapLock, bool, error) {
+	token, locked, err := dm.db.tryLock(dm.name, key, ttl)
+	if err != nil || !locked {
+		return nil, false, err
+	}
+	return &DMapLock{dm: dm, key: key, token: token}, true, nil
+}
+
+func (db *Olric) leaseKey(hkey uint64, name, key string, token LockToken, ttl time.Duration) error {
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return err
+	}
+	if dm.locker.check(key) {
+		return dm.locker.lease(key, token, ttl)
+	}
+
+	// Find the lock among previous owners, if any.
+	owner, err := db.findLockKey(hkey, name, key)
+	if err != nil {
+		return err
+	}
+	if hostCmp(db.this, owner) {
+		return ErrNoSuchLock
+	}
+	req := &protocol.Message{
+		DMap:  name,
+		Key:   key,
+		Value: token,
+		Extra: protocol.LockWithTimeoutExtra{TTL: ttl.Nanoseconds()},
+	}
+	_, err = db.requestTo(owner.String(), protocol.OpLeasePrev, req)
+	return err
+}
+
+func (db *Olric) lease(name, key string, token LockToken, ttl time.Duration) error {
+	<-db.bcx.Done()
+	if db.bcx.Err() == context.DeadlineExceeded {
+		return ErrOperationTimeout
+	}
+
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Value: token,
+			Extra: protocol.LockWithTimeoutExtra{TTL: ttl.Nanoseconds()},
+		}
+		_, err = db.requestTo(member.String(), protocol.OpLockLease, req)
+		return err
+	}
+	return db.leaseKey(hkey, name, key, token, ttl)
+}
+
+// Lease extends the lifetime of a held lock to newTTL from now, only if the given token is the one
+// returned when the lock was acquired. It returns ErrNoSuchLock if the lock has already expired or
+// it's held by someone else.
+func (dm *DMap) Lease(key string, token LockToken, newTTL time.Duration) error {
+	return dm.db.lease(dm.name, key, token, newTTL)
+}
+
+func (db *Olric) unlockKey(hkey uint64, name, key string, token LockToken) error {
 	owner, err := db.findLockKey(hkey, name, key)
 	if err != nil {
 		return err
 	}
 	if !hostCmp(db.this, owner) {
 		req := &protocol.Message{
-			DMap: name,
-			Key:  key,
+			DMap:  name,
+			Key:   key,
+			Value: token,
 		}
 		_, err = db.requestTo(owner.String(), protocol.OpUnlockPrev, req)
 		return err
@@ -162,14 +357,18 @@ func (db *Olric) unlockKey(hkey uint64, name, key string) error {
 	if err != nil {
 		return err
 	}
-	return dm.locker.unlock(key)
+	return dm.locker.unlock(key, token)
 }
 
-func (db *Olric) unlock(name, key string) error {
+func (db *Olric) unlock(name, key string, token LockToken) error {
 	<-db.bcx.Done()
 	if db.bcx.Err() == context.DeadlineExceeded {
 		return ErrOperationTimeout
 	}
+	if len(token) == 0 {
+		// A lock without a token has not been granted yet.
+		return ErrNoSuchLock
+	}
 
 	member, hkey, err := db.locateKey(name, key)
 	if err != nil {
@@ -177,36 +376,73 @@ func (db *Olric) unlock(name, key string) error {
 	}
 	if !hostCmp(member, db.this) {
 		req := &protocol.Message{
-			DMap: name,
-			Key:  key,
+			DMap:  name,
+			Key:   key,
+			Value: token,
 		}
 		_, err = db.requestTo(member.String(), protocol.OpExUnlock, req)
 		return err
 	}
-	return db.unlockKey(hkey, name, key)
+	return db.unlockKey(hkey, name, key, token)
 }
 
-// Unlock releases an acquired lock for the given key. It returns ErrNoSuchLock if there is no lock for the given key.
-func (dm *DMap) Unlock(key string) error {
-	return dm.db.unlock(dm.name, key)
+// Unlock releases an acquired lock for the given key. The token must be the one returned when the lock
+// was acquired. It returns ErrNoSuchLock if there is no lock for the given key or it's held by someone else.
+func (dm *DMap) Unlock(key string, token LockToken) error {
+	return dm.db.unlock(dm.name, key, token)
 }
 
 func (db *Olric) exLockWithTimeoutOperation(req *protocol.Message) *protocol.Message {
-	ttl := req.Extra.(protocol.LockWithTimeoutExtra).TTL
-	err := db.lockWithTimeout(req.DMap, req.Key, time.Duration(ttl))
+	extra, ok := req.Extra.(protocol.LockWithTimeoutExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	token, err := db.lockWithTimeout(req.DMap, req.Key, time.Duration(extra.TTL))
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = token
+	return resp
+}
+
+func (db *Olric) tryLockOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.LockWithTimeoutExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	token, _, err := db.tryLock(req.DMap, req.Key, time.Duration(extra.TTL))
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	// An empty value means that the lock is held by someone else.
+	resp := req.Success()
+	resp.Value = token
+	return resp
+}
+
+func (db *Olric) lockLeaseOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.LockWithTimeoutExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	err := db.lease(req.DMap, req.Key, LockToken(req.Value), time.Duration(extra.TTL))
+	if err == ErrNoSuchLock {
+		return req.Error(protocol.StatusNoSuchLock, "")
+	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
 
 func (db *Olric) exUnlockOperation(req *protocol.Message) *protocol.Message {
-	err := db.unlock(req.DMap, req.Key)
+	err := db.unlock(req.DMap, req.Key, LockToken(req.Value))
 	if err == ErrNoSuchLock {
 		return req.Error(protocol.StatusNoSuchLock, "")
 	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
@@ -215,7 +451,7 @@ func (db *Olric) findLockOperation(req *protocol.Message) *protocol.Message {
 	hkey := db.getHKey(req.DMap, req.Key)
 	dm, err := db.getDMap(req.DMap, hkey)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	if dm.locker.check(req.Key) {
 		return req.Success()
@@ -228,28 +464,57 @@ func (db *Olric) unlockPrevOperation(req *protocol.Message) *protocol.Message {
 	hkey := db.getHKey(req.DMap, key)
 	dm, err := db.getDMap(req.DMap, hkey)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
-	err = dm.locker.unlock(key)
+	err = dm.locker.unlock(key, req.Value)
 	if err == ErrNoSuchLock {
 		return req.Error(protocol.StatusNoSuchLock, "")
 	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
 
 func (db *Olric) lockPrevOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.LockWithTimeoutExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
 	key := req.Key
 	hkey := db.getHKey(req.DMap, key)
 	dm, err := db.getDMap(req.DMap, hkey)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
+	}
+	token, err := newLockToken()
+	if err != nil {
+		return errorResponse(req, err)
 	}
 	dm.locker.lock(key)
-	db.wg.Add(1)
-	ttl := req.Extra.(protocol.LockWithTimeoutExtra).TTL
-	go db.waitLockForTimeout(dm, key, time.Duration(ttl))
+	db.grantLock(dm, key, token, time.Duration(extra.TTL))
+	resp := req.Success()
+	resp.Value = token
+	return resp
+}
+
+func (db *Olric) leasePrevOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.LockWithTimeoutExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	key := req.Key
+	hkey := db.getHKey(req.DMap, key)
+	dm, err := db.getDMap(req.DMap, hkey)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	err = dm.locker.lease(key, req.Value, time.Duration(extra.TTL))
+	if err == ErrNoSuchLock {
+		return req.Error(protocol.StatusNoSuchLock, "")
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
 	return req.Success()
 }
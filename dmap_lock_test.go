@@ -40,11 +40,15 @@ func TestDMap_Locker_Standalone(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-	err = d.LockWithTimeout(key, time.Second)
+	lock, err := d.LockWithTimeout(key, time.Second)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-	err = d.Unlock(key)
+	err = d.Unlock(key, LockToken("invalid-token"))
+	if err != ErrNoSuchLock {
+		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
+	}
+	err = lock.Unlock()
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
@@ -63,12 +67,13 @@ func TestDMap_UnlockWithTwoHosts(t *testing.T) {
 	}()
 
 	dm := db1.NewDMap("mymap")
+	locks := make(map[string]*DMapLock)
 	for i := 0; i < 100; i++ {
 		err = dm.Put(bkey(i), bval(i))
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v", err)
 		}
-		err = dm.LockWithTimeout(bkey(i), time.Minute)
+		locks[bkey(i)], err = dm.LockWithTimeout(bkey(i), time.Minute)
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v", err)
 		}
@@ -90,7 +95,7 @@ func TestDMap_UnlockWithTwoHosts(t *testing.T) {
 	dm2 := db2.NewDMap("mymap")
 	for i := 0; i < 100; i++ {
 		key := bkey(i)
-		err := dm2.Unlock(key)
+		err := dm2.Unlock(key, locks[key].Token())
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v for %s", err, key)
 		}
@@ -130,30 +135,31 @@ func TestDMap_LockWithTwoHosts(t *testing.T) {
 	}()
 	db1.updateRouting()
 	dm2 := db2.NewDMap("mymap")
+	locks := make(map[string]*DMapLock)
 	for i := 0; i < 100; i++ {
 		key := bkey(i)
-		err = dm2.LockWithTimeout(key, time.Minute)
+		locks[key], err = dm2.LockWithTimeout(key, time.Minute)
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
 		}
 	}
 
-	err = dm2.Unlock("foobar")
+	err = dm2.Unlock("foobar", locks[bkey(0)].Token())
 	if err != ErrNoSuchLock {
 		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
 	}
 
-	err = dm.Unlock("foobadb2")
+	err = dm.Unlock("foobadb2", locks[bkey(0)].Token())
 	if err != ErrNoSuchLock {
 		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
 	}
 
-	err = dm.Unlock(bkey(1))
+	err = dm.Unlock(bkey(1), locks[bkey(1)].Token())
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
-	err = dm.LockWithTimeout(bkey(1), time.Second)
+	_, err = dm.LockWithTimeout(bkey(1), time.Second)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
@@ -179,23 +185,23 @@ func TestDMap_Locker_LockWithTimeout(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-	err = d.LockWithTimeout(key, 100*time.Millisecond)
+	lock, err := d.LockWithTimeout(key, 100*time.Millisecond)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 
 	time.Sleep(200 * time.Millisecond)
 
-	err = d.Unlock(key)
+	err = lock.Unlock()
 	if err != ErrNoSuchLock {
 		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
 	}
 
-	err = d.LockWithTimeout(key, time.Second)
+	lock, err = d.LockWithTimeout(key, time.Second)
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
-	err = d.Unlock(key)
+	err = lock.Unlock()
 	if err != nil {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
@@ -241,9 +247,10 @@ func TestDMap_LockWithTimeoutOnNetwork(t *testing.T) {
 	defer db1.fsckMx.Unlock()
 
 	dm2 := db2.NewDMap("mymap")
+	locks := make(map[string]*DMapLock)
 	for i := 0; i < 100; i++ {
 		key := bkey(i)
-		err = dm2.LockWithTimeout(key, 200*time.Millisecond)
+		locks[key], err = dm2.LockWithTimeout(key, 200*time.Millisecond)
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
 		}
@@ -252,10 +259,165 @@ func TestDMap_LockWithTimeoutOnNetwork(t *testing.T) {
 	time.Sleep(350 * time.Millisecond)
 	for i := 0; i < 100; i++ {
 		key := bkey(i)
-		err = dm2.Unlock(key)
+		err = dm2.Unlock(key, locks[key].Token())
+		if err != ErrNoSuchLock {
+			t.Fatalf("Expected ErrNoSuchLock. Got: %v for key: %s", err, key)
+		}
+	}
+}
+
+func TestDMap_TryLock(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1 := db1.NewDMap("mymap")
+	dm2 := db2.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		key := bkey(i)
+		lock, locked, err := dm1.TryLock(key, time.Minute)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
+		}
+		if !locked {
+			t.Fatalf("Expected to acquire the lock for key: %s", key)
+		}
+		_, locked, err = dm2.TryLock(key, time.Minute)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
+		}
+		if locked {
+			t.Fatalf("Expected to fail while the lock is held for key: %s", key)
+		}
+		err = dm2.Unlock(key, lock.Token())
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
+		}
+	}
+}
+
+func TestDMap_Lease(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1 := db1.NewDMap("mymap")
+	dm2 := db2.NewDMap("mymap")
+	locks := make(map[string]*DMapLock)
+	for i := 0; i < 10; i++ {
+		key := bkey(i)
+		lock, err := dm1.LockWithTimeout(key, 200*time.Millisecond)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
+		}
+		err = dm2.Lease(key, LockToken("invalid-token"), time.Minute)
 		if err != ErrNoSuchLock {
 			t.Fatalf("Expected ErrNoSuchLock. Got: %v for key: %s", err, key)
 		}
+		err = dm2.Lease(key, lock.Token(), time.Minute)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
+		}
+		locks[key] = lock
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	for key := range locks {
+		_, locked, err := dm2.TryLock(key, time.Second)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
+		}
+		if locked {
+			t.Fatalf("Expected the leased lock to be held for key: %s", key)
+		}
+		err = locks[key].Unlock()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
+		}
+		err = locks[key].Lease(time.Minute)
+		if err != ErrNoSuchLock {
+			t.Fatalf("Expected ErrNoSuchLock. Got: %v for key: %s", err, key)
+		}
+	}
+}
+
+func TestDMap_DMapLock(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	lock, err := dm.LockWithTimeout("mykey", 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if lock.Key() != "mykey" {
+		t.Fatalf("Expected mykey. Got: %s", lock.Key())
+	}
+	err = lock.Lease(time.Minute)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	err = lock.Unlock()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = lock.Unlock()
+	if err != ErrNoSuchLock {
+		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
+	}
+	err = lock.Lease(time.Minute)
+	if err != ErrNoSuchLock {
+		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
 	}
 }
 
@@ -295,9 +457,10 @@ func TestDMap_LockPrevious(t *testing.T) {
 	}()
 
 	dm2 := db2.NewDMap("mymap")
+	locks := make(map[string]*DMapLock)
 	for i := 0; i < 100; i++ {
 		key := bkey(i)
-		err = dm2.LockWithTimeout(key, 200*time.Millisecond)
+		locks[key], err = dm2.LockWithTimeout(key, 200*time.Millisecond)
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v for key: %s", err, key)
 		}
@@ -306,7 +469,7 @@ func TestDMap_LockPrevious(t *testing.T) {
 	time.Sleep(350 * time.Millisecond)
 	for i := 0; i < 100; i++ {
 		key := bkey(i)
-		err = dm2.Unlock(key)
+		err = dm2.Unlock(key, locks[key].Token())
 		if err != ErrNoSuchLock {
 			t.Fatalf("Expected ErrNoSuchLock. Got: %v for key: %s", err, key)
 		}
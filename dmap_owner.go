@@ -0,0 +1,56 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+// KeyOwner describes where a key is stored in the cluster.
+type KeyOwner struct {
+	// PartitionID is the partition of the key.
+	PartitionID uint64
+
+	// Owner is the primary owner of the partition. The requests for the key are served by it.
+	Owner Member
+
+	// Backups are the nodes which keep the backups of the partition. It's empty if BackupCount is zero.
+	Backups []Member
+}
+
+func newMember(h host) Member {
+	return Member{Name: h.Name, Birthdate: h.Birthdate}
+}
+
+// PartitionID returns the partition of the given key. The partition is calculated from the hash of
+// the DMap name and the key, so the same key may belong to different partitions in different DMaps.
+// It's deterministic and doesn't depend on the state of the cluster.
+func (dm *DMap) PartitionID(key string) uint64 {
+	return dm.db.getPartitionID(dm.db.getHKey(dm.name, key))
+}
+
+// Owner returns the partition, the primary owner and the backup owners of the given key from the
+// routing table of this node. It's a debugging helper to find hot spots and check data locality,
+// the result may be stale while the cluster is rebalancing.
+func (dm *DMap) Owner(key string) (KeyOwner, error) {
+	member, hkey, err := dm.db.locateKey(dm.name, key)
+	if err != nil {
+		return KeyOwner{}, err
+	}
+	ko := KeyOwner{
+		PartitionID: dm.db.getPartitionID(hkey),
+		Owner:       newMember(member),
+	}
+	for _, backup := range dm.db.getBackupPartitionOwners(hkey) {
+		ko.Backups = append(ko.Backups, newMember(backup))
+	}
+	return ko, nil
+}
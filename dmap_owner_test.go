@@ -0,0 +1,83 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDMap_Owner(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1, dm2 := db1.NewDMap("mymap"), db2.NewDMap("mymap")
+	instances := map[string]*Olric{db1.this.Name: db1, db2.this.Name: db2}
+	for i := 0; i < 20; i++ {
+		key := bkey(i)
+		err = dm1.Put(key, bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+
+		partID := dm1.PartitionID(key)
+		if partID != dm2.PartitionID(key) {
+			t.Fatalf("Expected the same partition on both nodes for %s", key)
+		}
+		ko, err := dm1.Owner(key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		ko2, err := dm2.Owner(key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if ko.PartitionID != partID || ko2.Owner != ko.Owner {
+			t.Fatalf("Expected the same owner on both nodes. Got: %v and %v", ko, ko2)
+		}
+		if len(ko.Backups) != 1 || ko.Backups[0].Name == ko.Owner.Name {
+			t.Fatalf("Expected a backup owner different from the primary owner. Got: %v", ko)
+		}
+
+		primary, backup := instances[ko.Owner.Name], instances[ko.Backups[0].Name]
+		if _, ok := primary.partitions[partID].m.Load("mymap"); !ok {
+			t.Fatalf("mymap could not be found on the primary owner of %s", key)
+		}
+		if _, ok := backup.backups[partID].m.Load("mymap"); !ok {
+			t.Fatalf("mymap could not be found on the backup owner of %s", key)
+		}
+	}
+}
@@ -15,7 +15,10 @@
 package olric
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -48,7 +51,27 @@ func (db *Olric) purgeOldVersions(hkey uint64, name, key string) {
 	}
 }
 
-func (db *Olric) putKeyVal(hkey uint64, name, key string, value []byte, timeout time.Duration) error {
+// Flags for PutIf.
+const (
+	// IfNotFound sets the value only if the key doesn't exist.
+	IfNotFound = int(1 << iota)
+	// IfFound sets the value only if the key already exists.
+	IfFound
+)
+
+func (db *Olric) putKeyVal(hkey uint64, name, key string, value []byte, timeout time.Duration, trace *protocol.TraceContext) error {
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return err
+	}
+	dm.Lock()
+	defer dm.Unlock()
+	return db.putKeyValLocked(dm, hkey, name, key, value, timeout, trace)
+}
+
+// putIfKeyVal checks the condition and sets the value atomically, under the lock of the dmap.
+func (db *Olric) putIfKeyVal(hkey uint64, name, key string, value []byte, timeout time.Duration, flags int,
+	trace *protocol.TraceContext) error {
 	dm, err := db.getDMap(name, hkey)
 	if err != nil {
 		return err
@@ -56,47 +79,82 @@ func (db *Olric) putKeyVal(hkey uint64, name, key string, value []byte, timeout
 	dm.Lock()
 	defer dm.Unlock()
 
+	vdata, err := dm.str.Get(hkey)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return err
+	}
+	found := err == nil && !isKeyExpired(vdata.TTL)
+	if flags&IfNotFound != 0 && found {
+		return ErrKeyFound
+	}
+	if flags&IfFound != 0 && !found {
+		return ErrKeyNotFound
+	}
+	return db.putKeyValLocked(dm, hkey, name, key, value, timeout, trace)
+}
+
+// putKeyValLocked sets the value on the given dmap. The caller must hold the lock of the dmap.
+func (db *Olric) putKeyValLocked(dm *dmap, hkey uint64, name, key string, value []byte, timeout time.Duration,
+	trace *protocol.TraceContext) error {
+	err := db.checkQuota(dm, name, hkey, key, value)
+	if err != nil {
+		return err
+	}
+	if timeout == nilTimeout {
+		timeout = dm.config.DefaultTTL
+	}
+	var ttl int64
+	if timeout.Seconds() != 0 {
+		// The backups get the same absolute expiry.
+		ttl = getTTL(db.jitterTimeout(dm, timeout))
+	}
+	val := &storage.VData{
+		Key:       key,
+		TTL:       ttl,
+		Timestamp: db.clock.now(),
+		Value:     value,
+	}
+
 	if db.config.BackupCount != 0 {
 		if db.config.BackupMode == AsyncBackupMode {
 			db.wg.Add(1)
 			go func() {
 				defer db.wg.Done()
-				err := db.putKeyValBackup(hkey, name, key, value, timeout)
+				err := db.putKeyValBackup(hkey, name, val, trace)
 				if err != nil {
 					db.log.Printf("[ERROR] Failed to create backup mode in async mode: %v", err)
 				}
 			}()
 		} else {
-			err := db.putKeyValBackup(hkey, name, key, value, timeout)
+			err := db.putKeyValBackup(hkey, name, val, trace)
+			if err == ErrWriteQuorum {
+				return err
+			}
 			if err != nil {
 				return fmt.Errorf("failed to create backup in sync mode: %v", err)
 			}
 		}
 	}
 
-	var ttl int64
-	if timeout.Seconds() != 0 {
-		ttl = getTTL(timeout)
-	}
-	val := &storage.VData{
-		Key:   key,
-		TTL:   ttl,
-		Value: value,
-	}
-	err = dm.str.Put(hkey, val)
+	err = db.putEntry(dm, name, hkey, val)
 	if err != nil {
 		return err
 	}
-
-	if db.config.OperationMode == OpInMemoryWithSnapshot {
-		dm.oplog.Put(hkey)
+	if dm.idle != nil {
+		dm.idle.touch(hkey, time.Now().UnixNano())
+	}
+	if dm.tracker != nil {
+		dm.tracker.touch(hkey)
+		db.evictKeysForBudget(dm, name, hkey)
 	}
 	// TODO: Consider running this at background.
 	db.purgeOldVersions(hkey, name, key)
 	return nil
 }
 
-func (db *Olric) put(name, key string, value []byte, timeout time.Duration) error {
+// put sets the value on the owner of the key. trace is the trace context of the operation, the requests
+// to the owners are linked to it.
+func (db *Olric) put(name, key string, value []byte, timeout time.Duration, trace *protocol.TraceContext) error {
 	member, hkey, err := db.locateKey(name, key)
 	if err != nil {
 		return err
@@ -105,27 +163,59 @@ func (db *Olric) put(name, key string, value []byte, timeout time.Duration) erro
 		req := &protocol.Message{
 			DMap:  name,
 			Key:   key,
+			Extra: protocol.PutExtra{Timestamp: db.clock.now()},
 			Value: value,
+			Trace: trace,
 		}
 		opcode := protocol.OpExPut
 		if timeout != nilTimeout {
 			opcode = protocol.OpExPutEx
-			req.Extra = protocol.PutExExtra{TTL: timeout.Nanoseconds()}
+			req.Extra = protocol.PutExExtra{TTL: timeout.Nanoseconds(), Timestamp: db.clock.now()}
 		}
 		_, err = db.requestTo(member.String(), opcode, req)
 		return err
 	}
-	return db.putKeyVal(hkey, name, key, value, timeout)
+	return db.putKeyVal(hkey, name, key, value, timeout, trace)
+}
+
+func (db *Olric) putIf(name, key string, value []byte, flags int, trace *protocol.TraceContext) error {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap:  name,
+			Key:   key,
+			Extra: protocol.PutIfExtra{Flags: uint8(flags)},
+			Value: value,
+			Trace: trace,
+		}
+		_, err = db.requestTo(member.String(), protocol.OpExPutIf, req)
+		return err
+	}
+	return db.putIfKeyVal(hkey, name, key, value, nilTimeout, flags, trace)
+}
+
+// PutIf sets the value for the given key if the condition given by flags is satisfied. The check and set
+// is atomic. Flags is one of IfNotFound and IfFound. It returns ErrKeyFound if IfNotFound is given and the
+// key exists, ErrKeyNotFound if IfFound is given and the key doesn't exist. It's thread-safe.
+func (dm *DMap) PutIf(key string, value interface{}, flags int) error {
+	val, err := dm.db.serializerOf(dm.name).Marshal(value)
+	if err != nil {
+		return err
+	}
+	return dm.db.putIf(dm.name, key, val, flags, nil)
 }
 
 // PutEx sets the value for the given key with TTL. It overwrites any previous value for that key. It's thread-safe.
 // The key has to be string. Value type is arbitrary. It is safe to modify the contents of the arguments after Put returns but not before.
 func (dm *DMap) PutEx(key string, value interface{}, timeout time.Duration) error {
-	val, err := dm.db.serializer.Marshal(value)
+	val, err := dm.db.serializerOf(dm.name).Marshal(value)
 	if err != nil {
 		return err
 	}
-	return dm.db.put(dm.name, key, val, timeout)
+	return dm.db.put(dm.name, key, val, timeout, nil)
 }
 
 // Put sets the value for the given key. It overwrites any previous value for that key and it's thread-safe.
@@ -134,56 +224,278 @@ func (dm *DMap) Put(key string, value interface{}) error {
 	return dm.PutEx(key, value, nilTimeout)
 }
 
+// PutManyError is returned by PutMany if some of the keys could not be written.
+// The other keys have been written successfully.
+type PutManyError struct {
+	// Errors maps the failed keys to their errors.
+	Errors map[string]error
+}
+
+// Keys returns the failed keys in sorted order.
+func (e *PutManyError) Keys() []string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (e *PutManyError) Error() string {
+	return fmt.Sprintf("failed to put %d keys: %v", len(e.Errors), e.Keys())
+}
+
+func (db *Olric) putMany(name string, entries map[string][]byte) error {
+	records := make([]protocol.Record, 0, len(entries))
+	for key, value := range entries {
+		records = append(records, protocol.Record{Key: key, Value: value})
+	}
+	return db.putRecords(name, records)
+}
+
+// putRecords writes the records with their TTLs. The records without a TTL are sent with OpExMPut,
+// so the nodes which don't know OpExMPutEx can still serve PutMany.
+func (db *Olric) putRecords(name string, records []protocol.Record) error {
+	// Group the records by their owners. Only one request is sent to a remote node.
+	local := make(map[uint64]protocol.Record)
+	remote := make(map[string][]protocol.Record)
+	for _, rec := range records {
+		member, hkey, err := db.locateKey(name, rec.Key)
+		if err != nil {
+			return err
+		}
+		if hostCmp(member, db.this) {
+			local[hkey] = rec
+			continue
+		}
+		addr := member.String()
+		remote[addr] = append(remote[addr], rec)
+	}
+
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	var wg sync.WaitGroup
+	for addr, recs := range remote {
+		wg.Add(1)
+		go func(addr string, recs []protocol.Record) {
+			defer wg.Done()
+			req := &protocol.Message{DMap: name}
+			op := protocol.OpExMPut
+			if hasTTL(recs) {
+				op = protocol.OpExMPutEx
+				req.Value = protocol.EncodeRecords(recs)
+			} else {
+				pairs := make(map[string][]byte, len(recs))
+				for _, rec := range recs {
+					pairs[rec.Key] = rec.Value
+				}
+				req.Value = protocol.EncodeEntries(pairs)
+			}
+			resp, err := db.requestTo(addr, op, req)
+			if err == nil {
+				var errs map[string][]byte
+				errs, err = protocol.DecodeEntries(resp.Value)
+				if err == nil {
+					mu.Lock()
+					for key, msg := range errs {
+						failed[key] = errors.New(string(msg))
+					}
+					mu.Unlock()
+					return
+				}
+			}
+			mu.Lock()
+			for _, rec := range recs {
+				failed[rec.Key] = err
+			}
+			mu.Unlock()
+		}(addr, recs)
+	}
+
+	for hkey, rec := range local {
+		// putKeyVal creates the backups like the single Put path.
+		err := db.putKeyVal(hkey, name, rec.Key, rec.Value, remainingTimeout(rec.TTL), nil)
+		if err != nil {
+			mu.Lock()
+			failed[rec.Key] = err
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		return &PutManyError{Errors: failed}
+	}
+	return nil
+}
+
+func hasTTL(records []protocol.Record) bool {
+	for _, rec := range records {
+		if rec.TTL != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// PutMany sets the values for the given keys. It sends only one request to every node which owns
+// some of the keys. It returns a *PutManyError which lists the failed keys, if some of the keys
+// could not be written. It's thread-safe.
+func (dm *DMap) PutMany(entries map[string]interface{}) error {
+	values := make(map[string][]byte, len(entries))
+	for key, value := range entries {
+		val, err := dm.db.serializerOf(dm.name).Marshal(value)
+		if err != nil {
+			return err
+		}
+		values[key] = val
+	}
+	return dm.db.putMany(dm.name, values)
+}
+
 func (db *Olric) exPutOperation(req *protocol.Message) *protocol.Message {
-	err := db.put(req.DMap, req.Key, req.Value, nilTimeout)
+	if extra, ok := req.Extra.(protocol.PutExtra); ok {
+		db.clock.update(extra.Timestamp)
+	}
+	err := db.put(req.DMap, req.Key, req.Value, nilTimeout, req.Trace)
+	if err == ErrWriteQuorum {
+		return req.Error(protocol.StatusWriteQuorum, err)
+	}
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
 
 func (db *Olric) exPutExOperation(req *protocol.Message) *protocol.Message {
-	ttl := req.Extra.(protocol.PutExExtra).TTL
-	err := db.put(req.DMap, req.Key, req.Value, time.Duration(ttl))
+	extra, ok := req.Extra.(protocol.PutExExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	db.clock.update(extra.Timestamp)
+	err := db.put(req.DMap, req.Key, req.Value, time.Duration(extra.TTL), req.Trace)
+	if err == ErrWriteQuorum {
+		return req.Error(protocol.StatusWriteQuorum, err)
+	}
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
 
-func (db *Olric) putBackupOperation(req *protocol.Message) *protocol.Message {
-	// TODO: We may need to check backup ownership
-	hkey := db.getHKey(req.DMap, req.Key)
-	dm, err := db.getBackupDMap(req.DMap, hkey)
+func (db *Olric) exPutIfOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.PutIfExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	err := db.putIf(req.DMap, req.Key, req.Value, int(extra.Flags), req.Trace)
+	if err == ErrWriteQuorum {
+		return req.Error(protocol.StatusWriteQuorum, err)
+	}
+	if err == ErrQuotaExceeded {
+		return req.Error(protocol.StatusQuotaExceeded, err)
+	}
+	if err == ErrKeyFound {
+		return req.Error(protocol.StatusKeyFound, "")
+	}
+	if err == ErrKeyNotFound {
+		return req.Error(protocol.StatusKeyNotFound, "")
+	}
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
+	return req.Success()
+}
 
-	var ttl int64
-	if req.Extra != nil {
-		if req.Extra.(protocol.PutExExtra).TTL != 0 {
-			tmp := time.Duration(req.Extra.(protocol.PutExExtra).TTL)
-			ttl = getTTL(tmp)
-		}
+func (db *Olric) exMPutOperation(req *protocol.Message) *protocol.Message {
+	entries, err := protocol.DecodeEntries(req.Value)
+	if err != nil {
+		return errorResponse(req, err)
 	}
+	return putManyResponse(req, db.putMany(req.DMap, entries))
+}
+
+func (db *Olric) exMPutExOperation(req *protocol.Message) *protocol.Message {
+	records, err := protocol.DecodeRecords(req.Value)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	return putManyResponse(req, db.putRecords(req.DMap, records))
+}
+
+// putManyResponse returns the failed keys with their error messages.
+func putManyResponse(req *protocol.Message, err error) *protocol.Message {
+	if err == nil {
+		return req.Success()
+	}
+	perr, ok := err.(*PutManyError)
+	if !ok {
+		return errorResponse(req, err)
+	}
+	errs := make(map[string][]byte, len(perr.Errors))
+	for key, e := range perr.Errors {
+		errs[key] = []byte(e.Error())
+	}
+	resp := req.Success()
+	resp.Value = protocol.EncodeEntries(errs)
+	return resp
+}
+
+func (db *Olric) putBackupOperation(req *protocol.Message) *protocol.Message {
 	vdata := &storage.VData{
 		Key:   req.Key,
-		TTL:   ttl,
 		Value: req.Value,
 	}
+	if extra, ok := req.Extra.(protocol.PutBackupExtra); ok {
+		vdata.TTL = extra.TTL
+		vdata.Timestamp = extra.Timestamp
+	}
+	err := db.putBackup(req.DMap, vdata)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	return req.Success()
+}
 
-	err = dm.str.Put(hkey, vdata)
+// putBackup writes a replica sent by the primary owner of the key.
+func (db *Olric) putBackup(name string, vdata *storage.VData) error {
+	// TODO: We may need to check backup ownership
+	hkey := db.getHKey(name, vdata.Key)
+	dm, err := db.getBackupDMap(name, hkey)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return err
 	}
+	db.clock.update(vdata.Timestamp)
 
-	if db.config.OperationMode == OpInMemoryWithSnapshot {
-		dm.oplog.Put(hkey)
+	dm.Lock()
+	defer dm.Unlock()
+	current, err := dm.str.Get(hkey)
+	if err == nil && current.Timestamp > vdata.Timestamp {
+		// Ignore the stale write, i.e. an old replay during a handoff.
+		return nil
 	}
-	return req.Success()
+	if dm.isDeleted(hkey, vdata.Timestamp) {
+		// The key has been deleted after this write, don't resurrect it.
+		return nil
+	}
+
+	err = db.putEntry(dm, name, hkey, vdata)
+	if err != nil {
+		return err
+	}
+	if dm.idle != nil {
+		dm.idle.touch(hkey, time.Now().UnixNano())
+	}
+	return nil
 }
 
-func (db *Olric) putKeyValBackup(hkey uint64, name, key string, value []byte, timeout time.Duration) error {
+func (db *Olric) putKeyValBackup(hkey uint64, name string, vdata *storage.VData, trace *protocol.TraceContext) error {
 	memCount := db.discovery.numMembers()
 	backupCount := calcMaxBackupCount(db.config.BackupCount, memCount)
 	backupOwners := db.getBackupPartitionOwners(hkey)
@@ -191,6 +503,11 @@ func (db *Olric) putKeyValBackup(hkey uint64, name, key string, value []byte, ti
 		backupOwners = backupOwners[len(backupOwners)-backupCount:]
 	}
 
+	// The primary owner is one of the replicas.
+	quorum := db.config.WriteQuorum - 1
+	if len(backupOwners) < quorum {
+		return ErrWriteQuorum
+	}
 	if len(backupOwners) == 0 {
 		// There is no backup owner, return nil.
 		return nil
@@ -202,17 +519,10 @@ func (db *Olric) putKeyValBackup(hkey uint64, name, key string, value []byte, ti
 		mem := backup
 		g.Go(func() error {
 			// TODO: We may need to retry with backoff
-			msg := &protocol.Message{
-				DMap:  name,
-				Key:   key,
-				Value: value,
-			}
-			if timeout != nilTimeout {
-				msg.Extra = protocol.PutExExtra{TTL: timeout.Nanoseconds()}
-			}
-			_, err := db.requestTo(mem.String(), protocol.OpPutBackup, msg)
+			err := db.sendBackup(mem.String(), name, vdata, trace)
 			if err != nil {
 				db.log.Printf("[ERROR] Failed to put backup hkey: %s on %s", mem, err)
+				db.addHint(mem, name, hkey, vdata.Key)
 				return err
 			}
 			atomic.AddInt32(&successful, 1)
@@ -220,6 +530,12 @@ func (db *Olric) putKeyValBackup(hkey uint64, name, key string, value []byte, ti
 		})
 	}
 	werr := g.Wait()
+	if quorum > 0 {
+		if int(atomic.LoadInt32(&successful)) < quorum {
+			return ErrWriteQuorum
+		}
+		return nil
+	}
 	// Return nil if one of the backup nodes has the key/value pair, at least.
 	// Active anti-entropy system will repair the failed backup node.
 	if atomic.LoadInt32(&successful) >= 1 {
@@ -0,0 +1,197 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// compileQuery compiles a glob pattern or a regular expression. Glob patterns support
+// '*' to match any sequence of characters and '?' to match a single character.
+func compileQuery(pattern string, isRegexp bool) (*regexp.Regexp, error) {
+	if isRegexp {
+		return regexp.Compile(pattern)
+	}
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func queryCursor(extra protocol.QueryExtra) protocol.ScanExtra {
+	return protocol.ScanExtra{PartID: extra.PartID, Offset: extra.Offset, Generation: extra.Generation}
+}
+
+func (db *Olric) queryPartition(name, pattern string, extra protocol.QueryExtra,
+	match *regexp.Regexp) (map[string][]byte, protocol.QueryExtra, error) {
+	part := db.partitions[extra.PartID]
+	part.RLock()
+	if len(part.owners) == 0 {
+		part.RUnlock()
+		return nil, extra, fmt.Errorf("no owner found for PartID: %d", extra.PartID)
+	}
+	owner := part.owners[len(part.owners)-1]
+	part.RUnlock()
+
+	if hostCmp(owner, db.this) {
+		items, next := db.scanItems(name, queryCursor(extra), match.MatchString)
+		entries := make(map[string][]byte, len(items))
+		for _, item := range items {
+			entries[item.key] = item.value
+		}
+		extra.PartID, extra.Offset, extra.Generation = next.PartID, next.Offset, next.Generation
+		return entries, extra, nil
+	}
+
+	req := &protocol.Message{
+		DMap:  name,
+		Extra: extra,
+		Value: []byte(pattern),
+	}
+	resp, err := db.requestTo(owner.String(), protocol.OpQuery, req)
+	if err != nil {
+		return nil, extra, err
+	}
+	entries, err := protocol.DecodeEntries(resp.Value)
+	if err != nil {
+		return nil, extra, err
+	}
+	next, ok := resp.Extra.(protocol.QueryExtra)
+	if !ok {
+		return nil, extra, fmt.Errorf("invalid response: no cursor")
+	}
+	return entries, next, nil
+}
+
+// queryBatch returns the next non-empty batch of matching entries and the cursor to continue
+// from. An empty batch means that the query is done. It fails with ErrOperationTimeout if ctx is
+// done before a batch is found.
+func (db *Olric) queryBatch(ctx context.Context, name, pattern string, extra protocol.QueryExtra) (map[string][]byte, protocol.QueryExtra, error) {
+	<-db.bcx.Done()
+	if db.bcx.Err() == context.DeadlineExceeded {
+		return nil, extra, ErrOperationTimeout
+	}
+	match, err := compileQuery(pattern, extra.Regexp != 0)
+	if err != nil {
+		return nil, extra, err
+	}
+
+	for extra.PartID < db.config.PartitionCount {
+		if ctx.Err() != nil {
+			return nil, extra, ErrOperationTimeout
+		}
+		entries, next, err := db.queryPartition(name, pattern, extra, match)
+		if err != nil {
+			return nil, extra, err
+		}
+		if len(entries) != 0 {
+			return entries, next, nil
+		}
+		extra = next
+	}
+	return nil, extra, nil
+}
+
+func (db *Olric) query(name, pattern string, isRegexp bool) (map[string]interface{}, error) {
+	extra := protocol.QueryExtra{}
+	if isRegexp {
+		extra.Regexp = 1
+	}
+	result := make(map[string]interface{})
+	for {
+		entries, next, err := db.queryBatch(context.Background(), name, pattern, extra)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return result, nil
+		}
+		for key, rawval := range entries {
+			value, err := db.unmarshalValue(name, rawval)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+		}
+		extra = next
+	}
+}
+
+// Query returns the keys which match the given glob pattern with their values. The pattern supports
+// '*' to match any sequence of characters and '?' to match a single character. Keys are matched
+// on the partition owners and the matching entries are transferred in batches. The result has the
+// same guarantees with Scan. It's thread-safe.
+func (dm *DMap) Query(pattern string) (map[string]interface{}, error) {
+	return dm.db.query(dm.name, pattern, false)
+}
+
+// QueryRegexp is like Query but it matches the keys with the given regular expression.
+func (dm *DMap) QueryRegexp(expr string) (map[string]interface{}, error) {
+	return dm.db.query(dm.name, expr, true)
+}
+
+func (db *Olric) exQueryOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.QueryExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	entries, next, err := db.queryBatch(req.Context(), req.DMap, string(req.Value), extra)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Extra = next
+	resp.Value = protocol.EncodeEntries(entries)
+	return resp
+}
+
+func (db *Olric) queryOperation(req *protocol.Message) *protocol.Message {
+	extra, ok := req.Extra.(protocol.QueryExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	if extra.PartID >= db.config.PartitionCount {
+		return req.Error(protocol.StatusInternalServerError, fmt.Sprintf("invalid PartID: %d", extra.PartID))
+	}
+	match, err := compileQuery(string(req.Value), extra.Regexp != 0)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	items, next := db.scanItems(req.DMap, queryCursor(extra), match.MatchString)
+	entries := make(map[string][]byte, len(items))
+	for _, item := range items {
+		entries[item.key] = item.value
+	}
+	extra.PartID, extra.Offset, extra.Generation = next.PartID, next.Offset, next.Generation
+	resp := req.Success()
+	resp.Extra = extra
+	resp.Value = protocol.EncodeEntries(entries)
+	return resp
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestDMap_Query(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 1000; i++ {
+		err = dm.Put("user:"+strconv.Itoa(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		err = dm.Put("session:"+strconv.Itoa(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	result, err := db2.NewDMap("mymap").Query("user:*")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(result) != 1000 {
+		t.Fatalf("Expected 1000 keys. Got: %d", len(result))
+	}
+	for i := 0; i < 1000; i++ {
+		value, ok := result["user:"+strconv.Itoa(i)]
+		if !ok {
+			t.Fatalf("Expected key user:%d in the result", i)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Value is different for key: user:%d", i)
+		}
+	}
+
+	result, err = dm.Query("user:?")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(result) != 10 {
+		t.Fatalf("Expected 10 keys. Got: %d", len(result))
+	}
+}
+
+func TestDMap_QueryRegexp(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	result, err := dm.QueryRegexp("^0000000[1-3]")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(result) != 30 {
+		t.Fatalf("Expected 30 keys. Got: %d", len(result))
+	}
+
+	_, err = dm.QueryRegexp("[")
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid regular expression")
+	}
+}
+
+func Test_CompileQuery(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"user:*", "user:1", true},
+		{"user:*", "user:", true},
+		{"user:*", "session:1", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"*", "anything", true},
+	}
+	for _, tt := range tests {
+		re, err := compileQuery(tt.pattern, false)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if re.MatchString(tt.key) != tt.match {
+			t.Fatalf("Expected %v for pattern %q and key %q", tt.match, tt.pattern, tt.key)
+		}
+	}
+}
+
+func TestDMap_QueryTimeout(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = db.queryBatch(ctx, "mymap", "*", protocol.QueryExtra{})
+	if err != ErrOperationTimeout {
+		t.Fatalf("Expected ErrOperationTimeout. Got: %v", err)
+	}
+	_, _, err = db.scan(ctx, "mymap", protocol.ScanExtra{})
+	if err != ErrOperationTimeout {
+		t.Fatalf("Expected ErrOperationTimeout. Got: %v", err)
+	}
+}
+
+func TestOlric_InvalidOperationTimeout(t *testing.T) {
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.OperationTimeouts = map[string]time.Duration{"foobar": time.Second}
+	_, err = New(cfg)
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown operation")
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+// scanBatchSize is the maximum number of keys returned by a single scan request.
+const scanBatchSize = 100
+
+type scanItem struct {
+	hkey  uint64
+	key   string
+	value []byte
+	ttl   int64
+}
+
+// recordInsert records the generation of a created key. The caller must hold the dmap lock.
+func (dm *dmap) recordInsert(hkey uint64) {
+	if dm.inserted == nil {
+		dm.inserted = make(map[uint64]uint64)
+	}
+	dm.inserted[hkey] = dm.generation
+}
+
+// scanItems returns a batch of items on the given partition, starting from the cursor. Items are
+// sorted by their hkeys and the offset of the cursor is the smallest hkey to return. So the cursor
+// stays valid under concurrent writes: a key is never returned twice, and the keys updated during the
+// scan are returned with their current values. The generation of the dmap is taken with the first batch,
+// the keys inserted after it are skipped. If match is not nil, only the matching keys are returned with
+// their values and expiry times.
+func (db *Olric) scanItems(name string, cursor protocol.ScanExtra, match func(key string) bool) ([]scanItem, protocol.ScanExtra) {
+	next := protocol.ScanExtra{PartID: cursor.PartID + 1}
+	part := db.partitions[cursor.PartID]
+	tmp, ok := part.m.Load(name)
+	if !ok {
+		return nil, next
+	}
+	dm := tmp.(*dmap)
+
+	var items []scanItem
+	dm.Lock()
+	if cursor.Generation == 0 {
+		dm.generation++
+		cursor.Generation = dm.generation
+	}
+	dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+		if hkey < cursor.Offset || isKeyExpired(vdata.TTL) {
+			return true
+		}
+		if generation, ok := dm.inserted[hkey]; ok && generation >= cursor.Generation {
+			// The key has been inserted during the scan.
+			return true
+		}
+		if match == nil {
+			items = append(items, scanItem{hkey: hkey, key: vdata.Key})
+			return true
+		}
+		if match(vdata.Key) {
+			// The value points to the underlying storage, copy it before releasing the lock.
+			value := make([]byte, len(vdata.Value))
+			copy(value, vdata.Value)
+			items = append(items, scanItem{hkey: hkey, key: vdata.Key, value: value, ttl: vdata.TTL})
+		}
+		return true
+	})
+	dm.Unlock()
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].hkey < items[j].hkey
+	})
+	// Limit the batch by the number of items and the total size of the values.
+	var size int
+	for i, item := range items {
+		size += len(item.key) + len(item.value)
+		if i == scanBatchSize || (i > 0 && size > protocol.MaxValueSize/2) {
+			items = items[:i]
+			if last := items[i-1].hkey; last != math.MaxUint64 {
+				next = protocol.ScanExtra{PartID: cursor.PartID, Offset: last + 1, Generation: cursor.Generation}
+			}
+			break
+		}
+	}
+	return items, next
+}
+
+// localScan returns a batch of keys on the given partition, starting from the cursor.
+func (db *Olric) localScan(name string, cursor protocol.ScanExtra) ([]string, protocol.ScanExtra) {
+	items, next := db.scanItems(name, cursor, nil)
+	keys := make([]string, 0, len(items))
+	for _, i := range items {
+		keys = append(keys, i.key)
+	}
+	return keys, next
+}
+
+func (db *Olric) scanPartition(name string, cursor protocol.ScanExtra) ([]string, protocol.ScanExtra, error) {
+	part := db.partitions[cursor.PartID]
+	part.RLock()
+	if len(part.owners) == 0 {
+		part.RUnlock()
+		return nil, cursor, fmt.Errorf("no owner found for PartID: %d", cursor.PartID)
+	}
+	owner := part.owners[len(part.owners)-1]
+	part.RUnlock()
+
+	if hostCmp(owner, db.this) {
+		keys, next := db.localScan(name, cursor)
+		return keys, next, nil
+	}
+	req := &protocol.Message{
+		DMap:  name,
+		Extra: cursor,
+	}
+	resp, err := db.requestTo(owner.String(), protocol.OpScan, req)
+	if err != nil {
+		return nil, cursor, err
+	}
+	keys, err := protocol.DecodeKeys(resp.Value)
+	if err != nil {
+		return nil, cursor, err
+	}
+	next, ok := resp.Extra.(protocol.ScanExtra)
+	if !ok {
+		return nil, cursor, fmt.Errorf("invalid response: no cursor")
+	}
+	return keys, next, nil
+}
+
+// scan returns the next non-empty batch of keys and the cursor to continue from. An empty batch
+// means that the scan is done. It fails with ErrOperationTimeout if ctx is done before a batch is found.
+func (db *Olric) scan(ctx context.Context, name string, cursor protocol.ScanExtra) ([]string, protocol.ScanExtra, error) {
+	<-db.bcx.Done()
+	if db.bcx.Err() == context.DeadlineExceeded {
+		return nil, cursor, ErrOperationTimeout
+	}
+
+	for cursor.PartID < db.config.PartitionCount {
+		if ctx.Err() != nil {
+			return nil, cursor, ErrOperationTimeout
+		}
+		keys, next, err := db.scanPartition(name, cursor)
+		if err != nil {
+			return nil, cursor, err
+		}
+		if len(keys) != 0 {
+			return keys, next, nil
+		}
+		cursor = next
+	}
+	return nil, cursor, nil
+}
+
+// ScanIterator iterates over the keys of a DMap, partition by partition. It's not thread-safe.
+//
+// The keys of a partition are visited in the order of their hkeys, so every key is returned at most once,
+// even if it's updated during the scan. A partition is scanned as of the time the iteration reaches it: the
+// keys inserted on it after that are skipped. Every key which exists during the entire scan is returned
+// exactly once. Keys which are deleted during the scan may or may not be returned. Keys may be missed or
+// duplicated while partitions are moving between nodes.
+type ScanIterator struct {
+	dm     *DMap
+	cursor protocol.ScanExtra
+	keys   []string
+	key    string
+	err    error
+	done   bool
+}
+
+// Scan returns an iterator to walk the keys of the DMap.
+func (dm *DMap) Scan() *ScanIterator {
+	return &ScanIterator{dm: dm}
+}
+
+// Next advances the iterator to the next key. It returns false when the scan is done or an error
+// occurs. Check Err after Next returns false.
+func (s *ScanIterator) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	if len(s.keys) == 0 && !s.done {
+		keys, next, err := s.dm.db.scan(context.Background(), s.dm.name, s.cursor)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.keys, s.cursor = keys, next
+		s.done = len(keys) == 0
+	}
+	if len(s.keys) == 0 {
+		return false
+	}
+	s.key, s.keys = s.keys[0], s.keys[1:]
+	return true
+}
+
+// Key returns the current key.
+func (s *ScanIterator) Key() string {
+	return s.key
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (s *ScanIterator) Err() error {
+	return s.err
+}
+
+func (db *Olric) exScanOperation(req *protocol.Message) *protocol.Message {
+	cursor, ok := req.Extra.(protocol.ScanExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	keys, next, err := db.scan(req.Context(), req.DMap, cursor)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Extra = next
+	resp.Value = protocol.EncodeKeys(keys)
+	return resp
+}
+
+func (db *Olric) scanOperation(req *protocol.Message) *protocol.Message {
+	cursor, ok := req.Extra.(protocol.ScanExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	if cursor.PartID >= db.config.PartitionCount {
+		return req.Error(protocol.StatusInternalServerError, fmt.Sprintf("invalid PartID: %d", cursor.PartID))
+	}
+	keys, next := db.localScan(req.DMap, cursor)
+	resp := req.Success()
+	resp.Extra = next
+	resp.Value = protocol.EncodeKeys(keys)
+	return resp
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestDMap_Scan(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	// More keys than scanBatchSize to get multiple batches from a partition.
+	dm := db1.NewDMap("mymap")
+	count := 10 * scanBatchSize
+	for i := 0; i < count; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	keys := make(map[string]struct{})
+	s := db2.NewDMap("mymap").Scan()
+	for s.Next() {
+		if _, ok := keys[s.Key()]; ok {
+			t.Fatalf("Duplicated key: %s", s.Key())
+		}
+		keys[s.Key()] = struct{}{}
+	}
+	if s.Err() != nil {
+		t.Fatalf("Expected nil. Got: %v", s.Err())
+	}
+	if len(keys) != count {
+		t.Fatalf("Expected %d keys. Got: %d", count, len(keys))
+	}
+	for i := 0; i < count; i++ {
+		if _, ok := keys[bkey(i)]; !ok {
+			t.Fatalf("Expected key %s in the result", bkey(i))
+		}
+	}
+}
+
+func TestDMap_ScanEmpty(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	s := db.NewDMap("mymap").Scan()
+	if s.Next() {
+		t.Fatalf("Expected no keys. Got: %s", s.Key())
+	}
+	if s.Err() != nil {
+		t.Fatalf("Expected nil. Got: %v", s.Err())
+	}
+}
+
+func TestDMap_ScanConcurrentWrites(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	// Fill a partition with more keys than scanBatchSize to get multiple batches.
+	dm := db.NewDMap("mymap")
+	var partID uint64
+	existing := make(map[string]struct{})
+	for i := 0; len(existing) < 3*scanBatchSize; i++ {
+		hkey := db.getHKey("mymap", bkey(i))
+		if db.getPartition(hkey).id != partID {
+			continue
+		}
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		existing[bkey(i)] = struct{}{}
+	}
+
+	records, cursor := db.localDump("mymap", protocol.ScanExtra{PartID: partID})
+	if cursor.PartID != partID || cursor.Generation == 0 {
+		t.Fatalf("Expected a cursor on PartID: %d with a generation. Got: %v", partID, cursor)
+	}
+	first := make(map[string]struct{})
+	for _, record := range records {
+		first[record.Key] = struct{}{}
+	}
+	// Update the existing keys and add new ones during the scan.
+	for key := range existing {
+		err = dm.Put(key, "updated-"+key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	var inserted int
+	for i := 0; inserted < 2*scanBatchSize; i++ {
+		key := "new-" + bkey(i)
+		if db.getPartition(db.getHKey("mymap", key)).id != partID {
+			continue
+		}
+		err = dm.Put(key, bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		inserted++
+	}
+	for cursor.PartID == partID {
+		var batch []protocol.Record
+		batch, cursor = db.localDump("mymap", cursor)
+		records = append(records, batch...)
+	}
+
+	seen := make(map[string]struct{})
+	for _, record := range records {
+		if _, ok := seen[record.Key]; ok {
+			t.Fatalf("Duplicated key: %s", record.Key)
+		}
+		seen[record.Key] = struct{}{}
+		if _, ok := existing[record.Key]; !ok {
+			t.Fatalf("Expected the keys inserted during the scan to be skipped. Got: %s", record.Key)
+		}
+		if _, ok := first[record.Key]; ok {
+			continue
+		}
+		// The keys updated before their batch are returned with their current values.
+		value, err := db.unmarshalValue("mymap", record.Value)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if value != "updated-"+record.Key {
+			t.Fatalf("Expected the updated value of %s. Got: %v", record.Key, value)
+		}
+	}
+	for key := range existing {
+		if _, ok := seen[key]; !ok {
+			t.Fatalf("Expected %s to be returned", key)
+		}
+	}
+}
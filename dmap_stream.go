@@ -0,0 +1,216 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// streamMagic marks the metadata of a stream, so it can be told apart from a regular value.
+var streamMagic = []byte("OLSTREAM")
+
+// streamMeta is stored under the key of a stream. The chunks of the stream are stored under the
+// keys derived from the key and the ID of the stream, so a new stream doesn't overwrite the chunks
+// of the old one before its metadata replaces the old metadata.
+type streamMeta struct {
+	ID     uint64
+	Chunks uint64
+	Size   uint64
+}
+
+func (s *streamMeta) chunkKey(key string, i uint64) string {
+	return fmt.Sprintf("%s\x00%x\x00%d", key, s.ID, i)
+}
+
+func (s *streamMeta) encode() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, streamMagic...))
+	// Writing into a bytes.Buffer never fails.
+	_ = binary.Write(buf, binary.BigEndian, s)
+	return buf.Bytes()
+}
+
+func decodeStreamMeta(data []byte) (*streamMeta, error) {
+	if !bytes.HasPrefix(data, streamMagic) {
+		return nil, ErrNotStream
+	}
+	s := &streamMeta{}
+	err := binary.Read(bytes.NewReader(data[len(streamMagic):]), binary.BigEndian, s)
+	if err != nil {
+		return nil, ErrNotStream
+	}
+	return s, nil
+}
+
+// deleteChunks deletes the first n chunks of the given stream. The errors are only logged, an orphan
+// chunk doesn't break the other streams.
+func (db *Olric) deleteChunks(name, key string, s *streamMeta, n uint64) {
+	for i := uint64(0); i < n; i++ {
+		chunkKey := s.chunkKey(key, i)
+		if err := db.deleteKey(name, chunkKey, nil); err != nil {
+			db.log.Printf("[ERROR] Failed to delete chunk: %d of stream: %s on DMap: %s: %v", i, key, name, err)
+		}
+	}
+}
+
+// streamChunkSize returns the size of the chunks for the given DMap. The chunks fit in MaxValueSize after
+// compression, incompressible data grows a little bit.
+func streamChunkSize(name string) int {
+	size := protocol.MaxValueSizeFor(name)
+	if protocol.Codec != nil {
+		size -= size / 64
+	}
+	return size
+}
+
+func (db *Olric) putReader(name, key string, r io.Reader) error {
+	s := &streamMeta{}
+	if err := binary.Read(rand.Reader, binary.BigEndian, &s.ID); err != nil {
+		return err
+	}
+	chunk := make([]byte, streamChunkSize(name))
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			perr := db.put(name, s.chunkKey(key, s.Chunks), chunk[:n], nilTimeout, nil)
+			if perr != nil {
+				db.deleteChunks(name, key, s, s.Chunks)
+				return perr
+			}
+			s.Chunks++
+			s.Size += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			db.deleteChunks(name, key, s, s.Chunks)
+			return err
+		}
+	}
+
+	// The chunks are in place, replace the metadata and delete the chunks of the old stream, if any.
+	oldval, err := db.getPut(name, key, s.encode())
+	if err != nil {
+		db.deleteChunks(name, key, s, s.Chunks)
+		return err
+	}
+	if old, err := decodeStreamMeta(oldval); err == nil {
+		db.deleteChunks(name, key, old, old.Chunks)
+	}
+	return nil
+}
+
+// PutReader stores the value read from r until io.EOF for the given key. The value may be bigger than
+// MaxValueSize, it's split into chunks which fit in MaxValueSize and are stored under the keys derived from
+// the given key. The chunks are deleted if a write fails in the middle of the stream, and the old
+// chunks are deleted after a new stream replaces them. The key must be read by GetReader. It's thread-safe.
+//
+// The chunks are regular keys of the DMap. They're counted by Len and returned by Scan, Query and Dump.
+// They get the DefaultTTL of the DMap and they're evicted like the other keys, independently of the
+// metadata under the given key. The readers return ErrStreamCorrupted if a chunk is lost.
+func (dm *DMap) PutReader(key string, r io.Reader) error {
+	return dm.db.putReader(dm.name, key, r)
+}
+
+// streamReader reads the chunks of a stream one by one.
+type streamReader struct {
+	db     *Olric
+	name   string
+	key    string
+	meta   *streamMeta
+	next   uint64
+	read   uint64
+	buf    []byte
+	closed bool
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for len(s.buf) == 0 {
+		if s.next == s.meta.Chunks {
+			if s.read != s.meta.Size {
+				return 0, ErrStreamCorrupted
+			}
+			return 0, io.EOF
+		}
+		value, err := s.db.get(s.name, s.meta.chunkKey(s.key, s.next))
+		if err == ErrKeyNotFound {
+			return 0, s.missingChunk()
+		}
+		if err != nil {
+			return 0, err
+		}
+		s.next++
+		s.read += uint64(len(value))
+		// The value may point to the memory of the storage, copy it.
+		s.buf = append(s.buf[:0], value...)
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// missingChunk returns the error for a chunk which is not found. The stream has been replaced or deleted
+// while reading it if its metadata is gone, otherwise the chunk has been lost.
+func (s *streamReader) missingChunk() error {
+	rawval, err := s.db.get(s.name, s.key)
+	if err == ErrKeyNotFound {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := decodeStreamMeta(rawval)
+	if err != nil || meta.ID != s.meta.ID {
+		return io.ErrUnexpectedEOF
+	}
+	return ErrStreamCorrupted
+}
+
+func (s *streamReader) Close() error {
+	s.closed = true
+	s.buf = nil
+	return nil
+}
+
+// GetReader returns a reader for the value which is stored by PutReader for the given key. The chunks are
+// fetched while reading, Read returns io.ErrUnexpectedEOF if the stream is replaced in the meantime and
+// ErrStreamCorrupted if a chunk is lost. It
+// returns ErrKeyNotFound if the DB does not contain the key and ErrNotStream if it's not stored by PutReader.
+// The returned reader is not thread-safe.
+func (dm *DMap) GetReader(key string) (io.ReadCloser, error) {
+	rawval, err := dm.db.get(dm.name, key)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := decodeStreamMeta(rawval)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		db:   dm.db,
+		name: dm.name,
+		key:  key,
+		meta: meta,
+	}, nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestDMap_PutReader(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"stream_test": {MaxValueSize: 1024},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	data := make([]byte, 10*1024+17)
+	rand.Read(data)
+	dm := db1.NewDMap("stream_test")
+	err = dm.PutReader("mykey", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	r, err := db2.NewDMap("stream_test").GetReader("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(value, data) {
+		t.Fatalf("Value is different")
+	}
+
+	// Replace the stream with a smaller one, the old chunks are deleted.
+	err = dm.PutReader("mykey", bytes.NewReader(data[:100]))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	length, err := dm.Len()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// The metadata and one chunk.
+	if length != 2 {
+		t.Fatalf("Expected length: 2. Got: %d", length)
+	}
+	r, err = dm.GetReader("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	value, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(value, data[:100]) {
+		t.Fatalf("Value is different")
+	}
+}
+
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("read failed")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestDMap_PutReaderCleanup(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"stream_test": {MaxValueSize: 1024},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	data := make([]byte, 10*1024)
+	rand.Read(data)
+	dm := db.NewDMap("stream_test")
+	r := &failingReader{r: bytes.NewReader(data), n: 5000}
+	err = dm.PutReader("mykey", r)
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	length, err := dm.Len()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if length != 0 {
+		t.Fatalf("Expected length: 0. Got: %d", length)
+	}
+	_, err = dm.GetReader("mykey")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+
+	err = dm.Put("regular", "value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = dm.GetReader("regular")
+	if err != ErrNotStream {
+		t.Fatalf("Expected ErrNotStream. Got: %v", err)
+	}
+}
+
+func TestDMap_GetReaderLostChunk(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"stream_test": {MaxValueSize: 1024},
+	}
+	db, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	data := make([]byte, 10*1024)
+	rand.Read(data)
+	dm := db.NewDMap("stream_test")
+	err = dm.PutReader("mykey", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The stream is replaced before the first chunk is read.
+	r, err := dm.GetReader("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = dm.PutReader("mykey", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF. Got: %v", err)
+	}
+
+	// A chunk is lost, i.e. evicted, while the metadata is still there.
+	rawval, err := db.get("stream_test", "mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	meta, err := decodeStreamMeta(rawval)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = dm.Delete(meta.chunkKey("mykey", 3))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	r, err = dm.GetReader("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != ErrStreamCorrupted {
+		t.Fatalf("Expected ErrStreamCorrupted. Got: %v", err)
+	}
+}
@@ -19,10 +19,12 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/buraksezer/olric/internal/protocol"
 	"github.com/buraksezer/olric/internal/snapshot"
 	"github.com/buraksezer/olric/internal/storage"
 	"github.com/dgraph-io/badger"
@@ -51,7 +53,7 @@ func getRandomAddr() (string, error) {
 	return l.Addr().String(), nil
 }
 
-func newTestOlric(peers []string, mc *memberlist.Config, snapshotDir string) (*Olric, error) {
+func newTestConfig(peers []string, mc *memberlist.Config) (*Config, error) {
 	addr, err := getRandomAddr()
 	if err != nil {
 		return nil, err
@@ -61,12 +63,19 @@ func newTestOlric(peers []string, mc *memberlist.Config, snapshotDir string) (*O
 	}
 	mc.Name = addr
 	mc.BindPort = 0
-	cfg := &Config{
+	return &Config{
 		PartitionCount:   7,
 		BackupCount:      1,
 		Name:             mc.Name,
 		Peers:            peers,
 		MemberlistConfig: mc,
+	}, nil
+}
+
+func newTestOlric(peers []string, mc *memberlist.Config, snapshotDir string) (*Olric, error) {
+	cfg, err := newTestConfig(peers, mc)
+	if err != nil {
+		return nil, err
 	}
 	if len(snapshotDir) != 0 {
 		opt := badger.DefaultOptions
@@ -75,6 +84,10 @@ func newTestOlric(peers []string, mc *memberlist.Config, snapshotDir string) (*O
 		cfg.BadgerOptions = &opt
 		cfg.OperationMode = OpInMemoryWithSnapshot
 	}
+	return startTestOlric(cfg)
+}
+
+func startTestOlric(cfg *Config) (*Olric, error) {
 	db, err := New(cfg)
 	if err != nil {
 		return nil, err
@@ -90,16 +103,23 @@ func newTestOlric(peers []string, mc *memberlist.Config, snapshotDir string) (*O
 			return nil, err
 		}
 	}
+	if db.wal != nil {
+		_, err = db.replayWAL()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	db.wg.Add(1)
 	go func() {
 		defer db.wg.Done()
-		err = db.server.ListenAndServe()
+		err = db.listenAndServe()
 		if err != nil {
 			db.log.Printf("[ERROR] Failed to run TCP server")
 		}
 	}()
 	<-db.server.StartCh
+	db.servePlaintext()
 
 	err = db.startDiscovery()
 	if err != nil {
@@ -125,6 +145,15 @@ func newOlricWithSnapshot(peers []string, snapshotDir string) (*Olric, error) {
 	return newTestOlric(peers, nil, snapshotDir)
 }
 
+func newOlricWithDMaps(peers []string, dmaps map[string]DMapConfig) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.DMaps = dmaps
+	return startTestOlric(cfg)
+}
+
 func TestDMap_Standalone(t *testing.T) {
 	db, err := newOlric(nil)
 	if err != nil {
@@ -294,6 +323,187 @@ func TestDMap_Put(t *testing.T) {
 	}
 }
 
+func TestDMap_PutMany(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	entries := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		entries[bkey(i)] = bval(i)
+	}
+	err = db1.NewDMap("mymap").PutMany(entries)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := db2.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		value, err := dm.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for %s", err, bkey(i))
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value retrieved for %s", bkey(i))
+		}
+	}
+
+	// Every key has a backup on the other node.
+	for i := 0; i < 100; i++ {
+		hkey := db1.getHKey("mymap", bkey(i))
+		owner := db1.getBackupPartitionOwners(hkey)[0]
+		db := db1
+		if hostCmp(owner, db2.this) {
+			db = db2
+		}
+		bdm, err := db.getBackupDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if _, err = bdm.str.Get(hkey); err != nil {
+			t.Fatalf("Expected nil. Got: %v for %s", err, bkey(i))
+		}
+	}
+}
+
+func TestDMap_PutDMapMaxValueSize(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	protocol.SetDMapMaxValueSize("small", 100)
+	defer protocol.SetDMapMaxValueSize("small", 0)
+
+	small := db2.NewDMap("small")
+	large := db2.NewDMap("large")
+	value := make([]byte, 200)
+	for i := 0; i < 100; i++ {
+		key := bkey(i)
+		err = large.Put(key, value)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+
+		// The limit is enforced when the owner or the backup owner receives the value.
+		err = small.Put(key, value)
+		if err == nil {
+			t.Fatalf("Expected an error for key: %s", key)
+		}
+	}
+}
+
+func TestDMap_PutIf(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1, dm2 := db1.NewDMap("mymap"), db2.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm1.PutIf(bkey(i), bval(i), IfFound)
+		if err != ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+		}
+	}
+
+	// Only one of the concurrent calls succeeds for every key.
+	var succeeded int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, dm := range []*DMap{dm1, dm2, dm1, dm2} {
+			wg.Add(1)
+			go func(dm *DMap, i int) {
+				defer wg.Done()
+				err := dm.PutIf(bkey(i), bval(i), IfNotFound)
+				if err == nil {
+					atomic.AddInt32(&succeeded, 1)
+					return
+				}
+				if err != ErrKeyFound {
+					t.Errorf("Expected ErrKeyFound. Got: %v", err)
+				}
+			}(dm, i)
+		}
+	}
+	wg.Wait()
+	if succeeded != 10 {
+		t.Fatalf("Expected 10 successful calls. Got: %d", succeeded)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = dm2.PutIf(bkey(i), bval(i+1), IfFound)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		value, err := dm1.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i+1)) {
+			t.Fatalf("Different value retrieved for %s", bkey(i))
+		}
+	}
+}
+
 func TestDMap_PutLookup(t *testing.T) {
 	db1, err := newOlric(nil)
 	if err != nil {
@@ -400,6 +610,106 @@ func TestDMap_Get(t *testing.T) {
 	}
 }
 
+func TestDMap_GetMany(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	var keys []string
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		keys = append(keys, bkey(i))
+	}
+	// Missing keys are omitted.
+	keys = append(keys, "missing-key")
+
+	entries, err := dm.GetMany(keys...)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("Expected 100 entries. Got: %d", len(entries))
+	}
+	for i := 0; i < 100; i++ {
+		value, ok := entries[bkey(i)]
+		if !ok {
+			t.Fatalf("Expected key %s in the result", bkey(i))
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value retrieved for %s", bkey(i))
+		}
+	}
+}
+
+func TestDMap_Len(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// Backups are not counted.
+	for _, d := range []*DMap{dm, db2.NewDMap("mymap")} {
+		length, err := d.Len()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if length != 100 {
+			t.Fatalf("Expected length 100. Got: %d", length)
+		}
+	}
+}
+
 func TestDMap_Delete(t *testing.T) {
 	db1, err := newOlric(nil)
 	if err != nil {
@@ -495,6 +805,72 @@ func TestDMap_GetLookup(t *testing.T) {
 	}
 }
 
+func TestDMap_DeleteMany(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	var keys []string
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		keys = append(keys, bkey(i))
+	}
+	// The absent keys are ignored.
+	err = dm.DeleteMany(append(keys, "absent-key")...)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm2 := db2.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		_, err = dm2.Get(bkey(i))
+		if err != ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound. Got: %v for %s", err, bkey(i))
+		}
+	}
+
+	// The backups are deleted too.
+	for i := 0; i < 100; i++ {
+		hkey := db1.getHKey("mymap", bkey(i))
+		owner := db1.getBackupPartitionOwners(hkey)[0]
+		db := db1
+		if hostCmp(owner, db2.this) {
+			db = db2
+		}
+		bdm, err := db.getBackupDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if _, err = bdm.str.Get(hkey); err != storage.ErrKeyNotFound {
+			t.Fatalf("Expected storage.ErrKeyNotFound. Got: %v for %s", err, bkey(i))
+		}
+	}
+}
+
 func TestDMap_DeleteLookup(t *testing.T) {
 	db1, err := newOlric(nil)
 	if err != nil {
@@ -658,6 +1034,77 @@ func TestDMap_Destroy(t *testing.T) {
 	}
 }
 
+func TestDMap_DestroyIdempotent(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	db1.updateRouting()
+
+	err = db1.NewDMap("absent").Destroy()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		err = dm.Destroy()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// The primary copies and the backups are cleared on all nodes.
+	for _, db := range []*Olric{db1, db2} {
+		for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+			for _, part := range []*partition{db.partitions[partID], db.backups[partID]} {
+				if _, ok := part.m.Load("mymap"); ok {
+					t.Fatalf("Expected the DMap to be destroyed on PartID(backup: %t): %d", part.backup, partID)
+				}
+				if count := atomic.LoadInt32(&part.count); count != 0 {
+					t.Fatalf("Expected DMap count is 0 on PartID(backup: %t): %d. Got: %d", part.backup, partID, count)
+				}
+			}
+		}
+	}
+}
+
+func TestDMap_DestroyError(t *testing.T) {
+	err := &DestroyError{Nodes: map[string]error{
+		"127.0.0.1:3320": ErrInternalServerError,
+		"127.0.0.1:3310": ErrOperationTimeout,
+	}}
+	expected := "failed to destroy DMap on 2 nodes: 127.0.0.1:3310: operation timeout, 127.0.0.1:3320: internal server error"
+	if err.Error() != expected {
+		t.Fatalf("Expected %q. Got: %q", expected, err.Error())
+	}
+}
+
 func TestDMap_CrashServer(t *testing.T) {
 	db1, err := newOlricWithCustomMemberlist(nil)
 	if err != nil {
@@ -757,9 +1204,9 @@ func TestDMap_PutEx(t *testing.T) {
 		}
 	}
 
+	time.Sleep(20 * time.Millisecond)
 	// Update currentUnixNano to evict the key now.
 	atomic.StoreInt64(&currentUnixNano, time.Now().UnixNano())
-	time.Sleep(20 * time.Millisecond)
 	for i := 0; i < 100; i++ {
 		_, err := dm.Get(bkey(i))
 		if err != ErrKeyNotFound {
@@ -768,6 +1215,66 @@ func TestDMap_PutEx(t *testing.T) {
 	}
 }
 
+func TestDMap_GetWithTTL(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			err = dm.PutEx(bkey(i), bval(i), time.Hour)
+		} else {
+			err = dm.Put(bkey(i), bval(i))
+		}
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		value, ttl, err := dm.GetWithTTL(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for %s", err, bkey(i))
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value retrieved for %s", bkey(i))
+		}
+		if i%2 == 0 {
+			if ttl <= 0 || ttl > time.Hour {
+				t.Fatalf("Expected a TTL between 0 and 1 hour. Got: %v", ttl)
+			}
+		} else if ttl != NoTTL {
+			t.Fatalf("Expected NoTTL. Got: %v", ttl)
+		}
+	}
+
+	_, _, err = dm.GetWithTTL("missing-key")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+}
+
 func TestDMap_TTLEviction(t *testing.T) {
 	db1, err := newOlric(nil)
 	if err != nil {
@@ -803,9 +1310,9 @@ func TestDMap_TTLEviction(t *testing.T) {
 	time.Sleep(20 * time.Millisecond)
 	// Update currentUnixNano to evict the key now.
 	atomic.StoreInt64(&currentUnixNano, time.Now().UnixNano())
-	for i := 0; i < 100; i++ {
-		db1.evictKeys()
-		db2.evictKeys()
+	for partID := uint64(0); partID < db1.config.PartitionCount; partID++ {
+		db1.evictKeys(partID)
+		db2.evictKeys(partID)
 	}
 	length := 0
 	for _, ins := range []*Olric{db1, db2} {
@@ -866,6 +1373,9 @@ func TestDMap_DeleteStaleDMaps(t *testing.T) {
 		}
 	}
 
+	// The DMaps are kept until their tombstones are reaped.
+	expireTombstones(db1)
+	expireTombstones(db2)
 	db1.deleteStaleDMaps()
 	db2.deleteStaleDMaps()
 
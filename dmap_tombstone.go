@@ -0,0 +1,122 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+// tombstone records a deleted key until its deadline. The copies of the key which are not newer than
+// the tombstone are stale, they're dropped instead of resurrecting the key. The fields are exported to
+// move the tombstones with the DMaps.
+type tombstone struct {
+	// Timestamp is the version of the delete, taken from the hybrid logical clock.
+	Timestamp int64
+
+	// Deadline is the time in nanoseconds when the tombstone is reaped.
+	Deadline int64
+}
+
+// addTombstone records the delete of hkey. The caller must hold the dmap lock.
+func (db *Olric) addTombstone(dm *dmap, hkey uint64) {
+	if db.config.TombstoneTTL < 0 {
+		return
+	}
+	if dm.tombstones == nil {
+		dm.tombstones = make(map[uint64]tombstone)
+	}
+	dm.tombstones[hkey] = tombstone{
+		Timestamp: db.clock.now(),
+		Deadline:  time.Now().Add(db.config.TombstoneTTL).UnixNano(),
+	}
+}
+
+// isDeleted returns true if hkey has been deleted after the given version of it. The caller must hold
+// the dmap lock.
+func (dm *dmap) isDeleted(hkey uint64, timestamp int64) bool {
+	t, ok := dm.tombstones[hkey]
+	if !ok {
+		return false
+	}
+	return t.Deadline > time.Now().UnixNano() && t.Timestamp >= timestamp
+}
+
+// isDeletedCopy returns true if the copy of hkey returned by a previous owner or a backup owner has been
+// deleted on this node. The delete may not be applied on the other owners yet.
+func (db *Olric) isDeletedCopy(dm *dmap, hkey uint64, resp *protocol.Message) bool {
+	extra, _ := resp.Extra.(protocol.GetExExtra)
+	dm.Lock()
+	defer dm.Unlock()
+	return dm.isDeleted(hkey, extra.Timestamp)
+}
+
+// mergeTombstones adds the tombstones of a moved DMap and deletes the stale keys. The caller must hold
+// the dmap lock.
+func (db *Olric) mergeTombstones(dm *dmap, tombstones map[uint64]tombstone) error {
+	now := time.Now().UnixNano()
+	for hkey, t := range tombstones {
+		if t.Deadline <= now {
+			continue
+		}
+		db.clock.update(t.Timestamp)
+		current, err := dm.str.Get(hkey)
+		if err == nil && current.Timestamp > t.Timestamp {
+			// The key has been set again after the delete.
+			continue
+		}
+		if err == nil {
+			if err = dm.str.Delete(hkey); err != nil {
+				return err
+			}
+			delete(dm.inserted, hkey)
+			dm.unindex(current.Key)
+			if dm.tracker != nil {
+				dm.tracker.remove(hkey)
+			}
+			if dm.idle != nil {
+				dm.idle.remove(hkey)
+			}
+		} else if err != storage.ErrKeyNotFound {
+			return err
+		}
+		if prev, ok := dm.tombstones[hkey]; ok && prev.Timestamp > t.Timestamp {
+			continue
+		}
+		if dm.tombstones == nil {
+			dm.tombstones = make(map[uint64]tombstone)
+		}
+		dm.tombstones[hkey] = t
+	}
+	return nil
+}
+
+// reapTombstones deletes the expired tombstones and returns the number of the remaining ones. The caller
+// must hold the dmap lock.
+func (dm *dmap) reapTombstones() int {
+	now := time.Now().UnixNano()
+	for hkey, t := range dm.tombstones {
+		if t.Deadline <= now {
+			delete(dm.tombstones, hkey)
+		}
+	}
+	if len(dm.tombstones) == 0 {
+		// Release the memory of the map.
+		dm.tombstones = nil
+	}
+	return len(dm.tombstones)
+}
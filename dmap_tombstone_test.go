@@ -0,0 +1,155 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// expireTombstones moves the deadlines of the tombstones on the node to the past.
+func expireTombstones(db *Olric) {
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		for _, part := range []*partition{db.partitions[partID], db.backups[partID]} {
+			part.m.Range(func(_, tmp interface{}) bool {
+				d := tmp.(*dmap)
+				d.Lock()
+				for hkey, t := range d.tombstones {
+					t.Deadline = 0
+					d.tombstones[hkey] = t
+				}
+				d.Unlock()
+				return true
+			})
+		}
+	}
+}
+
+func TestDMap_Tombstone(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// Delete the keys on the primary owners only, the backups keep the old values like a lost delete.
+	for i := 0; i < 10; i++ {
+		member, hkey, err := db1.locateKey("mymap", bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		owner := db1
+		if hostCmp(member, db2.this) {
+			owner = db2
+		}
+		d, err := owner.getDMap("mymap", hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		d.Lock()
+		err = owner.delKeyValOnOwners(d, hkey, "mymap", bkey(i), nil)
+		d.Unlock()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+
+		// The stale backup is moved to the primary owner during a rebalance.
+		bd, err := db1.getBackupDMap("mymap", hkey)
+		if hostCmp(member, db1.this) {
+			bd, err = db2.getBackupDMap("mymap", hkey)
+		}
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		bd.Lock()
+		payload, err := bd.str.Export()
+		bd.Unlock()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		part := owner.partitions[d.partID]
+		err = owner.mergeDMaps(part, &dmapbox{PartID: part.id, Name: "mymap", Payload: payload})
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// The backups still have the keys but the deletes win.
+	for _, db := range []*Olric{db1, db2} {
+		for i := 0; i < 10; i++ {
+			_, err = db.NewDMap("mymap").Get(bkey(i))
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected ErrKeyNotFound for %s. Got: %v", bkey(i), err)
+			}
+		}
+	}
+
+	// The keys can be set again after the delete.
+	err = dm.Put(bkey(1), bval(2))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	value, err := db2.NewDMap("mymap").Get(bkey(1))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(value.([]byte), bval(2)) {
+		t.Fatalf("Expected %s. Got: %v", bval(2), value)
+	}
+
+	// Reap the tombstones.
+	for _, db := range []*Olric{db1, db2} {
+		expireTombstones(db)
+		db.deleteStaleDMaps()
+		for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+			db.partitions[partID].m.Range(func(_, tmp interface{}) bool {
+				d := tmp.(*dmap)
+				d.Lock()
+				defer d.Unlock()
+				if len(d.tombstones) != 0 {
+					t.Fatalf("Expected the tombstones to be reaped on PartID: %d. Got: %d", partID, len(d.tombstones))
+				}
+				return true
+			})
+		}
+	}
+}
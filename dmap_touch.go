@@ -0,0 +1,87 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+// touchKeyVal records an access to the given key on this node, like a Get without returning the value.
+func (db *Olric) touchKeyVal(dm *dmap, hkey uint64, name, key string) error {
+	vdata, err := dm.str.Get(hkey)
+	if err == storage.ErrKeyNotFound {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if isKeyExpired(vdata.TTL) {
+		return ErrKeyNotFound
+	}
+	if dm.idle != nil {
+		if dm.idle.isIdle(hkey, time.Now().UnixNano()) {
+			// The sweeper will evict it.
+			return ErrKeyNotFound
+		}
+		db.touchIdle(dm, hkey, name, key)
+	}
+	if dm.tracker != nil {
+		dm.tracker.touch(hkey)
+	}
+	return nil
+}
+
+func (db *Olric) touch(name, key string) error {
+	member, hkey, err := db.locateKey(name, key)
+	if err != nil {
+		return err
+	}
+	if !hostCmp(member, db.this) {
+		req := &protocol.Message{
+			DMap: name,
+			Key:  key,
+		}
+		_, err = db.requestTo(member.String(), protocol.OpTouch, req)
+		return err
+	}
+
+	dm, err := db.getDMap(name, hkey)
+	if err != nil {
+		return err
+	}
+	return db.touchKeyVal(dm, hkey, name, key)
+}
+
+// Touch marks the given key as recently used without reading its value. It resets the idle time of
+// the key for MaxIdleDuration on the owner and the backups and counts as an access for the LRU and LFU
+// eviction policies, the TTL of the key doesn't change. It returns ErrKeyNotFound if the DB does not
+// contain the key. It's thread-safe.
+func (dm *DMap) Touch(key string) error {
+	return dm.db.touch(dm.name, key)
+}
+
+func (db *Olric) exTouchOperation(req *protocol.Message) *protocol.Message {
+	err := db.touch(req.DMap, req.Key)
+	if err == ErrKeyNotFound {
+		return req.Error(protocol.StatusKeyNotFound, "")
+	}
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	return req.Success()
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDMap_Touch(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"mymap": {MaxIdleDuration: 500 * time.Millisecond},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	err = dm.Touch("idle")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+	for _, key := range []string{"idle", "active"} {
+		err = dm.Put(key, key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		<-time.After(50 * time.Millisecond)
+		err = dm.Touch("active")
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v for the active key", err)
+		}
+	}
+	err = dm.Touch("idle")
+	if err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+	value, err := dm.Get("active")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if value.(string) != "active" {
+		t.Fatalf("Expected active. Got: %v", value)
+	}
+}
+
+func TestDMap_TouchKeepsTTL(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	err = dm.PutEx("mykey", "myvalue", time.Hour)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = dm.Touch("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	touched, err := dm.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if touched.TTL > time.Hour || touched.TTL < 59*time.Minute {
+		t.Fatalf("Expected the TTL to be unchanged. Got: %v", touched.TTL)
+	}
+}
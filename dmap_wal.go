@@ -0,0 +1,216 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"time"
+
+	"github.com/buraksezer/olric/internal/storage"
+	"github.com/buraksezer/olric/internal/wal"
+)
+
+// putEntry stores the given entry and records it on the operation log of the snapshot. The mutation is
+// written to the write-ahead log before it's applied, if it's enabled.
+func (db *Olric) putEntry(dm *dmap, name string, hkey uint64, vdata *storage.VData) error {
+	// Encrypt the value once, the write-ahead log keeps the encrypted value, too.
+	sealed, err := dm.str.Seal(hkey, vdata)
+	if err != nil {
+		return err
+	}
+	apply := func() error {
+		// The updates keep the generation of the insert.
+		created := dm.generation != 0 && !dm.str.Check(hkey)
+		err := dm.str.PutSealed(hkey, sealed)
+		if err != nil {
+			return err
+		}
+		if created {
+			dm.recordInsert(hkey)
+		}
+		// The key is set again after the delete.
+		delete(dm.tombstones, hkey)
+		db.indexValue(dm, name, hkey, vdata)
+		if db.config.OperationMode == OpInMemoryWithSnapshot {
+			dm.oplog.Put(hkey)
+		}
+		return nil
+	}
+	if db.wal == nil {
+		return apply()
+	}
+	rec := &wal.Record{
+		Op:     wal.OpPut,
+		Backup: dm.backup,
+		DMap:   name,
+		Key:    vdata.Key,
+		HKey:   hkey,
+		Value:  storage.EncodeRaw(sealed),
+	}
+	return db.wal.Apply(dm.partID, rec, apply)
+}
+
+// deleteEntry deletes the given entry and records it on the operation log of the snapshot. The mutation is
+// written to the write-ahead log before it's applied, if it's enabled.
+func (db *Olric) deleteEntry(dm *dmap, name string, hkey uint64, key string) error {
+	apply := func() error {
+		if db.config.OperationMode == OpInMemoryWithSnapshot {
+			dm.oplog.Delete(hkey)
+		}
+		err := dm.str.Delete(hkey)
+		if err != nil {
+			return err
+		}
+		delete(dm.inserted, hkey)
+		dm.unindex(key)
+		return nil
+	}
+	if db.wal == nil {
+		return apply()
+	}
+	rec := &wal.Record{
+		Op:     wal.OpDelete,
+		Backup: dm.backup,
+		DMap:   name,
+		Key:    key,
+		HKey:   hkey,
+	}
+	return db.wal.Apply(dm.partID, rec, apply)
+}
+
+type walKey struct {
+	name string
+	hkey uint64
+}
+
+// replayWAL applies the mutations in the write-ahead log which may not be in the snapshot. It returns
+// the last records of the keys on the primary partitions.
+func (db *Olric) replayWAL() ([]*wal.Record, error) {
+	now := time.Now()
+	var count int
+	last := make(map[walKey]*wal.Record)
+	err := db.wal.Replay(func(partID uint64, rec *wal.Record) error {
+		part := db.partitions[partID]
+		if rec.Backup {
+			part = db.backups[partID]
+		}
+		if part == nil {
+			db.log.Printf("[ERROR] Invalid PartID: %d in write-ahead log", partID)
+			return nil
+		}
+		dm, err := db.createDMap(part, rec.DMap)
+		if err != nil {
+			return err
+		}
+		dm.Lock()
+		defer dm.Unlock()
+
+		switch rec.Op {
+		case wal.OpPut:
+			vdata := storage.DecodeRaw(rec.Value)
+			if isKeyExpired(vdata.TTL) {
+				// The key has expired while the node was down.
+				dm.oplog.Delete(rec.HKey)
+				err = dm.str.Delete(rec.HKey)
+				break
+			}
+			// The value in the log has already been encrypted.
+			err = dm.str.PutSealed(rec.HKey, vdata)
+			if err == nil {
+				dm.oplog.Put(rec.HKey)
+				db.indexStored(dm, rec.DMap, rec.HKey)
+			}
+		case wal.OpDelete:
+			dm.oplog.Delete(rec.HKey)
+			err = dm.str.Delete(rec.HKey)
+			if err == nil {
+				dm.unindex(rec.Key)
+			}
+		}
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to replay hkey: %d on DMap: %s: %v", rec.HKey, rec.DMap, err)
+			return nil
+		}
+		count++
+		if !rec.Backup {
+			last[walKey{name: rec.DMap, hkey: rec.HKey}] = rec
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.log.Printf("[INFO] Replayed %d records from the write-ahead log in %v", count, time.Since(now))
+
+	records := make([]*wal.Record, 0, len(last))
+	for _, rec := range last {
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// reconcileBackups sends the current state of the keys which have been recovered from the write-ahead
+// log to the backups. The backups may have missed the mutations before the crash.
+func (db *Olric) reconcileBackups(records []*wal.Record) {
+	defer db.wg.Done()
+	if db.config.BackupCount == 0 {
+		return
+	}
+	select {
+	case <-db.ctx.Done():
+		return
+	case <-db.bcx.Done():
+		if db.bcx.Err() == context.DeadlineExceeded {
+			db.log.Printf("[ERROR] Failed to reconcile backups: bootstrap timeout")
+			return
+		}
+	}
+
+	for _, rec := range records {
+		select {
+		case <-db.ctx.Done():
+			return
+		default:
+		}
+		owners := db.getPartitionOwners(rec.HKey)
+		if len(owners) == 0 || !hostCmp(owners[len(owners)-1], db.this) {
+			// The key has been moved to another node.
+			continue
+		}
+		dm, err := db.getDMap(rec.DMap, rec.HKey)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to reconcile backups of DMap: %s: %v", rec.DMap, err)
+			continue
+		}
+		dm.Lock()
+		vdata, err := dm.str.Get(rec.HKey)
+		if err == nil {
+			// The value points to the storage, copy it before releasing the lock.
+			vdata.Value = append([]byte(nil), vdata.Value...)
+		}
+		dm.Unlock()
+
+		switch {
+		case err == storage.ErrKeyNotFound:
+			err = db.deleteKeyValBackup(rec.HKey, rec.DMap, rec.Key, nil)
+		case err != nil:
+		case !isKeyExpired(vdata.TTL):
+			err = db.putKeyValBackup(rec.HKey, rec.DMap, vdata, nil)
+		}
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to reconcile backups of hkey: %d on DMap: %s: %v", rec.HKey, rec.DMap, err)
+		}
+	}
+}
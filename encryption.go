@@ -0,0 +1,128 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnknownKeyVersion is returned when a value has been encrypted with a key which is not in
+// Config.EncryptionKeys.
+var ErrUnknownKeyVersion = errors.New("unknown encryption key version")
+
+var errInvalidCiphertext = errors.New("invalid ciphertext")
+
+// valueCipher encrypts the values in the partitions with AES-GCM. An encrypted value is stored as:
+//
+// KEY-VERSION(uint8) | NONCE(bytes) | CIPHERTEXT(bytes)
+//
+// The DMap name, the partition ID and the hkey of the entry are authenticated as additional data, so
+// a value cannot be swapped with the value of another key, even if it's in another DMap or partition.
+type valueCipher struct {
+	version uint8
+	aeads   map[uint8]cipher.AEAD
+}
+
+func newValueCipher(keys map[uint8][]byte, version uint8) (*valueCipher, error) {
+	if _, ok := keys[version]; !ok {
+		return nil, fmt.Errorf("no encryption key found for version: %d", version)
+	}
+	v := &valueCipher{
+		version: version,
+		aeads:   make(map[uint8]cipher.AEAD, len(keys)),
+	}
+	for ver, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key for version: %d: %v", ver, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		v.aeads[ver] = aead
+	}
+	return v, nil
+}
+
+// forDMap returns the cipher of a DMap fragment on the given partition.
+func (v *valueCipher) forDMap(name string, partID uint64) *dmapCipher {
+	return &dmapCipher{
+		valueCipher: v,
+		name:        name,
+		partID:      partID,
+	}
+}
+
+// Seal encrypts the value with the key of the current version.
+func (v *valueCipher) Seal(additionalData, plaintext []byte) ([]byte, error) {
+	aead := v.aeads[v.version]
+	size := aead.NonceSize()
+	out := make([]byte, 1+size, 1+size+len(plaintext)+aead.Overhead())
+	out[0] = v.version
+	if _, err := io.ReadFull(rand.Reader, out[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out[1:], plaintext, additionalData), nil
+}
+
+// Open decrypts the value with the key of the version it has been encrypted with.
+func (v *valueCipher) Open(additionalData, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 {
+		return nil, errInvalidCiphertext
+	}
+	aead, ok := v.aeads[ciphertext[0]]
+	if !ok {
+		return nil, ErrUnknownKeyVersion
+	}
+	size := aead.NonceSize()
+	if len(ciphertext) < 1+size+aead.Overhead() {
+		return nil, errInvalidCiphertext
+	}
+	return aead.Open(nil, ciphertext[1:1+size], ciphertext[1+size:], additionalData)
+}
+
+// dmapCipher implements storage.Cipher for a DMap fragment. The additional data of an entry is:
+//
+// PARTITION-ID(uint64) | HKEY(uint64) | DMAP-NAME(bytes)
+type dmapCipher struct {
+	*valueCipher
+	name   string
+	partID uint64
+}
+
+func (d *dmapCipher) additionalData(hkey uint64) []byte {
+	data := make([]byte, 16+len(d.name))
+	binary.BigEndian.PutUint64(data, d.partID)
+	binary.BigEndian.PutUint64(data[8:], hkey)
+	copy(data[16:], d.name)
+	return data
+}
+
+// Seal encrypts the value of the given hkey.
+func (d *dmapCipher) Seal(hkey uint64, plaintext []byte) ([]byte, error) {
+	return d.valueCipher.Seal(d.additionalData(hkey), plaintext)
+}
+
+// Open decrypts the value of the given hkey.
+func (d *dmapCipher) Open(hkey uint64, ciphertext []byte) ([]byte, error) {
+	return d.valueCipher.Open(d.additionalData(hkey), ciphertext)
+}
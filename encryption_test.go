@@ -0,0 +1,247 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+var testEncryptionKeys = map[uint8][]byte{
+	1: []byte("0123456789abcdef0123456789abcdef"),
+	2: []byte("fedcba9876543210fedcba9876543210"),
+}
+
+func newOlricWithEncryption(peers []string) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.EncryptionKeys = testEncryptionKeys
+	cfg.EncryptionKeyVersion = 2
+	return startTestOlric(cfg)
+}
+
+func TestValueCipher(t *testing.T) {
+	old, err := newValueCipher(map[uint8][]byte{1: testEncryptionKeys[1]}, 1)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	ciphertext, err := old.forDMap("mymap", 1).Seal(1, []byte("value"))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("value")) {
+		t.Fatalf("Ciphertext contains the plaintext")
+	}
+
+	// Rotate the keys, the values of the older key are still readable.
+	vc, err := newValueCipher(testEncryptionKeys, 2)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	dc := vc.forDMap("mymap", 1)
+	plaintext, err := dc.Open(1, ciphertext)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(plaintext, []byte("value")) {
+		t.Fatalf("Expected value. Got: %s", plaintext)
+	}
+	ciphertext, err = dc.Seal(1, []byte("value"))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if ciphertext[0] != 2 {
+		t.Fatalf("Expected key version: 2. Got: %d", ciphertext[0])
+	}
+	_, err = old.forDMap("mymap", 1).Open(1, ciphertext)
+	if err != ErrUnknownKeyVersion {
+		t.Fatalf("Expected ErrUnknownKeyVersion. Got: %v", err)
+	}
+	// The value is bound to its hkey, DMap and partition.
+	for _, other := range []*dmapCipher{vc.forDMap("mymap", 2), vc.forDMap("othermap", 1)} {
+		_, err = other.Open(1, ciphertext)
+		if err == nil {
+			t.Fatalf("Expected an error for DMap: %s on PartID: %d. Got: nil", other.name, other.partID)
+		}
+	}
+	_, err = dc.Open(2, ciphertext)
+	if err == nil {
+		t.Fatalf("Expected an error. Got: nil")
+	}
+
+	_, err = newValueCipher(testEncryptionKeys, 3)
+	if err == nil {
+		t.Fatalf("Expected an error for a missing key version. Got: nil")
+	}
+	_, err = newValueCipher(map[uint8][]byte{1: []byte("short")}, 1)
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid key. Got: nil")
+	}
+}
+
+func TestStorage_RangeDecryptionError(t *testing.T) {
+	vc, err := newValueCipher(testEncryptionKeys, 2)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	str, err := storage.New(0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer str.Close()
+	str.SetCipher(vc.forDMap("mymap", 1))
+	err = str.Put(1, &storage.VData{Key: bkey(1), Value: bval(1)})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The values of another DMap cannot be decrypted, Range reports it instead of skipping them.
+	str.SetCipher(vc.forDMap("othermap", 1))
+	err = str.Range(func(hkey uint64, vdata *storage.VData) bool {
+		t.Fatalf("Unexpected entry: %s", vdata.Key)
+		return true
+	})
+	if err == nil {
+		t.Fatalf("Expected an error. Got: nil")
+	}
+}
+
+func TestDMap_Encryption(t *testing.T) {
+	db1, err := newOlricWithEncryption(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithEncryption(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	// The backups are assigned only if the routing table is updated after the second node has joined.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(db1.consistent.GetMembers()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the second node to join the cluster")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	db1.updateRouting()
+
+	value := []byte("plaintext-value")
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err = dm.Put(bkey(i), value)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for _, db := range []*Olric{db1, db2} {
+		for i := 0; i < 10; i++ {
+			res, err := db.NewDMap("mymap").Get(bkey(i))
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			if !bytes.Equal(res.([]byte), value) {
+				t.Fatalf("Expected %s. Got: %v", value, res)
+			}
+		}
+	}
+
+	// Neither the owners nor the backups keep the plaintext.
+	var count int
+	for _, db := range []*Olric{db1, db2} {
+		for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+			for _, part := range []*partition{db.partitions[partID], db.backups[partID]} {
+				part.m.Range(func(_, tmp interface{}) bool {
+					d := tmp.(*dmap)
+					d.Lock()
+					defer d.Unlock()
+					for i := 0; i < 10; i++ {
+						raw, err := d.str.GetRaw(db.getHKey("mymap", bkey(i)))
+						if err == storage.ErrKeyNotFound {
+							continue
+						}
+						if err != nil {
+							t.Fatalf("Expected nil. Got: %v", err)
+						}
+						count++
+						if bytes.Contains(raw, value) {
+							t.Fatalf("Storage contains the plaintext of %s", bkey(i))
+						}
+					}
+					return true
+				})
+			}
+		}
+	}
+	if count != 20 {
+		t.Fatalf("Expected 20 replicas in the storage. Got: %d", count)
+	}
+}
+
+func benchmarkStoragePut(b *testing.B, c storage.Cipher) {
+	str, err := storage.New(0)
+	if err != nil {
+		b.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer str.Close()
+	if c != nil {
+		str.SetCipher(c)
+	}
+	value := make([]byte, 1024)
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hkey := uint64(i % 1024)
+		err = str.Put(hkey, &storage.VData{Key: bkey(i % 1024), Value: value})
+		if err != nil {
+			b.Fatalf("Expected nil. Got: %v", err)
+		}
+		_, err = str.Get(hkey)
+		if err != nil {
+			b.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+}
+
+func BenchmarkStorage_Plaintext(b *testing.B) {
+	benchmarkStoragePut(b, nil)
+}
+
+func BenchmarkStorage_Encrypted(b *testing.B) {
+	vc, err := newValueCipher(testEncryptionKeys, 2)
+	if err != nil {
+		b.Fatalf("Expected nil. Got: %v", err)
+	}
+	benchmarkStoragePut(b, vc.forDMap("mymap", 1))
+}
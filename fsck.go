@@ -15,6 +15,9 @@
 package olric
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 
@@ -24,21 +27,24 @@ import (
 	"github.com/vmihailenco/msgpack"
 )
 
+// errLockFound means that a DMap has locked keys. It's not moved until the locks are released.
+var errLockFound = errors.New("lock found")
+
 type dmapbox struct {
-	PartID  uint64
-	Name    string
-	Payload []byte
+	PartID     uint64
+	Name       string
+	Payload    []byte
+	Tombstones map[uint64]tombstone
 }
 
 func (db *Olric) moveBackupDMaps(part *partition, backups []host, wg *sync.WaitGroup) {
 	defer wg.Done() // local wg for this fsck call
 
-	// TODO: We may need to implement worker to limit concurrency. If the dmap count is too big, the following
-	// code may cause CPU/network IO starvation.
+	// The moves are limited by Config.RebalanceRate and Config.RebalanceConcurrency.
 	for _, backup := range backups {
 		part.m.Range(func(name, dm interface{}) bool {
 			wg.Add(1)
-			go db.moveDMap(part, name.(string), dm.(*dmap), backup, wg)
+			go db.moveDMapAtBackground(part, name.(string), dm.(*dmap), backup, wg)
 			return true
 		})
 	}
@@ -46,41 +52,65 @@ func (db *Olric) moveBackupDMaps(part *partition, backups []host, wg *sync.WaitG
 
 func (db *Olric) moveDMaps(part *partition, owner host, wg *sync.WaitGroup) {
 	defer wg.Done() // local wg for this fsck call
-	// TODO: We may need to implement worker to limit concurrency. If the dmap count is too large, the following
-	// code may cause CPU/network IO starvation.
+	// The moves are limited by Config.RebalanceRate and Config.RebalanceConcurrency.
 	part.m.Range(func(name, dm interface{}) bool {
 		wg.Add(1)
-		go db.moveDMap(part, name.(string), dm.(*dmap), owner, wg)
+		go db.moveDMapAtBackground(part, name.(string), dm.(*dmap), owner, wg)
 		return true
 	})
 }
 
-func (db *Olric) moveDMap(part *partition, name string, dm *dmap, owner host, wg *sync.WaitGroup) {
+func (db *Olric) moveDMapAtBackground(part *partition, name string, dm *dmap, owner host, wg *sync.WaitGroup) {
 	defer wg.Done()
+	err := db.moveDMap(db.ctx, part, name, dm, owner)
+	if err == errLockFound {
+		db.log.Printf("[DEBUG] Lock found on %s. moveDMap has been cancelled", name)
+		return
+	}
+	if err != nil {
+		db.log.Printf("[ERROR] Failed to move dmap. partID: %d, name: %s, error: %v", part.id, name, err)
+	}
+}
+
+// moveDMap sends the dmap to its new owner and deletes it on this node. It waits for the rebalancer
+// until the context is done.
+func (db *Olric) moveDMap(ctx context.Context, part *partition, name string, dm *dmap, owner host) error {
+	// The payload is exported under the lock, Inuse is a good estimation of its size.
+	release, err := db.rebalancer.acquire(ctx, dm.str.Inuse())
+	if err != nil {
+		return err
+	}
+	var moved int
+	defer func() {
+		release(moved)
+	}()
+
 	dm.Lock()
 	defer dm.Unlock()
 
+	if !part.hasDMap(name, dm) {
+		// It has already been moved or deleted by a concurrent call.
+		return nil
+	}
 	if !part.backup {
 		if dm.locker.length() != 0 {
-			db.log.Printf("[DEBUG] Lock found on %s. moveDMap has been cancelled", name)
-			return
+			return errLockFound
 		}
 	}
 
 	payload, err := dm.str.Export()
 	if err != nil {
-		db.log.Printf("[ERROR] Failed to call Export on dmap. partID: %d, name: %s, error: %v", part.id, name, err)
-		return
+		return fmt.Errorf("failed to call Export on dmap: %v", err)
 	}
 	data := &dmapbox{
-		PartID:  part.id,
-		Name:    name,
-		Payload: payload,
+		PartID:     part.id,
+		Name:       name,
+		Payload:    payload,
+		Tombstones: dm.tombstones,
 	}
 	value, err := msgpack.Marshal(data)
 	if err != nil {
-		db.log.Printf("[ERROR] Failed to encode dmap. partID: %d, name: %s, error: %v", data.PartID, data.Name, err)
-		return
+		return fmt.Errorf("failed to encode dmap: %v", err)
 	}
 	var opcode protocol.OpCode
 	if !part.backup {
@@ -93,13 +123,16 @@ func (db *Olric) moveDMap(part *partition, name string, dm *dmap, owner host, wg
 	}
 	_, err = db.requestTo(owner.String(), opcode, req)
 	if err != nil {
-		db.log.Printf("[ERROR] Failed to move dmap. partID: %d, name: %s, error: %v", data.PartID, data.Name, err)
-		return
+		return err
 	}
+	moved = len(value)
 
 	// Delete moved dmap object. the gc will free the allocated memory.
 	part.m.Delete(name)
-	atomic.AddInt32(&part.count, -1)
+	if atomic.AddInt32(&part.count, -1) == 0 && !part.backup {
+		// The last DMap of the partition has been moved to its new owner.
+		db.moves.push(partitionMovedEvent{partID: part.id, from: newMember(db.this), to: newMember(owner)})
+	}
 	err = dm.str.Close()
 	if err != nil {
 		db.log.Printf("[ERROR] Failed to close storage instance. partID: %d, name: %s, error: %v", data.PartID, data.Name, err)
@@ -117,6 +150,7 @@ func (db *Olric) moveDMap(part *partition, name string, dm *dmap, owner host, wg
 			)
 		}
 	}
+	return nil
 }
 
 func (db *Olric) mergeDMaps(part *partition, data *dmapbox) error {
@@ -125,31 +159,49 @@ func (db *Olric) mergeDMaps(part *partition, data *dmapbox) error {
 		return err
 	}
 
+	// Protect it against a concurrent createDMap call.
+	part.Lock()
 	tmp, ok := part.m.Load(data.Name)
 	if !ok {
-		dm := &dmap{str: str}
-		if !part.backup {
-			// Create this on the owners, not backups.
-			dm.locker = newLocker()
-		}
+		dm := db.newDMap(part, data.Name, str)
+		dm.tombstones = data.Tombstones
 		part.m.Store(data.Name, dm)
+		atomic.AddInt32(&part.count, 1)
+		part.Unlock()
 		return nil
 	}
+	part.Unlock()
 
 	dm := tmp.(*dmap)
 	dm.Lock()
 	defer dm.Unlock()
 
+	// The deletes win over the older versions of the keys on both sides.
+	if err := db.mergeTombstones(dm, data.Tombstones); err != nil {
+		return err
+	}
 	var merr error
-	str.Range(func(hkey uint64, vdata *storage.VData) bool {
-		if !dm.str.Check(hkey) {
-			merr = dm.str.Put(hkey, vdata)
-			if merr != nil {
-				return false
-			}
+	err = str.Range(func(hkey uint64, vdata *storage.VData) bool {
+		// Keep the newer version if both of them have the key.
+		current, err := dm.str.Get(hkey)
+		if err == nil && current.Timestamp >= vdata.Timestamp {
+			return true
 		}
-		return true
+		if dm.isDeleted(hkey, vdata.Timestamp) {
+			return true
+		}
+		db.clock.update(vdata.Timestamp)
+		// The imported storage has no cipher, the values are still encrypted.
+		merr = dm.str.PutSealed(hkey, vdata)
+		if merr == nil {
+			delete(dm.tombstones, hkey)
+			db.indexStored(dm, data.Name, hkey)
+		}
+		return merr == nil
 	})
+	if err != nil {
+		return err
+	}
 	return merr
 }
 
@@ -208,20 +260,21 @@ func (db *Olric) moveBackupDMapOperation(req *protocol.Message) *protocol.Messag
 	err := msgpack.Unmarshal(req.Value, dbox)
 	if err != nil {
 		db.log.Printf("[ERROR] Failed to unmarshal dmap for backup: %v", err)
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	part := db.backups[dbox.PartID]
 	part.RLock()
 	if len(part.owners) == 0 {
+		// The node is not bootstrapped yet, like moveDMapOperation.
 		part.RUnlock()
-		panic("partition owners list cannot be empty")
+		return req.Error(protocol.StatusNotOwner, "partition owners list cannot be empty")
 	}
 	part.RUnlock()
 	// TODO: Check partition owner here!
 	err = db.mergeDMaps(part, dbox)
 	if err != nil {
 		db.log.Printf("[ERROR] Failed to merge dmap for backup: %v", err)
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
@@ -231,21 +284,22 @@ func (db *Olric) moveDMapOperation(req *protocol.Message) *protocol.Message {
 	err := msgpack.Unmarshal(req.Value, dbox)
 	if err != nil {
 		db.log.Printf("[ERROR] Failed to unmarshal dmap for backup: %v", err)
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 
 	part := db.partitions[dbox.PartID]
 	part.RLock()
 	if len(part.owners) == 0 {
+		// The node is not bootstrapped yet, i.e. a leaving node hands off its partitions.
 		part.RUnlock()
-		panic("partition owners list cannot be empty")
+		return req.Error(protocol.StatusNotOwner, "partition owners list cannot be empty")
 	}
 	part.RUnlock()
 	// TODO: Check partition owner here!
 	err = db.mergeDMaps(part, dbox)
 	if err != nil {
 		db.log.Printf("[ERROR] Failed to merge dmap: %v", err)
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
 	return req.Success()
 }
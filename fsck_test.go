@@ -148,12 +148,13 @@ func TestFSCK_MergeWithLock(t *testing.T) {
 	}()
 
 	dm := db1.NewDMap("mymap")
+	locks := make(map[string]*DMapLock)
 	for i := 0; i < 100; i++ {
 		err = dm.Put(bkey(i), bval(i))
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v", err)
 		}
-		err = dm.LockWithTimeout(bkey(i), time.Minute)
+		locks[bkey(i)], err = dm.LockWithTimeout(bkey(i), time.Minute)
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v", err)
 		}
@@ -182,7 +183,7 @@ func TestFSCK_MergeWithLock(t *testing.T) {
 
 	dm2 := db2.NewDMap("mymap")
 	for i := 0; i < 100; i++ {
-		err = dm2.Unlock(bkey(i))
+		err = dm2.Unlock(bkey(i), locks[bkey(i)].Token())
 		if err != nil {
 			t.Fatalf("Expected nil. Got: %v", err)
 		}
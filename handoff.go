@@ -0,0 +1,130 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/consistent"
+)
+
+// HandoffError is returned by Shutdown if some of the DMaps could not be moved to their new owners
+// before leaving the cluster. Their backups on the other nodes, if any, are still available.
+type HandoffError struct {
+	// DMaps maps the partition IDs to the names of the DMaps which have not been moved.
+	DMaps map[uint64][]string
+}
+
+func (e *HandoffError) Error() string {
+	var count int
+	for _, names := range e.DMaps {
+		count += len(names)
+	}
+	return fmt.Sprintf("failed to hand off %d DMaps on %d partitions", count, len(e.DMaps))
+}
+
+// successors returns the primary owners of the partitions after this node leaves the cluster,
+// the coordinator assigns the partitions in the same way. It returns nil if this is the only node or
+// the other nodes are read-only replicas.
+func (db *Olric) successors() map[uint64]host {
+	var members []consistent.Member
+	for _, member := range db.consistent.GetMembers() {
+		if !hostCmp(member.(host), db.this) {
+			members = append(members, member)
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	ring := consistent.New(members, consistentConfig(db.config))
+	owners := make(map[uint64]host)
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		owner, err := partitionOwner(ring, partID)
+		if err != nil {
+			return nil
+		}
+		owners[partID] = owner
+	}
+	return owners
+}
+
+// handoff moves the primary copies on this node to the owners after it leaves the cluster. It stops
+// when the context is done and returns a *HandoffError for the DMaps which have not been moved.
+func (db *Olric) handoff(ctx context.Context) error {
+	owners := db.successors()
+	if owners == nil {
+		return nil
+	}
+
+	var mu sync.Mutex
+	failed := make(map[uint64][]string)
+	var wg sync.WaitGroup
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		if atomic.LoadInt32(&part.count) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(part *partition, owner host) {
+			defer wg.Done()
+			part.m.Range(func(name, dm interface{}) bool {
+				err := ctx.Err()
+				if err == nil {
+					err = db.moveDMap(ctx, part, name.(string), dm.(*dmap), owner)
+				}
+				if err != nil {
+					db.log.Printf("[ERROR] Failed to hand off DMap: %s on PartID: %d to %s: %v",
+						name, part.id, owner, err)
+					mu.Lock()
+					failed[part.id] = append(failed[part.id], name.(string))
+					mu.Unlock()
+				}
+				return true
+			})
+		}(part, owners[partID])
+	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		return &HandoffError{DMaps: failed}
+	}
+	return nil
+}
+
+// leave hands off the partitions and leaves the cluster. If the context is done, this node shuts
+// down without notifying the cluster and the other nodes detect its failure.
+func (db *Olric) leave(ctx context.Context) error {
+	now := time.Now()
+	err := db.handoff(ctx)
+	if err == nil {
+		db.log.Printf("[INFO] The partitions have been handed off in %v", time.Since(now))
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if lerr := db.discovery.memberlist.Leave(timeout); lerr != nil {
+		db.log.Printf("[ERROR] Failed to leave the cluster: %v", lerr)
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+func newOlricWithoutBackups(peers []string) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.BackupCount = 0
+	return startTestOlric(cfg)
+}
+
+func TestOlric_ShutdownHandoff(t *testing.T) {
+	db1, err := newOlricWithoutBackups(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithoutBackups(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	if db2.Stats().DMaps["mymap"].Length == 0 {
+		t.Fatalf("Expected some keys on the second node")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = db2.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The second node has left gracefully, the first one doesn't wait for the failure detection.
+	deadline := time.Now().Add(time.Second)
+	for db1.discovery.numMembers() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the second node to leave the cluster")
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	db1.updateRouting()
+	for i := 0; i < 100; i++ {
+		value, err := dm.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", bkey(i), err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value for %s", bkey(i))
+		}
+	}
+}
+
+func TestOlric_ShutdownHandoffTimeout(t *testing.T) {
+	db1, err := newOlricWithoutBackups(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithoutBackups(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	expected := make(map[uint64]bool)
+	for partID, part := range db2.partitions {
+		if atomic.LoadInt32(&part.count) != 0 {
+			expected[partID] = true
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db2.Shutdown(ctx)
+	merr, ok := err.(*multierror.Error)
+	if !ok {
+		t.Fatalf("Expected *multierror.Error. Got: %v", err)
+	}
+	var herr *HandoffError
+	for _, e := range merr.Errors {
+		if tmp, ok := e.(*HandoffError); ok {
+			herr = tmp
+		}
+	}
+	if herr == nil {
+		t.Fatalf("Expected a *HandoffError. Got: %v", err)
+	}
+	if len(herr.DMaps) != len(expected) {
+		t.Fatalf("Expected %d partitions. Got: %d", len(expected), len(herr.DMaps))
+	}
+	for partID, names := range herr.DMaps {
+		if !expected[partID] || len(names) != 1 || names[0] != "mymap" {
+			t.Fatalf("Unexpected DMaps on PartID: %d: %v", partID, names)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Ready returns nil if this node serves the requests correctly: it has loaded its data, joined the cluster,
+// received the routing table and moved the DMaps it doesn't own anymore. Otherwise, it returns an error
+// which wraps ErrNotReady with the reason.
+func (db *Olric) Ready() error {
+	if db.ctx.Err() != nil {
+		return errors.WithMessage(ErrNotReady, "shutting down")
+	}
+	if atomic.LoadInt32(&db.started) == 0 {
+		return errors.WithMessage(ErrNotReady, "starting")
+	}
+	if err := db.bcx.Err(); err != context.Canceled {
+		if err == context.DeadlineExceeded {
+			return errors.WithMessage(ErrNotReady, "bootstrap timed out")
+		}
+		return errors.WithMessage(ErrNotReady, "waiting for the routing table")
+	}
+	if rs := db.rebalancer.stats(); rs.Pending+rs.Active != 0 {
+		return errors.WithMessage(ErrNotReady, fmt.Sprintf("rebalancing %d DMaps", rs.Pending+rs.Active))
+	}
+	return nil
+}
+
+// serveHealthz is the liveness probe, it responds as long as the process is up.
+func (db *Olric) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz is the readiness probe, it responds with 503 Service Unavailable if the node is not ready.
+func (db *Olric) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err := db.Ready(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintln(w, err)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+func (db *Olric) registerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", db.serveHealthz)
+	mux.HandleFunc("/readyz", db.serveReadyz)
+}
+
+// sharesMetricsServer reports whether the health checks are served by the metrics server.
+func (db *Olric) sharesMetricsServer() bool {
+	return db.config.EnableMetrics && db.config.HealthAddr == db.config.MetricsAddr
+}
+
+// startHealthServer starts the HTTP server which exposes the health checks on /healthz and /readyz.
+// It's started before loading the data, so the liveness probe succeeds while the node is starting.
+func (db *Olric) startHealthServer() error {
+	if db.config.HealthAddr == "" || db.sharesMetricsServer() {
+		return nil
+	}
+	l, err := net.Listen("tcp", db.config.HealthAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	db.registerHealthHandlers(mux)
+	db.healthServer = &http.Server{Handler: mux}
+
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		err := db.healthServer.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			db.log.Printf("[ERROR] Failed to serve health checks: %v", err)
+		}
+	}()
+	db.log.Printf("[INFO] Health checks are exposed on http://%s/healthz and /readyz", l.Addr())
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestOlric_HealthChecks(t *testing.T) {
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.HealthAddr, err = getRandomAddr()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	db, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if err = db.Ready(); errors.Cause(err) != ErrNotReady {
+		t.Fatalf("Expected ErrNotReady. Got: %v", err)
+	}
+	go func() {
+		if err := db.Start(); err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + cfg.HealthAddr + path)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if code, _ := get("/readyz"); code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the node to be ready")
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("Expected 200 from /healthz. Got: %d", code)
+	}
+
+	// A node which is moving DMaps is not ready, but it's still alive.
+	atomic.AddInt64(&db.rebalancer.active, 1)
+	code, body := get("/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "rebalancing") {
+		t.Fatalf("Expected 503 while rebalancing. Got: %d %s", code, body)
+	}
+	if code, _ = get("/healthz"); code != http.StatusOK {
+		t.Fatalf("Expected 200 from /healthz. Got: %d", code)
+	}
+	atomic.AddInt64(&db.rebalancer.active, -1)
+	if err = db.Ready(); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync"
+	"time"
+)
+
+// hlc is a hybrid logical clock. It returns the wall clock time in nanoseconds, unless the wall
+// clock steps back or a newer timestamp is received from another node. Then the logical part
+// increases, so the timestamps of a node are always monotonic and newer than the ones it has seen.
+type hlc struct {
+	mu   sync.Mutex
+	last int64
+}
+
+// now returns a new timestamp.
+func (c *hlc) now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts := time.Now().UnixNano()
+	if ts <= c.last {
+		ts = c.last + 1
+	}
+	c.last = ts
+	return ts
+}
+
+// update merges a timestamp received from another node.
+func (c *hlc) update(ts int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ts > c.last {
+		c.last = ts
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	var c hlc
+	last := c.now()
+	for i := 0; i < 1000; i++ {
+		ts := c.now()
+		if ts <= last {
+			t.Fatalf("Expected a monotonic timestamp. Got: %d after %d", ts, last)
+		}
+		last = ts
+	}
+
+	// A timestamp from the future is received from another node.
+	future := time.Now().Add(time.Hour).UnixNano()
+	c.update(future)
+	if ts := c.now(); ts <= future {
+		t.Fatalf("Expected a timestamp newer than %d. Got: %d", future, ts)
+	}
+
+	// An older timestamp doesn't move the clock back.
+	c.update(0)
+	if ts := c.now(); ts <= future {
+		t.Fatalf("Expected a timestamp newer than %d. Got: %d", future, ts)
+	}
+}
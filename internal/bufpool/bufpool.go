@@ -17,26 +17,69 @@ package bufpool
 import (
 	"bytes"
 	"sync"
+	"sync/atomic"
 )
 
+// DefaultMaxSize is the default maximum capacity of a buffer retained by a BufPool.
+const DefaultMaxSize = 1 << 20
+
 // BufPool maintains a buffer pool.
 type BufPool struct {
 	p sync.Pool
+
+	// initialSize and maxSize are accessed atomically, they can be changed while the pool is in use.
+	initialSize int64
+	maxSize     int64
+
+	gets    uint64
+	misses  uint64
+	dropped uint64
+}
+
+// Stats contains the statistics of a BufPool.
+type Stats struct {
+	// Hits is the number of buffers reused from the pool.
+	Hits uint64
+
+	// Misses is the number of buffers allocated because the pool was empty.
+	Misses uint64
+
+	// Dropped is the number of buffers released instead of being put back because they have grown
+	// beyond the maximum size.
+	Dropped uint64
 }
 
-// New creates a new BufPool.
+// New creates a new BufPool which allocates empty buffers and retains the buffers up to DefaultMaxSize.
 func New() *BufPool {
-	return &BufPool{
-		p: sync.Pool{
-			New: func() interface{} {
-				return new(bytes.Buffer)
-			},
-		},
+	return NewWithSize(0, DefaultMaxSize)
+}
+
+// NewWithSize creates a new BufPool. The new buffers are allocated with initialSize bytes of capacity,
+// the buffers bigger than maxSize are dropped by Put. Zero maxSize means unlimited.
+func NewWithSize(initialSize, maxSize int) *BufPool {
+	p := &BufPool{}
+	p.SetSize(initialSize, maxSize)
+	p.p.New = func() interface{} {
+		atomic.AddUint64(&p.misses, 1)
+		return bytes.NewBuffer(make([]byte, 0, atomic.LoadInt64(&p.initialSize)))
 	}
+	return p
+}
+
+// SetSize changes the initial capacity of the new buffers and the maximum capacity of the retained
+// buffers. The buffers which are already in the pool are not affected.
+func (p *BufPool) SetSize(initialSize, maxSize int) {
+	atomic.StoreInt64(&p.initialSize, int64(initialSize))
+	atomic.StoreInt64(&p.maxSize, int64(maxSize))
 }
 
-// Put resets the buffer and puts it back to the pool.
+// Put resets the buffer and puts it back to the pool. It drops the buffer if its capacity exceeds
+// the maximum size, so a few big messages don't pin memory in the pool.
 func (p *BufPool) Put(b *bytes.Buffer) {
+	if max := atomic.LoadInt64(&p.maxSize); max > 0 && int64(b.Cap()) > max {
+		atomic.AddUint64(&p.dropped, 1)
+		return
+	}
 	b.Reset()
 	p.p.Put(b)
 }
@@ -44,5 +87,18 @@ func (p *BufPool) Put(b *bytes.Buffer) {
 // Get returns an empty buffer from the pool. It creates a new buffer, if there
 // is no bytes.Buffer available in the pool.
 func (p *BufPool) Get() *bytes.Buffer {
+	atomic.AddUint64(&p.gets, 1)
 	return p.p.Get().(*bytes.Buffer)
 }
+
+// Stats returns the statistics of the pool.
+func (p *BufPool) Stats() Stats {
+	// gets is incremented before the miss of the same call, load misses first to not count
+	// an in-flight miss as a hit.
+	misses := atomic.LoadUint64(&p.misses)
+	return Stats{
+		Hits:    atomic.LoadUint64(&p.gets) - misses,
+		Misses:  misses,
+		Dropped: atomic.LoadUint64(&p.dropped),
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bufpool
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufPool_InitialSize(t *testing.T) {
+	p := NewWithSize(4096, 0)
+	b := p.Get()
+	if b.Cap() != 4096 {
+		t.Fatalf("Expected capacity 4096. Got: %d", b.Cap())
+	}
+	if s := p.Stats(); s.Misses != 1 || s.Hits != 0 {
+		t.Fatalf("Expected 1 miss and 0 hits. Got: %d, %d", s.Misses, s.Hits)
+	}
+}
+
+func TestBufPool_Reuse(t *testing.T) {
+	p := New()
+	b := p.Get()
+	b.WriteString("value")
+	p.Put(b)
+	b = p.Get()
+	if b.Len() != 0 {
+		t.Fatalf("Expected an empty buffer. Got: %d bytes", b.Len())
+	}
+	s := p.Stats()
+	// sync.Pool may drop the pooled buffers at any time, i.e. during a GC.
+	if s.Hits+s.Misses != 2 {
+		t.Fatalf("Expected 2 gets. Got: %d hits, %d misses", s.Hits, s.Misses)
+	}
+}
+
+func TestBufPool_DropOversized(t *testing.T) {
+	p := NewWithSize(0, 1024)
+	p.Put(bytes.NewBuffer(make([]byte, 0, 2048)))
+	p.Put(bytes.NewBuffer(make([]byte, 0, 512)))
+	if s := p.Stats(); s.Dropped != 1 {
+		t.Fatalf("Expected 1 dropped buffer. Got: %d", s.Dropped)
+	}
+
+	p.SetSize(0, 4096)
+	p.Put(bytes.NewBuffer(make([]byte, 0, 2048)))
+	if s := p.Stats(); s.Dropped != 1 {
+		t.Fatalf("Expected 1 dropped buffer. Got: %d", s.Dropped)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*Package metrics implements lock-free histograms and a writer for the Prometheus text exposition format.*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of the latency buckets in seconds.
+var DefaultBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// DefaultSizeBuckets are the upper bounds of the size buckets in bytes.
+var DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+
+// Histogram counts the observed durations or sizes in buckets. It's safe for concurrent use.
+type Histogram struct {
+	bounds []float64
+	// counts has a bucket for every bound and the last one is +Inf. They are not cumulative.
+	counts []uint64
+	sum    int64
+	// scale converts the observed integers to the unit of the bounds, i.e. nanoseconds to seconds.
+	scale float64
+}
+
+func newHistogram(bounds []float64, scale float64) *Histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	return &Histogram{
+		bounds: b,
+		counts: make([]uint64, len(b)+1),
+		scale:  scale,
+	}
+}
+
+// NewHistogram returns a new Histogram of durations with the given upper bounds in seconds.
+func NewHistogram(bounds []float64) *Histogram {
+	return newHistogram(bounds, float64(time.Second))
+}
+
+// NewSizeHistogram returns a new Histogram of sizes with the given upper bounds in bytes.
+func NewSizeHistogram(bounds []float64) *Histogram {
+	return newHistogram(bounds, 1)
+}
+
+func (h *Histogram) observe(v int64) {
+	i := sort.SearchFloat64s(h.bounds, float64(v)/h.scale)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, v)
+}
+
+// Observe adds a duration to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	h.observe(int64(d))
+}
+
+// ObserveSize adds a size in bytes to the histogram.
+func (h *Histogram) ObserveSize(n int) {
+	h.observe(int64(n))
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	var total uint64
+	for i := range h.counts {
+		total += atomic.LoadUint64(&h.counts[i])
+	}
+	return total
+}
+
+// Label is a name-value pair which identifies a sample in a metric family.
+type Label struct {
+	Name  string
+	Value string
+}
+
+func formatLabels(labels []Label, extra ...Label) string {
+	labels = append(labels[:len(labels):len(labels)], extra...)
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l.Name+"="+strconv.Quote(l.Value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Writer writes metric families in the Prometheus text exposition format. It keeps the first error,
+// call Err after writing the metrics.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a new Writer.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+// Family writes the HELP and TYPE lines of a metric family. typ is one of counter, gauge and histogram.
+// The samples of the family follow it.
+func (w *Writer) Family(name, typ, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes a counter or gauge sample.
+func (w *Writer) Sample(name string, value float64, labels ...Label) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatFloat(value))
+}
+
+// Histogram writes the buckets, the sum and the count of a histogram.
+func (w *Writer) Histogram(name string, h *Histogram, labels ...Label) {
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		bound := math.Inf(1)
+		if i < len(h.bounds) {
+			bound = h.bounds[i]
+		}
+		w.printf("%s_bucket%s %d\n", name, formatLabels(labels, Label{Name: "le", Value: formatFloat(bound)}), cumulative)
+	}
+	sum := float64(atomic.LoadInt64(&h.sum)) / h.scale
+	w.printf("%s_sum%s %s\n", name, formatLabels(labels), formatFloat(sum))
+	w.printf("%s_count%s %d\n", name, formatLabels(labels), cumulative)
+}
+
+// Err returns the first error encountered while writing.
+func (w *Writer) Err() error {
+	return w.err
+}
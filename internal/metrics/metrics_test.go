@@ -0,0 +1,78 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	h := NewHistogram([]float64{0.5, 0.001})
+	h.Observe(time.Millisecond)
+	h.Observe(100 * time.Millisecond)
+	h.Observe(2 * time.Second)
+	if h.Count() != 3 {
+		t.Fatalf("Expected 3 observations. Got: %d", h.Count())
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Family("requests_total", "counter", "Number of requests.")
+	w.Sample("requests_total", 42, Label{Name: "op", Value: "Put"})
+	w.Family("latency_seconds", "histogram", "Latency of the requests.")
+	w.Histogram("latency_seconds", h, Label{Name: "op", Value: "Put"})
+	if w.Err() != nil {
+		t.Fatalf("Expected nil. Got: %v", w.Err())
+	}
+	expected := `# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{op="Put"} 42
+# HELP latency_seconds Latency of the requests.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="Put",le="0.001"} 1
+latency_seconds_bucket{op="Put",le="0.5"} 2
+latency_seconds_bucket{op="Put",le="+Inf"} 3
+latency_seconds_sum{op="Put"} 2.101
+latency_seconds_count{op="Put"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	h := NewSizeHistogram([]float64{64, 1024})
+	h.ObserveSize(10)
+	h.ObserveSize(64)
+	h.ObserveSize(4096)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Histogram("request_bytes", h)
+	if w.Err() != nil {
+		t.Fatalf("Expected nil. Got: %v", w.Err())
+	}
+	expected := `request_bytes_bucket{le="64"} 2
+request_bytes_bucket{le="1024"} 2
+request_bytes_bucket{le="+Inf"} 3
+request_bytes_sum 4170
+request_bytes_count 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
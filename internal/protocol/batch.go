@@ -0,0 +1,328 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Batch operations carry their keys and values in the value of the message.
+//
+// Keys:    [uint16 length][key]...
+// Entries: [uint16 length][key][uint32 length][value]...
+// Records: [uint16 length][key][uint32 length][value][int64 ttl]...
+// Backups: [uint16 length][key][uint32 length][value][int64 ttl][int64 timestamp]...
+
+// EncodeKeys encodes a list of keys to send it in the value of a message.
+func EncodeKeys(keys []string) []byte {
+	size := 0
+	for _, key := range keys {
+		size += 2 + len(key)
+	}
+	data := make([]byte, size)
+	offset := 0
+	for _, key := range keys {
+		binary.BigEndian.PutUint16(data[offset:], uint16(len(key)))
+		offset += 2
+		offset += copy(data[offset:], key)
+	}
+	return data
+}
+
+// DecodeKeys decodes a list of keys encoded by EncodeKeys.
+func DecodeKeys(data []byte) ([]string, error) {
+	var keys []string
+	for len(data) > 0 {
+		key, rest, err := decodeKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// EncodeEntries encodes key/value pairs to send them in the value of a message.
+func EncodeEntries(entries map[string][]byte) []byte {
+	size := 0
+	for key, value := range entries {
+		size += 2 + len(key) + 4 + len(value)
+	}
+	data := make([]byte, size)
+	offset := 0
+	for key, value := range entries {
+		binary.BigEndian.PutUint16(data[offset:], uint16(len(key)))
+		offset += 2
+		offset += copy(data[offset:], key)
+		binary.BigEndian.PutUint32(data[offset:], uint32(len(value)))
+		offset += 4
+		offset += copy(data[offset:], value)
+	}
+	return data
+}
+
+// DecodeEntries decodes key/value pairs encoded by EncodeEntries. It's safe to modify
+// the returned values, they don't share memory with data.
+func DecodeEntries(data []byte) (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	for len(data) > 0 {
+		key, rest, err := decodeKey(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < 4 {
+			return nil, ErrMalformedMessage
+		}
+		vlen := int(binary.BigEndian.Uint32(rest))
+		rest = rest[4:]
+		if vlen > len(rest) {
+			return nil, ErrMalformedMessage
+		}
+		value := make([]byte, vlen)
+		copy(value, rest[:vlen])
+		entries[key] = value
+		data = rest[vlen:]
+	}
+	return entries, nil
+}
+
+func decodeKey(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, ErrMalformedMessage
+	}
+	klen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if klen > len(data) {
+		return "", nil, ErrMalformedMessage
+	}
+	if klen > MaxKeyLen {
+		return "", nil, ErrKeyTooBig
+	}
+	return string(data[:klen]), data[klen:], nil
+}
+
+// Record is a key/value pair with its expiry. TTL is the expiry time in unix milliseconds, like the
+// TTL of the stored values. Zero means the key doesn't expire.
+type Record struct {
+	Key   string
+	Value []byte
+	TTL   int64
+}
+
+func recordSize(rec Record) int {
+	return 2 + len(rec.Key) + 4 + len(rec.Value) + 8
+}
+
+func encodeRecord(data []byte, rec Record) int {
+	binary.BigEndian.PutUint16(data, uint16(len(rec.Key)))
+	offset := 2
+	offset += copy(data[offset:], rec.Key)
+	binary.BigEndian.PutUint32(data[offset:], uint32(len(rec.Value)))
+	offset += 4
+	offset += copy(data[offset:], rec.Value)
+	binary.BigEndian.PutUint64(data[offset:], uint64(rec.TTL))
+	return offset + 8
+}
+
+// EncodeRecords encodes records to send them in the value of a message.
+func EncodeRecords(records []Record) []byte {
+	size := 0
+	for _, rec := range records {
+		size += recordSize(rec)
+	}
+	data := make([]byte, size)
+	offset := 0
+	for _, rec := range records {
+		offset += encodeRecord(data[offset:], rec)
+	}
+	return data
+}
+
+// DecodeRecords decodes records encoded by EncodeRecords. The values don't share memory with data.
+func DecodeRecords(data []byte) ([]Record, error) {
+	var records []Record
+	for len(data) > 0 {
+		key, rest, err := decodeKey(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < 4 {
+			return nil, ErrMalformedMessage
+		}
+		vlen := int(binary.BigEndian.Uint32(rest))
+		rest = rest[4:]
+		if vlen+8 > len(rest) {
+			return nil, ErrMalformedMessage
+		}
+		value := make([]byte, vlen)
+		copy(value, rest[:vlen])
+		ttl := int64(binary.BigEndian.Uint64(rest[vlen:]))
+		records = append(records, Record{Key: key, Value: value, TTL: ttl})
+		data = rest[vlen+8:]
+	}
+	return records, nil
+}
+
+// BackupRecord is a record written to a backup owner with the timestamp of the write, like
+// PutBackupExtra.
+type BackupRecord struct {
+	Record
+	Timestamp int64
+}
+
+// EncodedSize returns the size of the record encoded by EncodeBackupRecords.
+func (rec BackupRecord) EncodedSize() int {
+	return recordSize(rec.Record) + 8
+}
+
+// EncodeBackupRecords encodes backup records to send them in the value of a message.
+func EncodeBackupRecords(records []BackupRecord) []byte {
+	size := 0
+	for _, rec := range records {
+		size += rec.EncodedSize()
+	}
+	data := make([]byte, size)
+	offset := 0
+	for _, rec := range records {
+		offset += encodeRecord(data[offset:], rec.Record)
+		binary.BigEndian.PutUint64(data[offset:], uint64(rec.Timestamp))
+		offset += 8
+	}
+	return data
+}
+
+// DecodeBackupRecords decodes backup records encoded by EncodeBackupRecords. The values don't share
+// memory with data.
+func DecodeBackupRecords(data []byte) ([]BackupRecord, error) {
+	var records []BackupRecord
+	for len(data) > 0 {
+		key, rest, err := decodeKey(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) < 4 {
+			return nil, ErrMalformedMessage
+		}
+		vlen := int(binary.BigEndian.Uint32(rest))
+		rest = rest[4:]
+		if vlen+16 > len(rest) {
+			return nil, ErrMalformedMessage
+		}
+		value := make([]byte, vlen)
+		copy(value, rest[:vlen])
+		rec := BackupRecord{
+			Record: Record{
+				Key:   key,
+				Value: value,
+				TTL:   int64(binary.BigEndian.Uint64(rest[vlen:])),
+			},
+			Timestamp: int64(binary.BigEndian.Uint64(rest[vlen+8:])),
+		}
+		records = append(records, rec)
+		data = rest[vlen+16:]
+	}
+	return records, nil
+}
+
+// WriteRecord writes a record to w in the format of EncodeRecords. A stream of records can be read
+// with ReadRecord.
+func WriteRecord(w io.Writer, rec Record) error {
+	data := make([]byte, recordSize(rec))
+	encodeRecord(data, rec)
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadRecord reads a record written by WriteRecord from r. It returns io.EOF if r ends before the record
+// and io.ErrUnexpectedEOF if r ends in the middle of it. A value bigger than maxValueSize is not read,
+// it returns a *ValueTooBigError.
+func ReadRecord(r io.Reader, maxValueSize int) (Record, error) {
+	var rec Record
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:2]); err != nil {
+		return rec, err
+	}
+	klen := int(binary.BigEndian.Uint16(head[:2]))
+	if klen > MaxKeyLen {
+		return rec, ErrKeyTooBig
+	}
+	key := make([]byte, klen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return rec, noEOF(err)
+	}
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return rec, noEOF(err)
+	}
+	vlen := int(binary.BigEndian.Uint32(head[:]))
+	if vlen > maxValueSize {
+		return rec, &ValueTooBigError{Size: vlen, Limit: maxValueSize}
+	}
+	value := make([]byte, vlen+8)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return rec, noEOF(err)
+	}
+	rec.Key = string(key)
+	rec.Value = value[:vlen:vlen]
+	rec.TTL = int64(binary.BigEndian.Uint64(value[vlen:]))
+	return rec, nil
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF, a record cannot end in the middle.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// DumpMagic starts a dump stream. It's followed by the version and the records.
+//
+// Dump: [4 bytes magic][uint8 version][record]...
+const DumpMagic = "ODMP"
+
+// DumpVersion is the version of the dump format written by WriteDumpHeader.
+const DumpVersion uint8 = 1
+
+// ErrInvalidDump means that the stream doesn't start with DumpMagic.
+var ErrInvalidDump = errors.New("invalid dump")
+
+// WriteDumpHeader writes the magic and the version of a dump stream to w.
+func WriteDumpHeader(w io.Writer) error {
+	_, err := w.Write(append([]byte(DumpMagic), DumpVersion))
+	return err
+}
+
+// ReadDumpHeader reads the header of a dump stream from r. It returns ErrInvalidDump if the magic doesn't
+// match and an error if the version is not supported.
+func ReadDumpHeader(r io.Reader) error {
+	var header [len(DumpMagic) + 1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidDump
+		}
+		return err
+	}
+	if string(header[:len(DumpMagic)]) != DumpMagic {
+		return ErrInvalidDump
+	}
+	if version := header[len(DumpMagic)]; version != DumpVersion {
+		return fmt.Errorf("unsupported dump version: %d", version)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func Test_EncodeDecodeKeys(t *testing.T) {
+	keys := []string{"foo", "", "bar"}
+	decoded, err := DecodeKeys(EncodeKeys(keys))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(decoded) != len(keys) {
+		t.Fatalf("Expected %d keys. Got: %d", len(keys), len(decoded))
+	}
+	for i, key := range keys {
+		if decoded[i] != key {
+			t.Fatalf("Expected %s. Got: %s", key, decoded[i])
+		}
+	}
+
+	_, err = DecodeKeys([]byte{0, 10, 'a'})
+	if err != ErrMalformedMessage {
+		t.Fatalf("Expected ErrMalformedMessage. Got: %v", err)
+	}
+}
+
+func Test_EncodeDecodeEntries(t *testing.T) {
+	entries := map[string][]byte{
+		"foo": []byte("bar"),
+		"baz": nil,
+	}
+	data := EncodeEntries(entries)
+	decoded, err := DecodeEntries(data)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(decoded) != len(entries) {
+		t.Fatalf("Expected %d entries. Got: %d", len(entries), len(decoded))
+	}
+	for key, value := range entries {
+		if !bytes.Equal(decoded[key], value) {
+			t.Fatalf("Different value for %s: %s", key, decoded[key])
+		}
+	}
+
+	_, err = DecodeEntries(data[:len(data)-1])
+	if err != ErrMalformedMessage {
+		t.Fatalf("Expected ErrMalformedMessage. Got: %v", err)
+	}
+}
+
+func Test_EncodeDecodeRecords(t *testing.T) {
+	records := []Record{
+		{Key: "foo", Value: []byte("bar"), TTL: 1234},
+		{Key: "baz"},
+	}
+	decoded, err := DecodeRecords(EncodeRecords(records))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatalf("Expected %d records. Got: %d", len(records), len(decoded))
+	}
+	for i, rec := range records {
+		if decoded[i].Key != rec.Key || !bytes.Equal(decoded[i].Value, rec.Value) || decoded[i].TTL != rec.TTL {
+			t.Fatalf("Expected %v. Got: %v", rec, decoded[i])
+		}
+	}
+
+	_, err = DecodeRecords([]byte{0, 1, 'a', 0, 0, 0, 1, 'b'})
+	if err != ErrMalformedMessage {
+		t.Fatalf("Expected ErrMalformedMessage. Got: %v", err)
+	}
+}
+
+func Test_EncodeDecodeBackupRecords(t *testing.T) {
+	records := []BackupRecord{
+		{Record: Record{Key: "foo", Value: []byte("bar"), TTL: 1234}, Timestamp: 5678},
+		{Record: Record{Key: "baz"}},
+	}
+	data := EncodeBackupRecords(records)
+	if len(data) != records[0].EncodedSize()+records[1].EncodedSize() {
+		t.Fatalf("Expected the encoded size to match EncodedSize")
+	}
+	decoded, err := DecodeBackupRecords(data)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatalf("Expected %d records. Got: %d", len(records), len(decoded))
+	}
+	for i, rec := range records {
+		if decoded[i].Key != rec.Key || !bytes.Equal(decoded[i].Value, rec.Value) ||
+			decoded[i].TTL != rec.TTL || decoded[i].Timestamp != rec.Timestamp {
+			t.Fatalf("Expected %v. Got: %v", rec, decoded[i])
+		}
+	}
+
+	_, err = DecodeBackupRecords(data[:len(data)-1])
+	if err != ErrMalformedMessage {
+		t.Fatalf("Expected ErrMalformedMessage. Got: %v", err)
+	}
+}
+
+func Test_ReadWriteRecord(t *testing.T) {
+	buf := new(bytes.Buffer)
+	records := []Record{
+		{Key: "foo", Value: []byte("bar"), TTL: 1234},
+		{Key: "baz", Value: []byte("qux")},
+	}
+	for _, rec := range records {
+		err := WriteRecord(buf, rec)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), EncodeRecords(records)) {
+		t.Fatalf("Expected the same encoding with EncodeRecords")
+	}
+	for _, rec := range records {
+		got, err := ReadRecord(buf, 1024)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if got.Key != rec.Key || !bytes.Equal(got.Value, rec.Value) || got.TTL != rec.TTL {
+			t.Fatalf("Expected %v. Got: %v", rec, got)
+		}
+	}
+	_, err := ReadRecord(buf, 1024)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF. Got: %v", err)
+	}
+
+	_, err = ReadRecord(bytes.NewReader([]byte{0, 3, 'f'}), 1024)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected io.ErrUnexpectedEOF. Got: %v", err)
+	}
+	err = WriteRecord(buf, Record{Key: "big", Value: make([]byte, 2048)})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = ReadRecord(buf, 1024)
+	if _, ok := err.(*ValueTooBigError); !ok {
+		t.Fatalf("Expected *ValueTooBigError. Got: %v", err)
+	}
+}
+
+func Test_DumpHeader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := WriteDumpHeader(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = ReadDumpHeader(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	err = ReadDumpHeader(bytes.NewReader([]byte("ODM")))
+	if err != ErrInvalidDump {
+		t.Fatalf("Expected ErrInvalidDump. Got: %v", err)
+	}
+	err = ReadDumpHeader(bytes.NewReader([]byte("XXXX\x01")))
+	if err != ErrInvalidDump {
+		t.Fatalf("Expected ErrInvalidDump. Got: %v", err)
+	}
+	err = ReadDumpHeader(bytes.NewReader([]byte(DumpMagic + "\x02")))
+	if err == nil {
+		t.Fatalf("Expected an error for an unsupported version")
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import "github.com/pkg/errors"
+
+// CompressionCodec compresses and decompresses message values.
+type CompressionCodec interface {
+	// Compress compresses data and returns the compressed byte slice.
+	Compress(data []byte) []byte
+
+	// Decompress decompresses data and returns the original byte slice. It stops after limit+1 bytes, so
+	// a value longer than limit is rejected without decompressing all of it.
+	Decompress(data []byte, limit int) ([]byte, error)
+}
+
+// Codec is used to compress values of outgoing messages and decompress values of
+// incoming messages. Compression is disabled if it's nil. All the nodes and clients
+// in a cluster have to use the same codec.
+var Codec CompressionCodec
+
+// CompressionThreshold is 1KB by default. Values smaller than or equal to the threshold
+// are not compressed.
+var CompressionThreshold = 1 << 10
+
+// ErrNoCodec means that a compressed message is received but Codec is not set.
+var ErrNoCodec = errors.New("no compression codec")
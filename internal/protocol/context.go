@@ -0,0 +1,89 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is used to unblock pending I/O calls when the context is cancelled.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ReadContext is like Read but it sets the read deadline of the connection from the context
+// and resets it afterward. It returns ctx.Err() if the context is done before the message
+// has been read.
+func (m *Message) ReadContext(ctx context.Context, conn net.Conn) error {
+	return withDeadline(ctx, conn.SetReadDeadline, func() error {
+		return m.Read(conn)
+	})
+}
+
+// WriteContext is like Write but it sets the write deadline of the connection from the context
+// and resets it afterward. It returns ctx.Err() if the context is done before the message
+// has been written.
+func (m *Message) WriteContext(ctx context.Context, conn net.Conn) error {
+	return withDeadline(ctx, conn.SetWriteDeadline, func() error {
+		return m.Write(conn)
+	})
+}
+
+func withDeadline(ctx context.Context, setDeadline func(time.Time) error, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return filterNetworkErrors(err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := setDeadline(deadline); err != nil {
+			return filterNetworkErrors(err)
+		}
+	}
+
+	var stopped chan struct{}
+	done := make(chan struct{})
+	if ctx.Done() != nil {
+		// The context may be cancelled without a deadline. Unblock the pending call by moving
+		// the deadline to the past.
+		stopped = make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				setDeadline(aLongTimeAgo)
+			case <-done:
+			}
+		}()
+	}
+
+	err := f()
+	close(done)
+	if stopped != nil {
+		<-stopped
+	}
+	rerr := setDeadline(time.Time{})
+	if err != nil {
+		if cerr := ctx.Err(); cerr != nil {
+			return filterNetworkErrors(cerr)
+		}
+		// The deadline of the connection may fire slightly before the context's timer.
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return filterNetworkErrors(context.DeadlineExceeded)
+			}
+		}
+		return err
+	}
+	return filterNetworkErrors(rerr)
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+)
+
+// extras maps opcodes to factories which return a pointer to a fresh extra struct.
+var extras = make(map[OpCode]func() interface{})
+
+func init() {
+	RegisterExtra(OpExPut, func() interface{} { return &PutExtra{} })
+	RegisterExtra(OpExPutEx, func() interface{} { return &PutExExtra{} })
+	RegisterExtra(OpExPutIf, func() interface{} { return &PutIfExtra{} })
+	RegisterExtra(OpExCAS, func() interface{} { return &CASExtra{} })
+	RegisterExtra(OpExIncr, func() interface{} { return &IncrExtra{} })
+	RegisterExtra(OpExDecr, func() interface{} { return &IncrExtra{} })
+	RegisterExtra(OpExLockWithTimeout, func() interface{} { return &LockWithTimeoutExtra{} })
+	RegisterExtra(OpLockPrev, func() interface{} { return &LockWithTimeoutExtra{} })
+	RegisterExtra(OpTryLock, func() interface{} { return &LockWithTimeoutExtra{} })
+	RegisterExtra(OpLockLease, func() interface{} { return &LockWithTimeoutExtra{} })
+	RegisterExtra(OpLeasePrev, func() interface{} { return &LockWithTimeoutExtra{} })
+	RegisterExtra(OpIsPartEmpty, func() interface{} { return &IsPartEmptyExtra{} })
+	RegisterExtra(OpIsBackupEmpty, func() interface{} { return &IsPartEmptyExtra{} })
+	RegisterExtra(OpExpire, func() interface{} { return &ExpireExtra{} })
+	RegisterExtra(OpExpireBackup, func() interface{} { return &ExpireExtra{} })
+	// Responses of these operations carry the expiry of the key.
+	RegisterExtra(OpPutBackup, func() interface{} { return &PutBackupExtra{} })
+	RegisterExtra(OpExGetEx, func() interface{} { return &GetExExtra{} })
+	RegisterExtra(OpGetPrev, func() interface{} { return &GetExExtra{} })
+	RegisterExtra(OpGetBackup, func() interface{} { return &GetExExtra{} })
+	RegisterExtra(OpExGetEntry, func() interface{} { return &GetEntryExtra{} })
+	RegisterExtra(OpExLen, func() interface{} { return &LenExtra{} })
+	RegisterExtra(OpLen, func() interface{} { return &LenExtra{} })
+	// Responses of these operations carry the number of deleted keys.
+	RegisterExtra(OpExDeleteByPattern, func() interface{} { return &LenExtra{} })
+	RegisterExtra(OpDeleteByPattern, func() interface{} { return &LenExtra{} })
+	RegisterExtra(OpExScan, func() interface{} { return &ScanExtra{} })
+	RegisterExtra(OpScan, func() interface{} { return &ScanExtra{} })
+	RegisterExtra(OpDump, func() interface{} { return &ScanExtra{} })
+	RegisterExtra(OpExQuery, func() interface{} { return &QueryExtra{} })
+	RegisterExtra(OpQuery, func() interface{} { return &QueryExtra{} })
+	RegisterExtra(OpHello, func() interface{} { return &HelloExtra{} })
+	RegisterExtra(OpMerkleRoot, func() interface{} { return &MerkleExtra{} })
+	RegisterExtra(OpMerkleSubtree, func() interface{} { return &MerkleExtra{} })
+	RegisterExtra(OpMerkleKeys, func() interface{} { return &MerkleExtra{} })
+}
+
+// shortExtra is the size of an extra in the frames older than the version which has grown it. The
+// older frames carry the leading fields only.
+type shortExtra struct {
+	version uint8
+	size    int
+}
+
+// shortExtras maps the opcodes whose extras have grown to their sizes in the older frames.
+var shortExtras = map[OpCode]shortExtra{
+	OpExPut:   {version: TimestampVersion, size: 0},
+	OpExPutEx: {version: TimestampVersion, size: 8},
+	OpExScan:  {version: GenerationVersion, size: 16},
+	OpScan:    {version: GenerationVersion, size: 16},
+	OpDump:    {version: GenerationVersion, size: 16},
+	OpExQuery: {version: GenerationVersion, size: 17},
+	OpQuery:   {version: GenerationVersion, size: 17},
+}
+
+// extraSize returns the encoded size of the extra of a message with the given protocol version.
+func extraSize(op OpCode, status StatusCode, version uint8, extra interface{}) int {
+	size := binary.Size(extra)
+	if status == StatusMoved {
+		return size
+	}
+	if short, ok := shortExtras[op]; ok && version < short.version && short.size < size {
+		return short.size
+	}
+	return size
+}
+
+// RegisterExtra registers an extra type for the given opcode. factory must return a pointer
+// to a fixed-size struct. Read decodes the extras of both requests and responses into it and sets Message.Extra to the
+// struct value, not the pointer. It's not safe to call RegisterExtra concurrently with Read,
+// register extras before serving any request.
+func RegisterExtra(op OpCode, factory func() interface{}) {
+	extras[op] = factory
+}
+
+func decodeExtra(op OpCode, status StatusCode, raw []byte) (interface{}, error) {
+	var p interface{}
+	if status == StatusMoved {
+		// The extra of a redirect doesn't depend on the operation.
+		p = &MovedExtra{}
+	} else {
+		factory, ok := extras[op]
+		if !ok {
+			return nil, nil
+		}
+		p = factory()
+		if short, ok := shortExtras[op]; ok && len(raw) == short.size && short.size < binary.Size(p) {
+			// An extra of an older version, its missing fields are zero.
+			raw = append(raw[:short.size:short.size], make([]byte, binary.Size(p)-short.size)...)
+		}
+	}
+	err := binary.Read(bytes.NewReader(raw), binary.BigEndian, p)
+	if err != nil {
+		return nil, err
+	}
+	return reflect.Indirect(reflect.ValueOf(p)).Interface(), nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import "sync"
+
+// maxPooledValueBuf is the maximum capacity of a ValueBuf kept in a MessagePool. The bigger
+// buffers are released, so a few big values don't pin memory in the pool.
+const maxPooledValueBuf = 64 << 10
+
+// MessagePool is a pool of messages to reduce allocations of the callers which read many messages.
+// The messages returned by Get have a non-nil ValueBuf, so Read reuses it to store the value.
+//
+// A message must not be used after it's put back to the pool. Its Value points to the pooled
+// buffer, copy it before calling Put if it's still needed. It's safe for concurrent use.
+type MessagePool struct {
+	pool sync.Pool
+}
+
+// NewMessagePool returns a new MessagePool.
+func NewMessagePool() *MessagePool {
+	return &MessagePool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return &Message{ValueBuf: []byte{}}
+			},
+		},
+	}
+}
+
+// Get returns a reset message from the pool or allocates a new one.
+func (p *MessagePool) Get() *Message {
+	return p.pool.Get().(*Message)
+}
+
+// Put resets the message and puts it back to the pool.
+func (p *MessagePool) Put(m *Message) {
+	if m.ValueBuf == nil || cap(m.ValueBuf) > maxPooledValueBuf {
+		m.ValueBuf = []byte{}
+	}
+	m.Reset()
+	p.pool.Put(m)
+}
@@ -16,10 +16,15 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
 	"strings"
+	"sync"
 
 	"github.com/buraksezer/olric/internal/bufpool"
 	"github.com/pkg/errors"
@@ -28,11 +33,141 @@ import (
 // MaxValueSize is 1MB by default.
 var MaxValueSize = 1 << 20
 
+var (
+	dmapMaxValueSizeMtx sync.RWMutex
+	dmapMaxValueSize    = make(map[string]int)
+	largestValueSize    int
+)
+
+// SetDMapMaxValueSize sets the maximum value size for the given DMap. It overrides MaxValueSize for the
+// messages which target that DMap. Zero removes the override.
+func SetDMapMaxValueSize(dmap string, size int) {
+	dmapMaxValueSizeMtx.Lock()
+	defer dmapMaxValueSizeMtx.Unlock()
+	if size == 0 {
+		delete(dmapMaxValueSize, dmap)
+	} else {
+		dmapMaxValueSize[dmap] = size
+	}
+	largestValueSize = 0
+	for _, size := range dmapMaxValueSize {
+		if size > largestValueSize {
+			largestValueSize = size
+		}
+	}
+}
+
+// MaxValueSizeFor returns the maximum value size for the given DMap, it falls back to MaxValueSize.
+// Responses don't carry a DMap name, so the messages without a DMap name are checked against the
+// largest configured value size.
+func MaxValueSizeFor(dmap string) int {
+	dmapMaxValueSizeMtx.RLock()
+	defer dmapMaxValueSizeMtx.RUnlock()
+	if dmap == "" {
+		if largestValueSize > MaxValueSize {
+			return largestValueSize
+		}
+		return MaxValueSize
+	}
+	if size, ok := dmapMaxValueSize[dmap]; ok {
+		return size
+	}
+	return MaxValueSize
+}
+
 // ErrValueTooBig means that the value from sender is too big to receive.
 var ErrValueTooBig = errors.New("value too big")
 
+// ValueTooBigError is returned when a value exceeds its size limit. It carries the size of the value
+// and the limit. errors.Is(err, ErrValueTooBig) reports true for it.
+type ValueTooBigError struct {
+	Size  int
+	Limit int
+}
+
+func (e *ValueTooBigError) Error() string {
+	return fmt.Sprintf("%s: %d bytes, limit is %d bytes", ErrValueTooBig, e.Size, e.Limit)
+}
+
+// Unwrap returns ErrValueTooBig.
+func (e *ValueTooBigError) Unwrap() error {
+	return ErrValueTooBig
+}
+
+// MaxKeyLen is the maximum length of a received key. It's the longest key encoded in a header by default,
+// so a key accepted by a local DMap is accepted by the remote owners too.
+var MaxKeyLen = math.MaxUint16
+
+// MaxDMapLen is the maximum length of a received DMap name. It's the longest name encoded in a header by
+// default.
+var MaxDMapLen = math.MaxUint16
+
+// ErrKeyTooBig means that the key from sender is too big to receive.
+var ErrKeyTooBig = errors.New("key too big")
+
+// ErrDMapTooBig means that the DMap name from sender is too big to receive.
+var ErrDMapTooBig = errors.New("dmap name too big")
+
+const (
+	// LegacyProtocolVersion is the format of the nodes which predate the protocol versions. Its header has
+	// neither Version nor Flags, so its frames don't carry their version, see Message.Legacy, and they can't
+	// carry any flag. OpHello is always sent with it, so every peer is able to decode it.
+	LegacyProtocolVersion uint8 = 0
+
+	// MinProtocolVersion is the oldest version of Olric Binary Protocol.
+	MinProtocolVersion = LegacyProtocolVersion
+
+	// ProtocolVersion is the latest version of Olric Binary Protocol implemented by this package.
+	ProtocolVersion uint8 = 2
+
+	// FlagsVersion is the first protocol version with Version and Flags in the header.
+	FlagsVersion uint8 = 1
+
+	// RequestIDVersion is the first protocol version with RequestID in the header.
+	RequestIDVersion uint8 = 2
+
+	// TimestampVersion is the first protocol version with Timestamp in PutExtra and PutExExtra.
+	TimestampVersion uint8 = 2
+
+	// GenerationVersion is the first protocol version with Generation in ScanExtra and QueryExtra.
+	GenerationVersion uint8 = 2
+)
+
+// MaxProtocolVersion is the highest protocol version accepted and spoken by this node. Set it
+// to an older version to keep talking to old nodes during a rolling upgrade.
+var MaxProtocolVersion = ProtocolVersion
+
+// ErrUnsupportedVersion means that the message is encoded with a protocol version which is not supported.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// VerifyChecksums enables CRC32 checksums for outgoing messages and validation
+// of the checksums on incoming messages. It's disabled by default.
+var VerifyChecksums = false
+
+// ErrMalformedMessage means that the lengths in the message header are inconsistent with each other.
+var ErrMalformedMessage = errors.New("malformed message")
+
+// ErrInvalidMessage means that the message doesn't start with a magic code.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ErrChecksumMismatch means that the message body doesn't match with its checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 var pool *bufpool.BufPool = bufpool.New()
 
+// SetBufferPoolSize sets the initial capacity of the buffers allocated to read and write the messages,
+// and the maximum capacity of a buffer retained to be reused. See bufpool.NewWithSize.
+func SetBufferPoolSize(initialSize, maxSize int) {
+	pool.SetSize(initialSize, maxSize)
+}
+
+// BufferPoolStats returns the statistics of the buffers used to read and write the messages.
+func BufferPoolStats() bufpool.Stats {
+	return pool.Stats()
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // Operation defines an operation handler for Olric Binary Protocol.
 type Operation func(in *Message) (out *Message)
 
@@ -76,41 +211,290 @@ const (
 	OpBackupMoveDMap
 	OpIsPartEmpty
 	OpIsBackupEmpty
+	OpHello
+	OpPing
+	OpPong
+	OpExMGet
+	OpExMPut
+	OpExpire
+	OpExpireBackup
+	OpExGetEx
+	OpExPutIf
+	OpExCAS
+	OpExCAD
+	OpExAppend
+	OpExPrepend
+	OpExIncrByFloat
+	OpExLen
+	OpLen
+	OpExScan
+	OpScan
+	OpExQuery
+	OpQuery
+	OpTryLock
+	OpLockLease
+	OpLeasePrev
+	OpAccessBackup
+	OpMerkleRoot
+	OpMerkleSubtree
+	OpMerkleKeys
+	OpStats
+	OpSlowLog
+	OpExMDelete
+	OpMDeleteBackup
+	OpExGetEntry
+	OpAuth
+	OpTouch
+	OpExMPutEx
+	OpDump
+	OpPutBackupBatch
+	OpExClear
+	OpClear
+	OpExDeleteByPattern
+	OpDeleteByPattern
+	OpRefreshRouting
+	OpExGetByIndex
+	OpGetByIndex
 )
 
-// StatusCode ...
+// opNames maps the opcodes to their names without the Op prefix.
+var opNames = map[OpCode]string{
+	OpExPut:             "ExPut",
+	OpExPutEx:           "ExPutEx",
+	OpExGet:             "ExGet",
+	OpExDelete:          "ExDelete",
+	OpExDestroy:         "ExDestroy",
+	OpExLockWithTimeout: "ExLockWithTimeout",
+	OpExUnlock:          "ExUnlock",
+	OpExIncr:            "ExIncr",
+	OpExDecr:            "ExDecr",
+	OpExGetPut:          "ExGetPut",
+	OpUpdateRouting:     "UpdateRouting",
+	OpPutBackup:         "PutBackup",
+	OpDeletePrev:        "DeletePrev",
+	OpGetPrev:           "GetPrev",
+	OpGetBackup:         "GetBackup",
+	OpFindLock:          "FindLock",
+	OpLockPrev:          "LockPrev",
+	OpUnlockPrev:        "UnlockPrev",
+	OpDeleteBackup:      "DeleteBackup",
+	OpDestroyDMap:       "DestroyDMap",
+	OpMoveDMap:          "MoveDMap",
+	OpBackupMoveDMap:    "BackupMoveDMap",
+	OpIsPartEmpty:       "IsPartEmpty",
+	OpIsBackupEmpty:     "IsBackupEmpty",
+	OpHello:             "Hello",
+	OpPing:              "Ping",
+	OpPong:              "Pong",
+	OpExMGet:            "ExMGet",
+	OpExMPut:            "ExMPut",
+	OpExpire:            "Expire",
+	OpExpireBackup:      "ExpireBackup",
+	OpExGetEx:           "ExGetEx",
+	OpExPutIf:           "ExPutIf",
+	OpExCAS:             "ExCAS",
+	OpExCAD:             "ExCAD",
+	OpExAppend:          "ExAppend",
+	OpExPrepend:         "ExPrepend",
+	OpExIncrByFloat:     "ExIncrByFloat",
+	OpExLen:             "ExLen",
+	OpLen:               "Len",
+	OpExScan:            "ExScan",
+	OpScan:              "Scan",
+	OpExQuery:           "ExQuery",
+	OpQuery:             "Query",
+	OpTryLock:           "TryLock",
+	OpLockLease:         "LockLease",
+	OpLeasePrev:         "LeasePrev",
+	OpAccessBackup:      "AccessBackup",
+	OpMerkleRoot:        "MerkleRoot",
+	OpMerkleSubtree:     "MerkleSubtree",
+	OpMerkleKeys:        "MerkleKeys",
+	OpStats:             "Stats",
+	OpSlowLog:           "SlowLog",
+	OpExMDelete:         "ExMDelete",
+	OpMDeleteBackup:     "MDeleteBackup",
+	OpExGetEntry:        "ExGetEntry",
+	OpAuth:              "Auth",
+	OpTouch:             "Touch",
+	OpExMPutEx:          "ExMPutEx",
+	OpDump:              "Dump",
+	OpPutBackupBatch:    "PutBackupBatch",
+	OpExClear:           "ExClear",
+	OpClear:             "Clear",
+	OpExDeleteByPattern: "ExDeleteByPattern",
+	OpDeleteByPattern:   "DeleteByPattern",
+	OpRefreshRouting:    "RefreshRouting",
+	OpExGetByIndex:      "ExGetByIndex",
+	OpGetByIndex:        "GetByIndex",
+}
+
+// ParseOpCode returns the opcode of the given name, it's the inverse of OpCode.String.
+func ParseOpCode(name string) (OpCode, bool) {
+	for op, n := range opNames {
+		if n == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+// String returns the name of the opcode.
+func (op OpCode) String() string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("OpCode(%d)", uint8(op))
+}
+
+// StatusCode is the status of a response. The numeric values are a part of the wire format, so a new
+// status code is always appended to the end of the list and an existing one is never renumbered.
 type StatusCode uint8
 
 // status codes
 const (
-	StatusOK = StatusCode(iota)
-	StatusInternalServerError
-	StatusKeyNotFound
-	StatusNoSuchLock
-	StatusPartNotEmpty
-	StatusBackupNotEmpty
+	StatusOK                  = StatusCode(iota) // 0
+	StatusInternalServerError                    // 1: an unclassified error, the value carries its message.
+	StatusKeyNotFound                            // 2
+	StatusNoSuchLock                             // 3
+	StatusPartNotEmpty                           // 4
+	StatusBackupNotEmpty                         // 5
+	StatusKeyFound                               // 6
+	StatusValueTooBig                            // 7
+	StatusWriteQuorum                            // 8
+	StatusReadQuorum                             // 9
+	StatusQuotaExceeded                          // 10
+	StatusForbidden                              // 11
+	StatusUnauthorized                           // 12
+	StatusNotOwner                               // 13: the node doesn't own the partition of the request.
+	StatusTimeout                                // 14: the operation couldn't be completed in time.
+	StatusMoved                                  // 15: the node doesn't own the key, see FlagRedirect.
+	StatusOverflow                               // 16: the result of an integer operation overflows.
+	StatusReadOnly                               // 17: the node is a read-only replica, it doesn't accept writes.
+	StatusTooManyConnections                     // 18: the node rejects a new connection, it has too many of them.
+	StatusRateLimited                            // 19: the request exceeds a rate limit of the node, it's not handled.
+	StatusQuorumLost                             // 20: the node cannot reach a write quorum, too many nodes are down.
 )
 
-const headerSize int64 = 12
+// Flag ...
+type Flag uint8
+
+// flags
+const (
+	// FlagChecksum indicates that a CRC32 checksum of the body is appended after the value.
+	FlagChecksum Flag = 1 << iota
+
+	// FlagCompressed indicates that the value is compressed by Codec.
+	FlagCompressed
 
-// Header defines a message header for both request and response.
+	// FlagTraced indicates that a trace context is appended after the value, before the checksum.
+	FlagTraced
+
+	// FlagRedirect indicates that the sender routes the requests to the owners of the keys itself. A node
+	// which doesn't own the key of the request responds with StatusMoved instead of forwarding it. The value
+	// of the response is the address of the owner and its extra is MovedExtra.
+	FlagRedirect
+
+	// FlagLargeBody indicates that the length of the body is encoded in the extended header, a uint64 which
+	// follows the header. BodyLen is zero. Write sets it if the body doesn't fit in BodyLen, the frames with
+	// the smaller bodies are sent with it only if it's set by the sender.
+	FlagLargeBody
+)
+
+// headerSize is the length of the header of protocol version 1, the header of the later versions is
+// followed by RequestID.
+const headerSize int64 = 14
+
+// legacyHeaderSize is the length of the header of LegacyProtocolVersion.
+const legacyHeaderSize int64 = 12
+
+// requestIDSize is the length of RequestID in bytes.
+const requestIDSize = 4
+
+// extendedHeaderSize is the length of the body length in the extended header, see FlagLargeBody.
+const extendedHeaderSize = 8
+
+// maxBodyLen is the largest body length encoded in BodyLen, the longer bodies are sent with FlagLargeBody.
+var maxBodyLen uint64 = math.MaxUint32
+
+// checksumSize is the length of CRC32 checksum in bytes.
+const checksumSize = 4
+
+// traceContextSize is the length of an encoded TraceContext in bytes.
+const traceContextSize = 25
+
+// Header defines a message header for both request and response. The multi-byte fields of the header and
+// the extras are encoded in big-endian byte order on every platform, the signed integers in two's complement.
+// The wire format is shared with the clients in other languages, it must not change silently.
+//
+// Version and Flags are not encoded by LegacyProtocolVersion, RequestID is encoded by protocol version 2 and
+// later. A response carries the ID of its request, so the responses of the requests sent over a connection at
+// the same time are matched with them. Zero means that the request has no ID, the server responds to those
+// requests in order.
 type Header struct {
-	Magic    MagicCode  // 1
-	Op       OpCode     // 1
-	DMapLen  uint16     // 2
-	KeyLen   uint16     // 2
-	ExtraLen uint8      // 1
-	Status   StatusCode // 1
-	BodyLen  uint32     // 4
+	Magic     MagicCode  // 1
+	Version   uint8      // 1
+	Op        OpCode     // 1
+	DMapLen   uint16     // 2
+	KeyLen    uint16     // 2
+	ExtraLen  uint8      // 1
+	Status    StatusCode // 1
+	Flags     Flag       // 1
+	BodyLen   uint32     // 4: zero if FlagLargeBody is set.
+	RequestID uint32     // 4: protocol version 2 and later.
 }
 
-// Message defines a protocol message in Olric Binary Protocol.
+// Message defines a protocol message in Olric Binary Protocol. If FlagChecksum is set,
+// a 4 bytes CRC32 checksum of the body follows the value.
+//
+// If Trace is not nil, it's sent with FlagTraced. It's the trace context of the caller, so the spans
+// of the nodes can be linked.
+//
+// ValueBuf is not a part of the wire format. If it's not nil, Read reuses it to store
+// the value instead of allocating a new slice, growing it when needed. In that case Value
+// points to ValueBuf and it's only valid until the next Read on the same message.
+//
+// The context of a request is not a part of the wire format either, see Context.
+//
+// Legacy is not a part of the wire format either. The frames of LegacyProtocolVersion are not distinguished
+// from the others by their bytes, the peers know the version of a connection. If it's set, Read decodes a
+// legacy frame and Write encodes one, without the flags: the value is never compressed, Trace is not sent
+// and the checksum is not appended. Error and Success copy it from the request.
 type Message struct {
-	Header             // [0..10]
-	Extra  interface{} // [11..(m-1)] Command specific extras (In)
-	DMap   string      // [m..(n-1)] DMap (as needed, length in Header)
-	Key    string      // [n..(x-1)] Key (as needed, length in Header)
-	Value  []byte      // [x..y] Value (as needed, length in Header)
+	Header               // [0..13]
+	Extra    interface{} // [14..(m-1)] Command specific extras (In)
+	DMap     string      // [m..(n-1)] DMap (as needed, length in Header)
+	Key      string      // [n..(x-1)] Key (as needed, length in Header)
+	Value    []byte      // [x..y] Value (as needed, length in Header)
+	Trace    *TraceContext
+	ValueBuf []byte
+	Legacy   bool
+
+	// wire is the number of bytes read or written by the last Read or Write.
+	wire int64
+
+	ctx context.Context
+}
+
+// Context returns the context of the request. It's done when the server gives up the request, i.e. after
+// the timeout of the operation. It's context.Background(), if it's not set.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// SetContext sets the context of the request.
+func (m *Message) SetContext(ctx context.Context) {
+	m.ctx = ctx
+}
+
+// TraceContext identifies a span in a distributed trace, like the traceparent header of W3C Trace Context.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   uint8
 }
 
 // LockWithTimeoutExtra defines extra values for this operation.
@@ -118,20 +502,125 @@ type LockWithTimeoutExtra struct {
 	TTL int64
 }
 
-// PutExExtra defines extra values for this operation.
+// PutExtra defines extra values for this operation. Timestamp is the hybrid logical clock of
+// the node which forwards the request to the owner. The clients don't send it. The frames older
+// than TimestampVersion have no PutExtra.
+type PutExtra struct {
+	Timestamp int64
+}
+
+// PutExExtra defines extra values for this operation. Timestamp is the same with PutExtra. The
+// frames older than TimestampVersion carry only TTL, Timestamp is zero then.
 type PutExExtra struct {
+	TTL       int64
+	Timestamp int64
+}
+
+// ExpireExtra defines extra values for this operation.
+type ExpireExtra struct {
 	TTL int64
 }
 
+// PutIfExtra defines extra values for this operation.
+type PutIfExtra struct {
+	Flags uint8
+}
+
+// IncrExtra defines extra values for OpExIncr and OpExDecr. Initial is the value of the key before
+// the operation, if it doesn't exist. The requests without it start from zero.
+type IncrExtra struct {
+	Initial int64
+}
+
+// CASExtra defines extra values for this operation. The value of the message is the old value
+// followed by the new value, OldLen is the length of the old value.
+type CASExtra struct {
+	OldLen uint32
+}
+
+// GetExExtra defines extra values for the response of this operation. TTL is the absolute
+// expiry timestamp of the key in milliseconds, zero means that the key doesn't expire.
+// Timestamp is the version of the key, the hybrid logical clock of its last write in nanoseconds.
+type GetExExtra struct {
+	TTL       int64
+	Timestamp int64
+}
+
+// GetEntryExtra defines extra values for the response of this operation. TTL is the same with GetExExtra.
+// LastAccess is the last access time of the key in nanoseconds, zero means that it's not tracked. The value
+// of the message is the address of the owner followed by the value, OwnerLen is the length of the address.
+type GetEntryExtra struct {
+	TTL        int64
+	LastAccess int64
+	PartID     uint64
+	OwnerLen   uint16
+}
+
+// PutBackupExtra defines extra values for this operation. TTL and Timestamp are set by
+// the primary owner, like GetExExtra. The backup owners ignore the writes which are older
+// than their replicas.
+type PutBackupExtra struct {
+	TTL       int64
+	Timestamp int64
+}
+
+// LenExtra defines extra values for the response of this operation.
+type LenExtra struct {
+	Count uint64
+}
+
+// MovedExtra defines extra values for the responses with StatusMoved.
+type MovedExtra struct {
+	PartID uint64
+}
+
+// ScanExtra defines the cursor of scan operations. Offset is the smallest hkey to return
+// on the partition. Generation is taken by the owner when the scan reaches the partition, the
+// keys inserted after it are skipped. It's zero until the first batch of the partition, and in
+// the frames older than GenerationVersion.
+type ScanExtra struct {
+	PartID     uint64
+	Offset     uint64
+	Generation uint64
+}
+
+// QueryExtra defines the cursor of query operations like ScanExtra. If Regexp is not zero, the pattern
+// in the value of the message is a regular expression instead of a glob pattern.
+type QueryExtra struct {
+	PartID     uint64
+	Offset     uint64
+	Regexp     uint8
+	Generation uint64
+}
+
 // IsPartEmptyExtra defines extra values for this operation.
 type IsPartEmptyExtra struct {
 	PartID uint64
 }
 
+// HelloExtra defines extra values for this operation.
+type HelloExtra struct {
+	MaxVersion uint8
+}
+
+// MerkleExtra defines extra values for the anti-entropy operations. Level is the level of the nodes
+// in the value of an OpMerkleSubtree request, the root is at level zero.
+type MerkleExtra struct {
+	PartID uint64
+	Level  uint8
+}
+
 // ErrConnClosed means that the underlying TCP connection has been closed
 // by the client or operating system.
 var ErrConnClosed = errors.New("connection closed")
 
+// IsFramingError reports whether Read failed before it found the end of the message, so the rest of the
+// message can't be told from the next one and the connection must be closed. Read consumes the whole
+// message before returning the other errors, the connection is still usable after them.
+func IsFramingError(err error) bool {
+	return err == ErrInvalidMessage || err == ErrUnsupportedVersion || err == ErrMalformedMessage
+}
+
 func filterNetworkErrors(err error) error {
 	if err == nil {
 		return nil
@@ -142,83 +631,343 @@ func filterNetworkErrors(err error) error {
 	return err
 }
 
+// readN reads exactly n bytes into buf, like io.CopyN. The same io.LimitedReader is used
+// for consecutive reads of a message, io.CopyN allocates a new one on every call. The bytes
+// may arrive in any number of short reads. It returns io.EOF if the connection is closed
+// before the message, and io.ErrUnexpectedEOF if it's closed in the middle of the message.
+func (m *Message) readN(buf *bytes.Buffer, lr *io.LimitedReader, n int64) error {
+	lr.N = n
+	written, err := buf.ReadFrom(lr)
+	m.wire += written
+	if written < n && err == nil {
+		err = io.EOF
+	}
+	if err == io.EOF && m.wire != 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return filterNetworkErrors(err)
+}
+
 // Read reads a whole protocol message(including the value) from given connection
 // by decoding it.
 func (m *Message) Read(conn io.Reader) error {
+	// The message may be reused.
+	m.Extra, m.Value, m.Trace = nil, nil, nil
+	m.wire = 0
+
 	buf := pool.Get()
 	defer pool.Put(buf)
 
-	_, err := io.CopyN(buf, conn, headerSize)
-	if err != nil {
-		return filterNetworkErrors(err)
-	}
-	err = binary.Read(buf, binary.BigEndian, &m.Header)
-	if err != nil {
-		return err
+	lr := &io.LimitedReader{R: conn}
+	if m.Legacy {
+		err := m.readN(buf, lr, legacyHeaderSize)
+		if err != nil {
+			return err
+		}
+		decodeLegacyHeader(buf.Next(int(legacyHeaderSize)), &m.Header)
+	} else {
+		err := m.readN(buf, lr, headerSize)
+		if err != nil {
+			return err
+		}
+		decodeHeader(buf.Next(int(headerSize)), &m.Header)
 	}
 	if m.Magic != MagicReq && m.Magic != MagicRes {
-		return fmt.Errorf("invalid message")
+		return ErrInvalidMessage
+	}
+	if !m.Legacy && (m.Version < FlagsVersion || m.Version > MaxProtocolVersion) {
+		return ErrUnsupportedVersion
+	}
+	var err error
+	m.RequestID = 0
+	if m.Version >= RequestIDVersion {
+		err = m.readN(buf, lr, requestIDSize)
+		if err != nil {
+			return err
+		}
+		m.RequestID = binary.BigEndian.Uint32(buf.Next(requestIDSize))
 	}
 
-	vlen := int(m.BodyLen) - int(m.ExtraLen) - int(m.KeyLen) - int(m.DMapLen)
-	if vlen > MaxValueSize {
-		return ErrValueTooBig
+	bodyLen := int64(m.BodyLen)
+	if m.Flags&FlagLargeBody != 0 {
+		err = m.readN(buf, lr, extendedHeaderSize)
+		if err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint64(buf.Next(extendedHeaderSize))
+		if m.BodyLen != 0 || n > math.MaxInt64 {
+			return ErrMalformedMessage
+		}
+		bodyLen = int64(n)
 	}
 
-	_, err = io.CopyN(buf, conn, int64(m.BodyLen))
+	vlen := bodyLen - int64(m.ExtraLen) - int64(m.KeyLen) - int64(m.DMapLen)
+	if m.Flags&FlagChecksum != 0 {
+		vlen -= checksumSize
+	}
+	if m.Flags&FlagTraced != 0 {
+		vlen -= traceContextSize
+	}
+	if vlen < 0 || int64(m.ExtraLen) > bodyLen ||
+		int64(m.DMapLen) > bodyLen || int64(m.KeyLen) > bodyLen {
+		return ErrMalformedMessage
+	}
+	if int(m.KeyLen) > MaxKeyLen {
+		return m.discard(conn, bodyLen, ErrKeyTooBig)
+	}
+	if int(m.DMapLen) > MaxDMapLen {
+		return m.discard(conn, bodyLen, ErrDMapTooBig)
+	}
+
+	// The value size limit depends on the DMap. Read the extras and the DMap name first,
+	// so the body is not read before the limit is checked.
+	head := int64(m.ExtraLen) + int64(m.DMapLen)
+	err = m.readN(buf, lr, head)
 	if err != nil {
-		return filterNetworkErrors(err)
+		return err
+	}
+	dmap := string(buf.Bytes()[m.ExtraLen:])
+	maxValueSize := MaxValueSizeFor(dmap)
+	if vlen > int64(maxValueSize) {
+		return m.discard(conn, bodyLen-head, &ValueTooBigError{Size: int(vlen), Limit: maxValueSize})
+	}
+
+	err = m.readN(buf, lr, bodyLen-head)
+	if err != nil {
+		return err
 	}
-	// TODO: Move this block outside this function
-	if m.Magic == MagicReq && m.ExtraLen > 0 {
-		raw := buf.Next(int(m.ExtraLen))
-		if m.Op == OpExPutEx {
-			p := PutExExtra{}
-			err = binary.Read(bytes.NewReader(raw), binary.BigEndian, &p)
-			m.Extra = p
-		} else if m.Op == OpExLockWithTimeout || m.Op == OpLockPrev {
-			p := LockWithTimeoutExtra{}
-			err = binary.Read(bytes.NewReader(raw), binary.BigEndian, &p)
-			m.Extra = p
-		} else if m.Op == OpIsPartEmpty || m.Op == OpIsBackupEmpty {
-			p := IsPartEmptyExtra{}
-			err = binary.Read(bytes.NewReader(raw), binary.BigEndian, &p)
-			m.Extra = p
+	if m.Flags&FlagChecksum != 0 {
+		err = verifyChecksum(buf)
+		if err != nil {
+			return err
 		}
+	}
+	if m.Flags&FlagTraced != 0 {
+		m.Trace = decodeTraceContext(buf)
+	}
+	if m.ExtraLen > 0 {
+		m.Extra, err = decodeExtra(m.Op, m.Status, buf.Next(int(m.ExtraLen)))
 		if err != nil {
 			return err
 		}
 	}
-	m.DMap = string(buf.Next(int(m.DMapLen)))
+	buf.Next(int(m.DMapLen))
+	m.DMap = dmap
 	m.Key = string(buf.Next(int(m.KeyLen)))
-	if vlen != 0 {
+	if vlen == 0 {
+		return nil
+	}
+	if m.Flags&FlagCompressed != 0 {
+		return m.decompress(buf.Next(int(vlen)), maxValueSize)
+	}
+	if m.ValueBuf != nil {
+		if int64(cap(m.ValueBuf)) < vlen {
+			m.ValueBuf = make([]byte, vlen)
+		}
+		m.ValueBuf = m.ValueBuf[:vlen]
+		m.Value = m.ValueBuf
+	} else {
 		m.Value = make([]byte, vlen)
-		copy(m.Value, buf.Next(vlen))
 	}
+	copy(m.Value, buf.Next(int(vlen)))
+	return nil
+}
+
+// discard skips the next n bytes of a rejected message without buffering them and returns reason, so the
+// connection is still usable for the next message.
+func (m *Message) discard(conn io.Reader, n int64, reason error) error {
+	discarded, err := io.CopyN(ioutil.Discard, conn, n)
+	m.wire += discarded
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return filterNetworkErrors(err)
+	}
+	return reason
+}
+
+// encodeLegacyHeader encodes the header of LegacyProtocolVersion into b and returns its length.
+func encodeLegacyHeader(b []byte, h *Header) int {
+	b[0] = byte(h.Magic)
+	b[1] = byte(h.Op)
+	binary.BigEndian.PutUint16(b[2:4], h.DMapLen)
+	binary.BigEndian.PutUint16(b[4:6], h.KeyLen)
+	b[6] = h.ExtraLen
+	b[7] = byte(h.Status)
+	binary.BigEndian.PutUint32(b[8:12], h.BodyLen)
+	return int(legacyHeaderSize)
+}
+
+// decodeLegacyHeader decodes the header of LegacyProtocolVersion.
+func decodeLegacyHeader(b []byte, h *Header) {
+	h.Magic = MagicCode(b[0])
+	h.Version = LegacyProtocolVersion
+	h.Op = OpCode(b[1])
+	h.DMapLen = binary.BigEndian.Uint16(b[2:4])
+	h.KeyLen = binary.BigEndian.Uint16(b[4:6])
+	h.ExtraLen = b[6]
+	h.Status = StatusCode(b[7])
+	h.Flags = 0
+	h.BodyLen = binary.BigEndian.Uint32(b[8:12])
+}
+
+// encodeHeader encodes the header of the protocol version of h into b and returns its length.
+func encodeHeader(b []byte, h *Header) int {
+	b[0] = byte(h.Magic)
+	b[1] = h.Version
+	b[2] = byte(h.Op)
+	binary.BigEndian.PutUint16(b[3:5], h.DMapLen)
+	binary.BigEndian.PutUint16(b[5:7], h.KeyLen)
+	b[7] = h.ExtraLen
+	b[8] = byte(h.Status)
+	b[9] = byte(h.Flags)
+	binary.BigEndian.PutUint32(b[10:14], h.BodyLen)
+	if h.Version < RequestIDVersion {
+		return int(headerSize)
+	}
+	binary.BigEndian.PutUint32(b[14:18], h.RequestID)
+	return int(headerSize) + requestIDSize
+}
+
+// decodeHeader decodes the header of protocol version 1 without using reflection, binary.Read allocates
+// on every call and this is the hottest path of the protocol.
+func decodeHeader(b []byte, h *Header) {
+	h.Magic = MagicCode(b[0])
+	h.Version = b[1]
+	h.Op = OpCode(b[2])
+	h.DMapLen = binary.BigEndian.Uint16(b[3:5])
+	h.KeyLen = binary.BigEndian.Uint16(b[5:7])
+	h.ExtraLen = b[7]
+	h.Status = StatusCode(b[8])
+	h.Flags = Flag(b[9])
+	h.BodyLen = binary.BigEndian.Uint32(b[10:14])
+}
+
+func (m *Message) decompress(raw []byte, maxValueSize int) error {
+	if Codec == nil {
+		return ErrNoCodec
+	}
+	value, err := Codec.Decompress(raw, maxValueSize)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxValueSize {
+		// The rest of the value is not decompressed, its size is unknown.
+		return &ValueTooBigError{Size: len(value), Limit: maxValueSize}
+	}
+	m.Value = value
+	return nil
+}
+
+// verifyChecksum strips the CRC32 checksum from the end of the body and compares
+// it with the body, if VerifyChecksums is enabled.
+func verifyChecksum(buf *bytes.Buffer) error {
+	if buf.Len() < checksumSize {
+		return ErrChecksumMismatch
+	}
+	body := buf.Bytes()
+	payload := body[:len(body)-checksumSize]
+	if VerifyChecksums {
+		sum := binary.BigEndian.Uint32(body[len(body)-checksumSize:])
+		if crc32.Checksum(payload, crcTable) != sum {
+			return ErrChecksumMismatch
+		}
+	}
+	buf.Truncate(len(payload))
 	return nil
 }
 
+// decodeTraceContext strips the trace context from the end of the body. The length of the body
+// has already been checked.
+func decodeTraceContext(buf *bytes.Buffer) *TraceContext {
+	body := buf.Bytes()
+	b := body[len(body)-traceContextSize:]
+	tc := &TraceContext{Flags: b[24]}
+	copy(tc.TraceID[:], b[:16])
+	copy(tc.SpanID[:], b[16:24])
+	buf.Truncate(len(body) - traceContextSize)
+	return tc
+}
+
 // Write writes a protocol message to given TCP connection by encoding it.
 func (m *Message) Write(conn io.Writer) error {
 	buf := pool.Get()
 	defer pool.Put(buf)
+	m.wire = 0
 
+	if m.Legacy {
+		// The legacy frames carry no flags.
+		m.Version, m.Flags, m.RequestID = LegacyProtocolVersion, 0, 0
+	} else if m.Version < FlagsVersion || m.Version > MaxProtocolVersion {
+		m.Version = MaxProtocolVersion
+	}
 	m.DMapLen = uint16(len(m.DMap))
 	m.KeyLen = uint16(len(m.Key))
 	if m.Extra != nil {
-		m.ExtraLen = uint8(binary.Size(m.Extra))
+		m.ExtraLen = uint8(extraSize(m.Op, m.Status, m.Version, m.Extra))
+	}
+	// Keys, DMap names and extras are never compressed. So the servers can route
+	// the messages without decompressing them.
+	value := m.Value
+	if Codec != nil && len(value) > CompressionThreshold && !m.Legacy {
+		value = Codec.Compress(value)
+		m.Flags |= FlagCompressed
+	} else {
+		m.Flags &^= FlagCompressed
 	}
-	m.BodyLen = uint32(len(m.DMap) + len(m.Key) + len(m.Value) + int(m.ExtraLen))
-	err := binary.Write(buf, binary.BigEndian, m.Header)
+	trace := m.Trace != nil && !m.Legacy
+	checksum := VerifyChecksums && !m.Legacy
+	bodyLen := uint64(len(m.DMap) + len(m.Key) + len(value) + int(m.ExtraLen))
+	if trace {
+		m.Flags |= FlagTraced
+		bodyLen += traceContextSize
+	} else {
+		m.Flags &^= FlagTraced
+	}
+	if checksum {
+		m.Flags |= FlagChecksum
+		bodyLen += checksumSize
+	} else {
+		m.Flags &^= FlagChecksum
+	}
+	if bodyLen > maxBodyLen {
+		if m.Legacy {
+			return &ValueTooBigError{Size: len(value), Limit: int(maxBodyLen)}
+		}
+		m.Flags |= FlagLargeBody
+	}
+	if m.Flags&FlagLargeBody != 0 {
+		m.BodyLen = 0
+	} else {
+		m.BodyLen = uint32(bodyLen)
+	}
+	var header [headerSize + requestIDSize]byte
+	var headerLen int
+	if m.Legacy {
+		headerLen = encodeLegacyHeader(header[:], &m.Header)
+	} else {
+		headerLen = encodeHeader(header[:], &m.Header)
+	}
+	_, err := buf.Write(header[:headerLen])
 	if err != nil {
 		return err
 	}
+	if m.Flags&FlagLargeBody != 0 {
+		err = binary.Write(buf, binary.BigEndian, bodyLen)
+		if err != nil {
+			return err
+		}
+	}
+	body := buf.Len()
 
 	if m.Extra != nil {
 		err = binary.Write(buf, binary.BigEndian, m.Extra)
 		if err != nil {
 			return err
 		}
+		// Drop the fields which are newer than the version of the frame.
+		buf.Truncate(body + int(m.ExtraLen))
 	}
 
 	_, err = buf.WriteString(m.DMap)
@@ -231,15 +980,51 @@ func (m *Message) Write(conn io.Writer) error {
 		return err
 	}
 
-	_, err = buf.Write(m.Value)
+	_, err = buf.Write(value)
 	if err != nil {
 		return err
 	}
 
-	_, err = buf.WriteTo(conn)
+	if trace {
+		buf.Write(m.Trace.TraceID[:])
+		buf.Write(m.Trace.SpanID[:])
+		buf.WriteByte(m.Trace.Flags)
+	}
+
+	if checksum {
+		sum := crc32.Checksum(buf.Bytes()[body:], crcTable)
+		err = binary.Write(buf, binary.BigEndian, sum)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.wire, err = buf.WriteTo(conn)
 	return filterNetworkErrors(err)
 }
 
+// Size returns the number of bytes read or written by the last Read or Write, including the header.
+// It's the length of the message on the wire, unless Read or Write has failed in the middle of it.
+func (m *Message) Size() int {
+	return int(m.wire)
+}
+
+// Reset zeroes the message, so it can be reused for another Read or Write. Value and ValueBuf are
+// truncated to length zero, their capacities are kept and ValueBuf is reused by the next Read.
+//
+// The caller must not keep a reference to Value after Reset, the next Read may overwrite its contents.
+// Copy it before resetting the message if it's still needed.
+func (m *Message) Reset() {
+	m.Header = Header{}
+	m.Extra, m.Trace = nil, nil
+	m.DMap, m.Key = "", ""
+	m.Value = m.Value[:0]
+	m.ValueBuf = m.ValueBuf[:0]
+	m.Legacy = false
+	m.wire = 0
+	m.ctx = nil
+}
+
 // Error generates an error message for the request.
 func (m *Message) Error(status StatusCode, err interface{}) *Message {
 	var value []byte
@@ -251,11 +1036,14 @@ func (m *Message) Error(status StatusCode, err interface{}) *Message {
 	}
 	return &Message{
 		Header: Header{
-			Magic:  MagicRes,
-			Op:     m.Op,
-			Status: status,
+			Magic:     MagicRes,
+			Version:   m.Version,
+			Op:        m.Op,
+			Status:    status,
+			RequestID: m.RequestID,
 		},
-		Value: value,
+		Value:  value,
+		Legacy: m.Legacy,
 	}
 }
 
@@ -263,9 +1051,12 @@ func (m *Message) Error(status StatusCode, err interface{}) *Message {
 func (m *Message) Success() *Message {
 	return &Message{
 		Header: Header{
-			Magic:  MagicRes,
-			Op:     m.Op,
-			Status: StatusOK,
+			Magic:     MagicRes,
+			Version:   m.Version,
+			Op:        m.Op,
+			Status:    StatusOK,
+			RequestID: m.RequestID,
 		},
+		Legacy: m.Legacy,
 	}
 }
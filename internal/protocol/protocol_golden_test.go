@@ -0,0 +1,526 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var (
+	update      = flag.Bool("update", false, "rewrite the golden frames in testdata")
+	conformance = flag.String("conformance", "", "command of a client implementation to run the conformance harness against")
+)
+
+var goldenFramesPath = filepath.Join("testdata", "frames.json")
+
+// lastStatus is the last status code of the corpus. Update it when a status code is appended.
+const lastStatus = StatusQuorumLost
+
+// goldenFrame is a recorded frame and its decoded fields. The integers in the extras are decimal strings,
+// so they survive the JSON decoders which read every number as a float64. See PROTOCOL.md.
+type goldenFrame struct {
+	Name    string `json:"name,omitempty"`
+	Magic   uint8  `json:"magic"`
+	Version uint8  `json:"version"`
+	OpCode  uint8  `json:"opcode"`
+	Op      string `json:"op"`
+	Status  uint8  `json:"status"`
+	Flags   uint8  `json:"flags"`
+	// RequestID is omitted in the frames of protocol versions 0 and 1.
+	RequestID uint32       `json:"requestId,omitempty"`
+	Extra     *goldenExtra `json:"extra,omitempty"`
+	DMap      string       `json:"dmap"`
+	Key       string       `json:"key"`
+	Value     string       `json:"value"`
+	Trace     string       `json:"trace,omitempty"`
+	Frame     string       `json:"frame"`
+	Error     string       `json:"error,omitempty"`
+}
+
+type goldenExtra struct {
+	Type   string            `json:"type"`
+	Fields map[string]string `json:"fields"`
+}
+
+// frameOf returns the decoded fields of a message and its encoding.
+func frameOf(m *Message, raw []byte) goldenFrame {
+	f := goldenFrame{
+		Magic:     uint8(m.Magic),
+		Version:   m.Version,
+		OpCode:    uint8(m.Op),
+		Op:        m.Op.String(),
+		Status:    uint8(m.Status),
+		Flags:     uint8(m.Flags),
+		RequestID: m.RequestID,
+		DMap:      m.DMap,
+		Key:       m.Key,
+		Value:     hex.EncodeToString(m.Value),
+		Frame:     hex.EncodeToString(raw),
+	}
+	if m.Extra != nil {
+		v := reflect.ValueOf(m.Extra)
+		f.Extra = &goldenExtra{Type: v.Type().Name(), Fields: make(map[string]string)}
+		for i := 0; i < v.NumField(); i++ {
+			f.Extra.Fields[v.Type().Field(i).Name] = fmt.Sprint(v.Field(i).Interface())
+		}
+	}
+	if m.Trace != nil {
+		var b bytes.Buffer
+		b.Write(m.Trace.TraceID[:])
+		b.Write(m.Trace.SpanID[:])
+		b.WriteByte(m.Trace.Flags)
+		f.Trace = hex.EncodeToString(b.Bytes())
+	}
+	return f
+}
+
+// sequence returns n bytes counting up from 1. The fields of an extra decoded from it have distinct bytes,
+// so a wrong field order or byte order changes the decoded values.
+func sequence(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i + 1)
+	}
+	return b
+}
+
+// extraOf returns the extra of the operation with the given status filled with sequence, or nil if it
+// doesn't have one in the given protocol version.
+func extraOf(t *testing.T, version uint8, op OpCode, status StatusCode) interface{} {
+	var size int
+	if status == StatusMoved {
+		size = binary.Size(MovedExtra{})
+	} else if factory, ok := extras[op]; ok {
+		size = extraSize(op, status, version, factory())
+	}
+	if size == 0 {
+		return nil
+	}
+	extra, err := decodeExtra(op, status, sequence(size))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	return extra
+}
+
+// goldenRequestID is the request ID of the frames of protocol version 2 and later.
+const goldenRequestID = 0x01020304
+
+type goldenMessage struct {
+	name     string
+	msg      *Message
+	checksum bool
+}
+
+// goldenMessages returns the messages of the corpus: the messages of every protocol version since
+// FlagsVersion and the legacy messages.
+func goldenMessages(t *testing.T) []goldenMessage {
+	var messages []goldenMessage
+	for version := FlagsVersion; version <= ProtocolVersion; version++ {
+		messages = append(messages, versionMessages(t, version)...)
+	}
+	return append(messages,
+		goldenMessage{name: "Hello request with version 0", msg: &Message{
+			Header: Header{Magic: MagicReq, Op: OpHello},
+			Extra:  extraOf(t, LegacyProtocolVersion, OpHello, StatusOK),
+			Legacy: true,
+		}},
+		goldenMessage{name: "Hello response with version 0", msg: &Message{
+			Header: Header{Magic: MagicRes, Op: OpHello},
+			Extra:  extraOf(t, LegacyProtocolVersion, OpHello, StatusOK),
+			Legacy: true,
+		}},
+		goldenMessage{name: "ExPut request with version 0", msg: &Message{
+			Header: Header{Magic: MagicReq, Op: OpExPut},
+			Extra:  extraOf(t, LegacyProtocolVersion, OpExPut, StatusOK),
+			DMap:   "mydmap",
+			Key:    "mykey",
+			Value:  []byte("myvalue"),
+			Legacy: true,
+		}},
+		goldenMessage{name: "ExPutEx request with version 0", msg: &Message{
+			Header: Header{Magic: MagicReq, Op: OpExPutEx},
+			Extra:  extraOf(t, LegacyProtocolVersion, OpExPutEx, StatusOK),
+			DMap:   "mydmap",
+			Key:    "mykey",
+			Value:  []byte("myvalue"),
+			Legacy: true,
+		}},
+		goldenMessage{name: "ExGet response with version 0", msg: &Message{
+			Header: Header{Magic: MagicRes, Op: OpExGet},
+			Value:  []byte("myvalue"),
+			Legacy: true,
+		}},
+		goldenMessage{name: "ExGet response with version 0 and status 2", msg: &Message{
+			Header: Header{Magic: MagicRes, Op: OpExGet, Status: StatusKeyNotFound},
+			Value:  []byte("error message"),
+			Legacy: true,
+		}},
+	)
+}
+
+// versionMessages returns the messages of the given protocol version: a request and a response for every
+// opcode with its extra, an error response for every status code and the messages with the optional parts
+// of a frame. The messages of FlagsVersion keep the names of the first corpus, the names of the later
+// versions have their version.
+func versionMessages(t *testing.T, version uint8) []goldenMessage {
+	name := func(base string, with ...string) string {
+		if version != FlagsVersion {
+			with = append([]string{fmt.Sprintf("version %d", version)}, with...)
+		}
+		if len(with) == 0 {
+			return base
+		}
+		return base + " with " + strings.Join(with, " and ")
+	}
+	header := func(magic MagicCode, op OpCode) Header {
+		h := Header{Magic: magic, Version: version, Op: op}
+		if version >= RequestIDVersion {
+			h.RequestID = goldenRequestID
+		}
+		return h
+	}
+
+	var ops []OpCode
+	for op := range opNames {
+		// OpHello is sent with the legacy version since RequestIDVersion.
+		if op == OpHello && version >= RequestIDVersion {
+			continue
+		}
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i] < ops[j] })
+
+	var messages []goldenMessage
+	for _, op := range ops {
+		messages = append(messages, goldenMessage{
+			name: name(op.String() + " request"),
+			msg: &Message{
+				Header: header(MagicReq, op),
+				Extra:  extraOf(t, version, op, StatusOK),
+				DMap:   "mydmap",
+				Key:    "mykey",
+				Value:  []byte("myvalue"),
+			},
+		})
+		messages = append(messages, goldenMessage{
+			name: name(op.String() + " response"),
+			msg: &Message{
+				Header: header(MagicRes, op),
+				Extra:  extraOf(t, version, op, StatusOK),
+				Value:  []byte("myvalue"),
+			},
+		})
+	}
+	for status := StatusOK + 1; status <= lastStatus; status++ {
+		m := &Message{Header: header(MagicRes, OpExGet)}
+		m.Status = status
+		if status == StatusMoved {
+			m.Extra = extraOf(t, version, OpExGet, status)
+			m.Value = []byte("127.0.0.1:3320")
+		} else {
+			m.Value = []byte("error message")
+		}
+		messages = append(messages, goldenMessage{name: name("ExGet response", fmt.Sprintf("status %d", status)), msg: m})
+	}
+
+	trace := &TraceContext{Flags: 1}
+	copy(trace.TraceID[:], sequence(16))
+	copy(trace.SpanID[:], sequence(24)[16:])
+	request := func(flags Flag, trace *TraceContext) *Message {
+		m := &Message{
+			Header: header(MagicReq, OpExPutEx),
+			Extra:  extraOf(t, version, OpExPutEx, StatusOK),
+			DMap:   "mydmap",
+			Key:    "mykey",
+			Value:  []byte("myvalue"),
+			Trace:  trace,
+		}
+		m.Flags = flags
+		return m
+	}
+	redirect := &Message{
+		Header: header(MagicReq, OpExGet),
+		DMap:   "mydmap",
+		Key:    "mykey",
+	}
+	redirect.Flags = FlagRedirect
+	withoutValue := request(0, nil)
+	withoutValue.Value = nil
+	return append(messages,
+		goldenMessage{name: name("ExGet request", "FlagRedirect"), msg: redirect},
+		goldenMessage{name: name("ExPutEx request", "FlagChecksum"), msg: request(0, nil), checksum: true},
+		goldenMessage{name: name("ExPutEx request", "FlagTraced"), msg: request(0, trace)},
+		goldenMessage{name: name("ExPutEx request", "FlagTraced", "FlagChecksum"), msg: request(0, trace), checksum: true},
+		goldenMessage{name: name("ExPutEx request", "FlagLargeBody"), msg: request(FlagLargeBody, nil)},
+		goldenMessage{name: name("ExPutEx request", "FlagLargeBody", "FlagChecksum"), msg: request(FlagLargeBody, nil),
+			checksum: true},
+		goldenMessage{name: name("ExPutEx request without value"), msg: withoutValue},
+	)
+}
+
+// withChecksums runs fn with VerifyChecksums set to enabled.
+func withChecksums(enabled bool, fn func() error) error {
+	prev := VerifyChecksums
+	VerifyChecksums = enabled
+	defer func() {
+		VerifyChecksums = prev
+	}()
+	return fn()
+}
+
+func generateGoldenFrames(t *testing.T) []goldenFrame {
+	var frames []goldenFrame
+	for _, g := range goldenMessages(t) {
+		var buf bytes.Buffer
+		err := withChecksums(g.checksum, func() error {
+			return g.msg.Write(&buf)
+		})
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", g.name, err)
+		}
+		f := frameOf(g.msg, buf.Bytes())
+		f.Name = g.name
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+func loadGoldenFrames(t *testing.T) []goldenFrame {
+	data, err := ioutil.ReadFile(goldenFramesPath)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var frames []goldenFrame
+	if err = json.Unmarshal(data, &frames); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	return frames
+}
+
+// roundTripFrames is the client implementation of this package for the conformance harness. It decodes the
+// frames read from in, one per line with the protocol version of the connection, and writes the decoded fields
+// and the encoding of the decoded message to out as JSON, one per line.
+func roundTripFrames(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<20)
+	enc := json.NewEncoder(out)
+	for scanner.Scan() {
+		f := roundTripFrame(scanner.Text())
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// conformanceLine returns the input line of the conformance harness for a frame: the protocol version of the
+// connection and the hex encoded frame. The legacy frames don't carry their version.
+func conformanceLine(f goldenFrame) string {
+	return fmt.Sprintf("%d %s", f.Version, f.Frame)
+}
+
+func roundTripFrame(line string) goldenFrame {
+	var version uint8
+	var frame string
+	if _, err := fmt.Sscanf(line, "%d %s", &version, &frame); err != nil {
+		return goldenFrame{Error: err.Error()}
+	}
+	raw, err := hex.DecodeString(frame)
+	if err != nil {
+		return goldenFrame{Error: err.Error()}
+	}
+	m := Message{Legacy: version == LegacyProtocolVersion}
+	checksum := !m.Legacy && len(raw) > 9 && Flag(raw[9])&FlagChecksum != 0
+	err = withChecksums(checksum, func() error {
+		return m.Read(bytes.NewReader(raw))
+	})
+	if err != nil {
+		return goldenFrame{Error: err.Error()}
+	}
+	var buf bytes.Buffer
+	err = withChecksums(checksum, func() error {
+		return m.Write(&buf)
+	})
+	if err != nil {
+		return goldenFrame{Error: err.Error()}
+	}
+	return frameOf(&m, buf.Bytes())
+}
+
+// Test_GoldenFrames reads the recorded frames and writes them again. The decoded fields have to match with
+// the recorded ones, and the written bytes with the recorded frames. A deliberate change of the wire format
+// is recorded by running the test with -update.
+func Test_GoldenFrames(t *testing.T) {
+	generated := generateGoldenFrames(t)
+	if *update {
+		data, err := json.MarshalIndent(generated, "", "  ")
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if err = ioutil.WriteFile(goldenFramesPath, append(data, '\n'), 0644); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	frames := loadGoldenFrames(t)
+	for _, f := range frames {
+		raw, err := hex.DecodeString(f.Frame)
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", f.Name, err)
+		}
+		checksum := Flag(f.Flags)&FlagChecksum != 0
+
+		m := Message{Legacy: f.Version == LegacyProtocolVersion}
+		err = withChecksums(checksum, func() error {
+			return m.Read(bytes.NewReader(raw))
+		})
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", f.Name, err)
+		}
+		decoded := frameOf(&m, raw)
+		decoded.Name = f.Name
+		if !reflect.DeepEqual(decoded, f) {
+			t.Fatalf("Decoded frame of %s is different.\nExpected: %+v\nGot: %+v", f.Name, f, decoded)
+		}
+
+		var buf bytes.Buffer
+		err = withChecksums(checksum, func() error {
+			return m.Write(&buf)
+		})
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", f.Name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), raw) {
+			t.Fatalf("Written frame of %s is different.\nExpected: %x\nGot: %x", f.Name, raw, buf.Bytes())
+		}
+	}
+
+	// The corpus covers every opcode, extra type and status code, a new one has to be recorded.
+	if !reflect.DeepEqual(generated, frames) {
+		t.Fatalf("The recorded frames are out of date, run the test with -update and review the changes of %s",
+			goldenFramesPath)
+	}
+}
+
+func Test_GoldenFramesCoverage(t *testing.T) {
+	ops := make(map[string]bool)
+	types := make(map[string]bool)
+	for _, f := range loadGoldenFrames(t) {
+		if f.Magic == uint8(MagicReq) {
+			ops[f.Op] = true
+		}
+		if f.Extra != nil {
+			types[f.Extra.Type] = true
+		}
+	}
+	for op, name := range opNames {
+		if !ops[name] {
+			t.Fatalf("Expected a request frame for %s", op)
+		}
+	}
+	extraTypes := []interface{}{MovedExtra{}}
+	for _, factory := range extras {
+		extraTypes = append(extraTypes, factory())
+	}
+	for _, extra := range extraTypes {
+		name := reflect.Indirect(reflect.ValueOf(extra)).Type().Name()
+		if !types[name] {
+			t.Fatalf("Expected a frame with %s", name)
+		}
+	}
+}
+
+// Test_Conformance runs the conformance harness against a client implementation. It runs against this
+// package by default, the command of another implementation is given with -conformance:
+//
+//	go test ./internal/protocol -run Test_Conformance -conformance "python3 roundtrip.py"
+//
+// The command reads the frames from its stdin, one per line: the protocol version of the connection and the
+// hex encoded frame, separated by a space. For every frame, it writes a line of
+// JSON to its stdout: the decoded fields and the encoding of the decoded message, in the format of the
+// recorded frames. See PROTOCOL.md.
+func Test_Conformance(t *testing.T) {
+	var (
+		in  io.WriteCloser
+		out io.Reader
+	)
+	if *conformance == "" {
+		inr, inw := io.Pipe()
+		outr, outw := io.Pipe()
+		go func() {
+			outw.CloseWithError(roundTripFrames(inr, outw))
+		}()
+		in, out = inw, outr
+	} else {
+		args := strings.Fields(*conformance)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		var err error
+		if in, err = cmd.StdinPipe(); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if out, err = cmd.StdoutPipe(); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if err = cmd.Start(); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		defer func() {
+			if err := cmd.Wait(); err != nil {
+				t.Errorf("Expected nil. Got: %v", err)
+			}
+		}()
+	}
+	defer in.Close()
+
+	results := bufio.NewReader(out)
+	for _, f := range loadGoldenFrames(t) {
+		if _, err := fmt.Fprintln(in, conformanceLine(f)); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		line, err := results.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", f.Name, err)
+		}
+		var got goldenFrame
+		if err = json.Unmarshal(line, &got); err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", f.Name, err)
+		}
+		if got.Error != "" {
+			t.Errorf("Expected nil for %s. Got: %s", f.Name, got.Error)
+			continue
+		}
+		got.Name = f.Name
+		if !reflect.DeepEqual(got, f) {
+			t.Errorf("Round trip of %s is different.\nExpected: %+v\nGot: %+v", f.Name, f, got)
+		}
+	}
+}
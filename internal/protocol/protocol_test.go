@@ -0,0 +1,912 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func newTestMessage() *Message {
+	return &Message{
+		Header: Header{
+			Magic: MagicReq,
+			Op:    OpExPutEx,
+		},
+		Extra: PutExExtra{TTL: 10},
+		DMap:  "mydmap",
+		Key:   "mykey",
+		Value: []byte("myvalue"),
+	}
+}
+
+// newVersionedTestMessage returns newTestMessage encoded with the given protocol version.
+func newVersionedTestMessage(version uint8) *Message {
+	m := newTestMessage()
+	m.Version = version
+	return m
+}
+
+func Test_Checksum(t *testing.T) {
+	VerifyChecksums = true
+	defer func() {
+		VerifyChecksums = false
+	}()
+
+	buf := new(bytes.Buffer)
+	err := newTestMessage().Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	var msg Message
+	err = msg.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if msg.Flags&FlagChecksum == 0 {
+		t.Fatalf("Expected FlagChecksum to be set")
+	}
+	if msg.Key != "mykey" || !bytes.Equal(msg.Value, []byte("myvalue")) {
+		t.Fatalf("Decoded message is different: %v", msg)
+	}
+
+	// Corrupt the value and try again.
+	raw := buf.Bytes()
+	raw[len(raw)-checksumSize-1] ^= 0xFF
+	var corrupted Message
+	err = corrupted.Read(bytes.NewReader(raw))
+	if err != ErrChecksumMismatch {
+		t.Fatalf("Expected ErrChecksumMismatch. Got: %v", err)
+	}
+}
+
+// unhex decodes the hex string of a golden message, the spaces between the fields are ignored.
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	return b
+}
+
+// Test_WireFormat pins the bytes written for representative messages. The clients in other languages
+// depend on them, a failure means that the wire format has changed.
+func Test_WireFormat(t *testing.T) {
+	tc := &TraceContext{Flags: 1}
+	for i := range tc.TraceID {
+		tc.TraceID[i] = byte(i)
+	}
+	for i := range tc.SpanID {
+		tc.SpanID[i] = byte(0x10 + i)
+	}
+
+	tests := []struct {
+		name     string
+		msg      *Message
+		checksum bool
+		// golden is magic, version, op, dmap length, key length, extra length, status, flags and body
+		// length, followed by the request ID since version 2 and the body.
+		golden string
+	}{
+		{
+			name: "request with extra",
+			msg:  newVersionedTestMessage(1),
+			golden: "e2 01 01 0006 0005 08 00 00 0000001a " +
+				"000000000000000a " + // PutExExtra{TTL: 10}, without Timestamp before version 2
+				"6d79646d6170 6d796b6579 6d7976616c7565", // mydmap, mykey, myvalue
+		},
+		{
+			name: "byte order of extra",
+			msg: &Message{
+				Header: Header{Magic: MagicReq, Version: 2, Op: OpExPutEx},
+				Extra:  PutExExtra{TTL: 0x0102030405060708, Timestamp: -2},
+				DMap:   "m",
+				Key:    "k",
+			},
+			golden: "e2 02 01 0001 0001 10 00 00 00000012 00000000 " +
+				"0102030405060708 fffffffffffffffe " +
+				"6d 6b",
+		},
+		{
+			name: "request with extra of version 0",
+			msg: &Message{
+				Header: Header{Magic: MagicReq, Op: OpExPutEx},
+				Extra:  PutExExtra{TTL: 10, Timestamp: 20},
+				DMap:   "m",
+				Key:    "k",
+				Legacy: true,
+			},
+			golden: "e2 01 0001 0001 08 00 0000000a " +
+				"000000000000000a " +
+				"6d 6b",
+		},
+		{
+			name: "error response",
+			msg:  (&Message{Header: Header{Magic: MagicReq, Version: 1, Op: OpExGet}}).Error(StatusKeyNotFound, "key not found"),
+			golden: "e3 01 02 0000 0000 00 02 00 0000000d " +
+				"6b6579206e6f7420666f756e64",
+		},
+		{
+			name: "traced request with checksum",
+			msg: &Message{
+				Header: Header{Magic: MagicReq, Version: 1, Op: OpExGet},
+				DMap:   "d",
+				Key:    "k",
+				Trace:  tc,
+			},
+			checksum: true,
+			golden: "e2 01 02 0001 0001 00 00 05 0000001f " +
+				"64 6b " +
+				"000102030405060708090a0b0c0d0e0f 1011121314151617 01 " + // trace ID, span ID, flags
+				"5c16ff12", // CRC32-C of the body
+		},
+		{
+			name: "request with request ID",
+			msg: &Message{
+				Header: Header{Magic: MagicReq, Version: 2, Op: OpExGet, RequestID: 0x01020304},
+				DMap:   "d",
+				Key:    "k",
+			},
+			golden: "e2 02 02 0001 0001 00 00 00 00000002 01020304 " +
+				"64 6b",
+		},
+		{
+			name: "response with request ID",
+			msg: (&Message{Header: Header{Magic: MagicReq, Version: 2, Op: OpExGet, RequestID: 7}}).
+				Error(StatusKeyNotFound, "key not found"),
+			golden: "e3 02 02 0000 0000 00 02 00 0000000d 00000007 " +
+				"6b6579206e6f7420666f756e64",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			VerifyChecksums = test.checksum
+			defer func() {
+				VerifyChecksums = false
+			}()
+
+			buf := new(bytes.Buffer)
+			err := test.msg.Write(buf)
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			golden := unhex(t, test.golden)
+			if !bytes.Equal(buf.Bytes(), golden) {
+				t.Fatalf("Wire format has changed.\nExpected: %x\nGot:      %x", golden, buf.Bytes())
+			}
+		})
+	}
+}
+
+func Test_ChecksumDisabled(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := newTestMessage().Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	var msg Message
+	err = msg.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if msg.Flags&FlagChecksum != 0 {
+		t.Fatalf("Expected FlagChecksum to be unset")
+	}
+	if !bytes.Equal(msg.Value, []byte("myvalue")) {
+		t.Fatalf("Decoded value is different: %s", msg.Value)
+	}
+}
+
+func Test_TraceContext(t *testing.T) {
+	VerifyChecksums = true
+	defer func() {
+		VerifyChecksums = false
+	}()
+	tc := &TraceContext{Flags: 1}
+	copy(tc.TraceID[:], "0123456789abcdef")
+	copy(tc.SpanID[:], "01234567")
+
+	msg := newTestMessage()
+	msg.Trace = tc
+	buf := new(bytes.Buffer)
+	err := msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// Reuse the message to check that the trace context is reset.
+	decoded := &Message{Trace: &TraceContext{}}
+	err = decoded.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if decoded.Flags&FlagTraced == 0 {
+		t.Fatalf("Expected FlagTraced to be set")
+	}
+	if decoded.Trace == nil || *decoded.Trace != *tc {
+		t.Fatalf("Decoded trace context is different: %v", decoded.Trace)
+	}
+	if !bytes.Equal(decoded.Value, []byte("myvalue")) {
+		t.Fatalf("Decoded value is different: %s", decoded.Value)
+	}
+
+	buf.Reset()
+	err = newTestMessage().Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = decoded.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if decoded.Trace != nil {
+		t.Fatalf("Expected a nil trace context. Got: %v", decoded.Trace)
+	}
+}
+
+func Test_UnsupportedVersion(t *testing.T) {
+	msg := newTestMessage()
+	msg.Version = MaxProtocolVersion + 1
+	buf := new(bytes.Buffer)
+	err := msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// Write never encodes a version higher than MaxProtocolVersion.
+	raw := buf.Bytes()
+	if raw[1] != MaxProtocolVersion {
+		t.Fatalf("Expected version %d. Got: %d", MaxProtocolVersion, raw[1])
+	}
+
+	raw[1] = MaxProtocolVersion + 1
+	var resp Message
+	err = resp.Read(bytes.NewReader(raw))
+	if err != ErrUnsupportedVersion {
+		t.Fatalf("Expected ErrUnsupportedVersion. Got: %v", err)
+	}
+}
+
+func Test_MalformedMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+	}{
+		{
+			name:   "body shorter than dmap",
+			header: Header{DMapLen: 10, BodyLen: 5},
+		},
+		{
+			name:   "body shorter than key",
+			header: Header{KeyLen: 10, BodyLen: 5},
+		},
+		{
+			name:   "body shorter than extra",
+			header: Header{ExtraLen: 10, BodyLen: 5},
+		},
+		{
+			name:   "body shorter than sum of lengths",
+			header: Header{DMapLen: 3, KeyLen: 3, ExtraLen: 3, BodyLen: 8},
+		},
+		{
+			name:   "body shorter than checksum",
+			header: Header{Flags: FlagChecksum, BodyLen: 2},
+		},
+		{
+			name:   "large body with BodyLen",
+			header: Header{Flags: FlagLargeBody, BodyLen: 8},
+		},
+		{
+			name:   "max lengths with empty body",
+			header: Header{DMapLen: 0xFFFF, KeyLen: 0xFFFF, ExtraLen: 0xFF},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header.Magic = MagicReq
+			tt.header.Version = ProtocolVersion
+			tt.header.Op = OpExPut
+			buf := new(bytes.Buffer)
+			err := binary.Write(buf, binary.BigEndian, tt.header)
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			buf.Write(make([]byte, tt.header.BodyLen))
+
+			var msg Message
+			err = msg.Read(buf)
+			if err != ErrMalformedMessage {
+				t.Fatalf("Expected ErrMalformedMessage. Got: %v", err)
+			}
+		})
+	}
+}
+
+func Test_LargeBody(t *testing.T) {
+	defer func(n uint64) {
+		maxBodyLen = n
+	}(maxBodyLen)
+	maxBodyLen = 16
+
+	for _, checksum := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		err := withChecksums(checksum, func() error {
+			return newTestMessage().Write(buf)
+		})
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		raw := buf.Bytes()
+		if Flag(raw[9])&FlagLargeBody == 0 {
+			t.Fatalf("Expected FlagLargeBody to be set")
+		}
+		if n := binary.BigEndian.Uint32(raw[10:14]); n != 0 {
+			t.Fatalf("Expected BodyLen to be zero. Got: %d", n)
+		}
+		if n := binary.BigEndian.Uint64(raw[18:26]); n != uint64(len(raw)-26) {
+			t.Fatalf("Expected body length %d. Got: %d", len(raw)-26, n)
+		}
+
+		var msg Message
+		err = withChecksums(checksum, func() error {
+			return msg.Read(bytes.NewReader(raw))
+		})
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if msg.DMap != "mydmap" || msg.Key != "mykey" || !bytes.Equal(msg.Value, []byte("myvalue")) {
+			t.Fatalf("Decoded message is different: %v", msg)
+		}
+		if msg.Extra.(PutExExtra).TTL != 10 {
+			t.Fatalf("Decoded extra is different: %v", msg.Extra)
+		}
+	}
+
+	// The smaller bodies are sent with the short header, unless the sender sets the flag.
+	maxBodyLen = math.MaxUint32
+	msg := newTestMessage()
+	buf := new(bytes.Buffer)
+	if err := msg.Write(buf); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if msg.Flags&FlagLargeBody != 0 || int64(buf.Len()) != headerSize+requestIDSize+int64(msg.BodyLen) {
+		t.Fatalf("Expected the short header. Got: %x", buf.Bytes())
+	}
+	msg.Flags |= FlagLargeBody
+	buf.Reset()
+	if err := msg.Write(buf); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if msg.BodyLen != 0 || int64(buf.Len()) != headerSize+requestIDSize+extendedHeaderSize+34 {
+		t.Fatalf("Expected the extended header. Got: %x", buf.Bytes())
+	}
+}
+
+func Test_KeyAndDMapTooBig(t *testing.T) {
+	MaxKeyLen, MaxDMapLen = 256, 1<<10
+	defer func() {
+		MaxKeyLen, MaxDMapLen = math.MaxUint16, math.MaxUint16
+	}()
+
+	msg := newTestMessage()
+	msg.Key = string(make([]byte, MaxKeyLen+1))
+	buf := new(bytes.Buffer)
+	err := msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	msg = newTestMessage()
+	msg.DMap = string(make([]byte, MaxDMapLen+1))
+	err = msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = newTestMessage().Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	var resp Message
+	err = resp.Read(buf)
+	if err != ErrKeyTooBig {
+		t.Fatalf("Expected ErrKeyTooBig. Got: %v", err)
+	}
+	err = resp.Read(buf)
+	if err != ErrDMapTooBig {
+		t.Fatalf("Expected ErrDMapTooBig. Got: %v", err)
+	}
+	// The bodies of the rejected messages are discarded, the next message is read.
+	err = resp.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Key != newTestMessage().Key {
+		t.Fatalf("Expected key %s. Got: %s", newTestMessage().Key, resp.Key)
+	}
+}
+
+func Test_DMapMaxValueSize(t *testing.T) {
+	SetDMapMaxValueSize("small", 4)
+	SetDMapMaxValueSize("large", 2*MaxValueSize)
+	defer func() {
+		SetDMapMaxValueSize("small", 0)
+		SetDMapMaxValueSize("large", 0)
+	}()
+
+	tests := []struct {
+		dmap  string
+		vlen  int
+		fails bool
+	}{
+		{"small", 4, false},
+		{"small", 5, true},
+		{"large", MaxValueSize + 1, false},
+		{"large", 2*MaxValueSize + 1, true},
+		{"mydmap", MaxValueSize + 1, true},
+	}
+	for _, tt := range tests {
+		msg := newTestMessage()
+		msg.DMap = tt.dmap
+		msg.Value = make([]byte, tt.vlen)
+		buf := new(bytes.Buffer)
+		err := msg.Write(buf)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		var resp Message
+		err = resp.Read(buf)
+		if tt.fails {
+			if !errors.Is(err, ErrValueTooBig) {
+				t.Fatalf("Expected ErrValueTooBig for %s. Got: %v", tt.dmap, err)
+			}
+			verr := err.(*ValueTooBigError)
+			if verr.Size != tt.vlen || verr.Limit != MaxValueSizeFor(tt.dmap) {
+				t.Fatalf("Expected size %d and limit %d for %s. Got: %d, %d",
+					tt.vlen, MaxValueSizeFor(tt.dmap), tt.dmap, verr.Size, verr.Limit)
+			}
+		}
+		if !tt.fails && err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", tt.dmap, err)
+		}
+		if !tt.fails && resp.DMap != tt.dmap {
+			t.Fatalf("Expected %s. Got: %s", tt.dmap, resp.DMap)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("Expected the whole message to be consumed. Remaining: %d", buf.Len())
+		}
+	}
+
+	// Responses don't carry a DMap name. They're checked against the largest limit.
+	if MaxValueSizeFor("") != 2*MaxValueSize {
+		t.Fatalf("Expected %d. Got: %d", 2*MaxValueSize, MaxValueSizeFor(""))
+	}
+}
+
+func Test_ReadRandomHeaders(t *testing.T) {
+	MaxKeyLen, MaxDMapLen = 256, 1<<10
+	defer func() {
+		MaxKeyLen, MaxDMapLen = math.MaxUint16, math.MaxUint16
+	}()
+
+	const seed = 20181015
+	r := rand.New(rand.NewSource(seed))
+	header := make([]byte, headerSize)
+	body := make([]byte, 1<<10)
+	for i := 0; i < 100000; i++ {
+		r.Read(header)
+		// Keep the header valid enough to reach the length checks.
+		header[0] = byte(MagicReq)
+		header[1] = ProtocolVersion
+		r.Read(body)
+
+		var msg Message
+		err := msg.Read(io.MultiReader(bytes.NewReader(header), bytes.NewReader(body)))
+		if err == nil {
+			if len(msg.Key) > MaxKeyLen || len(msg.DMap) > MaxDMapLen || len(msg.Value) > MaxValueSize {
+				t.Fatalf("Limits exceeded by decoded message of seed %d, iteration %d: %v", seed, i, header)
+			}
+		}
+	}
+}
+
+type testCodec struct{}
+
+func (c testCodec) Compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (c testCodec) Decompress(data []byte, limit int) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), int64(limit)+1))
+}
+
+func Test_Compression(t *testing.T) {
+	Codec = testCodec{}
+	defer func() {
+		Codec = nil
+	}()
+
+	msg := newTestMessage()
+	msg.Value = bytes.Repeat([]byte("a"), CompressionThreshold+1)
+	buf := new(bytes.Buffer)
+	err := msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if buf.Len() >= len(msg.Value) {
+		t.Fatalf("Expected a compressed message. Length: %d", buf.Len())
+	}
+
+	var resp Message
+	err = resp.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Flags&FlagCompressed == 0 {
+		t.Fatalf("Expected FlagCompressed to be set")
+	}
+	if resp.DMap != msg.DMap || resp.Key != msg.Key {
+		t.Fatalf("Decoded message is different: %v", resp)
+	}
+	if !bytes.Equal(resp.Value, msg.Value) {
+		t.Fatalf("Decompressed value is different")
+	}
+
+	// Small values are not compressed.
+	msg = newTestMessage()
+	err = msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if msg.Flags&FlagCompressed != 0 {
+		t.Fatalf("Expected FlagCompressed to be unset")
+	}
+}
+
+func Test_DecompressionBomb(t *testing.T) {
+	Codec = testCodec{}
+	defer func() {
+		Codec = nil
+	}()
+
+	// A tiny frame which decompresses to a value far over the limit.
+	msg := newTestMessage()
+	msg.Value = make([]byte, 64*MaxValueSize)
+	buf := new(bytes.Buffer)
+	err := msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if buf.Len() > MaxValueSize {
+		t.Fatalf("Expected a compressed message under the limit. Length: %d", buf.Len())
+	}
+	var resp Message
+	err = resp.Read(buf)
+	verr, ok := err.(*ValueTooBigError)
+	if !ok {
+		t.Fatalf("Expected ValueTooBigError. Got: %v", err)
+	}
+	if verr.Size != MaxValueSize+1 || verr.Limit != MaxValueSize {
+		t.Fatalf("Expected %d bytes decompressed at most. Got: %d", MaxValueSize+1, verr.Size)
+	}
+}
+
+func Test_RegisterExtra(t *testing.T) {
+	type testExtra struct {
+		A uint32
+		B int64
+	}
+	op := OpCode(0xFF)
+	RegisterExtra(op, func() interface{} { return &testExtra{} })
+	defer delete(extras, op)
+
+	msg := newTestMessage()
+	msg.Op = op
+	msg.Extra = testExtra{A: 1, B: -2}
+	buf := new(bytes.Buffer)
+	err := msg.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	var resp Message
+	err = resp.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	extra, ok := resp.Extra.(testExtra)
+	if !ok {
+		t.Fatalf("Expected testExtra. Got: %T", resp.Extra)
+	}
+	if extra.A != 1 || extra.B != -2 {
+		t.Fatalf("Decoded extra is different: %v", extra)
+	}
+}
+
+func Test_ReadWriteContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- newTestMessage().WriteContext(context.Background(), client)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var msg Message
+	err := msg.ReadContext(ctx, server)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if msg.Key != "mykey" || !bytes.Equal(msg.Value, []byte("myvalue")) {
+		t.Fatalf("Decoded message is different: %v", msg)
+	}
+}
+
+func Test_ReadContextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var msg Message
+	err := msg.ReadContext(ctx, server)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded. Got: %v", err)
+	}
+}
+
+func Test_WriteContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	// Nobody reads from the other end of the pipe, Write blocks until cancellation.
+	err := newTestMessage().WriteContext(ctx, client)
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled. Got: %v", err)
+	}
+}
+
+func Test_ValueBuf(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for i := 0; i < 2; i++ {
+		err := newTestMessage().Write(buf)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	msg := Message{ValueBuf: make([]byte, 0, 64)}
+	err := msg.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !bytes.Equal(msg.Value, []byte("myvalue")) {
+		t.Fatalf("Decoded value is different: %s", msg.Value)
+	}
+	if &msg.Value[0] != &msg.ValueBuf[:1][0] {
+		t.Fatalf("Expected Value to point to ValueBuf")
+	}
+	first := &msg.ValueBuf[0]
+
+	err = msg.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if &msg.ValueBuf[0] != first {
+		t.Fatalf("Expected ValueBuf to be reused")
+	}
+}
+
+func Test_Reset(t *testing.T) {
+	buf := new(bytes.Buffer)
+	req := newTestMessage()
+	req.Trace = &TraceContext{Flags: 1}
+	err := req.Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	msg := Message{ValueBuf: make([]byte, 0, 64)}
+	err = msg.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	msg.Reset()
+	if msg.Header != (Header{}) {
+		t.Fatalf("Expected a zero header. Got: %v", msg.Header)
+	}
+	if msg.Extra != nil || msg.Trace != nil || msg.DMap != "" || msg.Key != "" || msg.Size() != 0 {
+		t.Fatalf("Expected a zero message. Got: %v", msg)
+	}
+	if len(msg.Value) != 0 || cap(msg.Value) != 64 {
+		t.Fatalf("Expected an empty value with capacity 64. Got: %d/%d", len(msg.Value), cap(msg.Value))
+	}
+	if len(msg.ValueBuf) != 0 || cap(msg.ValueBuf) != 64 {
+		t.Fatalf("Expected an empty ValueBuf with capacity 64. Got: %d/%d", len(msg.ValueBuf), cap(msg.ValueBuf))
+	}
+}
+
+func Test_MessagePool(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for i := 0; i < 2; i++ {
+		err := newTestMessage().Write(buf)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	p := NewMessagePool()
+	for i := 0; i < 2; i++ {
+		msg := p.Get()
+		if msg.ValueBuf == nil {
+			t.Fatalf("Expected a non-nil ValueBuf")
+		}
+		err := msg.Read(buf)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(msg.Value, []byte("myvalue")) {
+			t.Fatalf("Decoded value is different: %s", msg.Value)
+		}
+		p.Put(msg)
+		if msg.DMap != "" || len(msg.Value) != 0 {
+			t.Fatalf("Expected a reset message")
+		}
+	}
+
+	msg := &Message{ValueBuf: make([]byte, 0, maxPooledValueBuf+1)}
+	p.Put(msg)
+	if cap(msg.ValueBuf) != 0 {
+		t.Fatalf("Expected the big ValueBuf to be released")
+	}
+}
+
+func benchmarkRead(b *testing.B, valueBuf []byte) {
+	raw := new(bytes.Buffer)
+	err := newTestMessage().Write(raw)
+	if err != nil {
+		b.Fatalf("Expected nil. Got: %v", err)
+	}
+	r := bytes.NewReader(raw.Bytes())
+	msg := Message{ValueBuf: valueBuf}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Seek(0, io.SeekStart)
+		err = msg.Read(r)
+		if err != nil {
+			b.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkRead(b, nil)
+}
+
+func BenchmarkReadValueBuf(b *testing.B) {
+	benchmarkRead(b, make([]byte, 0, 64))
+}
+
+func Test_ParseOpCode(t *testing.T) {
+	for op, name := range opNames {
+		parsed, ok := ParseOpCode(name)
+		if !ok || parsed != op {
+			t.Fatalf("Expected %d for %s. Got: %d", op, name, parsed)
+		}
+	}
+	if _, ok := ParseOpCode("foobar"); ok {
+		t.Fatalf("Expected an unknown operation")
+	}
+}
+
+func Test_ReadShortReads(t *testing.T) {
+	VerifyChecksums = true
+	defer func() {
+		VerifyChecksums = false
+	}()
+
+	buf := new(bytes.Buffer)
+	err := newTestMessage().Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	raw := buf.Bytes()
+
+	// Every byte arrives in a separate read, like a slow sender.
+	var msg Message
+	err = msg.Read(iotest.OneByteReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if msg.Key != "mykey" || !bytes.Equal(msg.Value, []byte("myvalue")) {
+		t.Fatalf("Decoded message is different: %v", msg)
+	}
+
+	err = msg.Read(bytes.NewReader(nil))
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF. Got: %v", err)
+	}
+	for _, n := range []int{1, int(headerSize) - 1, int(headerSize), int(headerSize) + requestIDSize, len(raw) - 1} {
+		err = msg.Read(iotest.OneByteReader(bytes.NewReader(raw[:n])))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("Expected io.ErrUnexpectedEOF for %d bytes. Got: %v", n, err)
+		}
+	}
+}
+
+func Test_ReadTimeout(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := newTestMessage().Write(buf)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		// Send the header and stall.
+		_, _ = client.Write(buf.Bytes()[:headerSize])
+	}()
+
+	err = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var msg Message
+	err = msg.Read(server)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Expected a timeout error. Got: %v", err)
+	}
+
+	_ = client.Close()
+	err = msg.Read(server)
+	if err != io.EOF && err != ErrConnClosed {
+		t.Fatalf("Expected io.EOF or ErrConnClosed. Got: %v", err)
+	}
+}
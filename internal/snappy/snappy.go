@@ -0,0 +1,221 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*Package snappy implements the block format of Snappy compression, the framing format is not implemented.*/
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrCorrupt means that the input is not a valid Snappy block.
+var ErrCorrupt = errors.New("snappy: corrupt input")
+
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+)
+
+const (
+	// minMatch is the shortest match encoded as a copy.
+	minMatch = 4
+	// maxOffset is the longest distance of a match, the encoder emits copies with 1 or 2 bytes offsets.
+	maxOffset = 1<<16 - 1
+	tableBits = 14
+)
+
+// Encode returns the Snappy block of src.
+func Encode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	// table maps the hashes of 4 bytes sequences to their last positions plus one.
+	var table [1 << tableBits]int32
+	lit, s := 0, 0
+	for s+minMatch <= len(src) {
+		h := hash(load32(src, s))
+		candidate := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if candidate < 0 || s-candidate > maxOffset || load32(src, candidate) != load32(src, s) {
+			s++
+			continue
+		}
+		dst = emitLiteral(dst, src[lit:s])
+		offset, length := s-candidate, minMatch
+		for s+length < len(src) && src[s+length] == src[candidate+length] {
+			length++
+		}
+		dst = emitCopy(dst, offset, length)
+		s += length
+		lit = s
+	}
+	return emitLiteral(dst, src[lit:])
+}
+
+// DecodedLen returns the length of the decoded block.
+func DecodedLen(src []byte) (int, error) {
+	n, _, err := decodedLen(src)
+	return n, err
+}
+
+// Decode returns the decoded block of src. It decodes at most limit+1 bytes, so the caller rejects a block
+// longer than limit without allocating its decoded length.
+func Decode(src []byte, limit int) ([]byte, error) {
+	n, header, err := decodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	truncated := n > limit
+	if truncated {
+		n = limit + 1
+	}
+	dst := make([]byte, 0, n)
+	s := header
+	for s < len(src) && len(dst) < n {
+		var length int
+		switch src[s] & 0x03 {
+		case tagLiteral:
+			x := int(src[s] >> 2)
+			s++
+			if x >= 60 {
+				size := x - 59
+				if s+size > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = 0
+				for i := size - 1; i >= 0; i-- {
+					x = x<<8 | int(src[s+i])
+				}
+				s += size
+			}
+			length = x + 1
+			if length <= 0 || length > len(src)-s {
+				return nil, ErrCorrupt
+			}
+			if length > n-len(dst) {
+				length = n - len(dst)
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case tagCopy1:
+			if s+2 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = minMatch + int(src[s]>>2)&0x07
+			offset := int(src[s]&0xe0)<<3 | int(src[s+1])
+			s += 2
+			if dst, err = appendCopy(dst, offset, length, n); err != nil {
+				return nil, err
+			}
+		case tagCopy2:
+			if s+3 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(src[s]>>2)
+			offset := int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+			if dst, err = appendCopy(dst, offset, length, n); err != nil {
+				return nil, err
+			}
+		case tagCopy4:
+			if s+5 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(src[s]>>2)
+			offset := int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+			if dst, err = appendCopy(dst, offset, length, n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(dst) != n || (!truncated && s != len(src)) {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// decodedLen returns the decoded length of the block and the length of its header.
+func decodedLen(src []byte) (int, int, error) {
+	v, n := binary.Uvarint(src)
+	if n <= 0 || v > 1<<32-1 {
+		return 0, 0, ErrCorrupt
+	}
+	return int(v), n, nil
+}
+
+// appendCopy appends length bytes of dst starting offset bytes back, up to n bytes in total.
+func appendCopy(dst []byte, offset, length, n int) ([]byte, error) {
+	if offset <= 0 || offset > len(dst) {
+		return nil, ErrCorrupt
+	}
+	if length > n-len(dst) {
+		length = n - len(dst)
+	}
+	// The source and the destination overlap if offset is shorter than length, the bytes are
+	// copied one by one.
+	start := len(dst) - offset
+	for i := 0; i < length; i++ {
+		dst = append(dst, dst[start+i])
+	}
+	return dst, nil
+}
+
+func emitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2)|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func emitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		// Leave at least 4 bytes for the last copy.
+		dst = append(dst, 59<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-minMatch)<<2|tagCopy1, byte(offset))
+}
+
+func load32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i:])
+}
+
+func hash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - tableBits)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snappy
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSnappy_RoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 1<<17)
+	r.Read(random)
+	for _, data := range [][]byte{
+		nil,
+		[]byte("a"),
+		bytes.Repeat([]byte("a"), 1<<20),
+		bytes.Repeat([]byte("olric distributed cache "), 1<<12),
+		random,
+		append(random[:1<<10:1<<10], random[:1<<10]...),
+	} {
+		encoded := Encode(data)
+		decoded, err := Decode(encoded, len(data))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("Decoded data is different for %d bytes", len(data))
+		}
+		if n, _ := DecodedLen(encoded); n != len(data) {
+			t.Fatalf("Expected decoded length %d. Got: %d", len(data), n)
+		}
+	}
+}
+
+func TestSnappy_Decode(t *testing.T) {
+	// The length, a literal of "ab" and a copy of 8 bytes with offset 2, written by hand from the
+	// format description.
+	block := []byte{0x0a, 0x04, 'a', 'b', 0x11, 0x02}
+	decoded, err := Decode(block, 1<<10)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if string(decoded) != "ababababab" {
+		t.Fatalf("Expected ababababab. Got: %s", decoded)
+	}
+}
+
+func TestSnappy_DecodeLimit(t *testing.T) {
+	encoded := Encode(bytes.Repeat([]byte("a"), 1<<20))
+	decoded, err := Decode(encoded, 100)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(decoded) != 101 {
+		t.Fatalf("Expected 101 bytes. Got: %d", len(decoded))
+	}
+}
+
+func TestSnappy_Corrupt(t *testing.T) {
+	encoded := Encode(bytes.Repeat([]byte("olric "), 100))
+	for _, block := range [][]byte{
+		{},
+		encoded[:len(encoded)-1],
+		// A copy before the first byte.
+		{0x0a, 0x11, 0x02},
+		// A literal longer than the block.
+		{0x0a, 0x24, 'a'},
+	} {
+		if _, err := Decode(block, 1<<20); err != ErrCorrupt {
+			t.Fatalf("Expected ErrCorrupt for %v. Got: %v", block, err)
+		}
+	}
+}
@@ -17,6 +17,8 @@ package snapshot
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -39,22 +41,36 @@ const (
 	opDel uint8 = 1
 )
 
+// FormatVersion is the version of the on-disk format. Every entry is stored in the in-memory layout
+// of the storage package which contains key, TTL, timestamp and value. Bump it if the layout changes.
+//
+// Version 2 added the timestamp to the layout.
+const FormatVersion uint8 = 2
+
 var (
 	// PrimaryDMapKey is the key on Badger for registered DMap names on partitions.
 	PrimaryDMapKey = []byte("primary-dmap-key")
 
 	// BackupDMapKey is the key on Badger for registered DMap names on backups.
 	BackupDMapKey = []byte("backup-dmap-key")
+
+	// formatVersionKey is the key on Badger for the version of the on-disk format.
+	formatVersionKey = []byte("format-version-key")
 )
 
+// ErrUnsupportedFormat indicates that the snapshot has been written by a newer version of Olric.
+var ErrUnsupportedFormat = errors.New("unsupported snapshot format")
+
 type onDiskDMaps map[uint64]map[string]struct{}
 
 // OpLog defines operation log.
 type OpLog struct {
 	sync.Mutex
 
-	m   map[uint64]uint8
-	str *storage.Storage
+	// syncMu serializes the synchronizations of the DMap to BadgerDB.
+	syncMu sync.Mutex
+	m      map[uint64]uint8
+	str    *storage.Storage
 }
 
 // Put logs 'Put' operation for given hkey.
@@ -73,6 +89,16 @@ func (o *OpLog) Delete(hkey uint64) {
 	o.m[hkey] = opDel
 }
 
+// Journal is notified around the synchronization of a partition. It's implemented by the write-ahead log.
+type Journal interface {
+	// Checkpoint is called before the partition is synchronized.
+	Checkpoint(partID uint64) error
+
+	// Release is called after the partition is synchronized successfully. The mutations before
+	// the last checkpoint are in the snapshot.
+	Release(partID uint64) error
+}
+
 func dmapKey(partID uint64, name string) []byte {
 	return []byte("dmap-keys-" + name + "-" + strconv.Itoa(int(partID)))
 }
@@ -85,6 +111,7 @@ type Snapshot struct {
 	log              *log.Logger
 	workers          map[uint64]context.CancelFunc
 	oplogs           map[uint64]map[string]*OpLog
+	journal          Journal
 	snapshotInterval time.Duration
 	wg               sync.WaitGroup
 	ctx              context.Context
@@ -122,6 +149,11 @@ func New(opt *badger.Options, snapshotInterval, gcInterval time.Duration,
 	if err != nil {
 		return nil, err
 	}
+	err = checkFormatVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &Snapshot{
@@ -138,6 +170,28 @@ func New(opt *badger.Options, snapshotInterval, gcInterval time.Duration,
 	return s, nil
 }
 
+// checkFormatVersion checks the version of the on-disk format and sets it for a fresh snapshot.
+// The snapshots without a version have been written in the first version of the format.
+func checkFormatVersion(db *badger.DB) error {
+	return db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(formatVersionKey)
+		if err == badger.ErrKeyNotFound {
+			return txn.Set(formatVersionKey, []byte{FormatVersion})
+		}
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(value) != 1 || value[0] > FormatVersion {
+			return ErrUnsupportedFormat
+		}
+		return nil
+	})
+}
+
 // Shutdown closes a DB. It's crucial to call it to ensure all the pending updates make their way to disk.
 func (s *Snapshot) Shutdown() error {
 	select {
@@ -170,6 +224,9 @@ func (s *Snapshot) garbageCollection(gcInterval time.Duration, gcDiscardRatio fl
 }
 
 func (s *Snapshot) syncDMap(partID uint64, name string, oplog *OpLog) (map[uint64]uint8, error) {
+	oplog.syncMu.Lock()
+	defer oplog.syncMu.Unlock()
+
 	oplog.Lock()
 	if len(oplog.m) == 0 {
 		oplog.Unlock()
@@ -263,59 +320,102 @@ func (s *Snapshot) syncDMap(partID uint64, name string, oplog *OpLog) (map[uint6
 	return failed, wb.Flush()
 }
 
-// worker runs at background for every partition which has dmaps.
-func (s *Snapshot) worker(ctx context.Context, partID uint64) {
-	defer s.wg.Done()
+// SetJournal sets the journal which is notified around the synchronizations. It must be called before
+// registering a DMap.
+func (s *Snapshot) SetJournal(j Journal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal = j
+}
 
-	// Iterates over partitions dmaps and calls syncDMap to synchronize DMaps
-	// to BadgerDB.
-	sync := func() {
-		// sync the dmaps to badger.
-		s.mu.RLock()
-		defer s.mu.RUnlock()
+// syncPartition calls syncDMap for the DMaps on the given partition to synchronize them to BadgerDB.
+func (s *Snapshot) syncPartition(partID uint64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-		part, ok := s.oplogs[partID]
-		if !ok {
-			// There are no registered DMap on this partition.
-			return
+	part, ok := s.oplogs[partID]
+	if !ok {
+		// There are no registered DMap on this partition.
+		return nil
+	}
+	if s.journal != nil {
+		if err := s.journal.Checkpoint(partID); err != nil {
+			s.log.Printf("[ERROR] Failed to checkpoint journal of PartID: %d: %v", partID, err)
+			return err
 		}
-		for name, oplog := range part {
-			failed, err := s.syncDMap(partID, name, oplog)
-			if err != nil {
-				s.log.Printf("[ERROR] Failed to sync DMap: %s on PartID: %d: %v", name, partID, err)
-			}
-			// Re-add failed hkeys to OpLog for later processing.
-			// It can be pretty critical for our business. We may
-			// lose data at that point.
-			if len(failed) == 0 {
-				continue
-			}
-			oplog.Lock()
-			for hkey, op := range failed {
-				_, ok := oplog.m[hkey]
-				// If ok is true, the hkey is already updated or deleted by the user.
-				// So it will be processed again by the next call.
-				if !ok {
-					// Add it again to process in the next call.
-					oplog.m[hkey] = op
-				}
+	}
+	var serr error
+	for name, oplog := range part {
+		failed, err := s.syncDMap(partID, name, oplog)
+		if err != nil {
+			s.log.Printf("[ERROR] Failed to sync DMap: %s on PartID: %d: %v", name, partID, err)
+			serr = err
+		}
+		// Re-add failed hkeys to OpLog for later processing.
+		// It can be pretty critical for our business. We may
+		// lose data at that point.
+		if len(failed) == 0 {
+			continue
+		}
+		if serr == nil {
+			serr = fmt.Errorf("failed to sync %d keys of DMap: %s on PartID: %d", len(failed), name, partID)
+		}
+		oplog.Lock()
+		for hkey, op := range failed {
+			_, ok := oplog.m[hkey]
+			// If ok is true, the hkey is already updated or deleted by the user.
+			// So it will be processed again by the next call.
+			if !ok {
+				// Add it again to process in the next call.
+				oplog.m[hkey] = op
 			}
-			oplog.Unlock()
+		}
+		oplog.Unlock()
+	}
+	if serr == nil && s.journal != nil {
+		serr = s.journal.Release(partID)
+		if serr != nil {
+			s.log.Printf("[ERROR] Failed to release journal of PartID: %d: %v", partID, serr)
+		}
+	}
+	return serr
+}
+
+// Sync synchronizes all the registered DMaps to BadgerDB immediately.
+func (s *Snapshot) Sync() error {
+	s.mu.RLock()
+	partIDs := make([]uint64, 0, len(s.oplogs))
+	for partID := range s.oplogs {
+		partIDs = append(partIDs, partID)
+	}
+	s.mu.RUnlock()
+
+	var serr error
+	for _, partID := range partIDs {
+		if err := s.syncPartition(partID); err != nil {
+			serr = err
 		}
 	}
+	return serr
+}
+
+// worker runs at background for every partition which has dmaps.
+func (s *Snapshot) worker(ctx context.Context, partID uint64) {
+	defer s.wg.Done()
+
 	for {
 		select {
 		case <-s.ctx.Done():
 			// Olric instance has been closing. Call sync one last time.
 			s.log.Printf("[DEBUG] DMaps on PartID: %d have been synchronizing to BadgerDB for last time.", partID)
-			sync()
+			s.syncPartition(partID)
 			return
 		case <-ctx.Done():
 			// Partition is empty.
 			return
 		case <-time.After(s.snapshotInterval):
 			// Sync DMaps to BadgerDB periodically.
-			sync()
+			s.syncPartition(partID)
 		}
 	}
 }
@@ -433,12 +533,16 @@ func (s *Snapshot) UnregisterDMap(dkey []byte, partID uint64, name string) error
 	return nil
 }
 
-// DestroyDMap destroys a dmap's hkeys and releated data on the snapshot.
+// DestroyDMap destroys a dmap's hkeys and releated data on the snapshot. It's not an error if the
+// dmap has not been synced to the snapshot yet.
 func (s *Snapshot) DestroyDMap(dkey []byte, partID uint64, name string) error {
 	var hkeys map[uint64]struct{}
 	// Retrieve hkeys which belong to dmap from BadgerDB.
 	err := s.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(dmapKey(partID, name))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -349,3 +349,132 @@ func Test_DestroyDMap(t *testing.T) {
 		t.Fatalf("Expected nil. Got: %v", err)
 	}
 }
+
+func Test_DestroyDMapNotSynced(t *testing.T) {
+	tmpdir, snap, err := newSnapshot()
+	if err != nil {
+		t.Errorf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = snap.Shutdown()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		err = os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	str, err := storage.New(0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = snap.RegisterDMap(PrimaryDMapKey, 0, "test", str)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// Destroy it before the first sync.
+	err = snap.DestroyDMap(PrimaryDMapKey, 0, "test")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func Test_Sync(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "olric-snapshot")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	opt := badger.DefaultOptions
+	opt.Dir = dir
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	// The workers never run during the test.
+	snap, err := New(&opt, time.Hour, 0, 0, logger)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = snap.Shutdown()
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}()
+
+	str, err := storage.New(0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	oplog, err := snap.RegisterDMap(PrimaryDMapKey, 0, "test", str)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	for hkey := uint64(0); hkey < uint64(100); hkey++ {
+		vdata := &storage.VData{
+			Key:   strconv.Itoa(int(hkey)),
+			TTL:   1,
+			Value: []byte("value"),
+		}
+		err = str.Put(hkey, vdata)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		oplog.Put(hkey)
+	}
+	err = snap.Sync()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	err = snap.db.View(func(txn *badger.Txn) error {
+		bkey := make([]byte, 8)
+		for hkey := uint64(0); hkey < uint64(100); hkey++ {
+			binary.BigEndian.PutUint64(bkey, hkey)
+			_, err := txn.Get(bkey)
+			if err != nil {
+				return fmt.Errorf("hkey: %d: %v", hkey, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func Test_FormatVersion(t *testing.T) {
+	tmpdir, snap, err := newSnapshot()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = os.RemoveAll(tmpdir)
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	// Pretend that the snapshot has been written by a newer version.
+	err = snap.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(formatVersionKey, []byte{FormatVersion + 1})
+	})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = snap.Shutdown()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	opt := badger.DefaultOptions
+	opt.Dir = tmpdir
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	_, err = New(&opt, defaultSnapshotInterval, 0, 0, logger)
+	if err != ErrUnsupportedFormat {
+		t.Fatalf("Expected ErrUnsupportedFormat. Got: %v", err)
+	}
+}
@@ -37,9 +37,22 @@ var ErrFragmented = errors.New("storage fragmented")
 
 // VData represents a value with its metadata.
 type VData struct {
-	Key   string
-	TTL   int64
-	Value []byte
+	Key string
+	TTL int64
+	// Timestamp is the version of the entry, the hybrid logical clock of its write in nanoseconds.
+	// It's used to find the newest one of the replicas of a key.
+	Timestamp int64
+	Value     []byte
+}
+
+// Cipher encrypts the values before they're stored and decrypts them when they're read. The keys
+// and the metadata of the entries are never encrypted.
+type Cipher interface {
+	// Seal encrypts the value of the given hkey.
+	Seal(hkey uint64, plaintext []byte) ([]byte, error)
+
+	// Open decrypts the value of the given hkey.
+	Open(hkey uint64, ciphertext []byte) ([]byte, error)
 }
 
 // Storage implements a new off-heap data store which uses built-in map to
@@ -48,6 +61,7 @@ type VData struct {
 type Storage struct {
 	mu sync.RWMutex
 
+	cipher  Cipher
 	tables  []*table
 	merging int32
 	wg      sync.WaitGroup
@@ -70,23 +84,33 @@ func New(size int) (*Storage, error) {
 	return o, nil
 }
 
+// SetCipher sets the cipher to encrypt the values. The raw values, Export and Import are not affected,
+// they carry the encrypted values. It has to be called before the storage is used.
+func (s *Storage) SetCipher(c Cipher) {
+	s.cipher = c
+}
+
 // Close closes underlying tables and releases allocated memory with Munmap.
 // It blocks until everything is done.
 func (s *Storage) Close() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	select {
 	case <-s.ctx.Done():
 		// It's already closed.
+		s.mu.Unlock()
 		return nil
 	default:
 	}
-
 	s.cancel()
-	// Await for table merging processes gets closed.
+	s.mu.Unlock()
+
+	// Await for table merging processes gets closed. A merging process may be waiting
+	// for the lock, release it until they quit.
 	s.wg.Wait()
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	// free allocated area with Munmap.
 	for _, t := range s.tables {
 		err := t.close()
@@ -135,6 +159,30 @@ func (s *Storage) PutRaw(hkey uint64, value []byte) error {
 
 // Put sets the value for the given key. It overwrites any previous value for that key
 func (s *Storage) Put(hkey uint64, value *VData) error {
+	sealed, err := s.Seal(hkey, value)
+	if err != nil {
+		return err
+	}
+	return s.PutSealed(hkey, sealed)
+}
+
+// Seal returns a copy of the given VData with its value encrypted by the cipher of the storage. It returns
+// the given VData if there is no cipher.
+func (s *Storage) Seal(hkey uint64, value *VData) (*VData, error) {
+	if s.cipher == nil {
+		return value, nil
+	}
+	ciphertext, err := s.cipher.Seal(hkey, value.Value)
+	if err != nil {
+		return nil, err
+	}
+	sealed := *value
+	sealed.Value = ciphertext
+	return &sealed, nil
+}
+
+// PutSealed sets the value which has already been encrypted by Seal for the given key.
+func (s *Storage) PutSealed(hkey uint64, value *VData) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -211,7 +259,7 @@ func (s *Storage) Get(hkey uint64) (*VData, error) {
 			continue
 		}
 		// Found the key, return the stored value with its metadata.
-		return res, nil
+		return s.open(hkey, res)
 	}
 	// Nothing here.
 	return nil, ErrKeyNotFound
@@ -329,6 +377,18 @@ func (s *Storage) Len() int {
 	return total
 }
 
+// Inuse returns the number of bytes used by the keys and values in this storage.
+func (s *Storage) Inuse() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int
+	for _, t := range s.tables {
+		total += t.inuse
+	}
+	return total
+}
+
 // Check checks the key existence.
 func (s *Storage) Check(hkey uint64) bool {
 	s.mu.RLock()
@@ -350,11 +410,24 @@ func (s *Storage) Check(hkey uint64) bool {
 	return false
 }
 
+func (s *Storage) open(hkey uint64, vdata *VData) (*VData, error) {
+	if s.cipher == nil {
+		return vdata, nil
+	}
+	plaintext, err := s.cipher.Open(hkey, vdata.Value)
+	if err != nil {
+		return nil, err
+	}
+	vdata.Value = plaintext
+	return vdata, nil
+}
+
 // Range calls f sequentially for each key and value present in the map.
 // If f returns false, range stops the iteration. Range may be O(N) with
 // the number of elements in the map even if f returns false after a constant
-// number of calls.
-func (s *Storage) Range(f func(hkey uint64, vdata *VData) bool) {
+// number of calls. Range stops and returns the error if the value of an entry
+// cannot be decrypted.
+func (s *Storage) Range(f func(hkey uint64, vdata *VData) bool) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -367,11 +440,40 @@ func (s *Storage) Range(f func(hkey uint64, vdata *VData) bool) {
 		t := s.tables[i]
 		for hkey := range t.hkeys {
 			vdata, _ := t.get(hkey)
+			vdata, err := s.open(hkey, vdata)
+			if err != nil {
+				return errors.Wrapf(err, "failed to decrypt hkey: %d", hkey)
+			}
 			if !f(hkey, vdata) {
-				break
+				return nil
 			}
 		}
 	}
+	return nil
+}
+
+// EncodeRaw encodes the given VData to the in-memory layout. DecodeRaw decodes it.
+func EncodeRaw(vdata *VData) []byte {
+	raw := make([]byte, len(vdata.Key)+len(vdata.Value)+metadataLen)
+	offset := 0
+	// In-memory structure:
+	//
+	// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | TIMESTAMP(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
+	raw[offset] = uint8(len(vdata.Key))
+	offset++
+
+	offset += copy(raw[offset:], vdata.Key)
+
+	binary.BigEndian.PutUint64(raw[offset:], uint64(vdata.TTL))
+	offset += 8
+
+	binary.BigEndian.PutUint64(raw[offset:], uint64(vdata.Timestamp))
+	offset += 8
+
+	binary.BigEndian.PutUint32(raw[offset:], uint32(len(vdata.Value)))
+	offset += 4
+	copy(raw[offset:], vdata.Value)
+	return raw
 }
 
 // DecodeRaw creates VData for given byte slice. It assumes that the given data is valid. Never returns an error.
@@ -380,7 +482,7 @@ func DecodeRaw(raw []byte) *VData {
 	vdata := &VData{}
 	// In-memory structure:
 	//
-	// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
+	// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | TIMESTAMP(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
 	klen := int(uint8(raw[offset]))
 	offset++
 
@@ -390,6 +492,9 @@ func DecodeRaw(raw []byte) *VData {
 	vdata.TTL = int64(binary.BigEndian.Uint64(raw[offset : offset+8]))
 	offset += 8
 
+	vdata.Timestamp = int64(binary.BigEndian.Uint64(raw[offset : offset+8]))
+	offset += 8
+
 	vlen := binary.BigEndian.Uint32(raw[offset : offset+4])
 	offset += 4
 	vdata.Value = raw[offset : offset+int(vlen)]
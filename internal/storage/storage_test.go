@@ -334,6 +334,42 @@ func Test_Len(t *testing.T) {
 	}
 }
 
+func Test_Inuse(t *testing.T) {
+	s, err := New(0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		err = s.Close()
+		if err != nil {
+			t.Fatalf("Failed to close storage: %v", err)
+		}
+	}()
+
+	vdata := &VData{
+		Key:   bkey(1),
+		Value: bval(1),
+	}
+	hkey := xxhash.Sum64([]byte(vdata.Key))
+	err = s.Put(hkey, vdata)
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	// 21 bytes of metadata: key length, TTL, timestamp and value length.
+	expected := len(vdata.Key) + len(vdata.Value) + 21
+	if s.Inuse() != expected {
+		t.Fatalf("Expected inuse: %d. Got: %d", expected, s.Inuse())
+	}
+
+	err = s.Delete(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	if s.Inuse() != 0 {
+		t.Fatalf("Expected inuse: 0. Got: %d", s.Inuse())
+	}
+}
+
 func Test_Range(t *testing.T) {
 	s, err := New(0)
 	if err != nil {
@@ -402,3 +438,48 @@ func Test_Check(t *testing.T) {
 		}
 	}
 }
+
+func Test_EncodeRaw(t *testing.T) {
+	s, err := New(0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	defer func() {
+		err = s.Close()
+		if err != nil {
+			t.Fatalf("Failed to close storage: %v", err)
+		}
+	}()
+
+	vdata := &VData{
+		Key:       bkey(1),
+		TTL:       100,
+		Timestamp: 200,
+		Value:     bval(1),
+	}
+	hkey := xxhash.Sum64([]byte(vdata.Key))
+	err = s.Put(hkey, vdata)
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	stored, err := s.Get(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	if stored.Timestamp != vdata.Timestamp {
+		t.Fatalf("Expected timestamp: %d. Got: %d", vdata.Timestamp, stored.Timestamp)
+	}
+	raw, err := s.GetRaw(hkey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got %v", err)
+	}
+	// GetRaw returns a trailing byte.
+	if !bytes.Equal(EncodeRaw(vdata), raw[:len(raw)-1]) {
+		t.Fatalf("Encoded data is different from the in-memory layout")
+	}
+	decoded := DecodeRaw(EncodeRaw(vdata))
+	if decoded.Key != vdata.Key || decoded.TTL != vdata.TTL || decoded.Timestamp != vdata.Timestamp ||
+		!bytes.Equal(decoded.Value, vdata.Value) {
+		t.Fatalf("Decoded data is different: %v", decoded)
+	}
+}
@@ -22,7 +22,12 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-const maxKeyLen = 256
+const (
+	maxKeyLen = 256
+
+	// metadataLen is the length of the metadata of an entry: key length, TTL, timestamp and value length.
+	metadataLen = 21
+)
 
 var (
 	errNotEnoughSpace = errors.New("not enough space")
@@ -92,14 +97,14 @@ func (t *table) putRaw(hkey uint64, value []byte) error {
 
 // In-memory layout for entry:
 //
-// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
+// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | TIMESTAMP(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
 func (t *table) put(hkey uint64, value *VData) error {
 	if len(value.Key) >= maxKeyLen {
 		return ErrKeyTooLarge
 	}
 
 	// Check empty space on allocated memory area.
-	inuse := len(value.Key) + len(value.Value) + 13
+	inuse := len(value.Key) + len(value.Value) + metadataLen
 	if inuse+t.offset >= t.allocated {
 		return errNotEnoughSpace
 	}
@@ -125,6 +130,10 @@ func (t *table) put(hkey uint64, value *VData) error {
 	binary.BigEndian.PutUint64(t.memory[t.offset:], uint64(value.TTL))
 	t.offset += 8
 
+	// Set the timestamp. It's 8 bytes.
+	binary.BigEndian.PutUint64(t.memory[t.offset:], uint64(value.Timestamp))
+	t.offset += 8
+
 	// Set the value length. It's 4 bytes.
 	binary.BigEndian.PutUint32(t.memory[t.offset:], uint32(len(value.Value)))
 	t.offset += 4
@@ -143,12 +152,13 @@ func (t *table) getRaw(hkey uint64) ([]byte, bool) {
 	start, end := offset, offset
 
 	// In-memory structure:
-	// 1                 | klen       | 8           | 4                    | vlen
-	// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
+	// 1                 | klen       | 8           | 8                 | 4                    | vlen
+	// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | TIMESTAMP(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
 	klen := int(uint8(t.memory[end]))
 	end++       // One byte to keep key length
 	end += klen // Key length
 	end += 8    // For bytes for TTL
+	end += 8    // For bytes for timestamp
 
 	vlen := binary.BigEndian.Uint32(t.memory[end : end+4])
 	end += 4         // 4 bytes to keep value length
@@ -169,7 +179,7 @@ func (t *table) get(hkey uint64) (*VData, bool) {
 	vdata := &VData{}
 	// In-memory structure:
 	//
-	// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
+	// KEY-LENGTH(uint8) | KEY(bytes) | TTL(uint64) | TIMESTAMP(uint64) | VALUE-LENGTH(uint32) | VALUE(bytes)
 	klen := int(uint8(t.memory[offset]))
 	offset++
 
@@ -179,6 +189,9 @@ func (t *table) get(hkey uint64) (*VData, bool) {
 	vdata.TTL = int64(binary.BigEndian.Uint64(t.memory[offset : offset+8]))
 	offset += 8
 
+	vdata.Timestamp = int64(binary.BigEndian.Uint64(t.memory[offset : offset+8]))
+	offset += 8
+
 	vlen := binary.BigEndian.Uint32(t.memory[offset : offset+4])
 	offset += 4
 	vdata.Value = t.memory[offset : offset+int(vlen)]
@@ -198,9 +211,9 @@ func (t *table) delete(hkey uint64) bool {
 	offset += 1 + klen
 	garbage += 1 + klen
 
-	// TTL, skip it.
-	offset += 8
-	garbage += 8
+	// TTL and timestamp, skip them.
+	offset += 16
+	garbage += 16
 
 	// Value len and its header.
 	vlen := binary.BigEndian.Uint32(t.memory[offset : offset+4])
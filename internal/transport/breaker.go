@@ -0,0 +1,118 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPeerUnavailable is returned without sending the request when the circuit breaker of the peer is open.
+var ErrPeerUnavailable = errors.New("peer unavailable")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState uint8
+
+const (
+	// BreakerClosed lets the requests pass. It's the initial state.
+	BreakerClosed BreakerState = BreakerState(iota)
+
+	// BreakerOpen short-circuits the requests until the cooldown period ends.
+	BreakerOpen
+
+	// BreakerHalfOpen lets only one request pass to probe the peer.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// breaker is a circuit breaker of a peer. It opens after threshold consecutive failures.
+type breaker struct {
+	mu sync.Mutex
+
+	addr      string
+	threshold int
+	cooldown  time.Duration
+	onChange  func(addr string, from, to BreakerState)
+
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *breaker) setState(state BreakerState) func() {
+	from := b.state
+	b.state = state
+	if b.onChange == nil || from == state {
+		return func() {}
+	}
+	return func() { b.onChange(b.addr, from, state) }
+}
+
+// allow reports whether a request can be sent to the peer.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			b.mu.Unlock()
+			return false
+		}
+		notify := b.setState(BreakerHalfOpen)
+		b.probing = true
+		b.mu.Unlock()
+		notify()
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			b.mu.Unlock()
+			return false
+		}
+		b.probing = true
+	}
+	b.mu.Unlock()
+	return true
+}
+
+// done records the result of a request which is allowed by the breaker.
+func (b *breaker) done(failed bool) {
+	b.mu.Lock()
+	b.probing = false
+	notify := func() {}
+	if !failed {
+		b.failures = 0
+		notify = b.setState(BreakerClosed)
+	} else {
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+			b.openedAt = time.Now()
+			notify = b.setState(BreakerOpen)
+		}
+	}
+	b.mu.Unlock()
+	notify()
+}
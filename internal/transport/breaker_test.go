@@ -0,0 +1,132 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestBreaker(t *testing.T) {
+	var transitions []BreakerState
+	b := &breaker{
+		addr:      "127.0.0.1:3320",
+		threshold: 2,
+		cooldown:  50 * time.Millisecond,
+		onChange: func(addr string, from, to BreakerState) {
+			transitions = append(transitions, to)
+		},
+	}
+	b.done(true)
+	if !b.allow() {
+		t.Fatalf("Expected the breaker to be closed after 1 failure")
+	}
+	b.done(true)
+	if b.allow() {
+		t.Fatalf("Expected the breaker to be open after 2 failures")
+	}
+
+	<-time.After(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("Expected a probe request after the cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("Expected only one probe request in half-open state")
+	}
+	b.done(true)
+	if b.allow() {
+		t.Fatalf("Expected the breaker to be open after a failed probe")
+	}
+
+	<-time.After(60 * time.Millisecond)
+	if !b.allow() {
+		t.Fatalf("Expected a probe request after the cooldown")
+	}
+	b.done(false)
+	if !b.allow() {
+		t.Fatalf("Expected the breaker to be closed after a successful probe")
+	}
+
+	expected := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Expected transitions: %v. Got: %v", expected, transitions)
+	}
+	for i, state := range expected {
+		if transitions[i] != state {
+			t.Fatalf("Expected transitions: %v. Got: %v", expected, transitions)
+		}
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	// Find a free port. Nothing listens on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var mu sync.Mutex
+	var transitions []BreakerState
+	c := NewClient(&ClientConfig{
+		DialTimeout:      time.Second,
+		MaxConn:          1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  100 * time.Millisecond,
+		OnBreakerStateChange: func(_ string, from, to BreakerState) {
+			mu.Lock()
+			transitions = append(transitions, to)
+			mu.Unlock()
+		},
+	})
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		_, err = c.RequestTo(addr, protocol.OpPing, &protocol.Message{})
+		if err == nil || err == ErrPeerUnavailable {
+			t.Fatalf("Expected a network error. Got: %v", err)
+		}
+	}
+	_, err = c.RequestTo(addr, protocol.OpPing, &protocol.Message{})
+	if err != ErrPeerUnavailable {
+		t.Fatalf("Expected ErrPeerUnavailable. Got: %v", err)
+	}
+
+	var dials int32
+	s := newTestServer(t, addr, &dials)
+	defer shutdownTestServer(t, s)
+
+	<-time.After(150 * time.Millisecond)
+	_, err = c.RequestTo(addr, protocol.OpPing, &protocol.Message{})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Expected transitions: %v. Got: %v", expected, transitions)
+	}
+	for i, state := range expected {
+		if transitions[i] != state {
+			t.Fatalf("Expected transitions: %v. Got: %v", expected, transitions)
+		}
+	}
+}
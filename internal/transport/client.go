@@ -15,6 +15,9 @@
 package transport
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
@@ -23,6 +26,7 @@ import (
 
 	"github.com/buraksezer/olric/internal/protocol"
 	"github.com/buraksezer/pool"
+	"github.com/pkg/errors"
 )
 
 // Client is the client implementation for the internal TCP server.
@@ -30,18 +34,92 @@ import (
 type Client struct {
 	mu sync.RWMutex
 
-	dialer *net.Dialer
-	config *ClientConfig
-	pools  map[string]pool.Pool
+	dialer   *net.Dialer
+	config   *ClientConfig
+	pools    map[string]pool.Pool
+	versions map[string]uint8
+	breakers map[string]*breaker
+	// muxes are the multiplexed connections, a nil one means that the peer doesn't support them.
+	// muxDials serializes the dials of a peer, so the concurrent requests share the same connection.
+	muxes    map[string]*muxConn
+	muxDials map[string]*sync.Mutex
 }
 
 // ClientConfig configuration parameters of the client.
 type ClientConfig struct {
 	Addrs       []string
 	DialTimeout time.Duration
-	KeepAlive   time.Duration
-	MinConn     int
-	MaxConn     int
+
+	// KeepAlive is the period of the TCP keepalive probes. Zero means the default of the net package,
+	// a negative value disables the probes.
+	KeepAlive time.Duration
+
+	// DisableNoDelay enables the Nagle algorithm on the connections. TCP_NODELAY is set by default.
+	DisableNoDelay bool
+
+	// MinConn is the number of connections dialed when a pool is created for a peer.
+	MinConn int
+
+	// MaxConn is the maximum number of idle connections kept in the pool of a peer.
+	MaxConn int
+
+	// IdleTimeout is the maximum time that a connection can stay idle in the pool. The stale
+	// connections are closed instead of being reused. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxAttempts is the maximum number of attempts of a request which fails with a network error.
+	// Request retries it on the other hosts. Zero and one mean no retry.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It's doubled on every retry up to MaxBackoff.
+	Backoff time.Duration
+
+	// MaxBackoff is the maximum delay between two attempts. Zero means no limit.
+	MaxBackoff time.Duration
+
+	// BreakerThreshold is the number of consecutive network errors which open the circuit breaker
+	// of a peer. The requests to the peer fail with ErrPeerUnavailable until BreakerCooldown ends,
+	// then a probe request is let to pass. Zero disables the circuit breakers.
+	BreakerThreshold int
+
+	// BreakerCooldown is the time that a circuit breaker stays open.
+	BreakerCooldown time.Duration
+
+	// OnBreakerStateChange is called after the circuit breaker of a peer changes its state, if it's set.
+	OnBreakerStateChange func(addr string, from, to BreakerState)
+
+	// Tracer is called before every attempt of a request, if it's set. See ClientTracer.
+	Tracer ClientTracer
+
+	// TLSConfig enables TLS for the connections, if it's set. The handshake is completed before
+	// the hello message. ServerName is the host of the address, if it's empty.
+	TLSConfig *tls.Config
+
+	// Credential is sent with OpAuth after the hello message, if it's set.
+	Credential []byte
+
+	// Multiplex sends the requests to a peer over a single connection at the same time, instead of taking
+	// a connection from the pool for every request. The responses are matched with the requests by their
+	// IDs. The pool is still used for the peers which don't speak protocol.RequestIDVersion, and for
+	// RequestBatch.
+	Multiplex bool
+}
+
+// ErrUnauthorized is returned when a node rejects the credential.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrTooManyConnections is returned when a node rejects a new connection because of its connection limit.
+var ErrTooManyConnections = errors.New("too many connections")
+
+// ClientTracer is called before a request is sent to addr. It may replace req.Trace with the trace
+// context of its span, so the span of the server is linked to it. req.Trace is restored after the
+// request. The returned function is called with the response or the error.
+type ClientTracer func(addr string, req *protocol.Message) func(resp *protocol.Message, err error)
+
+// conn records the last time that a pooled connection was used.
+type conn struct {
+	net.Conn
+	lastUsed time.Time
 }
 
 // NewClient returns a new Client.
@@ -56,9 +134,13 @@ func NewClient(cc *ClientConfig) *Client {
 	}
 
 	c := &Client{
-		dialer: dialer,
-		config: cc,
-		pools:  make(map[string]pool.Pool),
+		dialer:   dialer,
+		config:   cc,
+		pools:    make(map[string]pool.Pool),
+		versions: make(map[string]uint8),
+		breakers: make(map[string]*breaker),
+		muxes:    make(map[string]*muxConn),
+		muxDials: make(map[string]*sync.Mutex),
 	}
 	return c
 }
@@ -70,6 +152,23 @@ func (c *Client) Close() {
 	for _, p := range c.pools {
 		p.Close()
 	}
+	for _, m := range c.muxes {
+		if m != nil {
+			m.close()
+		}
+	}
+}
+
+// IdleConns returns the number of idle connections in the pool of every peer.
+func (c *Client) IdleConns() map[string]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	idle := make(map[string]int, len(c.pools))
+	for addr, p := range c.pools {
+		idle[addr] = p.Len()
+	}
+	return idle
 }
 
 // CloseWithAddr closes the connection for given addr, if any exists.
@@ -77,15 +176,128 @@ func (c *Client) CloseWithAddr(addr string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	p, ok := c.pools[addr]
-	if !ok {
+	if ok {
 		p.Close()
 		delete(c.pools, addr)
 	}
+	if m := c.muxes[addr]; m != nil {
+		m.close()
+	}
+	delete(c.muxes, addr)
+}
+
+// hello exchanges the maximum supported protocol versions with the server on a freshly
+// dialed connection and saves the negotiated version for the given addr. The hello message
+// is framed with the legacy protocol, which every node speaks. The nodes which don't know
+// OpHello respond with StatusInternalServerError, they speak the legacy protocol.
+func (c *Client) hello(addr string, conn net.Conn) error {
+	req := &protocol.Message{
+		Header: protocol.Header{
+			Magic: protocol.MagicReq,
+			Op:    protocol.OpHello,
+		},
+		Extra:  protocol.HelloExtra{MaxVersion: protocol.MaxProtocolVersion},
+		Legacy: true,
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return err
+	}
+	resp := protocol.Message{Legacy: true}
+	err = resp.Read(conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status == protocol.StatusTooManyConnections {
+		return ErrTooManyConnections
+	}
+	if resp.Status == protocol.StatusInternalServerError {
+		resp.Value = []byte{protocol.LegacyProtocolVersion}
+	} else if resp.Status != protocol.StatusOK || len(resp.Value) != 1 {
+		return fmt.Errorf("protocol version negotiation failed: %s", string(resp.Value))
+	}
+	c.mu.Lock()
+	c.versions[addr] = resp.Value[0]
+	c.mu.Unlock()
+	return nil
+}
+
+// auth authenticates the connection with the credential.
+func (c *Client) auth(addr string, conn net.Conn) error {
+	req := &protocol.Message{
+		Header: protocol.Header{
+			Magic: protocol.MagicReq,
+			Op:    protocol.OpAuth,
+		},
+		Value: c.config.Credential,
+	}
+	c.setVersion(addr, req)
+	err := req.Write(conn)
+	if err != nil {
+		return err
+	}
+	resp := protocol.Message{Legacy: req.Legacy}
+	err = resp.Read(conn)
+	if err != nil {
+		return err
+	}
+	if resp.Status != protocol.StatusOK {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (c *Client) version(addr string) uint8 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.versions[addr]
+}
+
+// setVersion sets the negotiated protocol version of addr to the request. The requests to the
+// nodes which speak the legacy protocol are framed without the version.
+func (c *Client) setVersion(addr string, req *protocol.Message) {
+	req.Version = c.version(addr)
+	req.Legacy = req.Version == protocol.LegacyProtocolVersion
+}
+
+// dial connects to addr, negotiates the protocol version and authenticates the connection.
+func (c *Client) dial(addr string) (net.Conn, error) {
+	nc, err := c.dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := nc.(*net.TCPConn); ok {
+		if err = tc.SetNoDelay(!c.config.DisableNoDelay); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.config.TLSConfig != nil {
+		nc, err = c.handshake(addr, nc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = c.hello(addr, nc); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if c.config.Credential != nil {
+		if err = c.auth(addr, nc); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return nc, nil
 }
 
 func (c *Client) getPool(addr string) (pool.Pool, error) {
 	factory := func() (net.Conn, error) {
-		return c.dialer.Dial("tcp", addr)
+		nc, err := c.dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return &conn{Conn: nc, lastUsed: time.Now()}, nil
 	}
 
 	c.mu.RLock()
@@ -112,44 +324,350 @@ func (c *Client) getPool(addr string) (pool.Pool, error) {
 	return cpool, nil
 }
 
-// RequestTo initiates a request-response cycle to given host.
+// getMux returns the multiplexed connection to addr, a broken one is dialed again. It returns nil if the
+// peer doesn't speak protocol.RequestIDVersion.
+func (c *Client) getMux(addr string) (*muxConn, error) {
+	c.mu.RLock()
+	m, ok := c.muxes[addr]
+	c.mu.RUnlock()
+	if ok && (m == nil || !m.broken()) {
+		return m, nil
+	}
+
+	c.mu.Lock()
+	dialMu, ok := c.muxDials[addr]
+	if !ok {
+		dialMu = &sync.Mutex{}
+		c.muxDials[addr] = dialMu
+	}
+	c.mu.Unlock()
+	dialMu.Lock()
+	defer dialMu.Unlock()
+
+	// It may have been dialed by another request in the meantime.
+	c.mu.RLock()
+	m, ok = c.muxes[addr]
+	c.mu.RUnlock()
+	if ok && (m == nil || !m.broken()) {
+		return m, nil
+	}
+	nc, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.version(addr) < protocol.RequestIDVersion {
+		nc.Close()
+		m = nil
+	} else {
+		m = newMuxConn(nc)
+	}
+	c.mu.Lock()
+	c.muxes[addr] = m
+	c.mu.Unlock()
+	return m, nil
+}
+
+// handshake wraps the connection with TLS and completes the handshake. It closes the connection
+// if the handshake fails.
+func (c *Client) handshake(addr string, nc net.Conn) (net.Conn, error) {
+	config := c.config.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tc := tls.Client(nc, config)
+	if c.config.DialTimeout != 0 {
+		err := tc.SetDeadline(time.Now().Add(c.config.DialTimeout))
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	err := tc.Handshake()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	err = tc.SetDeadline(time.Time{})
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// getConn returns a connection from the pool. The connections which stayed idle longer than
+// IdleTimeout are closed and skipped.
+func (c *Client) getConn(cpool pool.Pool) (net.Conn, error) {
+	for {
+		pc, err := cpool.Get()
+		if err != nil {
+			return nil, err
+		}
+		if c.config.IdleTimeout == 0 {
+			return pc, nil
+		}
+		if time.Since(pc.(*pool.PoolConn).Conn.(*conn).lastUsed) < c.config.IdleTimeout {
+			return pc, nil
+		}
+		pc.(*pool.PoolConn).MarkUnusable()
+		if err = pc.Close(); err != nil {
+			log.Printf("[ERROR] Failed to close idle connection: %v", err)
+		}
+	}
+}
+
+// releaseConn puts the connection back to the pool. A connection which failed in a
+// request-response cycle is closed instead, its state is unknown.
+func releaseConn(pc net.Conn, failed bool) {
+	if failed {
+		pc.(*pool.PoolConn).MarkUnusable()
+	} else {
+		pc.(*pool.PoolConn).Conn.(*conn).lastUsed = time.Now()
+	}
+	err := pc.Close()
+	if err != nil {
+		log.Printf("[ERROR] Failed to close connection: %v", err)
+	}
+}
+
+func (c *Client) getBreaker(addr string) *breaker {
+	if c.config.BreakerThreshold == 0 {
+		return nil
+	}
+	c.mu.RLock()
+	b, ok := c.breakers[addr]
+	c.mu.RUnlock()
+	if ok {
+		return b
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok = c.breakers[addr]
+	if !ok {
+		b = &breaker{
+			addr:      addr,
+			threshold: c.config.BreakerThreshold,
+			cooldown:  c.config.BreakerCooldown,
+			onChange:  c.config.OnBreakerStateChange,
+		}
+		c.breakers[addr] = b
+	}
+	return b
+}
+
+// RequestTo initiates a request-response cycle to given host. It returns ErrPeerUnavailable
+// if the circuit breaker of the host is open.
 func (c *Client) RequestTo(addr string, op protocol.OpCode, req *protocol.Message) (*protocol.Message, error) {
+	if c.config.Tracer != nil {
+		parent := req.Trace
+		req.Op = op
+		end := c.config.Tracer(addr, req)
+		resp, err := c.requestWithBreaker(addr, op, req)
+		end(resp, err)
+		req.Trace = parent
+		return resp, err
+	}
+	return c.requestWithBreaker(addr, op, req)
+}
+
+func (c *Client) requestWithBreaker(addr string, op protocol.OpCode, req *protocol.Message) (*protocol.Message, error) {
+	b := c.getBreaker(addr)
+	if b == nil {
+		return c.requestTo(addr, op, req)
+	}
+	if !b.allow() {
+		return nil, ErrPeerUnavailable
+	}
+	resp, err := c.requestTo(addr, op, req)
+	b.done(err != nil && isRetryable(err))
+	return resp, err
+}
+
+func (c *Client) requestTo(addr string, op protocol.OpCode, req *protocol.Message) (*protocol.Message, error) {
+	if c.config.Multiplex {
+		m, err := c.getMux(addr)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			req.Magic = protocol.MagicReq
+			req.Version = c.version(addr)
+			req.Op = op
+			return m.roundTrip(req)
+		}
+	}
+
 	cpool, err := c.getPool(addr)
 	if err != nil {
 		return nil, err
 	}
 
+	pc, err := c.getConn(cpool)
+	if err != nil {
+		return nil, err
+	}
 	req.Magic = protocol.MagicReq
+	c.setVersion(addr, req)
 	req.Op = op
+	// A pooled connection carries one request at a time, the request doesn't need an ID.
+	req.RequestID = 0
+
+	defer func() {
+		// Broken connections, i.e. protocol.ErrConnClosed, are discarded.
+		releaseConn(pc, err != nil)
+	}()
+
+	err = req.Write(pc)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := protocol.Message{Legacy: req.Legacy}
+	err = resp.Read(pc)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, err
+}
+
+// RequestBatch sends the given requests to addr on one connection and returns the responses in
+// the same order, the server processes the requests of a connection one by one. The opcodes of
+// the requests must be set. The requests are written while the responses are read, so a big batch
+// doesn't fill up the socket buffers. A batch is not retried; if it fails with a network error,
+// some of the requests may have been processed. It returns ErrPeerUnavailable if the circuit breaker
+// of the host is open.
+func (c *Client) RequestBatch(addr string, reqs []*protocol.Message) ([]*protocol.Message, error) {
+	b := c.getBreaker(addr)
+	if b != nil && !b.allow() {
+		return nil, ErrPeerUnavailable
+	}
+	resps, err := c.requestBatch(addr, reqs)
+	if b != nil {
+		b.done(err != nil && isRetryable(err))
+	}
+	return resps, err
+}
 
-	conn, err := cpool.Get()
+func (c *Client) requestBatch(addr string, reqs []*protocol.Message) ([]*protocol.Message, error) {
+	cpool, err := c.getPool(addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := c.getConn(cpool)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
-		err = conn.Close()
-		if err != nil {
-			log.Printf("[ERROR] Failed to close connection: %v", err)
+		releaseConn(pc, err != nil)
+	}()
+
+	// fail records the first error of the writer and the reader, and unblocks the other one.
+	// The connection is discarded.
+	var once sync.Once
+	var first error
+	fail := func(e error) {
+		once.Do(func() {
+			first = e
+			_ = pc.SetDeadline(time.Now())
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, req := range reqs {
+			req.Magic = protocol.MagicReq
+			c.setVersion(addr, req)
+			// The responses of the requests without an ID are written in order.
+			req.RequestID = 0
+			if werr := req.Write(pc); werr != nil {
+				fail(werr)
+				return
+			}
 		}
 	}()
 
-	err = req.Write(conn)
-	if err != nil {
+	resps := make([]*protocol.Message, 0, len(reqs))
+	for _, req := range reqs {
+		resp := protocol.Message{Legacy: c.version(addr) == protocol.LegacyProtocolVersion}
+		rerr := resp.Read(pc)
+		if _, ok := rerr.(*protocol.ValueTooBigError); ok {
+			// The body of the response is discarded, the connection is still usable.
+			resps = append(resps, req.Error(protocol.StatusValueTooBig, rerr))
+			continue
+		}
+		if rerr != nil {
+			fail(rerr)
+			break
+		}
+		resps = append(resps, &resp)
+	}
+	<-done
+	if first != nil {
+		err = first
 		return nil, err
 	}
+	return resps, nil
+}
 
-	var resp protocol.Message
-	err = resp.Read(conn)
+// Ping sends OpPing to given host and returns the round trip time.
+func (c *Client) Ping(addr string) (time.Duration, error) {
+	now := time.Now()
+	resp, err := c.RequestTo(addr, protocol.OpPing, &protocol.Message{})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return &resp, err
+	if resp.Op != protocol.OpPong {
+		return 0, fmt.Errorf("unexpected response to ping: %d", resp.Op)
+	}
+	return time.Since(now), nil
+}
+
+// isRetryable reports whether a request which failed with err can be sent again. The network
+// errors are retryable, the host may be restarted or the cluster membership may be changed.
+func isRetryable(err error) bool {
+	err = errors.Cause(err)
+	if err == ErrPeerUnavailable || err == protocol.ErrConnClosed || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// backoff returns the delay before the given retry.
+func (c *Client) backoff(retry int) time.Duration {
+	delay := c.config.Backoff
+	for i := 1; i < retry; i++ {
+		delay *= 2
+		if c.config.MaxBackoff != 0 && delay >= c.config.MaxBackoff {
+			return c.config.MaxBackoff
+		}
+	}
+	return delay
 }
 
-// Request initiates a request-response cycle to randomly selected host.
+// Request initiates a request-response cycle to randomly selected host. The requests which fail
+// with a network error are retried on the next hosts, up to MaxAttempts. The hosts with an open
+// circuit breaker are skipped without waiting.
 func (c *Client) Request(op protocol.OpCode, req *protocol.Message) (*protocol.Message, error) {
 	// TODO: use an algorithm to distribute load fairly. Check out round-robin alg.
 	i := rand.Intn(len(c.config.Addrs))
-	addr := c.config.Addrs[i]
-	return c.RequestTo(addr, op, req)
+	for attempt := 1; ; attempt++ {
+		addr := c.config.Addrs[i]
+		resp, err := c.RequestTo(addr, op, req)
+		if err == nil || attempt >= c.config.MaxAttempts || !isRetryable(err) {
+			return resp, err
+		}
+		if err != ErrPeerUnavailable {
+			<-time.After(c.backoff(attempt))
+		}
+		i = (i + 1) % len(c.config.Addrs)
+	}
 }
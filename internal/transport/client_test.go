@@ -0,0 +1,367 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// newTestServer starts a server on a random port. It counts the dialed connections
+// by the hello messages.
+func newTestServer(t *testing.T, addr string, dials *int32) *Server {
+	s := NewServer(addr, nil, 0)
+	s.RegisterOperation(protocol.OpHello, func(req *protocol.Message) *protocol.Message {
+		atomic.AddInt32(dials, 1)
+		return s.helloOperation(req)
+	})
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	<-s.StartCh
+	return s
+}
+
+func shutdownTestServer(t *testing.T, s *Server) {
+	err := s.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestClient_ReuseConnection(t *testing.T) {
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		_, err := c.Ping(addr)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("Expected 1 connection. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+func TestClient_IdleTimeout(t *testing.T) {
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, MaxConn: 1, IdleTimeout: 50 * time.Millisecond})
+	defer c.Close()
+	_, err := c.Ping(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	<-time.After(100 * time.Millisecond)
+	_, err = c.Ping(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Fatalf("Expected 2 connections. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+func TestClient_DiscardBrokenConnection(t *testing.T) {
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	addr := s.listener.Addr().String()
+
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+	_, err := c.Ping(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// Restart the server. The pooled connection is closed by the peer.
+	shutdownTestServer(t, s)
+	s = newTestServer(t, addr, &dials)
+	defer shutdownTestServer(t, s)
+
+	_, err = c.Ping(addr)
+	if err == nil {
+		t.Fatalf("Expected an error on the broken connection")
+	}
+	cpool, err := c.getPool(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if cpool.Len() != 0 {
+		t.Fatalf("Expected the broken connection to be discarded. Pool length: %d", cpool.Len())
+	}
+	_, err = c.Ping(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Fatalf("Expected 2 connections. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+func TestClient_RetryOnBrokenConnection(t *testing.T) {
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	addr := s.listener.Addr().String()
+
+	c := NewClient(&ClientConfig{
+		Addrs:       []string{addr},
+		DialTimeout: time.Second,
+		MaxConn:     1,
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+	})
+	defer c.Close()
+	_, err := c.Request(protocol.OpPing, &protocol.Message{})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	shutdownTestServer(t, s)
+	s = newTestServer(t, addr, &dials)
+	defer shutdownTestServer(t, s)
+
+	resp, err := c.Request(protocol.OpPing, &protocol.Message{})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Op != protocol.OpPong {
+		t.Fatalf("Expected OpPong. Got: %d", resp.Op)
+	}
+}
+
+func TestClient_NoRetryOnErrorStatus(t *testing.T) {
+	var dials, calls int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		atomic.AddInt32(&calls, 1)
+		return req.Error(protocol.StatusKeyNotFound, "")
+	})
+
+	c := NewClient(&ClientConfig{
+		Addrs:       []string{s.listener.Addr().String()},
+		DialTimeout: time.Second,
+		MaxConn:     1,
+		MaxAttempts: 3,
+	})
+	defer c.Close()
+	resp, err := c.Request(protocol.OpExGet, &protocol.Message{DMap: "mymap", Key: "mykey"})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusKeyNotFound {
+		t.Fatalf("Expected StatusKeyNotFound. Got: %d", resp.Status)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("Expected 1 call. Got: %d", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestClient_Backoff(t *testing.T) {
+	c := NewClient(&ClientConfig{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond})
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, delay := range expected {
+		if c.backoff(i+1) != delay {
+			t.Fatalf("Expected %v for retry %d. Got: %v", delay, i+1, c.backoff(i+1))
+		}
+	}
+}
+
+func TestClient_RequestBatch(t *testing.T) {
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+	// Echo the keys back, so the responses can be matched with the requests.
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		resp := req.Success()
+		resp.Value = []byte(req.Key)
+		return resp
+	})
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+
+	var reqs []*protocol.Message
+	for i := 0; i < 1000; i++ {
+		reqs = append(reqs, &protocol.Message{
+			Header: protocol.Header{Op: protocol.OpExGet},
+			Key:    strconv.Itoa(i),
+			Value:  make([]byte, 1024),
+		})
+	}
+	resps, err := c.RequestBatch(addr, reqs)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(resps) != len(reqs) {
+		t.Fatalf("Expected %d responses. Got: %d", len(reqs), len(resps))
+	}
+	for i, resp := range resps {
+		if string(resp.Value) != strconv.Itoa(i) {
+			t.Fatalf("Expected %d. Got: %s", i, resp.Value)
+		}
+	}
+	// The connection is reused.
+	_, err = c.Ping(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("Expected 1 connection. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+func TestClient_ValueTooBig(t *testing.T) {
+	protocol.SetDMapMaxValueSize("small", 4)
+	defer protocol.SetDMapMaxValueSize("small", 0)
+
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+	s.RegisterOperation(protocol.OpExPut, func(req *protocol.Message) *protocol.Message {
+		return req.Success()
+	})
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{Addrs: []string{addr}, DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+	resp, err := c.Request(protocol.OpExPut, &protocol.Message{DMap: "small", Key: "mykey", Value: make([]byte, 5)})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusValueTooBig {
+		t.Fatalf("Expected StatusValueTooBig. Got: %d", resp.Status)
+	}
+	if !strings.Contains(string(resp.Value), "5 bytes, limit is 4 bytes") {
+		t.Fatalf("Expected the size and the limit in the error message. Got: %s", resp.Value)
+	}
+	// The body is discarded, the connection is still usable.
+	_, err = c.Ping(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("Expected 1 connection. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+func TestClient_KeyTooBig(t *testing.T) {
+	protocol.MaxKeyLen = 8
+	defer func() {
+		protocol.MaxKeyLen = math.MaxUint16
+	}()
+
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+	s.RegisterOperation(protocol.OpExPut, func(req *protocol.Message) *protocol.Message {
+		return req.Success()
+	})
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{Addrs: []string{addr}, DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+	req := &protocol.Message{DMap: "mydmap", Key: "a-key-longer-than-the-limit", Value: []byte("myvalue")}
+	resp, err := c.Request(protocol.OpExPut, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusInternalServerError || !strings.Contains(string(resp.Value), protocol.ErrKeyTooBig.Error()) {
+		t.Fatalf("Expected ErrKeyTooBig. Got: %d %s", resp.Status, resp.Value)
+	}
+	// The body is discarded, the same connection is still usable.
+	resp, err = c.Request(protocol.OpExPut, &protocol.Message{DMap: "mydmap", Key: "mykey", Value: []byte("myvalue")})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("Expected StatusOK. Got: %d", resp.Status)
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("Expected 1 connection. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+// serveLegacy serves the connections of l like a node which speaks the legacy protocol. It doesn't
+// know OpHello and responds to the other requests with StatusOK.
+func serveLegacy(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				req := protocol.Message{Legacy: true}
+				if err := req.Read(conn); err != nil {
+					return
+				}
+				resp := req.Success()
+				if req.Op == protocol.OpHello {
+					resp = req.Error(protocol.StatusInternalServerError, "unknown operation: "+strconv.Itoa(int(req.Op)))
+				}
+				if err := resp.Write(conn); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestClient_LegacyPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer l.Close()
+	go serveLegacy(l)
+
+	addr := l.Addr().String()
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+	req := &protocol.Message{DMap: "mydmap", Key: "mykey", Value: []byte("myvalue")}
+	resp, err := c.RequestTo(addr, protocol.OpExPut, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("Expected StatusOK. Got: %d", resp.Status)
+	}
+	if c.version(addr) != protocol.LegacyProtocolVersion {
+		t.Fatalf("Expected version %d. Got: %d", protocol.LegacyProtocolVersion, c.version(addr))
+	}
+}
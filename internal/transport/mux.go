@@ -0,0 +1,134 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// result is the response of a request sent over a multiplexed connection, or the error of the request.
+type result struct {
+	resp *protocol.Message
+	err  error
+}
+
+// muxConn is a connection which carries many requests at the same time. Every request gets an ID, the
+// responses are matched with the pending requests by their IDs in any order.
+type muxConn struct {
+	conn net.Conn
+
+	// wmu serializes the writes of the requests.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan result
+	// err is the error which broke the connection, the requests fail with it.
+	err error
+}
+
+func newMuxConn(conn net.Conn) *muxConn {
+	m := &muxConn{
+		conn:    conn,
+		pending: make(map[uint32]chan result),
+	}
+	go m.readResponses()
+	return m
+}
+
+// broken reports whether the connection is closed.
+func (m *muxConn) broken() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err != nil
+}
+
+// fail closes the connection and fails the pending requests with err.
+func (m *muxConn) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	_ = m.conn.Close()
+	for id, ch := range m.pending {
+		ch <- result{err: err}
+		delete(m.pending, id)
+	}
+}
+
+// close closes the connection, the pending requests fail with protocol.ErrConnClosed.
+func (m *muxConn) close() {
+	m.fail(protocol.ErrConnClosed)
+}
+
+// roundTrip sends the request with a new ID and waits for its response.
+func (m *muxConn) roundTrip(req *protocol.Message) (*protocol.Message, error) {
+	ch := make(chan result, 1)
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	m.nextID++
+	if m.nextID == 0 {
+		// Zero means that the request has no ID.
+		m.nextID++
+	}
+	req.RequestID = m.nextID
+	m.pending[req.RequestID] = ch
+	m.mu.Unlock()
+
+	m.wmu.Lock()
+	err := req.Write(m.conn)
+	m.wmu.Unlock()
+	if err != nil {
+		// A part of the request may have been written, the connection is unusable.
+		m.fail(err)
+	}
+	r := <-ch
+	return r.resp, r.err
+}
+
+// readResponses reads the responses and hands them over to their requests until the connection is broken.
+func (m *muxConn) readResponses() {
+	for {
+		resp := &protocol.Message{}
+		err := resp.Read(m.conn)
+		if _, ok := err.(*protocol.ValueTooBigError); !ok && err != nil {
+			m.fail(err)
+			return
+		}
+		// The body of a response which is too big is discarded, the connection is still usable.
+		m.mu.Lock()
+		ch, ok := m.pending[resp.RequestID]
+		delete(m.pending, resp.RequestID)
+		m.mu.Unlock()
+		if !ok {
+			m.fail(fmt.Errorf("unexpected response with request ID %d", resp.RequestID))
+			return
+		}
+		if err != nil {
+			ch <- result{err: err}
+		} else {
+			ch <- result{resp: resp}
+		}
+	}
+}
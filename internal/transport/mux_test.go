@@ -0,0 +1,129 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestClient_Multiplex(t *testing.T) {
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+
+	// The requests are responded after all of them arrive, so they have to be handled at the same time.
+	const n = 10
+	var arrived int32
+	all := make(chan struct{})
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		if atomic.AddInt32(&arrived, 1) == n {
+			close(all)
+		}
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			return req.Error(protocol.StatusTimeout, "requests are not handled at the same time")
+		}
+		resp := req.Success()
+		resp.Value = []byte(req.Key)
+		return resp
+	})
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, Multiplex: true})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			resp, err := c.RequestTo(addr, protocol.OpExGet, &protocol.Message{Key: key})
+			if err != nil {
+				t.Errorf("Expected nil. Got: %v", err)
+				return
+			}
+			if resp.Status != protocol.StatusOK || string(resp.Value) != key {
+				t.Errorf("Expected the response of %s. Got: %d %s", key, resp.Status, resp.Value)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("Expected 1 connection. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+func TestClient_MultiplexOldPeer(t *testing.T) {
+	protocol.MaxProtocolVersion = protocol.MinProtocolVersion
+	defer func() {
+		protocol.MaxProtocolVersion = protocol.ProtocolVersion
+	}()
+
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	defer shutdownTestServer(t, s)
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, MaxConn: 1, Multiplex: true})
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Ping(addr); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	m, err := c.getMux(addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if m != nil {
+		t.Fatalf("Expected no multiplexed connection to a peer of version %d", protocol.MinProtocolVersion)
+	}
+	// The connection dialed to check the version, and the pooled one.
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Fatalf("Expected 2 connections. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
+
+func TestClient_MultiplexBrokenConnection(t *testing.T) {
+	var dials int32
+	s := newTestServer(t, "127.0.0.1:0", &dials)
+	addr := s.listener.Addr().String()
+
+	c := NewClient(&ClientConfig{DialTimeout: time.Second, Multiplex: true})
+	defer c.Close()
+	if _, err := c.Ping(addr); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// Restart the server. The multiplexed connection is closed by the peer.
+	shutdownTestServer(t, s)
+	s = newTestServer(t, addr, &dials)
+	defer shutdownTestServer(t, s)
+
+	<-time.After(100 * time.Millisecond)
+	if _, err := c.Ping(addr); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Fatalf("Expected 2 connections. Got: %d", atomic.LoadInt32(&dials))
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// DMapRateLimit returns the maximum number of requests per second to a DMap. Zero means no limit.
+type DMapRateLimit func(dmap string) float64
+
+// tokenBucket allows rate requests per second on average. It's full initially and holds the tokens of
+// a second, so the bursts up to rate requests are allowed.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: burstOf(rate),
+		last:   now,
+	}
+}
+
+// burstOf returns the capacity of a bucket. A bucket can hold at least one token, so a rate below one
+// request per second doesn't block all the requests.
+func burstOf(rate float64) float64 {
+	return math.Max(rate, 1)
+}
+
+// allow takes a token from the bucket with the given rate. It returns false if the bucket is empty.
+// The rate may have changed since the last call, the tokens are refilled with the new one.
+func (b *tokenBucket) allow(rate float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rate = rate
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.tokens+elapsed.Seconds()*b.rate, burstOf(b.rate))
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter contains the token buckets of the DMaps and the throttle counters. The buckets of the
+// connections are kept by the connections.
+type rateLimiter struct {
+	// connRate is the limit of a connection in requests per second, it's stored as the bits of a float64.
+	// throttledConns is the number of the requests rejected by the limits of the connections. They're
+	// accessed atomically, keep them 64-bit aligned.
+	connRate       uint64
+	throttledConns uint64
+
+	// limited returns true for the operations which are rate limited.
+	limited  func(op protocol.OpCode) bool
+	dmapRate DMapRateLimit
+
+	mu    sync.Mutex
+	dmaps map[string]*tokenBucket
+	// throttledDMaps is the number of the requests rejected by the limits of the DMaps.
+	throttledDMaps map[string]uint64
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		dmaps:          make(map[string]*tokenBucket),
+		throttledDMaps: make(map[string]uint64),
+	}
+}
+
+// allowDMap takes a token from the bucket of the DMap. The bucket of a DMap is dropped when its limit is
+// removed.
+func (l *rateLimiter) allowDMap(dmap string, now time.Time) bool {
+	rate := l.dmapRate(dmap)
+	l.mu.Lock()
+	b, ok := l.dmaps[dmap]
+	if rate <= 0 {
+		if ok {
+			delete(l.dmaps, dmap)
+		}
+		l.mu.Unlock()
+		return true
+	}
+	if !ok {
+		b = newTokenBucket(rate, now)
+		l.dmaps[dmap] = b
+	}
+	l.mu.Unlock()
+
+	if b.allow(rate, now) {
+		return true
+	}
+	l.mu.Lock()
+	l.throttledDMaps[dmap]++
+	l.mu.Unlock()
+	return false
+}
+
+// allowConn takes a token from the bucket of the connection.
+func (l *rateLimiter) allowConn(c *connection, now time.Time) bool {
+	rate := math.Float64frombits(atomic.LoadUint64(&l.connRate))
+	if rate <= 0 {
+		c.bucket = nil
+		return true
+	}
+	if c.bucket == nil {
+		c.bucket = newTokenBucket(rate, now)
+	}
+	if c.bucket.allow(rate, now) {
+		return true
+	}
+	atomic.AddUint64(&l.throttledConns, 1)
+	return false
+}
+
+// SetRateLimits enables the rate limits for the operations which limited returns true. The requests
+// beyond the limit of their connection, see SetConnRateLimit, or the limit of their DMap returned by
+// dmapRate get a StatusRateLimited response without being handled. dmapRate is called for every limited
+// request, it may return a different limit for the next one. It must be called before Start.
+func (s *Server) SetRateLimits(limited func(op protocol.OpCode) bool, dmapRate DMapRateLimit) {
+	s.limiter.limited = limited
+	s.limiter.dmapRate = dmapRate
+}
+
+// SetConnRateLimit sets the maximum number of requests per second of a connection. Zero disables the
+// limit. It's safe to call it while the server is running, the open connections get the new limit with
+// their next requests.
+func (s *Server) SetConnRateLimit(rate float64) {
+	if rate < 0 {
+		rate = 0
+	}
+	atomic.StoreUint64(&s.limiter.connRate, math.Float64bits(rate))
+}
+
+// Throttled returns the number of the requests rejected by the limits of the connections, and the number
+// of them rejected by the limits of the DMaps, keyed by DMap name.
+func (s *Server) Throttled() (conns uint64, dmaps map[string]uint64) {
+	s.limiter.mu.Lock()
+	defer s.limiter.mu.Unlock()
+	dmaps = make(map[string]uint64, len(s.limiter.throttledDMaps))
+	for name, n := range s.limiter.throttledDMaps {
+		dmaps[name] = n
+	}
+	return atomic.LoadUint64(&s.limiter.throttledConns), dmaps
+}
+
+// allow checks the rate limits of the request. The connection limit is checked first, so a throttled
+// connection doesn't consume the tokens of the DMap.
+func (s *Server) allow(req *protocol.Message, c *connection) bool {
+	l := s.limiter
+	if l.limited == nil || !l.limited(req.Op) {
+		return true
+	}
+	now := time.Now()
+	if !l.allowConn(c, now) {
+		return false
+	}
+	if req.DMap == "" || l.dmapRate == nil {
+		return true
+	}
+	return l.allowDMap(req.DMap, now)
+}
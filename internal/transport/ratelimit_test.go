@@ -0,0 +1,143 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, now)
+	for i := 0; i < 2; i++ {
+		if !b.allow(2, now) {
+			t.Fatalf("Expected the burst to be allowed")
+		}
+	}
+	if b.allow(2, now) {
+		t.Fatalf("Expected the bucket to be empty")
+	}
+
+	// A token is refilled in half a second.
+	now = now.Add(500 * time.Millisecond)
+	if !b.allow(2, now) {
+		t.Fatalf("Expected a refilled token")
+	}
+	if b.allow(2, now) {
+		t.Fatalf("Expected the bucket to be empty")
+	}
+
+	// The bucket doesn't hold more than a second of tokens.
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if !b.allow(2, now) {
+			t.Fatalf("Expected the burst to be allowed")
+		}
+	}
+	if b.allow(2, now) {
+		t.Fatalf("Expected the bucket to be empty")
+	}
+
+	// A rate below one request per second still allows a request.
+	b = newTokenBucket(0.5, now)
+	if !b.allow(0.5, now) {
+		t.Fatalf("Expected a request to be allowed")
+	}
+	if b.allow(0.5, now.Add(time.Second)) {
+		t.Fatalf("Expected the bucket to be empty")
+	}
+	if !b.allow(0.5, now.Add(2*time.Second)) {
+		t.Fatalf("Expected a refilled token")
+	}
+}
+
+func roundTrip(t *testing.T, conn net.Conn, op protocol.OpCode, dmap string) protocol.StatusCode {
+	req := &protocol.Message{
+		Header: protocol.Header{
+			Magic: protocol.MagicReq,
+			Op:    op,
+		},
+		DMap: dmap,
+		Key:  "mykey",
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var resp protocol.Message
+	if err := resp.Read(conn); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	return resp.Status
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	s := NewServer("127.0.0.1:0", nil, 0)
+	for _, op := range []protocol.OpCode{protocol.OpExGet, protocol.OpGetBackup} {
+		s.RegisterOperation(op, func(req *protocol.Message) *protocol.Message {
+			return req.Success()
+		})
+	}
+	s.SetRateLimits(func(op protocol.OpCode) bool {
+		return op == protocol.OpExGet
+	}, func(dmap string) float64 {
+		if dmap == "limited" {
+			return 1
+		}
+		return 0
+	})
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	<-s.StartCh
+	defer shutdownTestServer(t, s)
+
+	conn := dialTestServer(t, s.listener.Addr().String())
+	defer conn.Close()
+
+	expect := func(op protocol.OpCode, dmap string, expected protocol.StatusCode) {
+		if status := roundTrip(t, conn, op, dmap); status != expected {
+			t.Fatalf("Expected status %d for %s on %s. Got: %d", expected, op, dmap, status)
+		}
+	}
+	// The limit of the DMap.
+	expect(protocol.OpExGet, "limited", protocol.StatusOK)
+	expect(protocol.OpExGet, "limited", protocol.StatusRateLimited)
+	expect(protocol.OpExGet, "unlimited", protocol.StatusOK)
+	// The operations which are not limited.
+	expect(protocol.OpGetBackup, "limited", protocol.StatusOK)
+
+	// The limit of the connection is changed while the server is running.
+	s.SetConnRateLimit(1)
+	expect(protocol.OpExGet, "unlimited", protocol.StatusOK)
+	expect(protocol.OpExGet, "unlimited", protocol.StatusRateLimited)
+	s.SetConnRateLimit(0)
+	expect(protocol.OpExGet, "unlimited", protocol.StatusOK)
+
+	conns, dmaps := s.Throttled()
+	if conns != 1 {
+		t.Fatalf("Expected 1 request throttled by the connection limit. Got: %d", conns)
+	}
+	if !reflect.DeepEqual(dmaps, map[string]uint64{"limited": 1}) {
+		t.Fatalf("Expected 1 request throttled by the DMap limit. Got: %v", dmaps)
+	}
+}
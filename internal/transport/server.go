@@ -17,8 +17,10 @@ package transport
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -41,18 +43,180 @@ const (
 	busyConn uint32 = 1
 )
 
+// TLSHandshakeTimeout is the maximum time spent for the TLS handshake of a new connection.
+var TLSHandshakeTimeout = 10 * time.Second
+
+// errSlowConsumer is returned when the outbound queue of a connection is full and the server
+// closes the slow connections.
+var errSlowConsumer = errors.New("outbound queue is full")
+
+// rejectTimeout is the maximum time spent for sending the error to a rejected connection, or to a connection
+// which is out of sync.
+var rejectTimeout = time.Second
+
+// maxInflight is the maximum number of the requests with an ID handled at the same time on a connection.
+// The server stops reading from the connection until one of them is handled.
+var maxInflight = 256
+
+// Observer is called after a request is handled. elapsed is the time spent by the operation and
+// writing the response. The sizes of the messages on the wire are valid, see protocol.Message.Size.
+type Observer func(req, resp *protocol.Message, elapsed time.Duration)
+
+// Tracer is called before a request is handled. It may replace req.Trace with the trace context
+// of its span, so the requests sent by the operation are linked to it. The returned function is
+// called after the response is written.
+type Tracer func(req *protocol.Message) func(resp *protocol.Message)
+
+// Authenticator is called with the credential of an OpAuth request. The connection is authenticated,
+// if it returns nil.
+type Authenticator func(credential []byte, conn net.Conn) error
+
+// Authorizer is called before a request is handled. The request is denied with StatusForbidden
+// if it returns an error.
+type Authorizer func(req *protocol.Message, conn net.Conn) error
+
+// ConnStats contains the traffic of a connection to the server.
+type ConnStats struct {
+	// RemoteAddr is the address of the client.
+	RemoteAddr string
+
+	// Since is the time when the connection is accepted.
+	Since time.Time
+
+	// BytesRead and BytesWritten are the number of bytes of the messages read from and written to
+	// the connection.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// response is a response waiting in the outbound queue of a connection. req is nil for the responses
+// which are not observed, i.e. the errors of the malformed requests.
+type response struct {
+	req   *protocol.Message
+	resp  *protocol.Message
+	start time.Time
+	end   func(*protocol.Message)
+}
+
+// connection is a connection accepted by the server.
+type connection struct {
+	// The counters are accessed atomically, keep them 64-bit aligned.
+	read    uint64
+	written uint64
+	status  uint32
+	// pending is the number of the responses which are not written yet.
+	pending int32
+
+	conn          net.Conn
+	since         time.Time
+	authenticated bool
+	// legacy is true until the client negotiates a versioned protocol with OpHello. The clients which
+	// don't send OpHello speak the legacy protocol. It's only accessed by the reader of the connection.
+	legacy bool
+	out    chan *response
+	reader deadlineReader
+	// bucket is the token bucket of the connection, it's nil if the connection has no rate limit.
+	bucket *tokenBucket
+	// inflight holds a token for every request with an ID which is being handled, handlers waits for them.
+	inflight chan struct{}
+	handlers sync.WaitGroup
+}
+
+// deadlineReader sets the read deadline of the connection when the first bytes of a message arrive,
+// so the rest of the message must be read within the timeout. A connection may wait for its next
+// request as long as it likes, but a sender which trickles a request doesn't pin the goroutine.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	armed   bool
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 && !r.armed && r.timeout > 0 {
+		r.armed = true
+		if derr := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return n, err
+}
+
+// disarm clears the read deadline set for the last message.
+func (r *deadlineReader) disarm() error {
+	if !r.armed {
+		return nil
+	}
+	r.armed = false
+	return r.conn.SetReadDeadline(time.Time{})
+}
+
+// idle reports whether the connection is waiting for a new request and all the responses are written.
+func (c *connection) idle() bool {
+	return atomic.LoadUint32(&c.status) == idleConn && len(c.inflight) == 0 && atomic.LoadInt32(&c.pending) == 0
+}
+
+func (c *connection) readMessage(m *protocol.Message) error {
+	m.Legacy = c.legacy
+	err := m.Read(&c.reader)
+	atomic.AddUint64(&c.read, uint64(m.Size()))
+	// The connection may still be usable after a rejected request, i.e. a value is too big.
+	if derr := c.reader.disarm(); err == nil {
+		err = derr
+	}
+	return err
+}
+
+func (c *connection) writeMessage(m *protocol.Message) error {
+	err := m.Write(c.conn)
+	atomic.AddUint64(&c.written, uint64(m.Size()))
+	return err
+}
+
+func (c *connection) stats() ConnStats {
+	return ConnStats{
+		RemoteAddr:   c.conn.RemoteAddr().String(),
+		Since:        c.since,
+		BytesRead:    atomic.LoadUint64(&c.read),
+		BytesWritten: atomic.LoadUint64(&c.written),
+	}
+}
+
 // Server implements a concurrent TCP server.
 type Server struct {
+	// The counters are accessed atomically, keep them 64-bit aligned.
+	droppedConns     uint64
+	droppedResponses uint64
+	rejectedConns    uint64
+	// The number of open connections, the highest number of them and their limit. They're accessed atomically.
+	conns     int32
+	peakConns int32
+	maxConns  int32
+
 	addr            string
 	keepAlivePeriod time.Duration
 	operations      operations
 	logger          *log.Logger
 	wg              sync.WaitGroup
 	listener        *net.TCPListener
+	mu              sync.Mutex
+	extraListeners  []*net.TCPListener
+	connections     map[*connection]struct{}
 	connCh          chan net.Conn
 	StartCh         chan struct{}
 	ctx             context.Context
 	cancel          context.CancelFunc
+	observer        Observer
+	tracer          Tracer
+	authorizer      Authorizer
+	authenticator   Authenticator
+	authTimeout     time.Duration
+	queueSize       int
+	closeOnFull     bool
+	noDelay         bool
+	timeouts        map[protocol.OpCode]time.Duration
+	readTimeout     time.Duration
+	limiter         *rateLimiter
 }
 
 // NewServer creates and returns a new Server.
@@ -61,16 +225,196 @@ func NewServer(addr string, logger *log.Logger, keepalivePeriod time.Duration) *
 	if logger == nil {
 		logger = log.New(os.Stderr, "", log.LstdFlags)
 	}
-	return &Server{
+	s := &Server{
 		operations:      operations{m: make(map[protocol.OpCode]protocol.Operation)},
 		addr:            addr,
 		keepAlivePeriod: keepalivePeriod,
 		logger:          logger,
 		connCh:          make(chan net.Conn),
+		connections:     make(map[*connection]struct{}),
+		queueSize:       1,
+		noDelay:         true,
 		StartCh:         make(chan struct{}),
 		ctx:             ctx,
 		cancel:          cancel,
+		limiter:         newRateLimiter(),
 	}
+	s.RegisterOperation(protocol.OpHello, s.helloOperation)
+	s.RegisterOperation(protocol.OpPing, s.pingOperation)
+	return s
+}
+
+// pingOperation replies with OpPong and the current unix time of the server in nanoseconds.
+func (s *Server) pingOperation(req *protocol.Message) *protocol.Message {
+	resp := req.Success()
+	resp.Op = protocol.OpPong
+	resp.Value = make([]byte, 8)
+	binary.BigEndian.PutUint64(resp.Value, uint64(time.Now().UnixNano()))
+	return resp
+}
+
+// helloOperation negotiates the protocol version with the client. The response value
+// is the highest protocol version supported by both sides.
+func (s *Server) helloOperation(req *protocol.Message) *protocol.Message {
+	version := protocol.MaxProtocolVersion
+	if extra, ok := req.Extra.(protocol.HelloExtra); ok && extra.MaxVersion < version {
+		version = extra.MaxVersion
+	}
+	resp := req.Success()
+	resp.Value = []byte{version}
+	return resp
+}
+
+// SetObserver sets a function which is called after every request. Set it before serving any request.
+func (s *Server) SetObserver(f Observer) {
+	s.observer = f
+}
+
+// SetTracer sets the tracer of the requests. It must be called before Start.
+func (s *Server) SetTracer(f Tracer) {
+	s.tracer = f
+}
+
+// SetAuthorizer sets the authorizer of the requests. It must be called before Start.
+func (s *Server) SetAuthorizer(f Authorizer) {
+	s.authorizer = f
+}
+
+// SetAuthenticator sets the authenticator of the connections. A connection must be authenticated with
+// OpAuth within timeout, the other requests except OpHello get StatusUnauthorized until then.
+// It must be called before Start.
+func (s *Server) SetAuthenticator(f Authenticator, timeout time.Duration) {
+	s.authenticator = f
+	s.authTimeout = timeout
+}
+
+// SetBackpressure sets the size of the outbound queue of the connections. The requests of a connection are
+// handled while its responses are written. If the queue is full, i.e. the client doesn't read its responses,
+// the server stops reading the requests of the connection. It closes the connection instead, if closeOnFull
+// is true. It must be called before Start.
+func (s *Server) SetBackpressure(queueSize int, closeOnFull bool) {
+	s.queueSize = queueSize
+	s.closeOnFull = closeOnFull
+}
+
+// SetNoDelay controls TCP_NODELAY on the accepted connections. It's true by default, so the Nagle algorithm
+// is disabled. It must be called before Start.
+func (s *Server) SetNoDelay(noDelay bool) {
+	s.noDelay = noDelay
+}
+
+// SetOperationTimeouts sets the maximum durations of the operations. A request which exceeds the timeout of
+// its operation gets a StatusTimeout response. It must be called before Start.
+func (s *Server) SetOperationTimeouts(timeouts map[protocol.OpCode]time.Duration) {
+	s.timeouts = timeouts
+}
+
+// SetReadTimeout sets the maximum time to read a request after its first bytes arrive. The connection is
+// closed if the rest of the request doesn't arrive in time. The connections waiting for unauthenticated
+// requests are limited by the authentication timeout instead. It must be called before Start.
+func (s *Server) SetReadTimeout(timeout time.Duration) {
+	s.readTimeout = timeout
+}
+
+// Dropped returns the number of the connections closed because their outbound queues were full, and the
+// number of the responses discarded with them.
+func (s *Server) Dropped() (conns, responses uint64) {
+	return atomic.LoadUint64(&s.droppedConns), atomic.LoadUint64(&s.droppedResponses)
+}
+
+// ConnCount returns the number of open connections.
+func (s *Server) ConnCount() int {
+	return int(atomic.LoadInt32(&s.conns))
+}
+
+// SetMaxConns sets the maximum number of open connections. The new connections beyond it get a response
+// with StatusTooManyConnections instead of the hello response, then they're closed. The open connections
+// are not affected if it's lowered. Zero disables the limit. It's safe to call it while the server is running.
+func (s *Server) SetMaxConns(max int) {
+	if max < 0 {
+		max = 0
+	}
+	atomic.StoreInt32(&s.maxConns, int32(max))
+}
+
+// PeakConnCount returns the highest number of open connections since the server has started.
+func (s *Server) PeakConnCount() int {
+	return int(atomic.LoadInt32(&s.peakConns))
+}
+
+// RejectedConns returns the number of the connections rejected because of the connection limit.
+func (s *Server) RejectedConns() uint64 {
+	return atomic.LoadUint64(&s.rejectedConns)
+}
+
+// acquireConn counts a new connection. It returns false if the connection limit is reached.
+func (s *Server) acquireConn() bool {
+	for {
+		n := atomic.LoadInt32(&s.conns)
+		if max := atomic.LoadInt32(&s.maxConns); max > 0 && n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.conns, n, n+1) {
+			n++
+			for {
+				peak := atomic.LoadInt32(&s.peakConns)
+				if n <= peak || atomic.CompareAndSwapInt32(&s.peakConns, peak, n) {
+					return true
+				}
+			}
+		}
+	}
+}
+
+// rejectConn sends StatusTooManyConnections to a connection over the limit and closes it. The client reads
+// it as the response of its hello message.
+func (s *Server) rejectConn(conn net.Conn) {
+	atomic.AddUint64(&s.rejectedConns, 1)
+	s.logger.Printf("[WARN] Rejected the connection of %s: too many connections", conn.RemoteAddr())
+	defer conn.Close()
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(tc); err != nil {
+			return
+		}
+	}
+	if err := conn.SetDeadline(time.Now().Add(rejectTimeout)); err != nil {
+		return
+	}
+	resp := &protocol.Message{
+		Header: protocol.Header{
+			Magic:  protocol.MagicRes,
+			Op:     protocol.OpHello,
+			Status: protocol.StatusTooManyConnections,
+		},
+		Value:  []byte("too many connections"),
+		Legacy: true,
+	}
+	if err := resp.Write(conn); err != nil {
+		return
+	}
+	drainConn(conn)
+}
+
+// drainConn closes the writing side of the connection and discards the incoming data until the client
+// closes it, or the deadline of the connection. Closing a connection with unread data resets it and the
+// client may lose the last response.
+func drainConn(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	_, _ = io.Copy(ioutil.Discard, conn)
+}
+
+// ConnStats returns the traffic of the open connections.
+func (s *Server) ConnStats() []ConnStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]ConnStats, 0, len(s.connections))
+	for c := range s.connections {
+		stats = append(stats, c.stats())
+	}
+	return stats
 }
 
 // RegisterOperation registers a function for given OpCode.
@@ -79,32 +423,255 @@ func (s *Server) RegisterOperation(op protocol.OpCode, e protocol.Operation) {
 }
 
 // waitForRequest waits for a new request, handles it and returns the appropriate response.
-func (s *Server) waitForRequest(req *protocol.Message, conn io.ReadWriter, connStatus *uint32) error {
-	defer atomic.StoreUint32(connStatus, idleConn) // Mark connection as idle before start waiting a new request
-	err := req.Read(conn)
+func (s *Server) waitForRequest(req *protocol.Message, c *connection) error {
+	defer atomic.StoreUint32(&c.status, idleConn) // Mark connection as idle before start waiting a new request
+	err := c.readMessage(req)
 	if err != nil {
 		return errors.WithMessage(err, "failed to read request")
 	}
 	// Mark connection as busy.
-	atomic.StoreUint32(connStatus, busyConn)
+	atomic.StoreUint32(&c.status, busyConn)
+	if req.Op == protocol.OpAuth {
+		return s.authenticate(req, c)
+	}
 	opr, ok := s.operations.m[req.Op]
 	if !ok {
 		return fmt.Errorf("unknown operation: %d", req.Op)
 	}
-	resp := opr(req)
-	err = resp.Write(conn)
-	// WithMessage returns nil, if the err is nil.
-	return errors.WithMessage(err, "failed to write response")
+	if !c.authenticated && req.Op != protocol.OpHello {
+		return s.send(c, &response{resp: req.Error(protocol.StatusUnauthorized, "authentication required")})
+	}
+	r := &response{req: req}
+	if s.tracer != nil {
+		r.end = s.tracer(req)
+	}
+	r.start = time.Now()
+	if err = s.authorize(req, c.conn); err != nil {
+		r.resp = req.Error(protocol.StatusForbidden, err)
+	} else if !s.allow(req, c) {
+		r.resp = req.Error(protocol.StatusRateLimited, "rate limit exceeded")
+	} else if req.RequestID != 0 {
+		s.handleAsync(c, opr, r)
+		return nil
+	} else {
+		r.resp = s.handle(opr, req)
+	}
+	err = s.send(c, r)
+	if req.Op == protocol.OpHello && r.resp.Status == protocol.StatusOK && len(r.resp.Value) == 1 {
+		// The next requests of the client are framed with the negotiated version.
+		c.legacy = r.resp.Value[0] == protocol.LegacyProtocolVersion
+	}
+	return err
+}
+
+// handleAsync handles a request with an ID in the background, so the next requests of the connection are
+// handled at the same time. Their responses are written in the order of completion, the client matches
+// them with the requests by their IDs. It blocks while maxInflight requests of the connection are handled.
+func (s *Server) handleAsync(c *connection, opr protocol.Operation, r *response) {
+	c.inflight <- struct{}{}
+	c.handlers.Add(1)
+	go func() {
+		defer c.handlers.Done()
+		r.resp = s.handle(opr, r.req)
+		err := s.send(c, r)
+		<-c.inflight
+		if err != nil {
+			// The reader of the connection stops when the connection is closed.
+			s.closeSlowConn(c)
+		}
+	}()
+}
+
+// handle calls the operation for the request. If the operation has a timeout, the context of the request
+// is done after the timeout and the request gets a StatusTimeout response. The long-running operations
+// check the context and stop early. The others keep running in the background until they return, so their
+// locks are released, and their responses are discarded.
+func (s *Server) handle(opr protocol.Operation, req *protocol.Message) *protocol.Message {
+	timeout, ok := s.timeouts[req.Op]
+	if !ok || timeout <= 0 {
+		return opr(req)
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	req.SetContext(ctx)
+
+	done := make(chan *protocol.Message, 1)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		done <- opr(req)
+	}()
+	select {
+	case resp := <-done:
+		return resp
+	case <-ctx.Done():
+		s.logger.Printf("[WARN] %s request of %s timed out after %v", req.Op, req.DMap, timeout)
+		return req.Error(protocol.StatusTimeout, "operation timeout")
+	}
+}
+
+// send puts the response into the outbound queue of the connection. It blocks until the queue has room,
+// or returns errSlowConsumer if the server closes the slow connections.
+func (s *Server) send(c *connection, r *response) error {
+	if r.req != nil {
+		// The response may have been received from another node, i.e. a forwarded request.
+		r.resp.Version = r.req.Version
+		r.resp.Legacy = r.req.Legacy
+		r.resp.RequestID = r.req.RequestID
+	}
+	atomic.AddInt32(&c.pending, 1)
+	if !s.closeOnFull {
+		c.out <- r
+		return nil
+	}
+	select {
+	case c.out <- r:
+		return nil
+	default:
+		atomic.AddInt32(&c.pending, -1)
+		return errSlowConsumer
+	}
+}
+
+// writeResponses writes the responses in the outbound queue of the connection until it's closed. The
+// connection is closed after a failed write, the rest of the queue is discarded.
+func (s *Server) writeResponses(c *connection) {
+	var failed bool
+	for r := range c.out {
+		if !failed {
+			err := c.writeMessage(r.resp)
+			if r.end != nil {
+				r.end(r.resp)
+			}
+			if s.observer != nil && r.req != nil {
+				s.observer(r.req, r.resp, time.Since(r.start))
+			}
+			if err != nil {
+				// Failed to write to the socket. Fail early. This should be a bug or
+				// the underlying TCP socket is unstable or unusable.
+				if err != protocol.ErrConnClosed {
+					s.logger.Printf("[ERROR] Failed to write response: %v", err)
+				}
+				failed = true
+				_ = c.conn.Close()
+			}
+		}
+		atomic.AddInt32(&c.pending, -1)
+	}
+}
+
+// authenticate handles an OpAuth request. The deadline of the connection is cleared after it's authenticated.
+func (s *Server) authenticate(req *protocol.Message, c *connection) error {
+	var resp *protocol.Message
+	if s.authenticator == nil {
+		// Authentication is disabled, every connection is authenticated.
+		resp = req.Success()
+	} else if err := s.authenticator(req.Value, c.conn); err != nil {
+		s.logger.Printf("[WARN] Failed to authenticate %s: %v", c.conn.RemoteAddr(), err)
+		resp = req.Error(protocol.StatusUnauthorized, "authentication failed")
+	} else {
+		if !c.authenticated && s.authTimeout != 0 {
+			err = c.conn.SetDeadline(time.Time{})
+			if err != nil {
+				return err
+			}
+			c.reader.timeout = s.readTimeout
+		}
+		c.authenticated = true
+		resp = req.Success()
+	}
+	return s.send(c, &response{resp: resp})
+}
+
+// authorize returns an error if the request is denied by the authorizer.
+func (s *Server) authorize(req *protocol.Message, conn net.Conn) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	return s.authorizer(req, conn)
+}
+
+// handshake completes the TLS handshake of the connection before the first request is read.
+func (s *Server) handshake(conn *tls.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(TLSHandshakeTimeout))
+	if err != nil {
+		return err
+	}
+	err = conn.Handshake()
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
 }
 
 // handleConn reads from TCP socket and calls related functions to generate a response.
 func (s *Server) handleConn(conn net.Conn) {
 	defer s.wg.Done()
+	if !s.acquireConn() {
+		s.rejectConn(conn)
+		return
+	}
+	defer atomic.AddInt32(&s.conns, -1)
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := s.handshake(tc); err != nil {
+			s.logger.Printf("[DEBUG] TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+	}
+
+	c := &connection{
+		conn:          conn,
+		since:         time.Now(),
+		authenticated: s.authenticator == nil,
+		legacy:        true,
+		out:           make(chan *response, s.queueSize),
+		reader:        deadlineReader{conn: conn, timeout: s.readTimeout},
+		inflight:      make(chan struct{}, maxInflight),
+	}
+	s.mu.Lock()
+	s.connections[c] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.connections, c)
+		s.mu.Unlock()
+	}()
+
+	// The connection is dropped, if it's not authenticated within authTimeout.
+	if !c.authenticated && s.authTimeout != 0 {
+		// Clearing the read deadline after a message would clear the authentication deadline too.
+		c.reader.timeout = 0
+		if err := conn.SetDeadline(time.Now().Add(s.authTimeout)); err != nil {
+			s.logger.Printf("[DEBUG] Failed to set deadline: %v", err)
+			_ = conn.Close()
+			return
+		}
+	}
 
-	var connStatus uint32
 	done := make(chan struct{})
 	defer close(done)
 
+	written := make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(written)
+		s.writeResponses(c)
+	}()
+	// desynced is set if the connection is closed after a framing error.
+	var desynced bool
+	// Wait for the requests being handled and the queued responses before closing the connection.
+	defer func() {
+		c.handlers.Wait()
+		close(c.out)
+		<-written
+		if desynced && conn.SetDeadline(time.Now().Add(rejectTimeout)) == nil {
+			drainConn(conn)
+		}
+	}()
+
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -113,13 +680,13 @@ func (s *Server) handleConn(conn net.Conn) {
 		case <-done:
 		}
 
-		if atomic.LoadUint32(&connStatus) != idleConn {
+		if !c.idle() {
 			s.logger.Printf("[DEBUG] Connection is busy, waiting")
 			ticker := time.NewTicker(100 * time.Millisecond)
 			defer ticker.Stop()
 			for {
 				<-ticker.C
-				if atomic.LoadUint32(&connStatus) == idleConn {
+				if c.idle() {
 					s.logger.Printf("[DEBUG] Connection is idle, closing")
 					break
 				}
@@ -133,20 +700,41 @@ func (s *Server) handleConn(conn net.Conn) {
 
 	for {
 		var req protocol.Message
-		err := s.waitForRequest(&req, conn, &connStatus)
+		err := s.waitForRequest(&req, c)
 		if err != nil {
 			// The socket probably would have been closed by the client.
 			if errors.Cause(err) == io.EOF || errors.Cause(err) == protocol.ErrConnClosed {
 				break
 			}
+			if errors.Cause(err) == io.ErrUnexpectedEOF {
+				s.logger.Printf("[DEBUG] Connection from %s is closed in the middle of a request", conn.RemoteAddr())
+				break
+			}
+			if nerr, ok := errors.Cause(err).(net.Error); ok && nerr.Timeout() {
+				s.logger.Printf("[DEBUG] Dropped connection from %s: %v", conn.RemoteAddr(), err)
+				break
+			}
+			if err == errSlowConsumer {
+				s.closeSlowConn(c)
+				break
+			}
 
 			// Protocol error. Prepare an error message and return it.
-			errResp := req.Error(protocol.StatusInternalServerError, err)
-			err = errResp.Write(conn)
+			status := protocol.StatusInternalServerError
+			if _, ok := errors.Cause(err).(*protocol.ValueTooBigError); ok {
+				s.logger.Printf("[WARN] Rejected a request from %s: %v", conn.RemoteAddr(), errors.Cause(err))
+				status = protocol.StatusValueTooBig
+			}
+			cause := errors.Cause(err)
+			err = s.send(c, &response{resp: req.Error(status, err)})
 			if err != nil {
-				// Failed to write to the socket. Fail early. This should be a bug or
-				// the underlying TCP socket is unstable or unusable.
-				s.logger.Printf("[ERROR] Failed to return error message: %v", err)
+				s.closeSlowConn(c)
+				break
+			}
+			if protocol.IsFramingError(cause) {
+				// The connection is out of sync. It's closed after the error response is written.
+				s.logger.Printf("[WARN] Closing the connection of %s: %v", conn.RemoteAddr(), cause)
+				desynced = true
 				break
 			}
 			// Continue waiting for incoming requests.
@@ -154,6 +742,15 @@ func (s *Server) handleConn(conn net.Conn) {
 	}
 }
 
+// closeSlowConn closes a connection whose outbound queue is full. The queued responses are discarded.
+func (s *Server) closeSlowConn(c *connection) {
+	s.logger.Printf("[WARN] Closed the connection of %s: %v", c.conn.RemoteAddr(), errSlowConsumer)
+	atomic.AddUint64(&s.droppedConns, 1)
+	// The response which doesn't fit in the queue is discarded too.
+	atomic.AddUint64(&s.droppedResponses, uint64(atomic.LoadInt32(&c.pending))+1)
+	_ = c.conn.Close()
+}
+
 func (s *Server) handleConns() {
 	defer s.wg.Done()
 
@@ -168,15 +765,21 @@ func (s *Server) handleConns() {
 	}
 }
 
-// waitForConnections calls Accept on given net.Listener.
-func (s *Server) waitForConnections(l net.Listener) error {
-	s.listener = l.(*net.TCPListener)
+// waitForConnections starts handling the connections and calls Accept on the given listener. The
+// accepted connections are wrapped with TLS, if tlsConfig is not nil.
+func (s *Server) waitForConnections(l *net.TCPListener, tlsConfig *tls.Config) error {
+	s.listener = l
 
 	s.wg.Add(1)
 	go s.handleConns()
 	close(s.StartCh)
+	return s.acceptConnections(l, tlsConfig)
+}
+
+// acceptConnections calls Accept on the given listener until the server is closed.
+func (s *Server) acceptConnections(l *net.TCPListener, tlsConfig *tls.Config) error {
 	for {
-		conn, err := s.listener.Accept()
+		tcpConn, err := l.AcceptTCP()
 		if err != nil {
 			select {
 			case <-s.ctx.Done():
@@ -186,22 +789,56 @@ func (s *Server) waitForConnections(l net.Listener) error {
 			s.logger.Printf("[DEBUG] Failed to accept TCP connection: %v", err)
 			continue
 		}
-		if s.keepAlivePeriod.Seconds() != 0 {
-			err = conn.(*net.TCPConn).SetKeepAlive(true)
-			if err != nil {
-				return err
-			}
-			err = conn.(*net.TCPConn).SetKeepAlivePeriod(s.keepAlivePeriod)
-			if err != nil {
-				return err
-			}
+		if err = s.setConnOptions(tcpConn); err != nil {
+			s.logger.Printf("[DEBUG] Failed to set TCP options of %s: %v", tcpConn.RemoteAddr(), err)
+			_ = tcpConn.Close()
+			continue
+		}
+		var conn net.Conn = tcpConn
+		if tlsConfig != nil {
+			// The handshake is done by handleConn, it doesn't block the accept loop.
+			conn = tls.Server(tcpConn, tlsConfig)
+		}
+		select {
+		case s.connCh <- conn:
+		case <-s.ctx.Done():
+			// handleConns has already returned.
+			_ = conn.Close()
+			return nil
+		}
+	}
+}
+
+// setConnOptions sets keepalive and TCP_NODELAY on an accepted connection. A negative keepalive period
+// disables the keepalive probes, zero leaves the default of the net package.
+func (s *Server) setConnOptions(tcpConn *net.TCPConn) error {
+	if s.keepAlivePeriod < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if s.keepAlivePeriod > 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpConn.SetKeepAlivePeriod(s.keepAlivePeriod); err != nil {
+			return err
 		}
-		s.connCh <- conn
 	}
+	return tcpConn.SetNoDelay(s.noDelay)
+}
+
+// listen listens on the TCP network address addr.
+func listen(addr string) (*net.TCPListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
 }
 
 // ListenAndServeTLS acts identically to ListenAndServe, except that it expects TLS connections.
-func (s *Server) ListenAndServeTLS(cert, key string) error {
+// The handshake is completed before the first request of a connection is read.
+func (s *Server) ListenAndServeTLS(config *tls.Config) error {
 	defer func() {
 		select {
 		case <-s.StartCh:
@@ -211,16 +848,11 @@ func (s *Server) ListenAndServeTLS(cert, key string) error {
 		close(s.StartCh)
 	}()
 
-	c, err := tls.LoadX509KeyPair(cert, key)
-	if err != nil {
-		return err
-	}
-	config := &tls.Config{Certificates: []tls.Certificate{c}}
-	l, err := tls.Listen("tcp", s.addr, config)
+	l, err := listen(s.addr)
 	if err != nil {
 		return err
 	}
-	return s.waitForConnections(l)
+	return s.waitForConnections(l, config)
 }
 
 // ListenAndServe listens on the TCP network address addr.
@@ -234,11 +866,31 @@ func (s *Server) ListenAndServe() error {
 		close(s.StartCh)
 	}()
 
-	l, err := net.Listen("tcp", s.addr)
+	l, err := listen(s.addr)
 	if err != nil {
 		return err
 	}
-	return s.waitForConnections(l)
+	return s.waitForConnections(l, nil)
+}
+
+// ServeAdditional listens on the given address in addition to the main listener, i.e. to accept both
+// plaintext and TLS connections while a cluster is migrated to TLS. The connections are TLS, if
+// tlsConfig is not nil. It must be called after StartCh is closed and blocks until the server is closed.
+func (s *Server) ServeAdditional(addr string, tlsConfig *tls.Config) error {
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.ctx.Done():
+		s.mu.Unlock()
+		return l.Close()
+	default:
+	}
+	s.extraListeners = append(s.extraListeners, l)
+	s.mu.Unlock()
+	return s.acceptConnections(l, tlsConfig)
 }
 
 // Shutdown gracefully shuts down the server without interrupting any active connections.
@@ -256,11 +908,21 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	}
 
 	var result error
+	s.mu.Lock()
 	s.cancel()
+	s.mu.Unlock()
 	err := s.listener.Close()
 	if err != nil {
 		result = multierror.Append(result, err)
 	}
+	s.mu.Lock()
+	for _, l := range s.extraListeners {
+		err = l.Close()
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	s.mu.Unlock()
 
 	done := make(chan struct{})
 	go func() {
@@ -0,0 +1,450 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// newBigResponseServer starts a server which replies to OpExGet with a big value, so a client which
+// doesn't read its responses fills up the socket buffers quickly.
+func newBigResponseServer(t *testing.T, queueSize int, closeOnFull bool) *Server {
+	s := NewServer("127.0.0.1:0", nil, 0)
+	s.SetBackpressure(queueSize, closeOnFull)
+	value := make([]byte, 1<<20)
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		resp := req.Success()
+		resp.Value = value
+		return resp
+	})
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	<-s.StartCh
+	return s
+}
+
+// dialTestServer connects to addr and negotiates the protocol version like a client does.
+func dialTestServer(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if err = NewClient(&ClientConfig{}).hello(addr, conn); err != nil {
+		conn.Close()
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	return conn
+}
+
+func writeRequests(conn net.Conn, n int) error {
+	for i := 0; i < n; i++ {
+		req := &protocol.Message{
+			Header: protocol.Header{
+				Magic: protocol.MagicReq,
+				Op:    protocol.OpExGet,
+			},
+			DMap: "mydmap",
+			Key:  "mykey",
+		}
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestServer_BackpressureBlock(t *testing.T) {
+	s := newBigResponseServer(t, 2, false)
+	defer shutdownTestServer(t, s)
+
+	conn := dialTestServer(t, s.listener.Addr().String())
+	defer conn.Close()
+
+	// The server stops reading the requests until the client reads the responses.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- writeRequests(conn, 64)
+	}()
+	<-time.After(100 * time.Millisecond)
+	for i := 0; i < 64; i++ {
+		var resp protocol.Message
+		err := resp.Read(conn)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if resp.Status != protocol.StatusOK || len(resp.Value) != 1<<20 {
+			t.Fatalf("Unexpected response: %d", resp.Status)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	conns, _ := s.Dropped()
+	if conns != 0 {
+		t.Fatalf("Expected no dropped connections. Got: %d", conns)
+	}
+}
+
+func TestServer_BackpressureClose(t *testing.T) {
+	s := newBigResponseServer(t, 2, true)
+	defer shutdownTestServer(t, s)
+
+	conn := dialTestServer(t, s.listener.Addr().String())
+	defer conn.Close()
+
+	// The client never reads its responses.
+	go func() {
+		_ = writeRequests(conn, 64)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conns, responses := s.Dropped()
+		if conns == 1 {
+			if responses == 0 {
+				t.Fatalf("Expected dropped responses")
+			}
+			return
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected the slow connection to be closed")
+}
+
+func getsockopt(t *testing.T, tc *net.TCPConn, level, opt int) int {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var value int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		value, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if serr != nil {
+		t.Fatalf("Expected nil. Got: %v", serr)
+	}
+	return value
+}
+
+func TestServer_SetConnOptions(t *testing.T) {
+	l, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer conn.Close()
+	tc, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer tc.Close()
+
+	s := NewServer("127.0.0.1:0", nil, time.Minute)
+	s.SetNoDelay(false)
+	if err = s.setConnOptions(tc); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if getsockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Fatalf("Expected TCP_NODELAY to be unset")
+	}
+	if getsockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Fatalf("Expected SO_KEEPALIVE to be set")
+	}
+
+	s = NewServer("127.0.0.1:0", nil, -1)
+	if err = s.setConnOptions(tc); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if getsockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Fatalf("Expected TCP_NODELAY to be set")
+	}
+	if getsockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Fatalf("Expected SO_KEEPALIVE to be unset")
+	}
+}
+
+func TestServer_OperationTimeout(t *testing.T) {
+	s := NewServer("127.0.0.1:0", nil, 0)
+	s.SetOperationTimeouts(map[protocol.OpCode]time.Duration{protocol.OpExQuery: 50 * time.Millisecond})
+	canceled := make(chan struct{})
+	s.RegisterOperation(protocol.OpExQuery, func(req *protocol.Message) *protocol.Message {
+		<-req.Context().Done()
+		close(canceled)
+		return req.Success()
+	})
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		if _, ok := req.Context().Deadline(); ok {
+			t.Errorf("Expected no deadline for OpExGet")
+		}
+		return req.Success()
+	})
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	<-s.StartCh
+	defer shutdownTestServer(t, s)
+
+	c := NewClient(&ClientConfig{Addrs: []string{s.listener.Addr().String()}, MaxConn: 1})
+	defer c.Close()
+	start := time.Now()
+	resp, err := c.Request(protocol.OpExQuery, &protocol.Message{DMap: "mydmap"})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusTimeout {
+		t.Fatalf("Expected StatusTimeout. Got: %d", resp.Status)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the timeout after 50ms. Took: %v", elapsed)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the context of the request to be done")
+	}
+
+	resp, err = c.Request(protocol.OpExGet, &protocol.Message{DMap: "mydmap", Key: "mykey"})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("Expected StatusOK. Got: %d", resp.Status)
+	}
+}
+
+func TestServer_ReadTimeout(t *testing.T) {
+	s := NewServer("127.0.0.1:0", nil, 0)
+	s.SetReadTimeout(100 * time.Millisecond)
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		return req.Success()
+	})
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	<-s.StartCh
+	defer shutdownTestServer(t, s)
+
+	conn := dialTestServer(t, s.listener.Addr().String())
+	defer conn.Close()
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	req := &protocol.Message{
+		Header: protocol.Header{
+			Magic: protocol.MagicReq,
+			Op:    protocol.OpExGet,
+		},
+		DMap: "mydmap",
+		Key:  "mykey",
+	}
+	buf := new(bytes.Buffer)
+	if err = req.Write(buf); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	raw := buf.Bytes()
+
+	// An idle connection is not affected by the timeout, and a request split across many
+	// segments is read as long as it's completed in time.
+	<-time.After(300 * time.Millisecond)
+	for i := range raw {
+		if _, err = conn.Write(raw[i : i+1]); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	var resp protocol.Message
+	if err = resp.Read(conn); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("Expected StatusOK. Got: %d", resp.Status)
+	}
+
+	// A stalled request is dropped after the timeout.
+	start := time.Now()
+	if _, err = conn.Write(raw[:len(raw)/2]); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF. Got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the connection to be closed after 100ms. Took: %v", elapsed)
+	}
+}
+
+func TestServer_MaxConns(t *testing.T) {
+	s := newBigResponseServer(t, 1, false)
+	defer shutdownTestServer(t, s)
+	s.SetMaxConns(1)
+
+	addr := s.listener.Addr().String()
+	c := NewClient(&ClientConfig{})
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		return conn
+	}
+
+	conn1 := dial()
+	defer conn1.Close()
+	if err := c.hello(addr, conn1); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	conn2 := dial()
+	defer conn2.Close()
+	if err := c.hello(addr, conn2); err != ErrTooManyConnections {
+		t.Fatalf("Expected ErrTooManyConnections. Got: %v", err)
+	}
+	if rejected := s.RejectedConns(); rejected != 1 {
+		t.Fatalf("Expected 1 rejected connection. Got: %d", rejected)
+	}
+
+	// The limit is changed while the server is running.
+	s.SetMaxConns(0)
+	conn3 := dial()
+	defer conn3.Close()
+	if err := c.hello(addr, conn3); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if peak := s.PeakConnCount(); peak != 2 {
+		t.Fatalf("Expected 2 peak connections. Got: %d", peak)
+	}
+}
+
+func TestServer_LegacyClient(t *testing.T) {
+	s := NewServer("127.0.0.1:0", nil, 0)
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		resp := req.Success()
+		resp.Value = []byte("myvalue")
+		return resp
+	})
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	<-s.StartCh
+	defer shutdownTestServer(t, s)
+
+	// A client which doesn't send OpHello speaks the legacy protocol.
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer conn.Close()
+	req := &protocol.Message{
+		Header: protocol.Header{
+			Magic: protocol.MagicReq,
+			Op:    protocol.OpExGet,
+		},
+		DMap:   "mydmap",
+		Key:    "mykey",
+		Legacy: true,
+	}
+	if err = req.Write(conn); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	resp := protocol.Message{Legacy: true}
+	if err = resp.Read(conn); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK || string(resp.Value) != "myvalue" {
+		t.Fatalf("Unexpected response: %d %s", resp.Status, resp.Value)
+	}
+}
+
+func TestServer_CloseOnFramingError(t *testing.T) {
+	s := NewServer("127.0.0.1:0", nil, 0)
+	s.RegisterOperation(protocol.OpExGet, func(req *protocol.Message) *protocol.Message {
+		return req.Success()
+	})
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil {
+			t.Errorf("Expected nil. Got: %v", err)
+		}
+	}()
+	<-s.StartCh
+	defer shutdownTestServer(t, s)
+
+	conn := dialTestServer(t, s.listener.Addr().String())
+	defer conn.Close()
+	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	req := &protocol.Message{
+		Header: protocol.Header{
+			Magic: protocol.MagicReq,
+			Op:    protocol.OpExGet,
+		},
+		DMap: "mydmap",
+		Key:  "mykey",
+	}
+	buf := new(bytes.Buffer)
+	if err = req.Write(buf); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// The body of a frame with an unsupported version can't be found. It must not be read as
+	// the next request.
+	raw := buf.Bytes()
+	raw[1] = protocol.MaxProtocolVersion + 1
+	if _, err = conn.Write(raw); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var resp protocol.Message
+	if err = resp.Read(conn); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusInternalServerError {
+		t.Fatalf("Expected StatusInternalServerError. Got: %d", resp.Status)
+	}
+	err = resp.Read(conn)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF. Got: %v", err)
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*Package wal implements a per-partition, append-only write-ahead log for the mutations on DMaps.*/
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SyncPolicy determines when the log is flushed to disk.
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes the log after every record.
+	SyncAlways SyncPolicy = "always"
+
+	// SyncEverySec flushes the log once per second. A crash may lose the last second of mutations.
+	SyncEverySec SyncPolicy = "everysec"
+
+	// SyncNo leaves flushing to the operating system.
+	SyncNo SyncPolicy = "no"
+)
+
+const (
+	// OpPut indicates a Put record.
+	OpPut uint8 = 0
+
+	// OpDelete indicates a Delete record.
+	OpDelete uint8 = 1
+)
+
+const (
+	segmentExt = ".wal"
+	headerSize = 8
+)
+
+// ErrUnknownSyncPolicy indicates that the given sync policy is not one of SyncAlways, SyncEverySec and SyncNo.
+var ErrUnknownSyncPolicy = errors.New("unknown sync policy")
+
+// errCorrupted indicates a torn or corrupted record. It's expected at the tail of a log after a crash.
+var errCorrupted = errors.New("corrupted record")
+
+// Record is a mutation on a DMap.
+type Record struct {
+	Op     uint8
+	Backup bool
+	DMap   string
+	Key    string
+	HKey   uint64
+	// Value is the entry in the in-memory layout of the storage package. It's empty for OpDelete.
+	Value []byte
+}
+
+// On-disk layout of a record:
+//
+// CRC32(uint32) | LENGTH(uint32) | OP(uint8) | BACKUP(uint8) | DMAP-LENGTH(uint16) | DMAP(bytes) |
+// KEY-LENGTH(uint16) | KEY(bytes) | HKEY(uint64) | VALUE(bytes)
+//
+// CRC32 is calculated over the bytes after LENGTH.
+func (r *Record) encode() []byte {
+	length := 1 + 1 + 2 + len(r.DMap) + 2 + len(r.Key) + 8 + len(r.Value)
+	buf := make([]byte, headerSize+length)
+	offset := headerSize
+	buf[offset] = r.Op
+	offset++
+	if r.Backup {
+		buf[offset] = 1
+	}
+	offset++
+	binary.BigEndian.PutUint16(buf[offset:], uint16(len(r.DMap)))
+	offset += 2
+	offset += copy(buf[offset:], r.DMap)
+	binary.BigEndian.PutUint16(buf[offset:], uint16(len(r.Key)))
+	offset += 2
+	offset += copy(buf[offset:], r.Key)
+	binary.BigEndian.PutUint64(buf[offset:], r.HKey)
+	offset += 8
+	copy(buf[offset:], r.Value)
+
+	binary.BigEndian.PutUint32(buf[4:], uint32(length))
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[headerSize:]))
+	return buf
+}
+
+func readRecord(r io.Reader) (*Record, error) {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, errCorrupted
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[4:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, errCorrupted
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header) || len(body) < 14 {
+		return nil, errCorrupted
+	}
+
+	rec := &Record{}
+	offset := 0
+	rec.Op = body[offset]
+	offset++
+	rec.Backup = body[offset] == 1
+	offset++
+	dlen := int(binary.BigEndian.Uint16(body[offset:]))
+	offset += 2
+	if offset+dlen+2 > len(body) {
+		return nil, errCorrupted
+	}
+	rec.DMap = string(body[offset : offset+dlen])
+	offset += dlen
+	klen := int(binary.BigEndian.Uint16(body[offset:]))
+	offset += 2
+	if offset+klen+8 > len(body) {
+		return nil, errCorrupted
+	}
+	rec.Key = string(body[offset : offset+klen])
+	offset += klen
+	rec.HKey = binary.BigEndian.Uint64(body[offset:])
+	offset += 8
+	rec.Value = body[offset:]
+	return rec, nil
+}
+
+// partitionLog is the log of a partition. It consists of segments, a new segment is started at every checkpoint.
+type partitionLog struct {
+	// mu is held for reading while a record is written and applied, and for writing by Checkpoint. So a
+	// checkpoint never splits a mutation.
+	mu sync.RWMutex
+
+	// fmu protects the fields below.
+	fmu        sync.Mutex
+	file       *os.File
+	dirty      bool
+	segment    uint64
+	checkpoint uint64
+}
+
+// WAL is a write-ahead log which keeps a log for every partition in a directory.
+type WAL struct {
+	mu sync.Mutex
+
+	dir    string
+	policy SyncPolicy
+	parts  map[uint64]*partitionLog
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func segmentName(partID, segment uint64) string {
+	return fmt.Sprintf("%d-%020d%s", partID, segment, segmentExt)
+}
+
+func parseSegmentName(name string) (partID, segment uint64, ok bool) {
+	if filepath.Ext(name) != segmentExt {
+		return 0, 0, false
+	}
+	_, err := fmt.Sscanf(name, "%d-%d"+segmentExt, &partID, &segment)
+	return partID, segment, err == nil
+}
+
+// Open opens the log in the given directory. The directory is created if it doesn't exist.
+func Open(dir string, policy SyncPolicy) (*WAL, error) {
+	switch policy {
+	case SyncAlways, SyncEverySec, SyncNo:
+	default:
+		return nil, ErrUnknownSyncPolicy
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WAL{
+		dir:    dir,
+		policy: policy,
+		parts:  make(map[uint64]*partitionLog),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	// Start new segments after the existing ones. They are kept until the next checkpoint.
+	for partID, segs := range segments {
+		w.parts[partID] = &partitionLog{segment: segs[len(segs)-1] + 1}
+	}
+	if policy == SyncEverySec {
+		w.wg.Add(1)
+		go w.syncEverySecond()
+	}
+	return w, nil
+}
+
+// segments returns the sorted segment numbers of the partitions on disk.
+func (w *WAL) segments() (map[uint64][]uint64, error) {
+	files, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make(map[uint64][]uint64)
+	for _, f := range files {
+		partID, segment, ok := parseSegmentName(f.Name())
+		if !ok {
+			continue
+		}
+		segments[partID] = append(segments[partID], segment)
+	}
+	for _, segs := range segments {
+		sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	}
+	return segments, nil
+}
+
+func (w *WAL) partition(partID uint64) *partitionLog {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.parts[partID]
+	if !ok {
+		p = &partitionLog{}
+		w.parts[partID] = p
+	}
+	return p
+}
+
+func (w *WAL) append(partID uint64, p *partitionLog, rec *Record) error {
+	p.fmu.Lock()
+	defer p.fmu.Unlock()
+	if p.file == nil {
+		path := filepath.Join(w.dir, segmentName(partID, p.segment))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		p.file = f
+	}
+	_, err := p.file.Write(rec.encode())
+	if err != nil {
+		return err
+	}
+	if w.policy == SyncAlways {
+		return p.file.Sync()
+	}
+	p.dirty = true
+	return nil
+}
+
+// Apply writes the record to the log of the given partition and calls apply if it succeeds.
+func (w *WAL) Apply(partID uint64, rec *Record, apply func() error) error {
+	p := w.partition(partID)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	err := w.append(partID, p, rec)
+	if err != nil {
+		return err
+	}
+	return apply()
+}
+
+// closeSegment flushes and closes the current segment of the partition. The caller must hold p.fmu.
+func (p *partitionLog) closeSegment() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = p.file.Close()
+	p.file = nil
+	p.dirty = false
+	return err
+}
+
+// Checkpoint starts a new segment for the given partition. It's called before the partition is
+// written to the snapshot. All the mutations in the previous segments have been applied when it returns.
+func (w *WAL) Checkpoint(partID uint64) error {
+	p := w.partition(partID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fmu.Lock()
+	defer p.fmu.Unlock()
+
+	err := p.closeSegment()
+	if err != nil {
+		return err
+	}
+	p.checkpoint = p.segment
+	p.segment++
+	return nil
+}
+
+// Release removes the segments of the given partition before the last checkpoint. It's called after
+// the partition is written to the snapshot successfully.
+func (w *WAL) Release(partID uint64) error {
+	p := w.partition(partID)
+	p.fmu.Lock()
+	checkpoint := p.checkpoint
+	p.fmu.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments[partID] {
+		if segment > checkpoint {
+			break
+		}
+		err = os.Remove(filepath.Join(w.dir, segmentName(partID, segment)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay calls f for every record on disk, in the order that they have been written for each partition.
+// The records after a torn or corrupted record are skipped for that partition, it's the tail of the log
+// after a crash.
+func (w *WAL) Replay(f func(partID uint64, rec *Record) error) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for partID, segs := range segments {
+	loop:
+		for _, segment := range segs {
+			file, err := os.Open(filepath.Join(w.dir, segmentName(partID, segment)))
+			if err != nil {
+				return err
+			}
+			r := bufio.NewReader(file)
+			for {
+				rec, err := readRecord(r)
+				if err == io.EOF {
+					break
+				}
+				if err == errCorrupted {
+					file.Close()
+					break loop
+				}
+				err = f(partID, rec)
+				if err != nil {
+					file.Close()
+					return err
+				}
+			}
+			file.Close()
+		}
+	}
+	return nil
+}
+
+// Sync flushes all the logs to disk.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	parts := make([]*partitionLog, 0, len(w.parts))
+	for _, p := range w.parts {
+		parts = append(parts, p)
+	}
+	w.mu.Unlock()
+
+	var serr error
+	for _, p := range parts {
+		p.fmu.Lock()
+		if p.file != nil && p.dirty {
+			if err := p.file.Sync(); err != nil {
+				serr = err
+			}
+			p.dirty = false
+		}
+		p.fmu.Unlock()
+	}
+	return serr
+}
+
+func (w *WAL) syncEverySecond() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			w.Sync()
+		}
+	}
+}
+
+// Close flushes and closes all the logs.
+func (w *WAL) Close() error {
+	select {
+	case <-w.ctx.Done():
+		return nil
+	default:
+	}
+	w.cancel()
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var cerr error
+	for _, p := range w.parts {
+		p.fmu.Lock()
+		if err := p.closeSegment(); err != nil {
+			cerr = err
+		}
+		p.fmu.Unlock()
+	}
+	return cerr
+}
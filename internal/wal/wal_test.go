@@ -0,0 +1,199 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newWAL(t *testing.T, policy SyncPolicy) (string, *WAL) {
+	dir, err := ioutil.TempDir("/tmp", "olric-wal")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	w, err := Open(dir, policy)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	return dir, w
+}
+
+func testRecord(i int) *Record {
+	return &Record{
+		Op:     OpPut,
+		Backup: i%2 == 0,
+		DMap:   "mymap",
+		Key:    strconv.Itoa(i),
+		HKey:   uint64(i),
+		Value:  []byte("value-" + strconv.Itoa(i)),
+	}
+}
+
+func replayAll(t *testing.T, w *WAL) map[uint64][]*Record {
+	records := make(map[uint64][]*Record)
+	err := w.Replay(func(partID uint64, rec *Record) error {
+		records[partID] = append(records[partID], rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	return records
+}
+
+func Test_ApplyReplay(t *testing.T) {
+	dir, w := newWAL(t, SyncAlways)
+	defer os.RemoveAll(dir)
+
+	var applied int
+	for i := 0; i < 100; i++ {
+		err := w.Apply(uint64(i%7), testRecord(i), func() error {
+			applied++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err := w.Apply(0, &Record{Op: OpDelete, DMap: "mymap", Key: "0", HKey: 0}, func() error { return nil })
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if applied != 100 {
+		t.Fatalf("Expected 100 applied records. Got: %d", applied)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	w, err = Open(dir, SyncAlways)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer w.Close()
+	records := replayAll(t, w)
+	var total int
+	for partID, recs := range records {
+		for idx, rec := range recs {
+			total++
+			if partID == 0 && idx == len(recs)-1 {
+				if rec.Op != OpDelete || rec.Key != "0" {
+					t.Fatalf("Expected the delete record at the end of PartID: 0. Got: %v", rec)
+				}
+				continue
+			}
+			// The records are in the order that they have been written.
+			i := int(partID) + idx*7
+			expected := testRecord(i)
+			if rec.Op != expected.Op || rec.Backup != expected.Backup || rec.DMap != expected.DMap ||
+				rec.Key != expected.Key || rec.HKey != expected.HKey || !bytes.Equal(rec.Value, expected.Value) {
+				t.Fatalf("Expected %v. Got: %v", expected, rec)
+			}
+		}
+	}
+	if total != 101 {
+		t.Fatalf("Expected 101 records. Got: %d", total)
+	}
+}
+
+func Test_TornTail(t *testing.T) {
+	dir, w := newWAL(t, SyncNo)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		err := w.Apply(0, testRecord(i), func() error { return nil })
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// Cut the last record in half.
+	path := filepath.Join(dir, segmentName(0, 0))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = os.Truncate(path, info.Size()-5)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	w, err = Open(dir, SyncNo)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer w.Close()
+	records := replayAll(t, w)
+	if len(records[0]) != 9 {
+		t.Fatalf("Expected 9 records. Got: %d", len(records[0]))
+	}
+}
+
+func Test_CheckpointRelease(t *testing.T) {
+	dir, w := newWAL(t, SyncEverySec)
+	defer os.RemoveAll(dir)
+	defer w.Close()
+
+	for i := 0; i < 10; i++ {
+		err := w.Apply(0, testRecord(i), func() error { return nil })
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err := w.Checkpoint(0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	// These are written after the checkpoint, they are not in the snapshot.
+	for i := 10; i < 15; i++ {
+		err := w.Apply(0, testRecord(i), func() error { return nil })
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err = w.Release(0)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = w.Sync()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	records := replayAll(t, w)
+	if len(records[0]) != 5 {
+		t.Fatalf("Expected 5 records. Got: %d", len(records[0]))
+	}
+	if records[0][0].Key != "10" {
+		t.Fatalf("Expected key: 10. Got: %s", records[0][0].Key)
+	}
+}
+
+func Test_UnknownSyncPolicy(t *testing.T) {
+	_, err := Open("/tmp", "foobar")
+	if err != ErrUnknownSyncPolicy {
+		t.Fatalf("Expected ErrUnknownSyncPolicy. Got: %v", err)
+	}
+}
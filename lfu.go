@@ -0,0 +1,143 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// lfuDecayFactor determines the decay period of the access counters. The counters are halved
+// after lfuDecayFactor accesses per key, so the keys which were hot in the past cannot dominate forever.
+const lfuDecayFactor = 10
+
+type lfuItem struct {
+	hkey  uint64
+	freq  uint32
+	index int
+}
+
+// lfuHeap is a min-heap of the keys ordered by access frequency.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int           { return len(h) }
+func (h lfuHeap) Less(i, j int) bool { return h[i].freq < h[j].freq }
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// lfu implements accessTracker for LFU eviction policy. The least frequently used key is at the root of the heap.
+type lfu struct {
+	mu       sync.Mutex
+	h        lfuHeap
+	items    map[uint64]*lfuItem
+	accesses int
+}
+
+func newLFU() *lfu {
+	return &lfu{
+		items: make(map[uint64]*lfuItem),
+	}
+}
+
+// decay halves the access counters of all the keys. The caller must hold l.mu.
+func (l *lfu) decay() {
+	for _, item := range l.h {
+		item.freq /= 2
+	}
+	heap.Init(&l.h)
+	l.accesses = 0
+}
+
+func (l *lfu) touch(hkey uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if item, ok := l.items[hkey]; ok {
+		if item.freq < ^uint32(0) {
+			item.freq++
+		}
+		heap.Fix(&l.h, item.index)
+	} else {
+		item := &lfuItem{hkey: hkey, freq: 1}
+		heap.Push(&l.h, item)
+		l.items[hkey] = item
+	}
+	l.accesses++
+	if l.accesses >= lfuDecayFactor*len(l.items) {
+		l.decay()
+	}
+}
+
+func (l *lfu) remove(hkey uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if item, ok := l.items[hkey]; ok {
+		heap.Remove(&l.h, item.index)
+		delete(l.items, hkey)
+	}
+}
+
+func (l *lfu) has(hkey uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.items[hkey]
+	return ok
+}
+
+func (l *lfu) length() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.items)
+}
+
+func (l *lfu) victim(except uint64) (uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.h) == 0 {
+		return 0, false
+	}
+	if l.h[0].hkey != except {
+		return l.h[0].hkey, true
+	}
+	// The next candidate is one of the children of the root.
+	var item *lfuItem
+	for i := 1; i <= 2 && i < len(l.h); i++ {
+		if item == nil || l.h[i].freq < item.freq {
+			item = l.h[i]
+		}
+	}
+	if item == nil {
+		return 0, false
+	}
+	return item.hkey, true
+}
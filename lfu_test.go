@@ -0,0 +1,100 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestLFU(t *testing.T) {
+	l := newLFU()
+	for i := uint64(0); i < 10; i++ {
+		for j := uint64(0); j <= i; j++ {
+			l.touch(i)
+		}
+	}
+	// 0 is the least frequently used key.
+	hkey, ok := l.victim(100)
+	if !ok {
+		t.Fatalf("Expected a victim")
+	}
+	if hkey != 0 {
+		t.Fatalf("Expected 0. Got: %d", hkey)
+	}
+	// The excepted key is skipped.
+	hkey, _ = l.victim(0)
+	if hkey != 1 {
+		t.Fatalf("Expected 1. Got: %d", hkey)
+	}
+
+	l.remove(0)
+	if l.has(0) {
+		t.Fatalf("Expected 0 to be removed")
+	}
+	hkey, _ = l.victim(100)
+	if hkey != 1 {
+		t.Fatalf("Expected 1. Got: %d", hkey)
+	}
+	if l.length() != 9 {
+		t.Fatalf("Expected 9 keys. Got: %d", l.length())
+	}
+}
+
+func TestLFUDecay(t *testing.T) {
+	l := newLFU()
+	for i := 0; i < 1000; i++ {
+		l.touch(1)
+	}
+	// The access counter of a key which was hot in the past decays.
+	for i := 0; i < 1000; i++ {
+		l.touch(2)
+		l.touch(3)
+	}
+	hkey, _ := l.victim(100)
+	if hkey != 1 {
+		t.Fatalf("Expected 1. Got: %d", hkey)
+	}
+}
+
+func benchmarkZipfHitRate(b *testing.B, newTracker func() accessTracker) {
+	const capacity = 1000
+	r := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(r, 1.1, 1, 100000)
+	tracker := newTracker()
+	var hits int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hkey := zipf.Uint64()
+		if tracker.has(hkey) {
+			hits++
+		}
+		tracker.touch(hkey)
+		if tracker.length() > capacity {
+			victim, _ := tracker.victim(hkey)
+			tracker.remove(victim)
+		}
+	}
+	b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+}
+
+func BenchmarkZipfHitRate(b *testing.B) {
+	b.Run("LRU", func(b *testing.B) {
+		benchmarkZipfHitRate(b, func() accessTracker { return newLRU() })
+	})
+	b.Run("LFU", func(b *testing.B) {
+		benchmarkZipfHitRate(b, func() accessTracker { return newLFU() })
+	})
+}
@@ -1,9 +1,11 @@
 package olric
 
 import (
+	"bytes"
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Slightly modified version of https://github.com/moby/moby/tree/master/pkg/locker
@@ -38,6 +40,10 @@ type lockCtr struct {
 	// this is int32 instead of uint32 so we can add `-1` in `dec()`
 	waiters int32
 	done    chan struct{}
+	// token identifies the current holder of the lock and deadline is the time when the lock
+	// expires. They are protected by locker.mu.
+	token    []byte
+	deadline time.Time
 }
 
 // inc increments the number of waiters waiting for the lock
@@ -120,22 +126,80 @@ func (l *locker) lock(name string) {
 	// increment the nameLock waiters while inside the main mutex
 	// this makes sure that the lock isn't deleted if `Lock` and `Unlock` are called concurrently
 	nameLock.inc()
-	nameLock.done = make(chan struct{})
 	l.mu.Unlock()
 
 	// Lock the nameLock outside the main mutex so we don't block other operations
 	// once locked then we can decrement the number of waiters for this lock
 	nameLock.lock()
 
+	// Create the notifier after acquiring the lock. Otherwise a waiter replaces the
+	// notifier of the current holder.
+	l.mu.Lock()
+	nameLock.done = make(chan struct{})
+	l.mu.Unlock()
+
 	nameLock.dec()
 }
 
-// unlock unlocks the mutex with the given name
-// If the given lock is not being waited on by any other callers, it is deleted
-func (l *locker) unlock(name string) error {
+// tryLock locks the mutex with the given name, only if nobody holds or waits for it. It never blocks
+// and returns true if the lock has been acquired.
+func (l *locker) tryLock(name string) bool {
 	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = make(map[string]*lockCtr)
+	}
+	if _, exists := l.locks[name]; exists {
+		return false
+	}
+	nameLock := &lockCtr{done: make(chan struct{})}
+	nameLock.lock()
+	l.locks[name] = nameLock
+	return true
+}
+
+// setToken sets the token and the deadline of the lock with the given name.
+func (l *locker) setToken(name string, token []byte, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	nameLock, exists := l.locks[name]
 	if !exists {
+		return
+	}
+	nameLock.token = token
+	nameLock.deadline = time.Now().Add(ttl)
+}
+
+// lease extends the deadline of the lock with the given name, only if the token matches.
+func (l *locker) lease(name string, token []byte, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nameLock, exists := l.locks[name]
+	if !exists || nameLock.token == nil || !bytes.Equal(nameLock.token, token) {
+		return ErrNoSuchLock
+	}
+	nameLock.deadline = time.Now().Add(ttl)
+	return nil
+}
+
+// remaining returns the remaining time until the lock with the given name expires. It returns false
+// if the lock isn't held with the given token anymore.
+func (l *locker) remaining(name string, token []byte) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	nameLock, exists := l.locks[name]
+	if !exists || !bytes.Equal(nameLock.token, token) {
+		return 0, false
+	}
+	return time.Until(nameLock.deadline), true
+}
+
+// unlock unlocks the mutex with the given name, only if the token matches the token of the holder.
+// If the given lock is not being waited on by any other callers, it is deleted
+func (l *locker) unlock(name string, token []byte) error {
+	l.mu.Lock()
+	nameLock, exists := l.locks[name]
+	if !exists || !bytes.Equal(nameLock.token, token) {
 		l.mu.Unlock()
 		return ErrNoSuchLock
 	}
@@ -143,6 +207,7 @@ func (l *locker) unlock(name string) error {
 	if nameLock.count() == 0 {
 		delete(l.locks, name)
 	}
+	nameLock.token = nil
 	nameLock.unlock()
 
 	select {
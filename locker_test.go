@@ -61,7 +61,7 @@ func TestLockerLock(t *testing.T) {
 	default:
 	}
 
-	if err := l.unlock("test"); err != nil {
+	if err := l.unlock("test", nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -80,7 +80,7 @@ func TestLockerUnlock(t *testing.T) {
 	l := newLocker()
 
 	l.lock("test")
-	l.unlock("test")
+	l.unlock("test", nil)
 
 	chDone := make(chan struct{})
 	go func() {
@@ -95,6 +95,49 @@ func TestLockerUnlock(t *testing.T) {
 	}
 }
 
+func TestLockerTryLock(t *testing.T) {
+	l := newLocker()
+
+	if !l.tryLock("test") {
+		t.Fatalf("Expected to acquire the lock")
+	}
+	if l.tryLock("test") {
+		t.Fatalf("Expected to fail while the lock is held")
+	}
+	if err := l.unlock("test", nil); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if !l.tryLock("test") {
+		t.Fatalf("Expected to acquire the lock after unlock")
+	}
+}
+
+func TestLockerLease(t *testing.T) {
+	l := newLocker()
+
+	l.lock("test")
+	l.setToken("test", []byte("token"), time.Second)
+	if err := l.lease("test", []byte("other"), time.Minute); err != ErrNoSuchLock {
+		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
+	}
+	if err := l.lease("test", []byte("token"), time.Minute); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	remaining, ok := l.remaining("test", []byte("token"))
+	if !ok {
+		t.Fatalf("Expected the lock to be held")
+	}
+	if remaining <= time.Second {
+		t.Fatalf("Expected the deadline to be extended. Got: %v", remaining)
+	}
+	if err := l.unlock("test", []byte("token")); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if err := l.lease("test", []byte("token"), time.Minute); err != ErrNoSuchLock {
+		t.Fatalf("Expected ErrNoSuchLock. Got: %v", err)
+	}
+}
+
 func TestLockerConcurrency(t *testing.T) {
 	l := newLocker()
 
@@ -104,7 +147,7 @@ func TestLockerConcurrency(t *testing.T) {
 		go func() {
 			l.lock("test")
 			// if there is a concurrency issue, will very likely panic here
-			l.unlock("test")
+			l.unlock("test", nil)
 			wg.Done()
 		}()
 	}
@@ -131,7 +174,7 @@ func BenchmarkLocker(b *testing.B) {
 	l := newLocker()
 	for i := 0; i < b.N; i++ {
 		l.lock("test")
-		l.unlock("test")
+		l.unlock("test", nil)
 	}
 }
 
@@ -141,7 +184,7 @@ func BenchmarkLockerParallel(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			l.lock("test")
-			l.unlock("test")
+			l.unlock("test", nil)
 		}
 	})
 }
@@ -157,7 +200,7 @@ func BenchmarkLockerMoreKeys(b *testing.B) {
 		for pb.Next() {
 			k := keys[rand.Intn(len(keys))]
 			l.lock(k)
-			l.unlock(k)
+			l.unlock(k, nil)
 		}
 	})
 }
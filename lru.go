@@ -0,0 +1,97 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"container/list"
+	"sync"
+)
+
+// accessTracker keeps the access metadata of the keys in a DMap fragment to pick the keys to evict.
+type accessTracker interface {
+	// touch records an access to the given key.
+	touch(hkey uint64)
+
+	// remove removes the metadata of the given key.
+	remove(hkey uint64)
+
+	// has returns true if the given key has access metadata.
+	has(hkey uint64) bool
+
+	// length returns the number of keys which have access metadata.
+	length() int
+
+	// victim returns the key which should be evicted first except the given one.
+	victim(except uint64) (uint64, bool)
+}
+
+// lru implements accessTracker for LRU eviction policy. The least recently used key is at the back of the list.
+type lru struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[uint64]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{
+		ll:    list.New(),
+		items: make(map[uint64]*list.Element),
+	}
+}
+
+func (l *lru) touch(hkey uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[hkey]; ok {
+		l.ll.MoveToFront(e)
+		return
+	}
+	l.items[hkey] = l.ll.PushFront(hkey)
+}
+
+func (l *lru) remove(hkey uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[hkey]; ok {
+		l.ll.Remove(e)
+		delete(l.items, hkey)
+	}
+}
+
+func (l *lru) has(hkey uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.items[hkey]
+	return ok
+}
+
+func (l *lru) length() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.items)
+}
+
+func (l *lru) victim(except uint64) (uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.ll.Back()
+	if e != nil && e.Value.(uint64) == except {
+		e = e.Prev()
+	}
+	if e == nil {
+		return 0, false
+	}
+	return e.Value.(uint64), true
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	l := newLRU()
+	for i := uint64(0); i < 10; i++ {
+		l.touch(i)
+	}
+	// 0 is the least recently used key. Touch it to make 1 the next victim.
+	l.touch(0)
+	hkey, ok := l.victim(100)
+	if !ok {
+		t.Fatalf("Expected a victim")
+	}
+	if hkey != 1 {
+		t.Fatalf("Expected 1. Got: %d", hkey)
+	}
+
+	l.remove(1)
+	if l.has(1) {
+		t.Fatalf("Expected 1 to be removed")
+	}
+	hkey, _ = l.victim(100)
+	if hkey != 2 {
+		t.Fatalf("Expected 2. Got: %d", hkey)
+	}
+	// The excepted key is skipped.
+	hkey, _ = l.victim(2)
+	if hkey != 3 {
+		t.Fatalf("Expected 3. Got: %d", hkey)
+	}
+	if l.length() != 9 {
+		t.Fatalf("Expected 9 keys. Got: %d", l.length())
+	}
+}
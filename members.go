@@ -0,0 +1,139 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Member represents a node in the cluster.
+type Member struct {
+	// Name is the name of the node. It's also the address of its TCP server.
+	Name string
+
+	// Birthdate is the time when the node started, in nanoseconds.
+	Birthdate int64
+}
+
+type memberEvent struct {
+	join   bool
+	member Member
+}
+
+// memberEvents queues the membership changes and keeps the callbacks. The events are queued
+// without blocking, so slow callbacks don't stall the membership layer.
+type memberEvents struct {
+	mu     sync.Mutex
+	join   []func(Member)
+	leave  []func(Member)
+	queue  []memberEvent
+	notify chan struct{}
+}
+
+func newMemberEvents() *memberEvents {
+	return &memberEvents{notify: make(chan struct{}, 1)}
+}
+
+func (m *memberEvents) push(evt memberEvent) {
+	m.mu.Lock()
+	m.queue = append(m.queue, evt)
+	m.mu.Unlock()
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (m *memberEvents) pop() (memberEvent, []func(Member), bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.queue) == 0 {
+		return memberEvent{}, nil, false
+	}
+	evt := m.queue[0]
+	m.queue = m.queue[1:]
+	callbacks := m.leave
+	if evt.join {
+		callbacks = m.join
+	}
+	return evt, callbacks, true
+}
+
+// OnMemberJoin registers a callback which is called when a node joins the cluster. The callbacks are
+// called in the order of the events from a dedicated goroutine, a slow callback delays the next events.
+func (db *Olric) OnMemberJoin(f func(Member)) {
+	db.members.mu.Lock()
+	defer db.members.mu.Unlock()
+	db.members.join = append(db.members.join, f)
+}
+
+// OnMemberLeave registers a callback which is called when a node leaves the cluster. See OnMemberJoin.
+func (db *Olric) OnMemberLeave(f func(Member)) {
+	db.members.mu.Lock()
+	defer db.members.mu.Unlock()
+	db.members.leave = append(db.members.leave, f)
+}
+
+// Members returns the alive nodes in the cluster, sorted by their birthdates. It returns nil
+// if this node hasn't joined the cluster yet.
+func (db *Olric) Members() []Member {
+	if db.discovery == nil {
+		return nil
+	}
+	var members []Member
+	for _, h := range db.discovery.getMembers() {
+		members = append(members, Member{Name: h.Name, Birthdate: h.Birthdate})
+	}
+	return members
+}
+
+func (db *Olric) listenMemberEvents(eventCh chan memberlist.NodeEvent) {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case evt := <-eventCh:
+			member := Member{Name: evt.Node.Name}
+			if mt, err := db.discovery.DecodeMeta(evt.Node.Meta); err == nil {
+				member.Birthdate = mt.Birthdate
+			}
+			db.members.push(memberEvent{join: evt.Event == memberlist.NodeJoin, member: member})
+			db.checkQuorum()
+		}
+	}
+}
+
+func (db *Olric) deliverMemberEvents() {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-db.members.notify:
+		}
+		for {
+			evt, callbacks, ok := db.members.pop()
+			if !ok {
+				break
+			}
+			for _, f := range callbacks {
+				f(evt.member)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestOlric_MemberEvents(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	joined := make(chan Member, 1)
+	left := make(chan Member, 1)
+	db1.OnMemberJoin(func(m Member) {
+		joined <- m
+	})
+	db1.OnMemberLeave(func(m Member) {
+		left <- m
+	})
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	select {
+	case m := <-joined:
+		if m.Name != db2.this.Name || m.Birthdate != db2.this.Birthdate {
+			t.Fatalf("Expected %s. Got: %v", db2.this, m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No join event received")
+	}
+
+	members := db1.Members()
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 members. Got: %d", len(members))
+	}
+	// The members are sorted by their birthdates.
+	if members[0].Name != db1.this.Name || members[1].Name != db2.this.Name {
+		t.Fatalf("Unexpected members: %v", members)
+	}
+
+	err = db2.discovery.memberlist.Leave(time.Second)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = db2.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	select {
+	case m := <-left:
+		if m.Name != db2.this.Name {
+			t.Fatalf("Expected %s. Got: %v", db2.this, m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No leave event received")
+	}
+	if len(db1.Members()) != 1 {
+		t.Fatalf("Expected 1 member. Got: %d", len(db1.Members()))
+	}
+}
+
+func TestOlric_PartitionCountMismatch(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.PartitionCount = db1.config.PartitionCount + 1
+	db2, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	go func() {
+		serr := db2.server.ListenAndServe()
+		if serr != nil {
+			db2.log.Printf("[ERROR] Failed to run TCP server")
+		}
+	}()
+	<-db2.server.StartCh
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	err = db2.startDiscovery()
+	if errors.Cause(err) != ErrPartitionCountMismatch {
+		t.Fatalf("Expected ErrPartitionCountMismatch. Got: %v", err)
+	}
+	if db1.discovery.numMembers() != 1 {
+		t.Fatalf("Expected member count is 1. Got: %d", db1.discovery.numMembers())
+	}
+}
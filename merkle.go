@@ -0,0 +1,119 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/buraksezer/olric/internal/storage"
+	"github.com/cespare/xxhash"
+)
+
+const (
+	merkleFanoutBits = 4
+
+	// merkleFanout is the number of children of an inner node.
+	merkleFanout = 1 << merkleFanoutBits
+
+	// merkleDepth is the number of levels below the root. A tree has merkleFanout^merkleDepth leaves.
+	merkleDepth = 3
+)
+
+// merkleTree summarizes the versions of the keys on a partition. A key falls into a leaf by the high
+// bits of its hkey and the hash of a leaf is the XOR of the hashes of its keys, so it doesn't depend on
+// the iteration order. The inner nodes hash their children. Two replicas of a partition have the same
+// root if they have the same versions of the same keys.
+type merkleTree struct {
+	levels [][]uint64
+}
+
+func newMerkleTree() *merkleTree {
+	t := &merkleTree{levels: make([][]uint64, merkleDepth+1)}
+	width := 1
+	for level := range t.levels {
+		t.levels[level] = make([]uint64, width)
+		width *= merkleFanout
+	}
+	return t
+}
+
+// merkleLeaf returns the leaf of the given hkey.
+func merkleLeaf(hkey uint64) uint32 {
+	return uint32(hkey >> (64 - merkleFanoutBits*merkleDepth))
+}
+
+// add adds a key to its leaf. Call build after adding the keys.
+func (t *merkleTree) add(name string, hkey uint64, vdata *storage.VData) {
+	buf := make([]byte, len(name)+24)
+	copy(buf, name)
+	binary.BigEndian.PutUint64(buf[len(name):], hkey)
+	binary.BigEndian.PutUint64(buf[len(name)+8:], uint64(vdata.TTL))
+	binary.BigEndian.PutUint64(buf[len(name)+16:], uint64(vdata.Timestamp))
+	t.levels[merkleDepth][merkleLeaf(hkey)] ^= xxhash.Sum64(buf)
+}
+
+// build calculates the hashes of the inner nodes.
+func (t *merkleTree) build() {
+	buf := make([]byte, 8*merkleFanout)
+	for level := merkleDepth - 1; level >= 0; level-- {
+		children := t.levels[level+1]
+		for i := range t.levels[level] {
+			for j, hash := range children[i*merkleFanout : (i+1)*merkleFanout] {
+				binary.BigEndian.PutUint64(buf[j*8:], hash)
+			}
+			t.levels[level][i] = xxhash.Sum64(buf)
+		}
+	}
+}
+
+func (t *merkleTree) root() uint64 {
+	return t.levels[0][0]
+}
+
+// children returns the hashes of the children of the given nodes, merkleFanout hashes for each node.
+func (t *merkleTree) children(level int, nodes []uint32) ([]uint64, error) {
+	if level < 0 || level >= merkleDepth {
+		return nil, fmt.Errorf("invalid level: %d", level)
+	}
+	hashes := make([]uint64, 0, len(nodes)*merkleFanout)
+	for _, node := range nodes {
+		if int(node) >= len(t.levels[level]) {
+			return nil, fmt.Errorf("invalid node: %d at level: %d", node, level)
+		}
+		first := int(node) * merkleFanout
+		hashes = append(hashes, t.levels[level+1][first:first+merkleFanout]...)
+	}
+	return hashes, nil
+}
+
+// diff compares the hashes of the children of the given nodes with the ones on another replica.
+// It returns the mismatched children.
+func (t *merkleTree) diff(level int, nodes []uint32, remote []uint64) ([]uint32, error) {
+	local, err := t.children(level, nodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(remote) != len(local) {
+		return nil, fmt.Errorf("expected %d hashes, got: %d", len(local), len(remote))
+	}
+	var mismatched []uint32
+	for i, hash := range local {
+		if hash != remote[i] {
+			mismatched = append(mismatched, nodes[i/merkleFanout]*merkleFanout+uint32(i%merkleFanout))
+		}
+	}
+	return mismatched, nil
+}
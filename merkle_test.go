@@ -0,0 +1,73 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"testing"
+
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+func TestMerkleTree(t *testing.T) {
+	hkeys := []uint64{1, 1 << 40, 1 << 62, 1<<63 + 7, 1<<64 - 1}
+	t1, t2 := newMerkleTree(), newMerkleTree()
+	for i, hkey := range hkeys {
+		t1.add("mymap", hkey, &storage.VData{Timestamp: int64(i)})
+	}
+	// The order of the keys doesn't matter.
+	for i := len(hkeys) - 1; i >= 0; i-- {
+		t2.add("mymap", hkeys[i], &storage.VData{Timestamp: int64(i)})
+	}
+	t1.build()
+	t2.build()
+	if t1.root() != t2.root() {
+		t.Fatalf("Expected the same root")
+	}
+
+	// A newer version of a key changes the root and a single leaf.
+	t2 = newMerkleTree()
+	for i, hkey := range hkeys {
+		timestamp := int64(i)
+		if i == 3 {
+			timestamp = 100
+		}
+		t2.add("mymap", hkey, &storage.VData{Timestamp: timestamp})
+	}
+	t2.build()
+	if t1.root() == t2.root() {
+		t.Fatalf("Expected different roots")
+	}
+	nodes := []uint32{0}
+	for level := 0; level < merkleDepth; level++ {
+		hashes, err := t2.children(level, nodes)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		nodes, err = t1.diff(level, nodes, hashes)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	if len(nodes) != 1 || nodes[0] != merkleLeaf(hkeys[3]) {
+		t.Fatalf("Expected leaf %d. Got: %v", merkleLeaf(hkeys[3]), nodes)
+	}
+
+	if _, err := t1.children(merkleDepth, []uint32{0}); err == nil {
+		t.Fatalf("Expected an error for the leaf level")
+	}
+	if _, err := t1.children(0, []uint32{1}); err == nil {
+		t.Fatalf("Expected an error for an invalid node")
+	}
+}
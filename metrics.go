@@ -0,0 +1,236 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/metrics"
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// requestMetrics counts the requests served by this node. It's fed by the TCP server.
+type requestMetrics struct {
+	// The counters are accessed atomically, keep them 64-bit aligned.
+	received    uint64
+	sent        uint64
+	requests    [256]uint64
+	failures    [256]uint64
+	opReceived  [256]uint64
+	opSent      [256]uint64
+	latency     [256]*metrics.Histogram
+	requestSize [256]*metrics.Histogram
+	replySize   [256]*metrics.Histogram
+}
+
+func newRequestMetrics() *requestMetrics {
+	m := &requestMetrics{}
+	for i := range m.latency {
+		m.latency[i] = metrics.NewHistogram(metrics.DefaultBuckets)
+		m.requestSize[i] = metrics.NewSizeHistogram(metrics.DefaultSizeBuckets)
+		m.replySize[i] = metrics.NewSizeHistogram(metrics.DefaultSizeBuckets)
+	}
+	return m
+}
+
+func (m *requestMetrics) observe(req, resp *protocol.Message, elapsed time.Duration) {
+	atomic.AddUint64(&m.received, uint64(req.Size()))
+	atomic.AddUint64(&m.sent, uint64(resp.Size()))
+	atomic.AddUint64(&m.requests[req.Op], 1)
+	if resp.Status == protocol.StatusInternalServerError {
+		atomic.AddUint64(&m.failures[req.Op], 1)
+	}
+	atomic.AddUint64(&m.opReceived[req.Op], uint64(req.Size()))
+	atomic.AddUint64(&m.opSent[req.Op], uint64(resp.Size()))
+	m.latency[req.Op].Observe(elapsed)
+	m.requestSize[req.Op].ObserveSize(req.Size())
+	m.replySize[req.Op].ObserveSize(resp.Size())
+}
+
+// ops returns the OpCodes of the requests served by this node.
+func (m *requestMetrics) ops() []protocol.OpCode {
+	var ops []protocol.OpCode
+	for op := range m.requests {
+		if atomic.LoadUint64(&m.requests[op]) != 0 {
+			ops = append(ops, protocol.OpCode(op))
+		}
+	}
+	return ops
+}
+
+// writeMetrics writes the metrics of this node in the Prometheus text exposition format.
+func (db *Olric) writeMetrics(w io.Writer) error {
+	stats := db.Stats()
+	mw := metrics.NewWriter(w)
+
+	ops := db.requests.ops()
+	mw.Family("olric_requests_total", "counter", "Number of requests served by this node.")
+	for _, op := range ops {
+		mw.Sample("olric_requests_total", float64(atomic.LoadUint64(&db.requests.requests[op])),
+			metrics.Label{Name: "op", Value: op.String()})
+	}
+	mw.Family("olric_request_failures_total", "counter", "Number of requests failed with an internal error.")
+	for _, op := range ops {
+		mw.Sample("olric_request_failures_total", float64(atomic.LoadUint64(&db.requests.failures[op])),
+			metrics.Label{Name: "op", Value: op.String()})
+	}
+	mw.Family("olric_request_duration_seconds", "histogram", "Latency of the requests served by this node.")
+	for _, op := range ops {
+		mw.Histogram("olric_request_duration_seconds", db.requests.latency[op],
+			metrics.Label{Name: "op", Value: op.String()})
+	}
+	mw.Family("olric_received_bytes_total", "counter", "Number of bytes received in requests.")
+	mw.Sample("olric_received_bytes_total", float64(atomic.LoadUint64(&db.requests.received)))
+	mw.Family("olric_sent_bytes_total", "counter", "Number of bytes sent in responses.")
+	mw.Sample("olric_sent_bytes_total", float64(atomic.LoadUint64(&db.requests.sent)))
+	mw.Family("olric_request_size_bytes", "histogram", "Size of the requests served by this node.")
+	for _, op := range ops {
+		mw.Histogram("olric_request_size_bytes", db.requests.requestSize[op],
+			metrics.Label{Name: "op", Value: op.String()})
+	}
+	mw.Family("olric_response_size_bytes", "histogram", "Size of the responses sent by this node.")
+	for _, op := range ops {
+		mw.Histogram("olric_response_size_bytes", db.requests.replySize[op],
+			metrics.Label{Name: "op", Value: op.String()})
+	}
+
+	mw.Family("olric_evictions_total", "counter", "Number of keys evicted by the eviction policies.")
+	mw.Sample("olric_evictions_total", float64(stats.Evictions))
+	mw.Family("olric_read_repairs_total", "counter", "Number of stale replicas repaired by the quorum reads.")
+	mw.Sample("olric_read_repairs_total", float64(stats.ReadRepairs))
+	mw.Family("olric_pending_hints", "gauge", "Number of writes waiting for their backup owners.")
+	mw.Sample("olric_pending_hints", float64(stats.PendingHints))
+	mw.Family("olric_rebalance_pending_dmaps", "gauge", "Number of DMaps waiting to be moved to their new owners.")
+	mw.Sample("olric_rebalance_pending_dmaps", float64(stats.Rebalance.Pending))
+	mw.Family("olric_rebalance_active_dmaps", "gauge", "Number of DMaps being moved to their new owners.")
+	mw.Sample("olric_rebalance_active_dmaps", float64(stats.Rebalance.Active))
+	mw.Family("olric_rebalance_moved_bytes_total", "counter", "Number of bytes sent to move the DMaps.")
+	mw.Sample("olric_rebalance_moved_bytes_total", float64(stats.Rebalance.MovedBytes))
+	mw.Family("olric_bufpool_hits_total", "counter", "Number of message buffers reused from the pool.")
+	mw.Sample("olric_bufpool_hits_total", float64(stats.BufferPool.Hits))
+	mw.Family("olric_bufpool_misses_total", "counter", "Number of message buffers allocated because the pool was empty.")
+	mw.Sample("olric_bufpool_misses_total", float64(stats.BufferPool.Misses))
+	mw.Family("olric_bufpool_dropped_total", "counter", "Number of oversized message buffers dropped instead of being reused.")
+	mw.Sample("olric_bufpool_dropped_total", float64(stats.BufferPool.Dropped))
+
+	partIDs := make([]uint64, 0, len(stats.Partitions))
+	for partID := range stats.Partitions {
+		partIDs = append(partIDs, partID)
+	}
+	sort.Slice(partIDs, func(i, j int) bool { return partIDs[i] < partIDs[j] })
+	mw.Family("olric_partition_keys", "gauge", "Number of keys on the partition.")
+	for _, partID := range partIDs {
+		mw.Sample("olric_partition_keys", float64(stats.Partitions[partID].Length),
+			metrics.Label{Name: "partition", Value: strconv.FormatUint(partID, 10)})
+	}
+	mw.Family("olric_partition_inuse_bytes", "gauge", "Number of bytes used by the keys and values on the partition.")
+	for _, partID := range partIDs {
+		mw.Sample("olric_partition_inuse_bytes", float64(stats.Partitions[partID].Inuse),
+			metrics.Label{Name: "partition", Value: strconv.FormatUint(partID, 10)})
+	}
+
+	names := make([]string, 0, len(stats.DMaps))
+	for name := range stats.DMaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dmapFamilies := []struct {
+		name, typ, help string
+		value           func(DMapStats) float64
+	}{
+		{"olric_dmap_keys", "gauge", "Number of keys in the DMap.",
+			func(s DMapStats) float64 { return float64(s.Length) }},
+		{"olric_dmap_hits_total", "counter", "Number of reads which found the key.",
+			func(s DMapStats) float64 { return float64(s.Hits) }},
+		{"olric_dmap_misses_total", "counter", "Number of reads which didn't find the key.",
+			func(s DMapStats) float64 { return float64(s.Misses) }},
+		{"olric_dmap_evictions_total", "counter", "Number of keys evicted by the eviction policy of the DMap.",
+			func(s DMapStats) float64 { return float64(s.Evictions) }},
+	}
+	for _, f := range dmapFamilies {
+		mw.Family(f.name, f.typ, f.help)
+		for _, name := range names {
+			mw.Sample(f.name, f.value(stats.DMaps[name]), metrics.Label{Name: "dmap", Value: name})
+		}
+	}
+
+	mw.Family("olric_server_connections", "gauge", "Number of open connections to this node.")
+	mw.Sample("olric_server_connections", float64(db.server.ConnCount()))
+	mw.Family("olric_server_peak_connections", "gauge", "Highest number of open connections to this node.")
+	mw.Sample("olric_server_peak_connections", float64(db.server.PeakConnCount()))
+	mw.Family("olric_server_rejected_connections_total", "counter", "Number of connections rejected by the connection limit.")
+	mw.Sample("olric_server_rejected_connections_total", float64(db.server.RejectedConns()))
+	mw.Family("olric_server_throttled_requests_total", "counter", "Number of requests rejected by the connection rate limit.")
+	mw.Sample("olric_server_throttled_requests_total", float64(stats.Throttled.Connections))
+	throttled := make([]string, 0, len(stats.Throttled.DMaps))
+	for name := range stats.Throttled.DMaps {
+		throttled = append(throttled, name)
+	}
+	sort.Strings(throttled)
+	mw.Family("olric_dmap_throttled_requests_total", "counter", "Number of requests rejected by the rate limit of the DMap.")
+	for _, name := range throttled {
+		mw.Sample("olric_dmap_throttled_requests_total", float64(stats.Throttled.DMaps[name]), metrics.Label{Name: "dmap", Value: name})
+	}
+	idle := db.client.IdleConns()
+	peers := make([]string, 0, len(idle))
+	for addr := range idle {
+		peers = append(peers, addr)
+	}
+	sort.Strings(peers)
+	mw.Family("olric_client_idle_connections", "gauge", "Number of idle connections in the pool of the peer.")
+	for _, addr := range peers {
+		mw.Sample("olric_client_idle_connections", float64(idle[addr]), metrics.Label{Name: "peer", Value: addr})
+	}
+	return mw.Err()
+}
+
+func (db *Olric) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := db.writeMetrics(w); err != nil {
+		db.log.Printf("[ERROR] Failed to write metrics: %v", err)
+	}
+}
+
+// startMetricsServer starts the HTTP server which exposes the metrics on /metrics.
+func (db *Olric) startMetricsServer() error {
+	l, err := net.Listen("tcp", db.config.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", db.serveMetrics)
+	mux.HandleFunc("/debug/routing", db.serveRoutingTable)
+	if db.sharesMetricsServer() {
+		db.registerHealthHandlers(mux)
+	}
+	db.metricsServer = &http.Server{Handler: mux}
+
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		err := db.metricsServer.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			db.log.Printf("[ERROR] Failed to serve metrics: %v", err)
+		}
+	}()
+	db.log.Printf("[INFO] Metrics are exposed on http://%s/metrics and the routing table on /debug/routing", l.Addr())
+	return nil
+}
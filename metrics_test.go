@@ -0,0 +1,78 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOlric_Metrics(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	db2.serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`olric_requests_total{op="ExPut"} `,
+		`olric_request_duration_seconds_bucket{op="ExPut",le="+Inf"} `,
+		`olric_request_duration_seconds_count{op="PutBackup"} `,
+		`olric_request_size_bytes_bucket{op="ExPut",le="64"} `,
+		`olric_response_size_bytes_count{op="ExPut"} `,
+		`olric_dmap_keys{dmap="mymap"} `,
+		"# TYPE olric_partition_keys gauge",
+		"olric_received_bytes_total ",
+		"olric_server_connections ",
+		"olric_bufpool_hits_total ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("Expected %q in the metrics. Got:\n%s", expected, body)
+		}
+	}
+	if rec.Header().Get("Content-Type") != "text/plain; version=0.0.4" {
+		t.Fatalf("Unexpected content type: %s", rec.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"strings"
+
+	"github.com/buraksezer/olric/internal/storage"
+)
+
+// namespaceOf returns the namespace of the given DMap name, an empty string if it has no namespace.
+func namespaceOf(name string) string {
+	i := strings.Index(name, NamespaceSeparator)
+	if i <= 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+// dmapConfig returns the configuration of the given DMap. It falls back to the default DMap
+// configuration of its namespace.
+func (db *Olric) dmapConfig(name string) DMapConfig {
+	if dc, ok := db.config.DMaps[name]; ok {
+		return dc
+	}
+	if nc, ok := db.config.Namespaces[namespaceOf(name)]; ok {
+		return nc.DMaps
+	}
+	return DMapConfig{}
+}
+
+// serializerOf returns the serializer of the given DMap. The values of the DMaps with RawValues are
+// stored as they are.
+func (db *Olric) serializerOf(name string) Serializer {
+	if db.dmapConfig(name).RawValues {
+		return rawSerializer{}
+	}
+	return db.serializer
+}
+
+// namespaceUsage returns the number of keys and the number of bytes in use in the DMaps of the given
+// namespace on the primary partitions of this node.
+func (db *Olric) namespaceUsage(ns string) (int, int) {
+	var keys, inuse int
+	prefix := ns + NamespaceSeparator
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		part.m.Range(func(name, tmp interface{}) bool {
+			if strings.HasPrefix(name.(string), prefix) {
+				dm := tmp.(*dmap)
+				keys += dm.str.Len()
+				inuse += dm.str.Inuse()
+			}
+			return true
+		})
+	}
+	return keys, inuse
+}
+
+// checkQuota returns ErrQuotaExceeded if writing the given key and value to dm exceeds the quota of
+// the namespace of the DMap. The caller must hold the lock of dm.
+func (db *Olric) checkQuota(dm *dmap, name string, hkey uint64, key string, value []byte) error {
+	ns := namespaceOf(name)
+	nc, ok := db.config.Namespaces[ns]
+	if !ok || (nc.MaxKeys == 0 && nc.MaxInuse == 0) {
+		return nil
+	}
+	keys, inuse := db.namespaceUsage(ns)
+	current, err := dm.str.Get(hkey)
+	if err != nil && err != storage.ErrKeyNotFound {
+		return err
+	}
+	found := err == nil
+	if found {
+		// The current value is replaced.
+		inuse -= len(current.Key) + len(current.Value)
+	}
+	if nc.MaxKeys > 0 && !found && keys >= nc.MaxKeys {
+		return ErrQuotaExceeded
+	}
+	if nc.MaxInuse > 0 && inuse+len(key)+len(value) > nc.MaxInuse {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
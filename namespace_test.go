@@ -0,0 +1,189 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+)
+
+func newOlricWithNamespaces(peers []string, namespaces map[string]NamespaceConfig) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Namespaces = namespaces
+	return startTestOlric(cfg)
+}
+
+func TestNamespace_MaxKeys(t *testing.T) {
+	db, err := newOlricWithNamespaces(nil, map[string]NamespaceConfig{"app1": {MaxKeys: 10}})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	// The quota is shared by the DMaps of the namespace.
+	users, orders := db.NewDMap("app1/users"), db.NewDMap("app1/orders")
+	for i := 0; i < 5; i++ {
+		err = users.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		err = orders.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err = users.Put(bkey(100), bval(100))
+	if err != ErrQuotaExceeded {
+		t.Fatalf("Expected ErrQuotaExceeded. Got: %v", err)
+	}
+	// Overwriting a key doesn't add a new one.
+	err = users.Put(bkey(0), bval(100))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The other namespaces have their own quotas.
+	err = db.NewDMap("app2/users").Put(bkey(100), bval(100))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	err = orders.Delete(bkey(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = users.Put(bkey(100), bval(100))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestNamespace_MaxInuse(t *testing.T) {
+	db, err := newOlricWithNamespaces(nil, map[string]NamespaceConfig{"app1": {MaxInuse: 1 << 10}})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("app1/mymap")
+	err = dm.Put("mykey", make([]byte, 512))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = dm.Put("otherkey", make([]byte, 512))
+	if err != ErrQuotaExceeded {
+		t.Fatalf("Expected ErrQuotaExceeded. Got: %v", err)
+	}
+	// The current value of the key is replaced, it's not counted.
+	err = dm.Put("mykey", make([]byte, 600))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestNamespace_Cluster(t *testing.T) {
+	namespaces := map[string]NamespaceConfig{"app1": {MaxKeys: 5}}
+	db1, err := newOlricWithNamespaces(nil, namespaces)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithNamespaces(peers, namespaces)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	// Every node enforces the quota for the keys owned by it, the backups are not counted.
+	dm := db1.NewDMap("app1/mymap")
+	var written int
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err == ErrQuotaExceeded {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		written++
+	}
+	if written != 10 {
+		t.Fatalf("Expected 10 keys. Got: %d", written)
+	}
+}
+
+func TestNamespace_DMapConfig(t *testing.T) {
+	db, err := newOlricWithNamespaces(nil, map[string]NamespaceConfig{
+		"app1": {DMaps: DMapConfig{EvictionPolicy: LRUEviction, MaxKeys: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db.config.DMaps = map[string]DMapConfig{"app1/custom": {MaxKeys: 2}}
+
+	if db.dmapConfig("app1/mymap").EvictionPolicy != LRUEviction {
+		t.Fatalf("Expected the namespace defaults for app1/mymap")
+	}
+	if db.dmapConfig("app1/custom").MaxKeys != 2 {
+		t.Fatalf("Expected the DMap configuration for app1/custom")
+	}
+	if db.dmapConfig("app2/mymap").EvictionPolicy != "" {
+		t.Fatalf("Expected the global defaults for app2/mymap")
+	}
+}
+
+func TestNamespace_Invalid(t *testing.T) {
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.Namespaces = map[string]NamespaceConfig{"app1/users": {MaxKeys: 1}}
+	_, err = New(cfg)
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid namespace")
+	}
+}
@@ -18,19 +18,26 @@ package olric
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/buraksezer/consistent"
+	"github.com/buraksezer/olric/internal/bufpool"
 	"github.com/buraksezer/olric/internal/protocol"
 	"github.com/buraksezer/olric/internal/snapshot"
 	"github.com/buraksezer/olric/internal/storage"
 	"github.com/buraksezer/olric/internal/transport"
+	"github.com/buraksezer/olric/internal/wal"
+	"github.com/dgraph-io/badger"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/logutils"
 	"github.com/hashicorp/memberlist"
@@ -41,16 +48,86 @@ var (
 	// ErrKeyNotFound is returned when a key could not be found.
 	ErrKeyNotFound = errors.New("key not found")
 
+	// ErrKeyFound is returned when a key exists but the operation requires it to be absent.
+	ErrKeyFound = errors.New("key found")
+
 	// ErrOperationTimeout is returned when an operation times out.
 	ErrOperationTimeout = errors.New("operation timeout")
 
+	// ErrValueTooBig is returned when a value exceeds MaxValueSize.
+	ErrValueTooBig = protocol.ErrValueTooBig
+
 	// ErrInternalServerError means that something unintentionally went wrong while processing the request.
 	ErrInternalServerError = errors.New("internal server error")
 
+	// ErrSnapshotDisabled is returned by Snapshot if the operation mode is not OpInMemoryWithSnapshot.
+	ErrSnapshotDisabled = errors.New("snapshot disabled")
+
+	// ErrWriteQuorum is returned when a write is not acknowledged by Config.WriteQuorum replicas.
+	// The write may be applied on some of the replicas.
+	ErrWriteQuorum = errors.New("write quorum cannot be reached")
+
+	// ErrReadQuorum is returned when a read is not responded by Config.ReadQuorum replicas.
+	ErrReadQuorum = errors.New("read quorum cannot be reached")
+
+	// ErrPartitionCountMismatch is returned by Start if the cluster has a different PartitionCount.
+	ErrPartitionCountMismatch = errors.New("partition count mismatch")
+
+	// ErrNotStream is returned by GetReader if the value of the key is not stored by PutReader.
+	ErrNotStream = errors.New("not a stream")
+
+	// ErrInvalidArgument is returned when a request doesn't have the extra of its operation.
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrStreamCorrupted is returned by the readers of GetReader if a chunk of the stream has been lost,
+	// i.e. evicted or expired, while its metadata is still there.
+	ErrStreamCorrupted = errors.New("stream is corrupted")
+
+	// ErrUnauthorized is returned when a connection cannot be authenticated by a node.
+	ErrUnauthorized = transport.ErrUnauthorized
+
+	// ErrTooManyConnections is returned when a node rejects a new connection, see Config.MaxConnections.
+	ErrTooManyConnections = transport.ErrTooManyConnections
+
+	// ErrForbidden is returned when a request is denied by the Authorizer.
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrQuotaExceeded is returned when a write exceeds the quota of the namespace of a DMap.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrOverflow is returned when the result of Incr or Decr doesn't fit in an int. The value is not changed.
+	ErrOverflow = errors.New("integer overflow")
+
+	// ErrNotOwner is returned when a request is sent to a node which doesn't own the partition, i.e. the
+	// node is not bootstrapped yet.
+	ErrNotOwner = errors.New("not owner")
+
+	// ErrNotReady is returned by Ready if the node doesn't serve the requests correctly yet.
+	ErrNotReady = errors.New("not ready")
+
+	// ErrReadOnly is returned when a write is sent to a read-only replica, see Config.ReadOnly.
+	ErrReadOnly = errors.New("read-only replica")
+
+	// ErrRateLimited is returned when a request exceeds a rate limit of a node, see Config.ConnRateLimit
+	// and DMapConfig.RateLimit. The request is not handled, it can be retried later.
+	ErrRateLimited = errors.New("rate limited")
+
+	// ErrQuorumLost is returned when a node cannot reach Config.WriteQuorum nodes, see Config.QuorumLossPolicy.
+	// The request is not handled, it can be retried when the nodes are back.
+	ErrQuorumLost = errors.New("quorum lost")
+
 	errPartNotEmpty   = errors.New("partition not empty")
 	errBackupNotEmpty = errors.New("backup not empty")
+
+	// errNoWritableMember is returned when all the members of the cluster are read-only replicas.
+	errNoWritableMember = errors.New("no writable member")
 )
 
+// ValueTooBigError is returned when a value exceeds MaxValueSize on the local node. It carries the size of
+// the value and the limit. Use errors.Is(err, ErrValueTooBig) to check it, the errors returned by the remote
+// nodes are ErrValueTooBig without the sizes.
+type ValueTooBigError = protocol.ValueTooBigError
+
 // ReleaseVersion is the current stable version of Olric
 const ReleaseVersion string = "0.1.0"
 
@@ -60,6 +137,56 @@ var bootstrapTimeoutDuration = 10 * time.Second
 
 // Olric implements a distributed, in-memory and embeddable key/value store.
 type Olric struct {
+	// The number of evicted keys. It's accessed atomically, keep it 64-bit aligned.
+	evictions uint64
+
+	// The number of stale replicas repaired by quorum reads. It's accessed atomically, too.
+	readRepairs uint64
+
+	// routingVersion is incremented when the routing table of this node changes. It's accessed atomically, too.
+	routingVersion uint64
+
+	// clock versions the writes.
+	clock hlc
+
+	// hints keeps the writes which could not be applied on the backup owners.
+	hints *hintStore
+
+	// members delivers the membership changes to the callbacks.
+	members *memberEvents
+
+	// moves delivers the partition moves to the callbacks.
+	moves *partitionEvents
+
+	// quorum keeps the write quorum status and delivers its changes to the callbacks.
+	quorum *quorumState
+
+	// requests counts the requests served by the TCP server, metricsServer exposes them.
+	requests      *requestMetrics
+	metricsServer *http.Server
+
+	// healthServer exposes the health checks, it's nil if they're served by metricsServer.
+	healthServer *http.Server
+
+	// started is set after Start has joined the cluster and started the background workers.
+	// It's accessed atomically.
+	started int32
+
+	// slowlog keeps the operations which took longer than Config.SlowLogThreshold.
+	slowlog *slowLog
+
+	// rebalancer limits the bandwidth and the concurrency of the DMap moves.
+	rebalancer *rebalancer
+
+	// backupBatcher coalesces the backup writes, it's nil if Config.BackupBatchWindow is not set.
+	backupBatcher *backupBatcher
+
+	// cipher encrypts the values in the partitions, it's nil if Config.EncryptionKeys is empty.
+	cipher *valueCipher
+
+	// rateLimits maps the DMap names to the rate limits set by SetDMapRateLimit.
+	rateLimits sync.Map
+
 	this       host
 	config     *Config
 	log        *log.Logger
@@ -72,6 +199,7 @@ type Olric struct {
 	client     *transport.Client
 	server     *transport.Server
 	snapshot   *snapshot.Snapshot
+	wal        *wal.WAL
 	ctx        context.Context
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
@@ -80,17 +208,45 @@ type Olric struct {
 	// To control non-bootstrapped Olric instance
 	bcx     context.Context
 	bcancel context.CancelFunc
+
+	// TLS configuration of the TCP server, it's nil if TLS is disabled.
+	serverTLS *tls.Config
 }
 
 type dmap struct {
+	// The counters are accessed atomically, keep them 64-bit aligned.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
 	sync.Mutex
 
-	locker *locker
-	oplog  *snapshot.OpLog
-	str    *storage.Storage
+	partID  uint64
+	backup  bool
+	config  DMapConfig
+	locker  *locker
+	oplog   *snapshot.OpLog
+	str     *storage.Storage
+	tracker accessTracker
+	idle    *idleTracker
+
+	// tombstones records the deleted keys until Config.TombstoneTTL passes.
+	tombstones map[uint64]tombstone
+
+	// generation is incremented when a scan reaches the dmap. inserted records the generation of the
+	// keys created since the first scan, the scans skip the keys which are newer than themselves.
+	generation uint64
+	inserted   map[uint64]uint64
+
+	// index is nil if the DMap has no index or it's a backup.
+	index dmapIndex
 }
 
 type partition struct {
+	// lastSync and syncedBytes are accessed atomically, keep them 64-bit aligned.
+	lastSync    int64
+	syncedBytes uint64
+
 	count  int32
 	id     uint64
 	backup bool
@@ -100,7 +256,17 @@ type partition struct {
 	owners []host
 }
 
-// DMap represents a distributed map object.
+// hasDMap returns true if dm is still stored in the partition with the given name. The callers which
+// delete a dmap check it after locking the dmap, another one may have deleted it in the meantime.
+func (part *partition) hasDMap(name string, dm *dmap) bool {
+	tmp, ok := part.m.Load(name)
+	return ok && tmp.(*dmap) == dm
+}
+
+// DMap represents a distributed map object. Its methods don't pass through the checks of Config.ReadOnly and
+// Config.QuorumLossPolicy, which are applied to the requests of the clients: the writes are applied if this
+// node owns the key, even while the write quorum is lost. The writes of the keys owned by the other nodes are
+// checked by the owners.
 type DMap struct {
 	name string
 	db   *Olric
@@ -114,6 +280,16 @@ func (db *Olric) NewDMap(name string) *DMap {
 	}
 }
 
+// consistentConfig returns the configuration of the consistent hash ring which assigns the partitions to the nodes.
+func consistentConfig(c *Config) consistent.Config {
+	return consistent.Config{
+		Hasher:            c.Hasher,
+		PartitionCount:    int(c.PartitionCount),
+		ReplicationFactor: 20, // TODO: This also may be a configuration param.
+		Load:              c.LoadFactor,
+	}
+}
+
 // New creates a new Olric object, otherwise returns an error.
 func New(c *Config) (*Olric, error) {
 	if c == nil {
@@ -122,6 +298,56 @@ func New(c *Config) (*Olric, error) {
 	if c.LogOutput != nil && c.Logger != nil {
 		return nil, fmt.Errorf("cannot specify both LogOutput and Logger")
 	}
+	if c.EnableWAL && c.OperationMode != OpInMemoryWithSnapshot {
+		return nil, fmt.Errorf("write-ahead log requires OpInMemoryWithSnapshot")
+	}
+	if c.ReplicaCount != 0 {
+		if c.ReplicaCount < 1 {
+			return nil, fmt.Errorf("invalid replica count: %d", c.ReplicaCount)
+		}
+		c.BackupCount = c.ReplicaCount - 1
+	}
+	if c.WriteQuorum < 0 || c.WriteQuorum > c.BackupCount+1 {
+		return nil, fmt.Errorf("write quorum cannot be bigger than the replica count: %d", c.WriteQuorum)
+	}
+	if c.WriteQuorum > 1 && c.BackupMode == AsyncBackupMode {
+		return nil, fmt.Errorf("write quorum requires SyncBackupMode")
+	}
+	if c.ReadQuorum < 0 || c.ReadQuorum > c.BackupCount+1 {
+		return nil, fmt.Errorf("read quorum cannot be bigger than the replica count: %d", c.ReadQuorum)
+	}
+	if c.TTLJitter < 0 || c.TTLJitter > 1 {
+		return nil, fmt.Errorf("TTL jitter must be between 0 and 1: %v", c.TTLJitter)
+	}
+	for name, dc := range c.DMaps {
+		switch dc.EvictionPolicy {
+		case "", NoEviction, LRUEviction, LFUEviction, TTLOnlyEviction:
+		default:
+			return nil, fmt.Errorf("unknown eviction policy for DMap: %s: %s", name, dc.EvictionPolicy)
+		}
+		if dc.TTLJitter < 0 || dc.TTLJitter > 1 {
+			return nil, fmt.Errorf("TTL jitter must be between 0 and 1 for DMap: %s: %v", name, dc.TTLJitter)
+		}
+		if dc.DefaultTTL < 0 {
+			return nil, fmt.Errorf("default TTL cannot be negative for DMap: %s: %v", name, dc.DefaultTTL)
+		}
+	}
+	for ns, nc := range c.Namespaces {
+		if ns == "" || strings.Contains(ns, NamespaceSeparator) {
+			return nil, fmt.Errorf("invalid namespace: %q", ns)
+		}
+		switch nc.DMaps.EvictionPolicy {
+		case "", NoEviction, LRUEviction, LFUEviction, TTLOnlyEviction:
+		default:
+			return nil, fmt.Errorf("unknown eviction policy for namespace: %s: %s", ns, nc.DMaps.EvictionPolicy)
+		}
+		if nc.DMaps.TTLJitter < 0 || nc.DMaps.TTLJitter > 1 {
+			return nil, fmt.Errorf("TTL jitter must be between 0 and 1 for namespace: %s: %v", ns, nc.DMaps.TTLJitter)
+		}
+		if nc.DMaps.DefaultTTL < 0 {
+			return nil, fmt.Errorf("default TTL cannot be negative for namespace: %s: %v", ns, nc.DMaps.DefaultTTL)
+		}
+	}
 
 	if c.Logger == nil {
 		logDest := c.LogOutput
@@ -161,17 +387,99 @@ func New(c *Config) (*Olric, error) {
 	if c.PartitionCount == 0 {
 		c.PartitionCount = DefaultPartitionCount
 	}
+	if c.ExpirySweepInterval == 0 {
+		c.ExpirySweepInterval = DefaultExpirySweepInterval
+	}
+	if c.ExpirySweepSampleSize == 0 {
+		c.ExpirySweepSampleSize = DefaultExpirySweepSampleSize
+	}
+	if c.MaxHints == 0 {
+		c.MaxHints = DefaultMaxHints
+	}
+	if c.SlowLogSize == 0 {
+		c.SlowLogSize = DefaultSlowLogSize
+	}
+	if c.MetricsAddr == "" {
+		c.MetricsAddr = DefaultMetricsAddr
+	}
+	if c.AntiEntropyInterval == 0 {
+		c.AntiEntropyInterval = DefaultAntiEntropyInterval
+	}
+	if c.TombstoneTTL == 0 {
+		c.TombstoneTTL = DefaultTombstoneTTL
+	}
+
+	if c.Authorizer == nil {
+		c.Authorizer = NopAuthorizer{}
+	}
+	if c.AuthTimeout == 0 {
+		c.AuthTimeout = DefaultAuthTimeout
+	}
+	if c.KeepAlivePeriod == 0 {
+		c.KeepAlivePeriod = DefaultKeepAlivePeriod
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = DefaultReadTimeout
+	}
+	if c.OutboundQueueSize == 0 {
+		c.OutboundQueueSize = DefaultOutboundQueueSize
+	}
+	if c.BackupBatchSize == 0 {
+		c.BackupBatchSize = DefaultBackupBatchSize
+	}
+	if c.OutboundQueueSize < 0 {
+		return nil, fmt.Errorf("invalid outbound queue size: %d", c.OutboundQueueSize)
+	}
+	if c.MaxConnections < 0 {
+		return nil, fmt.Errorf("invalid maximum number of connections: %d", c.MaxConnections)
+	}
+	if c.ConnRateLimit < 0 {
+		return nil, fmt.Errorf("invalid connection rate limit: %v", c.ConnRateLimit)
+	}
+	if c.RebalanceThreshold < 0 {
+		return nil, fmt.Errorf("invalid rebalance threshold: %v", c.RebalanceThreshold)
+	}
+	switch c.QuorumLossPolicy {
+	case "":
+		c.QuorumLossPolicy = QuorumLossReadOnly
+	case QuorumLossReadOnly, QuorumLossUnavailable:
+	default:
+		return nil, fmt.Errorf("unknown quorum loss policy: %s", c.QuorumLossPolicy)
+	}
+	switch c.BackpressurePolicy {
+	case "":
+		c.BackpressurePolicy = BackpressureBlock
+	case BackpressureBlock, BackpressureClose:
+	default:
+		return nil, fmt.Errorf("unknown backpressure policy: %s", c.BackpressurePolicy)
+	}
+
+	timeouts := make(map[protocol.OpCode]time.Duration, len(c.OperationTimeouts))
+	for name, timeout := range c.OperationTimeouts {
+		op, ok := protocol.ParseOpCode(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown operation: %s", name)
+		}
+		timeouts[op] = timeout
+	}
 
 	if c.MemberlistConfig == nil {
 		c.MemberlistConfig = memberlist.DefaultLocalConfig()
 	}
 
-	cfg := consistent.Config{
-		Hasher:            c.Hasher,
-		PartitionCount:    int(c.PartitionCount),
-		ReplicationFactor: 20, // TODO: This also may be a configuration param.
-		Load:              c.LoadFactor,
+	serverTLS, clientTLS, err := newTLSConfigs(c)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to load TLS configuration")
 	}
+
+	var vc *valueCipher
+	if len(c.EncryptionKeys) != 0 {
+		vc, err = newValueCipher(c.EncryptionKeys, c.EncryptionKeyVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	bctx, bcancel := context.WithTimeout(context.Background(), bootstrapTimeoutDuration)
 
@@ -179,10 +487,40 @@ func New(c *Config) (*Olric, error) {
 	if c.MaxValueSize != 0 {
 		protocol.MaxValueSize = c.MaxValueSize
 	}
+	for name, dc := range c.DMaps {
+		if dc.MaxValueSize != 0 {
+			protocol.SetDMapMaxValueSize(name, dc.MaxValueSize)
+		}
+	}
+	if c.MaxKeyLen != 0 {
+		protocol.MaxKeyLen = c.MaxKeyLen
+	}
+	if c.MaxDMapLen != 0 {
+		protocol.MaxDMapLen = c.MaxDMapLen
+	}
+	if c.BufferPoolInitialSize != 0 || c.BufferPoolMaxSize != 0 {
+		maxSize := c.BufferPoolMaxSize
+		if maxSize == 0 {
+			maxSize = bufpool.DefaultMaxSize
+		}
+		protocol.SetBufferPoolSize(c.BufferPoolInitialSize, maxSize)
+	}
+	if c.CompressionCodec != nil {
+		protocol.Codec = c.CompressionCodec
+	}
+	if c.CompressionThreshold != 0 {
+		protocol.CompressionThreshold = c.CompressionThreshold
+	}
+	if c.MaxProtocolVersion != 0 {
+		protocol.MaxProtocolVersion = c.MaxProtocolVersion
+	}
 	cc := &transport.ClientConfig{
-		DialTimeout: c.DialTimeout,
-		KeepAlive:   c.KeepAlivePeriod,
-		MaxConn:     1024, // TODO: Make this configurable.
+		DialTimeout:    c.DialTimeout,
+		KeepAlive:      c.KeepAlivePeriod,
+		MaxConn:        1024, // TODO: Make this configurable.
+		DisableNoDelay: c.DisableNoDelay,
+		TLSConfig:      clientTLS,
+		Credential:     c.Credential,
 	}
 	client := transport.NewClient(cc)
 	db := &Olric{
@@ -192,21 +530,53 @@ func New(c *Config) (*Olric, error) {
 		config:     c,
 		hasher:     c.Hasher,
 		serializer: c.Serializer,
-		consistent: consistent.New(nil, cfg),
+		consistent: consistent.New(nil, consistentConfig(c)),
 		client:     client,
 		partitions: make(map[uint64]*partition),
 		backups:    make(map[uint64]*partition),
+		hints:      newHintStore(c.MaxHints),
+		members:    newMemberEvents(),
+		moves:      newPartitionEvents(),
+		quorum:     newQuorumState(),
+		requests:   newRequestMetrics(),
+		slowlog:    newSlowLog(c.SlowLogThreshold, c.SlowLogSize),
+		rebalancer: newRebalancer(c.RebalanceRate, c.RebalanceConcurrency),
+		cipher:     vc,
 		bcx:        bctx,
 		bcancel:    bcancel,
 		server:     transport.NewServer(c.Name, c.Logger, c.KeepAlivePeriod),
+		serverTLS:  serverTLS,
+	}
+	if c.BackupBatchWindow > 0 {
+		db.backupBatcher = newBackupBatcher(c.BackupBatchWindow, c.BackupBatchSize, db.sendBackupBatch)
 	}
 	if c.OperationMode == OpInMemoryWithSnapshot {
-		snap, err := snapshot.New(c.BadgerOptions, c.SnapshotInterval,
+		// Don't modify the options of the caller.
+		opt := badger.DefaultOptions
+		if c.BadgerOptions != nil {
+			opt = *c.BadgerOptions
+		}
+		if c.SnapshotDir != "" {
+			opt.Dir = c.SnapshotDir
+			opt.ValueDir = c.SnapshotDir
+		}
+		snap, err := snapshot.New(&opt, c.SnapshotInterval,
 			c.GCInterval, c.GCDiscardRatio, c.Logger)
 		if err != nil {
 			return nil, err
 		}
 		db.snapshot = snap
+		if c.EnableWAL {
+			if c.WALSyncPolicy == "" {
+				c.WALSyncPolicy = WALSyncEverySec
+			}
+			w, err := wal.Open(filepath.Join(opt.Dir, "wal"), wal.SyncPolicy(c.WALSyncPolicy))
+			if err != nil {
+				return nil, err
+			}
+			db.wal = w
+			snap.SetJournal(w)
+		}
 	}
 	// Create all the partitions. It's read-only. No need for locking.
 	for i := uint64(0); i < c.PartitionCount; i++ {
@@ -222,28 +592,56 @@ func New(c *Config) (*Olric, error) {
 	}
 
 	db.registerOperations()
+	db.server.SetObserver(db.observeRequest)
+	db.server.SetBackpressure(c.OutboundQueueSize, c.BackpressurePolicy == BackpressureClose)
+	db.server.SetMaxConns(c.MaxConnections)
+	db.server.SetConnRateLimit(c.ConnRateLimit)
+	db.server.SetRateLimits(isClientOp, db.dmapRateLimit)
+	db.server.SetNoDelay(!c.DisableNoDelay)
+	db.server.SetReadTimeout(c.ReadTimeout)
+	db.server.SetOperationTimeouts(timeouts)
+	if _, ok := c.Authorizer.(NopAuthorizer); !ok {
+		db.server.SetAuthorizer(db.authorizeRequest)
+	}
+	if c.Authenticator != nil {
+		db.server.SetAuthenticator(db.authenticateConn, c.AuthTimeout)
+	}
+	if c.Tracer != nil {
+		db.server.SetTracer(db.traceRequest)
+		cc.Tracer = db.traceOutgoing
+	}
+	// The snapshot and the write-ahead log are restored before the first tick of updateCurrentUnixNano.
+	atomic.StoreInt64(&currentUnixNano, time.Now().UnixNano())
 	db.wg.Add(1)
 	go db.updateCurrentUnixNano()
 	return db, nil
 }
 
+// SetMaxConnections changes the maximum number of open connections to this node. The open connections are
+// not closed if it's lowered. Zero disables the limit. See Config.MaxConnections.
+func (db *Olric) SetMaxConnections(max int) {
+	db.server.SetMaxConns(max)
+}
+
 func (db *Olric) startDiscovery() error {
 	dsc, err := newDiscovery(db.config)
 	if err != nil {
 		return err
 	}
+
+	// The routing updates of the other nodes may arrive during the join, they read db.discovery.
 	db.discovery = dsc
 
-	eventCh := db.discovery.subscribeNodeEvents()
-	db.discovery.join()
-	this, err := db.discovery.findMember(db.config.Name)
+	eventCh := dsc.subscribeNodeEvents()
+	memberCh := dsc.subscribeNodeEvents()
+	if err = dsc.join(); err != nil {
+		db.log.Printf("[ERROR] Failed to join the cluster: %v", err)
+		return db.stopDiscovery(err)
+	}
+	this, err := dsc.findMember(db.config.Name)
 	if err != nil {
 		db.log.Printf("[DEBUG] Failed to get this node in cluster: %v", err)
-		serr := db.discovery.shutdown()
-		if serr != nil {
-			return serr
-		}
-		return err
+		return db.stopDiscovery(err)
 	}
 
 	db.this = this
@@ -254,27 +652,74 @@ func (db *Olric) startDiscovery() error {
 		db.bcancel()
 	}
 
-	db.wg.Add(1)
+	db.checkQuorum()
+
+	db.wg.Add(5)
 	go db.listenMemberlistEvents(eventCh)
+	go db.listenMemberEvents(memberCh)
+	go db.deliverMemberEvents()
+	go db.deliverPartitionEvents()
+	go db.deliverQuorumEvents()
 	return nil
 }
 
+// stopDiscovery shuts down the discovery after a failed join and returns err. Shutdown doesn't
+// leave the cluster then.
+func (db *Olric) stopDiscovery(err error) error {
+	serr := db.discovery.shutdown()
+	db.discovery = nil
+	if serr != nil {
+		return serr
+	}
+	return err
+}
+
 func (db *Olric) restoreDMap(dkey []byte, part *partition, name string, str *storage.Storage) error {
 	// Don't use Mutex for this because only partition owners list needs this.
 	oplog, err := db.snapshot.RegisterDMap(dkey, part.id, name, str)
 	if err != nil {
 		return err
 	}
-	dm := &dmap{
-		locker: newLocker(),
-		str:    str,
-		oplog:  oplog,
+	dm := db.newDMap(part, name, str)
+	dm.oplog = oplog
+	// The TTLs are absolute timestamps, drop the keys which have expired while the node was down.
+	count, err := dropExpiredKeys(dm)
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		db.log.Printf("[DEBUG] Dropped %d expired keys of DMap %s on PartID(backup: %t): %d",
+			count, name, part.backup, part.id)
 	}
 	part.m.Store(name, dm)
 	atomic.AddInt32(&part.count, 1)
 	return nil
 }
 
+// dropExpiredKeys deletes the expired keys of a restored dmap from the storage and the snapshot.
+// It returns the number of deleted keys.
+func dropExpiredKeys(dm *dmap) (int, error) {
+	var expired []uint64
+	err := dm.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+		if isKeyExpired(vdata.TTL) {
+			expired = append(expired, hkey)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, hkey := range expired {
+		dm.oplog.Delete(hkey)
+		err = dm.str.Delete(hkey)
+		if err != nil {
+			return 0, err
+		}
+		delete(dm.inserted, hkey)
+	}
+	return len(expired), nil
+}
+
 func (db *Olric) restoreFromSnapshot(dkey []byte) error {
 	l, err := db.snapshot.NewLoader(dkey)
 	if err == snapshot.ErrFirstRun {
@@ -307,8 +752,35 @@ func (db *Olric) restoreFromSnapshot(dkey []byte) error {
 	return nil
 }
 
+// listenAndServe runs the TCP server, it accepts TLS connections if TLS is enabled.
+func (db *Olric) listenAndServe() error {
+	if db.serverTLS != nil {
+		return db.server.ListenAndServeTLS(db.serverTLS)
+	}
+	return db.server.ListenAndServe()
+}
+
+// servePlaintext accepts plaintext connections on PlaintextAddr at background, if TLS is enabled.
+// It must be called after the TCP server has started.
+func (db *Olric) servePlaintext() {
+	if db.serverTLS == nil || db.config.PlaintextAddr == "" {
+		return
+	}
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		err := db.server.ServeAdditional(db.config.PlaintextAddr, nil)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to serve plaintext connections on %s: %v", db.config.PlaintextAddr, err)
+		}
+	}()
+}
+
 // Start starts background servers and joins the cluster.
 func (db *Olric) Start() error {
+	if err := db.startHealthServer(); err != nil {
+		return err
+	}
 	if db.config.OperationMode == OpInMemoryWithSnapshot {
 		now := time.Now()
 		db.log.Printf("[INFO] Reloading data from the snapshot. This may take a while.")
@@ -322,17 +794,20 @@ func (db *Olric) Start() error {
 		}
 		db.log.Printf("[INFO] Reloading data from the snapshot took %v", time.Since(now))
 	}
+	var replayed []*wal.Record
+	if db.wal != nil {
+		var err error
+		replayed, err = db.replayWAL()
+		if err != nil {
+			return err
+		}
+	}
 
 	errCh := make(chan error, 1)
 	db.wg.Add(1)
 	go func() {
 		defer db.wg.Done()
-		// TODO: Check files on disk.
-		if db.config.KeyFile != "" && db.config.CertFile != "" {
-			errCh <- db.server.ListenAndServeTLS(db.config.CertFile, db.config.KeyFile)
-			return
-		}
-		errCh <- db.server.ListenAndServe()
+		errCh <- db.listenAndServe()
 	}()
 
 	<-db.server.StartCh
@@ -341,67 +816,162 @@ func (db *Olric) Start() error {
 		return err
 	default:
 	}
+	db.servePlaintext()
 
 	if err := db.startDiscovery(); err != nil {
 		return err
 	}
-	db.wg.Add(3)
+	if db.config.EnableMetrics {
+		if err := db.startMetricsServer(); err != nil {
+			return err
+		}
+	}
+	if len(replayed) != 0 {
+		db.wg.Add(1)
+		go db.reconcileBackups(replayed)
+	}
+	db.wg.Add(4)
 	go db.updateRoutingPeriodically()
 	go db.evictKeysAtBackground()
+	go db.evictIdleKeysAtBackground()
 	go db.deleteStaleDMapsAtBackground()
+	if db.config.AntiEntropyInterval > 0 {
+		db.wg.Add(1)
+		go db.antiEntropyAtBackground()
+	}
+	atomic.StoreInt32(&db.started, 1)
 	return <-errCh
 }
 
 func (db *Olric) registerOperations() {
 	// Put
-	db.server.RegisterOperation(protocol.OpExPut, db.exPutOperation)
-	db.server.RegisterOperation(protocol.OpExPutEx, db.exPutExOperation)
+	db.server.RegisterOperation(protocol.OpExPut, db.writable(db.redirect(db.exPutOperation)))
+	db.server.RegisterOperation(protocol.OpExPutEx, db.writable(db.redirect(db.exPutExOperation)))
 	db.server.RegisterOperation(protocol.OpPutBackup, db.putBackupOperation)
+	db.server.RegisterOperation(protocol.OpPutBackupBatch, db.putBackupBatchOperation)
+	db.server.RegisterOperation(protocol.OpExMPut, db.writable(db.exMPutOperation))
+	db.server.RegisterOperation(protocol.OpExMPutEx, db.writable(db.exMPutExOperation))
+	db.server.RegisterOperation(protocol.OpExPutIf, db.writable(db.redirect(db.exPutIfOperation)))
 
 	// Get
-	db.server.RegisterOperation(protocol.OpExGet, db.exGetOperation)
+	db.server.RegisterOperation(protocol.OpExGet, db.readable(db.redirect(db.exGetOperation)))
 	db.server.RegisterOperation(protocol.OpGetPrev, db.getPrevOperation)
 	db.server.RegisterOperation(protocol.OpGetBackup, db.getBackupOperation)
+	db.server.RegisterOperation(protocol.OpExMGet, db.readable(db.exMGetOperation))
+	db.server.RegisterOperation(protocol.OpExGetEx, db.readable(db.redirect(db.exGetExOperation)))
+	db.server.RegisterOperation(protocol.OpExGetEntry, db.readable(db.redirect(db.exGetEntryOperation)))
+	db.server.RegisterOperation(protocol.OpAccessBackup, db.accessBackupOperation)
 
 	// Delete
-	db.server.RegisterOperation(protocol.OpExDelete, db.exDeleteOperation)
+	db.server.RegisterOperation(protocol.OpExDelete, db.writable(db.redirect(db.exDeleteOperation)))
 	db.server.RegisterOperation(protocol.OpDeleteBackup, db.deleteBackupOperation)
+	db.server.RegisterOperation(protocol.OpExMDelete, db.writable(db.exMDeleteOperation))
+	db.server.RegisterOperation(protocol.OpMDeleteBackup, db.mDeleteBackupOperation)
 	db.server.RegisterOperation(protocol.OpDeletePrev, db.deletePrevOperation)
+	db.server.RegisterOperation(protocol.OpExDeleteByPattern, db.writable(db.exDeleteByPatternOperation))
+	db.server.RegisterOperation(protocol.OpDeleteByPattern, db.deleteByPatternOperation)
+
+	// Expire
+	db.server.RegisterOperation(protocol.OpExpire, db.writable(db.redirect(db.exExpireOperation)))
+	db.server.RegisterOperation(protocol.OpExpireBackup, db.expireBackupOperation)
+
+	// Touch
+	db.server.RegisterOperation(protocol.OpTouch, db.writable(db.redirect(db.exTouchOperation)))
+
+	// Compare
+	db.server.RegisterOperation(protocol.OpExCAS, db.writable(db.redirect(db.exCASOperation)))
+	db.server.RegisterOperation(protocol.OpExCAD, db.writable(db.redirect(db.exCADOperation)))
 
 	// Lock/Unlock
-	db.server.RegisterOperation(protocol.OpExLockWithTimeout, db.exLockWithTimeoutOperation)
-	db.server.RegisterOperation(protocol.OpExUnlock, db.exUnlockOperation)
+	// Releasing and extending the locks are allowed while the write quorum is lost, so the holders don't
+	// have to wait for the TTLs of their locks.
+	db.server.RegisterOperation(protocol.OpExLockWithTimeout, db.writable(db.redirect(db.exLockWithTimeoutOperation)))
+	db.server.RegisterOperation(protocol.OpTryLock, db.writable(db.redirect(db.tryLockOperation)))
+	db.server.RegisterOperation(protocol.OpExUnlock, db.readable(db.redirect(db.exUnlockOperation)))
 	db.server.RegisterOperation(protocol.OpFindLock, db.findLockOperation)
 	db.server.RegisterOperation(protocol.OpLockPrev, db.lockPrevOperation)
 	db.server.RegisterOperation(protocol.OpUnlockPrev, db.unlockPrevOperation)
+	db.server.RegisterOperation(protocol.OpLockLease, db.readable(db.redirect(db.lockLeaseOperation)))
+	db.server.RegisterOperation(protocol.OpLeasePrev, db.leasePrevOperation)
 
 	// Destroy
-	db.server.RegisterOperation(protocol.OpExDestroy, db.exDestroyOperation)
+	db.server.RegisterOperation(protocol.OpExDestroy, db.writable(db.exDestroyOperation))
 	db.server.RegisterOperation(protocol.OpDestroyDMap, db.destroyDMapOperation)
 
+	// Clear
+	db.server.RegisterOperation(protocol.OpExClear, db.writable(db.exClearOperation))
+	db.server.RegisterOperation(protocol.OpClear, db.clearOperation)
+
+	// Len
+	db.server.RegisterOperation(protocol.OpExLen, db.readable(db.exLenOperation))
+	db.server.RegisterOperation(protocol.OpLen, db.lenOperation)
+
+	// Scan
+	db.server.RegisterOperation(protocol.OpExScan, db.readable(db.exScanOperation))
+	db.server.RegisterOperation(protocol.OpScan, db.scanOperation)
+	db.server.RegisterOperation(protocol.OpDump, db.dumpOperation)
+
+	// Query
+	db.server.RegisterOperation(protocol.OpExQuery, db.readable(db.exQueryOperation))
+	db.server.RegisterOperation(protocol.OpQuery, db.queryOperation)
+	db.server.RegisterOperation(protocol.OpExGetByIndex, db.readable(db.exGetByIndexOperation))
+	db.server.RegisterOperation(protocol.OpGetByIndex, db.getByIndexOperation)
+
 	// Atomic
-	db.server.RegisterOperation(protocol.OpExIncr, db.exIncrDecrOperation)
-	db.server.RegisterOperation(protocol.OpExDecr, db.exIncrDecrOperation)
-	db.server.RegisterOperation(protocol.OpExGetPut, db.exGetPutOperation)
+	db.server.RegisterOperation(protocol.OpExIncr, db.writable(db.redirect(db.exIncrDecrOperation)))
+	db.server.RegisterOperation(protocol.OpExDecr, db.writable(db.redirect(db.exIncrDecrOperation)))
+	db.server.RegisterOperation(protocol.OpExIncrByFloat, db.writable(db.redirect(db.exIncrByFloatOperation)))
+	db.server.RegisterOperation(protocol.OpExGetPut, db.writable(db.redirect(db.exGetPutOperation)))
+	db.server.RegisterOperation(protocol.OpExAppend, db.writable(db.redirect(db.exAppendPrependOperation)))
+	db.server.RegisterOperation(protocol.OpExPrepend, db.writable(db.redirect(db.exAppendPrependOperation)))
+
+	// Stats
+	db.server.RegisterOperation(protocol.OpStats, db.statsOperation)
+	db.server.RegisterOperation(protocol.OpSlowLog, db.slowLogOperation)
 
 	// Internal
 	db.server.RegisterOperation(protocol.OpUpdateRouting, db.updateRoutingOperation)
+	db.server.RegisterOperation(protocol.OpRefreshRouting, db.refreshRoutingOperation)
 	db.server.RegisterOperation(protocol.OpMoveDMap, db.moveDMapOperation)
 	db.server.RegisterOperation(protocol.OpBackupMoveDMap, db.moveBackupDMapOperation)
 	db.server.RegisterOperation(protocol.OpIsPartEmpty, db.isPartEmptyOperation)
 	db.server.RegisterOperation(protocol.OpIsBackupEmpty, db.isBackupEmptyOperation)
+	db.server.RegisterOperation(protocol.OpMerkleRoot, db.merkleRootOperation)
+	db.server.RegisterOperation(protocol.OpMerkleSubtree, db.merkleSubtreeOperation)
+	db.server.RegisterOperation(protocol.OpMerkleKeys, db.merkleKeysOperation)
 }
 
-// Shutdown stops background servers and leaves the cluster.
+// Shutdown stops accepting new requests, waits for the ongoing ones and moves the primary copies on this
+// node to their owners after it leaves. Then it stops background servers and leaves the cluster. If the
+// context is done before, it shuts down without leaving gracefully and returns a *HandoffError for the
+// DMaps which have not been moved.
 func (db *Olric) Shutdown(ctx context.Context) error {
+	// Shutdown may be called more than once, leave the cluster only once.
+	leaving := db.ctx.Err() == nil
 	db.cancel()
 
 	var result error
+	// Stop accepting new requests and wait for the ongoing ones.
 	if err := db.server.Shutdown(ctx); err != nil {
 		result = multierror.Append(result, err)
 	}
+	if db.metricsServer != nil {
+		if err := db.metricsServer.Shutdown(ctx); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if db.healthServer != nil {
+		if err := db.healthServer.Shutdown(ctx); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
 
 	if db.discovery != nil {
+		if leaving {
+			if err := db.leave(ctx); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
 		err := db.discovery.memberlist.Shutdown()
 		if err != nil {
 			result = multierror.Append(result, err)
@@ -414,6 +984,13 @@ func (db *Olric) Shutdown(ctx context.Context) error {
 		}
 	}
 
+	// The snapshot syncs the DMaps for the last time while shutting down, close the log after it.
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
 	db.wg.Wait()
 
 	// Free allocated memory by mmap.
@@ -442,6 +1019,15 @@ func (db *Olric) Shutdown(ctx context.Context) error {
 	return result
 }
 
+// Snapshot synchronizes the DMaps on this node to the snapshot immediately instead of waiting
+// for SnapshotInterval. It returns ErrSnapshotDisabled if the operation mode is not OpInMemoryWithSnapshot.
+func (db *Olric) Snapshot() error {
+	if db.config.OperationMode != OpInMemoryWithSnapshot {
+		return ErrSnapshotDisabled
+	}
+	return db.snapshot.Sync()
+}
+
 func (db *Olric) getPartitionID(hkey uint64) uint64 {
 	return hkey % db.config.PartitionCount
 }
@@ -501,6 +1087,40 @@ func (db *Olric) locateKey(name, key string) (host, uint64, error) {
 	return member, hkey, nil
 }
 
+// newDMap creates a new dmap with the configuration of the given DMap name.
+func (db *Olric) newDMap(part *partition, name string, str *storage.Storage) *dmap {
+	if db.cipher != nil {
+		str.SetCipher(db.cipher.forDMap(name, part.id))
+	}
+	dm := &dmap{
+		partID: part.id,
+		backup: part.backup,
+		config: db.dmapConfig(name),
+		locker: newLocker(),
+		str:    str,
+	}
+	// The keys are evicted by the owners of the partitions, backups follow them.
+	if !part.backup {
+		switch dm.config.EvictionPolicy {
+		case LRUEviction:
+			dm.tracker = newLRU()
+		case LFUEviction:
+			dm.tracker = newLFU()
+		case TTLOnlyEviction:
+			dm.tracker = &ttlTracker{str: str, log: db.log}
+		}
+	}
+	if dm.config.MaxIdleDuration > 0 {
+		dm.idle = newIdleTracker(dm.config.MaxIdleDuration)
+	}
+	if !part.backup && len(dm.config.Indexes) != 0 {
+		dm.index = newDMapIndex(dm.config.Indexes)
+		// The storage of a moved or a restored DMap is not empty.
+		db.buildIndex(dm, name)
+	}
+	return dm
+}
+
 func (db *Olric) createDMap(part *partition, name string) (*dmap, error) {
 	// We need to protect snapshot.RegisterDMap and storage.New
 	part.Lock()
@@ -515,10 +1135,7 @@ func (db *Olric) createDMap(part *partition, name string) (*dmap, error) {
 	if err != nil {
 		return nil, err
 	}
-	fresh := &dmap{
-		locker: newLocker(),
-		str:    str,
-	}
+	fresh := db.newDMap(part, name, str)
 	if db.config.OperationMode == OpInMemoryWithSnapshot {
 		dkey := snapshot.PrimaryDMapKey
 		if part.backup {
@@ -563,22 +1180,107 @@ func (db *Olric) requestTo(addr string, opcode protocol.OpCode, req *protocol.Me
 	if err != nil {
 		return nil, err
 	}
+	err = statusError(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
 
+// statusError returns the error of a response, nil if its status is StatusOK.
+func statusError(resp *protocol.Message) error {
 	switch {
 	case resp.Status == protocol.StatusOK:
-		return resp, nil
+		return nil
 	case resp.Status == protocol.StatusInternalServerError:
-		return nil, errors.Wrap(ErrInternalServerError, string(resp.Value))
+		return errors.Wrap(ErrInternalServerError, string(resp.Value))
 	case resp.Status == protocol.StatusNoSuchLock:
-		return nil, ErrNoSuchLock
+		return ErrNoSuchLock
 	case resp.Status == protocol.StatusKeyNotFound:
-		return nil, ErrKeyNotFound
+		return ErrKeyNotFound
+	case resp.Status == protocol.StatusKeyFound:
+		return ErrKeyFound
+	case resp.Status == protocol.StatusValueTooBig:
+		return ErrValueTooBig
 	case resp.Status == protocol.StatusPartNotEmpty:
-		return nil, errPartNotEmpty
+		return errPartNotEmpty
 	case resp.Status == protocol.StatusBackupNotEmpty:
-		return nil, errBackupNotEmpty
+		return errBackupNotEmpty
+	case resp.Status == protocol.StatusUnauthorized:
+		return ErrUnauthorized
+	case resp.Status == protocol.StatusForbidden:
+		return ErrForbidden
+	case resp.Status == protocol.StatusQuotaExceeded:
+		return ErrQuotaExceeded
+	case resp.Status == protocol.StatusWriteQuorum:
+		return ErrWriteQuorum
+	case resp.Status == protocol.StatusReadQuorum:
+		return ErrReadQuorum
+	case resp.Status == protocol.StatusNotOwner:
+		return ErrNotOwner
+	case resp.Status == protocol.StatusTimeout:
+		return ErrOperationTimeout
+	case resp.Status == protocol.StatusOverflow:
+		return ErrOverflow
+	case resp.Status == protocol.StatusReadOnly:
+		return ErrReadOnly
+	case resp.Status == protocol.StatusRateLimited:
+		return ErrRateLimited
+	case resp.Status == protocol.StatusQuorumLost:
+		return ErrQuorumLost
 	}
-	return nil, fmt.Errorf("unknown status code: %d", resp.Status)
+	return fmt.Errorf("unknown status code: %d", resp.Status)
+}
+
+// errorStatus returns the status code of an error, it's the inverse of statusError. The errors without
+// a distinct status code are StatusInternalServerError.
+func errorStatus(err error) protocol.StatusCode {
+	cause := errors.Cause(err)
+	if _, ok := cause.(*ValueTooBigError); ok {
+		return protocol.StatusValueTooBig
+	}
+	switch cause {
+	case ErrKeyNotFound:
+		return protocol.StatusKeyNotFound
+	case ErrKeyFound:
+		return protocol.StatusKeyFound
+	case ErrNoSuchLock:
+		return protocol.StatusNoSuchLock
+	case ErrValueTooBig:
+		return protocol.StatusValueTooBig
+	case ErrQuotaExceeded:
+		return protocol.StatusQuotaExceeded
+	case ErrWriteQuorum:
+		return protocol.StatusWriteQuorum
+	case ErrReadQuorum:
+		return protocol.StatusReadQuorum
+	case ErrForbidden:
+		return protocol.StatusForbidden
+	case ErrUnauthorized:
+		return protocol.StatusUnauthorized
+	case ErrNotOwner:
+		return protocol.StatusNotOwner
+	case ErrOperationTimeout, context.DeadlineExceeded:
+		return protocol.StatusTimeout
+	case ErrOverflow:
+		return protocol.StatusOverflow
+	case ErrReadOnly:
+		return protocol.StatusReadOnly
+	case ErrRateLimited:
+		return protocol.StatusRateLimited
+	case ErrQuorumLost:
+		return protocol.StatusQuorumLost
+	case errPartNotEmpty:
+		return protocol.StatusPartNotEmpty
+	case errBackupNotEmpty:
+		return protocol.StatusBackupNotEmpty
+	}
+	return protocol.StatusInternalServerError
+}
+
+// errorResponse returns an error response for err with its status code.
+func errorResponse(req *protocol.Message, err error) *protocol.Message {
+	return req.Error(errorStatus(err), err)
 }
 
 var currentUnixNano int64
@@ -19,7 +19,15 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/snapshot"
+	"github.com/buraksezer/olric/internal/storage"
+	"github.com/pkg/errors"
 )
 
 func Test_ReloadSnapshot(t *testing.T) {
@@ -81,3 +89,404 @@ func Test_ReloadSnapshot(t *testing.T) {
 		}
 	}
 }
+
+func TestOlric_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "olric-snapshot")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			t.Logf("[ERROR] Failed to remove data dir: %s: %v", dir, err)
+		}
+	}()
+
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.OperationMode = OpInMemoryWithSnapshot
+	cfg.SnapshotDir = dir
+	// Only the forced snapshot writes the DMaps to disk.
+	cfg.SnapshotInterval = time.Hour
+	db, err := startTestOlric(cfg)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.PutEx(bkey(i), bval(i), time.Hour)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err = db.Snapshot()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	l, err := db.snapshot.NewLoader(snapshot.PrimaryDMapKey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var total int
+	for {
+		sdm, err := l.Next()
+		if err == snapshot.ErrLoaderDone {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		total += sdm.Storage.Len()
+		sdm.Storage.Range(func(hkey uint64, vdata *storage.VData) bool {
+			if vdata.TTL == 0 {
+				t.Fatalf("Expected the expiry of %s in snapshot", vdata.Key)
+			}
+			return true
+		})
+	}
+	if total != 100 {
+		t.Fatalf("Expected 100 keys in snapshot. Got: %d", total)
+	}
+}
+
+func TestOlric_SnapshotTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "olric-snapshot")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			t.Logf("[ERROR] Failed to remove data dir: %s: %v", dir, err)
+		}
+	}()
+
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.OperationMode = OpInMemoryWithSnapshot
+	cfg.SnapshotDir = dir
+	cfg.SnapshotInterval = time.Hour
+	db, err := startTestOlric(cfg)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The even keys expire after the restart, the odd ones don't.
+	mname := "mymap"
+	dm := db.NewDMap(mname)
+	for i := 0; i < 100; i++ {
+		timeout := time.Hour
+		if i%2 == 0 {
+			timeout = 300 * time.Millisecond
+		}
+		err = dm.PutEx(bkey(i), bval(i), timeout)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	ttls := make(map[uint64]int64)
+	for i := 1; i < 100; i += 2 {
+		hkey := db.getHKey(mname, bkey(i))
+		d, err := db.getDMap(mname, hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		vdata, err := d.str.Get(hkey)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		ttls[hkey] = vdata.TTL
+	}
+	err = db.Snapshot()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = db.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// Let the clock pass the expiry of the even keys while the node is down.
+	<-time.After(500 * time.Millisecond)
+
+	cfg, err = newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.OperationMode = OpInMemoryWithSnapshot
+	cfg.SnapshotDir = dir
+	cfg.SnapshotInterval = time.Hour
+	db2, err := startTestOlric(cfg)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	var total int
+	for partID := uint64(0); partID < db2.config.PartitionCount; partID++ {
+		part := db2.partitions[partID]
+		tmp, ok := part.m.Load(mname)
+		if !ok {
+			continue
+		}
+		d := tmp.(*dmap)
+		total += d.str.Len()
+		d.str.Range(func(hkey uint64, vdata *storage.VData) bool {
+			ttl, ok := ttls[hkey]
+			if !ok {
+				t.Fatalf("Expected %s to be dropped on restore", vdata.Key)
+			}
+			if ttl != vdata.TTL {
+				t.Fatalf("Expected the expiry of %s: %d. Got: %d", vdata.Key, ttl, vdata.TTL)
+			}
+			return true
+		})
+	}
+	if total != len(ttls) {
+		t.Fatalf("Expected %d keys after restore. Got: %d", len(ttls), total)
+	}
+}
+
+func TestOlric_SnapshotDisabled(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	err = db.Snapshot()
+	if err != ErrSnapshotDisabled {
+		t.Fatalf("Expected ErrSnapshotDisabled. Got: %v", err)
+	}
+}
+
+func TestOlric_WALRecovery(t *testing.T) {
+	newDB := func(dir string) (*Olric, error) {
+		cfg, err := newTestConfig(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.OperationMode = OpInMemoryWithSnapshot
+		cfg.SnapshotDir = dir
+		cfg.SnapshotInterval = time.Hour
+		cfg.EnableWAL = true
+		cfg.WALSyncPolicy = WALSyncAlways
+		return startTestOlric(cfg)
+	}
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("/tmp", "olric-snapshot")
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		dirs = append(dirs, dir)
+	}
+	defer func() {
+		for _, dir := range dirs {
+			err := os.RemoveAll(dir)
+			if err != nil {
+				t.Logf("[ERROR] Failed to remove data dir: %s: %v", dir, err)
+			}
+		}
+	}()
+
+	db, err := newDB(dirs[0])
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	dm := db.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		err = dm.Delete(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// Simulate a crash: the write-ahead log is on disk but the snapshot is empty.
+	walDir := filepath.Join(dirs[1], "wal")
+	err = os.Mkdir(walDir, 0755)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dirs[0], "wal"))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dirs[0], "wal", f.Name()))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(walDir, f.Name()), data, 0644)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	err = db.Shutdown(context.Background())
+	if err != nil {
+		db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+	}
+
+	db2, err := newDB(dirs[1])
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm2 := db2.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		value, err := dm2.Get(bkey(i))
+		if i < 10 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value replayed for %d", i)
+		}
+	}
+
+	// The log is truncated after a successful snapshot.
+	err = db2.Snapshot()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	files, err = ioutil.ReadDir(walDir)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected an empty write-ahead log. Got: %d segments", len(files))
+	}
+}
+
+func TestOlric_WALRequiresSnapshot(t *testing.T) {
+	_, err := New(&Config{EnableWAL: true})
+	if err == nil {
+		t.Fatalf("Expected an error for write-ahead log without snapshot")
+	}
+}
+
+func Test_ErrorStatus(t *testing.T) {
+	errs := []error{
+		ErrKeyNotFound,
+		ErrKeyFound,
+		ErrNoSuchLock,
+		ErrValueTooBig,
+		ErrWriteQuorum,
+		ErrReadQuorum,
+		ErrQuotaExceeded,
+		ErrForbidden,
+		ErrUnauthorized,
+		ErrNotOwner,
+		ErrOperationTimeout,
+		ErrOverflow,
+		ErrReadOnly,
+		ErrRateLimited,
+		ErrQuorumLost,
+	}
+	for _, err := range errs {
+		status := errorStatus(errors.Wrap(err, "wrapped"))
+		if status == protocol.StatusInternalServerError {
+			t.Fatalf("Expected a distinct status code for %v", err)
+		}
+		resp := &protocol.Message{Header: protocol.Header{Status: status}}
+		if got := statusError(resp); got != err {
+			t.Fatalf("Expected %v for status %d. Got: %v", err, status, got)
+		}
+	}
+
+	verr := &ValueTooBigError{Size: 10, Limit: 1}
+	if status := errorStatus(verr); status != protocol.StatusValueTooBig {
+		t.Fatalf("Expected StatusValueTooBig. Got: %d", status)
+	}
+	if status := errorStatus(context.DeadlineExceeded); status != protocol.StatusTimeout {
+		t.Fatalf("Expected StatusTimeout. Got: %d", status)
+	}
+	if status := errorStatus(errors.New("foobar")); status != protocol.StatusInternalServerError {
+		t.Fatalf("Expected StatusInternalServerError. Got: %d", status)
+	}
+}
+
+func TestOlric_RequestWithoutExtra(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	ops := []protocol.OpCode{
+		protocol.OpExPutEx,
+		protocol.OpExPutIf,
+		protocol.OpExCAS,
+		protocol.OpExLockWithTimeout,
+		protocol.OpLockPrev,
+		protocol.OpTryLock,
+		protocol.OpLockLease,
+		protocol.OpLeasePrev,
+		protocol.OpIsPartEmpty,
+		protocol.OpIsBackupEmpty,
+		protocol.OpExpire,
+		protocol.OpExpireBackup,
+		protocol.OpExScan,
+		protocol.OpScan,
+		protocol.OpDump,
+		protocol.OpExQuery,
+		protocol.OpQuery,
+		protocol.OpMerkleRoot,
+		protocol.OpMerkleSubtree,
+		protocol.OpMerkleKeys,
+	}
+	for _, op := range ops {
+		req := &protocol.Message{
+			DMap:  "mymap",
+			Key:   "mykey",
+			Value: []byte("myvalue"),
+		}
+		_, err = db.requestTo(db.this.String(), op, req)
+		if errors.Cause(err) != ErrInternalServerError || !strings.Contains(err.Error(), ErrInvalidArgument.Error()) {
+			t.Fatalf("Expected ErrInvalidArgument for %s. Got: %v", op, err)
+		}
+	}
+}
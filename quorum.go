@@ -0,0 +1,174 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// quorumState keeps whether this node can reach Config.WriteQuorum nodes, and the callbacks of the changes.
+// The changes are queued like memberEvents, so slow callbacks don't stall the membership layer.
+type quorumState struct {
+	// lost is one if the quorum is lost, since is the time of the last change in nanoseconds and rejected
+	// is the number of the requests rejected with ErrQuorumLost. They're accessed atomically.
+	lost     int32
+	since    int64
+	rejected uint64
+
+	mu        sync.Mutex
+	callbacks []func(lost bool)
+	queue     []bool
+	notify    chan struct{}
+}
+
+func newQuorumState() *quorumState {
+	return &quorumState{notify: make(chan struct{}, 1)}
+}
+
+func (q *quorumState) push(lost bool) {
+	q.mu.Lock()
+	if len(q.callbacks) == 0 {
+		// Nobody listens, don't queue the change.
+		q.mu.Unlock()
+		return
+	}
+	q.queue = append(q.queue, lost)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *quorumState) pop() (bool, []func(bool), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) == 0 {
+		return false, nil, false
+	}
+	lost := q.queue[0]
+	q.queue = q.queue[1:]
+	return lost, q.callbacks, true
+}
+
+// QuorumStats contains the write quorum status of this node, see Config.QuorumLossPolicy.
+type QuorumStats struct {
+	// Lost is true if this node cannot reach Config.WriteQuorum nodes. It's always false if
+	// Config.WriteQuorum is zero or one.
+	Lost bool
+
+	// Since is the time of the last change of Lost. It's zero if the quorum has never been lost.
+	Since time.Time
+
+	// Rejected is the number of the requests rejected with ErrQuorumLost.
+	Rejected uint64
+}
+
+func (db *Olric) quorumStats() QuorumStats {
+	stats := QuorumStats{
+		Lost:     db.quorumLost(),
+		Rejected: atomic.LoadUint64(&db.quorum.rejected),
+	}
+	if since := atomic.LoadInt64(&db.quorum.since); since != 0 {
+		stats.Since = time.Unix(0, since)
+	}
+	return stats
+}
+
+// OnQuorumChange registers a callback which is called when this node loses the write quorum, with true,
+// and when it reaches the quorum again, with false. See Config.QuorumLossPolicy. The callbacks are called
+// in the order of the changes from a dedicated goroutine.
+func (db *Olric) OnQuorumChange(f func(lost bool)) {
+	db.quorum.mu.Lock()
+	defer db.quorum.mu.Unlock()
+	db.quorum.callbacks = append(db.quorum.callbacks, f)
+}
+
+// quorumLost returns true if this node cannot reach Config.WriteQuorum nodes.
+func (db *Olric) quorumLost() bool {
+	return atomic.LoadInt32(&db.quorum.lost) == 1
+}
+
+// checkQuorum compares the number of the alive nodes with Config.WriteQuorum. It's called after this node
+// joins the cluster and for every membership change.
+func (db *Olric) checkQuorum() {
+	if db.config.WriteQuorum <= 1 {
+		return
+	}
+	memCount := db.discovery.numMembers()
+	var lost int32
+	if memCount < db.config.WriteQuorum {
+		lost = 1
+	}
+	if atomic.SwapInt32(&db.quorum.lost, lost) == lost {
+		return
+	}
+	atomic.StoreInt64(&db.quorum.since, time.Now().UnixNano())
+	if lost == 1 {
+		db.log.Printf("[WARN] Write quorum is lost, %d of %d nodes are alive. Policy: %s",
+			memCount, db.config.WriteQuorum, db.config.QuorumLossPolicy)
+	} else {
+		db.log.Printf("[INFO] Write quorum is reached again, %d nodes are alive", memCount)
+	}
+	db.quorum.push(lost == 1)
+}
+
+func (db *Olric) deliverQuorumEvents() {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-db.quorum.notify:
+		}
+		for {
+			lost, callbacks, ok := db.quorum.pop()
+			if !ok {
+				break
+			}
+			for _, f := range callbacks {
+				f(lost)
+			}
+		}
+	}
+}
+
+// quorate wraps an operation of the clients. It's rejected with StatusQuorumLost while the write quorum
+// is lost.
+func (db *Olric) quorate(op protocol.Operation) protocol.Operation {
+	if db.config.WriteQuorum <= 1 {
+		return op
+	}
+	return func(req *protocol.Message) *protocol.Message {
+		if db.quorumLost() {
+			atomic.AddUint64(&db.quorum.rejected, 1)
+			return req.Error(protocol.StatusQuorumLost, ErrQuorumLost)
+		}
+		return op(req)
+	}
+}
+
+// readable wraps a read operation of the clients. The reads are served while the write quorum is lost,
+// unless the policy is QuorumLossUnavailable.
+func (db *Olric) readable(op protocol.Operation) protocol.Operation {
+	if db.config.QuorumLossPolicy != QuorumLossUnavailable {
+		return op
+	}
+	return db.quorate(op)
+}
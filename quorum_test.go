@@ -0,0 +1,226 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func newOlricWithQuorum(peers []string, policy QuorumLossPolicy) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ReplicaCount = 2
+	cfg.WriteQuorum = 2
+	cfg.QuorumLossPolicy = policy
+	return startTestOlric(cfg)
+}
+
+func TestOlric_QuorumLostReadOnly(t *testing.T) {
+	db1, err := newOlricWithQuorum(nil, "")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	if !db1.Stats().Quorum.Lost {
+		t.Fatalf("Expected the quorum to be lost in a single node cluster")
+	}
+	changes := make(chan bool, 2)
+	db1.OnQuorumChange(func(lost bool) {
+		changes <- lost
+	})
+	expectChange := func(expected bool) {
+		select {
+		case lost := <-changes:
+			if lost != expected {
+				t.Fatalf("Expected lost: %v. Got: %v", expected, lost)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No quorum change received")
+		}
+	}
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithQuorum(peers, "")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	expectChange(false)
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	err = db2.discovery.memberlist.Leave(time.Second)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	err = db2.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	expectChange(true)
+
+	req := &protocol.Message{
+		DMap:  "mymap",
+		Key:   bkey(0),
+		Value: bval(0),
+	}
+	_, err = db1.requestTo(db1.this.String(), protocol.OpExPut, req)
+	if err != ErrQuorumLost {
+		t.Fatalf("Expected ErrQuorumLost. Got: %v", err)
+	}
+
+	// The keys of this node are still served.
+	var served int
+	for i := 0; i < 100; i++ {
+		owners := db1.getPartitionOwners(db1.getHKey("mymap", bkey(i)))
+		if !hostCmp(owners[len(owners)-1], db1.this) {
+			continue
+		}
+		req := &protocol.Message{DMap: "mymap", Key: bkey(i)}
+		resp, err := db1.requestTo(db1.this.String(), protocol.OpExGet, req)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		value, err := db1.unmarshalValue("mymap", resp.Value)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value(%s) retrieved for %s", value.([]byte), bkey(i))
+		}
+		served++
+	}
+	if served == 0 {
+		t.Fatalf("Expected some keys owned by %s", db1.this)
+	}
+
+	stats := db1.Stats()
+	if !stats.Quorum.Lost {
+		t.Fatalf("Expected the quorum to be lost")
+	}
+	if stats.Quorum.Since.IsZero() {
+		t.Fatalf("Expected the time of the quorum loss")
+	}
+	if stats.Quorum.Rejected != 1 {
+		t.Fatalf("Expected 1 rejected request. Got: %d", stats.Quorum.Rejected)
+	}
+}
+
+func TestOlric_QuorumLostUnlock(t *testing.T) {
+	db, err := newOlricWithQuorum(nil, "")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	// The embedded node bypasses the quorum check.
+	lock, err := db.NewDMap("mymap").LockWithTimeout(bkey(0), time.Minute)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	req := &protocol.Message{
+		DMap:  "mymap",
+		Key:   bkey(1),
+		Extra: protocol.LockWithTimeoutExtra{TTL: time.Minute.Nanoseconds()},
+	}
+	_, err = db.requestTo(db.this.String(), protocol.OpExLockWithTimeout, req)
+	if err != ErrQuorumLost {
+		t.Fatalf("Expected ErrQuorumLost. Got: %v", err)
+	}
+
+	// The holder of a lock can still extend and release it.
+	req = &protocol.Message{
+		DMap:  "mymap",
+		Key:   bkey(0),
+		Extra: protocol.LockWithTimeoutExtra{TTL: time.Minute.Nanoseconds()},
+		Value: lock.Token(),
+	}
+	_, err = db.requestTo(db.this.String(), protocol.OpLockLease, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	req = &protocol.Message{
+		DMap:  "mymap",
+		Key:   bkey(0),
+		Value: lock.Token(),
+	}
+	_, err = db.requestTo(db.this.String(), protocol.OpExUnlock, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+func TestOlric_QuorumLostUnavailable(t *testing.T) {
+	db, err := newOlricWithQuorum(nil, QuorumLossUnavailable)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	for _, op := range []protocol.OpCode{protocol.OpExPut, protocol.OpExGet, protocol.OpExLen} {
+		req := &protocol.Message{
+			DMap:  "mymap",
+			Key:   bkey(0),
+			Value: bval(0),
+		}
+		if op == protocol.OpExLen {
+			req.Extra = protocol.LenExtra{}
+		}
+		_, err = db.requestTo(db.this.String(), op, req)
+		if err != ErrQuorumLost {
+			t.Fatalf("Expected ErrQuorumLost for %s. Got: %v", op, err)
+		}
+	}
+}
+
+func TestOlric_QuorumLossPolicy(t *testing.T) {
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.QuorumLossPolicy = "drop"
+	_, err = New(cfg)
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown quorum loss policy")
+	}
+}
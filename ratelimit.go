@@ -0,0 +1,54 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// isClientOp returns true for the operations of the clients. Their names are prefixed with "Ex", i.e.
+// ExPut or ExDestroy, the operations of the other nodes are not, i.e. PutBackup or ExpireBackup.
+func isClientOp(op protocol.OpCode) bool {
+	name := op.String()
+	return len(name) > 2 && strings.HasPrefix(name, "Ex") && unicode.IsUpper(rune(name[2]))
+}
+
+// dmapRateLimit returns the rate limit of a DMap. The limit set by SetDMapRateLimit takes precedence
+// over the configuration.
+func (db *Olric) dmapRateLimit(name string) float64 {
+	if rate, ok := db.rateLimits.Load(name); ok {
+		return rate.(float64)
+	}
+	return db.dmapConfig(name).RateLimit
+}
+
+// SetConnRateLimit changes the maximum number of requests per second of a client connection to this
+// node. The open connections get the new limit with their next requests. Zero disables the limit. See
+// Config.ConnRateLimit.
+func (db *Olric) SetConnRateLimit(rate float64) {
+	db.server.SetConnRateLimit(rate)
+}
+
+// SetDMapRateLimit changes the maximum number of requests per second of the clients to the given DMap on
+// this node. It overrides DMapConfig.RateLimit until the node is restarted, zero disables the limit.
+func (db *Olric) SetDMapRateLimit(name string, rate float64) {
+	if rate < 0 {
+		rate = 0
+	}
+	db.rateLimits.Store(name, rate)
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+func TestIsClientOp(t *testing.T) {
+	ops := map[protocol.OpCode]bool{
+		protocol.OpExPut:        true,
+		protocol.OpExDestroy:    true,
+		protocol.OpPutBackup:    false,
+		protocol.OpExpire:       false,
+		protocol.OpExpireBackup: false,
+		protocol.OpPing:         false,
+	}
+	for op, expected := range ops {
+		if isClientOp(op) != expected {
+			t.Fatalf("Expected %v for %s. Got: %v", expected, op, !expected)
+		}
+	}
+}
+
+func TestDMap_RateLimit(t *testing.T) {
+	db, err := newOlricWithDMaps(nil, map[string]DMapConfig{"limited": {RateLimit: 1}})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	addr := db.this.String()
+	value, err := db.serializer.Marshal("myvalue")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	put := func(name string) error {
+		_, err := db.requestTo(addr, protocol.OpExPut, &protocol.Message{DMap: name, Key: "mykey", Value: value})
+		return err
+	}
+	if err = put("limited"); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if err = put("limited"); err != ErrRateLimited {
+		t.Fatalf("Expected ErrRateLimited. Got: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = put("unlimited"); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	// The embedded DMaps are not limited.
+	if err = db.NewDMap("limited").Put("mykey", "myvalue"); err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The limit is removed while the node is running.
+	db.SetDMapRateLimit("limited", 0)
+	for i := 0; i < 10; i++ {
+		if err = put("limited"); err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	stats := db.Stats()
+	if n := stats.Throttled.DMaps["limited"]; n != 1 {
+		t.Fatalf("Expected 1 throttled request on limited. Got: %d", n)
+	}
+	if n := stats.Throttled.Connections; n != 0 {
+		t.Fatalf("Expected no request throttled by the connection limit. Got: %d", n)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rebalancer limits the bandwidth and the concurrency of the DMap moves, OpMoveDMap and OpBackupMoveDMap,
+// and keeps track of their progress.
+type rebalancer struct {
+	// The counters are accessed atomically, keep them 64-bit aligned.
+	movedDMaps uint64
+	movedBytes uint64
+	pending    int64
+	active     int64
+
+	// rate is in bytes per second, zero means unlimited.
+	rate int64
+	// slots is nil if the number of concurrent moves is unlimited.
+	slots chan struct{}
+
+	mu sync.Mutex
+	// next is the time when the bandwidth is available again.
+	next time.Time
+}
+
+func newRebalancer(rate, concurrency int) *rebalancer {
+	r := &rebalancer{rate: int64(rate)}
+	if concurrency > 0 {
+		r.slots = make(chan struct{}, concurrency)
+	}
+	return r
+}
+
+// acquire waits for a free slot and for the bandwidth to send size bytes. The returned function must
+// be called after the move with the number of bytes sent, zero if the move has failed.
+func (r *rebalancer) acquire(ctx context.Context, size int) (func(moved int), error) {
+	atomic.AddInt64(&r.pending, 1)
+	defer atomic.AddInt64(&r.pending, -1)
+
+	if r.slots != nil {
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func(moved int) {
+		atomic.AddInt64(&r.active, -1)
+		if moved != 0 {
+			atomic.AddUint64(&r.movedDMaps, 1)
+			atomic.AddUint64(&r.movedBytes, uint64(moved))
+		}
+		if r.slots != nil {
+			<-r.slots
+		}
+	}
+	atomic.AddInt64(&r.active, 1)
+	if err := r.wait(ctx, size); err != nil {
+		release(0)
+		return nil, err
+	}
+	return release, nil
+}
+
+// wait reserves the bandwidth for size bytes and waits until the reservation starts. The moves are
+// sent one after another at the configured rate, the first one is not delayed.
+func (r *rebalancer) wait(ctx context.Context, size int) error {
+	if r.rate == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	now := time.Now()
+	start := r.next
+	if start.Before(now) {
+		start = now
+	}
+	r.next = start.Add(time.Duration(int64(size) * int64(time.Second) / r.rate))
+	r.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *rebalancer) stats() RebalanceStats {
+	return RebalanceStats{
+		Pending:    int(atomic.LoadInt64(&r.pending)),
+		Active:     int(atomic.LoadInt64(&r.active)),
+		MovedDMaps: atomic.LoadUint64(&r.movedDMaps),
+		MovedBytes: atomic.LoadUint64(&r.movedBytes),
+	}
+}
+
+type partitionMovedEvent struct {
+	partID   uint64
+	from, to Member
+}
+
+// partitionEvents queues the partition moves and keeps the callbacks, like memberEvents. The moves
+// don't wait for the callbacks.
+type partitionEvents struct {
+	mu        sync.Mutex
+	callbacks []func(partID uint64, from, to Member)
+	queue     []partitionMovedEvent
+	notify    chan struct{}
+}
+
+func newPartitionEvents() *partitionEvents {
+	return &partitionEvents{notify: make(chan struct{}, 1)}
+}
+
+func (p *partitionEvents) push(evt partitionMovedEvent) {
+	p.mu.Lock()
+	if len(p.callbacks) == 0 {
+		// Nobody listens, don't queue the event.
+		p.mu.Unlock()
+		return
+	}
+	p.queue = append(p.queue, evt)
+	p.mu.Unlock()
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *partitionEvents) pop() (partitionMovedEvent, []func(uint64, Member, Member), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return partitionMovedEvent{}, nil, false
+	}
+	evt := p.queue[0]
+	p.queue = p.queue[1:]
+	return evt, p.callbacks, true
+}
+
+// OnPartitionMoved registers a callback which is called after this node moves a partition to its new
+// owner, i.e. the last DMap of the partition is sent with OpMoveDMap successfully. from is this node.
+// The moves of the backups are not reported. The callbacks are called in the order of the moves from
+// a dedicated goroutine, so they don't slow down the rebalancing.
+func (db *Olric) OnPartitionMoved(f func(partID uint64, from, to Member)) {
+	db.moves.mu.Lock()
+	defer db.moves.mu.Unlock()
+	db.moves.callbacks = append(db.moves.callbacks, f)
+}
+
+func (db *Olric) deliverPartitionEvents() {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.ctx.Done():
+			return
+		case <-db.moves.notify:
+		}
+		for {
+			evt, callbacks, ok := db.moves.pop()
+			if !ok {
+				break
+			}
+			for _, f := range callbacks {
+				f(evt.partID, evt.from, evt.to)
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRebalancer_Rate(t *testing.T) {
+	r := newRebalancer(10000, 0)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := r.acquire(context.Background(), 1000)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		release(1000)
+	}
+	// The first one is not delayed, the others wait 100ms for each other.
+	if elapsed := time.Since(now); elapsed < 200*time.Millisecond {
+		t.Fatalf("Expected the moves to be delayed. Elapsed: %v", elapsed)
+	}
+	stats := r.stats()
+	if stats.MovedDMaps != 3 || stats.MovedBytes != 3000 {
+		t.Fatalf("Unexpected stats: %v", stats)
+	}
+}
+
+func TestRebalancer_Concurrency(t *testing.T) {
+	r := newRebalancer(0, 1)
+	release, err := r.acquire(context.Background(), 1000)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = r.acquire(ctx, 1000)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded. Got: %v", err)
+	}
+	if stats := r.stats(); stats.Active != 1 || stats.Pending != 0 {
+		t.Fatalf("Unexpected stats: %v", stats)
+	}
+
+	release(0)
+	release, err = r.acquire(context.Background(), 1000)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	release(1000)
+	if stats := r.stats(); stats.Active != 0 || stats.MovedDMaps != 1 || stats.MovedBytes != 1000 {
+		t.Fatalf("Unexpected stats: %v", stats)
+	}
+}
+
+func TestOlric_RebalanceStats(t *testing.T) {
+	cfg, err := newTestConfig(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cfg.RebalanceRate = 1 << 20
+	cfg.RebalanceConcurrency = 1
+	db1, err := startTestOlric(cfg)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	stats := db1.Stats().Rebalance
+	if stats.MovedDMaps == 0 || stats.MovedBytes == 0 {
+		t.Fatalf("Expected some DMaps to be moved. Got: %v", stats)
+	}
+	if stats.Pending != 0 || stats.Active != 0 {
+		t.Fatalf("Expected no ongoing moves. Got: %v", stats)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = dm.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", bkey(i), err)
+		}
+	}
+}
+
+func TestOlric_OnPartitionMoved(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	moved := make(chan partitionMovedEvent, db1.config.PartitionCount)
+	db1.OnPartitionMoved(func(partID uint64, from, to Member) {
+		moved <- partitionMovedEvent{partID: partID, from: from, to: to}
+	})
+	for _, name := range []string{"mymap", "othermap"} {
+		dm := db1.NewDMap(name)
+		for i := 0; i < 100; i++ {
+			err = dm.Put(bkey(i), bval(i))
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+		}
+	}
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	seen := make(map[uint64]struct{})
+	timeout := time.After(5 * time.Second)
+	for len(seen) == 0 || len(moved) != 0 {
+		select {
+		case evt := <-moved:
+			if _, ok := seen[evt.partID]; ok {
+				t.Fatalf("Expected one event for partition %d", evt.partID)
+			}
+			seen[evt.partID] = struct{}{}
+			if evt.from.Name != db1.this.Name || evt.to.Name != db2.this.Name {
+				t.Fatalf("Expected a move from db1 to db2. Got: %v", evt)
+			}
+			if count := atomic.LoadInt32(&db1.partitions[evt.partID].count); count != 0 {
+				t.Fatalf("Expected no DMaps on partition %d of db1. Got: %d", evt.partID, count)
+			}
+		case <-timeout:
+			t.Fatalf("No partition move has been reported")
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/buraksezer/consistent"
 	"github.com/buraksezer/olric/internal/protocol"
 	"github.com/hashicorp/memberlist"
 	"github.com/vmihailenco/msgpack"
@@ -64,11 +65,96 @@ func (db *Olric) processNodeEvent(event memberlist.NodeEvent) {
 	}
 }
 
-func (db *Olric) distributeBackups(partID uint64, rt routing, backupCount int) {
-	backups, err := db.consistent.GetClosestNForPartition(int(partID), backupCount)
+// placeBackups selects count backup owners for a partition from the candidates, they're the other
+// members in the order of the hash ring. The candidates in the zones which have no replica of the
+// partition are preferred, then the ones in the racks which have no replica. It reports false if some
+// of the backups share a zone with another replica, though the owner has a zone label.
+func placeBackups(owner host, candidates []host, count int) ([]host, bool) {
+	if owner.Zone == "" && owner.Rack == "" {
+		return candidates[:count], true
+	}
+	type rack struct{ zone, rack string }
+	zones := map[string]struct{}{owner.Zone: {}}
+	racks := map[rack]struct{}{{owner.Zone, owner.Rack}: {}}
+	picked := make([]bool, len(candidates))
+	backups := make([]host, 0, count)
+	pick := func(accept func(h host) bool) {
+		for i, h := range candidates {
+			if len(backups) == count {
+				return
+			}
+			if picked[i] || !accept(h) {
+				continue
+			}
+			picked[i] = true
+			backups = append(backups, h)
+			zones[h.Zone] = struct{}{}
+			racks[rack{h.Zone, h.Rack}] = struct{}{}
+		}
+	}
+	pick(func(h host) bool {
+		_, ok := zones[h.Zone]
+		return !ok
+	})
+	distinct := len(backups) == count || owner.Zone == ""
+	pick(func(h host) bool {
+		_, ok := racks[rack{h.Zone, h.Rack}]
+		return !ok
+	})
+	pick(func(h host) bool { return true })
+	return backups, distinct
+}
+
+// partitionOwner returns the primary owner of a partition on the ring. A read-only replica never owns
+// a partition, the closest writable member to it on the ring owns the partition instead.
+func partitionOwner(ring *consistent.Consistent, partID uint64) (host, error) {
+	owner := ring.GetPartitionOwner(int(partID)).(host)
+	if !owner.ReadOnly {
+		return owner, nil
+	}
+	members, err := ring.GetClosestNForPartition(int(partID), len(ring.GetMembers())-1)
+	if err != nil {
+		return host{}, err
+	}
+	for _, member := range members {
+		if !member.(host).ReadOnly {
+			return member.(host), nil
+		}
+	}
+	return host{}, errNoWritableMember
+}
+
+// backupCandidates returns the backup owners of a partition placed by the topology labels of the members.
+func (db *Olric) backupCandidates(partID uint64, owner host, backupCount int) ([]host, bool, error) {
+	members, err := db.consistent.GetClosestNForPartition(int(partID), len(db.consistent.GetMembers())-1)
+	if err != nil {
+		return nil, false, err
+	}
+	candidates := make([]host, 0, len(members))
+	if ring := db.consistent.GetPartitionOwner(int(partID)).(host); !hostCmp(ring, owner) {
+		// The owner on the ring is a read-only replica or the partition stays on its current owner,
+		// see Config.RebalanceThreshold. It's the closest candidate.
+		candidates = append(candidates, ring)
+	}
+	for _, member := range members {
+		if !hostCmp(member.(host), owner) {
+			candidates = append(candidates, member.(host))
+		}
+	}
+	if len(candidates) < backupCount {
+		return nil, false, consistent.ErrInsufficientMemberCount
+	}
+	backups, distinct := placeBackups(owner, candidates, backupCount)
+	return backups, distinct, nil
+}
+
+// distributeBackups calculates the backup owners of the partition. It reports false if the backups
+// couldn't be placed in distinct zones.
+func (db *Olric) distributeBackups(partID uint64, owner host, rt routing, backupCount int) bool {
+	backups, distinct, err := db.backupCandidates(partID, owner, backupCount)
 	if err != nil {
 		db.log.Printf("[ERROR] Failed to calculate backups for partID: %d: %v", partID, err)
-		return
+		return true
 	}
 
 	bpart := db.backups[partID]
@@ -80,32 +166,29 @@ func (db *Olric) distributeBackups(partID uint64, rt routing, backupCount int) {
 		rt[partID] = data
 	}()
 	if len(bpart.owners) == 0 {
-		for _, backup := range backups {
-			bpart.owners = append(bpart.owners, backup.(host))
-		}
+		bpart.owners = append(bpart.owners, backups...)
 		data.Backups = bpart.owners
-		return
+		return distinct
 	}
 
 	// Here add the new partition owner.
 	for _, backup := range backups {
 		var exists bool
 		for i, bkp := range bpart.owners {
-			if hostCmp(bkp, backup.(host)) {
+			if hostCmp(bkp, backup) {
 				exists = true
 				// Remove it from the current position
 				bpart.owners = append(bpart.owners[:i], bpart.owners[i+1:]...)
 				// Append it again to head
-				bpart.owners = append(bpart.owners, backup.(host))
+				bpart.owners = append(bpart.owners, backup)
 				break
 			}
 		}
 		if !exists {
-			bpart.owners = append(bpart.owners, backup.(host))
+			bpart.owners = append(bpart.owners, backup)
 		}
 	}
 
-	// FIXME: What if tmp is empty?
 	// Prune dead nodes
 	tmp := []host{}
 	for _, backup := range bpart.owners {
@@ -120,7 +203,12 @@ func (db *Olric) distributeBackups(partID uint64, rt routing, backupCount int) {
 		}
 		tmp = append(tmp, cur)
 	}
-	// FIXME: What if tmp is empty?
+	if len(tmp) < backupCount {
+		// Some of the new backup owners have left the cluster but their NodeLeave events have not
+		// been processed yet. The routing table is calculated again after the events.
+		data.Backups = bpart.owners
+		return distinct
+	}
 
 	// Prune empty nodes
 	tbackups := []host{}
@@ -145,10 +233,10 @@ func (db *Olric) distributeBackups(partID uint64, rt routing, backupCount int) {
 	tbackups = append(tbackups, tmp[len(tmp)-backupCount:]...)
 	bpart.owners = tbackups
 	data.Backups = bpart.owners
+	return distinct
 }
 
-func (db *Olric) distributePrimaryCopies(partID uint64, rt routing) {
-	owner := db.consistent.GetPartitionOwner(int(partID))
+func (db *Olric) distributePrimaryCopies(partID uint64, owner host, rt routing) {
 	part := db.partitions[partID]
 	part.Lock()
 	defer part.Unlock()
@@ -159,24 +247,24 @@ func (db *Olric) distributePrimaryCopies(partID uint64, rt routing) {
 	}()
 
 	if len(part.owners) == 0 {
-		part.owners = append(part.owners, owner.(host))
+		part.owners = append(part.owners, owner)
 		data.Owners = part.owners
 		return
 	}
 	// Here add the new partition owner.
 	var exists bool
 	for i, own := range part.owners {
-		if hostCmp(own, owner.(host)) {
+		if hostCmp(own, owner) {
 			exists = true
 			// Remove it from the current position
 			part.owners = append(part.owners[:i], part.owners[i+1:]...)
 			// Append it again to head
-			part.owners = append(part.owners, owner.(host))
+			part.owners = append(part.owners, owner)
 			break
 		}
 	}
 	if !exists {
-		part.owners = append(part.owners, owner.(host))
+		part.owners = append(part.owners, owner)
 	}
 
 	// Prune dead nodes
@@ -193,6 +281,12 @@ func (db *Olric) distributePrimaryCopies(partID uint64, rt routing) {
 		}
 		tmp = append(tmp, cur)
 	}
+	if len(tmp) == 0 {
+		// The new owner has left the cluster but its NodeLeave event has not been processed yet.
+		// The routing table is calculated again after the event.
+		data.Owners = part.owners
+		return
+	}
 	// Prune empty nodes
 	owners := []host{}
 	for _, own := range tmp[:len(tmp)-1] {
@@ -218,16 +312,120 @@ func (db *Olric) distributePrimaryCopies(partID uint64, rt routing) {
 	data.Owners = part.owners
 }
 
+// writableMembers returns the members which can own a partition, keyed by name.
+func (db *Olric) writableMembers() map[string]host {
+	members := make(map[string]host)
+	for _, member := range db.consistent.GetMembers() {
+		if h := member.(host); !h.ReadOnly {
+			members[h.Name] = h
+		}
+	}
+	return members
+}
+
+// imbalance returns the ratio of the partitions on the most loaded member to the average minus one.
+func imbalance(owners map[uint64]host, members map[string]host) float64 {
+	if len(owners) == 0 || len(members) == 0 {
+		return 0
+	}
+	loads := make(map[string]int)
+	var max int
+	for _, owner := range owners {
+		loads[owner.Name]++
+		if loads[owner.Name] > max {
+			max = loads[owner.Name]
+		}
+	}
+	avg := float64(len(owners)) / float64(len(members))
+	return float64(max)/avg - 1
+}
+
+// imbalance returns the imbalance of the primary owners in the routing table of this node.
+func (db *Olric) imbalance() float64 {
+	owners := make(map[uint64]host)
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		part.RLock()
+		if len(part.owners) != 0 {
+			owners[partID] = part.owners[len(part.owners)-1]
+		}
+		part.RUnlock()
+	}
+	return imbalance(owners, db.writableMembers())
+}
+
+// assignOwners calculates the primary owners of the partitions. They're the owners on the hash ring,
+// unless Config.RebalanceThreshold is set and the current owners are balanced enough. The partitions
+// without a writable owner are omitted.
+func (db *Olric) assignOwners() map[uint64]host {
+	ring := make(map[uint64]host)
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		owner, err := partitionOwner(db.consistent, partID)
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to calculate the owner of partID: %d: %v", partID, err)
+			continue
+		}
+		ring[partID] = owner
+	}
+	if db.config.RebalanceThreshold == 0 {
+		return ring
+	}
+
+	// Keep the partitions on their current owners if they're still alive.
+	members := db.writableMembers()
+	current := make(map[uint64]host, len(ring))
+	var kept int
+	for partID, owner := range ring {
+		part := db.partitions[partID]
+		part.RLock()
+		if len(part.owners) != 0 {
+			prev := part.owners[len(part.owners)-1]
+			if member, ok := members[prev.Name]; ok && hostCmp(member, prev) && !hostCmp(prev, owner) {
+				owner = member
+				kept++
+			}
+		}
+		part.RUnlock()
+		current[partID] = owner
+	}
+	if kept == 0 {
+		return ring
+	}
+	ratio := imbalance(current, members)
+	if ratio > db.config.RebalanceThreshold {
+		db.log.Printf("[INFO] Imbalance: %.2f exceeds the threshold, %d partitions are moved to their owners on the hash ring",
+			ratio, kept)
+		return ring
+	}
+	db.log.Printf("[DEBUG] Imbalance: %.2f is below the threshold, %d partitions are kept on their current owners",
+		ratio, kept)
+	return current
+}
+
 func (db *Olric) distributePartitions() routing {
+	prev := db.currentRouting()
+	defer db.bumpRoutingVersion(prev)
+
 	rt := make(routing)
 	memCount := len(db.consistent.GetMembers())
 	backupCount := calcMaxBackupCount(db.config.BackupCount, memCount)
+	var shared int
+	owners := db.assignOwners()
 	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
-		db.distributePrimaryCopies(partID, rt)
+		owner, ok := owners[partID]
+		if !ok {
+			continue
+		}
+		db.distributePrimaryCopies(partID, owner, rt)
 		if db.config.BackupCount != 0 && backupCount != 0 {
-			db.distributeBackups(partID, rt, backupCount)
+			if !db.distributeBackups(partID, owner, rt, backupCount) {
+				shared++
+			}
 		}
 	}
+	if shared != 0 {
+		db.log.Printf("[WARN] Not enough zones to place the backups: %d partitions have replicas in the same zone", shared)
+	}
 	return rt
 }
 
@@ -277,6 +475,10 @@ func (db *Olric) listenMemberlistEvents(eventCh chan memberlist.NodeEvent) {
 		case evt := <-eventCh:
 			db.processNodeEvent(evt)
 			db.updateRouting()
+			if evt.Event == memberlist.NodeJoin {
+				db.wg.Add(1)
+				go db.replayHints(evt.Node.Name)
+			}
 		}
 	}
 }
@@ -298,11 +500,16 @@ func (db *Olric) updateRoutingPeriodically() {
 }
 
 func (db *Olric) updateRoutingOperation(req *protocol.Message) *protocol.Message {
+	if len(req.Value) == 0 {
+		// The clients send an empty routing table to fetch the current one.
+		return db.routingTableOperation(req)
+	}
 	rt := make(routing)
 	err := msgpack.Unmarshal(req.Value, &rt)
 	if err != nil {
-		return req.Error(protocol.StatusInternalServerError, err)
+		return errorResponse(req, err)
 	}
+	prev := db.currentRouting()
 	for partID, data := range rt {
 		// Set partition(primary copies) owners
 		part := db.partitions[partID]
@@ -316,6 +523,7 @@ func (db *Olric) updateRoutingOperation(req *protocol.Message) *protocol.Message
 		bpart.owners = data.Backups
 		bpart.Unlock()
 	}
+	db.bumpRoutingVersion(prev)
 
 	// Bootstrapped by the coordinator.
 	db.bcancel()
@@ -327,9 +535,71 @@ func (db *Olric) updateRoutingOperation(req *protocol.Message) *protocol.Message
 	return req.Success()
 }
 
+// redirect wraps an operation of the keys. The requests with FlagRedirect which are received by a node
+// other than the owner of the key get a StatusMoved response, the others are forwarded to the owner.
+func (db *Olric) redirect(op protocol.Operation) protocol.Operation {
+	return func(req *protocol.Message) *protocol.Message {
+		if req.Flags&protocol.FlagRedirect == 0 {
+			return op(req)
+		}
+		hkey := db.getHKey(req.DMap, req.Key)
+		part := db.getPartition(hkey)
+		part.RLock()
+		if len(part.owners) == 0 {
+			// The node is not bootstrapped yet, the operation waits for it.
+			part.RUnlock()
+			return op(req)
+		}
+		owner := part.owners[len(part.owners)-1]
+		part.RUnlock()
+		if hostCmp(owner, db.this) {
+			return op(req)
+		}
+		resp := req.Error(protocol.StatusMoved, owner.String())
+		resp.Extra = protocol.MovedExtra{PartID: part.id}
+		return resp
+	}
+}
+
+// writable wraps a write operation of the clients. A read-only replica rejects it with StatusReadOnly,
+// the other nodes reject it with StatusQuorumLost while the write quorum is lost. The DMap methods of the
+// embedded node don't pass through it.
+func (db *Olric) writable(op protocol.Operation) protocol.Operation {
+	if !db.config.ReadOnly {
+		return db.quorate(op)
+	}
+	return func(req *protocol.Message) *protocol.Message {
+		return req.Error(protocol.StatusReadOnly, ErrReadOnly)
+	}
+}
+
+// routingTableOperation returns the addresses of the partition owners, indexed by the partition IDs.
+// The address of a partition without an owner is empty.
+func (db *Olric) routingTableOperation(req *protocol.Message) *protocol.Message {
+	owners := make([]string, db.config.PartitionCount)
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		part := db.partitions[partID]
+		part.RLock()
+		if len(part.owners) != 0 {
+			owners[partID] = part.owners[len(part.owners)-1].String()
+		}
+		part.RUnlock()
+	}
+	value, err := msgpack.Marshal(owners)
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = value
+	return resp
+}
+
 func (db *Olric) isPartEmptyOperation(req *protocol.Message) *protocol.Message {
-	partID := req.Extra.(protocol.IsPartEmptyExtra).PartID
-	part := db.partitions[partID]
+	extra, ok := req.Extra.(protocol.IsPartEmptyExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	part := db.partitions[extra.PartID]
 	if atomic.LoadInt32(&part.count) == 0 {
 		return req.Success()
 	}
@@ -337,8 +607,11 @@ func (db *Olric) isPartEmptyOperation(req *protocol.Message) *protocol.Message {
 }
 
 func (db *Olric) isBackupEmptyOperation(req *protocol.Message) *protocol.Message {
-	partID := req.Extra.(protocol.IsPartEmptyExtra).PartID
-	part := db.backups[partID]
+	extra, ok := req.Extra.(protocol.IsPartEmptyExtra)
+	if !ok {
+		return errorResponse(req, ErrInvalidArgument)
+	}
+	part := db.backups[extra.PartID]
 
 	if atomic.LoadInt32(&part.count) == 0 {
 		return req.Success()
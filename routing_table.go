@@ -0,0 +1,149 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+var errNotCoordinator = errors.New("not the cluster coordinator")
+
+// PartitionRoute is the ownership of a partition in the routing table.
+type PartitionRoute struct {
+	PartitionID uint64
+
+	// Owners are the owners of the partition, the last one is the primary owner. The others are
+	// the previous owners which still keep some of its DMaps.
+	Owners []Member
+
+	// Backups are the backup owners of the partition, the previous ones included.
+	Backups []Member
+}
+
+// RoutingTable is a snapshot of the routing table of a node.
+type RoutingTable struct {
+	// Version is the value of RoutingVersion when the snapshot was taken.
+	Version uint64
+
+	// Partitions is indexed by the partition IDs.
+	Partitions []PartitionRoute
+}
+
+// currentRouting returns a copy of the partition owners and the backup owners on this node.
+func (db *Olric) currentRouting() routing {
+	rt := make(routing, db.config.PartitionCount)
+	for partID := uint64(0); partID < db.config.PartitionCount; partID++ {
+		var r route
+		part := db.partitions[partID]
+		part.RLock()
+		r.Owners = append(r.Owners, part.owners...)
+		part.RUnlock()
+
+		bpart := db.backups[partID]
+		bpart.RLock()
+		r.Backups = append(r.Backups, bpart.owners...)
+		bpart.RUnlock()
+		rt[partID] = r
+	}
+	return rt
+}
+
+func hostsEqual(a, b []host) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !hostCmp(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// bumpRoutingVersion increments the routing version if the ownership of a partition has changed since
+// the given copy of the routing table.
+func (db *Olric) bumpRoutingVersion(prev routing) {
+	for partID, r := range db.currentRouting() {
+		p := prev[partID]
+		if !hostsEqual(p.Owners, r.Owners) || !hostsEqual(p.Backups, r.Backups) {
+			atomic.AddUint64(&db.routingVersion, 1)
+			return
+		}
+	}
+}
+
+// RoutingVersion returns the version of the routing table of this node. It's incremented every time the
+// ownership of a partition changes, so a different version means that the table has been updated. The
+// versions of the nodes are independent from each other.
+func (db *Olric) RoutingVersion() uint64 {
+	return atomic.LoadUint64(&db.routingVersion)
+}
+
+// RoutingTable returns a snapshot of the routing table of this node with its version. It's a debugging
+// helper, the table is also served as JSON on /debug/routing by the metrics server.
+func (db *Olric) RoutingTable() RoutingTable {
+	// Load the version first, a concurrent update may only make the table newer than it.
+	rt := RoutingTable{
+		Version:    db.RoutingVersion(),
+		Partitions: make([]PartitionRoute, db.config.PartitionCount),
+	}
+	for partID, r := range db.currentRouting() {
+		pr := PartitionRoute{PartitionID: partID}
+		for _, owner := range r.Owners {
+			pr.Owners = append(pr.Owners, newMember(owner))
+		}
+		for _, backup := range r.Backups {
+			pr.Backups = append(pr.Backups, newMember(backup))
+		}
+		rt.Partitions[partID] = pr
+	}
+	return rt
+}
+
+// RefreshRouting makes the coordinator of the cluster calculate the routing table and push it to the
+// members now, instead of waiting for a membership change or the periodic update. It blocks until the
+// table is pushed and the coordinator has checked the ownership of its DMaps.
+func (db *Olric) RefreshRouting() error {
+	if db.discovery.isCoordinator() {
+		db.updateRouting()
+		return nil
+	}
+	_, err := db.requestTo(db.discovery.getCoordinator().String(), protocol.OpRefreshRouting, &protocol.Message{})
+	return err
+}
+
+func (db *Olric) refreshRoutingOperation(req *protocol.Message) *protocol.Message {
+	if !db.discovery.isCoordinator() {
+		// The coordinator has changed in the meantime.
+		return errorResponse(req, errNotCoordinator)
+	}
+	db.updateRouting()
+	return req.Success()
+}
+
+// serveRoutingTable dumps the routing table of this node as JSON.
+func (db *Olric) serveRoutingTable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(db.RoutingTable()); err != nil {
+		db.log.Printf("[ERROR] Failed to write routing table: %v", err)
+	}
+}
@@ -0,0 +1,459 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestOlric_Redirect(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	var key string
+	var owner host
+	for i := 0; ; i++ {
+		key = bkey(i)
+		owner, _, err = db1.locateKey("mymap", key)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if hostCmp(owner, db2.this) {
+			break
+		}
+	}
+
+	value, err := db1.serializer.Marshal("value")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	req := &protocol.Message{DMap: "mymap", Key: key, Value: value}
+	req.Flags |= protocol.FlagRedirect
+	resp, err := db1.client.RequestTo(db1.this.String(), protocol.OpExPut, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusMoved {
+		t.Fatalf("Expected StatusMoved. Got: %d", resp.Status)
+	}
+	if string(resp.Value) != owner.String() {
+		t.Fatalf("Expected owner %s. Got: %s", owner, string(resp.Value))
+	}
+	extra, ok := resp.Extra.(protocol.MovedExtra)
+	if !ok {
+		t.Fatalf("Expected MovedExtra. Got: %T", resp.Extra)
+	}
+	if extra.PartID != db1.getPartitionID(db1.getHKey("mymap", key)) {
+		t.Fatalf("Expected PartID %d. Got: %d", db1.getPartitionID(db1.getHKey("mymap", key)), extra.PartID)
+	}
+	if _, err = db1.NewDMap("mymap").Get(key); err != ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound. Got: %v", err)
+	}
+
+	// The owner processes the request.
+	resp, err = db1.client.RequestTo(owner.String(), protocol.OpExPut, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("Expected StatusOK. Got: %d", resp.Status)
+	}
+
+	// The requests without FlagRedirect are forwarded.
+	req = &protocol.Message{DMap: "mymap", Key: key}
+	resp, err = db1.client.RequestTo(db1.this.String(), protocol.OpExGet, req)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if resp.Status != protocol.StatusOK {
+		t.Fatalf("Expected StatusOK. Got: %d", resp.Status)
+	}
+}
+
+func TestOlric_RoutingTable(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	resp, err := db.client.RequestTo(db.this.String(), protocol.OpUpdateRouting, &protocol.Message{})
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	var owners []string
+	err = msgpack.Unmarshal(resp.Value, &owners)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if uint64(len(owners)) != db.config.PartitionCount {
+		t.Fatalf("Expected %d owners. Got: %d", db.config.PartitionCount, len(owners))
+	}
+	for partID, owner := range owners {
+		if owner != db.this.String() {
+			t.Fatalf("Expected owner of %d: %s. Got: %s", partID, db.this, owner)
+		}
+	}
+}
+
+func TestOlric_RoutingVersion(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	if db1.RoutingVersion() == 0 {
+		t.Fatalf("Expected a routing version after the bootstrap")
+	}
+	v1 := db1.RoutingVersion()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	// The second node asks the coordinator to push the table.
+	err = db2.RefreshRouting()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if db1.RoutingVersion() == v1 {
+		t.Fatalf("Expected a new routing version after the ownership change")
+	}
+	if db2.RoutingVersion() == 0 {
+		t.Fatalf("Expected a routing version on the second node")
+	}
+
+	// Let the previous owners be pruned, then the table is stable.
+	err = db2.RefreshRouting()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	v1, v2 := db1.RoutingVersion(), db2.RoutingVersion()
+	err = db2.RefreshRouting()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if db1.RoutingVersion() != v1 || db2.RoutingVersion() != v2 {
+		t.Fatalf("Expected the same routing versions without an ownership change")
+	}
+
+	rt := db2.RoutingTable()
+	if rt.Version != v2 {
+		t.Fatalf("Expected version: %d. Got: %d", v2, rt.Version)
+	}
+	if uint64(len(rt.Partitions)) != db2.config.PartitionCount {
+		t.Fatalf("Expected %d partitions. Got: %d", db2.config.PartitionCount, len(rt.Partitions))
+	}
+	coordinator := db1.RoutingTable()
+	for partID, pr := range rt.Partitions {
+		owners := coordinator.Partitions[partID].Owners
+		if len(pr.Owners) == 0 || pr.Owners[len(pr.Owners)-1] != owners[len(owners)-1] {
+			t.Fatalf("Expected owners of %d: %v. Got: %v", partID, owners, pr.Owners)
+		}
+		if len(pr.Backups) != 1 {
+			t.Fatalf("Expected one backup owner of %d. Got: %v", partID, pr.Backups)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	db1.serveRoutingTable(rec, httptest.NewRequest("GET", "/debug/routing", nil))
+	var dump RoutingTable
+	err = json.Unmarshal(rec.Body.Bytes(), &dump)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if dump.Version != db1.RoutingVersion() || len(dump.Partitions) != len(rt.Partitions) {
+		t.Fatalf("Expected the routing table of version %d. Got: %v", db1.RoutingVersion(), dump)
+	}
+}
+
+func Test_PlaceBackups(t *testing.T) {
+	node := func(name, zone, rack string) host {
+		return host{Name: name, NodeMetadata: NodeMetadata{Zone: zone, Rack: rack}}
+	}
+	names := func(hosts []host) string {
+		var s []string
+		for _, h := range hosts {
+			s = append(s, h.Name)
+		}
+		return strings.Join(s, ",")
+	}
+	candidates := []host{
+		node("n1", "a", "r1"),
+		node("n2", "a", "r2"),
+		node("n3", "b", "r1"),
+		node("n4", "c", "r1"),
+	}
+	tests := []struct {
+		owner    host
+		count    int
+		backups  string
+		distinct bool
+	}{
+		// Without labels, the closest members in the ring are selected.
+		{node("n0", "", ""), 2, "n1,n2", true},
+		{node("n0", "a", "r1"), 2, "n3,n4", true},
+		{node("n0", "b", "r1"), 1, "n1", true},
+		// There are only three zones, the last backup goes to another rack of the owner's zone.
+		{node("n0", "a", "r1"), 3, "n3,n4,n2", false},
+		{node("n0", "", "r1"), 1, "n1", true},
+	}
+	for i, tc := range tests {
+		backups, distinct := placeBackups(tc.owner, candidates, tc.count)
+		if names(backups) != tc.backups || distinct != tc.distinct {
+			t.Fatalf("Case %d: expected %s, %t. Got: %s, %t", i, tc.backups, tc.distinct, names(backups), distinct)
+		}
+	}
+}
+
+func TestOlric_ZoneAwareBackups(t *testing.T) {
+	var dbs []*Olric
+	defer func() {
+		for _, db := range dbs {
+			err := db.Shutdown(context.Background())
+			if err != nil {
+				db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+			}
+		}
+	}()
+	var peers []string
+	for _, zone := range []string{"zone-a", "zone-a", "zone-b"} {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		cfg.Zone = zone
+		db, err := startTestOlric(cfg)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		dbs = append(dbs, db)
+		peers = []string{dbs[0].discovery.localNode().Address()}
+	}
+	dbs[0].updateRouting()
+
+	for partID := uint64(0); partID < dbs[0].config.PartitionCount; partID++ {
+		owners := dbs[0].partitions[partID].owners
+		backups := dbs[0].backups[partID].owners
+		owner, backup := owners[len(owners)-1], backups[len(backups)-1]
+		if owner.Zone == "zone-a" && backup.Zone != "zone-b" {
+			t.Fatalf("Expected the backup of PartID: %d in zone-b. Got: %s", partID, backup.Zone)
+		}
+		if owner.Zone == "zone-b" && backup.Zone != "zone-a" {
+			t.Fatalf("Expected the backup of PartID: %d in zone-a. Got: %s", partID, backup.Zone)
+		}
+	}
+}
+
+func TestOlric_ReadOnlyReplica(t *testing.T) {
+	var dbs []*Olric
+	defer func() {
+		for _, db := range dbs {
+			err := db.Shutdown(context.Background())
+			if err != nil {
+				db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+			}
+		}
+	}()
+	var peers []string
+	for _, readOnly := range []bool{false, true} {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		cfg.ReadOnly = readOnly
+		db, err := startTestOlric(cfg)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		dbs = append(dbs, db)
+		peers = []string{dbs[0].discovery.localNode().Address()}
+	}
+	dbs[0].updateRouting()
+
+	for partID := uint64(0); partID < dbs[0].config.PartitionCount; partID++ {
+		owners := dbs[0].partitions[partID].owners
+		if owner := owners[len(owners)-1]; owner.ReadOnly {
+			t.Fatalf("Expected a writable owner for PartID: %d. Got: %s", partID, owner)
+		}
+		backups := dbs[0].backups[partID].owners
+		if backup := backups[len(backups)-1]; !hostCmp(backup, dbs[1].this) {
+			t.Fatalf("Expected the read-only replica as the backup of PartID: %d. Got: %s", partID, backup)
+		}
+	}
+
+	dm := dbs[0].NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		err := dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	replica := dbs[1].NewDMap("mymap")
+	for i := 0; i < 10; i++ {
+		value, err := replica.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value(%s) retrieved for %s", value.([]byte), bkey(i))
+		}
+	}
+
+	req := &protocol.Message{
+		DMap:  "mymap",
+		Key:   bkey(0),
+		Value: bval(0),
+	}
+	_, err := dbs[0].requestTo(dbs[1].this.String(), protocol.OpExPut, req)
+	if err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly. Got: %v", err)
+	}
+}
+
+func TestOlric_RebalanceThreshold(t *testing.T) {
+	newOlricWithThreshold := func(peers []string) (*Olric, error) {
+		cfg, err := newTestConfig(peers, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RebalanceThreshold = 2
+		return startTestOlric(cfg)
+	}
+	db1, err := newOlricWithThreshold(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithThreshold(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	// The first node owns twice the average, it's below the threshold.
+	for partID := uint64(0); partID < db1.config.PartitionCount; partID++ {
+		part := db1.partitions[partID]
+		part.RLock()
+		owner := part.owners[len(part.owners)-1]
+		part.RUnlock()
+		if !hostCmp(owner, db1.this) {
+			t.Fatalf("Expected the partition to stay on its owner: %d. Got: %s", partID, owner)
+		}
+	}
+	if imb := db1.Stats().Rebalance.Imbalance; imb != 1 {
+		t.Fatalf("Expected imbalance: 1. Got: %v", imb)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = db2.NewDMap("mymap").Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	// The partitions follow the hash ring when the imbalance exceeds the threshold.
+	db1.config.RebalanceThreshold = 0.5
+	db1.updateRouting()
+	for partID := uint64(0); partID < db1.config.PartitionCount; partID++ {
+		ring, err := partitionOwner(db1.consistent, partID)
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		part := db1.partitions[partID]
+		part.RLock()
+		owner := part.owners[len(part.owners)-1]
+		part.RUnlock()
+		if !hostCmp(owner, ring) {
+			t.Fatalf("Expected the owner on the hash ring for PartID: %d. Got: %s", partID, owner)
+		}
+	}
+	if imb := db1.Stats().Rebalance.Imbalance; imb >= 1 {
+		t.Fatalf("Expected a lower imbalance. Got: %v", imb)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = db2.NewDMap("mymap").Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+}
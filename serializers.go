@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"fmt"
 	"reflect"
 
 	"github.com/vmihailenco/msgpack"
@@ -81,3 +82,33 @@ func (m msgpackSerializer) Unmarshal(data []byte, v interface{}) error {
 func NewMsgpackSerializer() Serializer {
 	return Serializer(msgpackSerializer{})
 }
+
+// rawSerializer passes the byte slices through without encoding them.
+type rawSerializer struct{}
+
+func (r rawSerializer) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("mismatched type: %T, raw values must be byte slices", v)
+	}
+	return b, nil
+}
+
+func (r rawSerializer) Unmarshal(data []byte, v interface{}) error {
+	switch p := v.(type) {
+	case *interface{}:
+		*p = data
+	case *[]byte:
+		*p = data
+	default:
+		return fmt.Errorf("mismatched type: %T, raw values can only be decoded to byte slices", v)
+	}
+	return nil
+}
+
+// NewRawSerializer returns a serializer which stores byte slices as they are and returns them without
+// a decode step. It's used by the DMaps with DMapConfig.RawValues. The clients which manage their own
+// formats can use it to read and write the raw DMaps.
+func NewRawSerializer() Serializer {
+	return Serializer(rawSerializer{})
+}
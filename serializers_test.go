@@ -0,0 +1,168 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestSerializers(t *testing.T) {
+	serializers := map[string]Serializer{
+		"gob":     NewGobSerializer(),
+		"json":    NewJSONSerializer(),
+		"msgpack": NewMsgpackSerializer(),
+	}
+	for name, s := range serializers {
+		t.Run(name, func(t *testing.T) {
+			data, err := s.Marshal("value")
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			var value interface{}
+			err = s.Unmarshal(data, &value)
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			if value.(string) != "value" {
+				t.Fatalf("Expected value. Got: %v", value)
+			}
+		})
+	}
+}
+
+func TestDMap_PutGetWithSerializer(t *testing.T) {
+	serializers := map[string]Serializer{
+		"json":    NewJSONSerializer(),
+		"msgpack": NewMsgpackSerializer(),
+	}
+	for name, s := range serializers {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := newTestConfig(nil, nil)
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			cfg.Serializer = s
+			db, err := startTestOlric(cfg)
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			defer func() {
+				err = db.Shutdown(context.Background())
+				if err != nil {
+					db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+				}
+			}()
+
+			dm := db.NewDMap("mymap")
+			err = dm.Put("mykey", map[string]interface{}{"name": "olric"})
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			value, err := dm.Get("mykey")
+			if err != nil {
+				t.Fatalf("Expected nil. Got: %v", err)
+			}
+			var got string
+			switch v := value.(type) {
+			case map[string]interface{}:
+				got, _ = v["name"].(string)
+			case map[interface{}]interface{}:
+				got, _ = v["name"].(string)
+			}
+			if got != "olric" {
+				t.Fatalf("Expected olric. Got: %v", value)
+			}
+		})
+	}
+}
+
+func TestDMap_RawValues(t *testing.T) {
+	dmaps := map[string]DMapConfig{
+		"raw": {RawValues: true},
+	}
+	db1, err := newOlricWithDMaps(nil, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithDMaps(peers, dmaps)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm1, dm2 := db1.NewDMap("raw"), db2.NewDMap("raw")
+	for i := 0; i < 10; i++ {
+		err = dm1.Put(bkey(i), []byte(bkey(i)))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		value, err := dm2.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), []byte(bkey(i))) {
+			t.Fatalf("Expected %s. Got: %v", bkey(i), value)
+		}
+		// The stored bytes are not encoded.
+		rawval, err := db2.get("raw", bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(rawval, []byte(bkey(i))) {
+			t.Fatalf("Expected %s to be stored as it is. Got: %v", bkey(i), rawval)
+		}
+	}
+
+	err = dm1.Put("mykey", "string")
+	if err == nil {
+		t.Fatalf("Expected an error for a non-byte slice value")
+	}
+	_, err = dm1.Incr("counter", 1)
+	if err == nil {
+		t.Fatalf("Expected an error for Incr on a raw DMap")
+	}
+
+	// The other DMaps still use the serializer.
+	dm := db1.NewDMap("mymap")
+	err = dm.Put("mykey", "string")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	value, err := dm.Get("mykey")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if value.(string) != "string" {
+		t.Fatalf("Expected string. Got: %v", value)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/vmihailenco/msgpack"
+)
+
+// SlowLogEntry is an operation which took longer than the slow log threshold on this node.
+type SlowLogEntry struct {
+	// Time is the time when the operation ended.
+	Time time.Time
+
+	// Op is the name of the operation in Olric Binary Protocol.
+	Op string
+
+	// DMap is the name of the DMap, if the operation has one.
+	DMap string
+
+	// HKey is the hash of the key, if the operation has one.
+	HKey uint64
+
+	// Size is the size of the request in bytes.
+	Size int
+
+	// Latency is the time spent by the operation and writing its response.
+	Latency time.Duration
+}
+
+// slowLog keeps the last slow operations in a ring buffer.
+type slowLog struct {
+	// threshold is accessed atomically, keep it 64-bit aligned.
+	threshold int64
+
+	mu      sync.Mutex
+	entries []SlowLogEntry
+	next    int
+	full    bool
+}
+
+func newSlowLog(threshold time.Duration, size int) *slowLog {
+	return &slowLog{
+		threshold: int64(threshold),
+		entries:   make([]SlowLogEntry, size),
+	}
+}
+
+func (s *slowLog) isSlow(latency time.Duration) bool {
+	threshold := atomic.LoadInt64(&s.threshold)
+	return threshold > 0 && int64(latency) >= threshold
+}
+
+func (s *slowLog) add(entry SlowLogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) == 0 {
+		return
+	}
+	s.entries[s.next] = entry
+	s.next = (s.next + 1) % len(s.entries)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// list returns the entries, the newest one first.
+func (s *slowLog) list() []SlowLogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.next
+	if s.full {
+		count = len(s.entries)
+	}
+	entries := make([]SlowLogEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		entries = append(entries, s.entries[(s.next-i+len(s.entries))%len(s.entries)])
+	}
+	return entries
+}
+
+// resize changes the size of the ring buffer, the newest entries are kept.
+func (s *slowLog) resize(size int) {
+	entries := s.list()
+	if len(entries) > size {
+		entries = entries[:size]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = make([]SlowLogEntry, size)
+	s.next, s.full = 0, false
+	for i := len(entries) - 1; i >= 0; i-- {
+		s.entries[s.next] = entries[i]
+		s.next = (s.next + 1) % size
+		if s.next == 0 {
+			s.full = true
+		}
+	}
+}
+
+// SlowLog returns the last operations which took longer than the slow log threshold, the newest one first.
+func (db *Olric) SlowLog() []SlowLogEntry {
+	return db.slowlog.list()
+}
+
+// SetSlowLogThreshold changes the slow log threshold. Zero disables the slow log.
+func (db *Olric) SetSlowLogThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&db.slowlog.threshold, int64(threshold))
+}
+
+// SetSlowLogSize changes the maximum number of entries in the slow log. The newest entries are kept.
+func (db *Olric) SetSlowLogSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	db.slowlog.resize(size)
+}
+
+// observeRequest is called by the TCP server after every request.
+func (db *Olric) observeRequest(req, resp *protocol.Message, elapsed time.Duration) {
+	db.requests.observe(req, resp, elapsed)
+	if !db.slowlog.isSlow(elapsed) {
+		return
+	}
+	entry := SlowLogEntry{
+		Time:    time.Now(),
+		Op:      req.Op.String(),
+		DMap:    req.DMap,
+		Size:    req.Size(),
+		Latency: elapsed,
+	}
+	if req.Key != "" {
+		entry.HKey = db.getHKey(req.DMap, req.Key)
+	}
+	db.slowlog.add(entry)
+}
+
+func (db *Olric) slowLogOperation(req *protocol.Message) *protocol.Message {
+	value, err := msgpack.Marshal(db.SlowLog())
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = value
+	return resp
+}
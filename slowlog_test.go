@@ -0,0 +1,118 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	s := newSlowLog(time.Millisecond, 3)
+	if s.isSlow(time.Microsecond) || !s.isSlow(time.Millisecond) {
+		t.Fatalf("Unexpected result for the threshold: %v", time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		s.add(SlowLogEntry{HKey: uint64(i)})
+	}
+	expected := []uint64{4, 3, 2}
+	entries := s.list()
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries. Got: %d", len(expected), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.HKey != expected[i] {
+			t.Fatalf("Expected HKey: %d. Got: %d", expected[i], entry.HKey)
+		}
+	}
+
+	s.resize(2)
+	entries = s.list()
+	if len(entries) != 2 || entries[0].HKey != 4 || entries[1].HKey != 3 {
+		t.Fatalf("Expected the newest entries after resize. Got: %v", entries)
+	}
+	s.resize(4)
+	s.add(SlowLogEntry{HKey: 5})
+	entries = s.list()
+	if len(entries) != 3 || entries[0].HKey != 5 {
+		t.Fatalf("Expected 3 entries, the newest one first. Got: %v", entries)
+	}
+
+	s.resize(0)
+	s.add(SlowLogEntry{HKey: 6})
+	if len(s.list()) != 0 {
+		t.Fatalf("Expected an empty slow log")
+	}
+}
+
+func TestOlric_SlowLog(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	mname := "mymap"
+	dm := db1.NewDMap(mname)
+	err = dm.Put(bkey(0), bval(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	if len(db2.SlowLog()) != 0 {
+		t.Fatalf("Expected an empty slow log. Got: %v", db2.SlowLog())
+	}
+
+	db2.SetSlowLogThreshold(time.Nanosecond)
+	db2.SetSlowLogSize(10)
+	// Every Put reaches the second node: ExPut if it's the primary owner, PutBackup otherwise.
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	entries := db2.SlowLog()
+	if len(entries) != 10 {
+		t.Fatalf("Expected 10 entries. Got: %d", len(entries))
+	}
+	last := entries[0]
+	if last.Op != "ExPut" && last.Op != "PutBackup" {
+		t.Fatalf("Unexpected operation: %s", last.Op)
+	}
+	if last.DMap != mname || last.Latency <= 0 || last.Size == 0 {
+		t.Fatalf("Unexpected slow log entry: %v", last)
+	}
+	if last.HKey != db2.getHKey(mname, bkey(99)) {
+		t.Fatalf("Expected the last entry for key: %s", bkey(99))
+	}
+}
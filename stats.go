@@ -0,0 +1,287 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Stats contains the statistics of this node.
+type Stats struct {
+	// Evictions is the number of keys evicted by the eviction policies of the DMaps.
+	Evictions uint64
+
+	// ReadRepairs is the number of stale replicas repaired by the quorum reads.
+	ReadRepairs uint64
+
+	// PendingHints is the number of writes waiting for their backup owners to join the cluster again.
+	PendingHints int
+
+	// AntiEntropy contains the anti-entropy statistics of the partitions owned by this node, keyed
+	// by partition ID. The partitions which have never been synced with their backups are omitted.
+	AntiEntropy map[uint64]AntiEntropyStats
+
+	// Partitions contains the statistics of the partitions on this node, keyed by partition ID.
+	// The partitions without any DMap are omitted.
+	Partitions map[uint64]PartitionStats
+
+	// DMaps contains the statistics of the DMaps on this node, summed over the partitions.
+	DMaps map[string]DMapStats
+
+	// Rebalance contains the progress of the DMaps moved by this node to their new owners.
+	Rebalance RebalanceStats
+
+	// BytesReceived and BytesSent are the number of bytes of the requests served by this node
+	// and their responses.
+	BytesReceived uint64
+	BytesSent     uint64
+
+	// Operations contains the statistics of the requests served by this node, keyed by operation
+	// name, i.e. Put or ExGet. The operations which have never been requested are omitted.
+	Operations map[string]OperationStats
+
+	// Connections contains the traffic of the open connections to this node.
+	Connections []ConnectionStats
+
+	// OpenConnections is the number of open connections to this node, PeakConnections is the highest
+	// number of them since this node has started. RejectedConnections is the number of the connections
+	// rejected because of Config.MaxConnections.
+	OpenConnections     int
+	PeakConnections     int
+	RejectedConnections uint64
+
+	// DroppedConnections is the number of the connections closed because their outbound queues were
+	// full, DroppedResponses is the number of the responses discarded with them. See Config.BackpressurePolicy.
+	DroppedConnections uint64
+	DroppedResponses   uint64
+
+	// Throttled contains the number of the requests rejected by the rate limits of this node.
+	Throttled ThrottleStats
+
+	// Quorum contains the write quorum status of this node, see Config.QuorumLossPolicy.
+	Quorum QuorumStats
+
+	// BufferPool contains the statistics of the buffers used to read and write the messages. The pool
+	// is shared by the nodes running in the same process. See Config.BufferPoolMaxSize.
+	BufferPool BufferPoolStats
+}
+
+// BufferPoolStats contains the statistics of the buffer pool.
+type BufferPoolStats struct {
+	// Hits is the number of buffers reused from the pool.
+	Hits uint64
+
+	// Misses is the number of buffers allocated because the pool was empty.
+	Misses uint64
+
+	// Dropped is the number of buffers released instead of being reused because they were bigger
+	// than Config.BufferPoolMaxSize.
+	Dropped uint64
+}
+
+// ThrottleStats contains the number of the requests rejected with ErrRateLimited.
+type ThrottleStats struct {
+	// Connections is the number of the requests rejected by Config.ConnRateLimit.
+	Connections uint64
+
+	// DMaps is the number of the requests rejected by DMapConfig.RateLimit, keyed by DMap name. The DMaps
+	// which have never been throttled are omitted.
+	DMaps map[string]uint64
+}
+
+// OperationStats contains the statistics of the requests of an operation.
+type OperationStats struct {
+	// Requests is the number of requests served.
+	Requests uint64
+
+	// BytesReceived is the total size of the requests, BytesSent is the total size of the responses.
+	BytesReceived uint64
+	BytesSent     uint64
+}
+
+// ConnectionStats contains the traffic of a connection.
+type ConnectionStats struct {
+	// RemoteAddr is the address of the client or the node on the other end.
+	RemoteAddr string
+
+	// ConnectedAt is the time when the connection is accepted.
+	ConnectedAt time.Time
+
+	// BytesReceived and BytesSent are the number of bytes of the messages received from and sent to
+	// the connection, including the rejected requests.
+	BytesReceived uint64
+	BytesSent     uint64
+}
+
+// RebalanceStats contains the progress of the DMap moves, see Config.RebalanceRate and
+// Config.RebalanceConcurrency.
+type RebalanceStats struct {
+	// Pending is the number of DMaps waiting for a free slot or for the bandwidth to be moved.
+	Pending int
+
+	// Active is the number of DMaps being moved.
+	Active int
+
+	// MovedDMaps is the number of DMaps moved since this node has started.
+	MovedDMaps uint64
+
+	// MovedBytes is the total number of bytes sent to move the DMaps.
+	MovedBytes uint64
+
+	// Imbalance is the ratio of the partitions on the most loaded member to the average minus one, in the
+	// routing table of this node. See Config.RebalanceThreshold.
+	Imbalance float64
+}
+
+// AntiEntropyStats contains the anti-entropy statistics of a partition.
+type AntiEntropyStats struct {
+	// LastSync is the time of the last sync which compared the partition with all of its backups.
+	LastSync time.Time
+
+	// BytesTransferred is the total number of bytes exchanged with the backups to compare and repair them.
+	BytesTransferred uint64
+}
+
+// PartitionStats contains the statistics of a partition.
+type PartitionStats struct {
+	// Length is the number of keys on the partition.
+	Length int
+
+	// Inuse is the number of bytes used by the keys and values on the partition.
+	Inuse int
+
+	// BackupLag is the number of writes on the partition which are not applied on its backup owners yet.
+	BackupLag int
+
+	// DMaps contains the statistics of the DMaps on the partition, keyed by DMap name.
+	DMaps map[string]DMapStats
+}
+
+// DMapStats contains the statistics of a DMap.
+type DMapStats struct {
+	// Length is the number of keys in the DMap, including the expired ones which are not evicted yet.
+	Length int
+
+	// Inuse is the number of bytes used by the keys and values in the DMap.
+	Inuse int
+
+	// Hits is the number of reads which found the key.
+	Hits uint64
+
+	// Misses is the number of reads which didn't find the key.
+	Misses uint64
+
+	// Evictions is the number of keys evicted by the eviction policy of the DMap.
+	Evictions uint64
+}
+
+func (s *DMapStats) add(other DMapStats) {
+	s.Length += other.Length
+	s.Inuse += other.Inuse
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.Evictions += other.Evictions
+}
+
+// Stats returns the statistics of this node. It doesn't lock the DMaps, it's cheap enough to poll
+// every few seconds.
+func (db *Olric) Stats() Stats {
+	lag := db.hints.perPartition(db.config.PartitionCount)
+	stats := Stats{
+		Evictions:     atomic.LoadUint64(&db.evictions),
+		ReadRepairs:   atomic.LoadUint64(&db.readRepairs),
+		PendingHints:  db.hints.len(),
+		AntiEntropy:   make(map[uint64]AntiEntropyStats),
+		Partitions:    make(map[uint64]PartitionStats),
+		DMaps:         make(map[string]DMapStats),
+		Rebalance:     db.rebalancer.stats(),
+		BytesReceived: atomic.LoadUint64(&db.requests.received),
+		BytesSent:     atomic.LoadUint64(&db.requests.sent),
+		Operations:    make(map[string]OperationStats),
+	}
+	for _, op := range db.requests.ops() {
+		stats.Operations[op.String()] = OperationStats{
+			Requests:      atomic.LoadUint64(&db.requests.requests[op]),
+			BytesReceived: atomic.LoadUint64(&db.requests.opReceived[op]),
+			BytesSent:     atomic.LoadUint64(&db.requests.opSent[op]),
+		}
+	}
+	stats.Rebalance.Imbalance = db.imbalance()
+	stats.DroppedConnections, stats.DroppedResponses = db.server.Dropped()
+	stats.OpenConnections = db.server.ConnCount()
+	stats.PeakConnections = db.server.PeakConnCount()
+	stats.RejectedConnections = db.server.RejectedConns()
+	stats.Throttled.Connections, stats.Throttled.DMaps = db.server.Throttled()
+	stats.Quorum = db.quorumStats()
+	bs := protocol.BufferPoolStats()
+	stats.BufferPool = BufferPoolStats{Hits: bs.Hits, Misses: bs.Misses, Dropped: bs.Dropped}
+	for _, cs := range db.server.ConnStats() {
+		stats.Connections = append(stats.Connections, ConnectionStats{
+			RemoteAddr:    cs.RemoteAddr,
+			ConnectedAt:   cs.Since,
+			BytesReceived: cs.BytesRead,
+			BytesSent:     cs.BytesWritten,
+		})
+	}
+	for partID, part := range db.partitions {
+		if lastSync := atomic.LoadInt64(&part.lastSync); lastSync != 0 {
+			stats.AntiEntropy[partID] = AntiEntropyStats{
+				LastSync:         time.Unix(0, lastSync),
+				BytesTransferred: atomic.LoadUint64(&part.syncedBytes),
+			}
+		}
+		if atomic.LoadInt32(&part.count) == 0 {
+			continue
+		}
+		pstats := PartitionStats{
+			BackupLag: lag[partID],
+			DMaps:     make(map[string]DMapStats),
+		}
+		part.m.Range(func(name, tmp interface{}) bool {
+			dm := tmp.(*dmap)
+			dstats := DMapStats{
+				Length:    dm.str.Len(),
+				Inuse:     dm.str.Inuse(),
+				Hits:      atomic.LoadUint64(&dm.hits),
+				Misses:    atomic.LoadUint64(&dm.misses),
+				Evictions: atomic.LoadUint64(&dm.evictions),
+			}
+			pstats.Length += dstats.Length
+			pstats.Inuse += dstats.Inuse
+			pstats.DMaps[name.(string)] = dstats
+
+			total := stats.DMaps[name.(string)]
+			total.add(dstats)
+			stats.DMaps[name.(string)] = total
+			return true
+		})
+		stats.Partitions[partID] = pstats
+	}
+	return stats
+}
+
+func (db *Olric) statsOperation(req *protocol.Message) *protocol.Message {
+	value, err := msgpack.Marshal(db.Stats())
+	if err != nil {
+		return errorResponse(req, err)
+	}
+	resp := req.Success()
+	resp.Value = value
+	return resp
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOlric_Stats(t *testing.T) {
+	db, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	mname := "mymap"
+	dm := db.NewDMap(mname)
+	for i := 0; i < 10; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 15; i++ {
+		_, err = dm.Get(bkey(i))
+		if err != nil && err != ErrKeyNotFound {
+			t.Fatalf("Expected nil or ErrKeyNotFound. Got: %v", err)
+		}
+	}
+	hkey := db.getHKey(mname, bkey(0))
+	db.addHint(host{Name: "node"}, mname, hkey, bkey(0))
+
+	stats := db.Stats()
+	dstats := stats.DMaps[mname]
+	if dstats.Length != 10 {
+		t.Fatalf("Expected 10 keys. Got: %d", dstats.Length)
+	}
+	if dstats.Hits != 10 || dstats.Misses != 5 {
+		t.Fatalf("Expected 10 hits and 5 misses. Got: %d, %d", dstats.Hits, dstats.Misses)
+	}
+	if dstats.Inuse == 0 {
+		t.Fatalf("Expected a non-zero inuse")
+	}
+	var length, inuse, lag int
+	for _, pstats := range stats.Partitions {
+		length += pstats.Length
+		inuse += pstats.Inuse
+		lag += pstats.BackupLag
+	}
+	if length != dstats.Length || inuse != dstats.Inuse {
+		t.Fatalf("Expected the partitions to sum up to the DMap stats")
+	}
+	if lag != 1 || stats.Partitions[db.getPartitionID(hkey)].BackupLag != 1 {
+		t.Fatalf("Expected a backup lag of 1 on PartID: %d", db.getPartitionID(hkey))
+	}
+}
+
+func TestOlric_StatsBandwidth(t *testing.T) {
+	db1, err := newOlric(nil)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlric(peers)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	dm := db1.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+
+	stats := db2.Stats()
+	ostats, ok := stats.Operations["ExPut"]
+	if !ok || ostats.Requests == 0 {
+		t.Fatalf("Expected ExPut requests on the second node")
+	}
+	if ostats.BytesReceived == 0 || ostats.BytesSent == 0 {
+		t.Fatalf("Expected non-zero byte counters. Got: %d, %d", ostats.BytesReceived, ostats.BytesSent)
+	}
+	var received, sent uint64
+	for _, o := range stats.Operations {
+		received += o.BytesReceived
+		sent += o.BytesSent
+	}
+	if received != stats.BytesReceived || sent != stats.BytesSent {
+		t.Fatalf("Expected the operations to sum up to the totals")
+	}
+	if len(stats.Connections) == 0 {
+		t.Fatalf("Expected open connections on the second node")
+	}
+	received, sent = 0, 0
+	for _, c := range stats.Connections {
+		received += c.BytesReceived
+		sent += c.BytesSent
+	}
+	if received < stats.BytesReceived || sent < stats.BytesSent {
+		t.Fatalf("Expected the connections to cover the requests. Got: %d/%d, %d/%d",
+			received, stats.BytesReceived, sent, stats.BytesSent)
+	}
+	if stats.BufferPool.Hits == 0 {
+		t.Fatalf("Expected the message buffers to be reused")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newTLSConfigs returns the TLS configurations of the TCP server and the connections to the other
+// nodes. They're nil, if TLS is disabled.
+func newTLSConfigs(c *Config) (*tls.Config, *tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   c.ClientAuth,
+	}
+	client := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificate found in CA file: %s", c.CAFile)
+		}
+		server.ClientCAs = pool
+		client.RootCAs = pool
+	}
+	return server, client, nil
+}
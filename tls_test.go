@@ -0,0 +1,223 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric/internal/protocol"
+	"github.com/buraksezer/olric/internal/transport"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+}
+
+// newTestCertificates creates a CA and a certificate for 127.0.0.1 signed by it in dir. It returns
+// the paths of the CA, the certificate and the key files.
+func newTestCertificates(t *testing.T, dir string) (string, string, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "olric-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "olric-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writePEM(t, caFile, "CERTIFICATE", caDER)
+	writePEM(t, certFile, "CERTIFICATE", certDER)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return caFile, certFile, keyFile
+}
+
+func newOlricWithTLS(peers []string, caFile, certFile, keyFile, plaintextAddr string) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CAFile = caFile
+	cfg.CertFile = certFile
+	cfg.KeyFile = keyFile
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.PlaintextAddr = plaintextAddr
+	return startTestOlric(cfg)
+}
+
+func TestTLS_Cluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "olric-tls")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, certFile, keyFile := newTestCertificates(t, dir)
+
+	db1, err := newOlricWithTLS(nil, caFile, certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithTLS(peers, caFile, certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	// The keys owned by db2 and the backups are sent over TLS.
+	dm1, dm2 := db1.NewDMap("mymap"), db2.NewDMap("mymap")
+	for i := 0; i < 100; i++ {
+		err = dm1.Put(bkey(i), bval(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		value, err := dm2.Get(bkey(i))
+		if err != nil {
+			t.Fatalf("Expected nil. Got: %v", err)
+		}
+		if !bytes.Equal(value.([]byte), bval(i)) {
+			t.Fatalf("Different value returned for %s", bkey(i))
+		}
+	}
+
+	// A plaintext client cannot talk to a TLS listener.
+	c := transport.NewClient(&transport.ClientConfig{DialTimeout: time.Second, MaxConn: 1})
+	defer c.Close()
+	_, err = c.RequestTo(db1.this.String(), protocol.OpExGet, &protocol.Message{DMap: "mymap", Key: bkey(0)})
+	if err == nil {
+		t.Fatalf("Expected an error for a plaintext client")
+	}
+}
+
+func TestTLS_PlaintextAddr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "olric-tls")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, certFile, keyFile := newTestCertificates(t, dir)
+
+	plaintextAddr, err := getRandomAddr()
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	db, err := newOlricWithTLS(nil, caFile, certFile, keyFile, plaintextAddr)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db.Shutdown(context.Background())
+		if err != nil {
+			db.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	err = db.NewDMap("mymap").Put("mykey", "myvalue")
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// The same request is served on both listeners.
+	_, clientTLS, err := newTLSConfigs(db.config)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	tc := transport.NewClient(&transport.ClientConfig{DialTimeout: time.Second, MaxConn: 1, TLSConfig: clientTLS})
+	defer tc.Close()
+	pc := transport.NewClient(&transport.ClientConfig{DialTimeout: time.Second, MaxConn: 1})
+	defer pc.Close()
+	for addr, c := range map[string]*transport.Client{db.this.String(): tc, plaintextAddr: pc} {
+		var resp *protocol.Message
+		// The plaintext listener is started in the background.
+		for i := 0; i < 10; i++ {
+			resp, err = c.RequestTo(addr, protocol.OpExGet, &protocol.Message{DMap: "mymap", Key: "mykey"})
+			if err == nil {
+				break
+			}
+			<-time.After(50 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("Expected nil for %s. Got: %v", addr, err)
+		}
+		if resp.Status != protocol.StatusOK {
+			t.Fatalf("Expected StatusOK for %s. Got: %d", addr, resp.Status)
+		}
+	}
+}
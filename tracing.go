@@ -0,0 +1,126 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"github.com/buraksezer/olric/internal/protocol"
+)
+
+// TraceContext identifies a span in a distributed trace. It's propagated to the other nodes with the
+// requests. The fields are the same with the traceparent header of W3C Trace Context.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   uint8
+}
+
+// SpanKind is the role of a node in a request.
+type SpanKind int
+
+const (
+	// SpanKindServer is the kind of the spans of the received requests.
+	SpanKindServer SpanKind = iota
+
+	// SpanKindClient is the kind of the spans of the requests sent to the other nodes.
+	SpanKindClient
+)
+
+// SpanAttributes describes the request of a span.
+type SpanAttributes struct {
+	Kind SpanKind
+
+	// Op is the name of the operation in Olric Binary Protocol, i.e. ExPut or PutBackup.
+	Op string
+
+	// DMap is the name of the DMap, if the operation has one.
+	DMap string
+
+	// PartID is the partition of the key. It's only valid if HasPartID is true, the operations
+	// like Destroy don't work on a single partition.
+	PartID    uint64
+	HasPartID bool
+
+	// Node is the address of the node which handles the request. It's the target node of the
+	// spans with SpanKindClient.
+	Node string
+}
+
+// Tracer is the interface to plug a tracing library, i.e. an adapter for OpenTelemetry. Olric doesn't
+// depend on a tracing library, the requests are not traced if Config.Tracer is nil.
+type Tracer interface {
+	// StartSpan starts a new span. parent is the trace context propagated by the caller, it's nil
+	// if the request is not a part of a trace.
+	StartSpan(parent *TraceContext, attrs SpanAttributes) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// Context returns the trace context of the span. It's propagated with the requests sent
+	// while the span is active, so the spans of the other nodes are its children.
+	Context() TraceContext
+
+	// End ends the span. err is the error returned by the operation, nil if it succeeded.
+	End(err error)
+}
+
+func (db *Olric) spanAttributes(kind SpanKind, req *protocol.Message, node string) SpanAttributes {
+	attrs := SpanAttributes{
+		Kind: kind,
+		Op:   req.Op.String(),
+		DMap: req.DMap,
+		Node: node,
+	}
+	switch extra := req.Extra.(type) {
+	case protocol.ScanExtra:
+		attrs.PartID, attrs.HasPartID = extra.PartID, true
+	case protocol.QueryExtra:
+		attrs.PartID, attrs.HasPartID = extra.PartID, true
+	case protocol.IsPartEmptyExtra:
+		attrs.PartID, attrs.HasPartID = extra.PartID, true
+	case protocol.MerkleExtra:
+		attrs.PartID, attrs.HasPartID = extra.PartID, true
+	default:
+		if req.Key != "" {
+			attrs.PartID, attrs.HasPartID = db.getPartitionID(db.getHKey(req.DMap, req.Key)), true
+		}
+	}
+	return attrs
+}
+
+// traceRequest starts a span for a request received by the TCP server. The operation sees the trace
+// context of the span in req.Trace, it's propagated to the other nodes with the requests it sends.
+func (db *Olric) traceRequest(req *protocol.Message) func(*protocol.Message) {
+	attrs := db.spanAttributes(SpanKindServer, req, db.config.Name)
+	span := db.config.Tracer.StartSpan((*TraceContext)(req.Trace), attrs)
+	tc := protocol.TraceContext(span.Context())
+	req.Trace = &tc
+	return func(resp *protocol.Message) {
+		span.End(statusError(resp))
+	}
+}
+
+// traceOutgoing starts a span for a request sent to addr, as a child of req.Trace.
+func (db *Olric) traceOutgoing(addr string, req *protocol.Message) func(*protocol.Message, error) {
+	attrs := db.spanAttributes(SpanKindClient, req, addr)
+	span := db.config.Tracer.StartSpan((*TraceContext)(req.Trace), attrs)
+	tc := protocol.TraceContext(span.Context())
+	req.Trace = &tc
+	return func(resp *protocol.Message, err error) {
+		if err == nil {
+			err = statusError(resp)
+		}
+		span.End(err)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package olric
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+type testSpan struct {
+	tracer *testTracer
+	parent *TraceContext
+	attrs  SpanAttributes
+	ctx    TraceContext
+	ended  bool
+	err    error
+}
+
+func (s *testSpan) Context() TraceContext {
+	return s.ctx
+}
+
+func (s *testSpan) End(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.ended, s.err = true, err
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(parent *TraceContext, attrs SpanAttributes) Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &testSpan{tracer: t, attrs: attrs}
+	if parent != nil {
+		p := *parent
+		s.parent = &p
+		s.ctx.TraceID = parent.TraceID
+	} else {
+		binary.BigEndian.PutUint64(s.ctx.TraceID[:], uint64(len(t.spans)+1))
+	}
+	binary.BigEndian.PutUint64(s.ctx.SpanID[:], uint64(len(t.spans)+1))
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// find returns the span of the given operation which is a child of parent.
+func (t *testTracer) find(kind SpanKind, op string, parent *TraceContext) *testSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.spans {
+		if s.attrs.Kind != kind || s.attrs.Op != op {
+			continue
+		}
+		if parent == nil && s.parent == nil || parent != nil && s.parent != nil && *s.parent == *parent {
+			return s
+		}
+	}
+	return nil
+}
+
+func newOlricWithTracer(peers []string, tracer Tracer) (*Olric, error) {
+	cfg, err := newTestConfig(peers, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Tracer = tracer
+	return startTestOlric(cfg)
+}
+
+func TestOlric_Tracing(t *testing.T) {
+	tracer := &testTracer{}
+	db1, err := newOlricWithTracer(nil, tracer)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db1.Shutdown(context.Background())
+		if err != nil {
+			db1.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	peers := []string{db1.discovery.localNode().Address()}
+	db2, err := newOlricWithTracer(peers, tracer)
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+	defer func() {
+		err = db2.Shutdown(context.Background())
+		if err != nil {
+			db2.log.Printf("[ERROR] Failed to shutdown Olric: %v", err)
+		}
+	}()
+	db1.updateRouting()
+
+	// Find a key which is owned by the second node.
+	mname := "mymap"
+	var key string
+	for i := 0; ; i++ {
+		owners := db1.getPartitionOwners(db1.getHKey(mname, bkey(i)))
+		if hostCmp(owners[len(owners)-1], db2.this) {
+			key = bkey(i)
+			break
+		}
+	}
+	err = db1.NewDMap(mname).Put(key, bval(0))
+	if err != nil {
+		t.Fatalf("Expected nil. Got: %v", err)
+	}
+
+	// db1 forwards the request to db2, db2 sends the backup to db1.
+	forward := tracer.find(SpanKindClient, "ExPut", nil)
+	if forward == nil {
+		t.Fatalf("Expected a span for the forwarded request")
+	}
+	if forward.attrs.Node != db2.this.String() {
+		t.Fatalf("Expected target node: %s. Got: %s", db2.this, forward.attrs.Node)
+	}
+	ctx := forward.Context()
+	put := tracer.find(SpanKindServer, "ExPut", &ctx)
+	if put == nil {
+		t.Fatalf("Expected a server span linked to the forwarded request")
+	}
+	partID := db2.getPartitionID(db2.getHKey(mname, key))
+	if !put.attrs.HasPartID || put.attrs.PartID != partID || put.attrs.DMap != mname {
+		t.Fatalf("Unexpected attributes: %v", put.attrs)
+	}
+	ctx = put.Context()
+	backup := tracer.find(SpanKindClient, "PutBackup", &ctx)
+	if backup == nil {
+		t.Fatalf("Expected a span for the backup")
+	}
+	if backup.attrs.Node != db1.this.String() {
+		t.Fatalf("Expected target node: %s. Got: %s", db1.this, backup.attrs.Node)
+	}
+	ctx = backup.Context()
+	if tracer.find(SpanKindServer, "PutBackup", &ctx) == nil {
+		t.Fatalf("Expected a server span linked to the backup")
+	}
+	if ctx.TraceID != forward.Context().TraceID {
+		t.Fatalf("Expected the spans in the same trace")
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	for _, s := range tracer.spans {
+		// The server spans end after the response is written, check only the client spans.
+		if s.attrs.Kind == SpanKindClient && !s.ended {
+			t.Fatalf("Expected the span to be ended: %v", s.attrs)
+		}
+		if s.err != nil {
+			t.Fatalf("Expected nil. Got: %v", s.err)
+		}
+	}
+}